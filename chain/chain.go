@@ -0,0 +1,145 @@
+package chain
+
+import (
+	"errors"
+	"math"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+var (
+	// ErrBroken indicates that a link doesn't follow the one before it.
+	ErrBroken = errors.New("[chain] The link doesn't follow the previous one")
+	// ErrDuplicateEpoch indicates that a link is for an epoch already in
+	// the chain, but differs from the link of that epoch.
+	ErrDuplicateEpoch = errors.New("[chain] Another link for the epoch is already in the chain")
+	// ErrTruncated indicates that a link claimed to be the head of
+	// a chain is older than the head of the chain already seen.
+	ErrTruncated = errors.New("[chain] The chain is a truncation of the one already seen")
+	// ErrEmpty indicates that there are no links to verify.
+	ErrEmpty = errors.New("[chain] The chain has no links")
+)
+
+// A Link is an entry of a hash chain: the STR of Epoch, which commits to
+// the epoch PrevEpoch and the hash PrevHash of the STR before it, and
+// whose own hash, which the next STR commits to, is Hash.
+type Link struct {
+	Epoch     uint64
+	PrevEpoch uint64
+	PrevHash  hashed.Hash
+	Hash      hashed.Hash
+}
+
+// Follows returns true iff next is the link of the epoch after that of
+// prev, and commits to prev.
+func Follows(prev, next Link) bool {
+	return prev.Epoch != math.MaxUint64 &&
+		next.Epoch == prev.Epoch+1 &&
+		next.PrevEpoch == prev.Epoch &&
+		next.PrevHash == prev.Hash
+}
+
+// Verify checks that links, in the order of their epochs, form a hash
+// chain. It returns ErrEmpty if there are no links, ErrDuplicateEpoch if
+// two consecutive links are for the same epoch, and ErrBroken if a link
+// doesn't follow the one before it otherwise.
+func Verify(links []Link) error {
+	if len(links) == 0 {
+		return ErrEmpty
+	}
+	for i := 1; i < len(links); i++ {
+		if err := check(links[i-1], links[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns nil if next follows prev, and the error of Verify
+// otherwise.
+func check(prev, next Link) error {
+	switch {
+	case Follows(prev, next):
+		return nil
+	case next.Epoch == prev.Epoch:
+		return ErrDuplicateEpoch
+	default:
+		return ErrBroken
+	}
+}
+
+// A Chain is an append-only hash chain, which holds a link for every
+// epoch from that of its first link, e.g. a pinned initial STR, to that
+// of its head. It's not safe for concurrent use.
+type Chain struct {
+	links []Link
+}
+
+// New returns a Chain that starts with first.
+func New(first Link) *Chain {
+	return &Chain{links: []Link{first}}
+}
+
+// Append appends l to c. Appending the head of c again does nothing.
+// Otherwise, l must follow the head, or Append returns the error of
+// Verify and leaves c unchanged.
+func (c *Chain) Append(l Link) error {
+	head := c.Head()
+	if l == head {
+		return nil
+	}
+	if err := check(head, l); err != nil {
+		return err
+	}
+	c.links = append(c.links, l)
+	return nil
+}
+
+// Len returns the number of links in c.
+func (c *Chain) Len() int {
+	return len(c.links)
+}
+
+// First returns the first link of c.
+func (c *Chain) First() Link {
+	return c.links[0]
+}
+
+// Head returns the latest link of c.
+func (c *Chain) Head() Link {
+	return c.links[len(c.links)-1]
+}
+
+// At returns the link of epoch, and false if c has none.
+func (c *Chain) At(epoch uint64) (Link, bool) {
+	first := c.links[0].Epoch
+	if epoch < first || epoch-first >= uint64(len(c.links)) {
+		return Link{}, false
+	}
+	return c.links[epoch-first], true
+}
+
+// Check checks head, which a source, e.g. the directory or an auditor,
+// claims is the latest link of the chain, against c. It returns
+// ErrDuplicateEpoch if c has another link for the epoch of head, which
+// proves that the chain has forked, ErrTruncated if head is an older
+// link of c, i.e. the source presents a chain that was cut short, and
+// nil if head is the head of c or newer. A newer head still has to be
+// linked to c, e.g. by appending the links in between.
+func (c *Chain) Check(head Link) error {
+	if head.Epoch > c.Head().Epoch {
+		return nil
+	}
+	l, ok := c.At(head.Epoch)
+	switch {
+	case !ok:
+		// older than the start of c, so c can't tell
+		return ErrTruncated
+	case l != head:
+		return ErrDuplicateEpoch
+	case head.Epoch < c.Head().Epoch:
+		return ErrTruncated
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+package chain
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// links returns a valid chain of n links, starting at epoch from.
+func links(from uint64, n int) []Link {
+	ls := make([]Link, n)
+	prev := Link{Epoch: from - 1, Hash: hashed.Sum([]byte("genesis"))}
+	for i := range ls {
+		ls[i] = next(prev)
+		prev = ls[i]
+	}
+	if from == 0 {
+		// an initial STR commits to a random hash, and to epoch 0
+		ls[0].PrevEpoch = 0
+	}
+	return ls
+}
+
+// next returns the link after prev.
+func next(prev Link) Link {
+	l := Link{Epoch: prev.Epoch + 1, PrevEpoch: prev.Epoch, PrevHash: prev.Hash}
+	l.Hash = hashed.Sum(conv.ULongToBytes(l.Epoch), l.PrevHash[:])
+	return l
+}
+
+func TestFollows(t *testing.T) {
+	ls := links(0, 3)
+	if !Follows(ls[0], ls[1]) || !Follows(ls[1], ls[2]) {
+		t.Fatal("Expect consecutive links to follow each other")
+	}
+	forged := ls[1]
+	forged.PrevHash[0] ^= 1
+	skipped := ls[2]
+	skipped.PrevEpoch = 0
+	last := Link{Epoch: math.MaxUint64}
+	wrapped := next(last) // epoch 0
+	for _, tc := range []struct {
+		name       string
+		prev, next Link
+	}{
+		{"reversed", ls[1], ls[0]},
+		{"same", ls[1], ls[1]},
+		{"gap", ls[0], ls[2]},
+		{"other hash", ls[0], forged},
+		{"other previous epoch", ls[1], skipped},
+		// nothing precedes epoch 0, not even the last epoch
+		{"overflow", last, wrapped},
+	} {
+		if Follows(tc.prev, tc.next) {
+			t.Errorf("%s: expect the links not to follow each other", tc.name)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ls := links(0, 4)
+	forked := ls[2]
+	forked.Hash[0] ^= 1
+	for _, tc := range []struct {
+		name  string
+		links []Link
+		want  error
+	}{
+		{"chain", ls, nil},
+		{"initial STR", ls[:1], nil},
+		{"later start", ls[2:], nil},
+		{"empty", nil, ErrEmpty},
+		{"duplicate", []Link{ls[0], ls[1], ls[1], ls[2]}, ErrDuplicateEpoch},
+		{"fork", []Link{ls[0], ls[1], ls[2], forked}, ErrDuplicateEpoch},
+		{"gap", []Link{ls[0], ls[2]}, ErrBroken},
+		{"reordered", []Link{ls[0], ls[2], ls[1]}, ErrBroken},
+		{"forked link", []Link{ls[0], ls[1], forked, ls[3]}, ErrBroken},
+	} {
+		if err := Verify(tc.links); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestChainAppend(t *testing.T) {
+	ls := links(0, 4)
+	c := New(ls[0])
+	if c.Len() != 1 || c.First() != ls[0] || c.Head() != ls[0] {
+		t.Fatal("Expect a chain of the initial link")
+	}
+	if err := c.Append(ls[0]); err != nil || c.Len() != 1 {
+		t.Fatal("Expect appending the head again to do nothing, got", err)
+	}
+	for _, l := range ls[1:3] {
+		if err := c.Append(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	forked := ls[2]
+	forked.Hash[0] ^= 1
+	for _, tc := range []struct {
+		name string
+		l    Link
+		want error
+	}{
+		{"fork", forked, ErrDuplicateEpoch},
+		{"older", ls[1], ErrBroken},
+		{"gap", next(ls[3]), ErrBroken},
+	} {
+		if err := c.Append(tc.l); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	if c.Len() != 3 || c.Head() != ls[2] {
+		t.Fatal("Expect failed appends to leave the chain unchanged")
+	}
+
+	if err := c.Append(ls[3]); err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range ls {
+		if got, ok := c.At(uint64(i)); !ok || got != l {
+			t.Errorf("Expect the link of epoch %d", i)
+		}
+	}
+	if _, ok := c.At(4); ok {
+		t.Error("Expect no link after the head")
+	}
+}
+
+func TestChainCheck(t *testing.T) {
+	ls := links(5, 4) // epochs 5 to 8
+	c := New(ls[0])
+	for _, l := range ls[1:3] {
+		if err := c.Append(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forked := ls[1]
+	forked.Hash[0] ^= 1
+	for _, tc := range []struct {
+		name string
+		head Link
+		want error
+	}{
+		{"head", ls[2], nil},
+		{"newer", ls[3], nil},
+		{"truncated", ls[1], ErrTruncated},
+		{"first", ls[0], ErrTruncated},
+		{"before the first", Link{Epoch: 4}, ErrTruncated},
+		{"fork", forked, ErrDuplicateEpoch},
+	} {
+		if err := c.Check(tc.head); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	if _, ok := c.At(4); ok {
+		t.Error("Expect no link before the first")
+	}
+}
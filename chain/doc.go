@@ -0,0 +1,9 @@
+/*
+Package chain implements the hash chains that link the signed tree
+roots (STRs) of a CONIKS directory: the STR of every epoch commits to the
+epoch and hash of the STR before it, so that the directory can't rewrite
+its history without breaking the chain. A Link is what an STR
+contributes to its chain, and a Chain is an append-only history of
+links, such as an auditor keeps of each directory it audits.
+*/
+package chain
@@ -0,0 +1,74 @@
+// Command coniksadmin runs operational tasks on a directory server
+// through its admin socket (see protocol/admin), e.g. coniksdev
+// -admin-socket:
+//
+//	coniksadmin -socket PATH check [-samples N] [-timeout D]
+//
+// check runs the server's integrity checks: a storage fsck of the trees
+// it retains, the re-verification of its STR chain, the audit of the
+// temporary bindings it issued in the current epoch, and the
+// verification of a sample of proofs. It writes the JSON
+// directory.CheckReport to standard output, and exits non-zero if any
+// of the checks failed, so it can be run on a schedule.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ORBAT/cloniks/protocol/admin"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "coniksadmin:", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage: coniksadmin -socket PATH check [flags]")
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("coniksadmin", flag.ContinueOnError)
+	socket := fs.String("socket", "", "path of the server's admin socket")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *socket == "" {
+		return errUsage
+	}
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+
+	sub := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	switch cmd {
+	case "check":
+		samples := sub.Int("samples", admin.DefaultSamples, "number of names whose proofs are verified")
+		timeout := sub.Duration("timeout", 10*time.Minute, "how long the checks may take")
+		if err := sub.Parse(args); err != nil {
+			return err
+		}
+		return check(&admin.Client{Socket: *socket}, *samples, *timeout, out)
+	default:
+		return errUsage
+	}
+}
+
+func check(c *admin.Client, samples int, timeout time.Duration, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	report, err := c.Check(ctx, samples)
+	if report != nil {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol/admin"
+)
+
+func TestRun(t *testing.T) {
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), crypto.NewStaticTestSigningKey(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Register("alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := admin.Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	go func() { _ = (&admin.Server{Tree: d, Mu: &mu}).Serve(ctx, l) }()
+
+	if err := run([]string{"check"}, nil); err != errUsage {
+		t.Error("Expect", errUsage, "got", err)
+	}
+
+	var out bytes.Buffer
+	if err := run([]string{"-socket", socket, "check", "-samples", "5"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var report directory.CheckReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Epoch != 1 || !report.OK() {
+		t.Errorf("Unexpected report %s", out.String())
+	}
+
+	mu.Lock()
+	d.LatestSTR().Signature[0] ^= 1
+	mu.Unlock()
+	out.Reset()
+	err = run([]string{"-socket", socket, "check"}, &out)
+	if !errors.Is(err, admin.ErrCheckFailed) {
+		t.Error("Expect", admin.ErrCheckFailed, "got", err)
+	}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil || report.OK() {
+		t.Errorf("Expect the report of the failed check, got %s", out.String())
+	}
+}
@@ -0,0 +1,161 @@
+// Command coniksarchive inspects, prunes and exports a client's proof
+// archive (see protocol/archive):
+//
+//	coniksarchive -db DIR list [-name NAME] [-since T] [-until T]
+//	coniksarchive -db DIR prune [-max-age D] [-max-entries N]
+//	coniksarchive -db DIR export -signkey HEX [-name NAME] [-since T] [-until T]
+//	coniksarchive verify -signkey HEX < bundle.json
+//
+// Times are in RFC 3339 format. export writes a JSON evidence bundle to
+// standard output, which anybody can check with verify. verify checks the
+// bundle against the directory's public signing key given with -signkey,
+// not the one in the bundle, which whoever made the bundle could have
+// replaced.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/protocol/archive"
+	"github.com/ORBAT/cloniks/protocol/registry"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "coniksarchive:", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage: coniksarchive -db DIR list|prune|export [flags], or coniksarchive verify -signkey HEX")
+
+var errSignKey = errors.New("-signkey must be a hex-encoded public signing key")
+
+// parseSignKey decodes the hex-encoded public signing key of -signkey.
+func parseSignKey(s string) (sign.PublicKey, error) {
+	pk, err := hex.DecodeString(s)
+	if err != nil || len(pk) != sign.PublicKeySize {
+		return nil, errSignKey
+	}
+	return sign.PublicKey(pk), nil
+}
+
+// timeFlag is a flag.Value for RFC 3339 times.
+type timeFlag struct{ t *time.Time }
+
+func (f timeFlag) String() string {
+	if f.t == nil || f.t.IsZero() {
+		return ""
+	}
+	return f.t.Format(time.RFC3339)
+}
+
+func (f timeFlag) Set(s string) error {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		*f.t = t
+	}
+	return err
+}
+
+func filterFlags(fs *flag.FlagSet, f *archive.Filter) {
+	fs.StringVar(&f.Username, "name", "", "only entries for this username")
+	fs.Var(timeFlag{&f.Since}, "since", "only entries verified at or after this time")
+	fs.Var(timeFlag{&f.Until}, "until", "only entries verified at or before this time")
+}
+
+func run(args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("coniksarchive", flag.ContinueOnError)
+	db := fs.String("db", "", "archive directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	if *db == "" && cmd != "verify" {
+		return errUsage
+	}
+
+	var policy archive.Policy
+	var filter archive.Filter
+	var signKey string
+	sub := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	switch cmd {
+	case "verify":
+		sub.StringVar(&signKey, "signkey", "", "the directory's public signing key, hex-encoded")
+	case "list":
+		filterFlags(sub, &filter)
+	case "prune":
+		sub.DurationVar(&policy.MaxAge, "max-age", 0, "remove entries older than this")
+		sub.IntVar(&policy.MaxEntries, "max-entries", 0, "keep at most this many entries")
+	case "export":
+		filterFlags(sub, &filter)
+		sub.StringVar(&signKey, "signkey", "", "the directory's public signing key, hex-encoded")
+	default:
+		return errUsage
+	}
+	if err := sub.Parse(args); err != nil {
+		return err
+	}
+	if cmd == "verify" {
+		pk, err := parseSignKey(signKey)
+		if err != nil {
+			return err
+		}
+		return verify(in, out, pk)
+	}
+
+	// Open prunes, so only pass the policy for prune
+	a, err := archive.Open(*db, archive.Policy{})
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	switch cmd {
+	case "list":
+		es, err := a.Entries(filter)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			fmt.Fprintf(out, "%s\t%s\ttype=%s\tepoch=%d\t%s\n", e.Time.Format(time.RFC3339),
+				e.Username, registry.MessageTypeName(e.Type), e.Epoch(), registry.ErrorCodeName(e.Error))
+		}
+	case "prune":
+		a.Policy = policy
+		n, err := a.Prune()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "removed %d entries\n", n)
+	case "export":
+		pk, err := parseSignKey(signKey)
+		if err != nil {
+			return err
+		}
+		return a.Export(out, pk, filter)
+	}
+	return nil
+}
+
+func verify(in io.Reader, out io.Writer, signKey sign.PublicKey) error {
+	b, err := archive.ReadBundle(in)
+	if err != nil {
+		return err
+	}
+	if i, err := b.Verify(signKey); err != nil {
+		return fmt.Errorf("entry %d: %w", i, err)
+	}
+	fmt.Fprintf(out, "%d entries verified\n", len(b.Entries))
+	return nil
+}
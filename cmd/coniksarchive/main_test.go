@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol/archive"
+	"github.com/ORBAT/cloniks/protocol/client"
+)
+
+func TestRun(t *testing.T) {
+	db := t.TempDir()
+	a, err := archive.Open(db, archive.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey := crypto.NewStaticTestSigningKey()
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), signKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := client.New(d.LatestSTR(), true, signKey.Public())
+	cc.Archive = a
+	for _, name := range []string{"alice", "bob"} {
+		resp, err := d.Register(name, []byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), name, []byte("key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	var out bytes.Buffer
+	if err := run([]string{"-db", db, "list", "-name", "bob"}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], "bob") ||
+		!strings.Contains(lines[0], "type=Registration\t") || !strings.HasSuffix(lines[0], "\tReqSuccess") {
+		t.Fatalf("Unexpected listing %q", out.String())
+	}
+
+	out.Reset()
+	pk := hex.EncodeToString(signKey.Public())
+	if err := run([]string{"-db", db, "export", "-signkey", pk}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	bundle := out.String()
+	out.Reset()
+	if err := run([]string{"verify", "-signkey", pk}, strings.NewReader(bundle), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "2 entries verified\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+	if err := run([]string{"verify"}, strings.NewReader(bundle), &out); err != errSignKey {
+		t.Error("Expect", errSignKey, "got", err)
+	}
+	otherKey := hex.EncodeToString(make([]byte, len(signKey.Public())))
+	if err := run([]string{"verify", "-signkey", otherKey}, strings.NewReader(bundle), &out); !errors.Is(err, archive.ErrBadSignature) {
+		t.Error("Expect", archive.ErrBadSignature, "got", err)
+	}
+
+	out.Reset()
+	if err := run([]string{"-db", db, "prune", "-max-entries", "1"}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "removed 1 entries\n" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+
+	if err := run([]string{"-db", db, "frobnicate"}, nil, &out); err != errUsage {
+		t.Error("Expect", errUsage, "got", err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ORBAT/cloniks/protocol/wire"
+)
+
+// compressed wraps h so that its responses are compressed with the
+// server's preferred content coding the client accepts (see
+// wire.Handler).
+func (s *server) compressed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wire.Handler(h, s.codecs, &s.compression).ServeHTTP(w, r)
+	}
+}
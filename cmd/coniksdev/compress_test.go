@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+)
+
+func TestCompressedResponses(t *testing.T) {
+	s, err := newServer(directory.WithSnapshots(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.dir.Register("alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := s.handler()
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	plain := get("/monitor?name=alice&start=1", "")
+	if enc := plain.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Expect an uncompressed response, got %q", enc)
+	}
+	zipped := get("/monitor?name=alice&start=1", "gzip")
+	if enc := zipped.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Expect a gzip-compressed response, got %q", enc)
+	}
+	size := zipped.Body.Len()
+	if size >= plain.Body.Len() {
+		t.Errorf("Expect compression to shrink the response from %d bytes, got %d", plain.Body.Len(), size)
+	}
+	zr, err := gzip.NewReader(zipped.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Error("Expect the decompressed response to equal the uncompressed one")
+	}
+	if vary := zipped.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Expect Vary: Accept-Encoding, got %q", vary)
+	}
+
+	// too small to be worth it
+	if enc := get("/lookup?name=bob&epoch=999", "gzip").Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expect a small response to be uncompressed, got %q", enc)
+	}
+	s.codecs = nil
+	if enc := get("/monitor?name=alice&start=1", "gzip").Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Expect no compression without codecs, got %q", enc)
+	}
+
+	metrics := get("/metrics", "").Body.String()
+	for _, want := range []string{
+		"coniks_compressed_responses_total 1\n",
+		"coniks_compressed_response_bytes_total{stage=\"uncompressed\"} " + strconv.Itoa(plain.Body.Len()) + "\n",
+		"coniks_compressed_response_bytes_total{stage=\"compressed\"} " + strconv.Itoa(size) + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expect the metrics to contain %q, got\n%s", want, metrics)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	"github.com/ORBAT/cloniks/directory"
+)
+
+// jsonCodec encodes the messages of the gRPC frontend as JSON, so that
+// they're the same as those of the HTTP frontend, and no protobuf
+// definitions need to be generated. Clients select it with the content
+// subtype "json", e.g. with grpc.CallContentSubtype(jsonCodec{}.Name()).
+type jsonCodec struct{}
+
+var _ encoding.Codec = jsonCodec{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// grpcService is the name of the gRPC service of the directory.
+const grpcService = "coniks.Directory"
+
+// grpcMethod describes a unary method of the gRPC service: it decodes
+// a request of the type newRequest returns, and handle answers it like
+// the HTTP frontend.
+type grpcMethod struct {
+	name        string
+	requestType int
+	newRequest  func() interface{}
+	handle      func(d *directory.Tree, req interface{}) *directory.Response
+}
+
+var grpcMethods = []grpcMethod{
+	{"Register", directory.RegistrationType,
+		func() interface{} { return new(directory.RegistrationRequest) },
+		func(d *directory.Tree, req interface{}) *directory.Response {
+			return d.HandleRegistration(req.(*directory.RegistrationRequest))
+		}},
+	{"Lookup", directory.KeyLookupType,
+		func() interface{} { return new(directory.KeyLookupRequest) },
+		func(d *directory.Tree, req interface{}) *directory.Response {
+			return d.KeyLookup(req.(*directory.KeyLookupRequest))
+		}},
+	{"LookupInEpoch", directory.KeyLookupInEpochType,
+		func() interface{} { return new(directory.KeyLookupInEpochRequest) },
+		func(d *directory.Tree, req interface{}) *directory.Response {
+			return d.KeyLookupInEpoch(req.(*directory.KeyLookupInEpochRequest))
+		}},
+	{"Monitor", directory.MonitoringType,
+		func() interface{} { return new(directory.MonitoringRequest) },
+		func(d *directory.Tree, req interface{}) *directory.Response {
+			return d.Monitor(req.(*directory.MonitoringRequest))
+		}},
+	{"STRHistory", directory.STRType,
+		func() interface{} { return new(directory.STRHistoryRequest) },
+		func(d *directory.Tree, req interface{}) *directory.Response {
+			return d.GetSTRHistory(req.(*directory.STRHistoryRequest))
+		}},
+}
+
+// grpcServiceDesc returns the description of the gRPC service of the
+// directory, whose methods are called as /coniks.Directory/<name> with
+// the JSON-encoded requests of the HTTP frontend, and return
+// a JSON-encoded directory.Response. Like over HTTP, the directory's
+// error codes are in the responses rather than gRPC status codes, which
+// only report malformed messages and transport errors.
+func grpcServiceDesc() *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: grpcService,
+		HandlerType: (*interface{})(nil),
+		Metadata:    "coniksdev",
+	}
+	for _, m := range grpcMethods {
+		m := m
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: m.name,
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+				interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := m.newRequest()
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handle := func(_ context.Context, req interface{}) (interface{}, error) {
+					return srv.(*server).handleGRPC(m, req), nil
+				}
+				if interceptor == nil {
+					return handle(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcService + "/" + m.name}
+				return interceptor(ctx, req, info, handle)
+			},
+		})
+	}
+	return desc
+}
+
+func (s *server) handleGRPC(m grpcMethod, req interface{}) *directory.Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := m.handle(s.dir, req)
+	s.countResponse(m.requestType, resp.Error)
+	return resp
+}
+
+// grpcServer returns a gRPC server serving the directory of s.
+func (s *server) grpcServer() *grpc.Server {
+	srv := grpc.NewServer()
+	srv.RegisterService(grpcServiceDesc(), s)
+	return srv
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/client"
+)
+
+func TestGRPC(t *testing.T) {
+	s, err := newServer(directory.WithSnapshots(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := bufconn.Listen(1 << 20)
+	srv := s.grpcServer()
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Stop()
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	call := func(method string, req, resp interface{}) {
+		t.Helper()
+		if err := conn.Invoke(context.Background(), "/"+grpcService+"/"+method, req, resp); err != nil {
+			t.Fatal(method, err)
+		}
+	}
+
+	var genesis struct {
+		Error             protocol.ErrorCode
+		DirectoryResponse *directory.STRHistoryRange
+	}
+	call("STRHistory", &directory.STRHistoryRequest{}, &genesis)
+	cc := client.New(genesis.DirectoryResponse.STR[0], true, s.signKey)
+
+	var reg proofResponse
+	call("Register", &directory.RegistrationRequest{Username: "alice", Key: []byte("key")}, &reg)
+	if err := cc.HandleResponse(directory.RegistrationType, reg.response(), "alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.update(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lookup proofResponse
+	call("Lookup", &directory.KeyLookupRequest{Username: "alice"}, &lookup)
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup.response(), "alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	var monitoring proofResponse
+	call("Monitor", &directory.MonitoringRequest{Username: "alice", StartEpoch: 1, EndEpoch: 1}, &monitoring)
+	if err := cc.HandleResponse(directory.MonitoringType, monitoring.response(), "alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	var inEpoch proofResponse
+	call("LookupInEpoch", &directory.KeyLookupInEpochRequest{Username: "alice", Epoch: 0}, &inEpoch)
+	if inEpoch.Error != protocol.ReqNameNotFound {
+		t.Error("Expect", protocol.ReqNameNotFound, "got", inEpoch.Error)
+	}
+
+	s.mu.Lock()
+	n := s.responses[responseKey{directory.KeyLookupType, protocol.ReqSuccess}]
+	s.mu.Unlock()
+	if n != 1 {
+		t.Error("Expect 1 counted key lookup, got", n)
+	}
+
+	err = conn.Invoke(context.Background(), "/"+grpcService+"/Lookup", []byte("not json"), &lookup)
+	if grpcstatus.Code(err) != codes.Internal {
+		t.Error("Expect a malformed request to fail with", codes.Internal, "got", err)
+	}
+	err = conn.Invoke(context.Background(), "/"+grpcService+"/Delete", &directory.KeyLookupRequest{}, &lookup)
+	if grpcstatus.Code(err) != codes.Unimplemented {
+		t.Error("Expect", codes.Unimplemented, "got", err)
+	}
+}
@@ -0,0 +1,163 @@
+// Command coniksdev runs a throwaway CONIKS directory for application
+// developers to test against locally. It keeps everything in memory,
+// generates fresh keys on every start, starts a new epoch every few
+// seconds, and serves the directory over HTTP with JSON-encoded
+// responses:
+//
+//	GET  /                      web page showing the latest STRs live
+//	GET  /status                epoch, keys, health, announced policies, and tree sizes
+//	GET  /metrics               tree and response sizes in the Prometheus text format
+//	POST /register              register a JSON directory.RegistrationRequest
+//	GET  /lookup?name=&epoch=   key lookup, in the latest or the given epoch
+//	GET  /monitor?name=&start=&end=
+//	GET  /str?start=&end=       STR history
+//	POST /epoch                 start a new epoch now
+//	GET  /schedule              policy changes announced in the next STR
+//	POST /schedule              announce a JSON directory.PolicyUpdate
+//	DELETE /schedule?epoch=     cancel the policy change announced for the epoch
+//
+// The same requests are served over gRPC on -grpc-addr, as the unary
+// methods Register, Lookup, LookupInEpoch, Monitor and STRHistory of the
+// service coniks.Directory. Their messages are the JSON-encoded requests
+// and directory.Responses of the HTTP frontend rather than protobufs, so
+// clients call them with the content subtype "json", i.e. the content type
+// application/grpc+json.
+//
+// With -admin-socket, the admin interface of protocol/admin is served on
+// a Unix socket too, e.g. for coniksadmin check.
+//
+// Lookup, monitoring and STR history responses are compressed with zstd,
+// gzip or deflate if the client accepts any of them (see -compress and
+// protocol/wire).
+//
+// Flags can also be set with CONIKSDEV_-prefixed environment variables
+// (e.g. CONIKSDEV_ADDR), which is handy in containers.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/admin"
+	"github.com/ORBAT/cloniks/protocol/alert"
+	"github.com/ORBAT/cloniks/protocol/wire"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	grpcAddr := flag.String("grpc-addr", ":8081", "address to serve gRPC on; empty disables")
+	epoch := flag.Duration("epoch", 5*time.Second, "epoch length; 0 disables automatic epochs")
+	snapshots := flag.Uint64("snapshots", 1000, "number of snapshots to keep")
+	budget := flag.Uint64("memory-budget", 0, "approximate memory in bytes for snapshots, which replaces -snapshots; 0 disables")
+	full := flag.Uint64("full-snapshots", 0, "number of latest snapshots to keep in full; older ones keep only their STRs. 0 keeps all in full")
+	maxAge := flag.Duration("max-snapshot-age", 0, "how long snapshots are kept in full; older ones keep only their STRs. 0 keeps them regardless of age")
+	deadline := flag.Duration("deadline", 0, "how long an epoch update may take before an alert is logged and registrations are refused; 0 disables")
+	adminSocket := flag.String("admin-socket", "", "path of the Unix socket to serve the admin interface on; empty disables")
+	compress := flag.String("compress", "zstd,gzip,deflate", "content codings to compress responses with, in order of preference; empty disables")
+	flag.Parse()
+	if err := flagsFromEnv(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
+	opts := []directory.Option{
+		directory.WithSnapshots(*snapshots),
+		directory.WithRetention(merkletree.RetentionPolicy{Epochs: *full, MaxAge: *maxAge}),
+		// evict down to 80% of the budget, so that not every epoch evicts
+		directory.WithMemoryBudget(*budget/5*4, *budget),
+	}
+	if *epoch > 0 {
+		opts = append(opts, directory.WithScheduler(directory.Interval(*epoch)))
+	}
+	if *deadline > 0 {
+		opts = append(opts, directory.WithWatchdog(directory.WatchdogConfig{
+			Deadline: *deadline,
+			ReadOnly: true,
+			Alerts:   alert.NewStderrSink(),
+		}))
+	}
+	s, err := newServer(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.codecs, err = wire.ParseCodings(*compress); err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	if *epoch > 0 {
+		go s.run(ctx)
+	}
+	if *maxAge > 0 {
+		// snapshots age between epochs too
+		go func() { _ = s.dir.RunGC(ctx, &s.mu, *maxAge/10+time.Second) }()
+	}
+
+	if *adminSocket != "" {
+		l, err := admin.Listen(*adminSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a := &admin.Server{Tree: s.dir, Mu: &s.mu}
+		go func() { _ = a.Serve(ctx, l) }()
+	}
+
+	grpcSrv := s.grpcServer()
+	if *grpcAddr != "" {
+		l, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving gRPC on %s", *grpcAddr)
+		go func() {
+			if err := grpcSrv.Serve(l); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: *addr, Handler: s.handler()}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		stop()
+		grpcSrv.GracefulStop()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+
+	log.Printf("directory %s listening on %s, epoch length %s", s.dirID, *addr, *epoch)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// flagsFromEnv sets every flag in fs that wasn't given on the command
+// line from the environment variable CONIKSDEV_<NAME>, if it's set.
+func flagsFromEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		if v, ok := os.LookupEnv("CONIKSDEV_" + strings.ToUpper(f.Name)); ok {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("CONIKSDEV_%s: %v", strings.ToUpper(f.Name), e)
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/ORBAT/cloniks/protocol/registry"
+)
+
+// handleMetrics serves the sizes of the directory's trees as gauges in
+// the Prometheus text exposition format. The per-snapshot gauges are
+// labelled with the epoch, so there are as many series as snapshots
+// kept in memory. The sizes of compressed responses are counters, as are
+// the responses, labelled with the registry names of their request types
+// and error codes.
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	epoch := s.dir.LatestSTR().Epoch
+	stats, err := s.dir.Stats()
+	if err != nil {
+		s.mu.Unlock()
+		log.Printf("metrics: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	last := s.lastEpoch
+	keys := make([]responseKey, 0, len(s.responses))
+	responses := make(map[responseKey]uint64, len(s.responses))
+	for k, n := range s.responses {
+		keys = append(keys, k)
+		responses[k] = n
+	}
+	s.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].requestType != keys[j].requestType {
+			return keys[i].requestType < keys[j].requestType
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	gauge(w, "coniks_epoch", "Latest epoch of the directory.")
+	fmt.Fprintf(w, "coniks_epoch %d\n", epoch)
+	gauge(w, "coniks_snapshots", "Number of snapshots kept in memory.")
+	fmt.Fprintf(w, "coniks_snapshots %d\n", len(stats.Snapshots))
+	gauge(w, "coniks_memory_bytes", "Approximate memory footprint of all trees.")
+	fmt.Fprintf(w, "coniks_memory_bytes %d\n", stats.Bytes())
+	counter(w, "coniks_reclaimed_snapshots_total", "Snapshots whose trees were released, keeping their STRs.")
+	fmt.Fprintf(w, "coniks_reclaimed_snapshots_total %d\n", stats.Reclaimed.Pruned)
+	counter(w, "coniks_reclaimed_bytes_total", "Approximate memory footprint of the released trees of snapshots.")
+	fmt.Fprintf(w, "coniks_reclaimed_bytes_total %d\n", stats.Reclaimed.Bytes)
+	if last != nil {
+		gauge(w, "coniks_epoch_duration_seconds", "Time taken by the snapshot of the latest epoch.")
+		fmt.Fprintf(w, "coniks_epoch_duration_seconds %g\n", last.Duration.Seconds())
+		gauge(w, "coniks_epoch_insertions", "Bindings inserted in the latest epoch.")
+		fmt.Fprintf(w, "coniks_epoch_insertions %d\n", last.Insertions)
+		gauge(w, "coniks_epoch_fulfilled_promises", "Temporary bindings fulfilled by the latest epoch.")
+		fmt.Fprintf(w, "coniks_epoch_fulfilled_promises %d\n", last.FulfilledTBs)
+		gauge(w, "coniks_epoch_hashes_computed", "Node hashes computed for the latest epoch.")
+		fmt.Fprintf(w, "coniks_epoch_hashes_computed %d\n", last.Hash.Computed)
+		gauge(w, "coniks_epoch_promise_latency_seconds",
+			"Time between the issuance of the temporary bindings fulfilled by the latest epoch and its STR.")
+		fmt.Fprintf(w, "coniks_epoch_promise_latency_seconds{stat=\"max\"} %g\n", last.PromiseLatency.Max.Seconds())
+		fmt.Fprintf(w, "coniks_epoch_promise_latency_seconds{stat=\"mean\"} %g\n", last.PromiseLatency.Mean.Seconds())
+	}
+
+	gauge(w, "coniks_tree_leaves", "Number of leaves in a tree.")
+	for _, e := range stats.Snapshots {
+		fmt.Fprintf(w, "coniks_tree_leaves{epoch=\"%d\"} %d\n", e.Epoch, e.Leaves)
+	}
+	fmt.Fprintf(w, "coniks_tree_leaves{epoch=\"pending\"} %d\n", stats.Pending.Leaves)
+	gauge(w, "coniks_tree_nodes", "Number of nodes in a tree.")
+	for _, e := range stats.Snapshots {
+		fmt.Fprintf(w, "coniks_tree_nodes{epoch=\"%d\"} %d\n", e.Epoch, e.Nodes)
+	}
+	fmt.Fprintf(w, "coniks_tree_nodes{epoch=\"pending\"} %d\n", stats.Pending.Nodes)
+	gauge(w, "coniks_tree_bytes", "Approximate memory footprint of a tree.")
+	for _, e := range stats.Snapshots {
+		fmt.Fprintf(w, "coniks_tree_bytes{epoch=\"%d\"} %d\n", e.Epoch, e.Bytes)
+	}
+	fmt.Fprintf(w, "coniks_tree_bytes{epoch=\"pending\"} %d\n", stats.Pending.Bytes)
+	gauge(w, "coniks_tree_interior_nodes", "Number of interior nodes in the tree for the next epoch.")
+	fmt.Fprintf(w, "coniks_tree_interior_nodes %d\n", stats.Pending.Interior)
+	gauge(w, "coniks_tree_max_depth", "Level of the deepest leaf in the tree for the next epoch.")
+	fmt.Fprintf(w, "coniks_tree_max_depth %d\n", stats.Pending.MaxDepth)
+	gauge(w, "coniks_tree_average_depth", "Average level of the leaves in the tree for the next epoch.")
+	fmt.Fprintf(w, "coniks_tree_average_depth %g\n", stats.Pending.AverageDepth)
+
+	compression := s.compression.Load()
+	counter(w, "coniks_compressed_responses_total", "Responses sent compressed.")
+	fmt.Fprintf(w, "coniks_compressed_responses_total %d\n", compression.Responses)
+	counter(w, "coniks_compressed_response_bytes_total", "Size of the compressed responses before and after compression.")
+	fmt.Fprintf(w, "coniks_compressed_response_bytes_total{stage=\"uncompressed\"} %d\n",
+		compression.Uncompressed)
+	fmt.Fprintf(w, "coniks_compressed_response_bytes_total{stage=\"compressed\"} %d\n",
+		compression.Compressed)
+
+	counter(w, "coniks_responses_total", "Responses by request type and error code.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "coniks_responses_total{type=\"%s\",code=\"%s\"} %d\n",
+			registry.MessageTypeName(k.requestType), registry.ErrorCodeName(k.code), responses[k])
+	}
+}
+
+func gauge(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+func counter(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+	"github.com/ORBAT/cloniks/protocol/wire"
+)
+
+// server serves an in-memory directory over HTTP. Every request is
+// answered with a JSON-encoded directory.Response.
+type server struct {
+	mu      sync.Mutex
+	dir     *directory.Tree
+	signKey sign.PublicKey
+	vrfKey  vrf.PublicKey
+	dirID   string
+	started time.Time
+	// lastEpoch is the report of the latest epoch, or nil if there has
+	// been none since the start.
+	lastEpoch *directory.EpochReport
+	// codecs are the content codings lookup, monitoring and STR history
+	// responses may be compressed with, in order of preference.
+	codecs      []string
+	compression wire.Stats
+	// responses counts the responses by request type and error code.
+	responses map[responseKey]uint64
+}
+
+// A responseKey identifies a counter of responses.
+type responseKey struct {
+	requestType int
+	code        protocol.ErrorCode
+}
+
+var _ directory.Metrics = (*server)(nil)
+var _ directory.GCMetrics = (*server)(nil)
+
+// newServer creates a server for a directory with fresh keys, opened
+// with opts.
+func newServer(opts ...directory.Option) (*server, error) {
+	vrfKey, err := vrf.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	signKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{
+		started:   time.Now(),
+		codecs:    wire.DefaultCodings,
+		responses: make(map[responseKey]uint64),
+	}
+	opts = append([]directory.Option{directory.WithVRFKey(vrfKey), directory.WithSigningKey(signKey),
+		directory.WithMetrics(s)}, opts...)
+	if s.dir, err = directory.Open(opts...); err != nil {
+		return nil, err
+	}
+	s.signKey = signKey.Public()
+	s.vrfKey, _ = vrfKey.Public()
+	id, err := auditor.ComputeDirectoryIdentity(s.dir.LatestSTR())
+	if err != nil {
+		return nil, err
+	}
+	s.dirID = hex.EncodeToString(id[:])
+	return s, nil
+}
+
+// ObserveEpoch keeps the report of the latest epoch for /status and
+// /metrics, and logs epochs with new bindings. It's called by Update,
+// so s.mu is held.
+func (s *server) ObserveEpoch(r *directory.EpochReport) {
+	s.lastEpoch = r
+	if r.Insertions > 0 {
+		log.Printf("epoch %d: %d bindings inserted, %d promises fulfilled in at most %s, %d hashes computed in %s",
+			r.Epoch, r.Insertions, r.FulfilledTBs, r.PromiseLatency.Max, r.Hash.Computed, r.Duration)
+	}
+}
+
+// ObserveGC logs the errors of the garbage collections RunGC makes.
+func (s *server) ObserveGC(st merkletree.GCStats, err error) {
+	if err != nil {
+		log.Printf("garbage collection failed after pruning %d snapshots: %v", st.Pruned, err)
+	}
+}
+
+// ObserveRequest does nothing, since the handlers call the directory's
+// methods directly instead of HandleRequest. They count their responses
+// with countResponse instead.
+func (s *server) ObserveRequest(int, protocol.ErrorCode, time.Duration) {}
+
+// countResponse counts a response to a request of type requestType with
+// the error code code for /metrics. s.mu must be held.
+func (s *server) countResponse(requestType int, code protocol.ErrorCode) {
+	s.responses[responseKey{requestType, code}]++
+}
+
+// update takes a new snapshot of the directory.
+func (s *server) update() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.dir.Update()
+	return err
+}
+
+// run starts new epochs as scheduled until ctx is done, or an update
+// fails.
+func (s *server) run(ctx context.Context) {
+	if err := s.dir.Run(ctx, &s.mu); err != nil && err != ctx.Err() {
+		log.Printf("scheduled epochs stopped: %v", err)
+	}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/register", s.handleRegister)
+	mux.HandleFunc("/lookup", s.compressed(s.handleLookup))
+	mux.HandleFunc("/monitor", s.compressed(s.handleMonitor))
+	mux.HandleFunc("/str", s.compressed(s.handleSTR))
+	mux.HandleFunc("/epoch", s.handleEpoch)
+	mux.HandleFunc("/schedule", s.handleSchedule)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// epochParam parses the query parameter name as an epoch, returning def
+// if it's missing.
+func epochParam(r *http.Request, name string, def merkletree.Epoch) (merkletree.Epoch, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return merkletree.ParseEpoch(v)
+}
+
+func malformed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	writeJSON(w, directory.NewErrorResponse(protocol.ErrMalformedMessage))
+}
+
+type status struct {
+	Epoch        merkletree.Epoch
+	NextEpoch    time.Time `json:",omitempty"`
+	Started      time.Time
+	DirectoryID  string
+	SignKey      string
+	VrfKey       string
+	IndexSize    uint32
+	LeafCount    uint64
+	MaxDepth     uint32
+	TreeHash     string
+	STRSignature string
+	// MemoryBytes is the approximate memory footprint of all the trees
+	// of the directory.
+	MemoryBytes uint64
+	// Snapshots has the size of every snapshot kept in memory, and
+	// Pending that of the tree for the next epoch.
+	Snapshots []merkletree.EpochStats
+	Pending   merkletree.TreeStats
+	// LastEpoch describes the snapshot of the latest epoch, if one has
+	// been taken since the start.
+	LastEpoch *directory.EpochReport `json:",omitempty"`
+	// Health is that of the epoch updates, as observed by the
+	// directory's watchdog, if it has one.
+	Health directory.Health
+	// Schedule has the policy changes announced in the latest STR.
+	Schedule []*directory.PolicyUpdate `json:",omitempty"`
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	// the health is read first, since a hung update holds s.mu
+	health := s.dir.Health()
+	s.mu.Lock()
+	str := s.dir.LatestSTR()
+	stats, err := s.dir.Stats()
+	if err != nil {
+		s.mu.Unlock()
+		log.Printf("status: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	st := status{
+		Epoch:        str.Epoch,
+		NextEpoch:    s.dir.NextEpoch(),
+		Started:      s.started,
+		DirectoryID:  s.dirID,
+		SignKey:      hex.EncodeToString(s.signKey),
+		VrfKey:       hex.EncodeToString(s.vrfKey),
+		IndexSize:    str.Policies.IndexSize,
+		LeafCount:    str.LeafCount,
+		MaxDepth:     str.MaxDepth,
+		TreeHash:     hex.EncodeToString(str.TreeHash[:]),
+		STRSignature: hex.EncodeToString(str.Signature[:]),
+		MemoryBytes:  stats.Bytes(),
+		Snapshots:    stats.Snapshots,
+		Pending:      stats.Pending,
+		LastEpoch:    s.lastEpoch,
+		Health:       health,
+		Schedule:     str.Policies.Schedule,
+	}
+	s.mu.Unlock()
+	writeJSON(w, st)
+}
+
+// handleRegister expects a POSTed JSON directory.RegistrationRequest.
+func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req directory.RegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		malformed(w)
+		return
+	}
+
+	s.mu.Lock()
+	resp := s.dir.HandleRegistration(&req)
+	s.countResponse(directory.RegistrationType, resp.Error)
+	s.mu.Unlock()
+	switch resp.Error {
+	case protocol.ErrMalformedMessage:
+		w.WriteHeader(http.StatusBadRequest)
+	case protocol.ErrDirectory:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	writeJSON(w, resp)
+}
+
+// handleLookup looks up ?name in the latest epoch, or in ?epoch if given.
+func (s *server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if r.URL.Query().Get("epoch") == "" {
+		s.mu.Lock()
+		resp := s.dir.KeyLookup(&directory.KeyLookupRequest{Username: name})
+		s.countResponse(directory.KeyLookupType, resp.Error)
+		s.mu.Unlock()
+		writeJSON(w, resp)
+		return
+	}
+	epoch, err := epochParam(r, "epoch", 0)
+	if err != nil {
+		malformed(w)
+		return
+	}
+	s.mu.Lock()
+	resp := s.dir.KeyLookupInEpoch(&directory.KeyLookupInEpochRequest{Username: name, Epoch: epoch})
+	s.countResponse(directory.KeyLookupInEpochType, resp.Error)
+	s.mu.Unlock()
+	writeJSON(w, resp)
+}
+
+// handleMonitor monitors ?name in the epoch range [?start, ?end].
+func (s *server) handleMonitor(w http.ResponseWriter, r *http.Request) {
+	start, err1 := epochParam(r, "start", 0)
+	end, err2 := epochParam(r, "end", ^merkletree.Epoch(0))
+	if err1 != nil || err2 != nil {
+		malformed(w)
+		return
+	}
+	s.mu.Lock()
+	resp := s.dir.Monitor(&directory.MonitoringRequest{
+		Username:   r.URL.Query().Get("name"),
+		StartEpoch: start,
+		EndEpoch:   end,
+	})
+	s.countResponse(directory.MonitoringType, resp.Error)
+	s.mu.Unlock()
+	writeJSON(w, resp)
+}
+
+// handleSTR returns the STRs for the epoch range [?start, ?end]. By
+// default it returns the latest STR only.
+func (s *server) handleSTR(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	latest := s.dir.LatestSTR().Epoch
+	s.mu.Unlock()
+	start, err1 := epochParam(r, "start", latest)
+	end, err2 := epochParam(r, "end", ^merkletree.Epoch(0))
+	if err1 != nil || err2 != nil {
+		malformed(w)
+		return
+	}
+	s.mu.Lock()
+	resp := s.dir.GetSTRHistory(&directory.STRHistoryRequest{StartEpoch: start, EndEpoch: end})
+	s.countResponse(directory.STRType, resp.Error)
+	s.mu.Unlock()
+	writeJSON(w, resp)
+}
+
+// handleEpoch starts a new epoch immediately when POSTed to.
+func (s *server) handleEpoch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.update(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, directory.NewErrorResponse(protocol.ErrDirectory))
+		return
+	}
+	s.handleStatus(w, r)
+}
+
+// handleSchedule announces the policy change of a POSTed JSON
+// directory.PolicyUpdate, or cancels the one for ?epoch when DELETEd
+// from. It returns the announced policy changes, which the STR of the
+// next epoch commits to.
+func (s *server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var u directory.PolicyUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			malformed(w)
+			return
+		}
+		s.mu.Lock()
+		err := s.dir.SchedulePolicy(u.Epoch, &directory.Config{
+			MinKeyChangeInterval:  u.MinKeyChangeInterval,
+			DeletionQuarantine:    u.DeletionQuarantine,
+			ReattestationInterval: u.ReattestationInterval,
+			Capabilities:          u.Capabilities,
+		})
+		s.mu.Unlock()
+		if err != nil {
+			malformed(w)
+			return
+		}
+	case http.MethodDelete:
+		epoch, err := epochParam(r, "epoch", 0)
+		if err != nil {
+			malformed(w)
+			return
+		}
+		s.mu.Lock()
+		s.dir.CancelPolicy(epoch)
+		s.mu.Unlock()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	schedule := s.dir.PolicySchedule()
+	s.mu.Unlock()
+	writeJSON(w, schedule)
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(indexPage))
+}
+
+// indexPage polls /status and /str and shows the latest STRs.
+const indexPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>coniksdev</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>coniksdev</h1>
+<p id="status">loading&hellip;</p>
+<table>
+<thead><tr><th>epoch</th><th>tree hash</th><th>leaves</th><th>max depth</th><th>signature</th></tr></thead>
+<tbody id="strs"></tbody>
+</table>
+<script>
+function b64hex(b) {
+  return Array.from(atob(b || ""), c => c.charCodeAt(0).toString(16).padStart(2, "0")).join("");
+}
+function short(h) { return h.length > 16 ? h.slice(0, 16) + "…" : h; }
+async function refresh() {
+  try {
+    const st = await (await fetch("/status")).json();
+    document.getElementById("status").textContent =
+      "directory " + short(st.DirectoryID) + ", epoch " + st.Epoch +
+      (st.NextEpoch && !st.NextEpoch.startsWith("0001") ? ", next epoch at " + new Date(st.NextEpoch).toLocaleTimeString() : "");
+    const start = Math.max(0, st.Epoch - 9);
+    const resp = await (await fetch("/str?start=" + start)).json();
+    const rows = (resp.DirectoryResponse.STR || []).slice().reverse().map(s =>
+      "<tr><td>" + s.Epoch + "</td><td>" + short(b64hex(s.TreeHash)) + "</td><td>" + s.LeafCount +
+      "</td><td>" + s.MaxDepth + "</td><td>" + short(b64hex(s.Signature)) + "</td></tr>");
+    document.getElementById("strs").innerHTML = rows.join("");
+  } catch (e) {
+    document.getElementById("status").textContent = "error: " + e;
+  }
+}
+refresh();
+setInterval(refresh, 1000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/client"
+)
+
+// proofResponse is a directory.Response carrying a DirectoryProof.
+type proofResponse struct {
+	Error             protocol.ErrorCode
+	DirectoryResponse *directory.DirectoryProof
+}
+
+func (r *proofResponse) response() *directory.Response {
+	return &directory.Response{Error: r.Error, DirectoryResponse: r.DirectoryResponse}
+}
+
+func decode(t *testing.T, resp *http.Response, err error, v interface{}) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s, err := newServer(directory.WithSnapshots(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	var genesis struct {
+		Error             protocol.ErrorCode
+		DirectoryResponse *directory.STRHistoryRange
+	}
+	resp, err := http.Get(srv.URL + "/str")
+	decode(t, resp, err, &genesis)
+	cc := client.New(genesis.DirectoryResponse.STR[0], true, s.signKey)
+
+	body, _ := json.Marshal(&directory.RegistrationRequest{Username: "alice", Key: []byte("key")})
+	var reg proofResponse
+	resp, err = http.Post(srv.URL+"/register", "application/json", bytes.NewReader(body))
+	decode(t, resp, err, &reg)
+	if err := cc.HandleResponse(directory.RegistrationType, reg.response(), "alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	var st status
+	resp, err = http.Post(srv.URL+"/epoch", "", nil)
+	decode(t, resp, err, &st)
+	if st.Epoch != 1 || st.LeafCount != 1 || st.DirectoryID != s.dirID {
+		t.Fatalf("Unexpected status %+v", st)
+	}
+	if len(st.Snapshots) != 2 || st.Snapshots[1].Epoch != 1 || st.Snapshots[1].Leaves != 1 ||
+		st.Pending.Leaves != 1 || st.MemoryBytes == 0 {
+		t.Fatalf("Unexpected tree sizes %+v", st)
+	}
+
+	var latest struct {
+		Error             protocol.ErrorCode
+		DirectoryResponse *directory.STRHistoryRange
+	}
+	resp, err = http.Get(srv.URL + "/str")
+	decode(t, resp, err, &latest)
+	if err := cc.AuditDirectory(latest.DirectoryResponse.STR); err != nil {
+		t.Fatal(err)
+	}
+	cc.Update(latest.DirectoryResponse.STR[0])
+
+	var lookup proofResponse
+	resp, err = http.Get(srv.URL + "/lookup?name=alice")
+	decode(t, resp, err, &lookup)
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup.response(), "alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	var inEpoch proofResponse
+	resp, err = http.Get(srv.URL + "/lookup?name=alice&epoch=0")
+	decode(t, resp, err, &inEpoch)
+	if inEpoch.Error != protocol.ReqNameNotFound {
+		t.Error("Expect", protocol.ReqNameNotFound, "got", inEpoch.Error)
+	}
+
+	var bad directory.Response
+	resp, err = http.Get(srv.URL + "/str?start=x")
+	decode(t, resp, err, &bad)
+	if resp.StatusCode != http.StatusBadRequest || bad.Error != protocol.ErrMalformedMessage {
+		t.Error("Expect a malformed message error, got", resp.Status, bad.Error)
+	}
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics bytes.Buffer
+	metrics.ReadFrom(resp.Body)
+	resp.Body.Close()
+	for _, line := range []string{"coniks_epoch 1\n", "coniks_snapshots 2\n",
+		"coniks_tree_leaves{epoch=\"0\"} 0\n", "coniks_tree_leaves{epoch=\"1\"} 1\n",
+		"coniks_epoch_insertions 1\n", "coniks_epoch_fulfilled_promises 1\n",
+		"coniks_tree_interior_nodes 1\n", "coniks_tree_max_depth 1\n",
+		"coniks_epoch_promise_latency_seconds{stat=\"max\"} ",
+		"coniks_responses_total{type=\"KeyLookup\",code=\"ReqSuccess\"} 1\n",
+		"coniks_responses_total{type=\"KeyLookupInEpoch\",code=\"ReqNameNotFound\"} 1\n"} {
+		if !strings.Contains(metrics.String(), line) {
+			t.Errorf("Expect %q in metrics:\n%s", line, metrics.String())
+		}
+	}
+
+	resp, err = http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page bytes.Buffer
+	page.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(page.String(), "<title>coniksdev</title>") {
+		t.Error("Unexpected index page")
+	}
+}
+
+func TestServerSchedule(t *testing.T) {
+	s, err := newServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+
+	var schedule []*directory.PolicyUpdate
+	body, _ := json.Marshal(&directory.PolicyUpdate{Epoch: 3, MinKeyChangeInterval: 2})
+	resp, err := http.Post(srv.URL+"/schedule", "application/json", bytes.NewReader(body))
+	decode(t, resp, err, &schedule)
+	if len(schedule) != 1 || schedule[0].Epoch != 3 || schedule[0].MinKeyChangeInterval != 2 {
+		t.Fatalf("Unexpected schedule %+v", schedule)
+	}
+
+	var bad directory.Response
+	body, _ = json.Marshal(&directory.PolicyUpdate{Epoch: 1})
+	resp, err = http.Post(srv.URL+"/schedule", "application/json", bytes.NewReader(body))
+	decode(t, resp, err, &bad)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expect", http.StatusBadRequest, "got", resp.StatusCode)
+	}
+
+	var st status
+	resp, err = http.Post(srv.URL+"/epoch", "", nil)
+	decode(t, resp, err, &st)
+	if len(st.Schedule) != 1 || st.Schedule[0].Epoch != 3 {
+		t.Fatalf("Expect the STR to announce the policy change, got %+v", st.Schedule)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/schedule?epoch=3", nil)
+	resp, err = http.DefaultClient.Do(req)
+	decode(t, resp, err, &schedule)
+	if len(schedule) != 0 {
+		t.Errorf("Expect the policy change to be cancelled, got %+v", schedule)
+	}
+}
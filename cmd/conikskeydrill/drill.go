@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+	"github.com/ORBAT/cloniks/protocol/client"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+// The keys a scenario's attacker compromised.
+const (
+	signingKey = "signing key"
+	vrfKey     = "VRF key"
+	bothKeys   = "both keys"
+)
+
+// victim is the user whose binding the attacker goes after.
+const victim = "alice"
+
+// attackerKey is the key the attacker binds the victim to.
+var attackerKey = []byte("attacker's key")
+
+// A Result is the outcome of one check of the drill: whether Detector,
+// a verifier built from this module, detected the attack of Scenario,
+// and with which error.
+type Result struct {
+	Scenario    string
+	Compromised string
+	Detector    string
+	Detected    bool
+	Error       string `json:",omitempty"`
+}
+
+// detect returns the Result of the check by detector that returned err,
+// which detects the attack iff it's not nil.
+func detect(detector string, err error) Result {
+	r := Result{Detector: detector, Detected: err != nil}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// A deployment is a test deployment of a directory whose keys the drill
+// compromises.
+type deployment struct {
+	dir     *directory.Tree
+	signKey sign.PrivateKey
+	vrfKey  vrf.PrivateKey
+	keys    map[string][]byte // the users' keys, by username
+}
+
+// newDeployment starts a directory with the given keys, registers the
+// victim, another user "bob" and users more, and takes epochs
+// snapshots.
+func newDeployment(signKey sign.PrivateKey, vrfKey vrf.PrivateKey, users, epochs int) (*deployment, error) {
+	dir, err := directory.New(vrfKey, signKey, uint64(epochs)+2)
+	if err != nil {
+		return nil, err
+	}
+	d := &deployment{dir: dir, signKey: signKey, vrfKey: vrfKey, keys: make(map[string][]byte)}
+	names := []string{victim, "bob"}
+	for i := 0; i < users; i++ {
+		names = append(names, "user"+strconv.Itoa(i))
+	}
+	for _, name := range names {
+		key := []byte(name + "'s key")
+		if _, err := dir.Register(name, key); err != nil {
+			return nil, err
+		}
+		d.keys[name] = key
+	}
+	for i := 0; i < epochs; i++ {
+		if _, err := dir.Update(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// latest returns the latest STR of d.
+func (d *deployment) latest() *directory.SignedTreeRoot {
+	return d.dir.LatestSTR()
+}
+
+// publicKey returns the signing key clients and auditors of d pin.
+func (d *deployment) publicKey() sign.PublicKey {
+	return d.signKey.Public()
+}
+
+// client returns a client of d that verified its latest STR.
+func (d *deployment) client() *client.ConsistencyChecks {
+	return client.New(d.latest(), true, d.publicKey())
+}
+
+// lookup returns the directory's response to a lookup of name.
+func (d *deployment) lookup(name string) *directory.Response {
+	return d.dir.KeyLookup(&directory.KeyLookupRequest{Username: name})
+}
+
+// forgery is a directory response forged by an attacker: the proof of
+// the victim's binding to attackerKey in a tree of the attacker's
+// making, and the STR for it.
+type forgery struct {
+	str *directory.SignedTreeRoot
+	ap  *merkletree.AuthenticationPath
+}
+
+// forge binds the victim to attackerKey at index in a new tree, and
+// signs the STR of the tree for epoch, linked to the STR with the hash
+// prevHash, with signer. proof is the index proof of the forged
+// binding.
+func (d *deployment) forge(signer sign.Signer, epoch merkletree.Epoch, prevHash hashed.Hash,
+	index, proof []byte) (*forgery, error) {
+	policies := d.latest().Policies
+	m, err := merkletree.NewMerkleTreeWithIndexSize(int(policies.IndexSize))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Set(index, []byte(victim), attackerKey); err != nil {
+		return nil, err
+	}
+	m.Hash()
+	str := merkletree.NewSTR(signer, policies, m, epoch, prevHash, nil)
+	ap, err := m.Get(index)
+	if err != nil {
+		return nil, err
+	}
+	ap.VrfProof = proof
+	return &forgery{str: directory.NewDirSTR(str), ap: ap}, nil
+}
+
+// response returns f as the response to a lookup of the victim.
+func (f *forgery) response() *directory.Response {
+	return directory.NewKeyLookupProof(f.ap, f.str, nil, protocol.ReqSuccess)
+}
+
+// guessedIndex is the index of the victim an attacker without the VRF
+// key makes up.
+func (d *deployment) guessedIndex() []byte {
+	return hashed.Digest([]byte(victim))[:d.latest().Policies.IndexSize]
+}
+
+// victimIndex computes the index of the victim, and its proof, with the
+// VRF key.
+func (d *deployment) victimIndex() (index, proof []byte) {
+	index, proof = d.vrfKey.Prove([]byte(victim))
+	return index[:d.latest().Policies.IndexSize], proof
+}
+
+// nextSTR forges the victim's binding in an STR for the epoch after the
+// latest one, linked to it and signed with signer.
+func (d *deployment) nextSTR(signer sign.Signer, index, proof []byte) (*forgery, error) {
+	latest := d.latest()
+	return d.forge(signer, latest.Epoch+1, hashed.Sum(latest.Signature[:]), index, proof)
+}
+
+// equivocation returns the result of checking whether a and b are
+// evidence of equivocation that a third party accepts.
+func (d *deployment) equivocation(a, b *directory.SignedTreeRoot) Result {
+	bsA, err := evidence.MarshalSTR(a)
+	if err != nil {
+		return detect("evidence", nil)
+	}
+	bsB, err := evidence.MarshalSTR(b)
+	if err != nil {
+		return detect("evidence", nil)
+	}
+	if _, err := evidence.VerifyEquivocation(d.publicKey(), bsA, bsB); err != nil {
+		return detect("evidence", nil)
+	}
+	return detect("evidence", fmt.Errorf("the directory equivocated in epoch %d", a.Epoch))
+}
+
+// A scenario is a compromise of the keys of a deployment, and an attack
+// the attacker mounts with them, which the verifiers are expected to
+// detect.
+type scenario struct {
+	name        string
+	compromised string
+	// attack mounts the attack on d, and returns the results of the
+	// verifiers that should detect it
+	attack func(d *deployment) ([]Result, error)
+}
+
+var scenarios = []scenario{
+	// an STR for the latest epoch with another tree, signed with the stolen key
+	{"forked-str", signingKey,
+		func(d *deployment) ([]Result, error) {
+			latest := d.latest()
+			f, err := d.forge(d.signKey, latest.Epoch, latest.PreviousSTRHash, d.guessedIndex(), nil)
+			if err != nil {
+				return nil, err
+			}
+			return []Result{
+				detect("client", d.client().HandleResponse(directory.KeyLookupType, f.response(), victim, nil)),
+				detect("auditor", auditor.New(d.publicKey(), latest).AuditDirectory([]*directory.SignedTreeRoot{f.str})),
+				d.equivocation(latest, f.str),
+			}, nil
+		}},
+	// an STR for the next epoch that skips the latest STR in the hash chain
+	{"unlinked-str", signingKey,
+		func(d *deployment) ([]Result, error) {
+			latest := d.latest()
+			f, err := d.forge(d.signKey, latest.Epoch+1, latest.PreviousSTRHash, d.guessedIndex(), nil)
+			if err != nil {
+				return nil, err
+			}
+			return []Result{
+				detect("client", d.client().HandleResponse(directory.KeyLookupType, f.response(), victim, nil)),
+				detect("auditor", auditor.New(d.publicKey(), latest).AuditDirectory([]*directory.SignedTreeRoot{f.str})),
+			}, nil
+		}},
+	// the victim bound to another key at a made-up index in the next STR
+	{"forged-binding", signingKey,
+		func(d *deployment) ([]Result, error) {
+			f, err := d.nextSTR(d.signKey, d.guessedIndex(), nil)
+			if err != nil {
+				return nil, err
+			}
+			return []Result{
+				detect("client", d.client().HandleResponse(directory.KeyLookupType, f.response(), victim, nil)),
+			}, nil
+		}},
+	// another user's proof of inclusion, passed off as the proof of the victim's absence at their index
+	{"manipulated-index", vrfKey,
+		func(d *deployment) ([]Result, error) {
+			resp := d.lookup("bob")
+			df := resp.DirectoryResponse.(*directory.DirectoryProof)
+			ap := *df.AP[0]
+			ap.LookupIndex, ap.VrfProof = d.victimIndex()
+			resp = directory.NewKeyLookupProof(&ap, df.STR[0], nil, protocol.ReqNameNotFound)
+			return []Result{
+				detect("client", d.client().HandleResponse(directory.KeyLookupType, resp, victim, nil)),
+			}, nil
+		}},
+	// the victim bound to another key at their index in the next STR, signed with another key
+	{"unsigned-binding", vrfKey,
+		func(d *deployment) ([]Result, error) {
+			other, err := sign.GenerateKey(nil)
+			if err != nil {
+				return nil, err
+			}
+			index, proof := d.victimIndex()
+			f, err := d.nextSTR(other, index, proof)
+			if err != nil {
+				return nil, err
+			}
+			return []Result{
+				detect("client", d.client().HandleResponse(directory.KeyLookupType, f.response(), victim, nil)),
+				detect("auditor", auditor.New(d.publicKey(), d.latest()).AuditDirectory([]*directory.SignedTreeRoot{f.str})),
+			}, nil
+		}},
+	// the victim bound to another key at their index in the next STR, shown to others while the directory goes on
+	{"impersonation", bothKeys,
+		func(d *deployment) ([]Result, error) {
+			index, proof := d.victimIndex()
+			f, err := d.nextSTR(d.signKey, index, proof)
+			if err != nil {
+				return nil, err
+			}
+			// a client looking up the victim can't tell, but the victim's
+			// own client can, and so can anybody who saw both STRs
+			monitor := detect("victim's client",
+				d.client().HandleResponse(directory.KeyLookupType, f.response(), victim, d.keys[victim]))
+			if _, err := d.dir.Update(); err != nil {
+				return nil, err
+			}
+			return []Result{monitor, d.equivocation(d.latest(), f.str)}, nil
+		}},
+}
+
+// drill runs the scenarios named in only, or all of them if only is
+// empty, each against a new deployment made by deploy, and returns the
+// scorecard of the results.
+func drill(deploy func() (*deployment, error), only map[string]bool) ([]Result, error) {
+	var card []Result
+	for _, s := range scenarios {
+		if len(only) > 0 && !only[s.name] {
+			continue
+		}
+		d, err := deploy()
+		if err != nil {
+			return nil, err
+		}
+		results, err := s.attack(d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+		for _, r := range results {
+			r.Scenario, r.Compromised = s.name, s.compromised
+			card = append(card, r)
+		}
+	}
+	return card, nil
+}
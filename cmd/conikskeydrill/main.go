@@ -0,0 +1,154 @@
+// Command conikskeydrill runs a key compromise drill: it starts a test
+// deployment of a directory, hands its signing key, its VRF key or both
+// to a simulated attacker, and checks that the clients, auditors and
+// evidence verifiers of this module detect each attack the attacker
+// mounts with them:
+//
+//	conikskeydrill [-signkey HEX] [-vrfkey HEX] [-users N] [-epochs N] [-scenario NAME,...] [-json]
+//
+// The deployment has the given hex-encoded private keys, e.g. those of
+// a staging directory, or fresh ones. The scorecard lists the result of
+// every check, and conikskeydrill exits with status 1 if any attack
+// went undetected, so that it doubles as an end-to-end security
+// regression test. The scenarios are:
+//
+//	forked-str         signing key  an STR for the latest epoch with another tree
+//	unlinked-str       signing key  an STR for the next epoch that isn't linked to the latest one
+//	forged-binding     signing key  a binding at a made-up index
+//	manipulated-index  VRF key      another user's proof passed off as the proof of the victim's absence
+//	unsigned-binding   VRF key      a binding at the victim's index, signed with another key
+//	impersonation      both keys    a binding at the victim's index, signed with the stolen key
+//
+// An attacker with both keys can fool a client that looks up the victim,
+// so that attack is only detected by the victim's own client and by
+// whoever saw both the forged STR and the directory's.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "conikskeydrill:", err)
+		os.Exit(1)
+	}
+}
+
+// errMissed is returned by run if an attack went undetected.
+var errMissed = errors.New("attacks went undetected")
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("conikskeydrill", flag.ContinueOnError)
+	signKeyHex := fs.String("signkey", "", "the deployment's private signing key, hex-encoded; a fresh one if empty")
+	vrfKeyHex := fs.String("vrfkey", "", "the deployment's private VRF key, hex-encoded; a fresh one if empty")
+	users := fs.Int("users", 100, "number of users to register besides the victim and bob")
+	epochs := fs.Int("epochs", 3, "number of epochs before the attacks")
+	only := fs.String("scenario", "", "comma-separated scenarios to run; all if empty")
+	asJSON := fs.Bool("json", false, "write the scorecard as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *epochs < 1 {
+		return errors.New("-epochs must be at least 1")
+	}
+
+	signKey, err := parseSignKey(*signKeyHex)
+	if err != nil {
+		return err
+	}
+	vrfKey, err := parseVRFKey(*vrfKeyHex)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	if *only != "" {
+		known := make(map[string]bool)
+		for _, s := range scenarios {
+			known[s.name] = true
+		}
+		for _, name := range strings.Split(*only, ",") {
+			if !known[name] {
+				return fmt.Errorf("unknown scenario %q", name)
+			}
+			names[name] = true
+		}
+	}
+
+	card, err := drill(func() (*deployment, error) {
+		return newDeployment(signKey, vrfKey, *users, *epochs)
+	}, names)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(card)
+	} else {
+		err = writeScorecard(out, card)
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range card {
+		if !r.Detected {
+			return errMissed
+		}
+	}
+	return nil
+}
+
+func parseSignKey(s string) (sign.PrivateKey, error) {
+	if s == "" {
+		return sign.GenerateKey(nil)
+	}
+	bs, err := hex.DecodeString(s)
+	if err != nil || len(bs) != sign.PrivateKeySize {
+		return nil, errors.New("-signkey must be a hex-encoded private signing key")
+	}
+	return sign.PrivateKey(bs), nil
+}
+
+func parseVRFKey(s string) (vrf.PrivateKey, error) {
+	if s == "" {
+		return vrf.GenerateKey(nil)
+	}
+	bs, err := hex.DecodeString(s)
+	if err != nil || len(bs) != vrf.PrivateKeySize {
+		return nil, errors.New("-vrfkey must be a hex-encoded private VRF key")
+	}
+	return vrf.PrivateKey(bs), nil
+}
+
+// writeScorecard writes card as a table, followed by the number of
+// attacks detected.
+func writeScorecard(out io.Writer, card []Result) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCENARIO\tCOMPROMISED\tDETECTOR\tRESULT\tERROR")
+	detected := 0
+	for _, r := range card {
+		result := "MISSED"
+		if r.Detected {
+			result = "detected"
+			detected++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Scenario, r.Compromised, r.Detector, result, r.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d of %d checks detected the attack\n", detected, len(card))
+	return err
+}
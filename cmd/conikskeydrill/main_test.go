@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+)
+
+func TestRun(t *testing.T) {
+	signKey := hex.EncodeToString(crypto.NewStaticTestSigningKey())
+	vrfKey := hex.EncodeToString(crypto.NewStaticTestVRFKey())
+	var out bytes.Buffer
+	if err := run([]string{"-signkey", signKey, "-vrfkey", vrfKey, "-users", "10", "-json"}, &out); err != nil {
+		t.Fatal(err, out.String())
+	}
+	var card []Result
+	if err := json.Unmarshal(out.Bytes(), &card); err != nil {
+		t.Fatal(err)
+	}
+	ran := make(map[string]bool)
+	for _, r := range card {
+		ran[r.Scenario] = true
+		if !r.Detected || r.Error == "" {
+			t.Errorf("Expect %s to be detected by the %s, got %+v", r.Scenario, r.Detector, r)
+		}
+	}
+	for _, s := range scenarios {
+		if !ran[s.name] {
+			t.Error("Expect scenario", s.name, "to run")
+		}
+	}
+
+	out.Reset()
+	if err := run([]string{"-users", "0", "-scenario", "forked-str,impersonation"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "5 of 5 checks detected the attack\n") {
+		t.Errorf("Unexpected scorecard %q", out.String())
+	}
+	if err := run([]string{"-scenario", "nothing"}, &out); err == nil {
+		t.Error("Expect an unknown scenario to be rejected")
+	}
+	if err := run([]string{"-signkey", "00"}, &out); err == nil {
+		t.Error("Expect a malformed key to be rejected")
+	}
+}
+
+func TestScorecardMissed(t *testing.T) {
+	saved := scenarios
+	defer func() { scenarios = saved }()
+	scenarios = []scenario{{"harmless", signingKey,
+		func(d *deployment) ([]Result, error) {
+			return []Result{detect("client", nil)}, nil
+		}}}
+	var out bytes.Buffer
+	if err := run([]string{"-users", "0"}, &out); err != errMissed {
+		t.Error("Expect", errMissed, "got", err)
+	}
+	if !strings.Contains(out.String(), "MISSED") {
+		t.Errorf("Expect the miss in the scorecard, got %q", out.String())
+	}
+}
@@ -0,0 +1,105 @@
+// Package cryptotest provides fakes of the CONIKS cryptographic
+// primitives that fail on demand, so that tests can deterministically
+// exercise the handling of failures that practically never happen with
+// the real primitives: invalid signatures, VRF proofs that don't match
+// the index, and index collisions.
+package cryptotest
+
+import (
+	"bytes"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+)
+
+// A Signer is a sign.Signer that signs with Key, but returns invalid
+// signatures for the messages Fail returns true for. A nil Fail never
+// fails.
+type Signer struct {
+	Key  sign.PrivateKey
+	Fail func(message []byte) bool
+}
+
+var _ sign.Signer = (*Signer)(nil)
+
+// Sign signs message with s.Key, and corrupts the signature if
+// s.Fail(message) is true.
+func (s *Signer) Sign(message []byte) []byte {
+	sig := s.Key.Sign(message)
+	if s.Fail != nil && s.Fail(message) {
+		sig[0] ^= 0xff
+	}
+	return sig
+}
+
+// Public returns the public key of s.Key.
+func (s *Signer) Public() sign.PublicKey {
+	return s.Key.Public()
+}
+
+// A Verifier is a sign.Verifier that verifies signatures with Key, but
+// rejects the signatures of the messages Fail returns true for. A nil
+// Fail never fails.
+type Verifier struct {
+	Key  sign.PublicKey
+	Fail func(message []byte) bool
+}
+
+var _ sign.Verifier = (*Verifier)(nil)
+
+// Verify returns false if v.Fail(message) is true, and verifies sig with
+// v.Key otherwise.
+func (v *Verifier) Verify(message, sig []byte) bool {
+	if v.Fail != nil && v.Fail(message) {
+		return false
+	}
+	return v.Key.Verify(message, sig)
+}
+
+// An Indexer computes lookup indices with the VRF key Key, like
+// merkletree.VRFIndexer, but can be made to misbehave. It implements
+// merkletree.Indexer.
+type Indexer struct {
+	Key vrf.PrivateKey
+	// Mismatch, if set, makes the proof of the index of the keys it
+	// returns true for a proof for a different key, so that verifying
+	// the index fails.
+	Mismatch func(key []byte) bool
+	// Collide maps keys to the keys whose indices and proofs they get
+	// instead of their own, which simulates index collisions.
+	Collide map[string]string
+}
+
+// Index returns the index of key and its proof, as configured by ix.
+func (ix *Indexer) Index(key []byte) (index, proof []byte) {
+	if other, ok := ix.Collide[string(key)]; ok {
+		key = []byte(other)
+	}
+	index, proof = ix.Key.Prove(key)
+	if ix.Mismatch != nil && ix.Mismatch(key) {
+		_, proof = ix.Key.Prove(append([]byte("mismatch "), key...))
+	}
+	return index, proof
+}
+
+// Containing returns a Fail function for Signer and Verifier that fails
+// for the messages containing sub, e.g. the temporary bindings of a
+// value.
+func Containing(sub []byte) func(message []byte) bool {
+	return func(message []byte) bool {
+		return bytes.Contains(message, sub)
+	}
+}
+
+// Keys returns a Mismatch function for Indexer that matches the given
+// keys.
+func Keys(keys ...string) func(key []byte) bool {
+	return func(key []byte) bool {
+		for _, k := range keys {
+			if k == string(key) {
+				return true
+			}
+		}
+		return false
+	}
+}
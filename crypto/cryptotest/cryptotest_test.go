@@ -0,0 +1,49 @@
+package cryptotest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+)
+
+func TestSignerVerifier(t *testing.T) {
+	s := &Signer{Key: crypto.NewStaticTestSigningKey(), Fail: Containing([]byte("bad"))}
+	good, bad := []byte("a good message"), []byte("a bad message")
+	if !s.Public().Verify(good, s.Sign(good)) {
+		t.Error("Expect a valid signature")
+	}
+	if s.Public().Verify(bad, s.Sign(bad)) {
+		t.Error("Expect an invalid signature")
+	}
+
+	v := &Verifier{Key: s.Public(), Fail: Containing([]byte("good"))}
+	if v.Verify(good, s.Sign(good)) {
+		t.Error("Expect the verifier to reject the signature")
+	}
+	v.Fail = nil
+	if !v.Verify(good, s.Sign(good)) {
+		t.Error("Expect the verifier to accept the signature")
+	}
+}
+
+func TestIndexer(t *testing.T) {
+	vrfKey := crypto.NewStaticTestVRFKey()
+	pk, _ := vrfKey.Public()
+	ix := &Indexer{
+		Key:      vrfKey,
+		Mismatch: Keys("bob"),
+		Collide:  map[string]string{"mallory": "alice"},
+	}
+
+	index, proof := ix.Index([]byte("alice"))
+	if !pk.Verify([]byte("alice"), index, proof) {
+		t.Error("Expect a valid index for alice")
+	}
+	if collided, _ := ix.Index([]byte("mallory")); !bytes.Equal(collided, index) {
+		t.Error("Expect mallory to get the index of alice")
+	}
+	if index, proof := ix.Index([]byte("bob")); pk.Verify([]byte("bob"), index, proof) {
+		t.Error("Expect the proof for bob not to match its index")
+	}
+}
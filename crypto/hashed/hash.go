@@ -2,6 +2,8 @@ package hashed
 
 import (
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -48,6 +50,64 @@ func Digest(ms ...[]byte) (ret []byte) {
 	return sum
 }
 
+// ErrHashSize indicates that a byte slice can't be converted to a Hash
+// because it isn't HashSizeByte bytes long.
+var ErrHashSize = errors.New("[hashed] Wrong hash size")
+
+// A Hash is an output of the hash function. Unlike the []byte returned
+// by Digest, it can't have the wrong length, can be compared with ==,
+// and doesn't need to be allocated separately from the struct holding
+// it.
+type Hash [HashSizeByte]byte
+
+// Sum hashes all passed byte slices, like Digest, but returns a Hash.
+func Sum(ms ...[]byte) (ret Hash) {
+	h := hasherPool.Get().(*Hasher)
+	for _, m := range ms {
+		_, _ = h.Write(m)
+	}
+	h.Sum(ret[:0])
+	h.Reset()
+	hasherPool.Put(h)
+	return ret
+}
+
+// HashFromBytes converts b to a Hash. It returns ErrHashSize if b isn't
+// HashSizeByte bytes long.
+func HashFromBytes(b []byte) (h Hash, err error) {
+	if len(b) != HashSizeByte {
+		return h, ErrHashSize
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// IsZero reports whether h is the zero Hash, i.e. unset.
+func (h Hash) IsZero() bool {
+	return h == Hash{}
+}
+
+// MarshalText encodes h in base64, like encoding/json encodes []byte, so
+// that h serializes the same as the hash did when it was a []byte.
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(h[:])), nil
+}
+
+// UnmarshalText decodes a Hash encoded by MarshalText. An empty text
+// decodes to the zero Hash.
+func (h *Hash) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*h = Hash{}
+		return nil
+	}
+	b, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h, err = HashFromBytes(b)
+	return err
+}
+
 // RandSlice returns a random slice of bytes from a fast user-space CSPRNG
 func RandSlice() []byte {
 	return frand.Bytes(32)
@@ -2,6 +2,7 @@ package hashed
 
 import (
 	"bytes"
+	"encoding/json"
 	"testing"
 
 	// "github.com/stretchr/testify/assert"
@@ -21,6 +22,33 @@ func TestDigest(t *testing.T) {
 	require.Equal(t, Digest(msg), d)
 }
 
+func TestHash(t *testing.T) {
+	msg := []byte("test message")
+	h := Sum(msg)
+	if !bytes.Equal(h[:], Digest(msg)) {
+		t.Fatal("Expect Sum to equal Digest")
+	}
+	if _, err := HashFromBytes(msg); err != ErrHashSize {
+		t.Fatal("Expect", ErrHashSize, "got", err)
+	}
+	if fromBytes, err := HashFromBytes(Digest(msg)); err != nil || fromBytes != h {
+		t.Fatal("Expect the hash, got", err)
+	}
+
+	// a Hash serializes like the []byte it replaced, and an unset one
+	// decodes to the zero Hash
+	bs, err := json.Marshal(h)
+	require.NoError(t, err)
+	want, _ := json.Marshal(h[:])
+	require.Equal(t, want, bs)
+	var decoded Hash
+	require.NoError(t, json.Unmarshal(bs, &decoded))
+	require.Equal(t, h, decoded)
+	require.NoError(t, json.Unmarshal([]byte(`""`), &decoded))
+	require.True(t, decoded.IsZero())
+	require.Equal(t, ErrHashSize, json.Unmarshal([]byte(`"AAAA"`), &decoded))
+}
+
 func TestMakeRand(t *testing.T) {
 	r := RandSlice()
 	// check if hashed the random output:
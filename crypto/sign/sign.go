@@ -5,6 +5,8 @@ package sign
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"io"
 )
 
@@ -17,6 +19,63 @@ const (
 	SignatureSize = 64
 )
 
+// ErrSignatureSize indicates that a byte slice can't be converted to
+// a Signature because it isn't SignatureSize bytes long.
+var ErrSignatureSize = errors.New("[sign] Wrong signature size")
+
+// A Signature is a signature created by a PrivateKey. Unlike the []byte
+// returned by Sign, it can't have the wrong length, can be compared with
+// ==, and doesn't need to be allocated separately from the struct
+// holding it.
+type Signature [SignatureSize]byte
+
+// SignatureFromBytes converts sig to a Signature. It returns
+// ErrSignatureSize if sig isn't SignatureSize bytes long.
+func SignatureFromBytes(sig []byte) (s Signature, err error) {
+	if len(sig) != SignatureSize {
+		return s, ErrSignatureSize
+	}
+	copy(s[:], sig)
+	return s, nil
+}
+
+// IsZero reports whether s is the zero Signature, i.e. unset.
+func (s Signature) IsZero() bool {
+	return s == Signature{}
+}
+
+// MarshalText encodes s in base64, like encoding/json encodes []byte, so
+// that s serializes the same as the signature did when it was a []byte.
+func (s Signature) MarshalText() ([]byte, error) {
+	return []byte(base64.StdEncoding.EncodeToString(s[:])), nil
+}
+
+// UnmarshalText decodes a Signature encoded by MarshalText.
+func (s *Signature) UnmarshalText(text []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*s, err = SignatureFromBytes(sig)
+	return err
+}
+
+// A Signer signs messages. PrivateKey is the Signer of the CONIKS
+// protocols; other implementations are mainly useful in tests.
+type Signer interface {
+	Sign(message []byte) []byte
+	Public() PublicKey
+}
+
+// A Verifier verifies signatures. PublicKey is the Verifier of the
+// CONIKS protocols; other implementations are mainly useful in tests.
+type Verifier interface {
+	Verify(message, sig []byte) bool
+}
+
+var _ Signer = PrivateKey(nil)
+var _ Verifier = PublicKey(nil)
+
 // PrivateKey wraps the underlying private-key (ed25519.PrivateKey).
 // It provides some wrapper methods: Sign(), Public()
 type PrivateKey ed25519.PrivateKey
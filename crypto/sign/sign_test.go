@@ -2,6 +2,7 @@ package sign
 
 import (
 	"bytes"
+	"encoding/json"
 	"testing"
 )
 
@@ -38,3 +39,88 @@ func TestConvertPrivateKeyToPublicKey(t *testing.T) {
 		t.Fatal("Raw byte respresentation doesn't match public key.")
 	}
 }
+
+func TestBatch(t *testing.T) {
+	key, err := GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := key.Public()
+
+	var empty Batch
+	if !empty.Verify() || empty.FirstInvalid() != -1 {
+		t.Error("Expect an empty batch to be valid")
+	}
+
+	// large enough to be verified concurrently
+	for _, bad := range []int{-1, 0, 17, 99} {
+		var b Batch
+		for i := 0; i < 100; i++ {
+			msg := []byte{byte(i)}
+			sig := key.Sign(msg)
+			if i == bad {
+				sig[0]++
+			}
+			b.Add(pk, msg, sig)
+		}
+		if b.Len() != 100 {
+			t.Fatal("Expect 100 signatures, got", b.Len())
+		}
+		if got := b.Verify(); got != (bad == -1) {
+			t.Errorf("Verify() = %v with bad signature %d", got, bad)
+		}
+		if got := b.FirstInvalid(); got != bad {
+			t.Errorf("Expect first invalid signature %d, got %d", bad, got)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	key, err := GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := key.Sign([]byte("test message"))
+	if _, err := SignatureFromBytes(sig[1:]); err != ErrSignatureSize {
+		t.Fatal("Expect", ErrSignatureSize, "got", err)
+	}
+	s, err := SignatureFromBytes(sig)
+	if err != nil || s.IsZero() {
+		t.Fatal("Expect a signature, got", err)
+	}
+
+	// a Signature serializes like the []byte it replaced
+	bs, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := json.Marshal(sig); !bytes.Equal(bs, want) {
+		t.Fatalf("Expect %s, got %s", want, bs)
+	}
+	var decoded Signature
+	if err := json.Unmarshal(bs, &decoded); err != nil || decoded != s {
+		t.Fatal("Expect the signature to round-trip, got", err)
+	}
+	short, _ := json.Marshal(sig[1:])
+	if err := json.Unmarshal(short, &decoded); err != ErrSignatureSize {
+		t.Fatal("Expect", ErrSignatureSize, "got", err)
+	}
+}
+
+func BenchmarkBatchVerify(b *testing.B) {
+	key, err := GenerateKey(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var batch Batch
+	for i := 0; i < 1000; i++ {
+		msg := []byte{byte(i), byte(i >> 8)}
+		batch.Add(key.Public(), msg, key.Sign(msg))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !batch.Verify() {
+			b.Fatal("invalid batch")
+		}
+	}
+}
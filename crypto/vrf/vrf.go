@@ -172,6 +172,26 @@ func (sk PrivateKey) Prove(m []byte) (vrf, proof []byte) {
 	return
 }
 
+// VerifyTruncated returns true iff index is a non-empty prefix of
+// Compute(m) for the sk that corresponds to pk. It is used to verify
+// lookup indices that are truncated VRF outputs.
+func (pkBytes PublicKey) VerifyTruncated(m, index, proof []byte) bool {
+	if len(proof) != ProofSize || len(index) == 0 || len(index) > Size {
+		return false
+	}
+	// the full output is determined by the H(m)^x part of the proof;
+	// Verify checks that part.
+	hash := hashed.New()
+	hash.Write(proof[64:96]) // const length
+	hash.Write(m)
+	var vrf [Size]byte
+	hash.Digest().Read(vrf[:])
+	if !bytes.Equal(vrf[:len(index)], index) {
+		return false
+	}
+	return pkBytes.Verify(m, vrf[:], proof)
+}
+
 // Verify returns true iff vrf=Compute(m) for the sk that
 // corresponds to pk.
 func (pkBytes PublicKey) Verify(m, vrfBytes, proof []byte) bool {
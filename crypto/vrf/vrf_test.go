@@ -23,6 +23,33 @@ func TestHonestComplete(t *testing.T) {
 	}
 }
 
+func TestVerifyTruncated(t *testing.T) {
+	sk, err := GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, _ := sk.Public()
+	alice := []byte("alice")
+	aliceVRF, aliceProof := sk.Prove(alice)
+
+	for _, n := range []int{1, 16, Size} {
+		if !pk.VerifyTruncated(alice, aliceVRF[:n], aliceProof) {
+			t.Errorf("truncated output of %d bytes rejected", n)
+		}
+	}
+	index := append([]byte{}, aliceVRF[:16]...)
+	index[0] ^= 1
+	if pk.VerifyTruncated(alice, index, aliceProof) {
+		t.Error("forged truncated index accepted")
+	}
+	if pk.VerifyTruncated([]byte("bob"), aliceVRF[:16], aliceProof) {
+		t.Error("truncated index accepted for the wrong message")
+	}
+	if pk.VerifyTruncated(alice, nil, aliceProof) {
+		t.Error("empty index accepted")
+	}
+}
+
 func TestConvertPrivateKeyToPublicKey(t *testing.T) {
 	sk, err := GenerateKey(nil)
 	if err != nil {
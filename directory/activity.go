@@ -0,0 +1,92 @@
+package directory
+
+import (
+	"math"
+
+	"lukechampine.com/frand"
+
+	"github.com/ORBAT/cloniks/conv"
+)
+
+// ActivityStats are counts of the operations of a single epoch that
+// a directory opened WithActivityStats commits to in the epoch's STR, so
+// that the public can observe trends in the directory's activity.
+//
+// The counts are differentially private: each is noised with the
+// two-sided geometric distribution with the parameter Epsilon, so that
+// they reveal little about whether any single operation took place. The
+// smaller Epsilon is, the noisier the counts, and the stronger the
+// privacy. Since the noise is drawn once per epoch from a
+// cryptographically secure source and committed to by the STR, repeated
+// requests can't be averaged to remove it.
+type ActivityStats struct {
+	Epsilon float64
+	// Registrations is the noised number of bindings registered in the
+	// epoch.
+	Registrations uint64
+	// Changes is the noised number of other bindings set in the epoch,
+	// e.g. by a bulk import.
+	Changes uint64
+}
+
+// activityStatsTag marks the activity stats in serialized configs.
+var activityStatsTag = []byte("activity stats")
+
+// Bytes serializes the stats for signing the tree root.
+func (s *ActivityStats) Bytes() []byte {
+	bs := append([]byte{}, activityStatsTag...)
+	bs = append(bs, conv.ULongToBytes(math.Float64bits(s.Epsilon))...)
+	bs = append(bs, conv.ULongToBytes(s.Registrations)...)
+	bs = append(bs, conv.ULongToBytes(s.Changes)...)
+	return bs
+}
+
+// newActivityStats noises the counts of the operations of an epoch with
+// the privacy parameter epsilon.
+func newActivityStats(epsilon float64, registrations, changes uint64) *ActivityStats {
+	return &ActivityStats{
+		Epsilon:       epsilon,
+		Registrations: addNoise(registrations, epsilon),
+		Changes:       addNoise(changes, epsilon),
+	}
+}
+
+// addNoise adds noise from the two-sided geometric distribution with the
+// parameter epsilon to n, which makes n epsilon-differentially private
+// if a single operation changes it by at most 1. Results are clamped to
+// the range of uint64 instead of wrapping around.
+func addNoise(n uint64, epsilon float64) uint64 {
+	noise := geometric(epsilon) - geometric(epsilon)
+	switch {
+	case noise < 0 && uint64(-noise) > n:
+		return 0
+	case noise < 0:
+		return n - uint64(-noise)
+	case uint64(noise) > math.MaxUint64-n:
+		return math.MaxUint64
+	}
+	return n + uint64(noise)
+}
+
+// maxNoise bounds the draws of geometric, so that the difference of two
+// of them fits in an int64.
+const maxNoise = 1 << 62
+
+// geometric draws from the geometric distribution with the success
+// probability 1-exp(-epsilon), i.e. the number of failures before the
+// first success, clamped to maxNoise.
+func geometric(epsilon float64) int64 {
+	// a uniform float in (0, 1]
+	u := float64(frand.Uint64n(1<<53)+1) / (1 << 53)
+	return geometricOf(u, epsilon)
+}
+
+// geometricOf is geometric for the uniform draw u. For a small epsilon,
+// the draw would overflow an int64 without the clamping.
+func geometricOf(u, epsilon float64) int64 {
+	g := math.Floor(math.Log(u) / -epsilon)
+	if !(g < maxNoise) {
+		return maxNoise
+	}
+	return int64(g)
+}
@@ -0,0 +1,84 @@
+package directory
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddNoise(t *testing.T) {
+	const n, samples = 100, 20000
+	var sum float64
+	distinct := make(map[uint64]bool)
+	for i := 0; i < samples; i++ {
+		noised := addNoise(n, 1)
+		sum += float64(noised)
+		distinct[noised] = true
+	}
+	// the noise has mean 0 and a standard deviation of about 1.4
+	assert.InDelta(t, n, sum/samples, 0.1)
+	assert.True(t, len(distinct) > 5, "Expect noised counts")
+
+	// negative counts are clamped instead of wrapping around
+	for i := 0; i < 100; i++ {
+		assert.True(t, addNoise(0, 0.1) < 1000)
+	}
+}
+
+func TestGeometricClamped(t *testing.T) {
+	// the smallest draw with a tiny epsilon is far beyond an int64
+	smallest := 1.0 / (1 << 53)
+	assert.Equal(t, int64(maxNoise), geometricOf(smallest, 1e-300))
+	assert.Equal(t, int64(maxNoise), geometricOf(smallest, math.SmallestNonzeroFloat64))
+	assert.Equal(t, int64(0), geometricOf(1, 1e-300))
+	assert.Equal(t, int64(36), geometricOf(smallest, 1))
+
+	for i := 0; i < 100; i++ {
+		g := geometric(1e-300)
+		assert.True(t, g >= 0 && g <= maxNoise, "Expect %d to be clamped", g)
+		// the noised counts saturate instead of wrapping around
+		assert.True(t, addNoise(5, 1e-300) <= 5+maxNoise)
+		assert.True(t, addNoise(math.MaxUint64-5, 1e-300) >= math.MaxUint64-5-maxNoise)
+	}
+}
+
+func TestTree_ActivityStats(t *testing.T) {
+	_, err := Open(WithSigningKey(signKey), WithVRFKey(vrfKey), WithActivityStats(0))
+	assert.Equal(t, ErrInvalidEpsilon, err)
+
+	d, err := Open(WithSigningKey(signKey), WithVRFKey(vrfKey), WithActivityStats(0.5))
+	require.NoError(t, err)
+	assert.Nil(t, d.LatestSTR().Policies.Stats)
+	for i := 0; i < 50; i++ {
+		_, err := d.Register("user"+strconv.Itoa(i), []byte("key"))
+		require.NoError(t, err)
+	}
+	d.Update()
+	d.Update()
+
+	str, prev := d.LatestSTR(), NewDirSTR(d.pad.GetSTR(1))
+	require.NotNil(t, prev.Policies.Stats)
+	require.NotNil(t, str.Policies.Stats)
+	assert.Equal(t, 0.5, prev.Policies.Stats.Epsilon)
+	assert.InDelta(t, 50, prev.Policies.Stats.Registrations, 30)
+	assert.InDelta(t, 0, str.Policies.Stats.Registrations, 30)
+	assert.Nil(t, d.config.Stats, "Expect the stats only in the STRs")
+
+	// the stats are signed, and survive the wire format
+	assert.True(t, signKey.Public().Verify(prev.Bytes(), prev.Signature[:]))
+	forged := *prev.Policies.Stats
+	forged.Registrations++
+	config := *prev.Policies
+	config.Stats = &forged
+	assert.False(t, signKey.Public().Verify((&SignedTreeRoot{prev.SignedTreeRoot, &config}).Bytes(),
+		prev.Signature[:]))
+	bs, err := json.Marshal(prev)
+	require.NoError(t, err)
+	var decoded SignedTreeRoot
+	require.NoError(t, json.Unmarshal(bs, &decoded))
+	assert.Equal(t, prev.Policies.Stats, decoded.Policies.Stats)
+}
@@ -0,0 +1,124 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrBadTimestamp indicates that an ArchivalAttestation has no valid
+// timestamp from before the time it's required to predate.
+var ErrBadTimestamp = errors.New("[directory] Invalid archival timestamp")
+
+// An ArchivalAttestation is a directory's fresh signature of its STR
+// history up to the STR of Epoch, made with its current signing key
+// Key. Like a Rollup, it commits to the history with the root of the
+// merkletree.STRList of the STRs for epochs 0 through Epoch.
+//
+// Signatures on old STRs protect them only as long as the key that made
+// them stays secret. Once it leaks, anybody can sign a different STR for
+// an old epoch. A re-attestation made before the leak pins the signatures
+// of the genuine STRs, so a verifier still accepts only them (see
+// VerifyHistory). A Timestamp from an external timestamping service
+// proves that the attestation existed before a leak of Key itself (see
+// VerifyTimestamp).
+type ArchivalAttestation struct {
+	Epoch          merkletree.Epoch
+	ListRoot       hashed.Hash
+	DirInitSTRHash hashed.Hash
+	Key            sign.PublicKey
+	Signature      sign.Signature
+	// Timestamp is the token the Tree's Timestamper issued for Digest,
+	// if it has one.
+	Timestamp []byte `json:",omitempty"`
+}
+
+// A Timestamper obtains proof from an external timestamping service,
+// e.g. an RFC 3161 authority or a public ledger, that a digest existed
+// at the time it's called. A Tree calls its Timestamper from a goroutine
+// of its own after Update, so it may block, but must be safe for
+// concurrent use.
+type Timestamper interface {
+	// Timestamp returns the token that proves that digest exists now.
+	Timestamp(digest hashed.Hash) ([]byte, error)
+}
+
+// A TimestampVerifier verifies the token a Timestamper issued for digest,
+// and returns the time it proves digest existed at.
+type TimestampVerifier func(digest hashed.Hash, token []byte) (time.Time, error)
+
+// archivalAttestationPrefix separates the signed archival attestations
+// from other signed messages.
+var archivalAttestationPrefix = []byte("archival attestation")
+
+// Bytes serializes the attestation for signing by the directory.
+func (a *ArchivalAttestation) Bytes() []byte {
+	bs := append([]byte{}, archivalAttestationPrefix...)
+	bs = append(bs, a.Epoch.Bytes()...)
+	bs = append(bs, a.ListRoot[:]...)
+	bs = append(bs, a.DirInitSTRHash[:]...)
+	return appendFields(bs, a.Key)
+}
+
+// Digest returns the hash of the signed attestation, which its Timestamp
+// is issued for.
+func (a *ArchivalAttestation) Digest() hashed.Hash {
+	return hashed.Sum(a.Bytes(), a.Signature[:])
+}
+
+// VerifyHistory verifies that strs are the STRs of the epochs 0 through
+// a.Epoch that a attests to, and that a is signed with the current key of
+// the directory. strKey is the key the STRs are signed with, which may
+// have leaked since: the signature of each STR still has to verify, but
+// only the signatures a pins are accepted.
+//
+// It returns CheckBadSignature if a isn't signed with current or an STR
+// isn't signed with strKey, and CheckBadSTR if strs aren't a hash chain
+// from the genesis STR or aren't the history a attests to.
+func (a *ArchivalAttestation) VerifyHistory(strs []*SignedTreeRoot, strKey,
+	current sign.PublicKey) error {
+	if !bytes.Equal(a.Key, current) || !verifyWithKey(a.Key, a.Bytes(), a.Signature) {
+		return protocol.CheckBadSignature
+	}
+	if uint64(len(strs)) != uint64(a.Epoch)+1 || strs[0].VerifyGenesis(strKey) != nil {
+		return protocol.CheckBadSTR
+	}
+	var list merkletree.STRList
+	for i, str := range strs {
+		if i > 0 && (str.Epoch != strs[i-1].Epoch+1 || !str.VerifyHashChain(strs[i-1])) {
+			return protocol.CheckBadSTR
+		}
+		if !strKey.Verify(str.Bytes(), str.Signature[:]) {
+			return protocol.CheckBadSignature
+		}
+		list.Append(str.SignedTreeRoot)
+	}
+	if list.Root() != a.ListRoot || list.First() != a.DirInitSTRHash {
+		return protocol.CheckBadSTR
+	}
+	return nil
+}
+
+// VerifyTimestamp verifies that a has a Timestamp that proves that it
+// existed before notAfter, e.g. the time its Key or the key of the STRs
+// it attests to is known to have leaked. It returns ErrBadTimestamp if a
+// has no Timestamp, or verify rejects it, or it's too late.
+func (a *ArchivalAttestation) VerifyTimestamp(verify TimestampVerifier, notAfter time.Time) error {
+	if len(a.Timestamp) == 0 {
+		return ErrBadTimestamp
+	}
+	t, err := verify(a.Digest(), a.Timestamp)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadTimestamp, err)
+	}
+	if !t.Before(notAfter) {
+		return ErrBadTimestamp
+	}
+	return nil
+}
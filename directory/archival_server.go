@@ -0,0 +1,122 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"fmt"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+// ReattestHistory signs an ArchivalAttestation of the directory's STR
+// history up to the latest STR with its current signing key, and has the
+// Tree's Timestamper, if any, timestamp it. Like Rollup, it doesn't need the
+// older STRs. It returns ErrBadTimestamp if timestamping fails, and
+// otherwise keeps the attestation as the Tree's latest one.
+func (d *Tree) ReattestHistory() (*ArchivalAttestation, error) {
+	a := d.attestHistory()
+	if err := d.timestamp(a); err != nil {
+		return nil, err
+	}
+	d.setArchival(a)
+	return a, nil
+}
+
+// LatestArchivalAttestation returns the latest attestation
+// ReattestHistory or Update made, or nil if there is none. The
+// attestation Update made is only returned once it's timestamped.
+func (d *Tree) LatestArchivalAttestation() *ArchivalAttestation {
+	d.archivalMu.Lock()
+	defer d.archivalMu.Unlock()
+	return d.archival
+}
+
+// attestHistory returns the signed, but not timestamped, attestation of
+// the STR history up to the latest STR.
+func (d *Tree) attestHistory() *ArchivalAttestation {
+	root, first := d.pad.STRListRoot()
+	a := &ArchivalAttestation{
+		Epoch:          d.LatestSTR().Epoch,
+		ListRoot:       root,
+		DirInitSTRHash: first,
+		Key:            d.pad.PublicKey(),
+	}
+	a.Signature = d.pad.Sign(a.Bytes())
+	return a
+}
+
+// timestamp has the Tree's Timestamper, if any, timestamp a. It only uses
+// the Tree's options, so it may be called without holding the Tree.
+func (d *Tree) timestamp(a *ArchivalAttestation) error {
+	if d.timestamper == nil {
+		return nil
+	}
+	token, err := d.timestamper.Timestamp(a.Digest())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadTimestamp, err)
+	}
+	a.Timestamp = token
+	return nil
+}
+
+// setArchival keeps a as the latest attestation, unless one of a later
+// epoch was timestamped first.
+func (d *Tree) setArchival(a *ArchivalAttestation) {
+	d.archivalMu.Lock()
+	defer d.archivalMu.Unlock()
+	if d.archival == nil || a.Epoch >= d.archival.Epoch {
+		d.archival = a
+	}
+}
+
+// reattestIfDue re-attests the STR history if the Tree was opened
+// WithArchivalAttestation and the epoch of the latest STR is a multiple
+// of the interval. The attestation is timestamped by a goroutine of its
+// own, so that Update doesn't wait for the Timestamper while the Tree is
+// locked. A failed timestamp is reported to the watchdog and the
+// ArchivalMetrics, if any, and retried at the next interval, so until
+// then LatestArchivalAttestation returns the previous attestation.
+func (d *Tree) reattestIfDue() {
+	if d.archivalInterval == 0 || uint64(d.LatestSTR().Epoch)%d.archivalInterval != 0 {
+		return
+	}
+	a := d.attestHistory()
+	if d.timestamper == nil {
+		d.setArchival(a)
+		return
+	}
+	dirID := d.id()
+	d.timestamping.Add(1)
+	go func() {
+		defer d.timestamping.Done()
+		err := d.timestamp(a)
+		if err == nil {
+			d.setArchival(a)
+		}
+		if m, ok := d.metrics.(ArchivalMetrics); ok {
+			m.ObserveArchival(a, err)
+		}
+		if err != nil && d.watchdog != nil {
+			d.watchdog.failedTimestamp(dirID, a.Epoch, err)
+		}
+	}()
+}
+
+// failedTimestamp alerts that the archival attestation of epoch couldn't
+// be timestamped because of err.
+func (w *watchdog) failedTimestamp(dirID string, epoch merkletree.Epoch, err error) {
+	w.mu.Lock()
+	w.health.FailedTimestamps++
+	w.mu.Unlock()
+	_ = alert.Send(w.Alerts, &alert.Alert{
+		Kind:      alert.TimestampFailed,
+		Severity:  alert.Warning,
+		Time:      w.now(),
+		Directory: dirID,
+		Epoch:     epoch,
+		Message:   "the archival attestation of the STR history couldn't be timestamped",
+		Err:       err,
+	})
+}
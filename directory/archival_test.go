@@ -0,0 +1,155 @@
+package directory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+// testTimestamper issues tokens of the digest and an offset from now, or
+// fails, once it can receive from wait, if it isn't nil.
+type testTimestamper struct {
+	now  time.Time
+	fail bool
+	wait chan struct{}
+}
+
+func (ts *testTimestamper) Timestamp(digest hashed.Hash) ([]byte, error) {
+	if ts.wait != nil {
+		<-ts.wait
+	}
+	if ts.fail {
+		return nil, errors.New("unavailable")
+	}
+	token := append([]byte{}, digest[:]...)
+	return append(token, make([]byte, 8)...), nil
+}
+
+func verifyTestTimestamp(ts *testTimestamper) TimestampVerifier {
+	return func(digest hashed.Hash, token []byte) (time.Time, error) {
+		if len(token) != hashed.HashSizeByte+8 || !bytes.Equal(token[:hashed.HashSizeByte], digest[:]) {
+			return time.Time{}, errors.New("bad token")
+		}
+		return ts.now.Add(time.Duration(binary.BigEndian.Uint64(token[hashed.HashSizeByte:]))), nil
+	}
+}
+
+func TestArchivalAttestation(t *testing.T) {
+	ts := &testTimestamper{now: time.Unix(1e9, 0)}
+	key := crypto.NewStaticTestSigningKey()
+	d, err := Open(
+		WithSigningKey(key),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithArchivalAttestation(3, ts),
+	)
+	require.NoError(t, err)
+	assert.Nil(t, d.LatestArchivalAttestation())
+	strs := []*SignedTreeRoot{d.LatestSTR()}
+	for i := 0; i < 7; i++ {
+		strs = append(strs, mustUpdate(t, d).STR)
+	}
+	d.timestamping.Wait()
+	a := d.LatestArchivalAttestation()
+	require.NotNil(t, a)
+	assert.EqualValues(t, 6, a.Epoch)
+	assert.NotEmpty(t, a.Timestamp)
+
+	pk := key.Public()
+	history := strs[:7]
+	assert.NoError(t, a.VerifyHistory(history, pk, pk))
+
+	// the leaked key signs a different STR for epoch 2
+	forged := *history[2].SignedTreeRoot
+	forged.LeafCount++
+	copy(forged.Signature[:], key.Sign(forged.Bytes()))
+	forgedHistory := append([]*SignedTreeRoot{}, history...)
+	forgedHistory[2] = NewDirSTR(&forged)
+	assert.Equal(t, protocol.CheckBadSTR, a.VerifyHistory(forgedHistory, pk, pk))
+	// even if the rest of the chain is re-signed to match it
+	for i := 3; i < len(forgedHistory); i++ {
+		next := *forgedHistory[i].SignedTreeRoot
+		next.PreviousSTRHash = hashed.Sum(forgedHistory[i-1].Signature[:])
+		copy(next.Signature[:], key.Sign(next.Bytes()))
+		forgedHistory[i] = NewDirSTR(&next)
+	}
+	assert.Equal(t, protocol.CheckBadSTR, a.VerifyHistory(forgedHistory, pk, pk))
+	assert.Equal(t, protocol.CheckBadSTR, a.VerifyHistory(history[:6], pk, pk))
+
+	other, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.CheckBadSignature, a.VerifyHistory(history, pk, other.Public()))
+
+	verify := verifyTestTimestamp(ts)
+	assert.NoError(t, a.VerifyTimestamp(verify, ts.now.Add(time.Second)))
+	assert.True(t, errors.Is(a.VerifyTimestamp(verify, ts.now), ErrBadTimestamp))
+	stamped := *a
+	stamped.Epoch++
+	assert.True(t, errors.Is(stamped.VerifyTimestamp(verify, ts.now.Add(time.Second)), ErrBadTimestamp))
+
+	// a failed timestamp keeps the previous attestation
+	ts.fail = true
+	_, err = d.ReattestHistory()
+	assert.True(t, errors.Is(err, ErrBadTimestamp))
+	assert.Equal(t, a, d.LatestArchivalAttestation())
+}
+
+// archivalMetrics records the errors of the archival attestations it
+// observes.
+type archivalMetrics struct {
+	epochFunc
+	mu   sync.Mutex
+	errs []error
+}
+
+func (m *archivalMetrics) ObserveArchival(a *ArchivalAttestation, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs = append(m.errs, err)
+}
+
+func TestArchivalTimestampFailures(t *testing.T) {
+	alerts := new(alertRecorder)
+	metrics := &archivalMetrics{epochFunc: func(*EpochReport) {}}
+	ts := &testTimestamper{fail: true, wait: make(chan struct{})}
+	d := openWatched(t, WatchdogConfig{Alerts: alerts}, nil,
+		WithMetrics(metrics), WithArchivalAttestation(2, ts))
+
+	// Update doesn't wait for the timestamper
+	mustUpdate(t, d)
+	mustUpdate(t, d)
+	close(ts.wait)
+	d.timestamping.Wait()
+	assert.Nil(t, d.LatestArchivalAttestation())
+	require.Len(t, metrics.errs, 1)
+	assert.True(t, errors.Is(metrics.errs[0], ErrBadTimestamp))
+	require.Equal(t, 1, alerts.len())
+	assert.Equal(t, alert.TimestampFailed, alerts.alerts[0].Kind)
+	assert.EqualValues(t, 2, alerts.alerts[0].Epoch)
+	health := d.Health()
+	assert.True(t, health.Healthy)
+	assert.Equal(t, uint64(1), health.FailedTimestamps)
+
+	// the next interval is retried
+	ts.fail = false
+	mustUpdate(t, d)
+	mustUpdate(t, d)
+	d.timestamping.Wait()
+	require.NotNil(t, d.LatestArchivalAttestation())
+	assert.EqualValues(t, 4, d.LatestArchivalAttestation().Epoch)
+	require.Len(t, metrics.errs, 2)
+	assert.NoError(t, metrics.errs[1])
+	assert.Equal(t, 1, alerts.len())
+	assert.Equal(t, uint64(1), d.Health().FailedTimestamps)
+}
@@ -0,0 +1,34 @@
+package directory
+
+import "github.com/ORBAT/cloniks/crypto/sign"
+
+// An Attestation is an auditor's signature of the AttestationBytes of
+// a Rollup or an STR, with which the auditor with the public key Auditor
+// vouches for it to clients that don't check the directory's STR
+// history themselves:
+//
+// - for a Rollup, the auditor asserts that the directory's STR history
+// it observed up to the rollup's STR is linear, and is what the rollup's
+// ListRoot commits to.
+// - for an STR, the auditor asserts that the STR is part of the linear
+// STR history it observed, i.e. that it saw no other STR for its epoch.
+type Attestation struct {
+	Auditor   sign.PublicKey
+	Signature sign.Signature
+}
+
+// rollupAttestationPrefix and strAttestationPrefix separate the
+// attestations from each other and from other signed messages.
+var (
+	rollupAttestationPrefix = []byte("rollup attestation")
+	strAttestationPrefix    = []byte("str attestation")
+)
+
+// AttestationBytes serializes the signed STR for signing by an auditor.
+// See Attestation.
+func (str *SignedTreeRoot) AttestationBytes() []byte {
+	bs := append([]byte{}, strAttestationPrefix...)
+	bs = append(bs, str.Bytes()...)
+	bs = append(bs, str.Signature[:]...)
+	return bs
+}
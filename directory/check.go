@@ -0,0 +1,216 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// The names of the checks of Tree.Check.
+const (
+	// CheckStorage checks the invariants of the trees the Tree retains in
+	// memory or its NodeStore (see merkletree.PAD.CheckInvariants).
+	CheckStorage = "storage"
+	// CheckSTRChain verifies the signatures and the hash chain of the
+	// STRs the Tree retains, following its key rotations.
+	CheckSTRChain = "str-chain"
+	// CheckPromises audits the temporary bindings issued in the current
+	// epoch: each must be signed by the Tree, over the latest STR, and
+	// its binding must be in the pending tree, so that the next snapshot
+	// fulfills it.
+	CheckPromises = "promises"
+	// CheckProofs verifies the proofs of a sample of the names bound in
+	// the latest snapshot, and of a name that isn't, against its STR.
+	CheckProofs = "proofs"
+)
+
+// A CheckResult is the result of one of the checks of Tree.Check:
+// Checked is the number of trees, STRs, promises or proofs it checked,
+// and Error describes the first failure, if any.
+type CheckResult struct {
+	Name    string
+	Checked int
+	Error   string `json:",omitempty"`
+	Took    time.Duration
+}
+
+// A CheckReport is the result of Tree.Check, in the latest epoch. It can
+// be encoded as JSON, e.g. for scheduled integrity checks.
+type CheckReport struct {
+	Epoch  merkletree.Epoch
+	Checks []CheckResult
+}
+
+// OK returns true iff none of the checks of r failed.
+func (r *CheckReport) OK() bool {
+	return len(r.Failed()) == 0
+}
+
+// Failed returns the names of the checks of r that failed.
+func (r *CheckReport) Failed() []string {
+	var failed []string
+	for _, c := range r.Checks {
+		if c.Error != "" {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+// Check runs every integrity check of the Tree on the epochs it retains
+// (see CheckStorage, CheckSTRChain, CheckPromises and CheckProofs), and
+// reports the results. CheckProofs samples up to samples names, chosen
+// with rnd, or with the default source if rnd is nil. Check takes time
+// linear in the size of the retained trees. It's meant for operators,
+// not part of the protocol, and like the Tree, it must not be used
+// concurrently with the Tree's updates.
+func (d *Tree) Check(samples int, rnd *rand.Rand) *CheckReport {
+	report := &CheckReport{Epoch: d.LatestSTR().Epoch}
+	for _, c := range []struct {
+		name string
+		run  func() (int, error)
+	}{
+		{CheckStorage, d.pad.CheckInvariants},
+		{CheckSTRChain, d.checkSTRChain},
+		{CheckPromises, d.checkPromises},
+		{CheckProofs, func() (int, error) { return d.checkProofs(samples, rnd) }},
+	} {
+		start := time.Now()
+		n, err := runCheck(c.run)
+		res := CheckResult{Name: c.name, Checked: n, Took: time.Since(start)}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		report.Checks = append(report.Checks, res)
+	}
+	return report
+}
+
+// runCheck runs a check, turning a panic, e.g. of a merkletree that
+// fails ErrInvalidTree, into its failure. Checks only read the Tree, so
+// a panicking one can't leave it half-changed.
+func runCheck(run func() (int, error)) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run()
+}
+
+// checkSTRChain verifies the STRs the Tree retains in a row up to the
+// latest one, from the latest back: each must commit to the STR before
+// it, and be signed with the key of its epoch. That's the Tree's key for
+// the latest STR, and for the others the key of the STR after them,
+// unless they announce a rotation to that key, in which case it's the
+// rotation's OldKey.
+func (d *Tree) checkSTRChain() (int, error) {
+	str := d.LatestSTR()
+	key := d.PublicKey()
+	checked := 0
+	for {
+		if !key.Verify(str.Bytes(), str.Signature[:]) {
+			return checked, fmt.Errorf("epoch %d: %w", str.Epoch, merkletree.ErrBadSTRSignature)
+		}
+		checked++
+		if str.Epoch == 0 {
+			return checked, nil
+		}
+		prev := d.pad.GetSTR(str.Epoch - 1)
+		if prev == nil {
+			return checked, nil
+		}
+		prevSTR := NewDirSTR(prev)
+		if !str.VerifyHashChain(prevSTR) {
+			return checked, fmt.Errorf("epoch %d: %w", str.Epoch, merkletree.ErrBrokenSTRChain)
+		}
+		if prevSTR.Policies == nil {
+			return checked, nil
+		}
+		if r := prevSTR.Policies.KeyRotation; r != nil && r.Epoch == str.Epoch {
+			if !bytes.Equal(r.NewKey, key) {
+				return checked, fmt.Errorf("epoch %d: %w: the key doesn't follow the rotation",
+					str.Epoch, merkletree.ErrBadSTRSignature)
+			}
+			key = r.OldKey
+		}
+		str = prevSTR
+	}
+}
+
+// checkPromises audits the temporary bindings of the current epoch.
+func (d *Tree) checkPromises() (int, error) {
+	strSig := d.LatestSTR().Signature
+	key := d.PublicKey()
+	checked := 0
+	for name, tb := range d.tbs {
+		if !key.Verify(tb.Bytes(strSig), tb.Signature[:]) {
+			return checked, fmt.Errorf("promise for %q: invalid signature", name)
+		}
+		ap, _, err := d.pad.LookupPending([]byte(name))
+		if err != nil {
+			return checked, fmt.Errorf("promise for %q: %w", name, err)
+		}
+		if ap.ProofType() != merkletree.ProofOfInclusion || !bytes.Equal(ap.LookupIndex, tb.Index) ||
+			!bytes.Equal(ap.Leaf.Value, tb.Value) {
+			return checked, fmt.Errorf("promise for %q: the pending tree doesn't bind the promised value", name)
+		}
+		checked++
+	}
+	return checked, nil
+}
+
+// checkProofs verifies the proofs of up to samples names bound in the
+// latest snapshot, chosen uniformly with rnd, and of one that isn't, like
+// a client would: against the STR, and with the lookup index of the name
+// under the STR's policies.
+func (d *Tree) checkProofs(samples int, rnd *rand.Rand) (int, error) {
+	intn := rand.Intn
+	if rnd != nil {
+		intn = rnd.Intn
+	}
+	type binding struct{ key, value []byte }
+	sample := make([]binding, 0, samples)
+	seen := 0
+	latest := d.latest()
+	// reservoir sampling, since the number of bindings isn't known
+	if err := latest.Iterate(func(key, value []byte) bool {
+		seen++
+		switch {
+		case len(sample) < samples:
+			sample = append(sample, binding{key, value})
+		case samples > 0:
+			if i := intn(seen); i < samples {
+				sample[i] = binding{key, value}
+			}
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	// a reserved name can't be bound
+	sample = append(sample, binding{key: []byte(fmt.Sprintf("\x00check%d", intn(1<<30)))})
+
+	str := NewDirSTR(latest.STR())
+	checked := 0
+	for _, b := range sample {
+		ap, err := latest.Get(b.key)
+		if err != nil {
+			return checked, fmt.Errorf("proof for %q: %w", b.key, err)
+		}
+		if str.Policies != nil && !str.Policies.VerifyIndex(b.key, ap.LookupIndex, ap.VrfProof) {
+			return checked, fmt.Errorf("proof for %q: invalid lookup index", b.key)
+		}
+		if err := ap.VerifyBinding(str.TreeHash[:], ap.TreeNonce, ap.LookupIndex, b.key, b.value); err != nil {
+			return checked, fmt.Errorf("proof for %q: %w", b.key, err)
+		}
+		checked++
+	}
+	return checked, nil
+}
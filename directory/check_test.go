@@ -0,0 +1,51 @@
+package directory
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+)
+
+func checked(r *CheckReport) map[string]int {
+	m := make(map[string]int)
+	for _, c := range r.Checks {
+		m[c.Name] = c.Checked
+	}
+	return m
+}
+
+func TestTree_Check(t *testing.T) {
+	d, err := New(crypto.NewStaticTestVRFKey(), crypto.NewStaticTestSigningKey(), 10)
+	require.NoError(t, err)
+	newKey, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	require.NoError(t, d.ScheduleKeyRotation(newKey, 3))
+	for i, name := range []string{"alice", "bob", "carol", "dave"} {
+		_, err := d.Register(name, []byte("key"))
+		require.NoError(t, err)
+		if i < 3 {
+			d.Update()
+		}
+	}
+
+	r := d.Check(2, rand.New(rand.NewSource(1)))
+	require.True(t, r.OK(), "%+v", r)
+	assert.Equal(t, d.LatestSTR().Epoch, r.Epoch)
+	assert.Equal(t, map[string]int{
+		CheckStorage:  5, // the 4 snapshots and the pending tree
+		CheckSTRChain: 4,
+		CheckPromises: 1,
+		CheckProofs:   3,
+	}, checked(r))
+
+	d.tbs["dave"].Value = []byte("other key")
+	d.pad.GetSTR(1).Signature[0] ^= 1
+	r = d.Check(2, nil)
+	assert.Equal(t, []string{CheckSTRChain, CheckPromises}, r.Failed())
+	assert.Equal(t, 2, checked(r)[CheckSTRChain])
+}
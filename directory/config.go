@@ -1,6 +1,9 @@
 package directory
 
 import (
+	"encoding/json"
+
+	"github.com/ORBAT/cloniks/conv"
 	"github.com/ORBAT/cloniks/crypto/hashed"
 	"github.com/ORBAT/cloniks/crypto/vrf"
 	"github.com/ORBAT/cloniks/merkletree"
@@ -8,12 +11,100 @@ import (
 )
 
 // Config is the configuration for a directory tree. This includes the public part of the VRF key
-// used to generate private indices, the cryptographic algorithms in use, as well as the protocol
-// version number.
+// used to generate private indices, the size of the private indices, the cryptographic algorithms
+// in use, as well as the protocol version number.
 type Config struct {
 	Version        []byte
 	HashID         []byte
 	VrfPublicKey   vrf.PublicKey
+	// IndexSize is the size of private indices in bytes. Indices are the VRF output truncated to
+	// IndexSize bytes.
+	IndexSize      uint32
+	// IndexHashKey is set if the directory computes indices with a keyed hash instead of the VRF
+	// (see merkletree.HashIndexer), and is the hash key. VrfPublicKey is unused in that case.
+	IndexHashKey []byte `json:",omitempty"`
+	// Stats is set if the directory publishes the ActivityStats of every epoch, and has those of
+	// the epoch of the STR.
+	Stats *ActivityStats `json:",omitempty"`
+	// Namespaces maps the namespaces whose keys are indexed with their own VRF key to its public
+	// key (see Namespace). Keys in other namespaces are indexed with VrfPublicKey.
+	Namespaces map[string]vrf.PublicKey `json:",omitempty"`
+	// NextUpdate is set if the directory ends its epochs on a schedule (see Tree.Run), and is when
+	// the epoch of the STR is scheduled to end, in Unix nanoseconds. Clients may use the results
+	// they verified against the STR until then without asking the directory again.
+	NextUpdate int64 `json:",omitempty"`
+	// MinKeyChangeInterval is the minimum number of epochs between two changes of a user's key
+	// (see KeyTransition), or zero if there is none. The directory rejects earlier changes, and
+	// clients verify that it did, so that a hijacker can't quickly replace a key even with the
+	// directory's help.
+	MinKeyChangeInterval uint64 `json:",omitempty"`
+	// DeletionQuarantine is the number of epochs after the deletion of a binding (see Deletion)
+	// during which the name can't be bound to a different key, or zero if there is none. Clients
+	// verify it against the tombstone of the binding, so that nobody can take over a name right
+	// after its owner deleted it, even with the directory's help.
+	DeletionQuarantine uint64 `json:",omitempty"`
+	// ReattestationInterval is the number of epochs after which a binding expires unless its
+	// owner re-attests it (see Reattestation), or zero if bindings don't expire. Clients verify
+	// the expiry against the latest re-attestation of the binding.
+	ReattestationInterval uint64 `json:",omitempty"`
+	// MaxChangesPerEpoch is the number of times a name may be bound to a key in one epoch (see
+	// Tree.Register), or zero for the default of once. If it's more than one, the temporary binding
+	// of a later registration in the epoch supersedes that of an earlier one, so clients only verify
+	// that a promised name is bound at the promised index in the next snapshot, not to which of the
+	// keys promised for it.
+	MaxChangesPerEpoch uint64 `json:",omitempty"`
+	// Capabilities are the optional features the directory supports, so that clients can detect
+	// them without trial and error. Clients verify that no capability disappears from one STR to
+	// the next unless the later one flags a PolicyChange.
+	Capabilities Capabilities `json:",omitempty"`
+	// PolicyChange is set in the STR of an epoch in which the directory withdrew capabilities
+	// (see Tree.SetCapabilities) or withdrew or changed an announced Upgrade or KeyRotation, and
+	// only in that one.
+	PolicyChange bool `json:",omitempty"`
+	// Upgrade is set if the directory announced that it switches to another protocol version at
+	// a later epoch (see Tree.ScheduleUpgrade). Clients verify that the version changes exactly
+	// at that epoch, and never without an announcement.
+	Upgrade *Upgrade `json:",omitempty"`
+	// Schedule holds the changes of the directory's policies it announced for later epochs (see
+	// Tree.SchedulePolicy), ordered by epoch. Clients verify that the policies change exactly at
+	// those epochs, and that announcements are only withdrawn or changed in an STR that flags
+	// a PolicyChange.
+	Schedule []*PolicyUpdate `json:",omitempty"`
+	// Operators is set if the directory is co-managed by several parties (see Tree.SetOperators),
+	// and is the policy that governs the publication of the next STR. Clients verify that every STR
+	// has the Approvals that the policy of the STR before it requires, or if that has none, its own.
+	Operators *Operators `json:",omitempty"`
+	// Approvals are the operators' approvals of the STR, if the directory is co-managed (see
+	// Tree.Approve).
+	Approvals []*Approval `json:",omitempty"`
+	// KeyRotation is set if the directory announced that it signs its STRs with another key from
+	// a later epoch on (see Tree.ScheduleKeyRotation). Clients verify that the key changes exactly
+	// at that epoch, and follow the rotation only if the new key signed the announcement.
+	KeyRotation *KeyRotation `json:",omitempty"`
+}
+
+// Capabilities is a set of optional directory features.
+type Capabilities uint32
+
+const (
+	// CapBatchLookup indicates that the directory answers batches of key lookups.
+	CapBatchLookup Capabilities = 1 << iota
+	// CapStreamingHistory indicates that the directory streams its STR history.
+	CapStreamingHistory
+	// CapKeyChange indicates that the directory accepts key transitions (see KeyTransition).
+	CapKeyChange
+	// CapDeletion indicates that the directory deletes bindings on request.
+	CapDeletion
+)
+
+// Has returns true iff c includes all the capabilities in want.
+func (c Capabilities) Has(want Capabilities) bool {
+	return c&want == want
+}
+
+// Withdrawn returns the capabilities in c that aren't in next.
+func (c Capabilities) Withdrawn(next Capabilities) Capabilities {
+	return c &^ next
 }
 
 var _ merkletree.AssocData = (*Config)(nil)
@@ -22,26 +113,190 @@ var versionBs = []byte(protocol.Version)
 
 var hashBs = []byte(hashed.HashID)
 
-// NewConfig returns a new Config with the given public VRF key.
+// NewConfig returns a new Config with the given public VRF key and the default index size.
 func NewConfig(vrfPublicKey vrf.PublicKey) *Config {
 	return &Config{
 		Version:        versionBs,
 		HashID:         hashBs,
 		VrfPublicKey:   vrfPublicKey,
+		IndexSize:      merkletree.DefaultIndexSize,
 	}
 }
 
+// NewHashIndexConfig returns a new Config for a directory that computes indices with a keyed hash
+// with the key hashKey, and the default index size.
+func NewHashIndexConfig(hashKey []byte) *Config {
+	c := NewConfig(nil)
+	c.IndexHashKey = hashKey
+	return c
+}
+
+// hashIndexTag marks the hash key in serialized configs.
+var hashIndexTag = []byte("hash index")
+
+// nextUpdateTag marks the time of the next update in serialized configs.
+var nextUpdateTag = []byte("next update")
+
+// minKeyChangeIntervalTag marks the minimum key change interval in serialized configs.
+var minKeyChangeIntervalTag = []byte("min key change interval")
+
+// deletionQuarantineTag marks the deletion quarantine in serialized configs.
+var deletionQuarantineTag = []byte("deletion quarantine")
+
+// reattestationIntervalTag marks the re-attestation interval in serialized configs.
+var reattestationIntervalTag = []byte("reattestation interval")
+
+// maxChangesPerEpochTag marks the maximum number of changes per epoch in serialized configs.
+var maxChangesPerEpochTag = []byte("max changes per epoch")
+
+// capabilitiesTag marks the capabilities in serialized configs.
+var capabilitiesTag = []byte("capabilities")
+
+// policyChangeTag marks a flagged policy change in serialized configs.
+var policyChangeTag = []byte("policy change")
+
+// upgradeTag marks an announced upgrade in serialized configs.
+var upgradeTag = []byte("upgrade")
+
+// keyRotationTag marks an announced signing key rotation in serialized configs.
+var keyRotationTag = []byte("key rotation")
+
+// scheduleTag marks the announced policy changes in serialized configs.
+var scheduleTag = []byte("policy schedule")
+
 // Bytes serializes the config for signing the tree root. Default config serialization includes the
-// library version, the cryptographic algorithms in use (i.e., the hashing algorithm) and the public
-// part of the VRF key.
+// library version, the cryptographic algorithms in use (i.e., the hashing algorithm), the public
+// part of the VRF key and the index size. Configs with a hash index also include the hash key,
+// those with namespace VRF keys the keys, those with activity stats the stats, those with
+// a NextUpdate the time, those with a MinKeyChangeInterval the interval, those with
+// a DeletionQuarantine the quarantine, those with a ReattestationInterval the interval, those with
+// a MaxChangesPerEpoch the maximum, those with Capabilities the capabilities, those with
+// a PolicyChange a tag, those with an Upgrade the announced version and epoch, those with
+// a Schedule the announced policy changes, those with Operators the operator policy, those with
+// Approvals the approvals, and those with a KeyRotation the announced rotation and the new key's
+// signature of it. That is the serialization of protocol.Version; configs of other versions are
+// serialized the way their version defines (see encodings).
 func (p *Config) Bytes() []byte {
+	if encode, ok := encodings[string(p.Version)]; ok {
+		return encode(p)
+	}
+	return p.bytes()
+}
+
+// bytes is the serialization of configs of protocol.Version.
+func (p *Config) bytes() []byte {
 	bs := make([]byte, 0, len(p.Version) + len(p.HashID) + len(p.VrfPublicKey) + 8)
 	bs = append(bs, p.Version...)                                   // protocol version
 	bs = append(bs, p.HashID...)                                    // cryptographic algorithms in use
 	bs = append(bs, p.VrfPublicKey...)                              // vrf public key
+	bs = append(bs, conv.UInt32ToBytes(p.IndexSize)...)             // index size
+	if p.IndexHashKey != nil {
+		bs = append(bs, hashIndexTag...)
+		bs = append(bs, p.IndexHashKey...)
+	}
+	if len(p.Namespaces) > 0 {
+		bs = append(bs, p.namespacesBytes()...)
+	}
+	if p.Stats != nil {
+		bs = append(bs, p.Stats.Bytes()...)
+	}
+	if p.NextUpdate != 0 {
+		bs = append(bs, nextUpdateTag...)
+		bs = append(bs, conv.LongToBytes(p.NextUpdate)...)
+	}
+	if p.MinKeyChangeInterval != 0 {
+		bs = append(bs, minKeyChangeIntervalTag...)
+		bs = append(bs, conv.ULongToBytes(p.MinKeyChangeInterval)...)
+	}
+	if p.DeletionQuarantine != 0 {
+		bs = append(bs, deletionQuarantineTag...)
+		bs = append(bs, conv.ULongToBytes(p.DeletionQuarantine)...)
+	}
+	if p.ReattestationInterval != 0 {
+		bs = append(bs, reattestationIntervalTag...)
+		bs = append(bs, conv.ULongToBytes(p.ReattestationInterval)...)
+	}
+	if p.MaxChangesPerEpoch != 0 {
+		bs = append(bs, maxChangesPerEpochTag...)
+		bs = append(bs, conv.ULongToBytes(p.MaxChangesPerEpoch)...)
+	}
+	if p.Capabilities != 0 {
+		bs = append(bs, capabilitiesTag...)
+		bs = append(bs, conv.UInt32ToBytes(uint32(p.Capabilities))...)
+	}
+	if p.PolicyChange {
+		bs = append(bs, policyChangeTag...)
+	}
+	if p.Upgrade != nil {
+		bs = append(bs, upgradeTag...)
+		bs = append(bs, p.Upgrade.Bytes()...)
+	}
+	if len(p.Schedule) > 0 {
+		bs = append(bs, p.scheduleBytes()...)
+	}
+	if p.Operators != nil {
+		bs = append(bs, p.Operators.Bytes()...)
+	}
+	if len(p.Approvals) > 0 {
+		bs = append(bs, p.approvalsBytes()...)
+	}
+	if p.KeyRotation != nil {
+		bs = append(bs, keyRotationTag...)
+		bs = append(bs, p.KeyRotation.Bytes()...)
+		bs = append(bs, p.KeyRotation.Signature[:]...)
+	}
 	return bs
 }
 
+// hashIndexer returns the indexer for a directory using the hash index declared in p, or nil if
+// the directory uses the VRF.
+func (p *Config) hashIndexer() *merkletree.HashIndexer {
+	if p.IndexHashKey == nil {
+		return nil
+	}
+	return &merkletree.HashIndexer{Key: p.IndexHashKey}
+}
+
+// VerifyIndex returns true iff index is the lookup index of key, truncated to p.IndexSize bytes,
+// under the index function declared in p. proof is the index proof from the key's authentication
+// path, i.e. the VRF proof unless p declares a hash index. The VRF proof is verified with the key
+// of key's namespace, if p declares one.
+func (p *Config) VerifyIndex(key, index, proof []byte) bool {
+	if len(index) != int(p.IndexSize) {
+		return false
+	}
+	if ix := p.hashIndexer(); ix != nil {
+		return len(proof) == 0 && ix.Verify(key, index)
+	}
+	return p.VRFKeyFor(key).VerifyTruncated(key, index, proof)
+}
+
+// ConfigType is the type ID that Config is registered under as the
+// associated data of STRs (see merkletree.RegisterAssocData), so that
+// merkletree.UnmarshalSTR reconstructs their policies.
+const ConfigType = "coniks.directory.Config"
+
+func init() {
+	merkletree.RegisterAssocData(ConfigType, DecodeConfig)
+}
+
+// AssocDataType returns ConfigType. It makes a Config
+// a merkletree.TypedAssocData.
+func (p *Config) AssocDataType() string {
+	return ConfigType
+}
+
+// DecodeConfig parses the JSON encoding of a Config, e.g. the policies
+// of an STR loaded from a merkletree.STRStore. It's
+// a merkletree.AssocDataDecoder.
+func DecodeConfig(data []byte) (merkletree.AssocData, error) {
+	p := new(Config)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
 // GetConfig returns the Config included in the STR.
 func GetConfig(str *merkletree.SignedTreeRoot) *Config {
 	return str.Ad.(*Config)
@@ -0,0 +1,87 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// deletionSuffix follows the username in the name of the leaf that
+// stores the tombstone of the user's deleted binding. See
+// transitionSuffix.
+const deletionSuffix = "\x00deletion"
+
+var (
+	// ErrBadDeletion is wrapped by the errors of Delete for deletions the
+	// Tree can't accept.
+	ErrBadDeletion = errors.New("[directory] Invalid deletion")
+	// ErrQuarantined is wrapped by the errors of Register for deleted
+	// names whose quarantine hasn't ended yet.
+	ErrQuarantined = errors.New("[directory] Name is quarantined after deletion")
+)
+
+// DeletionName returns the name of the leaf in which the tombstone of
+// the deleted binding of username is stored.
+func DeletionName(username string) string {
+	return username + deletionSuffix
+}
+
+// A Deletion is a user's signed request to delete the binding of
+// Username to Key as of Epoch. It's signed with Key.
+//
+// Deletion is soft: the directory keeps the binding, stores the Deletion
+// as its tombstone in the leaf DeletionName(Username) from Epoch on, and
+// attaches it to the responses to key lookups of Username while Username
+// is bound to Key, starting immediately, and to the monitoring responses
+// that include the binding. A client that monitors Username accepts the
+// binding's absence from the snapshots from Epoch on if they come with
+// its tombstone. The deleted key can never be
+// bound to Username again, and a different one only DeletionQuarantine
+// epochs after Epoch (see Config), so that nobody can take over the name
+// right after its owner deleted it.
+type Deletion struct {
+	Username  string
+	Key       []byte
+	Epoch     merkletree.Epoch
+	Signature sign.Signature
+}
+
+// deletionPrefix separates the signed deletions from other signed
+// messages.
+var deletionPrefix = []byte("deletion")
+
+// Bytes serializes the deletion for signing.
+func (del *Deletion) Bytes() []byte {
+	bs := appendFields(append([]byte{}, deletionPrefix...), []byte(del.Username), del.Key)
+	return append(bs, del.Epoch.Bytes()...)
+}
+
+// Sign signs the deletion with key, which must be the private key of
+// del.Key.
+func (del *Deletion) Sign(key sign.PrivateKey) {
+	copy(del.Signature[:], key.Sign(del.Bytes()))
+}
+
+// Deletes returns true iff del is a validly signed deletion of the
+// binding of username to key.
+func (del *Deletion) Deletes(username string, key []byte) bool {
+	return del.Username == username && bytes.Equal(del.Key, key) &&
+		verifyWithKey(del.Key, del.Bytes(), del.Signature)
+}
+
+// QuarantineEnd returns the first epoch in which the name del deleted
+// may be bound to a different key, under the policies p.
+func (del *Deletion) QuarantineEnd(p *Config) merkletree.Epoch {
+	return del.Epoch + merkletree.Epoch(p.DeletionQuarantine)
+}
+
+// A DeletionRequest is a message with a Deletion that a CONIKS client
+// sends to the directory to delete its user's binding. See Tree.Delete.
+//
+// The response to a successful request has the error code ReqSuccess
+// and no DirectoryResponse.
+type DeletionRequest struct {
+	Deletion *Deletion
+}
@@ -0,0 +1,105 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// Delete deletes the binding del deletes, which becomes part of the
+// snapshot taken at the end of the current epoch. See Deletion.
+//
+// It returns an error wrapping ErrBadDeletion if del isn't signed by
+// del.Key, if del.Key isn't bound to del.Username in the latest snapshot
+// or has a pending key transition, or if del.Epoch isn't the current
+// epoch, i.e. the one after the latest snapshot. Like Register, it
+// returns ErrReadOnly if the Tree is in read-only mode.
+func (d *Tree) Delete(del *Deletion) error {
+	if len(del.Username) == 0 || len(del.Key) == 0 {
+		return ErrNoKeyOrValue
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	if !del.Deletes(del.Username, del.Key) {
+		return fmt.Errorf("%w: bad signature", ErrBadDeletion)
+	}
+	latest := d.latest()
+	if del.Epoch != latest.STR().Epoch+1 {
+		return fmt.Errorf("%w: epoch %d isn't the current one", ErrBadDeletion, del.Epoch)
+	}
+	ap, err := latest.Get([]byte(del.Username))
+	if err != nil {
+		return err
+	}
+	if ap.ProofType() != merkletree.ProofOfInclusion || !bytes.Equal(ap.Leaf.Value, del.Key) ||
+		d.tbs[del.Username] != nil {
+		return fmt.Errorf("%w: %s isn't bound to the key", ErrBadDeletion, del.Username)
+	}
+	if d.transitions[del.Username] != nil {
+		return fmt.Errorf("%w: %s has a pending key transition", ErrBadDeletion, del.Username)
+	}
+
+	value, err := json.Marshal(del)
+	if err != nil {
+		return err
+	}
+	if err := d.pad.Set([]byte(DeletionName(del.Username)), value); err != nil {
+		return fmt.Errorf("setting value in PAD: %w", err)
+	}
+	d.deletions[del.Username] = del
+	return nil
+}
+
+// checkReregistration returns an error if value can't be bound to the
+// name deleted by del in epoch: one wrapping ErrRejected for the deleted
+// key, which never can, and one wrapping ErrQuarantined for other keys
+// before the quarantine has ended.
+func (d *Tree) checkReregistration(del *Deletion, value []byte, epoch merkletree.Epoch) error {
+	if bytes.Equal(del.Key, value) {
+		return fmt.Errorf("%w: the key of %s was deleted", ErrRejected, del.Username)
+	}
+	if end := del.QuarantineEnd(d.config); epoch < end {
+		return fmt.Errorf("%w: until epoch %d", ErrQuarantined, end)
+	}
+	return nil
+}
+
+// withDeletion attaches the tombstone of the binding of username to key,
+// the key res binds username to, to res if it has been deleted.
+func (d *Tree) withDeletion(res *Response, username string, key []byte) *Response {
+	if del := d.deletions[username]; del != nil && bytes.Equal(del.Key, key) {
+		res.DirectoryResponse.(*DirectoryProof).Deletion = del
+	}
+	return res
+}
+
+// HandleDeletion deletes the binding the Deletion in the DeletionRequest
+// req received from a CONIKS client deletes, and returns the response to
+// be sent back to the client. A request without a deletion, username or
+// key is considered malformed, and causes HandleDeletion() to return
+// a NewErrorResponse(ErrMalformedMessage). A deletion the Tree doesn't
+// accept causes it to return a NewErrorResponse(ReqRejected), and any
+// other error a NewErrorResponse(ErrDirectory).
+func (d *Tree) HandleDeletion(req *DeletionRequest) *Response {
+	if req.Deletion == nil {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+	switch err := d.Delete(req.Deletion); {
+	case err == nil:
+		return NewErrorResponse(protocol.ReqSuccess)
+	case err == ErrNoKeyOrValue:
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	case errors.Is(err, ErrBadDeletion):
+		return NewErrorResponse(protocol.ReqRejected)
+	default:
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
+}
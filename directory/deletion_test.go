@@ -0,0 +1,115 @@
+package directory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// newDeletion returns a deletion of the binding of alice to the public
+// key of key in epoch, signed with key.
+func newDeletion(key sign.PrivateKey, epoch merkletree.Epoch) *Deletion {
+	del := &Deletion{Username: "alice", Key: key.Public(), Epoch: epoch}
+	del.Sign(key)
+	return del
+}
+
+func TestDeletion(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithDeletionQuarantine(3),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), d.LatestSTR().Policies.DeletionQuarantine)
+	key, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = d.Register("alice", key.Public())
+	require.NoError(t, err)
+	assert.True(t, errors.Is(d.Delete(newDeletion(key, 1)), ErrBadDeletion), "pending binding")
+	d.Update()
+	ep := d.LatestSTR().Epoch
+
+	other, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	forged := newDeletion(key, ep+1)
+	forged.Epoch++
+	for name, del := range map[string]*Deletion{
+		"bad signature": forged,
+		"past epoch":    newDeletion(key, ep),
+		"wrong key":     newDeletion(other, ep+1),
+	} {
+		assert.True(t, errors.Is(d.Delete(del), ErrBadDeletion), name)
+	}
+
+	del := newDeletion(key, ep+1)
+	res := d.HandleRequest(&Request{Type: DeletionType, Request: &DeletionRequest{Deletion: del}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	lookup := func() *DirectoryProof {
+		res := d.KeyLookup(&KeyLookupRequest{Username: "alice"})
+		require.Equal(t, protocol.ReqSuccess, res.Error)
+		return res.DirectoryResponse.(*DirectoryProof)
+	}
+	// lookups carry the tombstone right away, and the next snapshot
+	// commits to it
+	assert.Equal(t, del, lookup().Deletion)
+	d.Update()
+	ap := mustLookup(t, d, DeletionName("alice"))
+	require.Equal(t, merkletree.ProofOfInclusion, ap.ProofType())
+	assert.Equal(t, del, lookup().Deletion)
+	monitor := func() *DirectoryProof {
+		res := d.Monitor(&MonitoringRequest{Username: "alice", StartEpoch: ep, EndEpoch: d.LatestSTR().Epoch})
+		require.Equal(t, protocol.ReqSuccess, res.Error)
+		return res.DirectoryResponse.(*DirectoryProof)
+	}
+	// so do monitoring responses that include the binding
+	assert.Equal(t, del, monitor().Deletion)
+	tr := newTransition(key, other.Public(), ep+1, ep+5)
+	assert.True(t, errors.Is(d.AnnounceTransition(tr), ErrBadTransition))
+
+	// the name is quarantined for other keys until ep+4, and forever for
+	// the deleted one
+	_, err = d.Register("alice", other.Public())
+	assert.True(t, errors.Is(err, ErrQuarantined))
+	assert.Equal(t, protocol.ReqRejected,
+		d.HandleRegistration(&RegistrationRequest{Username: "alice", Key: other.Public()}).Error)
+	d.Update()
+	d.Update()
+	_, err = d.Register("alice", key.Public())
+	assert.True(t, errors.Is(err, ErrRejected))
+
+	resp, err := d.Register("alice", other.Public())
+	require.NoError(t, err)
+	assert.Equal(t, del, resp.Deletion)
+	assert.Equal(t, merkletree.ProofOfInclusion, resp.AuthPath.ProofType())
+	assert.Equal(t, []byte(other.Public()), resp.TB.Value)
+	// the tombstone is returned until the new binding is in a snapshot
+	assert.Equal(t, del, lookup().Deletion)
+	d.Update()
+	df := lookup()
+	assert.Nil(t, df.Deletion)
+	assert.Equal(t, []byte(other.Public()), df.AP[0].Leaf.Value)
+	assert.Nil(t, monitor().Deletion)
+}
+
+func TestHandleDeletionErrors(t *testing.T) {
+	d := NewTestTree(t)
+	for _, tc := range []struct {
+		name string
+		req  *DeletionRequest
+		want protocol.ErrorCode
+	}{
+		{"no deletion", &DeletionRequest{}, protocol.ErrMalformedMessage},
+		{"no key", &DeletionRequest{Deletion: &Deletion{Username: "alice"}}, protocol.ErrMalformedMessage},
+		{"unsigned", &DeletionRequest{Deletion: &Deletion{Username: "alice", Key: []byte("key")}}, protocol.ReqRejected},
+	} {
+		assert.Equal(t, tc.want, d.HandleDeletion(tc.req).Error, tc.name)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// GCMetrics is implemented by Metrics that also observe the garbage
+// collections of a Tree.
+type GCMetrics interface {
+	// ObserveGC is called with the memory released by every
+	// Tree.CollectGarbage, and its error, if it failed.
+	ObserveGC(st merkletree.GCStats, err error)
+}
+
+// CollectGarbage prunes the snapshots that have fallen out of the Tree's
+// retention policy (see SetRetentionPolicy), keeping their STRs, and
+// returns the memory it released. If the Tree's Metrics implement
+// GCMetrics, they observe it. Stats().Reclaimed is the memory released
+// so far. If a pruned snapshot couldn't be spilled to the Tree's
+// SnapshotStore, CollectGarbage returns the memory released before
+// along with an error wrapping merkletree.ErrSpillFailed, and the
+// snapshot is pruned by a later call.
+func (d *Tree) CollectGarbage() (merkletree.GCStats, error) {
+	st, err := d.pad.CollectGarbage()
+	if m, ok := d.metrics.(GCMetrics); ok {
+		m.ObserveGC(st, err)
+	}
+	return st, err
+}
+
+// RunGC calls CollectGarbage every interval until ctx is done, and then
+// returns ctx.Err(). Like Run, it holds mu while using the Tree. The
+// errors of CollectGarbage don't stop it; they're observed by the Tree's
+// Metrics, and sent to the Alerts of its watchdog, if any.
+func (d *Tree) RunGC(ctx context.Context, mu sync.Locker, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			mu.Lock()
+			if _, err := d.CollectGarbage(); err != nil && d.watchdog != nil {
+				d.watchdog.alert(d.id(), d.pad.LatestSTR().Epoch, "garbage collection failed", err)
+			}
+			mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+type gcMetrics struct {
+	countingMetrics
+	reclaimed merkletree.GCStats
+}
+
+func (m *gcMetrics) ObserveGC(st merkletree.GCStats, err error) {
+	m.reclaimed.Pruned += st.Pruned
+	m.reclaimed.Bytes += st.Bytes
+}
+
+func TestOpen_Retention(t *testing.T) {
+	_, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithRetention(merkletree.RetentionPolicy{Epochs: 2, Archive: true}),
+	)
+	assert.Equal(t, merkletree.ErrNoSnapshotStore, err)
+
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithSnapshotStore(merkletree.NewMemSnapshotStore()),
+		WithRetention(merkletree.RetentionPolicy{Epochs: 1, Archive: true}),
+	)
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+	d.Update()
+	res := d.KeyLookupInEpoch(&KeyLookupInEpochRequest{Username: "alice", Epoch: 1})
+	assert.Equal(t, protocol.ReqSuccess, res.Error)
+	assert.Equal(t, uint64(2), mustStats(t, d).Reclaimed.Pruned)
+}
+
+func TestTree_RunGC(t *testing.T) {
+	metrics := &gcMetrics{countingMetrics: countingMetrics{requests: make(map[protocol.ErrorCode]int)}}
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithRetention(merkletree.RetentionPolicy{MaxAge: 20 * time.Millisecond}),
+		WithMetrics(metrics),
+	)
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+	d.Update()
+
+	var mu sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.RunGC(ctx, &mu, time.Millisecond) }()
+	// the snapshots of epochs 0 and 1 age, and the latest is kept
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return mustStats(t, d).Reclaimed.Pruned == 2
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	// an update may have pruned the snapshot of epoch 0 already
+	assert.NotZero(t, metrics.reclaimed.Pruned)
+	assert.NotZero(t, metrics.reclaimed.Bytes)
+	res := d.KeyLookupInEpoch(&KeyLookupInEpochRequest{Username: "alice", Epoch: 1})
+	assert.Equal(t, protocol.ReqEpochPruned, res.Error)
+	res = d.GetSTRHistory(&STRHistoryRequest{StartEpoch: 0, EndEpoch: 2})
+	assert.Equal(t, protocol.ReqSuccess, res.Error)
+}
+
+// failingSnapshotStore is a MemSnapshotStore whose PutSnapshot fails
+// while fail is set.
+type failingSnapshotStore struct {
+	*merkletree.MemSnapshotStore
+	fail bool
+}
+
+func (s *failingSnapshotStore) PutSnapshot(str *merkletree.SignedTreeRoot, m *merkletree.MerkleTree) error {
+	if s.fail {
+		return errors.New("store failed")
+	}
+	return s.MemSnapshotStore.PutSnapshot(str, m)
+}
+
+func TestTree_SpillFailure(t *testing.T) {
+	store := &failingSnapshotStore{MemSnapshotStore: merkletree.NewMemSnapshotStore(), fail: true}
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithSnapshotStore(store),
+	)
+	require.NoError(t, err)
+	mustUpdate(t, d)
+	assert.True(t, errors.Is(d.SetFullSnapshots(1), merkletree.ErrSpillFailed))
+
+	// the snapshot is taken, but the older ones keep their trees
+	report, err := d.Update()
+	assert.True(t, errors.Is(err, merkletree.ErrSpillFailed))
+	require.NotNil(t, report)
+	assert.Equal(t, merkletree.Epoch(2), report.Epoch)
+	res := d.KeyLookupInEpoch(&KeyLookupInEpochRequest{Username: "alice", Epoch: 1})
+	assert.Equal(t, protocol.ReqNameNotFound, res.Error)
+
+	store.fail = false
+	st, err := d.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), st.Pruned)
+}
@@ -0,0 +1,57 @@
+package directory
+
+import (
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// A DirectoryIdentity is what an auditor knows about the identity of
+// a directory it audits: the directory's address Addr, e.g. its
+// operator's domain, its public signing key SignKey, and its initial
+// STR InitSTR, whose hash identifies the directory in AuditingRequests.
+// Auditors exchange the identities of the directories they audit, so
+// that a new auditor can learn which directories to audit, and so that
+// conflicting initial STRs for the same address are detected.
+type DirectoryIdentity struct {
+	Addr    string
+	SignKey sign.PublicKey
+	InitSTR *SignedTreeRoot
+}
+
+// ID returns the identifier of the directory, i.e. the hash of the
+// signature of its initial STR.
+func (id *DirectoryIdentity) ID() [hashed.HashSizeByte]byte {
+	return hashed.Sum(id.InitSTR.Signature[:])
+}
+
+// Verify verifies that id's initial STR is the genesis STR of
+// a directory with id's signing key. See SignedTreeRoot.VerifyGenesis.
+func (id *DirectoryIdentity) Verify() error {
+	return id.InitSTR.VerifyGenesis(id.SignKey)
+}
+
+// A DirectoryIdentities response lists the identities of the
+// directories an auditor audits. An auditor returns it upon
+// a DirectoriesRequest.
+type DirectoryIdentities struct {
+	Directories []*DirectoryIdentity
+}
+
+// A DirectoriesRequest is a message that a CONIKS auditor sends to
+// another auditor to learn which directories it audits.
+//
+// The response to a successful request is a DirectoryIdentities.
+type DirectoriesRequest struct{}
+
+var _ DirectoryResponse = (*DirectoryIdentities)(nil)
+
+// NewDirectoryIdentitiesResponse creates the response message a CONIKS
+// auditor sends upon a DirectoriesRequest, and returns a Response
+// containing a DirectoryIdentities with the identities ids.
+func NewDirectoryIdentitiesResponse(ids []*DirectoryIdentity) *Response {
+	return &Response{
+		Error:             protocol.ReqSuccess,
+		DirectoryResponse: &DirectoryIdentities{Directories: ids},
+	}
+}
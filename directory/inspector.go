@@ -0,0 +1,77 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// An Inspector answers questions about the epochs a Tree retains, e.g.
+// to investigate a verification failure a client reported for a name
+// in an epoch: it puts what the Tree served then, and why, into a single
+// Inspection. It's a debugging facade for operators, not part of the
+// protocol, and like the Tree, it must not be used concurrently with
+// the Tree's updates.
+type Inspector struct {
+	d *Tree
+}
+
+// NewInspector returns an Inspector of the epochs d retains.
+func NewInspector(d *Tree) *Inspector {
+	return &Inspector{d: d}
+}
+
+// An Inspection describes the snapshot of Epoch, and the lookup of Name
+// in it, if any:
+//   - STR is the snapshot's signed tree root
+//   - Policies are the policies in force in Epoch, i.e. those of STR
+//   - AP is the proof for Name that a lookup in Epoch returns, and
+//     ProofType whether it proves inclusion or absence
+//   - Delta is the delta that turned the tree of the epoch before into
+//     that of Epoch, or a full one if Epoch is 0 or the tree of the epoch
+//     before isn't retained (see merkletree.PAD.Delta)
+//
+// An Inspection can be encoded as JSON, e.g. to attach it to a bug
+// report.
+type Inspection struct {
+	Epoch     merkletree.Epoch
+	Name      string `json:",omitempty"`
+	STR       *SignedTreeRoot
+	Policies  *Config
+	AP        *merkletree.AuthenticationPath `json:",omitempty"`
+	ProofType merkletree.ProofType           `json:",omitempty"`
+	Delta     *merkletree.Delta
+}
+
+// Inspect returns the Inspection of the snapshot of epoch, and of the
+// lookup of name in it, unless name is empty. The name is looked up as
+// is, so the leaves the Tree stores for users, such as
+// TransitionName(username), can be inspected too. Inspect returns
+// merkletree.ErrSTRNotFound if epoch is after the latest epoch or isn't
+// retained, and a merkletree.ErrEpochPruned if only the STR of epoch is.
+func (in *Inspector) Inspect(name string, epoch merkletree.Epoch) (*Inspection, error) {
+	view, err := in.d.pad.At(epoch)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := in.d.pad.Delta(epoch, false)
+	if err != nil {
+		return nil, err
+	}
+	str := NewDirSTR(view.STR())
+	insp := &Inspection{
+		Epoch:    epoch,
+		Name:     name,
+		STR:      str,
+		Policies: str.Policies,
+		Delta:    delta,
+	}
+	if name != "" {
+		if insp.AP, err = view.Get([]byte(name)); err != nil {
+			return nil, err
+		}
+		insp.ProofType = insp.AP.ProofType()
+	}
+	return insp, nil
+}
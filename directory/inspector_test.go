@@ -0,0 +1,53 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+func TestInspector(t *testing.T) {
+	d := NewTestTree(t)
+	_, err := d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+	d.SetCapabilities(CapBatchLookup)
+	_, err = d.Register("bob", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+	in := NewInspector(d)
+
+	insp, err := in.Inspect("alice", 1)
+	require.NoError(t, err)
+	assert.Equal(t, d.pad.GetSTR(1).Signature, insp.STR.Signature)
+	assert.Equal(t, merkletree.ProofOfInclusion, insp.ProofType)
+	assert.NoError(t, insp.AP.Verify([]byte("alice"), []byte("key"), insp.STR.TreeHash[:]))
+	assert.Zero(t, insp.Policies.Capabilities)
+	require.Len(t, insp.Delta.Set, 1)
+	assert.Equal(t, []byte("alice"), insp.Delta.Set[0].Key)
+
+	insp, err = in.Inspect("bob", 1)
+	require.NoError(t, err)
+	assert.True(t, insp.ProofType.IsAbsence())
+	insp, err = in.Inspect("", 2)
+	require.NoError(t, err)
+	assert.Nil(t, insp.AP)
+	assert.Equal(t, CapBatchLookup, insp.Policies.Capabilities, "the policy in force in epoch 2")
+	require.Len(t, insp.Delta.Set, 1)
+	assert.Equal(t, []byte("bob"), insp.Delta.Set[0].Key)
+	assert.False(t, insp.Delta.Full)
+	_, err = json.Marshal(insp)
+	assert.NoError(t, err)
+
+	_, err = in.Inspect("alice", 3)
+	assert.Equal(t, merkletree.ErrSTRNotFound, err)
+	d.SetFullSnapshots(1)
+	_, err = in.Inspect("alice", 1)
+	var pruned merkletree.ErrEpochPruned
+	assert.True(t, errors.As(err, &pruned))
+}
@@ -0,0 +1,67 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// ErrBadKeyRotation is returned by ScheduleKeyRotation for rotations the
+// Tree can't announce.
+var ErrBadKeyRotation = errors.New("[directory] Invalid signing key rotation")
+
+// A KeyRotation announces that a directory retires its signing key
+// OldKey and signs its STRs with NewKey from Epoch on: the STR of that
+// epoch is the first one signed with NewKey. Like an Upgrade, the
+// announcement is part of every STR from the one after it's scheduled up
+// to the one before Epoch, so it's signed with OldKey. Signature is
+// NewKey's signature of the announcement, so the keys are cross-signed:
+// OldKey vouches for NewKey, and NewKey for taking over the directory
+// of OldKey. Clients and auditors verify both, and follow the rotation
+// exactly at Epoch.
+type KeyRotation struct {
+	OldKey    sign.PublicKey
+	NewKey    sign.PublicKey
+	Epoch     merkletree.Epoch
+	Signature sign.Signature
+}
+
+// keyRotationPrefix separates the signed key rotations from other signed
+// messages.
+var keyRotationPrefix = []byte("key rotation")
+
+// Bytes serializes r for signing with its NewKey, i.e. without the
+// Signature.
+func (r *KeyRotation) Bytes() []byte {
+	bs := append([]byte{}, keyRotationPrefix...)
+	bs = appendFields(bs, r.OldKey, r.NewKey)
+	return append(bs, r.Epoch.Bytes()...)
+}
+
+// Verify returns true iff r's Signature is a valid signature of r with
+// its NewKey.
+func (r *KeyRotation) Verify() bool {
+	return verifyWithKey(r.NewKey, r.Bytes(), r.Signature)
+}
+
+// Equal returns true iff r and other announce the same rotation, or are
+// both nil.
+func (r *KeyRotation) Equal(other *KeyRotation) bool {
+	if r == nil || other == nil {
+		return r == other
+	}
+	return r.Epoch == other.Epoch && bytes.Equal(r.OldKey, other.OldKey) &&
+		bytes.Equal(r.NewKey, other.NewKey) && r.Signature == other.Signature
+}
+
+// KeyAt returns the key that signs the STR of epoch, the one after
+// prevSTR, given the key key that signed prevSTR: the NewKey of the
+// rotation prevSTR announced for epoch, if any, and otherwise key.
+func KeyAt(prevSTR *SignedTreeRoot, epoch merkletree.Epoch, key sign.PublicKey) sign.PublicKey {
+	if r := prevSTR.Policies.KeyRotation; r != nil && r.Epoch == epoch {
+		return r.NewKey
+	}
+	return key
+}
@@ -0,0 +1,73 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// ScheduleKeyRotation announces that the Tree retires its current
+// signing key and signs its STRs with newKey from epoch on, starting
+// with the STR the next Update signs. The announcement must precede the
+// switch, so epoch must be later than the epoch of that STR. Rescheduling
+// or cancelling (see CancelKeyRotation) an announced rotation flags
+// a PolicyChange, like withdrawing an announced upgrade. The Tree keeps
+// newKey in memory only, like the rest of its state that isn't in its
+// stores: Open doesn't resume a directory from its stores, and refuses
+// an STRStore that isn't empty, so an announced rotation never outlives
+// its key.
+// It returns ErrBadKeyRotation if newKey is the current key, or epoch is
+// too early.
+func (d *Tree) ScheduleKeyRotation(newKey sign.Signer, epoch merkletree.Epoch) error {
+	oldKey := d.pad.PublicKey()
+	if bytes.Equal(newKey.Public(), oldKey) || epoch <= d.pad.LatestSTR().Epoch+1 {
+		return ErrBadKeyRotation
+	}
+	r := &KeyRotation{OldKey: oldKey, NewKey: newKey.Public(), Epoch: epoch}
+	copy(r.Signature[:], newKey.Sign(r.Bytes()))
+	d.setKeyRotation(r)
+	d.rotationKey = newKey
+	return nil
+}
+
+// CancelKeyRotation withdraws the rotation announced with
+// ScheduleKeyRotation, if any, starting with the STR the next Update
+// signs.
+func (d *Tree) CancelKeyRotation() {
+	if d.config.KeyRotation != nil {
+		d.setKeyRotation(nil)
+		d.rotationKey = nil
+	}
+}
+
+// setKeyRotation replaces the announced key rotation with r.
+func (d *Tree) setKeyRotation(r *KeyRotation) {
+	if d.config.KeyRotation != nil && !d.config.KeyRotation.Equal(r) {
+		d.policyChange = true
+	}
+	// STRs share the Config, so it's replaced instead of modified
+	config := *d.config
+	config.KeyRotation = r
+	d.config = &config
+	d.pad.SetAssocData(d.config)
+}
+
+// activateKeyRotation switches the Tree to the announced signing key if
+// the rotation is due in epoch, the epoch of the STR the next Update
+// signs.
+func (d *Tree) activateKeyRotation(epoch merkletree.Epoch) {
+	r := d.config.KeyRotation
+	if r == nil || r.Epoch != epoch || d.rotationKey == nil {
+		return
+	}
+	d.pad.SetSigningKey(d.rotationKey)
+	d.rotationKey = nil
+	config := *d.config
+	config.KeyRotation = nil
+	d.config = &config
+	d.pad.SetAssocData(d.config)
+}
@@ -0,0 +1,113 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/merkletree/strdb"
+)
+
+func TestScheduleKeyRotation(t *testing.T) {
+	d := NewTestTree(t)
+	oldKey := crypto.NewStaticTestSigningKey()
+	newKey, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrBadKeyRotation, d.ScheduleKeyRotation(oldKey, 5))
+	// the announcement has to precede the switch
+	assert.Equal(t, ErrBadKeyRotation, d.ScheduleKeyRotation(newKey, 1))
+	require.NoError(t, d.ScheduleKeyRotation(newKey, 3))
+
+	d.Update()
+	announced := d.LatestSTR()
+	r := announced.Policies.KeyRotation
+	require.NotNil(t, r)
+	assert.Equal(t, oldKey.Public(), r.OldKey)
+	assert.Equal(t, newKey.Public(), r.NewKey)
+	assert.True(t, r.Verify())
+	assert.True(t, oldKey.Public().Verify(announced.Bytes(), announced.Signature[:]))
+	d.Update()
+	assert.NotNil(t, d.LatestSTR().Policies.KeyRotation)
+	prev := d.LatestSTR()
+	d.Update()
+	rotated := d.LatestSTR()
+	assert.Nil(t, rotated.Policies.KeyRotation)
+	assert.False(t, rotated.Policies.PolicyChange)
+	assert.True(t, newKey.Public().Verify(rotated.Bytes(), rotated.Signature[:]))
+	assert.False(t, oldKey.Public().Verify(rotated.Bytes(), rotated.Signature[:]))
+	assert.Equal(t, sign.PublicKey(newKey.Public()), KeyAt(prev, rotated.Epoch, oldKey.Public()))
+	assert.Equal(t, sign.PublicKey(newKey.Public()), KeyAt(rotated, rotated.Epoch+1, newKey.Public()))
+	assert.True(t, rotated.VerifyHashChain(prev))
+
+	// the earlier STRs keep their signatures
+	assert.True(t, oldKey.Public().Verify(prev.Bytes(), prev.Signature[:]))
+}
+
+func TestCancelKeyRotation(t *testing.T) {
+	d := NewTestTree(t)
+	oldKey := crypto.NewStaticTestSigningKey()
+	newKey, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+
+	d.CancelKeyRotation()
+	d.Update()
+	assert.False(t, d.LatestSTR().Policies.PolicyChange)
+
+	require.NoError(t, d.ScheduleKeyRotation(newKey, 5))
+	d.Update()
+	d.CancelKeyRotation()
+	d.Update()
+	assert.Nil(t, d.LatestSTR().Policies.KeyRotation)
+	assert.True(t, d.LatestSTR().Policies.PolicyChange)
+	for d.LatestSTR().Epoch < 6 {
+		d.Update()
+		str := d.LatestSTR()
+		assert.True(t, oldKey.Public().Verify(str.Bytes(), str.Signature[:]))
+	}
+}
+
+func TestConfigBytesKeyRotation(t *testing.T) {
+	newKey, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	c := NewConfig(nil)
+	plain := c.Bytes()
+	r := &KeyRotation{OldKey: crypto.NewStaticTestSigningKey().Public(), NewKey: newKey.Public(), Epoch: 3}
+	copy(r.Signature[:], newKey.Sign(r.Bytes()))
+	c.KeyRotation = r
+	announced := c.Bytes()
+	assert.NotEqual(t, plain, announced)
+	forged := *r
+	forged.Signature[0] ^= 1
+	assert.False(t, forged.Verify())
+	c.KeyRotation = &forged
+	assert.NotEqual(t, announced, c.Bytes())
+}
+
+func TestKeyRotationReopen(t *testing.T) {
+	store, err := strdb.Open(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	open := func() (*Tree, error) {
+		return Open(
+			WithSigningKey(crypto.NewStaticTestSigningKey()),
+			WithVRFKey(crypto.NewStaticTestVRFKey()),
+			WithSTRStore(store),
+		)
+	}
+	d, err := open()
+	require.NoError(t, err)
+	newKey, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	require.NoError(t, d.ScheduleKeyRotation(newKey, 3))
+	d.Update()
+	require.NotNil(t, d.LatestSTR().Policies.KeyRotation)
+
+	// the announcement can't be resumed without the key it announces
+	_, err = open()
+	assert.Equal(t, merkletree.ErrSTRStoreNotEmpty, err)
+}
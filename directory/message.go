@@ -1,12 +1,16 @@
 package directory
 
 import (
+	"github.com/ORBAT/cloniks/conv"
 	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
 	"github.com/ORBAT/cloniks/merkletree"
 	"github.com/ORBAT/cloniks/protocol"
 )
 
 // The types of requests CONIKS clients send during the CONIKS protocols.
+// They're sent as numbers, so new types are only ever appended, and
+// named in the protocol/registry package.
 const (
 	RegistrationType = iota
 	KeyLookupType
@@ -14,6 +18,17 @@ const (
 	MonitoringType
 	AuditType
 	STRType
+	BindingUnchangedType
+	STRSkipType
+	RollupType
+	TranscriptType
+	TransitionType
+	RevocationType
+	DeletionType
+	ReattestationType
+	ProposalType
+	ApprovalType
+	OpeningType
 )
 
 // A Request message defines the data a CONIKS client must send to a CONIKS
@@ -64,11 +79,11 @@ type KeyLookupRequest struct {
 // of STRs covering the epoch range [Epoch, d.LatestSTR().Epoch].
 type KeyLookupInEpochRequest struct {
 	Username string
-	Epoch    uint64
+	Epoch    merkletree.Epoch
 }
 
 // A MonitoringRequest is a message with a username as a string and the
-// start and end epochs of an epoch range as two uint64 that a CONIKS
+// start and end epochs of an epoch range that a CONIKS
 // client sends to the directory to monitor the given user's key in a CONIKS
 // key directory, i.e. to ensure that the key bound to the username hasn't
 // changed unexpectedly.
@@ -88,12 +103,12 @@ type KeyLookupInEpochRequest struct {
 // registration.
 type MonitoringRequest struct {
 	Username   string
-	StartEpoch uint64
-	EndEpoch   uint64
+	StartEpoch merkletree.Epoch
+	EndEpoch   merkletree.Epoch
 }
 
 // An AuditingRequest is a message with a CONIKS key directory's address
-// as a string, and a StartEpoch and an EndEpoch as uint64's that a CONIKS
+// as a string, and a StartEpoch and an EndEpoch that a CONIKS
 // client sends to a CONIKS auditor to request the given directory's
 // STRs for the given epoch range. To obtain a single STR, the client
 // must set StartEpoch = EndEpoch in the request.
@@ -102,12 +117,12 @@ type MonitoringRequest struct {
 // a list of STRs covering the epoch range [StartEpoch, EndEpoch].
 type AuditingRequest struct {
 	DirInitSTRHash [hashed.HashSizeByte]byte
-	StartEpoch     uint64
-	EndEpoch       uint64
+	StartEpoch     merkletree.Epoch
+	EndEpoch       merkletree.Epoch
 }
 
 // An STRHistoryRequest is a message with a StartEpoch and optional EndEpoch
-// of an epoch range as two uint64's that a CONIKS auditor
+// of an epoch range that a CONIKS auditor
 // sends to a directory to retrieve a range of STRs starting at epoch
 // StartEpoch.
 //
@@ -115,8 +130,41 @@ type AuditingRequest struct {
 // a list of STRs covering the epoch range [StartEpoch, EndEpoch],
 // or [StartEpoch, d.LatestSTR().Epoch] if EndEpoch is omitted.
 type STRHistoryRequest struct {
-	StartEpoch uint64
-	EndEpoch   uint64
+	StartEpoch merkletree.Epoch
+	EndEpoch   merkletree.Epoch
+}
+
+// A BindingUnchangedRequest is a message that a CONIKS client sends to
+// the directory to check whether the binding for Username has changed
+// since Epoch, the last epoch in which the client verified it.
+// Commitment is the commitment to the binding's value in Epoch, or nil
+// if Username wasn't registered in Epoch. Epoch should be the epoch of
+// the client's latest verified STR, so that the client can link the
+// STRs in the response to it.
+//
+// In the steady state, the binding doesn't change, and the response is
+// a BindingUnchanged with no authentication paths, which makes this
+// request far cheaper than monitoring. If the binding did change,
+// the response is a DirectoryProof for the first epoch of the change.
+type BindingUnchangedRequest struct {
+	Username   string
+	Epoch      merkletree.Epoch
+	Commitment []byte `json:",omitempty"`
+}
+
+// An STRSkipRequest is a message that a CONIKS client sends to the
+// directory to catch up from StartEpoch, the epoch of the client's
+// latest verified STR, to EndEpoch without fetching every STR in
+// between.
+//
+// The response to a successful request is an STRHistoryRange with the
+// STRs for the epochs merkletree.SkipPath(StartEpoch, EndEpoch), each of
+// which links to the one before it, and the first of which links to the
+// STR for StartEpoch. An EndEpoch greater than the directory's latest
+// epoch sets the end of the path at the latest epoch.
+type STRSkipRequest struct {
+	StartEpoch merkletree.Epoch
+	EndEpoch   merkletree.Epoch
 }
 
 // A Response message indicates the result of a CONIKS client request
@@ -140,6 +188,22 @@ type DirectoryProof struct {
 	AP  []*merkletree.AuthenticationPath
 	STR []*SignedTreeRoot
 	TB  *TemporaryBinding `json:",omitempty"`
+	// Revocation is set in key lookup responses if the returned key has
+	// been revoked.
+	Revocation *Revocation `json:",omitempty"`
+	// Deletion is set in key lookup responses if the returned binding has
+	// been deleted, in monitoring responses if the last binding they
+	// include has been, and in registration responses if the registration
+	// replaces a deleted binding. It's the binding's tombstone.
+	Deletion *Deletion `json:",omitempty"`
+	// Reattestation is set in key lookup responses if the returned
+	// binding has been re-attested, and is its latest re-attestation.
+	// Expired is set if the binding has expired for lack of one (see
+	// Reattestation). It isn't signed, so it's only a hint: clients
+	// derive the expiry from the proven leaf and the re-attestation (see
+	// Config.BindingExpiry).
+	Reattestation *Reattestation `json:",omitempty"`
+	Expired       bool           `json:",omitempty"`
 }
 
 // An STRHistoryRange response includes a list of signed tree roots
@@ -152,6 +216,44 @@ type STRHistoryRange struct {
 	STR []*SignedTreeRoot
 }
 
+// A BindingUnchanged response is the directory's signed assertion that
+// the commitment to a binding hasn't changed from the epoch in the
+// BindingUnchangedRequest through the epoch Through. STR is the range of
+// signed tree roots for the epochs after the request's epoch up to and
+// including Through, which links the assertion to the client's latest
+// verified STR. It is empty if Through is the request's epoch.
+type BindingUnchanged struct {
+	Through   merkletree.Epoch
+	Signature sign.Signature
+	STR       []*SignedTreeRoot
+}
+
+// bindingUnchangedPrefix separates the signed assertions of
+// BindingUnchanged from other messages signed by the directory.
+var bindingUnchangedPrefix = []byte("binding unchanged")
+
+// Bytes serializes the assertion that the commitment at index hasn't
+// changed since the epoch since through u.Through. strSig is the
+// signature of the STR for u.Through.
+func (u *BindingUnchanged) Bytes(index merkletree.Index, commitment []byte, since merkletree.Epoch, strSig sign.Signature) []byte {
+	bs := append([]byte{}, bindingUnchangedPrefix...)
+	bs = append(bs, conv.UInt32ToBytes(uint32(len(index)))...)
+	bs = append(bs, index...)
+	bs = append(bs, conv.UInt32ToBytes(uint32(len(commitment)))...)
+	bs = append(bs, commitment...)
+	bs = append(bs, since.Bytes()...)
+	bs = append(bs, u.Through.Bytes()...)
+	bs = append(bs, strSig[:]...)
+	return bs
+}
+
+// An EpochPruned response tells the client that the directory only
+// keeps the STR of an epoch it requested, so it can't serve proofs for
+// that epoch. Nearest is the nearest epoch it can serve proofs for.
+type EpochPruned struct {
+	Nearest merkletree.Epoch
+}
+
 // NewErrorResponse creates a new response message indicating the error
 // that occurred while a CONIKS directory or a CONIKS auditor was
 // processing a client request.
@@ -161,6 +263,20 @@ func NewErrorResponse(e protocol.ErrorCode) *Response {
 
 var _ DirectoryResponse = (*DirectoryProof)(nil)
 var _ DirectoryResponse = (*STRHistoryRange)(nil)
+var _ DirectoryResponse = (*BindingUnchanged)(nil)
+var _ DirectoryResponse = (*EpochPruned)(nil)
+
+// NewEpochPrunedResponse creates the response message a CONIKS directory
+// sends to a client that requested proofs for an epoch whose snapshot
+// has been pruned, and returns a Response with the error code
+// ReqEpochPruned containing an EpochPruned struct.
+// See Tree.SetFullSnapshots() for details.
+func NewEpochPrunedResponse(nearest merkletree.Epoch) *Response {
+	return &Response{
+		Error:             protocol.ReqEpochPruned,
+		DirectoryResponse: &EpochPruned{Nearest: nearest},
+	}
+}
 
 // NewRegistrationProof creates the response message a CONIKS directory
 // sends to a client upon a RegistrationRequest,
@@ -246,6 +362,22 @@ func NewMonitoringProof(ap []*merkletree.AuthenticationPath,
 	}
 }
 
+// NewBindingUnchangedProof creates the response message a CONIKS
+// directory sends to a client upon a BindingUnchangedRequest if the
+// binding hasn't changed. directory.BindingUnchanged() passes the
+// latest epoch through, the signature sig of the assertion, and the
+// signed tree roots str for the epochs after the requested one.
+func NewBindingUnchangedProof(through merkletree.Epoch, sig sign.Signature, str []*SignedTreeRoot) *Response {
+	return &Response{
+		Error: protocol.ReqSuccess,
+		DirectoryResponse: &BindingUnchanged{
+			Through:   through,
+			Signature: sig,
+			STR:       str,
+		},
+	}
+}
+
 // NewSTRHistoryRange creates the response message a CONIKS auditor
 // sends to a client upon an AuditingRequest,
 // and returns a Response containing an STRHistoryRange struct.
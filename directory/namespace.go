@@ -0,0 +1,60 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+)
+
+// NamespaceSeparator separates the namespace of a key from the rest of
+// the key, e.g. the key "acme/alice" is in the namespace "acme".
+const NamespaceSeparator = '/'
+
+// ErrInvalidNamespace indicates that WithNamespaceVRFKey was given an
+// empty namespace or one containing NamespaceSeparator, or that it was
+// combined with WithHashIndex.
+var ErrInvalidNamespace = errors.New("[directory] Invalid namespace")
+
+// Namespace returns the namespace of key, i.e. the part before the first
+// NamespaceSeparator, or "" if key has none. Keys without a namespace,
+// and keys in namespaces without their own VRF key, are indexed with the
+// directory's VRF key.
+func Namespace(key []byte) string {
+	if i := bytes.IndexByte(key, NamespaceSeparator); i >= 0 {
+		return string(key[:i])
+	}
+	return ""
+}
+
+// namespacesTag marks the namespace keys in serialized configs.
+var namespacesTag = []byte("namespaces")
+
+// namespacesBytes serializes the namespace keys of p, sorted by
+// namespace, each namespace prefixed with its length.
+func (p *Config) namespacesBytes() []byte {
+	names := make([]string, 0, len(p.Namespaces))
+	for name := range p.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bs := append([]byte{}, namespacesTag...)
+	for _, name := range names {
+		bs = append(bs, conv.UInt32ToBytes(uint32(len(name)))...)
+		bs = append(bs, name...)
+		bs = append(bs, p.Namespaces[name]...)
+	}
+	return bs
+}
+
+// VRFKeyFor returns the VRF public key declared in p for the indices of
+// key: that of key's namespace, if p declares one, and VrfPublicKey
+// otherwise.
+func (p *Config) VRFKeyFor(key []byte) vrf.PublicKey {
+	if pk, ok := p.Namespaces[Namespace(key)]; ok {
+		return pk
+	}
+	return p.VrfPublicKey
+}
@@ -0,0 +1,44 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"strings"
+
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// WithNamespaceVRFKey makes the Tree compute the private indices of the
+// keys in namespace with vrfKey instead of the key given with WithVRFKey,
+// and advertise its public key in the Config, so that a compromised
+// namespace key only reveals the lookups of its namespace. Give it once
+// for every namespace with its own key; every key must be independent.
+// It can't be combined with WithHashIndex.
+func WithNamespaceVRFKey(namespace string, vrfKey vrf.PrivateKey) Option {
+	return func(o *options) error {
+		if namespace == "" || strings.IndexByte(namespace, NamespaceSeparator) >= 0 {
+			return ErrInvalidNamespace
+		}
+		if o.namespaces == nil {
+			o.namespaces = make(map[string]vrf.PrivateKey)
+		}
+		o.namespaces[namespace] = vrfKey
+		return nil
+	}
+}
+
+// namespaceIndexer computes the indices of keys with the VRF key of
+// their namespace, or with def if their namespace has none.
+type namespaceIndexer struct {
+	def  merkletree.Indexer
+	keys map[string]vrf.PrivateKey
+}
+
+func (ix namespaceIndexer) Index(key []byte) (index, proof []byte) {
+	if k, ok := ix.keys[Namespace(key)]; ok {
+		return k.Prove(key)
+	}
+	return ix.def.Index(key)
+}
@@ -0,0 +1,90 @@
+package directory
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+func TestNamespace(t *testing.T) {
+	for key, ns := range map[string]string{
+		"alice":           "",
+		"acme/alice":      "acme",
+		"acme/dev/alice":  "acme",
+		"/alice":          "",
+		"alice@acme.test": "",
+	} {
+		assert.Equal(t, ns, Namespace([]byte(key)), key)
+	}
+}
+
+func TestNamespaceVRFKeys(t *testing.T) {
+	acmeKey, err := vrf.GenerateKey(nil)
+	require.NoError(t, err)
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithNamespaceVRFKey("acme", acmeKey),
+	)
+	require.NoError(t, err)
+	acmePublic, _ := acmeKey.Public()
+	config := d.LatestSTR().Policies
+	assert.Equal(t, map[string]vrf.PublicKey{"acme": acmePublic}, config.Namespaces)
+
+	for _, name := range []string{"acme/alice", "globex/bob", "carol"} {
+		_, err := d.Register(name, []byte("key"))
+		require.NoError(t, err)
+	}
+	d.Update()
+
+	for _, name := range []string{"acme/alice", "globex/bob", "carol"} {
+		ap, err := d.pad.Lookup([]byte(name))
+		require.NoError(t, err)
+		assert.Equal(t, merkletree.ProofOfInclusion, ap.ProofType(), name)
+		assert.True(t, config.VerifyIndex([]byte(name), ap.LookupIndex, ap.VrfProof), name)
+
+		// only the keys of acme are indexed with acme's key
+		acmeIndex, _ := acmeKey.Prove([]byte(name))
+		inAcme := bytes.Equal(acmeIndex[:config.IndexSize], ap.LookupIndex)
+		assert.Equal(t, name == "acme/alice", inAcme, name)
+	}
+
+	// the proofs only verify with the keys of their namespaces
+	ap, err := d.pad.Lookup([]byte("acme/alice"))
+	require.NoError(t, err)
+	noNamespaces := *config
+	noNamespaces.Namespaces = nil
+	assert.False(t, noNamespaces.VerifyIndex([]byte("acme/alice"), ap.LookupIndex, ap.VrfProof))
+
+	// the namespace keys are signed, and survive serialization
+	assert.NotEqual(t, noNamespaces.Bytes(), config.Bytes())
+	bs, err := json.Marshal(config)
+	require.NoError(t, err)
+	var decoded Config
+	require.NoError(t, json.Unmarshal(bs, &decoded))
+	assert.Equal(t, config.Bytes(), decoded.Bytes())
+}
+
+func TestWithNamespaceVRFKey_Invalid(t *testing.T) {
+	for _, ns := range []string{"", "acme/dev"} {
+		_, err := Open(
+			WithSigningKey(crypto.NewStaticTestSigningKey()),
+			WithVRFKey(crypto.NewStaticTestVRFKey()),
+			WithNamespaceVRFKey(ns, crypto.NewStaticTestVRFKey()),
+		)
+		assert.Equal(t, ErrInvalidNamespace, err, ns)
+	}
+	_, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithHashIndex([]byte("hash key")),
+		WithNamespaceVRFKey("acme", crypto.NewStaticTestVRFKey()),
+	)
+	assert.Equal(t, ErrInvalidNamespace, err)
+}
@@ -0,0 +1,590 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// DefaultSnapshots is the number of snapshots a Tree created with Open
+// keeps in memory unless WithSnapshots is given.
+const DefaultSnapshots = 1000
+
+var (
+	// ErrNoSigningKey indicates that Open was called without
+	// WithSigningKey.
+	ErrNoSigningKey = errors.New("[directory] No signing key given")
+	// ErrNoIndexKey indicates that Open was called without either
+	// WithVRFKey or WithHashIndex, so the Tree can't compute indices.
+	ErrNoIndexKey = errors.New("[directory] No VRF key or hash index key given")
+	// ErrNoScheduler indicates that Tree.Run was called on a Tree
+	// opened without WithScheduler.
+	ErrNoScheduler = errors.New("[directory] No scheduler given")
+	// ErrInvalidEpsilon indicates that WithActivityStats was given
+	// a privacy parameter that isn't positive.
+	ErrInvalidEpsilon = errors.New("[directory] Epsilon must be positive")
+)
+
+// A Storage persists the snapshots a Tree removes from memory, e.g. so
+// that proofs for old epochs can still be served from disk.
+type Storage interface {
+	// StoreSnapshot is called with a view of every snapshot whose tree
+	// is about to be removed from memory. See merkletree.EvictionFunc.
+	StoreSnapshot(view merkletree.ReadOnlyTree)
+}
+
+// A Scheduler decides when the epochs of a Tree end. See Tree.Run.
+type Scheduler interface {
+	// Next returns when the epoch starting at start ends.
+	Next(start time.Time) time.Time
+}
+
+// Interval is a Scheduler for epochs of a fixed length.
+type Interval time.Duration
+
+// Next returns start plus the interval.
+func (i Interval) Next(start time.Time) time.Time {
+	return start.Add(time.Duration(i))
+}
+
+// A Policy decides which bindings a Tree accepts for registration, e.g.
+// to enforce a key format.
+type Policy interface {
+	// CheckRegistration returns an error if the binding of key to value
+	// must not be registered.
+	CheckRegistration(key string, value []byte) error
+}
+
+// A Publisher publishes the STRs a Tree signs, e.g. to external
+// mediums that make it harder for the directory to equivocate. See the
+// publish package.
+type Publisher interface {
+	// PublishSTR is called with the STR of every snapshot Tree.Update
+	// takes. It's called while the Tree is in use, so it mustn't block.
+	PublishSTR(str *SignedTreeRoot)
+}
+
+// A ReportPublisher is a Publisher that publishes the EpochReports of
+// the snapshots along with their STRs, e.g. to integrators' dashboards.
+// Tree.Update calls PublishReport instead of PublishSTR for a Publisher
+// that implements it.
+type ReportPublisher interface {
+	Publisher
+	// PublishReport is called with the report of every snapshot
+	// Tree.Update takes, whose STR is report.STR. Like PublishSTR, it
+	// mustn't block.
+	PublishReport(report *EpochReport)
+}
+
+// Metrics observes the requests a Tree handles and the epochs it takes
+// snapshots of.
+type Metrics interface {
+	// ObserveRequest is called after Tree.HandleRequest has handled a
+	// request of type requestType in time took, with the error code of
+	// its response.
+	ObserveRequest(requestType int, code protocol.ErrorCode, took time.Duration)
+	// ObserveEpoch is called with the report of every snapshot
+	// Tree.Update takes.
+	ObserveEpoch(report *EpochReport)
+}
+
+// ArchivalMetrics is Metrics that also observe the archival attestations
+// a Tree opened WithArchivalAttestation and a Timestamper makes.
+type ArchivalMetrics interface {
+	Metrics
+	// ObserveArchival is called with every attestation Tree.Update makes
+	// once it's timestamped, and with the error of the Timestamper if it
+	// failed. It's called from the goroutine that timestamps a, so it
+	// must be safe for concurrent use.
+	ObserveArchival(a *ArchivalAttestation, err error)
+}
+
+// An Authorizer decides which requests a Tree serves.
+type Authorizer interface {
+	// Authorize returns an error if req must not be served.
+	Authorize(req *Request) error
+}
+
+// An Option sets an optional parameter of a Tree created with Open.
+type Option func(*options) error
+
+type options struct {
+	signKey       sign.Signer
+	vrfKey        vrf.PrivateKey
+	indexer       merkletree.Indexer
+	hashKey       []byte
+	indexSize     int
+	snapshots     uint64
+	retention     merkletree.RetentionPolicy
+	budgetLow     uint64
+	budgetHigh    uint64
+	storage       Storage
+	scheduler     Scheduler
+	policy        Policy
+	metrics       Metrics
+	authorizer    Authorizer
+	epsilon       float64
+	watchdog      *WatchdogConfig
+	publisher     Publisher
+	namespaces    map[string]vrf.PrivateKey
+	minKeyChange  uint64
+	capabilities  Capabilities
+	quarantine    uint64
+	reattestation uint64
+	maxChanges    uint64
+	nodeStore     merkletree.NodeStore
+	snapshotStore merkletree.SnapshotStore
+	strStore      merkletree.STRStore
+	leafIndex     bool
+	randomness    io.Reader
+	archival      uint64
+	timestamper   Timestamper
+}
+
+// WithSigningKey sets the key the Tree signs STRs and TBs with. It's
+// required. signKey is usually a sign.PrivateKey.
+func WithSigningKey(signKey sign.Signer) Option {
+	return func(o *options) error {
+		o.signKey = signKey
+		return nil
+	}
+}
+
+// WithVRFKey makes the Tree compute private indices with vrfKey, like
+// New does.
+func WithVRFKey(vrfKey vrf.PrivateKey) Option {
+	return func(o *options) error {
+		o.vrfKey = vrfKey
+		return nil
+	}
+}
+
+// WithIndexer makes the Tree compute indices with ix instead of the VRF
+// key given with WithVRFKey, whose public key the Tree still advertises
+// to clients. It's meant for tests that need indices that don't match
+// the advertised VRF, e.g. with a cryptotest.Indexer.
+func WithIndexer(ix merkletree.Indexer) Option {
+	return func(o *options) error {
+		o.indexer = ix
+		return nil
+	}
+}
+
+// WithHashIndex makes the Tree compute indices with a keyed hash with
+// the key hashKey, like NewWithHashIndex does. It takes precedence over
+// WithVRFKey.
+func WithHashIndex(hashKey []byte) Option {
+	return func(o *options) error {
+		o.hashKey = hashKey
+		return nil
+	}
+}
+
+// WithIndexSize makes the Tree truncate its indices to indexSize bytes,
+// like NewWithIndexSize does. indexSize must be in
+// [merkletree.MinIndexSize, merkletree.DefaultIndexSize].
+func WithIndexSize(indexSize int) Option {
+	return func(o *options) error {
+		if indexSize < merkletree.MinIndexSize || indexSize > merkletree.DefaultIndexSize {
+			return merkletree.ErrInvalidIndexSize
+		}
+		o.indexSize = indexSize
+		return nil
+	}
+}
+
+// WithSnapshots sets the number of snapshots the Tree keeps in memory.
+// The default is DefaultSnapshots.
+func WithSnapshots(n uint64) Option {
+	return func(o *options) error {
+		o.snapshots = n
+		return nil
+	}
+}
+
+// WithFullSnapshots makes the Tree keep the full snapshots of only the
+// n latest epochs. See Tree.SetFullSnapshots.
+func WithFullSnapshots(n uint64) Option {
+	return func(o *options) error {
+		o.retention.Epochs = n
+		return nil
+	}
+}
+
+// WithRetention makes the Tree keep the full snapshots that policy
+// retains, replacing the n of WithFullSnapshots if given before it. See
+// Tree.SetRetentionPolicy.
+func WithRetention(policy merkletree.RetentionPolicy) Option {
+	return func(o *options) error {
+		o.retention = policy
+		return nil
+	}
+}
+
+// WithMemoryBudget makes the Tree keep as many snapshots as fit in
+// a memory budget. See Tree.SetMemoryBudget.
+func WithMemoryBudget(low, high uint64) Option {
+	return func(o *options) error {
+		if low > high {
+			return merkletree.ErrInvalidMemoryBudget
+		}
+		o.budgetLow, o.budgetHigh = low, high
+		return nil
+	}
+}
+
+// WithStorage makes the Tree pass every snapshot it removes from memory
+// to storage.
+func WithStorage(storage Storage) Option {
+	return func(o *options) error {
+		o.storage = storage
+		return nil
+	}
+}
+
+// WithScheduler makes Tree.Run end epochs as scheduled by scheduler.
+func WithScheduler(scheduler Scheduler) Option {
+	return func(o *options) error {
+		o.scheduler = scheduler
+		return nil
+	}
+}
+
+// WithPolicy makes the Tree reject registrations that policy doesn't
+// accept.
+func WithPolicy(policy Policy) Option {
+	return func(o *options) error {
+		o.policy = policy
+		return nil
+	}
+}
+
+// WithMetrics makes the Tree report its requests and epochs to metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) error {
+		o.metrics = metrics
+		return nil
+	}
+}
+
+// WithAuthorizer makes Tree.HandleRequest serve only the requests
+// authorizer authorizes.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(o *options) error {
+		o.authorizer = authorizer
+		return nil
+	}
+}
+
+// WithPublisher makes the Tree pass the STR of every snapshot it takes
+// to publisher.
+func WithPublisher(publisher Publisher) Option {
+	return func(o *options) error {
+		o.publisher = publisher
+		return nil
+	}
+}
+
+// WithActivityStats makes the Tree commit to the ActivityStats of every
+// epoch in its STR, noised with the privacy parameter epsilon, which
+// must be positive. A typical epsilon is between 0.1 and 1.
+func WithActivityStats(epsilon float64) Option {
+	return func(o *options) error {
+		if !(epsilon > 0) {
+			return ErrInvalidEpsilon
+		}
+		o.epsilon = epsilon
+		return nil
+	}
+}
+
+// WithMinKeyChangeInterval makes the Tree reject key transitions that
+// happen less than epochs epochs after the previous change of the user's
+// key, and commit to the interval in the Config of its STRs, so that
+// clients can verify that it did.
+func WithMinKeyChangeInterval(epochs uint64) Option {
+	return func(o *options) error {
+		o.minKeyChange = epochs
+		return nil
+	}
+}
+
+// WithDeletionQuarantine makes the Tree refuse to bind a deleted name to
+// a different key for epochs epochs after the deletion, and commit to
+// the quarantine in the Config of its STRs, so that clients can verify
+// that it did. See Deletion.
+func WithDeletionQuarantine(epochs uint64) Option {
+	return func(o *options) error {
+		o.quarantine = epochs
+		return nil
+	}
+}
+
+// WithReattestationInterval makes bindings expire unless their owners
+// re-attest them every epochs epochs, and commits to the interval in the
+// Config of its STRs, so that clients can verify the expiry. See
+// Reattestation.
+func WithReattestationInterval(epochs uint64) Option {
+	return func(o *options) error {
+		o.reattestation = epochs
+		return nil
+	}
+}
+
+// WithMaxChangesPerEpoch makes the Tree bind a name to a key up to
+// changes times in one epoch instead of once (see Tree.Register), e.g.
+// for deployments whose keys change fast, and commits to the maximum in
+// the Config of its STRs. Clients then can't verify which of the keys
+// promised for a name in an epoch the next snapshot binds it to; see
+// Config.MaxChangesPerEpoch.
+func WithMaxChangesPerEpoch(changes uint64) Option {
+	return func(o *options) error {
+		o.maxChanges = changes
+		return nil
+	}
+}
+
+// WithCapabilities makes the Tree advertise caps in the Config of its
+// STRs. See Tree.SetCapabilities.
+func WithCapabilities(caps Capabilities) Option {
+	return func(o *options) error {
+		o.capabilities = caps
+		return nil
+	}
+}
+
+// WithNodeStore makes the Tree keep the nodes of its snapshots in store
+// instead of memory, and load them as needed. See merkletree.NodeStore.
+func WithNodeStore(store merkletree.NodeStore) Option {
+	return func(o *options) error {
+		o.nodeStore = store
+		return nil
+	}
+}
+
+// WithSnapshotStore makes the Tree spill the snapshots it removes from
+// memory to store, and serve lookups in their epochs from it. See
+// merkletree.SnapshotStore.
+func WithSnapshotStore(store merkletree.SnapshotStore) Option {
+	return func(o *options) error {
+		o.snapshotStore = store
+		return nil
+	}
+}
+
+// WithLeafIndex makes the Tree index the leaves of its snapshots by
+// lookup index, so that lookups of registered names don't walk the tree
+// down, at the cost of memory. See merkletree.WithLeafIndex.
+func WithLeafIndex() Option {
+	return func(o *options) error {
+		o.leafIndex = true
+		return nil
+	}
+}
+
+// WithRandomness makes the Tree read the nonces of its trees and the
+// salts of its commitments from rnd, e.g. to generate reproducible test
+// vectors. It must never be used in production, since a predictable rnd
+// leaks the Tree's bindings. See merkletree.WithRandomness.
+func WithRandomness(rnd io.Reader) Option {
+	return func(o *options) error {
+		o.randomness = rnd
+		return nil
+	}
+}
+
+// WithSTRStore makes the Tree archive every STR it signs in store, which
+// must be empty, so that GetSTRHistory can serve the STRs of epochs it no
+// longer keeps in memory. A store that serializes the STRs parses their
+// policies with the decoder registered for ConfigType. See
+// merkletree.STRStore.
+func WithSTRStore(store merkletree.STRStore) Option {
+	return func(o *options) error {
+		o.strStore = store
+		return nil
+	}
+}
+
+// WithArchivalAttestation makes Update re-attest the Tree's STR history
+// every epochs epochs, and timestamp the attestations with timestamper
+// if it isn't nil. The timestamping happens after Update returns, so a
+// slow timestamper doesn't delay the epochs; its failures are reported
+// to the Tree's watchdog and ArchivalMetrics, if any. See
+// Tree.ReattestHistory.
+func WithArchivalAttestation(epochs uint64, timestamper Timestamper) Option {
+	return func(o *options) error {
+		o.archival = epochs
+		o.timestamper = timestamper
+		return nil
+	}
+}
+
+// Open creates a new Tree composed of the subsystems given with opts.
+// WithSigningKey and either WithVRFKey or WithHashIndex are required;
+// without them Open returns ErrNoSigningKey or ErrNoIndexKey. Open
+// returns the error of any invalid option.
+func Open(opts ...Option) (*Tree, error) {
+	o := options{
+		indexSize: merkletree.DefaultIndexSize,
+		snapshots: DefaultSnapshots,
+	}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	if o.signKey == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	var d *Tree
+	var err error
+	storeOpts := []merkletree.PADOption{}
+	if o.nodeStore != nil {
+		storeOpts = append(storeOpts, merkletree.WithNodeStore(o.nodeStore))
+	}
+	if o.snapshotStore != nil {
+		storeOpts = append(storeOpts, merkletree.WithSnapshotStore(o.snapshotStore))
+	}
+	if o.strStore != nil {
+		storeOpts = append(storeOpts, merkletree.WithSTRStore(o.strStore))
+	}
+	if o.leafIndex {
+		storeOpts = append(storeOpts, merkletree.WithTreeOptions(merkletree.WithLeafIndex()))
+	}
+	if o.randomness != nil {
+		storeOpts = append(storeOpts, merkletree.WithTreeOptions(merkletree.WithRandomness(o.randomness)))
+	}
+	switch {
+	case o.hashKey != nil && o.namespaces != nil:
+		return nil, ErrInvalidNamespace
+	case o.hashKey != nil:
+		config := NewHashIndexConfig(o.hashKey)
+		config.IndexSize = uint32(o.indexSize)
+		config.MinKeyChangeInterval = o.minKeyChange
+		config.DeletionQuarantine = o.quarantine
+		config.ReattestationInterval = o.reattestation
+		config.MaxChangesPerEpoch = o.maxChanges
+		config.Capabilities = o.capabilities
+		d, err = newTree(config, o.signKey, nil, o.snapshots, append(storeOpts,
+			merkletree.WithIndexer(*config.hashIndexer()), merkletree.WithIndexSize(o.indexSize))...)
+	case o.vrfKey != nil:
+		vrfPublicKey, ok := o.vrfKey.Public()
+		if !ok {
+			return nil, vrf.ErrGetPubKey
+		}
+		config := NewConfig(vrfPublicKey)
+		config.IndexSize = uint32(o.indexSize)
+		config.MinKeyChangeInterval = o.minKeyChange
+		config.DeletionQuarantine = o.quarantine
+		config.ReattestationInterval = o.reattestation
+		config.MaxChangesPerEpoch = o.maxChanges
+		config.Capabilities = o.capabilities
+		padOpts := append(storeOpts, merkletree.WithIndexSize(o.indexSize))
+		if o.namespaces != nil {
+			config.Namespaces = make(map[string]vrf.PublicKey, len(o.namespaces))
+			for name, k := range o.namespaces {
+				if config.Namespaces[name], ok = k.Public(); !ok {
+					return nil, vrf.ErrGetPubKey
+				}
+			}
+			padOpts = append(padOpts, merkletree.WithIndexer(
+				namespaceIndexer{merkletree.VRFIndexer{Key: o.vrfKey}, o.namespaces}))
+		}
+		if o.indexer != nil {
+			padOpts = append(padOpts, merkletree.WithIndexer(o.indexer))
+		}
+		d, err = newTree(config, o.signKey, o.vrfKey, o.snapshots, padOpts...)
+	default:
+		return nil, ErrNoIndexKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if o.storage != nil {
+		d.SetEvictionFunc(o.storage.StoreSnapshot)
+	}
+	if err := d.SetRetentionPolicy(o.retention); err != nil {
+		return nil, err
+	}
+	if err := d.SetMemoryBudget(o.budgetLow, o.budgetHigh); err != nil {
+		return nil, err
+	}
+	d.scheduler = o.scheduler
+	d.policy = o.policy
+	d.metrics = o.metrics
+	d.authorizer = o.authorizer
+	d.epsilon = o.epsilon
+	d.publisher = o.publisher
+	d.archivalInterval = o.archival
+	d.timestamper = o.timestamper
+	if o.watchdog != nil {
+		d.watchdog = newWatchdog(*o.watchdog)
+	}
+	if d.scheduler != nil {
+		d.nextEpoch = d.scheduler.Next(time.Now())
+	}
+	return d, nil
+}
+
+// NextEpoch returns when Run will next call Update, or the zero time if
+// the Tree was opened without WithScheduler.
+func (d *Tree) NextEpoch() time.Time {
+	return d.nextEpoch
+}
+
+// Run calls Update whenever an epoch scheduled by the Tree's Scheduler
+// ends, until ctx is done, and then returns ctx.Err(). A Tree isn't safe
+// for concurrent use, so Run holds mu while using the Tree, and any
+// goroutine using the Tree at the same time must hold mu too. Run
+// returns ErrNoScheduler if the Tree was opened without WithScheduler.
+// If the Tree was opened WithWatchdog, the updates are watched as
+// configured, and a failing update is a failure instead of stopping
+// Run; otherwise, Run returns the error of a failing update. A panicking
+// update isn't recovered: it means the Tree may be half-updated, and
+// mustn't serve any more requests. An epoch that doesn't end, because it failed or its operators
+// didn't approve it, is tried again when the Scheduler would end an
+// epoch starting then.
+func (d *Tree) Run(ctx context.Context, mu sync.Locker) error {
+	if d.scheduler == nil {
+		return ErrNoScheduler
+	}
+	var retry time.Time
+	for {
+		mu.Lock()
+		next := d.nextEpoch
+		mu.Unlock()
+		if retry.After(next) {
+			next = retry
+		}
+
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+			mu.Lock()
+			err := d.scheduledUpdate()
+			mu.Unlock()
+			if err == nil {
+				continue
+			}
+			if d.watchdog == nil && !errors.Is(err, ErrNotApproved) {
+				return err
+			}
+			retry = d.scheduler.Next(time.Now())
+		}
+	}
+}
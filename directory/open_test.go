@@ -0,0 +1,320 @@
+package directory
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/merkletree/strdb"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+type policyFunc func(key string, value []byte) error
+
+func (f policyFunc) CheckRegistration(key string, value []byte) error { return f(key, value) }
+
+type authorizerFunc func(req *Request) error
+
+func (f authorizerFunc) Authorize(req *Request) error { return f(req) }
+
+type storageFunc func(view merkletree.ReadOnlyTree)
+
+func (f storageFunc) StoreSnapshot(view merkletree.ReadOnlyTree) { f(view) }
+
+type countingMetrics struct {
+	requests map[protocol.ErrorCode]int
+	epochs   []merkletree.Epoch
+}
+
+func (m *countingMetrics) ObserveRequest(requestType int, code protocol.ErrorCode, took time.Duration) {
+	m.requests[code]++
+}
+
+func (m *countingMetrics) ObserveEpoch(report *EpochReport) {
+	m.epochs = append(m.epochs, report.Epoch)
+}
+
+func TestOpen(t *testing.T) {
+	signKey := crypto.NewStaticTestSigningKey()
+	vrfKey := crypto.NewStaticTestVRFKey()
+
+	_, err := Open(WithVRFKey(vrfKey))
+	assert.Equal(t, ErrNoSigningKey, err)
+	_, err = Open(WithSigningKey(signKey))
+	assert.Equal(t, ErrNoIndexKey, err)
+	_, err = Open(WithSigningKey(signKey), WithVRFKey(vrfKey), WithIndexSize(1))
+	assert.Equal(t, merkletree.ErrInvalidIndexSize, err)
+	_, err = Open(WithSigningKey(signKey), WithVRFKey(vrfKey), WithMemoryBudget(2, 1))
+	assert.Equal(t, merkletree.ErrInvalidMemoryBudget, err)
+
+	d, err := Open(WithSigningKey(signKey), WithHashIndex([]byte("hash key")),
+		WithIndexSize(merkletree.MinIndexSize))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(merkletree.MinIndexSize), d.LatestSTR().Policies.IndexSize)
+	assert.Equal(t, []byte("hash key"), d.LatestSTR().Policies.IndexHashKey)
+	assert.Len(t, d.pad.Index([]byte("alice")), merkletree.MinIndexSize)
+	assert.True(t, d.NextEpoch().IsZero())
+	assert.Equal(t, ErrNoScheduler, d.Run(context.Background(), new(sync.Mutex)))
+}
+
+func TestOpen_Subsystems(t *testing.T) {
+	var stored []merkletree.Epoch
+	metrics := &countingMetrics{requests: make(map[protocol.ErrorCode]int)}
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithSnapshots(2),
+		WithStorage(storageFunc(func(view merkletree.ReadOnlyTree) {
+			stored = append(stored, view.Epoch())
+		})),
+		WithPolicy(policyFunc(func(key string, value []byte) error {
+			if len(value) != 4 {
+				return errors.New("keys must be 4 bytes")
+			}
+			return nil
+		})),
+		WithAuthorizer(authorizerFunc(func(req *Request) error {
+			if req.Type == STRType {
+				return errors.New("auditors only")
+			}
+			return nil
+		})),
+		WithMetrics(metrics),
+	)
+	require.NoError(t, err)
+
+	_, err = d.Register("alice", []byte("too long"))
+	assert.True(t, errors.Is(err, ErrRejected), err)
+	res := d.HandleRequest(&Request{Type: RegistrationType,
+		Request: &RegistrationRequest{Username: "alice", Key: []byte("too long")}})
+	assert.Equal(t, protocol.ReqRejected, res.Error)
+	res = d.HandleRequest(&Request{Type: RegistrationType,
+		Request: &RegistrationRequest{Username: "alice", Key: []byte("key!")}})
+	assert.Equal(t, protocol.ReqSuccess, res.Error)
+	res = d.HandleRequest(&Request{Type: STRType, Request: &STRHistoryRequest{}})
+	assert.Equal(t, protocol.ReqRejected, res.Error)
+	assert.Equal(t, map[protocol.ErrorCode]int{protocol.ReqSuccess: 1, protocol.ReqRejected: 2},
+		metrics.requests)
+
+	for i := 0; i < 3; i++ {
+		d.Update()
+	}
+	assert.Equal(t, []merkletree.Epoch{1, 2, 3}, metrics.epochs)
+	assert.NotEmpty(t, stored)
+	assert.Equal(t, merkletree.Epoch(0), stored[0])
+}
+
+func TestTree_Run(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithScheduler(Interval(time.Millisecond)),
+	)
+	require.NoError(t, err)
+	assert.False(t, d.NextEpoch().IsZero())
+
+	var mu sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, &mu) }()
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return d.LatestSTR().Epoch >= 3
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestTree_RunNotApproved(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithScheduler(Interval(time.Millisecond)),
+	)
+	require.NoError(t, err)
+	keys, o := operatorKeys(t, 1)
+	o.Threshold = 1
+	require.NoError(t, d.SetOperators(o))
+
+	var mu sync.Mutex
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, &mu) }()
+	// the epoch is tried again until the operators approve it
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, merkletree.Epoch(0), d.LatestSTR().Epoch)
+	require.NoError(t, d.Approve(mustPropose(t, d).Approve(keys[0])))
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return d.LatestSTR().Epoch == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestOpen_NodeStore(t *testing.T) {
+	store := merkletree.NewMemNodeStore()
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithNodeStore(store),
+	)
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+	assert.NotZero(t, store.Len())
+
+	res := d.KeyLookup(&KeyLookupRequest{Username: "alice"})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	ap := res.DirectoryResponse.(*DirectoryProof).AP[0]
+	assert.NoError(t, ap.Verify([]byte("alice"), []byte("key"), d.LatestSTR().TreeHash[:]))
+}
+
+// failingStore is a MemNodeStore whose Put fails while fail is set.
+type failingStore struct {
+	*merkletree.MemNodeStore
+	fail bool
+}
+
+func (s *failingStore) Put(h, n []byte) error {
+	if s.fail {
+		return errors.New("store failed")
+	}
+	return s.MemNodeStore.Put(h, n)
+}
+
+func TestOpen_NodeStoreFailure(t *testing.T) {
+	store := &failingStore{MemNodeStore: merkletree.NewMemNodeStore()}
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithNodeStore(store),
+	)
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	store.fail = true
+	report, err := d.Update()
+	assert.Nil(t, report)
+	assert.True(t, errors.Is(err, ErrUpdateFailed), err)
+	assert.Equal(t, merkletree.Epoch(0), d.LatestSTR().Epoch)
+
+	store.fail = false
+	report = mustUpdate(t, d)
+	assert.Equal(t, 1, report.FulfilledTBs)
+}
+
+func TestOpen_LeafIndex(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithNodeStore(merkletree.NewMemNodeStore()),
+		WithLeafIndex(),
+	)
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+
+	res := d.KeyLookup(&KeyLookupRequest{Username: "alice"})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	ap := res.DirectoryResponse.(*DirectoryProof).AP[0]
+	assert.NoError(t, ap.Verify([]byte("alice"), []byte("key"), d.LatestSTR().TreeHash[:]))
+
+	res = d.KeyLookup(&KeyLookupRequest{Username: "bob"})
+	require.Equal(t, protocol.ReqNameNotFound, res.Error)
+	ap = res.DirectoryResponse.(*DirectoryProof).AP[0]
+	assert.NoError(t, ap.Verify([]byte("bob"), nil, d.LatestSTR().TreeHash[:]))
+}
+
+func TestOpen_SnapshotStore(t *testing.T) {
+	store := merkletree.NewMemSnapshotStore()
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithSnapshots(2),
+		WithSnapshotStore(store),
+	)
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		d.Update()
+	}
+	assert.NotZero(t, store.Len())
+
+	res := d.KeyLookupInEpoch(&KeyLookupInEpochRequest{Username: "alice", Epoch: 1})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	df := res.DirectoryResponse.(*DirectoryProof)
+	assert.Len(t, df.STR, 4)
+	assert.NoError(t, df.AP[0].Verify([]byte("alice"), []byte("key"), df.STR[0].TreeHash[:]))
+}
+
+func TestOpen_STRStore(t *testing.T) {
+	store, err := strdb.Open(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithSnapshots(2),
+		WithSTRStore(store),
+	)
+	require.NoError(t, err)
+	strs := []*SignedTreeRoot{d.LatestSTR()}
+	for i := 0; i < 5; i++ {
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+
+	res := d.GetSTRHistory(&STRHistoryRequest{StartEpoch: 0, EndEpoch: 5})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	got := res.DirectoryResponse.(*STRHistoryRange).STR
+	require.Len(t, got, len(strs))
+	for i, str := range got {
+		assert.Equal(t, strs[i].Signature, str.Signature)
+		assert.Equal(t, strs[i].Bytes(), str.Bytes())
+		assert.Equal(t, strs[i].Policies.Bytes(), str.Policies.Bytes())
+	}
+}
+
+func TestOpen_Capabilities(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithCapabilities(CapBatchLookup|CapKeyChange),
+	)
+	require.NoError(t, err)
+	first := d.LatestSTR()
+	assert.True(t, first.Policies.Capabilities.Has(CapKeyChange))
+	assert.False(t, first.Policies.Capabilities.Has(CapKeyChange|CapDeletion))
+
+	// adding a capability isn't a policy change
+	d.SetCapabilities(CapBatchLookup | CapKeyChange | CapDeletion)
+	d.Update()
+	assert.Equal(t, CapBatchLookup|CapKeyChange|CapDeletion, d.LatestSTR().Policies.Capabilities)
+	assert.False(t, d.LatestSTR().Policies.PolicyChange)
+
+	d.SetCapabilities(CapKeyChange)
+	d.Update()
+	assert.Equal(t, CapKeyChange, d.LatestSTR().Policies.Capabilities)
+	assert.True(t, d.LatestSTR().Policies.PolicyChange)
+	d.Update()
+	assert.False(t, d.LatestSTR().Policies.PolicyChange)
+
+	// the earlier STRs are unchanged
+	assert.Equal(t, CapBatchLookup|CapKeyChange, first.Policies.Capabilities)
+	assert.True(t, crypto.NewStaticTestSigningKey().Public().Verify(first.Bytes(), first.Signature[:]))
+}
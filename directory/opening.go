@@ -0,0 +1,38 @@
+package directory
+
+import (
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// An OpeningRequest is a message that a user sends to the directory to
+// get the opening of the commitment to their binding in Epoch, i.e. the
+// salt with which the directory committed to the key bound to Username,
+// so that they can verify for themselves that the directory committed to
+// exactly the key they registered. It's signed with the private key of
+// the key bound to Username in Epoch, so that only the user can make it.
+//
+// The response to a successful request is a DirectoryProof like that to
+// a KeyLookupInEpochRequest, whose AP opens the commitment and proves it
+// against the STR for Epoch.
+type OpeningRequest struct {
+	Username  string
+	Epoch     merkletree.Epoch
+	Signature sign.Signature
+}
+
+// openingRequestPrefix separates the signed opening requests from other
+// signed messages.
+var openingRequestPrefix = []byte("commitment opening")
+
+// Bytes serializes the request for signing.
+func (r *OpeningRequest) Bytes() []byte {
+	bs := appendFields(append([]byte{}, openingRequestPrefix...), []byte(r.Username))
+	return append(bs, r.Epoch.Bytes()...)
+}
+
+// Sign signs the request with key, which must be the private key of the
+// key bound to r.Username in r.Epoch.
+func (r *OpeningRequest) Sign(key sign.PrivateKey) {
+	copy(r.Signature[:], key.Sign(r.Bytes()))
+}
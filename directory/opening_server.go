@@ -0,0 +1,38 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// HandleOpening returns the response to the OpeningRequest req received
+// from a user, which opens the commitment to their binding in req.Epoch.
+// A request without a username or with an epoch greater than the latest
+// epoch of this directory is considered malformed, and causes
+// HandleOpening() to return a NewErrorResponse(ErrMalformedMessage).
+// If req.Username isn't bound in req.Epoch, or req isn't signed with the
+// key it's bound to, it returns a NewErrorResponse(ReqRejected).
+// Otherwise, it returns a NewKeyLookupInEpochProof(ap, str, ReqSuccess),
+// as KeyLookupInEpoch() does. If the snapshot of req.Epoch has been
+// pruned, it returns a NewEpochPrunedResponse(nearest).
+func (d *Tree) HandleOpening(req *OpeningRequest) *Response {
+	if len(req.Username) == 0 || req.Epoch > d.LatestSTR().Epoch {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+	views, err := d.snapshots(req.Epoch, d.LatestSTR().Epoch)
+	if err != nil {
+		return errorResponse(err)
+	}
+	ap, err := views[0].Get([]byte(req.Username))
+	if err != nil {
+		return errorResponse(err)
+	}
+	if ap.ProofType() != merkletree.ProofOfInclusion ||
+		!verifyWithKey(ap.Leaf.Value, req.Bytes(), req.Signature) {
+		return NewErrorResponse(protocol.ReqRejected)
+	}
+	return NewKeyLookupInEpochProof(ap, dirSTRs(views), protocol.ReqSuccess)
+}
@@ -0,0 +1,45 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestHandleOpening(t *testing.T) {
+	d := NewTestTree(t)
+	key, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	other, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = d.Register("alice", key.Public())
+	require.NoError(t, err)
+	d.Update()
+	d.Update()
+
+	open := func(username string, epoch merkletree.Epoch, key sign.PrivateKey) *Response {
+		req := &OpeningRequest{Username: username, Epoch: epoch}
+		req.Sign(key)
+		return d.HandleRequest(&Request{Type: OpeningType, Request: req})
+	}
+	res := open("alice", 1, key)
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	df := res.DirectoryResponse.(*DirectoryProof)
+	require.Len(t, df.AP, 1)
+	assert.Len(t, df.STR, 2)
+	assert.Equal(t, merkletree.Epoch(1), df.STR[0].Epoch)
+	ap := df.AP[0]
+	assert.True(t, ap.Leaf.Commitment.Verify([]byte("alice"), key.Public()))
+	assert.NoError(t, ap.Verify([]byte("alice"), key.Public(), df.STR[0].TreeHash[:]))
+
+	assert.Equal(t, protocol.ReqRejected, open("alice", 1, other).Error, "signed by another key")
+	assert.Equal(t, protocol.ReqRejected, open("alice", 0, key).Error, "not bound yet")
+	assert.Equal(t, protocol.ReqRejected, open("bob", 1, key).Error)
+	assert.Equal(t, protocol.ErrMalformedMessage, open("alice", 3, key).Error)
+	assert.Equal(t, protocol.ErrMalformedMessage, open("", 1, key).Error)
+}
@@ -0,0 +1,163 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+var (
+	// ErrBadOperators is returned by SetOperators for operator policies
+	// that can't be met or aren't well-formed.
+	ErrBadOperators = errors.New("[directory] Invalid operator policy")
+	// ErrBadApproval is returned by Approve for approvals the Tree can't
+	// count towards its pending epoch.
+	ErrBadApproval = errors.New("[directory] Invalid epoch approval")
+	// ErrNotApproved indicates that a co-managed Tree didn't take
+	// a snapshot because its operators didn't approve it. See Update.
+	ErrNotApproved = errors.New("[directory] Epoch not approved by the operators")
+)
+
+// Operators is the policy of a directory that is co-managed by several
+// parties: publishing an epoch takes the Approval of at least Threshold
+// of the operators with the public keys Keys, in addition to the
+// directory's signature. No single party can then change the bindings,
+// or the policies, behind the backs of the others. The policy of an STR
+// governs the publication of the next one, so changing or removing it
+// takes the approval of the operators it replaces; an STR introducing
+// a policy is governed by that policy itself.
+type Operators struct {
+	Keys      []sign.PublicKey
+	Threshold uint32
+}
+
+// operatorsTag marks the operator policy in serialized configs.
+var operatorsTag = []byte("operators")
+
+// Bytes serializes o for signing, as the threshold followed by the keys.
+func (o *Operators) Bytes() []byte {
+	bs := append([]byte{}, operatorsTag...)
+	bs = append(bs, conv.UInt32ToBytes(o.Threshold)...)
+	bs = append(bs, conv.UInt32ToBytes(uint32(len(o.Keys)))...)
+	for _, k := range o.Keys {
+		bs = append(bs, k...)
+	}
+	return bs
+}
+
+// has returns true iff key is one of the operators' keys.
+func (o *Operators) has(key sign.PublicKey) bool {
+	for _, k := range o.Keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Approved returns true iff approvals has valid approvals of p by at
+// least o.Threshold distinct operators. Approvals of others, and invalid
+// ones, are ignored.
+func (o *Operators) Approved(p *EpochProposal, approvals []*Approval) bool {
+	var approved []sign.PublicKey
+	for _, a := range approvals {
+		if a == nil || !o.has(a.Operator) || !a.Verify(p) {
+			continue
+		}
+		counted := false
+		for _, k := range approved {
+			counted = counted || bytes.Equal(k, a.Operator)
+		}
+		if !counted {
+			approved = append(approved, a.Operator)
+		}
+	}
+	return uint32(len(approved)) >= o.Threshold
+}
+
+// An EpochProposal is the pending root of a co-managed directory that
+// its operators approve: the STR for Epoch that the directory publishes
+// with their approval links to the STR with the hash PreviousSTRHash,
+// and commits to the tree with the hash TreeHash.
+type EpochProposal struct {
+	Epoch           merkletree.Epoch
+	PreviousSTRHash hashed.Hash
+	TreeHash        hashed.Hash
+}
+
+// approvalPrefix separates the signed epoch proposals from other signed
+// messages.
+var approvalPrefix = []byte("epoch approval")
+
+// Bytes serializes p for signing by an operator.
+func (p *EpochProposal) Bytes() []byte {
+	bs := append([]byte{}, approvalPrefix...)
+	bs = append(bs, p.Epoch.Bytes()...)
+	bs = append(bs, p.PreviousSTRHash[:]...)
+	return append(bs, p.TreeHash[:]...)
+}
+
+// Approve signs p with the operator key key.
+func (p *EpochProposal) Approve(key sign.PrivateKey) *Approval {
+	a := &Approval{Operator: key.Public()}
+	copy(a.Signature[:], key.Sign(p.Bytes()))
+	return a
+}
+
+// Proposal returns the EpochProposal that str publishes, i.e. the one
+// its operators approved if its directory is co-managed.
+func (str *SignedTreeRoot) Proposal() *EpochProposal {
+	return &EpochProposal{
+		Epoch:           str.Epoch,
+		PreviousSTRHash: str.PreviousSTRHash,
+		TreeHash:        str.TreeHash,
+	}
+}
+
+// An Approval is the signature of an EpochProposal by the operator with
+// the public key Operator.
+type Approval struct {
+	Operator  sign.PublicKey
+	Signature sign.Signature
+}
+
+// Verify returns true iff a is a valid approval of p.
+func (a *Approval) Verify(p *EpochProposal) bool {
+	return a.Operator.Verify(p.Bytes(), a.Signature[:])
+}
+
+// approvalsTag marks the approvals in serialized configs.
+var approvalsTag = []byte("approvals")
+
+// approvalsBytes serializes the approvals of the STR of p.
+func (p *Config) approvalsBytes() []byte {
+	bs := append([]byte{}, approvalsTag...)
+	bs = append(bs, conv.UInt32ToBytes(uint32(len(p.Approvals)))...)
+	for _, a := range p.Approvals {
+		bs = append(bs, a.Operator...)
+		bs = append(bs, a.Signature[:]...)
+	}
+	return bs
+}
+
+// A ProposalRequest is a message that an operator of a co-managed
+// directory sends to it to get the EpochProposal of its pending root.
+//
+// The response to a successful request is an EpochProposal.
+type ProposalRequest struct{}
+
+// An ApprovalRequest is a message with an Approval that an operator of
+// a co-managed directory sends to it to approve its pending root. See
+// Tree.Approve.
+//
+// The response to a successful request has the error code ReqSuccess
+// and no DirectoryResponse.
+type ApprovalRequest struct {
+	Approval *Approval
+}
+
+var _ DirectoryResponse = (*EpochProposal)(nil)
@@ -0,0 +1,178 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// SetOperators makes the Tree co-managed by the operators of o, starting
+// with the STR the next Update signs, or, if o is nil, stops it from
+// being co-managed. That STR, and every one after it, needs the
+// approval of the operators (see Approve), and that of the STR which
+// changes or removes o needs the approval of the operators of o. It
+// returns an error wrapping ErrBadOperators if o has a key that isn't
+// a public signing key, has a key twice, or has a Threshold of zero or
+// above the number of keys.
+func (d *Tree) SetOperators(o *Operators) error {
+	if o != nil {
+		if o.Threshold == 0 || int(o.Threshold) > len(o.Keys) {
+			return fmt.Errorf("%w: threshold %d of %d operators", ErrBadOperators, o.Threshold, len(o.Keys))
+		}
+		for i, k := range o.Keys {
+			if len(k) != sign.PublicKeySize {
+				return fmt.Errorf("%w: operator %d has a key of %d bytes", ErrBadOperators, i, len(k))
+			}
+			if (&Operators{Keys: o.Keys[:i]}).has(k) {
+				return fmt.Errorf("%w: operator %d has the key of another", ErrBadOperators, i)
+			}
+		}
+		o = &Operators{Keys: append([]sign.PublicKey(nil), o.Keys...), Threshold: o.Threshold}
+	}
+	// STRs share the Config, so it's replaced instead of modified
+	config := *d.config
+	config.Operators = o
+	d.config = &config
+	d.pad.SetAssocData(d.config)
+	return nil
+}
+
+// operators returns the policy that governs the publication of the
+// Tree's next STR: that of its latest STR, or that the next STR
+// introduces, if any.
+func (d *Tree) operators() *Operators {
+	if o := GetConfig(d.pad.LatestSTR()).Operators; o != nil {
+		return o
+	}
+	return d.config.Operators
+}
+
+// Propose returns the EpochProposal for the Tree's pending root, i.e.
+// the one the next Update publishes unless bindings change before it,
+// which the operators of a co-managed Tree approve. Key transitions
+// due in that epoch happen first, since they're part of the root, and
+// Propose returns the error of one that can't be applied, or of
+// computing the root.
+func (d *Tree) Propose() (*EpochProposal, error) {
+	if err := d.applyTransitions(d.pad.LatestSTR().Epoch + 1); err != nil {
+		return nil, err
+	}
+	return d.pendingProposal()
+}
+
+// pendingProposal returns the EpochProposal for the Tree's pending root
+// as it is, without the key transitions that are due, or the error of
+// computing the root.
+func (d *Tree) pendingProposal() (*EpochProposal, error) {
+	latest := d.pad.LatestSTR()
+	epoch := latest.Epoch + 1
+	hash, _, err := d.pad.RefreshPending()
+	if err != nil {
+		return nil, err
+	}
+	p := &EpochProposal{
+		Epoch:           epoch,
+		PreviousSTRHash: hashed.Sum(latest.Signature[:]),
+	}
+	copy(p.TreeHash[:], hash)
+	return p, nil
+}
+
+// Approve collects the approval a of an operator of the co-managed Tree
+// for its pending root (see Propose). Approvals only count for the root
+// they sign, so those collected before bindings changed are dropped,
+// and the operators need to approve the new root. An operator's later
+// approval replaces their earlier one. Approve returns an error wrapping
+// ErrBadApproval if the Tree isn't co-managed, a isn't by one of its
+// operators, or a doesn't approve its pending root.
+func (d *Tree) Approve(a *Approval) error {
+	o := d.operators()
+	if o == nil {
+		return fmt.Errorf("%w: the directory isn't co-managed", ErrBadApproval)
+	}
+	if !o.has(a.Operator) {
+		return fmt.Errorf("%w: %x isn't an operator", ErrBadApproval, []byte(a.Operator))
+	}
+	p, err := d.Propose()
+	if err != nil {
+		return err
+	}
+	if !a.Verify(p) {
+		return fmt.Errorf("%w: it doesn't approve the pending root of epoch %d", ErrBadApproval, p.Epoch)
+	}
+	if d.proposal == nil || *d.proposal != *p {
+		d.proposal, d.approvals = p, nil
+	}
+	for i, prev := range d.approvals {
+		if bytes.Equal(prev.Operator, a.Operator) {
+			d.approvals[i] = a
+			return nil
+		}
+	}
+	d.approvals = append(d.approvals, a)
+	return nil
+}
+
+// approved returns true iff the Tree isn't co-managed, or its operators
+// approved its pending root, which isn't the case if the root can't be
+// computed. Unlike Propose, it doesn't change the Tree.
+func (d *Tree) approved() bool {
+	o := d.operators()
+	if o == nil {
+		return true
+	}
+	// due key transitions would change the approved root
+	if d.proposal == nil || d.transitionsDue(d.pad.LatestSTR().Epoch+1) {
+		return false
+	}
+	p, err := d.pendingProposal()
+	if err != nil {
+		return false
+	}
+	return *d.proposal == *p && o.Approved(p, d.approvals)
+}
+
+// HandleProposal returns the response to the ProposalRequest req
+// received from an operator, which has the EpochProposal of the Tree's
+// pending root, a NewErrorResponse(ReqRejected) if the Tree isn't
+// co-managed, or a NewErrorResponse(ErrDirectory) if Propose fails.
+func (d *Tree) HandleProposal(req *ProposalRequest) *Response {
+	if d.operators() == nil {
+		return NewErrorResponse(protocol.ReqRejected)
+	}
+	p, err := d.Propose()
+	if err != nil {
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
+	return &Response{
+		Error:             protocol.ReqSuccess,
+		DirectoryResponse: p,
+	}
+}
+
+// HandleApproval collects the approval in the ApprovalRequest req
+// received from an operator, and returns the response to be sent back.
+// A request without an approval is considered malformed, and causes
+// HandleApproval() to return a NewErrorResponse(ErrMalformedMessage).
+// An approval the Tree doesn't accept causes it to return
+// a NewErrorResponse(ReqRejected).
+func (d *Tree) HandleApproval(req *ApprovalRequest) *Response {
+	if req.Approval == nil {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+	switch err := d.Approve(req.Approval); {
+	case err == nil:
+		return NewErrorResponse(protocol.ReqSuccess)
+	case errors.Is(err, ErrBadApproval):
+		return NewErrorResponse(protocol.ReqRejected)
+	default:
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
+}
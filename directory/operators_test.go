@@ -0,0 +1,195 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// operatorKeys generates the signing keys of n operators.
+func operatorKeys(t *testing.T, n int) ([]sign.PrivateKey, *Operators) {
+	keys := make([]sign.PrivateKey, n)
+	o := &Operators{}
+	for i := range keys {
+		k, err := sign.GenerateKey(nil)
+		require.NoError(t, err)
+		keys[i] = k
+		o.Keys = append(o.Keys, k.Public())
+	}
+	return keys, o
+}
+
+func TestSetOperators(t *testing.T) {
+	d := NewTestTree(t)
+	_, o := operatorKeys(t, 2)
+
+	for _, bad := range []*Operators{
+		{Keys: o.Keys},
+		{Keys: o.Keys, Threshold: 3},
+		{Keys: []sign.PublicKey{o.Keys[0], o.Keys[0]}, Threshold: 1},
+		{Keys: []sign.PublicKey{o.Keys[0][:5]}, Threshold: 1},
+	} {
+		assert.True(t, errors.Is(d.SetOperators(bad), ErrBadOperators), "%v", bad)
+	}
+	assert.Nil(t, d.config.Operators)
+
+	o.Threshold = 2
+	require.NoError(t, d.SetOperators(o))
+	withOperators := d.config.Bytes()
+	assert.Equal(t, o, d.config.Operators)
+	o.Threshold = 1 // the Tree has its own copy
+	assert.Equal(t, uint32(2), d.config.Operators.Threshold)
+	require.NoError(t, d.SetOperators(nil))
+	assert.NotEqual(t, withOperators, d.config.Bytes())
+}
+
+// assertNotApproved asserts that d doesn't take a snapshot because its
+// operators didn't approve it.
+func assertNotApproved(t *testing.T, d *Tree, msgAndArgs ...interface{}) {
+	t.Helper()
+	report, err := d.Update()
+	assert.Nil(t, report, msgAndArgs...)
+	assert.Equal(t, ErrNotApproved, err, msgAndArgs...)
+}
+
+func TestCoManagedUpdate(t *testing.T) {
+	d := NewTestTree(t)
+	keys, o := operatorKeys(t, 3)
+	o.Threshold = 2
+	require.NoError(t, d.SetOperators(o))
+	_, err := d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+
+	// the first STR is governed by the policy it introduces
+	assertNotApproved(t, d)
+	_, err = d.Update()
+	assert.Equal(t, ErrNotApproved, err)
+	p := mustPropose(t, d)
+	require.NoError(t, d.Approve(p.Approve(keys[0])))
+	require.NoError(t, d.Approve(p.Approve(keys[0])))
+	assertNotApproved(t, d, "an operator's approval counts once")
+	require.NoError(t, d.Approve(p.Approve(keys[2])))
+	report := mustUpdate(t, d)
+	require.NotNil(t, report)
+	str := report.STR
+	assert.Equal(t, p, str.Proposal())
+	assert.Len(t, str.Policies.Approvals, 2)
+	assert.True(t, o.Approved(str.Proposal(), str.Policies.Approvals))
+	assert.Nil(t, d.config.Approvals, "approvals are only in the STR they approve")
+
+	// approvals of a root don't carry over to the next one
+	assertNotApproved(t, d)
+	p = mustPropose(t, d)
+	require.NoError(t, d.Approve(p.Approve(keys[1])))
+	_, err = d.Register("bob", []byte("key"))
+	require.NoError(t, err)
+	require.NoError(t, d.Approve(mustPropose(t, d).Approve(keys[2])))
+	assertNotApproved(t, d)
+	require.NoError(t, d.Approve(mustPropose(t, d).Approve(keys[1])))
+	require.NotNil(t, mustUpdate(t, d))
+
+	// removing the policy takes the approval of its operators
+	require.NoError(t, d.SetOperators(nil))
+	assertNotApproved(t, d)
+	p = mustPropose(t, d)
+	require.NoError(t, d.Approve(p.Approve(keys[0])))
+	require.NoError(t, d.Approve(p.Approve(keys[1])))
+	require.NotNil(t, mustUpdate(t, d))
+	assert.Nil(t, d.LatestSTR().Policies.Operators)
+	require.NotNil(t, mustUpdate(t, d))
+	assert.Nil(t, d.LatestSTR().Policies.Approvals)
+}
+
+func TestUnapprovedUpdate(t *testing.T) {
+	oldKey, err := sign.GenerateKey(bytes.NewReader(make([]byte, 32)))
+	require.NoError(t, err)
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithScheduler(Interval(time.Hour)),
+	)
+	require.NoError(t, err)
+	_, err = d.Register("alice", oldKey.Public())
+	require.NoError(t, err)
+	mustUpdate(t, d)
+	ep := d.LatestSTR().Epoch
+	require.NoError(t, d.AnnounceTransition(newTransition(oldKey, []byte("new key"), ep, ep+2)))
+	mustUpdate(t, d)
+	keys, o := operatorKeys(t, 1)
+	o.Threshold = 1
+	require.NoError(t, d.SetOperators(o))
+
+	// the transition is due, but nothing changes without an approval
+	next := d.nextEpoch
+	assertNotApproved(t, d)
+	assert.Equal(t, next, d.nextEpoch)
+	assert.Contains(t, d.transitions, "alice")
+	assert.Equal(t, ep+1, d.LatestSTR().Epoch)
+
+	require.NoError(t, d.Approve(mustPropose(t, d).Approve(keys[0])))
+	report := mustUpdate(t, d)
+	assert.Equal(t, ep+2, report.Epoch)
+	assert.NotContains(t, d.transitions, "alice")
+	ap := d.KeyLookup(&KeyLookupRequest{Username: "alice"}).DirectoryResponse.(*DirectoryProof).AP[0]
+	assert.Equal(t, []byte("new key"), ap.Leaf.Value)
+}
+
+func TestApprove(t *testing.T) {
+	d := NewTestTree(t)
+	keys, o := operatorKeys(t, 2)
+	other, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+
+	assert.True(t, errors.Is(d.Approve(mustPropose(t, d).Approve(keys[0])), ErrBadApproval),
+		"the Tree isn't co-managed")
+	o.Threshold = 1
+	require.NoError(t, d.SetOperators(o))
+	p := mustPropose(t, d)
+	assert.True(t, errors.Is(d.Approve(p.Approve(other)), ErrBadApproval))
+	stale := *p
+	stale.Epoch++
+	assert.True(t, errors.Is(d.Approve(stale.Approve(keys[0])), ErrBadApproval))
+	forged := p.Approve(keys[0])
+	forged.Operator = o.Keys[1]
+	assert.True(t, errors.Is(d.Approve(forged), ErrBadApproval))
+	assertNotApproved(t, d)
+}
+
+func TestHandleApproval(t *testing.T) {
+	d := NewTestTree(t)
+	keys, o := operatorKeys(t, 2)
+
+	res := d.HandleRequest(&Request{Type: ProposalType, Request: &ProposalRequest{}})
+	assert.Equal(t, protocol.ReqRejected, res.Error)
+	o.Threshold = 2
+	require.NoError(t, d.SetOperators(o))
+	res = d.HandleRequest(&Request{Type: ProposalType, Request: &ProposalRequest{}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	p := res.DirectoryResponse.(*EpochProposal)
+
+	res = d.HandleRequest(&Request{Type: ApprovalType, Request: &ApprovalRequest{}})
+	assert.Equal(t, protocol.ErrMalformedMessage, res.Error)
+	for _, k := range keys {
+		res = d.HandleRequest(&Request{Type: ApprovalType, Request: &ApprovalRequest{Approval: p.Approve(k)}})
+		assert.Equal(t, protocol.ReqSuccess, res.Error)
+	}
+	res = d.HandleRequest(&Request{Type: ApprovalType, Request: &ApprovalRequest{
+		Approval: (&EpochProposal{Epoch: 7}).Approve(keys[0])}})
+	assert.Equal(t, protocol.ReqRejected, res.Error)
+	assert.NotNil(t, mustUpdate(t, d))
+}
+
+func mustPropose(t *testing.T, d *Tree) *EpochProposal {
+	t.Helper()
+	p, err := d.Propose()
+	require.NoError(t, err)
+	return p
+}
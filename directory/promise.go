@@ -0,0 +1,83 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+// defaultPromiseWarning is the fraction of the promise deadline after
+// which fulfilled promises are reported as close to it.
+const defaultPromiseWarning = 0.8
+
+// PromiseLatency describes how long the temporary bindings fulfilled by
+// a snapshot waited for it: the time between the issuance of each TB and
+// the signing of the STR that includes its binding. Clients use a TB's
+// binding right away on the directory's promise to include it in the
+// next snapshot, so the latency shows whether the directory keeps its
+// promises in time. It's zero for snapshots that fulfill no TBs.
+type PromiseLatency struct {
+	Max  time.Duration
+	Mean time.Duration
+}
+
+// now returns the current time, as seen by the Tree's watchdog, if any.
+func (d *Tree) now() time.Time {
+	if d.watchdog != nil {
+		return d.watchdog.now()
+	}
+	return time.Now()
+}
+
+// promiseLatency returns the PromiseLatency of the TBs issued since the
+// latest snapshot, whose STR was signed at signed.
+func (d *Tree) promiseLatency(signed time.Time) PromiseLatency {
+	var l PromiseLatency
+	if len(d.tbIssued) == 0 {
+		return l
+	}
+	var total time.Duration
+	for _, issued := range d.tbIssued {
+		latency := signed.Sub(issued)
+		total += latency
+		if latency > l.Max {
+			l.Max = latency
+		}
+	}
+	l.Mean = total / time.Duration(len(d.tbIssued))
+	return l
+}
+
+// checkPromises alerts if the slowest promise fulfilled by the snapshot
+// of epoch, whose PromiseLatency is l, took more than the warning
+// fraction of the promise deadline, or more than the deadline.
+func (w *watchdog) checkPromises(dirID string, epoch merkletree.Epoch, l PromiseLatency) {
+	warning := w.PromiseWarning
+	if warning <= 0 || warning >= 1 {
+		warning = defaultPromiseWarning
+	}
+	severity := alert.Warning
+	switch {
+	case l.Max > w.PromiseDeadline:
+		severity = alert.Critical
+		w.mu.Lock()
+		w.health.LatePromises++
+		w.mu.Unlock()
+	case float64(l.Max) <= warning*float64(w.PromiseDeadline):
+		return
+	}
+	_ = alert.Send(w.Alerts, &alert.Alert{
+		Kind:      alert.SlowPromise,
+		Severity:  severity,
+		Time:      w.now(),
+		Directory: dirID,
+		Epoch:     epoch,
+		Message: fmt.Sprintf("a promise took %s of its deadline of %s to be fulfilled",
+			l.Max, w.PromiseDeadline),
+	})
+}
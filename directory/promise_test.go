@@ -0,0 +1,59 @@
+package directory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+func TestPromiseLatency(t *testing.T) {
+	alerts := new(alertRecorder)
+	var report *EpochReport
+	d := openWatched(t, WatchdogConfig{PromiseDeadline: 10 * time.Second, Alerts: alerts},
+		func(r *EpochReport) { report = r })
+	clock := time.Unix(1000, 0)
+	d.watchdog.now = func() time.Time { return clock }
+
+	d.Update()
+	assert.Equal(t, PromiseLatency{}, report.PromiseLatency)
+
+	_, err := d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	clock = clock.Add(2 * time.Second)
+	_, err = d.Register("bob", []byte("key"))
+	require.NoError(t, err)
+	clock = clock.Add(4 * time.Second)
+	d.Update()
+	assert.Equal(t, PromiseLatency{Max: 6 * time.Second, Mean: 5 * time.Second}, report.PromiseLatency)
+	assert.Zero(t, alerts.len())
+
+	// close to the deadline
+	_, err = d.Register("carol", []byte("key"))
+	require.NoError(t, err)
+	clock = clock.Add(9 * time.Second)
+	d.Update()
+	require.Equal(t, 1, alerts.len())
+	assert.Equal(t, alert.SlowPromise, alerts.alerts[0].Kind)
+	assert.Equal(t, alert.Warning, alerts.alerts[0].Severity)
+	assert.Equal(t, d.LatestSTR().Epoch, alerts.alerts[0].Epoch)
+	assert.Zero(t, d.Health().LatePromises)
+
+	// after the deadline
+	_, err = d.Register("dave", []byte("key"))
+	require.NoError(t, err)
+	clock = clock.Add(11 * time.Second)
+	d.Update()
+	require.Equal(t, 2, alerts.len())
+	assert.Equal(t, alert.Critical, alerts.alerts[1].Severity)
+	assert.Equal(t, uint64(1), d.Health().LatePromises)
+
+	// snapshots without promises don't alert
+	clock = clock.Add(time.Minute)
+	d.Update()
+	assert.Equal(t, PromiseLatency{}, report.PromiseLatency)
+	assert.Equal(t, 2, alerts.len())
+}
@@ -0,0 +1,97 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// reattestationSuffix follows the username in the name of the leaf that
+// stores the user's latest re-attestation. See transitionSuffix.
+const reattestationSuffix = "\x00reattestation"
+
+// ErrBadReattestation is wrapped by the errors of Reattest for
+// re-attestations the Tree can't accept.
+var ErrBadReattestation = errors.New("[directory] Invalid re-attestation")
+
+// ReattestationName returns the name of the leaf in which the latest
+// re-attestation of the binding of username is stored.
+func ReattestationName(username string) string {
+	return username + reattestationSuffix
+}
+
+// A Reattestation is a user's signed statement that Username is still
+// bound to their Key as of Epoch. It's signed with Key.
+//
+// If the directory's Config has a ReattestationInterval, every binding
+// must be re-attested at least that many epochs after it was made or
+// last re-attested, or it expires: the directory keeps the binding, but
+// flags it as expired in the responses to key lookups of Username until
+// the user re-attests it. The directory stores the latest re-attestation
+// in the leaf ReattestationName(Username) from Epoch on, and attaches it
+// to the responses to key lookups of Username while Username is bound to
+// Key, so that clients can verify when the binding expires.
+type Reattestation struct {
+	Username  string
+	Key       []byte
+	Epoch     merkletree.Epoch
+	Signature sign.Signature
+}
+
+// reattestationPrefix separates the signed re-attestations from other
+// signed messages.
+var reattestationPrefix = []byte("reattestation")
+
+// Bytes serializes the re-attestation for signing.
+func (r *Reattestation) Bytes() []byte {
+	bs := appendFields(append([]byte{}, reattestationPrefix...), []byte(r.Username), r.Key)
+	return append(bs, r.Epoch.Bytes()...)
+}
+
+// Sign signs the re-attestation with key, which must be the private key
+// of r.Key.
+func (r *Reattestation) Sign(key sign.PrivateKey) {
+	copy(r.Signature[:], key.Sign(r.Bytes()))
+}
+
+// Attests returns true iff r is a validly signed re-attestation of the
+// binding of username to key.
+func (r *Reattestation) Attests(username string, key []byte) bool {
+	return r.Username == username && bytes.Equal(r.Key, key) &&
+		verifyWithKey(r.Key, r.Bytes(), r.Signature)
+}
+
+// Expiry returns the first epoch in which the binding r attests is
+// expired under the policies p, unless it's re-attested again before.
+func (r *Reattestation) Expiry(p *Config) merkletree.Epoch {
+	return r.Epoch + merkletree.Epoch(p.ReattestationInterval)
+}
+
+// BindingExpiry returns the first epoch in which the binding proven by
+// leaf, the user leaf of an authentication path, is expired under the
+// policies p, which must have a ReattestationInterval, unless it's
+// re-attested before. The binding is renewed in the epoch it was made
+// in, i.e. the ChangedEpoch of leaf, and in the Epoch of r, its latest
+// re-attestation, if r isn't nil and attests it, which the caller must
+// have verified. Both are proven, by the tree and by the signature of r,
+// so clients derive the expiry themselves rather than trusting the
+// directory to flag it.
+func (p *Config) BindingExpiry(leaf *merkletree.ProofNode, r *Reattestation) merkletree.Epoch {
+	renewed := leaf.ChangedEpoch
+	if r != nil && bytes.Equal(r.Key, leaf.Value) && r.Epoch > renewed {
+		renewed = r.Epoch
+	}
+	return renewed + merkletree.Epoch(p.ReattestationInterval)
+}
+
+// A ReattestationRequest is a message with a Reattestation that a CONIKS
+// client sends to the directory to renew its user's binding. See
+// Tree.Reattest.
+//
+// The response to a successful request has the error code ReqSuccess
+// and no DirectoryResponse.
+type ReattestationRequest struct {
+	Reattestation *Reattestation
+}
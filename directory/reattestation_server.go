@@ -0,0 +1,105 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// Reattest stores the re-attestation r, which becomes part of the
+// snapshot taken at the end of the current epoch, and renews the binding
+// it attests. See Reattestation.
+//
+// It returns an error wrapping ErrBadReattestation if the Tree has no
+// ReattestationInterval, if r isn't signed by r.Key, if r.Key isn't bound
+// to r.Username in the latest snapshot or has been revoked or deleted, or
+// if r.Epoch isn't the current epoch, i.e. the one after the latest
+// snapshot. Like Register, it returns ErrReadOnly if the Tree is in
+// read-only mode.
+func (d *Tree) Reattest(r *Reattestation) error {
+	if len(r.Username) == 0 || len(r.Key) == 0 {
+		return ErrNoKeyOrValue
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	if d.config.ReattestationInterval == 0 {
+		return fmt.Errorf("%w: the directory doesn't require re-attestations", ErrBadReattestation)
+	}
+	if !r.Attests(r.Username, r.Key) {
+		return fmt.Errorf("%w: bad signature", ErrBadReattestation)
+	}
+	latest := d.latest()
+	if r.Epoch != latest.STR().Epoch+1 {
+		return fmt.Errorf("%w: epoch %d isn't the current one", ErrBadReattestation, r.Epoch)
+	}
+	ap, err := latest.Get([]byte(r.Username))
+	if err != nil {
+		return err
+	}
+	if ap.ProofType() != merkletree.ProofOfInclusion || !bytes.Equal(ap.Leaf.Value, r.Key) ||
+		d.tbs[r.Username] != nil {
+		return fmt.Errorf("%w: %s isn't bound to the key", ErrBadReattestation, r.Username)
+	}
+	if d.revoked(r.Username, r.Key) {
+		return fmt.Errorf("%w: the key has been revoked", ErrBadReattestation)
+	}
+	if d.deletions[r.Username] != nil {
+		return fmt.Errorf("%w: the binding has been deleted", ErrBadReattestation)
+	}
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := d.pad.Set([]byte(ReattestationName(r.Username)), value); err != nil {
+		return fmt.Errorf("setting value in PAD: %w", err)
+	}
+	d.reattestations[r.Username] = r
+	return nil
+}
+
+// withReattestation attaches the latest re-attestation of the binding
+// of username that leaf proves in epoch to res, and flags the binding if
+// it has expired (see Config.BindingExpiry).
+func (d *Tree) withReattestation(res *Response, username string, leaf *merkletree.ProofNode,
+	epoch merkletree.Epoch) *Response {
+	df := res.DirectoryResponse.(*DirectoryProof)
+	r := d.reattestations[username]
+	if r != nil && bytes.Equal(r.Key, leaf.Value) {
+		df.Reattestation = r
+	}
+	df.Expired = d.config.ReattestationInterval > 0 && epoch >= d.config.BindingExpiry(leaf, r)
+	return res
+}
+
+// HandleReattestation stores the Reattestation in the
+// ReattestationRequest req received from a CONIKS client, and returns
+// the response to be sent back to the client. A request without
+// a re-attestation, username or key is considered malformed, and causes
+// HandleReattestation() to return a NewErrorResponse(ErrMalformedMessage).
+// A re-attestation the Tree doesn't accept causes it to return
+// a NewErrorResponse(ReqRejected), and any other error
+// a NewErrorResponse(ErrDirectory).
+func (d *Tree) HandleReattestation(req *ReattestationRequest) *Response {
+	if req.Reattestation == nil {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+	switch err := d.Reattest(req.Reattestation); {
+	case err == nil:
+		return NewErrorResponse(protocol.ReqSuccess)
+	case err == ErrNoKeyOrValue:
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	case errors.Is(err, ErrBadReattestation):
+		return NewErrorResponse(protocol.ReqRejected)
+	default:
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
+}
@@ -0,0 +1,102 @@
+package directory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// newReattestation returns a re-attestation of the binding of alice to
+// the public key of key in epoch, signed with key.
+func newReattestation(key sign.PrivateKey, epoch merkletree.Epoch) *Reattestation {
+	r := &Reattestation{Username: "alice", Key: key.Public(), Epoch: epoch}
+	r.Sign(key)
+	return r
+}
+
+func TestReattestation(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithReattestationInterval(3),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), d.LatestSTR().Policies.ReattestationInterval)
+	key, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = d.Register("alice", key.Public())
+	require.NoError(t, err)
+	assert.True(t, errors.Is(d.Reattest(newReattestation(key, 1)), ErrBadReattestation), "pending binding")
+	d.Update()
+	lookup := func() *DirectoryProof {
+		res := d.KeyLookup(&KeyLookupRequest{Username: "alice"})
+		require.Equal(t, protocol.ReqSuccess, res.Error)
+		return res.DirectoryResponse.(*DirectoryProof)
+	}
+	// the binding was made in epoch 1, and expires in epoch 4
+	for d.LatestSTR().Epoch < 3 {
+		assert.False(t, lookup().Expired)
+		d.Update()
+	}
+	assert.False(t, lookup().Expired)
+	d.Update()
+	assert.True(t, lookup().Expired)
+	assert.Nil(t, lookup().Reattestation)
+
+	ep := d.LatestSTR().Epoch
+	other, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	forged := newReattestation(key, ep+1)
+	forged.Epoch++
+	for name, r := range map[string]*Reattestation{
+		"bad signature": forged,
+		"past epoch":    newReattestation(key, ep),
+		"wrong key":     newReattestation(other, ep+1),
+	} {
+		assert.True(t, errors.Is(d.Reattest(r), ErrBadReattestation), name)
+	}
+
+	r := newReattestation(key, ep+1)
+	res := d.HandleRequest(&Request{Type: ReattestationType, Request: &ReattestationRequest{Reattestation: r}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	// lookups carry the re-attestation right away, which renews the
+	// binding until ep+4, and the next snapshot commits to it
+	assert.Equal(t, r, lookup().Reattestation)
+	assert.False(t, lookup().Expired)
+	d.Update()
+	ap := mustLookup(t, d, ReattestationName("alice"))
+	require.Equal(t, merkletree.ProofOfInclusion, ap.ProofType())
+	for d.LatestSTR().Epoch < ep+3 {
+		d.Update()
+		assert.False(t, lookup().Expired)
+	}
+	d.Update()
+	assert.True(t, lookup().Expired)
+	assert.Equal(t, r, lookup().Reattestation)
+
+	// monitoring responses carry the expiry too
+	mon := d.Monitor(&MonitoringRequest{Username: "alice", StartEpoch: 1, EndEpoch: d.LatestSTR().Epoch})
+	require.Equal(t, protocol.ReqSuccess, mon.Error)
+	assert.True(t, mon.DirectoryResponse.(*DirectoryProof).Expired)
+}
+
+func TestReattestationDisabled(t *testing.T) {
+	d := NewTestTree(t)
+	key, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = d.Register("alice", key.Public())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		d.Update()
+	}
+	assert.False(t, d.KeyLookup(&KeyLookupRequest{Username: "alice"}).DirectoryResponse.(*DirectoryProof).Expired)
+	assert.True(t, errors.Is(d.Reattest(newReattestation(key, d.LatestSTR().Epoch+1)), ErrBadReattestation))
+	assert.Equal(t, protocol.ErrMalformedMessage, d.HandleReattestation(&ReattestationRequest{}).Error)
+}
@@ -0,0 +1,129 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// revocationSuffix follows the username in the name of the leaf that
+// stores the revocation of the user's key. See transitionSuffix.
+const revocationSuffix = "\x00revocation"
+
+// ErrBadRevocation is wrapped by the errors of Revoke for revocations
+// the Tree can't accept.
+var ErrBadRevocation = errors.New("[directory] Invalid revocation")
+
+// RevocationName returns the name of the leaf in which the revocation
+// of the key of username is stored.
+func RevocationName(username string) string {
+	return username + revocationSuffix
+}
+
+// A RecoveryDelegation is a user's statement, signed with Key, that
+// RecoveryKey may revoke Key. The user creates it while they hold Key,
+// and keeps it with the private recovery key, so that they can revoke
+// Key even if they lose it.
+type RecoveryDelegation struct {
+	Username    string
+	Key         []byte
+	RecoveryKey []byte
+	Signature   sign.Signature
+}
+
+// recoveryDelegationPrefix separates the signed recovery delegations
+// from other signed messages.
+var recoveryDelegationPrefix = []byte("recovery delegation")
+
+// Bytes serializes the delegation for signing with Key.
+func (r *RecoveryDelegation) Bytes() []byte {
+	return appendFields(append([]byte{}, recoveryDelegationPrefix...),
+		[]byte(r.Username), r.Key, r.RecoveryKey)
+}
+
+// Sign signs the delegation with the private key whose public key is
+// r.Key.
+func (r *RecoveryDelegation) Sign(key sign.PrivateKey) {
+	copy(r.Signature[:], key.Sign(r.Bytes()))
+}
+
+// A Revocation is a statement that the key Key bound to Username is
+// compromised as of Epoch, so that nobody should encrypt to it, nor
+// trust what it signed since. It's signed either with Key itself, or,
+// if Recovery is set, with the recovery key Key delegated to.
+//
+// The directory stores the revocation in the leaf RevocationName(Username)
+// from the epoch after it was submitted, and attaches it to the responses
+// to key lookups of Username while Username is bound to Key, starting
+// immediately.
+type Revocation struct {
+	Username  string
+	Key       []byte
+	Epoch     merkletree.Epoch
+	Recovery  *RecoveryDelegation `json:",omitempty"`
+	Signature sign.Signature
+}
+
+// revocationPrefix separates the signed revocations from other signed
+// messages.
+var revocationPrefix = []byte("revocation")
+
+// Bytes serializes the revocation for signing.
+func (r *Revocation) Bytes() []byte {
+	bs := appendFields(append([]byte{}, revocationPrefix...), []byte(r.Username), r.Key)
+	return append(bs, r.Epoch.Bytes()...)
+}
+
+// Sign signs the revocation with key, which must be the private key of
+// r.Key, or the recovery key of r.Recovery.
+func (r *Revocation) Sign(key sign.PrivateKey) {
+	copy(r.Signature[:], key.Sign(r.Bytes()))
+}
+
+// Verify returns true iff r is signed with r.Key, or with a recovery key
+// r.Key delegated to for r.Username.
+func (r *Revocation) Verify() bool {
+	signer := r.Key
+	if d := r.Recovery; d != nil {
+		if d.Username != r.Username || !bytes.Equal(d.Key, r.Key) ||
+			!verifyWithKey(d.Key, d.Bytes(), d.Signature) {
+			return false
+		}
+		signer = d.RecoveryKey
+	}
+	return verifyWithKey(signer, r.Bytes(), r.Signature)
+}
+
+// Revokes returns true iff r is a valid revocation of the key of
+// username.
+func (r *Revocation) Revokes(username string, key []byte) bool {
+	return r.Username == username && bytes.Equal(r.Key, key) && r.Verify()
+}
+
+// A RevocationRequest is a message with a Revocation that a CONIKS
+// client sends to the directory to revoke its user's key. See
+// Tree.Revoke.
+//
+// The response to a successful request has the error code ReqSuccess
+// and no DirectoryResponse.
+type RevocationRequest struct {
+	Revocation *Revocation
+}
+
+// appendFields appends the length-prefixed fields to bs.
+func appendFields(bs []byte, fields ...[]byte) []byte {
+	for _, f := range fields {
+		bs = append(bs, conv.UInt32ToBytes(uint32(len(f)))...)
+		bs = append(bs, f...)
+	}
+	return bs
+}
+
+// verifyWithKey returns true iff sig is a signature of message with the
+// ed25519 public key key.
+func verifyWithKey(key, message []byte, sig sign.Signature) bool {
+	return len(key) == sign.PublicKeySize && sign.PublicKey(key).Verify(message, sig[:])
+}
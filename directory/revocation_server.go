@@ -0,0 +1,112 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// Revoke stores the revocation r, which becomes part of the snapshot
+// taken at the end of the current epoch, and is attached to the
+// responses to key lookups of r.Username right away. A revoked key can't
+// announce a key transition.
+//
+// It returns an error wrapping ErrBadRevocation if r isn't signed by
+// r.Key or a recovery key it delegated to, if r.Key isn't bound to
+// r.Username in the latest snapshot or by a temporary binding, or if
+// r.Epoch is later than the current epoch. Like Register, it returns
+// ErrReadOnly if the Tree is in read-only mode.
+func (d *Tree) Revoke(r *Revocation) error {
+	if len(r.Username) == 0 || len(r.Key) == 0 {
+		return ErrNoKeyOrValue
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	if !r.Verify() {
+		return fmt.Errorf("%w: bad signature", ErrBadRevocation)
+	}
+	latest := d.latest()
+	if r.Epoch > latest.STR().Epoch+1 {
+		return fmt.Errorf("%w: epoch %d is in the future", ErrBadRevocation, r.Epoch)
+	}
+	bound, err := d.boundKey(latest, r.Username)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(bound, r.Key) {
+		return fmt.Errorf("%w: %s isn't bound to the key", ErrBadRevocation, r.Username)
+	}
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := d.pad.Set([]byte(RevocationName(r.Username)), value); err != nil {
+		return fmt.Errorf("setting value in PAD: %w", err)
+	}
+	d.revocations[r.Username] = r
+	return nil
+}
+
+// boundKey returns the key bound to username in the snapshot latest, or
+// by a temporary binding, or nil if there is none, or the error of
+// looking it up.
+func (d *Tree) boundKey(latest merkletree.ReadOnlyTree, username string) ([]byte, error) {
+	ap, err := latest.Get([]byte(username))
+	if err != nil {
+		return nil, err
+	}
+	if ap.ProofType() == merkletree.ProofOfInclusion {
+		return ap.Leaf.Value, nil
+	}
+	if tb := d.tbs[username]; tb != nil {
+		return tb.Value, nil
+	}
+	return nil, nil
+}
+
+// withRevocation attaches the revocation of key, the key res binds
+// username to, to res if there is one.
+func (d *Tree) withRevocation(res *Response, username string, key []byte) *Response {
+	if d.revoked(username, key) {
+		res.DirectoryResponse.(*DirectoryProof).Revocation = d.revocations[username]
+	}
+	return res
+}
+
+// revoked reports whether key, bound to username, has been revoked.
+func (d *Tree) revoked(username string, key []byte) bool {
+	r := d.revocations[username]
+	return r != nil && bytes.Equal(r.Key, key)
+}
+
+// HandleRevocation stores the revocation in the RevocationRequest req
+// received from a CONIKS client, and returns the response to be sent
+// back to the client. A request without a revocation, username or key
+// is considered malformed, and causes HandleRevocation() to return
+// a NewErrorResponse(ErrMalformedMessage). A revocation the Tree doesn't
+// accept causes it to return a NewErrorResponse(ReqRejected), and any
+// other error a NewErrorResponse(ErrDirectory).
+func (d *Tree) HandleRevocation(req *RevocationRequest) *Response {
+	if req.Revocation == nil {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+	switch err := d.Revoke(req.Revocation); {
+	case err == nil:
+		return NewErrorResponse(protocol.ReqSuccess)
+	case err == ErrNoKeyOrValue:
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	case errors.Is(err, ErrBadRevocation):
+		return NewErrorResponse(protocol.ReqRejected)
+	default:
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
+}
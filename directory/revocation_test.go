@@ -0,0 +1,121 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// newRevocation returns a revocation of the key of alice in epoch,
+// signed with key.
+func newRevocation(key sign.PrivateKey, epoch merkletree.Epoch) *Revocation {
+	r := &Revocation{Username: "alice", Key: key.Public(), Epoch: epoch}
+	r.Sign(key)
+	return r
+}
+
+func TestRevocation(t *testing.T) {
+	key, err := sign.GenerateKey(bytes.NewReader(make([]byte, 32)))
+	require.NoError(t, err)
+	d := NewTestTree(t)
+	_, err = d.Register("alice", key.Public())
+	require.NoError(t, err)
+	d.Update()
+	ep := d.LatestSTR().Epoch
+
+	other, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	forged := newRevocation(key, ep)
+	forged.Epoch++
+	bob := newRevocation(key, ep)
+	bob.Username = "bob"
+	bob.Sign(key)
+	for name, r := range map[string]*Revocation{
+		"bad signature":  forged,
+		"future epoch":   newRevocation(key, ep+2),
+		"wrong key":      newRevocation(other, ep),
+		"not registered": bob,
+	} {
+		assert.True(t, errors.Is(d.Revoke(r), ErrBadRevocation), name)
+	}
+
+	lookup := func() *DirectoryProof {
+		res := d.KeyLookup(&KeyLookupRequest{Username: "alice"})
+		require.Equal(t, protocol.ReqSuccess, res.Error)
+		return res.DirectoryResponse.(*DirectoryProof)
+	}
+	require.Nil(t, lookup().Revocation)
+
+	r := newRevocation(key, ep)
+	res := d.HandleRequest(&Request{Type: RevocationType, Request: &RevocationRequest{Revocation: r}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	// lookups carry the revocation right away
+	assert.Equal(t, r, lookup().Revocation)
+	tr := &KeyTransition{Username: "alice", OldKey: key.Public(), NewKey: []byte("new key"), Epoch: ep + 2}
+	tr.Sign(key)
+	assert.True(t, errors.Is(d.AnnounceTransition(tr), ErrBadTransition))
+
+	// and the next snapshot commits to it
+	d.Update()
+	ap := mustLookup(t, d, RevocationName("alice"))
+	require.Equal(t, merkletree.ProofOfInclusion, ap.ProofType())
+	assert.Equal(t, r, lookup().Revocation)
+
+	// a new key isn't revoked
+	_, err = d.Register("bob", key.Public())
+	require.NoError(t, err)
+	assert.Nil(t, d.KeyLookup(&KeyLookupRequest{Username: "bob"}).DirectoryResponse.(*DirectoryProof).Revocation)
+}
+
+func TestRevocationWithRecoveryKey(t *testing.T) {
+	key, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	recovery, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	d := NewTestTree(t)
+	_, err = d.Register("alice", key.Public())
+	require.NoError(t, err)
+
+	delegation := &RecoveryDelegation{Username: "alice", Key: key.Public(), RecoveryKey: recovery.Public()}
+	delegation.Sign(key)
+	r := &Revocation{Username: "alice", Key: key.Public(), Recovery: delegation}
+	r.Sign(recovery)
+	assert.True(t, r.Verify())
+	assert.False(t, r.Revokes("bob", key.Public()))
+
+	undelegated := *r
+	undelegated.Recovery = nil
+	assert.False(t, undelegated.Verify())
+	selfDelegated := *delegation
+	selfDelegated.Sign(recovery)
+	forged := *r
+	forged.Recovery = &selfDelegated
+	assert.False(t, forged.Verify())
+
+	// the pending key can be revoked too
+	require.NoError(t, d.Revoke(r))
+	res := d.KeyLookup(&KeyLookupRequest{Username: "alice"})
+	assert.Equal(t, r, res.DirectoryResponse.(*DirectoryProof).Revocation)
+}
+
+func TestHandleRevocationErrors(t *testing.T) {
+	d := NewTestTree(t)
+	for _, tc := range []struct {
+		name string
+		req  *RevocationRequest
+		want protocol.ErrorCode
+	}{
+		{"no revocation", &RevocationRequest{}, protocol.ErrMalformedMessage},
+		{"no key", &RevocationRequest{Revocation: &Revocation{Username: "alice"}}, protocol.ErrMalformedMessage},
+		{"unsigned", &RevocationRequest{Revocation: &Revocation{Username: "alice", Key: []byte("key")}}, protocol.ReqRejected},
+	} {
+		assert.Equal(t, tc.want, d.HandleRevocation(tc.req).Error, tc.name)
+	}
+}
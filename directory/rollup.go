@@ -0,0 +1,65 @@
+package directory
+
+import (
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// A Rollup is a directory's signed commitment to its whole STR history
+// up to STR. It lets new clients of an old directory start from STR
+// instead of downloading and verifying every STR since the initial one.
+// ListRoot is the root of the merkletree.STRList of the STRs for epochs
+// 0 through STR.Epoch, and DirInitSTRHash identifies the directory like
+// in an AuditingRequest.
+//
+// A client can't check ListRoot by itself. Instead, it only accepts
+// a Rollup that enough of the auditors it trusts attested to, i.e.
+// checked against the STR history they observed. See Attestation.
+type Rollup struct {
+	STR            *SignedTreeRoot
+	ListRoot       hashed.Hash
+	DirInitSTRHash [hashed.HashSizeByte]byte
+	Signature      sign.Signature
+}
+
+// rollupPrefix separates the signed rollups from other signed messages.
+var rollupPrefix = []byte("rollup")
+
+// Bytes serializes the rollup for signing by the directory.
+func (r *Rollup) Bytes() []byte {
+	strHash := hashed.Sum(r.STR.Signature[:])
+	bs := append([]byte{}, rollupPrefix...)
+	bs = append(bs, r.STR.Epoch.Bytes()...)
+	bs = append(bs, strHash[:]...)
+	bs = append(bs, r.ListRoot[:]...)
+	bs = append(bs, r.DirInitSTRHash[:]...)
+	return bs
+}
+
+// AttestationBytes serializes the signed rollup for signing by an
+// auditor. See Attestation.
+func (r *Rollup) AttestationBytes() []byte {
+	bs := append([]byte{}, rollupAttestationPrefix...)
+	bs = append(bs, r.Bytes()...)
+	bs = append(bs, r.Signature[:]...)
+	return bs
+}
+
+// A RollupRequest is a message that a new CONIKS client sends to the
+// directory to get a Rollup of its STR history up to the latest epoch.
+//
+// The response to a successful request is a Rollup.
+type RollupRequest struct{}
+
+var _ DirectoryResponse = (*Rollup)(nil)
+
+// NewRollupResponse creates the response message a CONIKS directory
+// sends to a client upon a RollupRequest, and returns a Response
+// containing the Rollup r.
+func NewRollupResponse(r *Rollup) *Response {
+	return &Response{
+		Error:             protocol.ReqSuccess,
+		DirectoryResponse: r,
+	}
+}
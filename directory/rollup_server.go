@@ -0,0 +1,18 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+// Rollup signs a Rollup of the directory's STR history up to the latest
+// STR. It doesn't need the older STRs, which may have been removed from
+// memory.
+func (d *Tree) Rollup() *Rollup {
+	root, first := d.pad.STRListRoot()
+	r := &Rollup{
+		STR:            d.LatestSTR(),
+		ListRoot:       root,
+		DirInitSTRHash: first,
+	}
+	r.Signature = d.pad.Sign(r.Bytes())
+	return r
+}
@@ -0,0 +1,33 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestTree_Rollup(t *testing.T) {
+	d, err := New(vrfKey, signKey, 2)
+	require.NoError(t, err)
+	var list merkletree.STRList
+	list.Append(d.LatestSTR().SignedTreeRoot)
+	for i := 0; i < 10; i++ {
+		d.Update()
+		list.Append(d.LatestSTR().SignedTreeRoot)
+	}
+
+	// the older STRs have been removed from memory, but are still
+	// committed to
+	res := d.HandleRequest(&Request{Type: RollupType, Request: &RollupRequest{}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	r := res.DirectoryResponse.(*Rollup)
+	assert.Equal(t, d.LatestSTR(), r.STR)
+	assert.Equal(t, list.Root(), r.ListRoot)
+	assert.Equal(t, [hashed.HashSizeByte]byte(list.First()), r.DirInitSTRHash)
+	assert.True(t, signKey.Public().Verify(r.Bytes(), r.Signature[:]))
+}
@@ -0,0 +1,75 @@
+package directory
+
+import (
+	"errors"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// ErrBadSchedule is returned by SchedulePolicy for policy changes the
+// Tree can't announce.
+var ErrBadSchedule = errors.New("[directory] Invalid policy schedule")
+
+// A PolicyUpdate announces that a directory's policies change at Epoch:
+// the STR of that epoch is the first whose Config has the
+// MinKeyChangeInterval, DeletionQuarantine, ReattestationInterval and
+// Capabilities of the update. Like an Upgrade, the announcement is part
+// of every STR from the one after it's scheduled up to the one before
+// Epoch, so that clients learn of it in advance and can check that the
+// change happens exactly then. An announced change may withdraw
+// capabilities without flagging a PolicyChange.
+type PolicyUpdate struct {
+	Epoch                 merkletree.Epoch
+	MinKeyChangeInterval  uint64       `json:",omitempty"`
+	DeletionQuarantine    uint64       `json:",omitempty"`
+	ReattestationInterval uint64       `json:",omitempty"`
+	Capabilities          Capabilities `json:",omitempty"`
+}
+
+// Bytes serializes u for signing, as the epoch followed by the policies.
+func (u *PolicyUpdate) Bytes() []byte {
+	bs := conv.ULongToBytes(uint64(u.Epoch))
+	bs = append(bs, conv.ULongToBytes(u.MinKeyChangeInterval)...)
+	bs = append(bs, conv.ULongToBytes(u.DeletionQuarantine)...)
+	bs = append(bs, conv.ULongToBytes(u.ReattestationInterval)...)
+	return append(bs, conv.UInt32ToBytes(uint32(u.Capabilities))...)
+}
+
+// Equal returns true iff u and other announce the same change, or are
+// both nil.
+func (u *PolicyUpdate) Equal(other *PolicyUpdate) bool {
+	if u == nil || other == nil {
+		return u == other
+	}
+	return *u == *other
+}
+
+// Matches returns true iff p has the policies u announces.
+func (u *PolicyUpdate) Matches(p *Config) bool {
+	return p.MinKeyChangeInterval == u.MinKeyChangeInterval &&
+		p.DeletionQuarantine == u.DeletionQuarantine &&
+		p.ReattestationInterval == u.ReattestationInterval &&
+		p.Capabilities == u.Capabilities
+}
+
+// ScheduledAt returns the PolicyUpdate p announces for epoch, or nil if
+// there's none.
+func (p *Config) ScheduledAt(epoch merkletree.Epoch) *PolicyUpdate {
+	for _, u := range p.Schedule {
+		if u.Epoch == epoch {
+			return u
+		}
+	}
+	return nil
+}
+
+// scheduleBytes serializes the announced policy updates of p.
+func (p *Config) scheduleBytes() []byte {
+	bs := append([]byte{}, scheduleTag...)
+	bs = append(bs, conv.UInt32ToBytes(uint32(len(p.Schedule)))...)
+	for _, u := range p.Schedule {
+		bs = append(bs, u.Bytes()...)
+	}
+	return bs
+}
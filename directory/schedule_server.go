@@ -0,0 +1,102 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// SchedulePolicy announces that the Tree's policies change to the
+// MinKeyChangeInterval, DeletionQuarantine, ReattestationInterval and
+// Capabilities of cfg at epoch, starting with the STR the next Update
+// signs. Any number of changes may be queued; one for an epoch that
+// already has one replaces it. The announcement must precede the
+// change, so epoch must be later than the epoch of that STR. Changing or
+// cancelling (see CancelPolicy) an announced change flags
+// a PolicyChange, like withdrawing capabilities. It returns
+// ErrBadSchedule if cfg is nil or epoch is too early.
+func (d *Tree) SchedulePolicy(epoch merkletree.Epoch, cfg *Config) error {
+	if cfg == nil || epoch <= d.pad.LatestSTR().Epoch+1 {
+		return ErrBadSchedule
+	}
+	u := &PolicyUpdate{
+		Epoch:                 epoch,
+		MinKeyChangeInterval:  cfg.MinKeyChangeInterval,
+		DeletionQuarantine:    cfg.DeletionQuarantine,
+		ReattestationInterval: cfg.ReattestationInterval,
+		Capabilities:          cfg.Capabilities,
+	}
+	schedule := make([]*PolicyUpdate, 0, len(d.config.Schedule)+1)
+	inserted := false
+	for _, s := range d.config.Schedule {
+		switch {
+		case s.Epoch == epoch:
+			continue
+		case s.Epoch > epoch && !inserted:
+			schedule = append(schedule, u)
+			inserted = true
+		}
+		schedule = append(schedule, s)
+	}
+	if !inserted {
+		schedule = append(schedule, u)
+	}
+	if prev := d.config.ScheduledAt(epoch); prev != nil && !prev.Equal(u) {
+		d.policyChange = true
+	}
+	d.setSchedule(schedule)
+	return nil
+}
+
+// CancelPolicy withdraws the policy change announced for epoch with
+// SchedulePolicy, if any, starting with the STR the next Update signs.
+func (d *Tree) CancelPolicy(epoch merkletree.Epoch) {
+	if d.config.ScheduledAt(epoch) == nil {
+		return
+	}
+	var schedule []*PolicyUpdate
+	for _, u := range d.config.Schedule {
+		if u.Epoch != epoch {
+			schedule = append(schedule, u)
+		}
+	}
+	d.policyChange = true
+	d.setSchedule(schedule)
+}
+
+// PolicySchedule returns the policy changes the Tree announced and
+// hasn't made yet, ordered by epoch.
+func (d *Tree) PolicySchedule() []*PolicyUpdate {
+	return append([]*PolicyUpdate(nil), d.config.Schedule...)
+}
+
+// setSchedule replaces the announced policy changes with schedule.
+func (d *Tree) setSchedule(schedule []*PolicyUpdate) {
+	// STRs share the Config and its Schedule, so both are replaced
+	// instead of modified
+	config := *d.config
+	config.Schedule = schedule
+	d.config = &config
+	d.pad.SetAssocData(d.config)
+}
+
+// activatePolicies changes the Tree's policies as announced if a change
+// is due in epoch, the epoch of the STR the next Update signs.
+func (d *Tree) activatePolicies(epoch merkletree.Epoch) {
+	if len(d.config.Schedule) == 0 || d.config.Schedule[0].Epoch != epoch {
+		return
+	}
+	u := d.config.Schedule[0]
+	config := *d.config
+	config.MinKeyChangeInterval = u.MinKeyChangeInterval
+	config.DeletionQuarantine = u.DeletionQuarantine
+	config.ReattestationInterval = u.ReattestationInterval
+	config.Capabilities = u.Capabilities
+	config.Schedule = config.Schedule[1:]
+	if len(config.Schedule) == 0 {
+		config.Schedule = nil
+	}
+	d.config = &config
+	d.pad.SetAssocData(d.config)
+}
@@ -0,0 +1,91 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+func TestSchedulePolicy(t *testing.T) {
+	d := NewTestTree(t)
+	pk := crypto.NewStaticTestSigningKey().Public()
+
+	assert.Equal(t, ErrBadSchedule, d.SchedulePolicy(3, nil))
+	// the announcement has to precede the change
+	assert.Equal(t, ErrBadSchedule, d.SchedulePolicy(1, &Config{MinKeyChangeInterval: 2}))
+	require.NoError(t, d.SchedulePolicy(4, &Config{DeletionQuarantine: 5, Capabilities: CapDeletion}))
+	require.NoError(t, d.SchedulePolicy(3, &Config{MinKeyChangeInterval: 2}))
+	assert.Equal(t, []merkletree.Epoch{3, 4}, epochs(d.PolicySchedule()))
+
+	d.Update()
+	announced := d.LatestSTR()
+	assert.Equal(t, []merkletree.Epoch{3, 4}, epochs(announced.Policies.Schedule))
+	assert.False(t, announced.Policies.PolicyChange)
+	d.Update()
+	d.Update()
+	changed := d.LatestSTR()
+	assert.Equal(t, uint64(2), changed.Policies.MinKeyChangeInterval)
+	assert.Equal(t, []merkletree.Epoch{4}, epochs(changed.Policies.Schedule))
+	d.Update()
+	last := d.LatestSTR()
+	assert.Equal(t, uint64(5), last.Policies.DeletionQuarantine)
+	assert.Equal(t, CapDeletion, last.Policies.Capabilities)
+	assert.Nil(t, last.Policies.Schedule)
+	assert.False(t, last.Policies.PolicyChange)
+	assert.True(t, pk.Verify(last.Bytes(), last.Signature[:]))
+
+	// the earlier STRs are unchanged
+	assert.Equal(t, []merkletree.Epoch{3, 4}, epochs(announced.Policies.Schedule))
+	assert.Zero(t, announced.Policies.MinKeyChangeInterval)
+	assert.True(t, pk.Verify(announced.Bytes(), announced.Signature[:]))
+}
+
+func TestChangeSchedule(t *testing.T) {
+	d := NewTestTree(t)
+
+	d.CancelPolicy(5)
+	require.NoError(t, d.SchedulePolicy(5, &Config{MinKeyChangeInterval: 2}))
+	d.Update()
+	assert.False(t, d.LatestSTR().Policies.PolicyChange)
+
+	// announcing the same change again is no change
+	require.NoError(t, d.SchedulePolicy(5, &Config{MinKeyChangeInterval: 2}))
+	d.Update()
+	assert.False(t, d.LatestSTR().Policies.PolicyChange)
+
+	require.NoError(t, d.SchedulePolicy(5, &Config{MinKeyChangeInterval: 3}))
+	d.Update()
+	assert.True(t, d.LatestSTR().Policies.PolicyChange)
+	assert.Equal(t, uint64(3), d.LatestSTR().Policies.ScheduledAt(5).MinKeyChangeInterval)
+
+	d.CancelPolicy(5)
+	d.Update()
+	assert.True(t, d.LatestSTR().Policies.PolicyChange)
+	assert.Nil(t, d.LatestSTR().Policies.Schedule)
+	for d.LatestSTR().Epoch < 6 {
+		d.Update()
+		assert.Zero(t, d.LatestSTR().Policies.MinKeyChangeInterval)
+	}
+}
+
+func TestConfigBytesSchedule(t *testing.T) {
+	c := NewConfig(nil)
+	plain := c.Bytes()
+	c.Schedule = []*PolicyUpdate{{Epoch: 3, MinKeyChangeInterval: 2}}
+	announced := c.Bytes()
+	assert.NotEqual(t, plain, announced)
+	c.Schedule = []*PolicyUpdate{{Epoch: 3, MinKeyChangeInterval: 3}}
+	assert.NotEqual(t, announced, c.Bytes())
+}
+
+func epochs(schedule []*PolicyUpdate) []merkletree.Epoch {
+	var es []merkletree.Epoch
+	for _, u := range schedule {
+		es = append(es, u.Epoch)
+	}
+	return es
+}
@@ -1,6 +1,12 @@
 package directory
 
-import "github.com/ORBAT/cloniks/merkletree"
+import (
+	"bytes"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
 
 // SignedTreeRoot
 type SignedTreeRoot struct {
@@ -16,6 +22,42 @@ func NewDirSTR(str *merkletree.SignedTreeRoot) *SignedTreeRoot {
 	}
 }
 
+// MarshalJSON encodes str with merkletree.MarshalSTR, with its policies
+// as the associated data, so that UnmarshalJSON reconstructs them with
+// the decoder registered for ConfigType, and the signature of the decoded
+// STR can be verified again.
+func (str SignedTreeRoot) MarshalJSON() ([]byte, error) {
+	if str.SignedTreeRoot == nil {
+		return []byte("null"), nil
+	}
+	inner := *str.SignedTreeRoot
+	inner.Ad = nil
+	if str.Policies != nil {
+		inner.Ad = str.Policies
+	}
+	return merkletree.MarshalSTR(&inner)
+}
+
+// UnmarshalJSON decodes an STR encoded with MarshalJSON, whose policies
+// are its associated data. It returns the errors of
+// merkletree.UnmarshalSTR, or merkletree.ErrMalformedSTR if the
+// associated data isn't a Config.
+func (str *SignedTreeRoot) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	inner, err := merkletree.UnmarshalSTR(data)
+	if err != nil {
+		return err
+	}
+	policies, ok := inner.Ad.(*Config)
+	if inner.Ad != nil && !ok {
+		return merkletree.ErrMalformedSTR
+	}
+	str.SignedTreeRoot, str.Policies = inner, policies
+	return nil
+}
+
 // Serialize overrides merkletree.SignedTreeRoot.Bytes
 func (str *SignedTreeRoot) Bytes() []byte {
 	return append(str.SerializeInternal(), str.Policies.Bytes()...)
@@ -25,3 +67,23 @@ func (str *SignedTreeRoot) Bytes() []byte {
 func (str *SignedTreeRoot) VerifyHashChain(savedSTR *SignedTreeRoot) bool {
 	return str.SignedTreeRoot.VerifyHashChain(savedSTR.SignedTreeRoot)
 }
+
+// VerifyGenesis verifies that str is the genesis STR of a directory with
+// the public signing key signKey (see merkletree.NewGenesisSTR), e.g. the
+// initial STR that a client pins or that identifies the directory to an
+// auditor. It returns ErrMalformedMessage if str isn't a well-formed
+// genesis STR, and CheckBadSignature if its signature doesn't verify.
+func (str *SignedTreeRoot) VerifyGenesis(signKey sign.PublicKey) error {
+	if str == nil || str.SignedTreeRoot == nil || str.Policies == nil || !str.IsGenesis() {
+		return protocol.ErrMalformedMessage
+	}
+	if !signKey.Verify(str.Bytes(), str.Signature[:]) {
+		return protocol.CheckBadSignature
+	}
+	return nil
+}
+
+// VerifySkip shadows merkletree.SignedTreeRoot.VerifySkip
+func (str *SignedTreeRoot) VerifySkip(older *SignedTreeRoot) bool {
+	return str.SignedTreeRoot.VerifySkip(older.SignedTreeRoot)
+}
@@ -1,6 +1,8 @@
 package directory
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
 
 	"github.com/ORBAT/cloniks/crypto/sign"
@@ -31,13 +33,13 @@ func TestVerifyHashChain(t *testing.T) {
 
 	savedSTR := pad.LatestSTR()
 
-	for i := uint64(1); i < N; i++ {
+	for i := merkletree.Epoch(1); i < merkletree.Epoch(N); i++ {
 		pad.Update(nil)
 		str := pad.LatestSTR()
 		if i != str.Epoch {
 			t.Fatal("Epochs aren't increasing.")
 		}
-		if !pk.Verify(str.Bytes(), str.Signature) {
+		if !pk.Verify(str.Bytes(), str.Signature[:]) {
 			t.Fatal("Invalid STR signature at epoch", i)
 		}
 		if !str.VerifyHashChain(savedSTR) {
@@ -46,3 +48,47 @@ func TestVerifyHashChain(t *testing.T) {
 		savedSTR = str
 	}
 }
+
+func TestUnmarshalSTRPolicies(t *testing.T) {
+	d := NewTestTree(t)
+	d.Update()
+	str := d.LatestSTR()
+
+	enc, err := merkletree.MarshalSTR(str.SignedTreeRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := merkletree.UnmarshalSTR(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewDirSTR(decoded)
+	if got.Policies == nil || !bytes.Equal(got.Policies.Bytes(), str.Policies.Bytes()) {
+		t.Fatal("Expect the policies", str.Policies, "got", got.Policies)
+	}
+	if !d.PublicKey().Verify(got.Bytes(), got.Signature[:]) {
+		t.Error("Expect the signature of the decoded STR to verify")
+	}
+}
+
+func TestSTRJSON(t *testing.T) {
+	d := NewTestTree(t)
+	d.Update()
+	str := d.LatestSTR()
+
+	enc, err := json.Marshal(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded SignedTreeRoot
+	if err := json.Unmarshal(enc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Policies == nil || decoded.Ad != decoded.Policies {
+		t.Fatal("Expect the policies to be the associated data, got", decoded.Ad)
+	}
+	if !d.PublicKey().Verify(decoded.Bytes(), decoded.Signature[:]) ||
+		!d.PublicKey().Verify(decoded.SignedTreeRoot.Bytes(), decoded.Signature[:]) {
+		t.Error("Expect the signature of the decoded STR to verify")
+	}
+}
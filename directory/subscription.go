@@ -0,0 +1,39 @@
+package directory
+
+import (
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// A Notification tells a subscriber that the bindings at some of the
+// lookup indices it subscribed to changed in the epoch of STR. AP has
+// the authentication path for each of them in that epoch's snapshot: a
+// proof of inclusion of the new binding, or a proof of absence if the
+// binding was removed. The paths have no VrfProof, since the Tree only
+// knows the indices, so a client verifying them must fill in the proofs
+// it got when it looked up the indices.
+type Notification struct {
+	STR *SignedTreeRoot
+	AP  []*merkletree.AuthenticationPath
+}
+
+var _ DirectoryResponse = (*Notification)(nil)
+
+// NewNotificationResponse creates the message a CONIKS directory pushes
+// to a subscribed client, and returns a Response containing the
+// Notification n.
+func NewNotificationResponse(n *Notification) *Response {
+	return &Response{
+		Error:             protocol.ReqSuccess,
+		DirectoryResponse: n,
+	}
+}
+
+// commitment returns the commitment to the binding ap proves the
+// inclusion of, or nil if ap is a proof of absence.
+func commitment(ap *merkletree.AuthenticationPath) []byte {
+	if ap.ProofType() != merkletree.ProofOfInclusion {
+		return nil
+	}
+	return ap.Leaf.Commitment.Hash
+}
@@ -0,0 +1,99 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// A Subscriber receives the notifications of a Subscription, e.g. to
+// push them to a client. Notify is called by Tree.Update, so it must not
+// use the Tree, and shouldn't block.
+type Subscriber interface {
+	Notify(n *Notification)
+}
+
+// SubscriberFunc adapts a function to a Subscriber.
+type SubscriberFunc func(n *Notification)
+
+// Notify calls f(n).
+func (f SubscriberFunc) Notify(n *Notification) {
+	f(n)
+}
+
+// A Subscription is a subscriber's interest in changes to the bindings
+// at a set of lookup indices, e.g. those of the contacts of a client,
+// which spares the client from monitoring each of them every epoch.
+type Subscription struct {
+	tree       *Tree
+	subscriber Subscriber
+	indices    []merkletree.Index
+	// commitments has the commitment to the binding at each index in
+	// the latest epoch, or nil if there is none.
+	commitments [][]byte
+}
+
+// Subscribe makes Update notify s whenever the bindings at any of the
+// lookup indices change, starting with the next epoch. Each
+// notification only has proofs for the indices whose bindings changed.
+// Subscribe returns merkletree.ErrIndexLength if any index isn't
+// of the Tree's index size, and the error of looking up an index.
+func (d *Tree) Subscribe(s Subscriber, indices ...merkletree.Index) (*Subscription, error) {
+	latest := d.latest()
+	sub := &Subscription{tree: d, subscriber: s}
+	for _, index := range indices {
+		if err := index.Validate(d.pad.IndexSize()); err != nil {
+			return nil, err
+		}
+		ap, err := latest.GetIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		sub.indices = append(sub.indices, append(merkletree.Index{}, index...))
+		sub.commitments = append(sub.commitments, commitment(ap))
+	}
+	d.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// Cancel stops the notifications of s.
+func (s *Subscription) Cancel() {
+	delete(s.tree.subs, s)
+}
+
+// notify notifies the subscribers whose bindings changed in the latest
+// epoch. An index that can't be looked up is skipped, and its change
+// is notified in a later epoch in which it can.
+func (d *Tree) notify() {
+	if len(d.subs) == 0 {
+		return
+	}
+	latest := d.latest()
+	str := NewDirSTR(latest.STR())
+	// many subscriptions may share an index, e.g. that of a popular
+	// contact
+	aps := make(map[string]*merkletree.AuthenticationPath)
+	for sub := range d.subs {
+		var changed []*merkletree.AuthenticationPath
+		for i, index := range sub.indices {
+			ap, ok := aps[string(index)]
+			if !ok {
+				var err error
+				if ap, err = latest.GetIndex(index); err != nil {
+					continue
+				}
+				aps[string(index)] = ap
+			}
+			if c := commitment(ap); !bytes.Equal(c, sub.commitments[i]) {
+				sub.commitments[i] = c
+				changed = append(changed, ap)
+			}
+		}
+		if len(changed) > 0 {
+			sub.subscriber.Notify(&Notification{STR: str, AP: changed})
+		}
+	}
+}
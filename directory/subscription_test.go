@@ -0,0 +1,54 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+func TestTree_Subscribe(t *testing.T) {
+	d := NewTestTree(t)
+	_, err := d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+
+	var contacts, bobs []*Notification
+	alice, bob, carol := d.pad.Index([]byte("alice")), d.pad.Index([]byte("bob")), d.pad.Index([]byte("carol"))
+	_, err = d.Subscribe(SubscriberFunc(func(n *Notification) { contacts = append(contacts, n) }),
+		alice, bob, carol)
+	require.NoError(t, err)
+	sub, err := d.Subscribe(SubscriberFunc(func(n *Notification) { bobs = append(bobs, n) }), bob)
+	require.NoError(t, err)
+	_, err = d.Subscribe(nil, bob[1:])
+	assert.Equal(t, merkletree.ErrIndexLength, err)
+
+	// nothing changed
+	d.Update()
+	assert.Empty(t, contacts)
+
+	_, err = d.Register("bob", []byte("bob key"))
+	require.NoError(t, err)
+	// the registration is only notified once it's committed to
+	assert.Empty(t, contacts)
+	d.Update()
+	require.Len(t, contacts, 1)
+	require.Len(t, bobs, 1)
+	n := contacts[0]
+	assert.Equal(t, d.LatestSTR(), n.STR)
+	require.Len(t, n.AP, 1)
+	assert.Equal(t, merkletree.ProofOfInclusion, n.AP[0].ProofType())
+	assert.Equal(t, bob, n.AP[0].LookupIndex)
+	assert.NoError(t, n.AP[0].Verify([]byte("bob"), []byte("bob key"), n.STR.TreeHash[:]))
+
+	sub.Cancel()
+	_, err = d.Register("carol", []byte("carol key"))
+	require.NoError(t, err)
+	d.Update()
+	require.Len(t, contacts, 2)
+	assert.Len(t, bobs, 1)
+	require.Len(t, contacts[1].AP, 1)
+	assert.Equal(t, carol, contacts[1].AP[0].LookupIndex)
+}
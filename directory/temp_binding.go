@@ -1,5 +1,11 @@
 package directory
 
+import (
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
 // A TemporaryBinding consists of the private Index for a key, its Value, and a digital Signature of
 // these fields.
 //
@@ -7,18 +13,27 @@ package directory
 // corresponding name-to-key binding in the next directory snapshot. As such, TBs allow clients to
 // begin using the contained key-to-value binding without having to wait for the binding's inclusion
 // in the next snapshot.
+//
+// If the directory binds a name more than once per epoch (see Config.MaxChangesPerEpoch), Change
+// is the number of times it bound the name in the epoch up to and including this TB, unless it's
+// the first time. A TB supersedes the TBs for the same index issued in the same epoch with a lower
+// Change, so the next snapshot fulfills the TB with the highest Change.
 type TemporaryBinding struct {
-	Index     []byte
+	Index     merkletree.Index
 	Value     []byte
-	Signature []byte
+	Change    uint64 `json:",omitempty"`
+	Signature sign.Signature
 }
 
 // Bytes serializes the temporary binding into
 // a specified format.
-func (tb *TemporaryBinding) Bytes(strSig []byte) []byte {
+func (tb *TemporaryBinding) Bytes(strSig sign.Signature) []byte {
 	tbBytes := make([]byte, 0, len(strSig) + len(tb.Index) + len(tb.Value))
-	tbBytes = append(tbBytes, strSig...)
+	tbBytes = append(tbBytes, strSig[:]...)
 	tbBytes = append(tbBytes, tb.Index...)
 	tbBytes = append(tbBytes, tb.Value...)
+	if tb.Change > 1 {
+		tbBytes = append(tbBytes, conv.ULongToBytes(tb.Change)...)
+	}
 	return tbBytes
 }
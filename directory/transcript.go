@@ -0,0 +1,116 @@
+package directory
+
+import (
+	"encoding/json"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// A Transcript accumulates a hash of all the requests and responses
+// exchanged in a session between a CONIKS client and a directory. The
+// directory keeps one, and signs it at the end of the session, so that
+// the client gets compact evidence of exactly what the directory
+// claimed: with the messages, anybody can recompute the hash by adding
+// them to a Transcript in order, and check the directory's signature.
+// See Session and SignedTranscript.
+//
+// Each message is hashed in its encoding/json serialization, which is
+// deterministic, so the hash doesn't depend on the bytes a transport
+// framed the messages in. The zero Transcript is empty and ready to use.
+// A Transcript isn't safe for concurrent use.
+type Transcript struct {
+	hash      hashed.Hash
+	exchanges uint64
+}
+
+// transcriptPrefix separates the hashes of transcripts from other
+// hashes.
+var transcriptPrefix = []byte("transcript")
+
+// Add adds the exchange of the request req and the response resp to t.
+// It only fails if a message can't be serialized.
+func (t *Transcript) Add(req *Request, resp *Response) error {
+	reqBs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	respBs, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	t.hash = hashed.Sum(transcriptPrefix, t.hash[:],
+		conv.ULongToBytes(uint64(len(reqBs))), reqBs,
+		conv.ULongToBytes(uint64(len(respBs))), respBs)
+	t.exchanges++
+	return nil
+}
+
+// Sum returns the hash of the exchanges added to t. It's all zeros if
+// there were none.
+func (t *Transcript) Sum() hashed.Hash {
+	return t.hash
+}
+
+// Len returns the number of exchanges added to t.
+func (t *Transcript) Len() uint64 {
+	return t.exchanges
+}
+
+// A SignedTranscript is a directory's signed statement that Hash is the
+// Transcript of the Exchanges of a session, sent at the end of the
+// session upon a TranscriptRequest. Epoch is the latest epoch at the
+// time, and DirInitSTRHash identifies the directory like in an
+// AuditingRequest.
+type SignedTranscript struct {
+	Hash           hashed.Hash
+	Exchanges      uint64
+	Epoch          merkletree.Epoch
+	DirInitSTRHash [hashed.HashSizeByte]byte
+	Signature      sign.Signature
+}
+
+// signedTranscriptPrefix separates the signed transcripts from other
+// signed messages.
+var signedTranscriptPrefix = []byte("signed transcript")
+
+// Bytes serializes the transcript for signing by the directory.
+func (st *SignedTranscript) Bytes() []byte {
+	bs := append([]byte{}, signedTranscriptPrefix...)
+	bs = append(bs, st.Hash[:]...)
+	bs = append(bs, conv.ULongToBytes(st.Exchanges)...)
+	bs = append(bs, st.Epoch.Bytes()...)
+	bs = append(bs, st.DirInitSTRHash[:]...)
+	return bs
+}
+
+// Verify returns true iff st is signed with signKey, and is for the
+// transcript t.
+func (st *SignedTranscript) Verify(signKey sign.PublicKey, t *Transcript) bool {
+	return st.Hash == t.Sum() && st.Exchanges == t.Len() &&
+		signKey.Verify(st.Bytes(), st.Signature[:])
+}
+
+// A TranscriptRequest is a message that a CONIKS client sends to the
+// directory at the end of a session, to get the directory's signature
+// of the session's transcript. Only a Session answers it; Tree's
+// HandleRequest considers it malformed.
+//
+// The response to a successful request is a SignedTranscript of the
+// exchanges before the request.
+type TranscriptRequest struct{}
+
+var _ DirectoryResponse = (*SignedTranscript)(nil)
+
+// NewTranscriptResponse creates the response message a CONIKS directory
+// sends to a client upon a TranscriptRequest, and returns a Response
+// containing the SignedTranscript st.
+func NewTranscriptResponse(st *SignedTranscript) *Response {
+	return &Response{
+		Error:             protocol.ReqSuccess,
+		DirectoryResponse: st,
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"sync"
+
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// A Session handles the requests of one client session, e.g. those
+// received over one connection, and keeps their Transcript. A Session
+// is safe for concurrent use, but like HandleRequest, it doesn't lock
+// its Tree.
+type Session struct {
+	d          *Tree
+	mu         sync.Mutex
+	transcript Transcript
+}
+
+// NewSession starts a session with a client.
+func (d *Tree) NewSession() *Session {
+	return &Session{d: d}
+}
+
+// HandleRequest handles req like Tree.HandleRequest, and adds the
+// exchange to the session's transcript. It answers a TranscriptRequest
+// with the SignedTranscript of the exchanges so far; that exchange isn't
+// added to the transcript.
+func (s *Session) HandleRequest(req *Request) *Response {
+	if _, ok := req.Request.(*TranscriptRequest); ok && req.Type == TranscriptType {
+		return NewTranscriptResponse(s.Sign())
+	}
+	resp := s.d.HandleRequest(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.transcript.Add(req, resp); err != nil {
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
+	return resp
+}
+
+// Sign signs the transcript of the exchanges so far.
+func (s *Session) Sign() *SignedTranscript {
+	s.mu.Lock()
+	st := &SignedTranscript{Hash: s.transcript.Sum(), Exchanges: s.transcript.Len()}
+	s.mu.Unlock()
+	_, st.DirInitSTRHash = s.d.pad.STRListRoot()
+	st.Epoch = s.d.LatestSTR().Epoch
+	st.Signature = s.d.pad.Sign(st.Bytes())
+	return st
+}
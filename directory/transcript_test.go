@@ -0,0 +1,67 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestTranscript(t *testing.T) {
+	var a, b Transcript
+	assert.True(t, a.Sum().IsZero())
+	req := &Request{Type: KeyLookupType, Request: &KeyLookupRequest{Username: "alice"}}
+	resp := NewErrorResponse(protocol.ReqNameNotFound)
+	require.NoError(t, a.Add(req, resp))
+	require.NoError(t, b.Add(req, resp))
+	assert.Equal(t, a.Sum(), b.Sum())
+	assert.Equal(t, uint64(1), a.Len())
+	assert.False(t, a.Sum().IsZero())
+
+	// the order of the exchanges matters
+	other := &Request{Type: KeyLookupType, Request: &KeyLookupRequest{Username: "bob"}}
+	require.NoError(t, a.Add(req, resp))
+	require.NoError(t, a.Add(other, resp))
+	require.NoError(t, b.Add(other, resp))
+	require.NoError(t, b.Add(req, resp))
+	assert.NotEqual(t, a.Sum(), b.Sum())
+	assert.Equal(t, a.Len(), b.Len())
+}
+
+func TestSession(t *testing.T) {
+	d := NewTestTree(t)
+	s := d.NewSession()
+	var mine Transcript
+	for _, req := range []*Request{
+		{Type: RegistrationType, Request: &RegistrationRequest{Username: "alice", Key: []byte("key")}},
+		{Type: KeyLookupType, Request: &KeyLookupRequest{Username: "alice"}},
+		{Type: KeyLookupType, Request: &KeyLookupRequest{Username: "bob"}},
+	} {
+		resp := s.HandleRequest(req)
+		require.NoError(t, mine.Add(req, resp))
+	}
+
+	res := s.HandleRequest(&Request{Type: TranscriptType, Request: &TranscriptRequest{}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	st := res.DirectoryResponse.(*SignedTranscript)
+	pk := signKey.Public()
+	assert.True(t, st.Verify(pk, &mine))
+	assert.Equal(t, uint64(3), st.Exchanges)
+	assert.Equal(t, d.LatestSTR().Epoch, st.Epoch)
+	_, first := d.pad.STRListRoot()
+	assert.EqualValues(t, first, st.DirInitSTRHash)
+
+	// the transcript request isn't part of the transcript
+	assert.Equal(t, st.Hash, s.Sign().Hash)
+
+	var other Transcript
+	assert.False(t, st.Verify(pk, &other))
+	st.Epoch++
+	assert.False(t, st.Verify(pk, &mine))
+
+	// only sessions answer transcript requests
+	res = d.HandleRequest(&Request{Type: TranscriptType, Request: &TranscriptRequest{}})
+	assert.Equal(t, protocol.ErrMalformedMessage, res.Error)
+}
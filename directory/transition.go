@@ -0,0 +1,110 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// transitionSuffix follows the username in the name of the leaf that
+// stores the user's key transition. Since usernames can't contain NUL
+// bytes, the names of these leaves can't be registered.
+const transitionSuffix = "\x00transition"
+
+// ErrReservedName is returned by Register for usernames that contain
+// a NUL byte, which are reserved for the directory's own leaves.
+var ErrReservedName = errors.New("[directory] Reserved username")
+
+// ErrBadTransition is wrapped by the errors of AnnounceTransition for
+// key transitions the Tree can't accept.
+var ErrBadTransition = errors.New("[directory] Invalid key transition")
+
+// TransitionName returns the name of the leaf in which the key
+// transition of username is stored. Contacts look it up like any other
+// name, and verify the KeyTransition it's bound to with
+// ParseKeyTransition.
+func TransitionName(username string) string {
+	return username + transitionSuffix
+}
+
+// A KeyTransition is a user's signed pre-announcement that the key bound
+// to Username will change from OldKey to NewKey in Epoch. It's signed
+// with OldKey, which must thus be an ed25519 public key, so only the
+// holder of the current key can announce a change.
+//
+// The directory stores the transition in the leaf TransitionName(Username)
+// from the epoch after it was announced, so that the user's contacts can
+// learn about the change before it happens, and treat it as expected
+// rather than as directory misbehavior. In Epoch, the directory binds
+// Username to NewKey.
+//
+// Since is the epoch in which Username was bound to OldKey, i.e. that of
+// its registration or of its previous transition. It lets clients verify
+// that the directory enforced its Config's MinKeyChangeInterval.
+type KeyTransition struct {
+	Username  string
+	OldKey    []byte
+	NewKey    []byte
+	Since     merkletree.Epoch
+	Epoch     merkletree.Epoch
+	Signature sign.Signature
+}
+
+// keyTransitionPrefix separates the signed key transitions from other
+// signed messages.
+var keyTransitionPrefix = []byte("key transition")
+
+// Bytes serializes the transition for signing with the old key.
+func (t *KeyTransition) Bytes() []byte {
+	bs := appendFields(append([]byte{}, keyTransitionPrefix...),
+		[]byte(t.Username), t.OldKey, t.NewKey)
+	bs = append(bs, t.Since.Bytes()...)
+	return append(bs, t.Epoch.Bytes()...)
+}
+
+// Sign signs the transition with the private key whose public key is
+// t.OldKey.
+func (t *KeyTransition) Sign(key sign.PrivateKey) {
+	copy(t.Signature[:], key.Sign(t.Bytes()))
+}
+
+// Verify returns true iff t is signed with t.OldKey.
+func (t *KeyTransition) Verify() bool {
+	return verifyWithKey(t.OldKey, t.Bytes(), t.Signature)
+}
+
+// ParseKeyTransition parses the value of the leaf TransitionName(username)
+// and verifies that it's a key transition of username signed with its
+// old key. The caller must still check that the old key is the one it
+// knows username to be bound to.
+func ParseKeyTransition(username string, value []byte) (*KeyTransition, error) {
+	t := new(KeyTransition)
+	if err := json.Unmarshal(value, t); err != nil {
+		return nil, err
+	}
+	if t.Username != username || !t.Verify() {
+		return nil, ErrBadTransition
+	}
+	return t, nil
+}
+
+// A TransitionRequest is a message with a KeyTransition that a CONIKS
+// client sends to the directory to pre-announce a change of its user's
+// key. See Tree.AnnounceTransition.
+//
+// The response to a successful request has the error code ReqSuccess
+// and no DirectoryResponse; the client can look up
+// TransitionName(Username) in the next epoch to verify that the
+// transition was stored.
+type TransitionRequest struct {
+	Transition *KeyTransition
+}
+
+// reservedName reports whether name is reserved for the directory's own
+// leaves.
+func reservedName(name string) bool {
+	return strings.IndexByte(name, 0) >= 0
+}
@@ -0,0 +1,132 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// AnnounceTransition stores the key transition t, which becomes visible
+// in the snapshot taken at the end of the current epoch, and binds
+// t.Username to t.NewKey in t.Epoch. Announcing another transition for
+// the same user before t.Epoch replaces t.
+//
+// It returns an error wrapping ErrBadTransition if t isn't signed by its
+// old key, if t.OldKey isn't the key bound to t.Username in the latest
+// snapshot or has been revoked or deleted, or if t.Epoch isn't at least two epochs after the latest one,
+// i.e. if contacts wouldn't see the transition in a snapshot before it
+// happens. It also returns such an error if t.Since isn't the epoch in
+// which t.Username was bound to t.OldKey, or if t.Epoch is less than the
+// Tree's minimum key change interval after it (see
+// WithMinKeyChangeInterval). Like Register, it returns an error wrapping ErrRejected if the
+// Tree's Policy rejects the new binding, and ErrReadOnly if the Tree is
+// in read-only mode.
+func (d *Tree) AnnounceTransition(t *KeyTransition) error {
+	if len(t.Username) == 0 || len(t.NewKey) == 0 {
+		return ErrNoKeyOrValue
+	}
+	if d.readOnly() {
+		return ErrReadOnly
+	}
+	if !t.Verify() {
+		return fmt.Errorf("%w: bad signature", ErrBadTransition)
+	}
+	latest := d.latest()
+	if t.Epoch < latest.STR().Epoch+2 {
+		return fmt.Errorf("%w: epoch %d is too early", ErrBadTransition, t.Epoch)
+	}
+	ap, err := latest.Get([]byte(t.Username))
+	if err != nil {
+		return err
+	}
+	if ap.ProofType() != merkletree.ProofOfInclusion || !bytes.Equal(ap.Leaf.Value, t.OldKey) {
+		return fmt.Errorf("%w: %s isn't bound to the old key", ErrBadTransition, t.Username)
+	}
+	if d.revoked(t.Username, t.OldKey) {
+		return fmt.Errorf("%w: the old key has been revoked", ErrBadTransition)
+	}
+	if d.deletions[t.Username] != nil {
+		return fmt.Errorf("%w: the binding has been deleted", ErrBadTransition)
+	}
+	// the leaf records the epoch of the registration or of the previous
+	// transition, so it needn't be kept elsewhere
+	if since := ap.Leaf.ChangedEpoch; t.Since != since {
+		return fmt.Errorf("%w: the old key was bound in epoch %d, not %d", ErrBadTransition, since, t.Since)
+	}
+	if interval := d.config.MinKeyChangeInterval; uint64(t.Epoch-t.Since) < interval {
+		return fmt.Errorf("%w: the key can't change before epoch %d", ErrBadTransition, t.Since+merkletree.Epoch(interval))
+	}
+	if d.policy != nil {
+		if err := d.policy.CheckRegistration(t.Username, t.NewKey); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+
+	value, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := d.pad.Set([]byte(TransitionName(t.Username)), value); err != nil {
+		return fmt.Errorf("setting value in PAD: %w", err)
+	}
+	d.transitions[t.Username] = t
+	return nil
+}
+
+// transitionsDue returns true iff an announced key transition happens in
+// epoch or before.
+func (d *Tree) transitionsDue(epoch merkletree.Epoch) bool {
+	for _, t := range d.transitions {
+		if t.Epoch <= epoch {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTransitions binds the users whose transitions happen in the
+// epoch epoch to their new keys. If the PAD can't bind a user, it
+// returns the error, and the user's transition stays announced, so that
+// the next update applies it.
+func (d *Tree) applyTransitions(epoch merkletree.Epoch) error {
+	for name, t := range d.transitions {
+		if t.Epoch > epoch {
+			continue
+		}
+		if err := d.pad.Set([]byte(name), t.NewKey); err != nil {
+			return fmt.Errorf("binding %s to its new key: %w", name, err)
+		}
+		delete(d.transitions, name)
+	}
+	return nil
+}
+
+// HandleTransition announces the key transition in the TransitionRequest
+// req received from a CONIKS client, and returns the response to be sent
+// back to the client. A request without a transition, username or new
+// key is considered malformed, and causes HandleTransition() to return
+// a NewErrorResponse(ErrMalformedMessage). A transition the Tree doesn't
+// accept causes it to return a NewErrorResponse(ReqRejected), and any
+// other error a NewErrorResponse(ErrDirectory).
+func (d *Tree) HandleTransition(req *TransitionRequest) *Response {
+	if req.Transition == nil {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+	switch err := d.AnnounceTransition(req.Transition); {
+	case err == nil:
+		return NewErrorResponse(protocol.ReqSuccess)
+	case err == ErrNoKeyOrValue:
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	case errors.Is(err, ErrBadTransition), errors.Is(err, ErrRejected):
+		return NewErrorResponse(protocol.ReqRejected)
+	default:
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
+}
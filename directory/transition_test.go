@@ -0,0 +1,145 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// newTransition returns a transition of alice from the public key of
+// oldKey, bound since epoch since, to newKey in epoch, signed with oldKey.
+func newTransition(oldKey sign.PrivateKey, newKey []byte, since, epoch merkletree.Epoch) *KeyTransition {
+	t := &KeyTransition{Username: "alice", OldKey: oldKey.Public(), NewKey: newKey, Since: since, Epoch: epoch}
+	t.Sign(oldKey)
+	return t
+}
+
+func TestKeyTransition(t *testing.T) {
+	oldKey, err := sign.GenerateKey(bytes.NewReader(make([]byte, 32)))
+	require.NoError(t, err)
+	newKey := []byte("new key")
+	d := NewTestTree(t)
+	_, err = d.Register("alice", oldKey.Public())
+	require.NoError(t, err)
+	d.Update()
+	ep := d.LatestSTR().Epoch
+
+	forged := newTransition(oldKey, newKey, ep, ep+2)
+	forged.NewKey = []byte("forged key")
+	bob := newTransition(oldKey, newKey, ep, ep+2)
+	bob.Username = "bob"
+	bob.Sign(oldKey)
+	other, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	for name, tr := range map[string]*KeyTransition{
+		"bad signature":  forged,
+		"too early":      newTransition(oldKey, newKey, ep, ep+1),
+		"wrong old key":  newTransition(other, newKey, ep, ep+2),
+		"wrong since":    newTransition(oldKey, newKey, ep-1, ep+2),
+		"malformed":      {Username: "alice", OldKey: []byte("short"), NewKey: newKey, Epoch: ep + 2},
+		"not registered": bob,
+	} {
+		assert.True(t, errors.Is(d.AnnounceTransition(tr), ErrBadTransition), name)
+	}
+
+	tr := newTransition(oldKey, newKey, ep, ep+2)
+	res := d.HandleRequest(&Request{Type: TransitionType, Request: &TransitionRequest{Transition: tr}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+
+	// the transition is visible in the next epoch, before it happens
+	d.Update()
+	ap := mustLookup(t, d, TransitionName("alice"))
+	require.Equal(t, merkletree.ProofOfInclusion, ap.ProofType())
+	got, err := ParseKeyTransition("alice", ap.Leaf.Value)
+	require.NoError(t, err)
+	assert.Equal(t, tr, got)
+	_, err = ParseKeyTransition("bob", ap.Leaf.Value)
+	assert.Equal(t, ErrBadTransition, err)
+	assert.Equal(t, []byte(oldKey.Public()), mustLookup(t, d, "alice").Leaf.Value)
+
+	d.Update()
+	assert.Equal(t, newKey, mustLookup(t, d, "alice").Leaf.Value)
+	assert.Empty(t, d.transitions)
+}
+
+func TestHandleTransitionErrors(t *testing.T) {
+	d := NewTestTree(t)
+	for _, tc := range []struct {
+		name string
+		req  *TransitionRequest
+		want protocol.ErrorCode
+	}{
+		{"no transition", &TransitionRequest{}, protocol.ErrMalformedMessage},
+		{"no new key", &TransitionRequest{Transition: &KeyTransition{Username: "alice"}}, protocol.ErrMalformedMessage},
+		{"unsigned", &TransitionRequest{Transition: &KeyTransition{Username: "alice", NewKey: []byte("key")}}, protocol.ReqRejected},
+	} {
+		assert.Equal(t, tc.want, d.HandleTransition(tc.req).Error, tc.name)
+	}
+
+	_, err := d.Register(TransitionName("alice"), []byte("key"))
+	assert.Equal(t, ErrReservedName, err)
+	res := d.HandleRegistration(&RegistrationRequest{Username: TransitionName("alice"), Key: []byte("key")})
+	assert.Equal(t, protocol.ReqRejected, res.Error)
+}
+
+func TestKeyTransitionMinInterval(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithMinKeyChangeInterval(4),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), d.LatestSTR().Policies.MinKeyChangeInterval)
+	oldKey, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	newKey, err := sign.GenerateKey(nil)
+	require.NoError(t, err)
+	_, err = d.Register("alice", oldKey.Public())
+	require.NoError(t, err)
+	d.Update()
+	ep := d.LatestSTR().Epoch
+
+	assert.True(t, errors.Is(d.AnnounceTransition(newTransition(oldKey, newKey.Public(), ep, ep+3)), ErrBadTransition))
+	require.NoError(t, d.AnnounceTransition(newTransition(oldKey, newKey.Public(), ep, ep+4)))
+	for i := 0; i < 4; i++ {
+		d.Update()
+	}
+	require.Equal(t, []byte(newKey.Public()), mustLookup(t, d, "alice").Leaf.Value)
+
+	// the interval counts from the epoch of the previous transition
+	next := &KeyTransition{Username: "alice", OldKey: newKey.Public(), NewKey: []byte("next key"), Since: ep + 4}
+	for _, tc := range []struct {
+		epoch merkletree.Epoch
+		err   bool
+	}{{ep + 7, true}, {ep + 8, false}} {
+		next.Epoch = tc.epoch
+		next.Sign(newKey)
+		assert.Equal(t, tc.err, errors.Is(d.AnnounceTransition(next), ErrBadTransition), tc.epoch)
+	}
+}
+
+func TestKeyTransitionSinceFromLeaf(t *testing.T) {
+	oldKey, err := sign.GenerateKey(bytes.NewReader(make([]byte, 32)))
+	require.NoError(t, err)
+	d := NewTestTree(t)
+	d.Update()
+	// a binding the Tree didn't register itself, e.g. one in a tree it
+	// was built from, is known since the epoch its leaf records
+	require.NoError(t, d.pad.Set([]byte("alice"), oldKey.Public()))
+	d.Update()
+	since := d.LatestSTR().Epoch
+	d.Update()
+	ep := d.LatestSTR().Epoch
+
+	assert.True(t, errors.Is(d.AnnounceTransition(newTransition(oldKey, []byte("new key"), 0, ep+2)),
+		ErrBadTransition))
+	require.NoError(t, d.AnnounceTransition(newTransition(oldKey, []byte("new key"), since, ep+2)))
+}
@@ -1,10 +1,15 @@
+//go:build !coniks_client
+// +build !coniks_client
+
 package directory
 
 import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ORBAT/cloniks/crypto"
 	"github.com/ORBAT/cloniks/crypto/sign"
@@ -15,9 +20,60 @@ import (
 
 // A Tree is an authenticated key/value dictionary based on a prefix Merkle tree.
 type Tree struct {
-	pad    *merkletree.PAD
-	tbs    map[string]*TemporaryBinding
-	config *Config
+	pad *merkletree.PAD
+	tbs map[string]*TemporaryBinding
+	// tbIssued are the times at which the TBs were issued, by username
+	tbIssued map[string]time.Time
+	// tbChanges are the numbers of times names were bound in the
+	// current epoch, whose latest TBs are in tbs, by username
+	tbChanges map[string]uint64
+	// fulfilled are the TBs of the names bound more than once in the
+	// epoch before the latest snapshot, which superseded the earlier TBs
+	// of their epoch, by username
+	fulfilled map[string]*TemporaryBinding
+	config    *Config
+	subs      map[*Subscription]struct{}
+	// transitions are the announced key transitions that haven't
+	// happened yet, by username
+	transitions map[string]*KeyTransition
+	// revocations are the latest revocations, by username
+	revocations map[string]*Revocation
+	// deletions are the tombstones of the deleted bindings in the latest
+	// snapshot or the current epoch, by username
+	deletions map[string]*Deletion
+	// reattestations are the latest re-attestations, by username
+	reattestations map[string]*Reattestation
+	// policyChange is set if capabilities were withdrawn since the
+	// latest snapshot
+	policyChange bool
+	// approvals are the operators' approvals of proposal, the latest
+	// pending root they approved, if the Tree is co-managed
+	proposal  *EpochProposal
+	approvals []*Approval
+	// rotationKey is the new signing key of the announced KeyRotation
+	rotationKey sign.Signer
+
+	// the optional subsystems set by Open
+	scheduler  Scheduler
+	nextEpoch  time.Time
+	policy     Policy
+	metrics    Metrics
+	authorizer Authorizer
+	epsilon    float64 // of the activity stats, or 0 if there are none
+	watchdog   *watchdog
+	publisher  Publisher
+
+	// archivalInterval is the number of epochs between the Tree's
+	// archival attestations, or 0 if it only makes them on
+	// ReattestHistory, timestamper timestamps them, and archival is the
+	// latest one. The attestations Update makes are timestamped by their
+	// own goroutines, tracked by timestamping, so archival is guarded by
+	// archivalMu.
+	archivalInterval uint64
+	timestamper      Timestamper
+	timestamping     sync.WaitGroup
+	archivalMu       sync.Mutex
+	archival         *ArchivalAttestation
 }
 
 // New constructs a new Tree given the key server's PAD
@@ -26,30 +82,196 @@ type Tree struct {
 // signKey is the private key the key server uses to generate signed tree
 // roots (STRs) and TBs.
 // dirSize indicates the number of PAD snapshots the server keeps in memory.
-func New(vrfKey vrf.PrivateKey, signKey sign.PrivateKey, dirSize uint64) (*Tree, error) {
-	d := new(Tree)
+func New(vrfKey vrf.PrivateKey, signKey sign.Signer, dirSize uint64) (*Tree, error) {
+	return NewWithIndexSize(vrfKey, signKey, dirSize, merkletree.DefaultIndexSize)
+}
+
+// NewWithIndexSize is like New, but the Tree's private indices are
+// truncated to indexSize bytes. The index size is advertised in the
+// Tree's Config so that clients can verify the truncated indices.
+func NewWithIndexSize(vrfKey vrf.PrivateKey, signKey sign.Signer, dirSize uint64,
+	indexSize int) (*Tree, error) {
 	vrfPublicKey, ok := vrfKey.Public()
 	if !ok {
 		return nil, vrf.ErrGetPubKey
 	}
-	d.config = NewConfig(vrfPublicKey)
-	pad, err := merkletree.NewPAD(d.config, signKey, vrfKey, dirSize)
+	config := NewConfig(vrfPublicKey)
+	config.IndexSize = uint32(indexSize)
+	return newTree(config, signKey, vrfKey, dirSize, merkletree.WithIndexSize(indexSize))
+}
+
+// NewWithHashIndex is like New, but the Tree computes indices with a keyed
+// hash with the key hashKey instead of a VRF (see merkletree.HashIndexer).
+// This is much faster, but anybody can then compute the index of any
+// username, and learn whether it's registered. The hash key is advertised
+// in the Tree's Config so that clients can verify the indices.
+func NewWithHashIndex(signKey sign.Signer, dirSize uint64, hashKey []byte) (*Tree, error) {
+	config := NewHashIndexConfig(hashKey)
+	return newTree(config, signKey, nil, dirSize, merkletree.WithIndexer(*config.hashIndexer()))
+}
+
+func newTree(config *Config, signKey sign.Signer, vrfKey vrf.PrivateKey, dirSize uint64,
+	opts ...merkletree.PADOption) (*Tree, error) {
+	pad, err := merkletree.NewPAD(config, signKey, vrfKey, dirSize, opts...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	d.pad = pad
-	d.tbs = make(map[string]*TemporaryBinding)
-	return d, nil
+	return &Tree{
+		pad:       pad,
+		tbs:       make(map[string]*TemporaryBinding),
+		tbIssued:  make(map[string]time.Time),
+		tbChanges: make(map[string]uint64),
+		fulfilled: make(map[string]*TemporaryBinding),
+		config:    config,
+		subs:      make(map[*Subscription]struct{}),
+
+		transitions: make(map[string]*KeyTransition),
+		revocations: make(map[string]*Revocation),
+		deletions:   make(map[string]*Deletion),
+
+		reattestations: make(map[string]*Reattestation),
+	}, nil
+}
+
+// An EpochReport describes the snapshot taken by Update at the end of
+// an epoch.
+type EpochReport struct {
+	// Epoch is the new epoch, and STR the signed tree root of its
+	// snapshot.
+	Epoch merkletree.Epoch
+	STR   *SignedTreeRoot
+	// FulfilledTBs is the number of temporary bindings whose bindings
+	// the snapshot includes.
+	FulfilledTBs int
+	// Insertions is the number of bindings set since the previous
+	// snapshot.
+	Insertions uint64
+	// Duration is how long taking the snapshot took.
+	Duration time.Duration
+	// Hash is the work of computing the tree hash of the snapshot.
+	Hash merkletree.HashStats
+	// PromiseLatency is how long the fulfilled temporary bindings
+	// waited for the snapshot.
+	PromiseLatency PromiseLatency
 }
 
 // Update creates a new PAD snapshot updating this Tree. Deletes all issued TBs for the ending epoch
-// as their corresponding mappings will have been inserted into the PAD.
-func (d *Tree) Update() {
-	d.pad.Update(d.config)
-	// clear issued temporary bindings
-	for key := range d.tbs {
+// as their corresponding mappings will have been inserted into the PAD, binds the users whose
+// announced key transitions happen in the new epoch to their new keys, notifies the
+// subscribers whose bindings changed (see Subscribe), and passes the new STR to the Tree's
+// Publisher, if any, along with the EpochReport if it's a ReportPublisher. Returns the
+// EpochReport of the snapshot, which is also passed to the Tree's Metrics, if any, and
+// alerts the Tree's watchdog if the fulfilled promises took too long (see
+// WatchdogConfig.PromiseDeadline). If the Tree has a Scheduler, Update schedules the end of the new epoch, and
+// commits to it in the NextUpdate of the STR's Config. If the Tree is co-managed (see SetOperators),
+// Update only takes the snapshot if enough operators approved the pending root (see Approve), which
+// the STR's Config then includes, and otherwise returns ErrNotApproved without changing the Tree.
+// If a user can't be bound to the new key of their transition, the Tree's NodeStore can't
+// store the snapshot, or its STRStore can't archive the STR, Update takes none, and returns
+// an error wrapping ErrUpdateFailed. If the snapshot is taken, but an older one couldn't be spilled to
+// the Tree's SnapshotStore, Update returns the EpochReport along with the error, which wraps
+// merkletree.ErrSpillFailed.
+func (d *Tree) Update() (*EpochReport, error) {
+	if !d.approved() {
+		return nil, ErrNotApproved
+	}
+	start := time.Now()
+	if d.scheduler != nil {
+		d.nextEpoch = d.scheduler.Next(start)
+	}
+	epoch := d.pad.LatestSTR().Epoch + 1
+	if err := d.applyTransitions(epoch); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpdateFailed, err)
+	}
+	d.activateUpgrade(epoch)
+	d.activateKeyRotation(epoch)
+	d.activatePolicies(epoch)
+	if d.epsilon > 0 || d.scheduler != nil || d.policyChange || d.approvals != nil {
+		d.pad.SetAssocData(d.epochConfig())
+	}
+	st, err := d.pad.Update(d.config)
+	if err != nil && st.Epoch != epoch {
+		return nil, fmt.Errorf("%w: %v", ErrUpdateFailed, err)
+	}
+	spillErr := err
+	d.policyChange = false
+	d.proposal, d.approvals = nil, nil
+	report := &EpochReport{
+		Epoch:          st.Epoch,
+		STR:            d.LatestSTR(),
+		FulfilledTBs:   len(d.tbs),
+		Insertions:     st.Insertions,
+		Hash:           st.Hash,
+		PromiseLatency: d.promiseLatency(d.now()),
+	}
+	// clear issued temporary bindings, and the tombstones of the bindings
+	// they replaced, keeping the ones that superseded others
+	for key := range d.fulfilled {
+		delete(d.fulfilled, key)
+	}
+	for key, tb := range d.tbs {
+		if tb.Change > 1 {
+			d.fulfilled[key] = tb
+		}
 		delete(d.tbs, key)
+		delete(d.tbIssued, key)
+		delete(d.tbChanges, key)
+		delete(d.deletions, key)
+	}
+	report.Duration = time.Since(start)
+	d.reattestIfDue()
+	d.notify()
+	if p, ok := d.publisher.(ReportPublisher); ok {
+		p.PublishReport(report)
+	} else if d.publisher != nil {
+		d.publisher.PublishSTR(report.STR)
 	}
+	if d.metrics != nil {
+		d.metrics.ObserveEpoch(report)
+	}
+	if w := d.watchdog; w != nil && w.PromiseDeadline > 0 && report.FulfilledTBs > 0 {
+		w.checkPromises(d.id(), report.Epoch, report.PromiseLatency)
+	}
+	return report, spillErr
+}
+
+// epochConfig returns a copy of the Tree's Config with the ActivityStats
+// of the epoch ending now, if the Tree has them, the end of the next
+// epoch, if it's scheduled, the PolicyChange flag, if capabilities
+// or an announced upgrade or key rotation were withdrawn in the epoch, and the
+// operators' approvals, if the Tree is co-managed.
+func (d *Tree) epochConfig() *Config {
+	config := *d.config
+	if d.epsilon > 0 {
+		registrations := uint64(len(d.tbs))
+		var changes uint64
+		if n := d.pad.Insertions(); n > registrations {
+			changes = n - registrations
+		}
+		config.Stats = newActivityStats(d.epsilon, registrations, changes)
+	}
+	if d.scheduler != nil {
+		config.NextUpdate = d.nextEpoch.UnixNano()
+	}
+	config.PolicyChange = d.policyChange
+	config.Approvals = d.approvals
+	return &config
+}
+
+// SetCapabilities makes the Tree advertise caps in the Config of its
+// STRs, starting with the one the next Update signs. If caps lacks any of
+// the capabilities the Tree advertised so far, that STR also flags
+// a PolicyChange, without which clients consider the withdrawal
+// a downgrade attack.
+func (d *Tree) SetCapabilities(caps Capabilities) {
+	if d.config.Capabilities.Withdrawn(caps) != 0 {
+		d.policyChange = true
+	}
+	// STRs share the Config, so it's replaced instead of modified
+	config := *d.config
+	config.Capabilities = caps
+	d.config = &config
+	d.pad.SetAssocData(d.config)
 }
 
 // LatestSTR returns this Tree's latest STR.
@@ -57,24 +279,111 @@ func (d *Tree) LatestSTR() *SignedTreeRoot {
 	return NewDirSTR(d.pad.LatestSTR())
 }
 
-// newTB creates a new temporary binding for the given name-to-value mapping.
+// SetFullSnapshots makes the Tree keep the full snapshots of only the n
+// latest epochs, and only the STRs of older ones, which makes retaining
+// a long STR history much cheaper. Requests for proofs in older epochs
+// are answered with a NewEpochPrunedResponse() telling the client the
+// nearest epoch the Tree can serve proofs for, and STR history requests
+// are served as before. If n is 0, which is the default, every snapshot
+// is kept in full. It returns an error wrapping merkletree.ErrSpillFailed
+// if a pruned snapshot couldn't be spilled to the Tree's SnapshotStore.
+// See merkletree.PAD.SetFullSnapshots().
+func (d *Tree) SetFullSnapshots(n uint64) error {
+	return d.pad.SetFullSnapshots(n)
+}
+
+// SetRetentionPolicy makes the Tree keep the full snapshots that policy
+// retains, e.g. those of the latest epochs or of the last day, and only
+// the STRs of the others, as SetFullSnapshots does. Snapshots that are
+// only too old are pruned by CollectGarbage, or RunGC. If policy
+// archives the snapshots, the Tree must have been opened
+// WithSnapshotStore; otherwise it returns
+// merkletree.ErrNoSnapshotStore. See merkletree.RetentionPolicy.
+func (d *Tree) SetRetentionPolicy(policy merkletree.RetentionPolicy) error {
+	return d.pad.SetRetentionPolicy(policy)
+}
+
+// SetMemoryBudget makes the Tree keep as many snapshots as fit in a
+// memory budget instead of the fixed number it was created with: when
+// their approximate memory footprint exceeds high, the oldest ones are
+// evicted until it's at most low. A high of 0 removes the budget.
+// See merkletree.PAD.SetMemoryBudget().
+func (d *Tree) SetMemoryBudget(low, high uint64) error {
+	return d.pad.SetMemoryBudget(low, high)
+}
+
+// SetEvictionFunc makes the Tree call f with a view of every snapshot
+// whose tree is about to be removed from memory, so that a persistence
+// layer can archive it. NewDirSTR(view.STR()) is the snapshot's STR.
+// See merkletree.EvictionFunc.
+func (d *Tree) SetEvictionFunc(f merkletree.EvictionFunc) {
+	d.pad.SetEvictionFunc(f)
+}
+
+// Stats returns the sizes and approximate memory footprints of the
+// snapshots this Tree retains in memory, and of the tree for the next
+// epoch, along with the depths of their leaves. Operators can use them
+// to tune the number of snapshots the Tree is created with, and to watch
+// the directory grow. Stats returns the error of loading the nodes of the
+// tree for the next epoch from the Tree's NodeStore, if it has one.
+func (d *Tree) Stats() (merkletree.PADStats, error) {
+	return d.pad.Stats()
+}
+
+// newTB creates a new temporary binding for the given name-to-value mapping,
+// which is the change-th binding of the name in the current epoch.
 // newTB() computes the private index for the name, and
-// digitally signs the (index, value, latest STR signature) tuple.
-func (d *Tree) newTB(name string, value []byte) *TemporaryBinding {
-	index := d.pad.Index(name)
-	return &TemporaryBinding{
-		Index:     index,
-		Value:     value,
-		Signature: d.pad.Sign(d.LatestSTR().Signature, index, value),
+// digitally signs the (index, value, latest STR signature) tuple, along with
+// change if the TB supersedes another (see TemporaryBinding).
+func (d *Tree) newTB(name string, value []byte, change uint64) *TemporaryBinding {
+	tb := &TemporaryBinding{
+		Index: d.pad.Index([]byte(name)),
+		Value: value,
 	}
+	if change > 1 {
+		tb.Change = change
+	}
+	tb.Signature = d.pad.Sign(tb.Bytes(d.LatestSTR().Signature))
+	return tb
 }
 
 var ErrNoKeyOrValue = errors.New("no key or value provided")
 
+// ErrRejected is wrapped by the errors of Register for bindings the
+// Tree's Policy doesn't accept. See WithPolicy.
+var ErrRejected = errors.New("[directory] Binding rejected by policy")
+
+// A RegistrationResponse is the result of Register.
 type RegistrationResponse struct {
-	AuthPath    *merkletree.AuthenticationPath
-	TempBinding *TemporaryBinding
-	Root        *SignedTreeRoot
+	// AuthPath is a proof of absence of the key in the latest snapshot,
+	// or a proof of inclusion if the key was registered in an earlier epoch.
+	AuthPath *merkletree.AuthenticationPath
+	// STR is the signed tree root of the latest snapshot, which AuthPath
+	// is a proof against.
+	STR *SignedTreeRoot
+	// TB is the temporary binding promising to include the key in the
+	// next snapshot. It's nil if the key is already in the latest snapshot.
+	TB *TemporaryBinding
+	// Existing is true if the key was already registered, either in an
+	// earlier epoch or in the current one.
+	Existing bool
+	// Deletion is the tombstone of the deleted binding the registration
+	// replaces, in which case AuthPath is a proof of its inclusion.
+	Deletion *Deletion
+}
+
+// Response converts r to the wire format a CONIKS client expects in
+// response to a RegistrationRequest: a DirectoryProof with
+// the error code ReqNameExisted if r.Existing is true, and ReqSuccess
+// otherwise.
+func (r *RegistrationResponse) Response() *Response {
+	code := protocol.ReqSuccess
+	if r.Existing {
+		code = protocol.ReqNameExisted
+	}
+	res := NewRegistrationProof(r.AuthPath, r.STR, r.TB, code)
+	res.DirectoryResponse.(*DirectoryProof).Deletion = r.Deletion
+	return res
 }
 
 // Register a new key/value mapping in this Tree. Inserts the new mapping into a pending version
@@ -82,37 +391,106 @@ type RegistrationResponse struct {
 // returns a proof of absence for the value and a TemporaryBinding that can be used to prove that
 // the Tree has promised to include the key in the next epoch.
 //
-// If the key already exists, returns an ErrKeyExists and proof (or if the key was in the current
-// temporary bindings, a proof of current absence + non-nil TemporaryBinding).
-func (d *Tree) Register(key string, value []byte) (resp RegistrationResponse, err error) {
+// If the key already exists, returns an ErrKeyExists and a response with Existing set and either a
+// proof of inclusion or, if the key was registered in the current epoch, a proof of absence and
+// the existing TemporaryBinding. If the Tree's Config allows more than one change per epoch (see
+// WithMaxChangesPerEpoch), a key registered in the current epoch is instead bound to a different
+// value as if it were new, until it was bound the maximum number of times, and the new
+// TemporaryBinding supersedes the existing one. If the Tree's Policy rejects the binding, returns an error
+// wrapping ErrRejected. If the Tree's watchdog put it in read-only mode, returns ErrReadOnly,
+// since the Tree may not be able to keep its promises. If the key contains a NUL byte, returns
+// ErrReservedName. A key whose binding was deleted (see Deletion) is replaced like a new one if
+// the quarantine has ended; otherwise, returns an error wrapping ErrQuarantined, and for the
+// deleted key itself one wrapping ErrRejected. For any other error the response is nil.
+func (d *Tree) Register(key string, value []byte) (*RegistrationResponse, error) {
 	if len(key) == 0 || len(value) == 0 {
-		return resp, ErrNoKeyOrValue
+		return nil, ErrNoKeyOrValue
+	}
+	if reservedName(key) {
+		return nil, ErrReservedName
+	}
+	if d.readOnly() {
+		return nil, ErrReadOnly
+	}
+	if d.policy != nil {
+		if err := d.policy.CheckRegistration(key, value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrRejected, err)
+		}
 	}
 
 	// check if key already exists
-	resp.AuthPath, err = d.pad.Lookup(key)
+	latest := d.latest()
+	ap, err := latest.Get([]byte(key))
 	if err != nil {
-		panic(fmt.Errorf("lookup in current epoch should never fail but got: %w", err))
+		return nil, fmt.Errorf("looking up key in PAD: %w", err)
 	}
+	resp := &RegistrationResponse{AuthPath: ap, STR: NewDirSTR(latest.STR())}
 
-	if resp.AuthPath.ProofType() == merkletree.ProofOfInclusion {
+	// check temporary bindings too in case the key was registered in this epoch
+	if tb := d.tbs[key]; tb != nil &&
+		(bytes.Equal(tb.Value, value) || d.tbChanges[key] >= d.maxChangesPerEpoch()) {
+		resp.TB = tb
+		resp.Existing = true
 		return resp, ErrKeyExists(key)
 	}
 
-	// check temporary bindings too in case the key was registered in this epoch
-	if resp.TempBinding = d.tbs[key]; resp.TempBinding != nil {
-		return resp, ErrKeyExists(key)
+	if ap.ProofType() == merkletree.ProofOfInclusion {
+		del := d.deletions[key]
+		if del == nil {
+			resp.Existing = true
+			return resp, ErrKeyExists(key)
+		}
+		if err := d.checkReregistration(del, value, latest.STR().Epoch+1); err != nil {
+			return nil, err
+		}
+		resp.Deletion = del
 	}
 
-	resp.TempBinding = d.newTB(key, value)
-	if err := d.pad.Set(key, value); err != nil {
-		resp.TempBinding = nil
-		return resp, fmt.Errorf("setting value in PAD: %w", err)
+	tb := d.newTB(key, value, d.tbChanges[key]+1)
+	if err := d.pad.Set([]byte(key), value); err != nil {
+		return nil, fmt.Errorf("setting value in PAD: %w", err)
 	}
+	d.tbs[key] = tb
+	d.tbIssued[key] = d.now()
+	d.tbChanges[key]++
+	resp.TB = tb
 
-	d.tbs[key] = resp.TempBinding
+	return resp, nil
+}
 
-	return
+// maxChangesPerEpoch returns the number of times the Tree binds a name
+// in one epoch.
+func (d *Tree) maxChangesPerEpoch() uint64 {
+	if d.config.MaxChangesPerEpoch == 0 {
+		return 1
+	}
+	return d.config.MaxChangesPerEpoch
+}
+
+// HandleRegistration registers the binding in the RegistrationRequest
+// req received from a CONIKS client, and returns the response to be sent
+// back to the client. It's Register() for the wire protocol: see
+// RegistrationResponse.Response() for the format of the response.
+//
+// A request without a username or key is considered malformed, and causes
+// HandleRegistration() to return a NewErrorResponse(ErrMalformedMessage).
+// A binding the Tree's Policy rejects, a reserved username, or a deleted
+// one that can't be registered again (yet) causes it to return
+// a NewErrorResponse(ReqRejected).
+// If Register() fails for any other reason, HandleRegistration() returns
+// a NewErrorResponse(ErrDirectory).
+func (d *Tree) HandleRegistration(req *RegistrationRequest) *Response {
+	resp, err := d.Register(req.Username, req.Key)
+	switch {
+	case err == nil, IsKeyExistsError(err):
+		return resp.Response()
+	case err == ErrNoKeyOrValue:
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	case errors.Is(err, ErrRejected), errors.Is(err, ErrQuarantined), err == ErrReservedName:
+		return NewErrorResponse(protocol.ReqRejected)
+	default:
+		return NewErrorResponse(protocol.ErrDirectory)
+	}
 }
 
 // KeyLookup gets the public key for the username indicated in the
@@ -132,8 +510,16 @@ func (d *Tree) Register(key string, value []byte) (resp RegistrationResponse, er
 // absence, str, tb, ReqSuccess) if there is a corresponding TB for
 // the username, but there isn't an entry in the directory yet, and a
 // a message.NewKeyLookupProof(ap=proof of inclusion, str, nil, ReqSuccess)
-// if there is.
+// if there is. If the username was bound more than once in the epoch the
+// latest snapshot ended, the proof of inclusion comes with the TB that
+// superseded the others instead of nil, so that clients holding an earlier
+// TB can verify that the snapshot kept the directory's promises.
 // In any case, str is the signed tree root for the latest epoch.
+// If the returned key has been revoked, the proof includes the
+// Revocation, even if it isn't part of a snapshot yet, and if the
+// returned binding has been deleted, the proof includes its tombstone. If
+// it has been re-attested, the proof includes the latest re-attestation,
+// and if it has expired for lack of one, the proof flags it as Expired.
 // If KeyLookup() encounters an internal error at any point, it returns
 // a message.NewErrorResponse(ErrDirectory).
 func (d *Tree) KeyLookup(req *KeyLookupRequest) *Response {
@@ -143,19 +529,43 @@ func (d *Tree) KeyLookup(req *KeyLookupRequest) *Response {
 		return NewErrorResponse(protocol.ErrMalformedMessage)
 	}
 
-	ap, err := d.pad.Lookup(req.Username)
+	latest := d.latest()
+	ap, err := latest.Get([]byte(req.Username))
 	if err != nil {
-		return NewErrorResponse(protocol.ErrDirectory)
+		return errorResponse(err)
 	}
+	str := NewDirSTR(latest.STR())
 
 	if bytes.Equal(ap.LookupIndex, ap.Leaf.Index) {
-		return NewKeyLookupProof(ap, d.LatestSTR(), nil, protocol.ReqSuccess)
+		res := d.withDeletion(d.withRevocation(NewKeyLookupProof(ap, str, d.fulfilled[req.Username], protocol.ReqSuccess),
+			req.Username, ap.Leaf.Value), req.Username, ap.Leaf.Value)
+		return d.withReattestation(res, req.Username, ap.Leaf, str.Epoch)
 	}
 	// if not found in the tree, do lookup in tb array
 	if tb := d.tbs[req.Username]; tb != nil {
-		return NewKeyLookupProof(ap, d.LatestSTR(), tb, protocol.ReqSuccess)
+		return d.withRevocation(NewKeyLookupProof(ap, str, tb, protocol.ReqSuccess),
+			req.Username, tb.Value)
+	}
+	return NewKeyLookupProof(ap, str, nil, protocol.ReqNameNotFound)
+}
+
+// KeyLookupBatch searches all of usernames in the latest snapshot, and
+// returns a single MultiAuthPath proving each of their bindings or their
+// absence, along with the snapshot's STR. Monitoring many names this way
+// doesn't repeat the upper levels of their paths. Unlike KeyLookup, it
+// doesn't consider temporary bindings, revocations or deletions.
+// KeyLookupBatch returns the error of looking them up.
+func (d *Tree) KeyLookupBatch(usernames []string) (*merkletree.MultiAuthPath, *SignedTreeRoot, error) {
+	latest := d.latest()
+	keys := make([][]byte, len(usernames))
+	for i, username := range usernames {
+		keys[i] = []byte(username)
+	}
+	mp, err := latest.GetBatch(keys)
+	if err != nil {
+		return nil, nil, err
 	}
-	return NewKeyLookupProof(ap, d.LatestSTR(), nil, protocol.ReqNameNotFound)
+	return mp, NewDirSTR(latest.STR()), nil
 }
 
 // KeyLookupInEpoch gets the public key for the username for a prior
@@ -181,6 +591,9 @@ func (d *Tree) KeyLookup(req *KeyLookupRequest) *Response {
 // KeyLookupInEpoch() proofs do not include temporary bindings since
 // the TB corresponding to a registered binding is discarded at the time
 // the binding is included in a directory snapshot.
+// If the snapshot for the indicated epoch has been pruned (see
+// SetFullSnapshots()), KeyLookupInEpoch() returns a
+// message.NewEpochPrunedResponse(nearest).
 // If KeyLookupInEpoch() encounters an internal error at any point,
 // it returns a message.NewErrorResponse(ErrDirectory).
 func (d *Tree) KeyLookupInEpoch(req *KeyLookupInEpochRequest) *Response {
@@ -191,18 +604,15 @@ func (d *Tree) KeyLookupInEpoch(req *KeyLookupInEpochRequest) *Response {
 		return NewErrorResponse(protocol.ErrMalformedMessage)
 	}
 
-	var strs []*SignedTreeRoot
-	startEp := req.Epoch
-	endEp := d.LatestSTR().Epoch
-
-	ap, err := d.pad.LookupInEpoch(req.Username, startEp)
+	views, err := d.snapshots(req.Epoch, d.LatestSTR().Epoch)
 	if err != nil {
-		return NewErrorResponse(protocol.ErrDirectory)
+		return errorResponse(err)
 	}
-	for ep := startEp; ep <= endEp; ep++ {
-		str := NewDirSTR(d.pad.GetSTR(ep))
-		strs = append(strs, str)
+	ap, err := views[0].Get([]byte(req.Username))
+	if err != nil {
+		return errorResponse(err)
 	}
+	strs := dirSTRs(views)
 
 	if bytes.Equal(ap.LookupIndex, ap.Leaf.Index) {
 		return NewKeyLookupInEpochProof(ap, strs, protocol.ReqSuccess)
@@ -210,6 +620,65 @@ func (d *Tree) KeyLookupInEpoch(req *KeyLookupInEpochRequest) *Response {
 	return NewKeyLookupInEpochProof(ap, strs, protocol.ReqNameNotFound)
 }
 
+// BindingUnchanged checks whether the binding for the username in the
+// BindingUnchangedRequest req has changed since the requested epoch,
+// and returns a protocol.Response.
+// The response (which also includes the error code) is supposed to
+// be sent back to the client.
+//
+// A request without a username or with an epoch greater than the latest
+// epoch of this directory is considered malformed, and causes
+// BindingUnchanged() to return a
+// message.NewErrorResponse(ErrMalformedMessage).
+// If the commitment to the binding is the requested one in every epoch
+// up to the latest, BindingUnchanged() returns a
+// message.NewBindingUnchangedProof(through=latest epoch, sig, str),
+// where sig is the directory's signature of the assertion, and str is
+// a list of STRs for the epoch range (req.Epoch, latest].
+// Otherwise, it returns a message.NewKeyLookupInEpochProof(ap, str, e)
+// for the first epoch ep in which the commitment differs, where str is
+// a list of STRs for the epoch range (req.Epoch, ep], i.e. ap is for the
+// last STR, and e is ReqSuccess or ReqNameNotFound as for
+// KeyLookupInEpoch().
+// If a snapshot after the requested epoch has been pruned, it returns
+// a message.NewEpochPrunedResponse(nearest).
+// If BindingUnchanged() encounters an internal error at any point,
+// e.g. if a snapshot in the range is no longer available, it returns
+// a message.NewErrorResponse(ErrDirectory).
+func (d *Tree) BindingUnchanged(req *BindingUnchangedRequest) *Response {
+	// make sure the request is well-formed
+	if len(req.Username) <= 0 ||
+		req.Epoch > d.LatestSTR().Epoch {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+
+	ep, ap, err := d.pad.FirstChangeSince([]byte(req.Username), req.Commitment, req.Epoch)
+	if err != nil {
+		return errorResponse(err)
+	}
+	// the snapshot of req.Epoch itself isn't needed, and may have been pruned
+	views, err := d.snapshots(req.Epoch+1, ep)
+	if err != nil {
+		return errorResponse(err)
+	}
+	last, err := d.pad.At(ep)
+	if err != nil {
+		return errorResponse(err)
+	}
+	strs := dirSTRs(views)
+
+	if ap != nil {
+		if bytes.Equal(ap.LookupIndex, ap.Leaf.Index) {
+			return NewKeyLookupInEpochProof(ap, strs, protocol.ReqSuccess)
+		}
+		return NewKeyLookupInEpochProof(ap, strs, protocol.ReqNameNotFound)
+	}
+	u := &BindingUnchanged{Through: ep, STR: strs}
+	u.Signature = d.pad.Sign(u.Bytes(d.pad.Index([]byte(req.Username)), req.Commitment,
+		req.Epoch, last.STR().Signature))
+	return NewBindingUnchangedProof(u.Through, u.Signature, u.STR)
+}
+
 // Monitor gets the directory proofs for the username for the range of
 // epochs indicated in the MonitoringRequest req received from a
 // CONIKS client, and returns a protocol.Response.
@@ -226,6 +695,16 @@ func (d *Tree) KeyLookupInEpoch(req *KeyLookupInEpochRequest) *Response {
 // and endEpoch are the epoch range endpoints indicated in the client's
 // request. If req.endEpoch is greater than d.LatestSTR().Epoch,
 // the end of the range will be set to d.LatestSTR().Epoch.
+// If the snapshot for the start epoch has been pruned (see
+// SetFullSnapshots()), Monitor() returns a
+// message.NewEpochPrunedResponse(nearest).
+// If the username is bound in the end epoch, the response includes the
+// re-attestation of its binding and its expiry, like KeyLookup(), so
+// that the owner learns when to re-attest it. If the range ends with the
+// latest snapshot, the response includes the TB that superseded the
+// others, like KeyLookup(). If the last binding in the range has been
+// deleted, the response includes its tombstone, with which the client
+// verifies that the binding may be absent from later snapshots.
 // If Monitor() encounters an internal error at any point,
 // it returns a message.NewErrorResponse(ErrDirectory).
 func (d *Tree) Monitor(req *MonitoringRequest) *Response {
@@ -237,24 +716,35 @@ func (d *Tree) Monitor(req *MonitoringRequest) *Response {
 		return NewErrorResponse(protocol.ErrMalformedMessage)
 	}
 
-	var strs []*SignedTreeRoot
-	var aps []*merkletree.AuthenticationPath
-	startEp := req.StartEpoch
 	endEp := req.EndEpoch
 	if endEp > d.LatestSTR().Epoch {
 		endEp = d.LatestSTR().Epoch
 	}
-	for ep := startEp; ep <= endEp; ep++ {
-		ap, err := d.pad.LookupInEpoch(req.Username, ep)
-		if err != nil {
-			return NewErrorResponse(protocol.ErrDirectory)
+	views, err := d.snapshots(req.StartEpoch, endEp)
+	if err != nil {
+		return errorResponse(err)
+	}
+	aps := make([]*merkletree.AuthenticationPath, len(views))
+	for i, v := range views {
+		if aps[i], err = v.Get([]byte(req.Username)); err != nil {
+			return errorResponse(err)
 		}
-		aps = append(aps, ap)
-		str := NewDirSTR(d.pad.GetSTR(ep))
-		strs = append(strs, str)
 	}
 
-	return NewMonitoringProof(aps, strs)
+	res := NewMonitoringProof(aps, dirSTRs(views))
+	if endEp == d.LatestSTR().Epoch {
+		res.DirectoryResponse.(*DirectoryProof).TB = d.fulfilled[req.Username]
+	}
+	for i := len(aps) - 1; i >= 0; i-- {
+		if aps[i].ProofType() == merkletree.ProofOfInclusion {
+			res = d.withDeletion(res, req.Username, aps[i].Leaf.Value)
+			break
+		}
+	}
+	if last := aps[len(aps)-1]; last.ProofType() == merkletree.ProofOfInclusion {
+		return d.withReattestation(res, req.Username, last.Leaf, endEp)
+	}
+	return res
 }
 
 // GetSTRHistory gets the directory snapshots for the epoch range
@@ -273,6 +763,9 @@ func (d *Tree) Monitor(req *MonitoringRequest) *Response {
 // and endEpoch are the epoch range endpoints indicated in the client's
 // request. If req.endEpoch is greater than d.LatestSTR().Epoch,
 // the end of the range will be set to d.LatestSTR().Epoch.
+// If a snapshot in the range is no longer available, GetSTRHistory()
+// returns a message.NewErrorResponse(ErrDirectory); a Tree opened
+// WithSTRStore serves the STRs of all epochs.
 func (d *Tree) GetSTRHistory(req *STRHistoryRequest) *Response {
 	// make sure the request is well-formed
 	if req.StartEpoch > d.LatestSTR().Epoch ||
@@ -287,13 +780,213 @@ func (d *Tree) GetSTRHistory(req *STRHistoryRequest) *Response {
 
 	var strs []*SignedTreeRoot
 	for ep := req.StartEpoch; ep <= endEp; ep++ {
-		str := NewDirSTR(d.pad.GetSTR(ep))
-		strs = append(strs, str)
+		// only the STR is needed, so pruned snapshots are fine
+		str := d.pad.GetSTR(ep)
+		if str == nil {
+			return NewErrorResponse(protocol.ErrDirectory)
+		}
+		strs = append(strs, NewDirSTR(str))
 	}
 
 	return NewSTRHistoryRange(strs)
 }
 
+// GetSTRSkips gets the STRs linking the STR for req.StartEpoch to the
+// STR for req.EndEpoch with the fewest STRs, i.e. the STRs for the
+// epochs merkletree.SkipPath(req.StartEpoch, req.EndEpoch). It lets
+// a client that went offline for many epochs catch up without fetching
+// every STR. If req.EndEpoch is greater than d.LatestSTR().Epoch,
+// the path ends at d.LatestSTR().Epoch.
+//
+// Like GetSTRHistory(), GetSTRSkips() returns
+// a message.NewErrorResponse(ErrMalformedMessage) for a start epoch
+// greater than the latest epoch or the end epoch, and
+// a message.NewErrorResponse(ErrDirectory) if an STR in the path is no
+// longer available. Otherwise it returns
+// a message.NewSTRHistoryRange(strs).
+func (d *Tree) GetSTRSkips(req *STRSkipRequest) *Response {
+	if req.StartEpoch > d.LatestSTR().Epoch ||
+		req.EndEpoch < req.StartEpoch {
+		return NewErrorResponse(protocol.ErrMalformedMessage)
+	}
+
+	endEp := req.EndEpoch
+	if req.EndEpoch > d.LatestSTR().Epoch {
+		endEp = d.LatestSTR().Epoch
+	}
+
+	var strs []*SignedTreeRoot
+	for _, ep := range merkletree.SkipPath(req.StartEpoch, endEp) {
+		str := d.pad.GetSTR(ep)
+		if str == nil {
+			return NewErrorResponse(protocol.ErrDirectory)
+		}
+		strs = append(strs, NewDirSTR(str))
+	}
+
+	return NewSTRHistoryRange(strs)
+}
+
+// PublicKey returns the public key the Tree signs its STRs with.
+func (d *Tree) PublicKey() sign.PublicKey {
+	return d.pad.PublicKey()
+}
+
+// Snapshot returns the STR of epoch and the Delta that turns the tree of
+// the epoch before into the tree of epoch, as returned by
+// merkletree.PAD.Delta, e.g. to archive or replicate the Tree's history.
+// The Delta is full if full is set. Snapshot returns the errors of
+// merkletree.PAD.Delta.
+func (d *Tree) Snapshot(epoch merkletree.Epoch, full bool) (*SignedTreeRoot, *merkletree.Delta, error) {
+	delta, err := d.pad.Delta(epoch, full)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewDirSTR(d.pad.GetSTR(epoch)), delta, nil
+}
+
+// Changes returns the bindings that were added, modified or removed
+// between the snapshots of the epochs from and to, e.g. so that auditors
+// and operators can see what changed in an epoch. The keys of the
+// changed leaves are the usernames, or the names of the leaves the Tree
+// stores for users, such as TransitionName(username). Changes returns
+// the errors of merkletree.PAD.Changes.
+func (d *Tree) Changes(from, to merkletree.Epoch) ([]merkletree.Change, error) {
+	return d.pad.Changes(from, to)
+}
+
+// latest returns a view of the latest snapshot of the PAD.
+func (d *Tree) latest() merkletree.ReadOnlyTree {
+	view, err := d.pad.At(d.pad.LatestSTR().Epoch)
+	if err != nil {
+		panic(fmt.Errorf("the latest snapshot should always be available but got: %w", err))
+	}
+	return view
+}
+
+// snapshots returns views of the PAD snapshots for the epoch range
+// [start, end], so that a response is built from exactly these epochs.
+func (d *Tree) snapshots(start, end merkletree.Epoch) ([]merkletree.ReadOnlyTree, error) {
+	views := make([]merkletree.ReadOnlyTree, 0, end-start+1)
+	for ep := start; ep <= end; ep++ {
+		view, err := d.pad.At(ep)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// errorResponse returns the response for the error err of the PAD:
+// a NewEpochPrunedResponse() if the requested snapshot has been pruned,
+// and a NewErrorResponse(ErrDirectory) otherwise.
+func errorResponse(err error) *Response {
+	var pruned merkletree.ErrEpochPruned
+	if errors.As(err, &pruned) {
+		return NewEpochPrunedResponse(pruned.Nearest)
+	}
+	return NewErrorResponse(protocol.ErrDirectory)
+}
+
+// dirSTRs returns the STRs of views.
+func dirSTRs(views []merkletree.ReadOnlyTree) []*SignedTreeRoot {
+	var strs []*SignedTreeRoot
+	for _, v := range views {
+		strs = append(strs, NewDirSTR(v.STR()))
+	}
+	return strs
+}
+
+// HandleRequest dispatches the request req received from a CONIKS
+// client or auditor to the method handling its type, and returns
+// the response to be sent back.
+// It returns a NewErrorResponse(ErrMalformedMessage) if req.Request
+// doesn't match req.Type, or if req.Type isn't a request a directory
+// serves, and a NewErrorResponse(ReqRejected) if the Tree's Authorizer
+// doesn't authorize req. The Tree's Metrics, if any, observe every
+// request.
+func (d *Tree) HandleRequest(req *Request) *Response {
+	if d.metrics == nil {
+		return d.handleRequest(req)
+	}
+	start := time.Now()
+	resp := d.handleRequest(req)
+	d.metrics.ObserveRequest(req.Type, resp.Error, time.Since(start))
+	return resp
+}
+
+func (d *Tree) handleRequest(req *Request) *Response {
+	if d.authorizer != nil {
+		if err := d.authorizer.Authorize(req); err != nil {
+			return NewErrorResponse(protocol.ReqRejected)
+		}
+	}
+	switch r := req.Request.(type) {
+	case *RegistrationRequest:
+		if req.Type == RegistrationType {
+			return d.HandleRegistration(r)
+		}
+	case *KeyLookupRequest:
+		if req.Type == KeyLookupType {
+			return d.KeyLookup(r)
+		}
+	case *KeyLookupInEpochRequest:
+		if req.Type == KeyLookupInEpochType {
+			return d.KeyLookupInEpoch(r)
+		}
+	case *MonitoringRequest:
+		if req.Type == MonitoringType {
+			return d.Monitor(r)
+		}
+	case *STRHistoryRequest:
+		if req.Type == STRType {
+			return d.GetSTRHistory(r)
+		}
+	case *BindingUnchangedRequest:
+		if req.Type == BindingUnchangedType {
+			return d.BindingUnchanged(r)
+		}
+	case *STRSkipRequest:
+		if req.Type == STRSkipType {
+			return d.GetSTRSkips(r)
+		}
+	case *RollupRequest:
+		if req.Type == RollupType {
+			return NewRollupResponse(d.Rollup())
+		}
+	case *TransitionRequest:
+		if req.Type == TransitionType {
+			return d.HandleTransition(r)
+		}
+	case *RevocationRequest:
+		if req.Type == RevocationType {
+			return d.HandleRevocation(r)
+		}
+	case *DeletionRequest:
+		if req.Type == DeletionType {
+			return d.HandleDeletion(r)
+		}
+	case *ReattestationRequest:
+		if req.Type == ReattestationType {
+			return d.HandleReattestation(r)
+		}
+	case *ProposalRequest:
+		if req.Type == ProposalType {
+			return d.HandleProposal(r)
+		}
+	case *ApprovalRequest:
+		if req.Type == ApprovalType {
+			return d.HandleApproval(r)
+		}
+	case *OpeningRequest:
+		if req.Type == OpeningType {
+			return d.HandleOpening(r)
+		}
+	}
+	return NewErrorResponse(protocol.ErrMalformedMessage)
+}
+
 // NewTestTree creates a Tree used for testing server-side
 // CONIKS operations.
 func NewTestTree(t *testing.T) *Tree {
@@ -1,12 +1,16 @@
 package directory
 
 import (
+	"errors"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/cryptotest"
+	"github.com/ORBAT/cloniks/internal/race"
 	"github.com/ORBAT/cloniks/merkletree"
 	"github.com/ORBAT/cloniks/protocol"
 )
@@ -16,7 +20,7 @@ func TestDirectoryKeyLookupInEpochBadEpoch(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
 		userName string
-		ep       uint64
+		ep       merkletree.Epoch
 		want     error
 	}{
 		{"invalid username", "", 0, protocol.ErrMalformedMessage},
@@ -38,8 +42,8 @@ func TestBadRequestMonitoring(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
 		userName string
-		startEp  uint64
-		endEp    uint64
+		startEp  merkletree.Epoch
+		endEp    merkletree.Epoch
 		want     error
 	}{
 		{"invalid username", "", 0, 0, protocol.ErrMalformedMessage},
@@ -63,8 +67,8 @@ func TestBadRequestGetSTRHistory(t *testing.T) {
 
 	for _, tc := range []struct {
 		name    string
-		startEp uint64
-		endEp   uint64
+		startEp merkletree.Epoch
+		endEp   merkletree.Epoch
 		want    error
 	}{
 		{"bad end epoch", 4, 2, protocol.ErrMalformedMessage},
@@ -80,6 +84,33 @@ func TestBadRequestGetSTRHistory(t *testing.T) {
 	}
 }
 
+func TestTree_GetSTRSkips(t *testing.T) {
+	d, err := New(vrfKey, signKey, 30)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		d.Update()
+	}
+	for _, req := range []*STRSkipRequest{{StartEpoch: 4, EndEpoch: 2}, {StartEpoch: 21}} {
+		assert.Equal(t, protocol.ErrMalformedMessage, d.GetSTRSkips(req).Error)
+	}
+
+	res := d.HandleRequest(&Request{Type: STRSkipType, Request: &STRSkipRequest{StartEpoch: 3, EndEpoch: 100}})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	strs := res.DirectoryResponse.(*STRHistoryRange).STR
+	var epochs []merkletree.Epoch
+	prev := NewDirSTR(d.pad.GetSTR(3))
+	for _, str := range strs {
+		epochs = append(epochs, str.Epoch)
+		assert.True(t, str.VerifySkip(prev), "expect epoch %d to link to %d", str.Epoch, prev.Epoch)
+		prev = str
+	}
+	assert.Equal(t, []merkletree.Epoch{4, 8, 16, 20}, epochs)
+
+	res = d.GetSTRSkips(&STRSkipRequest{StartEpoch: 20, EndEpoch: 20})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	assert.Empty(t, res.DirectoryResponse.(*STRHistoryRange).STR)
+}
+
 
 var signKey = crypto.NewStaticTestSigningKey()
 var vrfKey = crypto.NewStaticTestVRFKey()
@@ -93,7 +124,7 @@ func newTreeWithKeys(keys ...string) func(t *testing.T) *Tree {
 	return func(t *testing.T) *Tree {
 		tree := newEmptyTree(t)
 		for _, key := range keys {
-			require.NoError(t, tree.pad.Set(key, []byte("value "+key)))
+			require.NoError(t, tree.pad.Set([]byte(key), []byte("value "+key)))
 			tree.Update()
 		}
 		return tree
@@ -112,7 +143,9 @@ func TestTree_Register(t *testing.T) {
 		wantProof merkletree.ProofType
 		wantErr  bool
 	}{
-		// TODO: Add test cases.
+		{"new key in empty tree", newEmptyTree, args{"alice", []byte("key")}, merkletree.ProofOfAbsenceEmpty, false},
+		{"existing key", newTreeWithKeys("alice"), args{"alice", []byte("key")}, merkletree.ProofOfInclusion, true},
+		{"key registered in this epoch", newTreeWithTBs("alice"), args{"alice", []byte("key")}, merkletree.ProofOfAbsenceEmpty, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -126,6 +159,310 @@ func TestTree_Register(t *testing.T) {
 			require.NotNil(t, gotResp, "should always get a RegistrationResponse")
 
 			assert.Equal(t, tt.wantProof, gotResp.AuthPath.ProofType())
+			assert.Equal(t, tt.wantErr, gotResp.Existing)
+			assert.Equal(t, d.LatestSTR(), gotResp.STR)
+			// only keys that aren't in the latest snapshot get a TB
+			assert.Equal(t, tt.wantProof.IsAbsence(), gotResp.TB != nil)
 		})
 	}
-}
\ No newline at end of file
+}
+func newTreeWithTBs(keys ...string) func(t *testing.T) *Tree {
+	return func(t *testing.T) *Tree {
+		tree := newEmptyTree(t)
+		for _, key := range keys {
+			_, err := tree.Register(key, []byte("value "+key))
+			require.NoError(t, err)
+		}
+		return tree
+	}
+}
+
+func TestTree_RegisterMaxChangesPerEpoch(t *testing.T) {
+	d, err := Open(
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithMaxChangesPerEpoch(2),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), d.LatestSTR().Policies.MaxChangesPerEpoch)
+
+	first, err := d.Register("alice", []byte("key 1"))
+	require.NoError(t, err)
+	// registering the promised key again changes nothing
+	again, err := d.Register("alice", []byte("key 1"))
+	assert.True(t, IsKeyExistsError(err))
+	assert.Equal(t, first.TB, again.TB)
+	second, err := d.Register("alice", []byte("key 2"))
+	require.NoError(t, err)
+	assert.False(t, second.Existing)
+	assert.Equal(t, []byte("key 2"), second.TB.Value)
+	assert.Equal(t, first.TB.Index, second.TB.Index)
+	// the maximum is reached
+	third, err := d.Register("alice", []byte("key 3"))
+	assert.True(t, IsKeyExistsError(err))
+	assert.Equal(t, second.TB, third.TB)
+
+	report := mustUpdate(t, d)
+	assert.Equal(t, 1, report.FulfilledTBs)
+	res := d.KeyLookup(&KeyLookupRequest{Username: "alice"})
+	assert.Equal(t, []byte("key 2"), res.DirectoryResponse.(*DirectoryProof).AP[0].Leaf.Value)
+
+	// the count starts over in the next epoch
+	_, err = d.Register("bob", []byte("key 1"))
+	require.NoError(t, err)
+	_, err = d.Register("bob", []byte("key 2"))
+	require.NoError(t, err)
+}
+
+func TestTree_HandleRegistration(t *testing.T) {
+	d := newEmptyTree(t)
+	for _, tc := range []struct {
+		name string
+		req  *RegistrationRequest
+		want protocol.ErrorCode
+	}{
+		{"no username", &RegistrationRequest{Key: []byte("key")}, protocol.ErrMalformedMessage},
+		{"no key", &RegistrationRequest{Username: "alice"}, protocol.ErrMalformedMessage},
+		{"new key", &RegistrationRequest{Username: "alice", Key: []byte("key")}, protocol.ReqSuccess},
+		{"existing key", &RegistrationRequest{Username: "alice", Key: []byte("key")}, protocol.ReqNameExisted},
+	} {
+		resp := d.HandleRegistration(tc.req)
+		assert.Equal(t, tc.want, resp.Error, tc.name)
+		if tc.want == protocol.ReqSuccess || tc.want == protocol.ReqNameExisted {
+			df := resp.DirectoryResponse.(*DirectoryProof)
+			assert.Len(t, df.AP, 1, tc.name)
+			assert.Len(t, df.STR, 1, tc.name)
+			assert.NotNil(t, df.TB, tc.name)
+		}
+	}
+}
+
+func TestTree_HandleRequest(t *testing.T) {
+	d := newTreeWithKeys("alice")(t)
+	for _, tc := range []struct {
+		name string
+		req  *Request
+		want protocol.ErrorCode
+	}{
+		{"registration", &Request{RegistrationType, &RegistrationRequest{Username: "bob", Key: []byte("key")}}, protocol.ReqSuccess},
+		{"lookup", &Request{KeyLookupType, &KeyLookupRequest{Username: "alice"}}, protocol.ReqSuccess},
+		{"lookup in epoch", &Request{KeyLookupInEpochType, &KeyLookupInEpochRequest{Username: "alice", Epoch: 0}}, protocol.ReqNameNotFound},
+		{"monitoring", &Request{MonitoringType, &MonitoringRequest{Username: "alice", StartEpoch: 1, EndEpoch: 1}}, protocol.ReqSuccess},
+		{"STR history", &Request{STRType, &STRHistoryRequest{StartEpoch: 0, EndEpoch: 1}}, protocol.ReqSuccess},
+		{"binding unchanged", &Request{BindingUnchangedType, &BindingUnchangedRequest{Username: "alice", Epoch: 1}}, protocol.ReqSuccess},
+		{"type mismatch", &Request{KeyLookupType, &MonitoringRequest{Username: "alice"}}, protocol.ErrMalformedMessage},
+		{"auditing", &Request{AuditType, &AuditingRequest{}}, protocol.ErrMalformedMessage},
+		{"nil request", &Request{KeyLookupType, nil}, protocol.ErrMalformedMessage},
+	} {
+		assert.Equal(t, tc.want, d.HandleRequest(tc.req).Error, tc.name)
+	}
+}
+
+func TestTree_BindingUnchanged(t *testing.T) {
+	d := newTreeWithKeys("alice")(t) // alice is in epoch 1
+	d.Update()
+	d.Update()
+	pk := crypto.NewStaticTestSigningKey().Public()
+
+	// alice wasn't registered in epoch 0
+	resp := d.BindingUnchanged(&BindingUnchangedRequest{Username: "alice", Epoch: 0})
+	require.Equal(t, protocol.ReqSuccess, resp.Error)
+	df, ok := resp.DirectoryResponse.(*DirectoryProof)
+	require.True(t, ok, "expect the proof of the change")
+	require.Len(t, df.STR, 1)
+	assert.Equal(t, merkletree.Epoch(1), df.STR[0].Epoch)
+	assert.Equal(t, merkletree.ProofOfInclusion, df.AP[0].ProofType())
+	commitment := df.AP[0].Leaf.Commitment.Hash
+
+	resp = d.BindingUnchanged(&BindingUnchangedRequest{Username: "alice", Epoch: 1, Commitment: commitment})
+	require.Equal(t, protocol.ReqSuccess, resp.Error)
+	u, ok := resp.DirectoryResponse.(*BindingUnchanged)
+	require.True(t, ok, "expect an unchanged assertion")
+	assert.Equal(t, merkletree.Epoch(3), u.Through)
+	require.Len(t, u.STR, 2)
+	assert.Equal(t, merkletree.Epoch(2), u.STR[0].Epoch)
+	msg := u.Bytes(df.AP[0].LookupIndex, commitment, 1, u.STR[1].Signature)
+	assert.True(t, pk.Verify(msg, u.Signature[:]))
+	assert.False(t, pk.Verify(u.Bytes(df.AP[0].LookupIndex, commitment, 2, u.STR[1].Signature), u.Signature[:]))
+
+	// nothing to link if the client is up to date
+	resp = d.BindingUnchanged(&BindingUnchangedRequest{Username: "alice", Epoch: 3, Commitment: commitment})
+	u = resp.DirectoryResponse.(*BindingUnchanged)
+	assert.Equal(t, merkletree.Epoch(3), u.Through)
+	assert.Empty(t, u.STR)
+
+	for _, req := range []*BindingUnchangedRequest{{Username: "", Epoch: 1}, {Username: "alice", Epoch: 4}} {
+		assert.Equal(t, protocol.ErrMalformedMessage, d.BindingUnchanged(req).Error)
+	}
+}
+
+func TestNewWithHashIndex(t *testing.T) {
+	d, err := NewWithHashIndex(crypto.NewStaticTestSigningKey(), 10, []byte("hash key"))
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	d.Update()
+
+	str := d.LatestSTR()
+	assert.Equal(t, []byte("hash key"), str.Policies.IndexHashKey)
+	assert.NotEqual(t, NewConfig(nil).Bytes(), str.Policies.Bytes(),
+		"expect the hash key to be signed")
+
+	ap := d.KeyLookup(&KeyLookupRequest{Username: "alice"}).DirectoryResponse.(*DirectoryProof).AP[0]
+	assert.Equal(t, merkletree.ProofOfInclusion, ap.ProofType())
+	assert.True(t, str.Policies.VerifyIndex([]byte("alice"), ap.LookupIndex, ap.VrfProof))
+	assert.False(t, str.Policies.VerifyIndex([]byte("bob"), ap.LookupIndex, ap.VrfProof))
+	assert.False(t, NewConfig(nil).VerifyIndex([]byte("alice"), ap.LookupIndex, ap.VrfProof),
+		"expect a VRF config to reject hash indices")
+}
+
+func TestEvictedSnapshots(t *testing.T) {
+	d, err := New(crypto.NewStaticTestVRFKey(), crypto.NewStaticTestSigningKey(), 4)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		d.Update()
+	}
+	// epoch 0 has been evicted; earlier the handlers would panic on it
+	for name, res := range map[string]*Response{
+		"lookup in epoch": d.KeyLookupInEpoch(&KeyLookupInEpochRequest{Username: "alice", Epoch: 0}),
+		"monitoring":      d.Monitor(&MonitoringRequest{Username: "alice", StartEpoch: 0, EndEpoch: 5}),
+		"STR history":     d.GetSTRHistory(&STRHistoryRequest{StartEpoch: 0, EndEpoch: 5}),
+		"unchanged":       d.BindingUnchanged(&BindingUnchangedRequest{Username: "alice", Epoch: 0}),
+	} {
+		assert.Equal(t, protocol.ErrDirectory, res.Error, name)
+	}
+
+	res := d.Monitor(&MonitoringRequest{Username: "alice", StartEpoch: 4, EndEpoch: 5})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	proof := res.DirectoryResponse.(*DirectoryProof)
+	for i, str := range proof.STR {
+		assert.Equal(t, merkletree.Epoch(4+i), str.Epoch)
+		assert.True(t, proof.AP[i].ProofType().IsAbsence())
+		assert.NoError(t, proof.AP[i].Verify([]byte("alice"), nil, str.TreeHash[:]))
+	}
+}
+
+func TestTree_SetFullSnapshots(t *testing.T) {
+	d, err := New(crypto.NewStaticTestVRFKey(), crypto.NewStaticTestSigningKey(), 10)
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		d.Update()
+	}
+	d.SetFullSnapshots(2) // epochs 3 and 4
+
+	for name, res := range map[string]*Response{
+		"lookup in epoch": d.KeyLookupInEpoch(&KeyLookupInEpochRequest{Username: "alice", Epoch: 1}),
+		"monitoring":      d.Monitor(&MonitoringRequest{Username: "alice", StartEpoch: 2, EndEpoch: 4}),
+		"unchanged":       d.BindingUnchanged(&BindingUnchangedRequest{Username: "alice", Epoch: 1}),
+	} {
+		assert.Equal(t, protocol.ReqEpochPruned, res.Error, name)
+		assert.Equal(t, &EpochPruned{Nearest: 3}, res.DirectoryResponse, name)
+	}
+
+	res := d.GetSTRHistory(&STRHistoryRequest{StartEpoch: 0, EndEpoch: 4})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	assert.Len(t, res.DirectoryResponse.(*STRHistoryRange).STR, 5)
+
+	res = d.KeyLookupInEpoch(&KeyLookupInEpochRequest{Username: "alice", Epoch: 3})
+	assert.Equal(t, protocol.ReqSuccess, res.Error)
+	// the binding hasn't changed since epoch 2, whose snapshot isn't needed
+	res = d.BindingUnchanged(&BindingUnchangedRequest{Username: "alice", Epoch: 2,
+		Commitment: res.DirectoryResponse.(*DirectoryProof).AP[0].Leaf.Commitment.Hash})
+	require.Equal(t, protocol.ReqSuccess, res.Error)
+	assert.Equal(t, merkletree.Epoch(4), res.DirectoryResponse.(*BindingUnchanged).Through)
+}
+
+func TestTree_SetMemoryBudget(t *testing.T) {
+	d, err := New(crypto.NewStaticTestVRFKey(), crypto.NewStaticTestSigningKey(), 2)
+	require.NoError(t, err)
+	var archived []*SignedTreeRoot
+	d.SetEvictionFunc(func(view merkletree.ReadOnlyTree) {
+		archived = append(archived, NewDirSTR(view.STR()))
+	})
+	assert.Equal(t, merkletree.ErrInvalidMemoryBudget, d.SetMemoryBudget(2, 1))
+	// enough for a few empty snapshots, whose STRs take more memory than
+	// their trees, which share their nodes
+	snapshot := mustStats(t, d).Snapshots[0].Bytes
+	require.NoError(t, d.SetMemoryBudget(9*snapshot, 12*snapshot))
+	for i := 0; i < 10; i++ {
+		d.Update()
+	}
+	stats := mustStats(t, d)
+	assert.True(t, len(stats.Snapshots) > 2, "expect more snapshots than the Tree was created with")
+	require.NotEmpty(t, archived)
+	assert.Equal(t, merkletree.Epoch(0), archived[0].Epoch)
+	assert.Equal(t, stats.Snapshots[0].Epoch, archived[len(archived)-1].Epoch+1)
+}
+
+// mustUpdate calls d.Update, failing t if it returns an error.
+func mustUpdate(t *testing.T, d *Tree) *EpochReport {
+	t.Helper()
+	report, err := d.Update()
+	require.NoError(t, err)
+	return report
+}
+
+// mustLookup looks name up in the latest snapshot of d.
+func mustLookup(t *testing.T, d *Tree, name string) *merkletree.AuthenticationPath {
+	t.Helper()
+	ap, err := d.latest().Get([]byte(name))
+	require.NoError(t, err)
+	return ap
+}
+
+func mustStats(t *testing.T, d *Tree) merkletree.PADStats {
+	t.Helper()
+	st, err := d.Stats()
+	require.NoError(t, err)
+	return st
+}
+
+func TestTree_Update(t *testing.T) {
+	d := newTreeWithTBs("alice", "bob")(t)
+	report := mustUpdate(t, d)
+	assert.Equal(t, merkletree.Epoch(1), report.Epoch)
+	assert.Equal(t, d.LatestSTR(), report.STR)
+	assert.Equal(t, 2, report.FulfilledTBs)
+	assert.Equal(t, uint64(2), report.Insertions)
+	assert.NotZero(t, report.Hash.Computed)
+
+	report = mustUpdate(t, d)
+	assert.Equal(t, 0, report.FulfilledTBs)
+	assert.Equal(t, uint64(0), report.Insertions)
+}
+
+func TestTree_RegisterIndexCollision(t *testing.T) {
+	vrfKey := crypto.NewStaticTestVRFKey()
+	d, err := Open(WithSigningKey(crypto.NewStaticTestSigningKey()), WithVRFKey(vrfKey),
+		WithIndexer(&cryptotest.Indexer{Key: vrfKey, Collide: map[string]string{"mallory": "alice"}}))
+	require.NoError(t, err)
+	_, err = d.Register("alice", []byte("alice's key"))
+	require.NoError(t, err)
+
+	_, err = d.Register("mallory", []byte("mallory's key"))
+	assert.True(t, errors.Is(err, merkletree.ErrIndexCollision), err)
+	res := d.HandleRegistration(&RegistrationRequest{Username: "mallory", Key: []byte("mallory's key")})
+	assert.Equal(t, protocol.ErrDirectory, res.Error)
+}
+
+// TestKeyLookupAllocs keeps the per-request garbage of serving lookups in
+// check. Most of it comes from computing the index with the VRF.
+func TestKeyLookupAllocs(t *testing.T) {
+	if race.Enabled {
+		t.Skip("the race detector allocates")
+	}
+	const budget = 24
+	d := NewTestTree(t)
+	for i := 0; i < 200; i++ {
+		_, err := d.Register("user"+strconv.Itoa(i), []byte("key"))
+		require.NoError(t, err)
+	}
+	d.Update()
+	for _, name := range []string{"user100", "nobody"} {
+		req := &KeyLookupRequest{Username: name}
+		allocs := testing.AllocsPerRun(50, func() { d.KeyLookup(req) })
+		assert.LessOrEqual(t, allocs, float64(budget), name)
+	}
+}
@@ -0,0 +1,60 @@
+package directory
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrBadUpgrade is returned by ScheduleUpgrade for upgrades the Tree
+// can't announce.
+var ErrBadUpgrade = errors.New("[directory] Invalid protocol upgrade")
+
+// An Upgrade announces that a directory switches to the protocol Version
+// at Epoch: the STR of that epoch is the first whose Config has the new
+// Version, and is serialized, signed and verified the way it defines.
+// The announcement is part of every STR from the one after it's
+// scheduled up to the one before Epoch, so that clients and auditors
+// learn of it in advance and can check that the switch happens exactly
+// then.
+type Upgrade struct {
+	Version []byte
+	Epoch   merkletree.Epoch
+}
+
+// Bytes serializes u for signing, as the length-prefixed version
+// followed by the epoch.
+func (u *Upgrade) Bytes() []byte {
+	bs := conv.UInt32ToBytes(uint32(len(u.Version)))
+	bs = append(bs, u.Version...)
+	return append(bs, conv.ULongToBytes(uint64(u.Epoch))...)
+}
+
+// Equal returns true iff u and other announce the same upgrade, or are
+// both nil.
+func (u *Upgrade) Equal(other *Upgrade) bool {
+	if u == nil || other == nil {
+		return u == other
+	}
+	return u.Epoch == other.Epoch && bytes.Equal(u.Version, other.Version)
+}
+
+// encodings maps the protocol versions this module supports to the
+// serialization of the Configs of their STRs. A version that changes the
+// serialization, or the algorithms a Config declares, adds its own
+// encoding here, so that directories and clients select it by the
+// Version of each STR, and STRs signed before and after an upgrade both
+// verify.
+var encodings = map[string]func(p *Config) []byte{
+	protocol.Version: (*Config).bytes,
+}
+
+// SupportsVersion returns true iff this module can serialize and verify
+// STRs of the protocol version.
+func SupportsVersion(version []byte) bool {
+	_, ok := encodings[string(version)]
+	return ok
+}
@@ -0,0 +1,61 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"bytes"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// ScheduleUpgrade announces that the Tree switches to the protocol
+// version at epoch, starting with the STR the next Update signs. The
+// announcement must precede the switch, so epoch must be later than the
+// epoch of that STR. Rescheduling or cancelling (see CancelUpgrade) an
+// announced upgrade flags a PolicyChange, like withdrawing capabilities.
+// It returns ErrBadUpgrade if the version isn't supported or is the
+// current one, or epoch is too early.
+func (d *Tree) ScheduleUpgrade(version []byte, epoch merkletree.Epoch) error {
+	if !SupportsVersion(version) || bytes.Equal(version, d.config.Version) ||
+		epoch <= d.pad.LatestSTR().Epoch+1 {
+		return ErrBadUpgrade
+	}
+	d.setUpgrade(&Upgrade{Version: version, Epoch: epoch})
+	return nil
+}
+
+// CancelUpgrade withdraws the upgrade announced with ScheduleUpgrade, if
+// any, starting with the STR the next Update signs.
+func (d *Tree) CancelUpgrade() {
+	if d.config.Upgrade != nil {
+		d.setUpgrade(nil)
+	}
+}
+
+// setUpgrade replaces the announced upgrade with u.
+func (d *Tree) setUpgrade(u *Upgrade) {
+	if d.config.Upgrade != nil && !d.config.Upgrade.Equal(u) {
+		d.policyChange = true
+	}
+	// STRs share the Config, so it's replaced instead of modified
+	config := *d.config
+	config.Upgrade = u
+	d.config = &config
+	d.pad.SetAssocData(d.config)
+}
+
+// activateUpgrade switches the Tree to the announced protocol version if
+// the upgrade is due in epoch, the epoch of the STR the next Update
+// signs.
+func (d *Tree) activateUpgrade(epoch merkletree.Epoch) {
+	u := d.config.Upgrade
+	if u == nil || u.Epoch != epoch {
+		return
+	}
+	config := *d.config
+	config.Version = u.Version
+	config.Upgrade = nil
+	d.config = &config
+	d.pad.SetAssocData(d.config)
+}
@@ -0,0 +1,73 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+)
+
+var nextVersion = []byte("0.2")
+
+func TestScheduleUpgrade(t *testing.T) {
+	encodings[string(nextVersion)] = (*Config).bytes
+	defer delete(encodings, string(nextVersion))
+	d := NewTestTree(t)
+	pk := crypto.NewStaticTestSigningKey().Public()
+
+	assert.Equal(t, ErrBadUpgrade, d.ScheduleUpgrade([]byte("9.9"), 5))
+	assert.Equal(t, ErrBadUpgrade, d.ScheduleUpgrade(versionBs, 5))
+	// the announcement has to precede the switch
+	assert.Equal(t, ErrBadUpgrade, d.ScheduleUpgrade(nextVersion, 1))
+	require.NoError(t, d.ScheduleUpgrade(nextVersion, 3))
+
+	d.Update()
+	announced := d.LatestSTR()
+	assert.Equal(t, &Upgrade{Version: nextVersion, Epoch: 3}, announced.Policies.Upgrade)
+	assert.Equal(t, versionBs, announced.Policies.Version)
+	d.Update()
+	assert.NotNil(t, d.LatestSTR().Policies.Upgrade)
+	d.Update()
+	upgraded := d.LatestSTR()
+	assert.Equal(t, nextVersion, upgraded.Policies.Version)
+	assert.Nil(t, upgraded.Policies.Upgrade)
+	assert.False(t, upgraded.Policies.PolicyChange)
+	assert.True(t, pk.Verify(upgraded.Bytes(), upgraded.Signature[:]))
+
+	// the earlier STRs are unchanged
+	assert.Equal(t, versionBs, announced.Policies.Version)
+	assert.True(t, pk.Verify(announced.Bytes(), announced.Signature[:]))
+}
+
+func TestCancelUpgrade(t *testing.T) {
+	encodings[string(nextVersion)] = (*Config).bytes
+	defer delete(encodings, string(nextVersion))
+	d := NewTestTree(t)
+
+	d.CancelUpgrade()
+	d.Update()
+	assert.False(t, d.LatestSTR().Policies.PolicyChange)
+
+	require.NoError(t, d.ScheduleUpgrade(nextVersion, 5))
+	d.Update()
+	d.CancelUpgrade()
+	d.Update()
+	assert.Nil(t, d.LatestSTR().Policies.Upgrade)
+	assert.True(t, d.LatestSTR().Policies.PolicyChange)
+	for d.LatestSTR().Epoch < 6 {
+		d.Update()
+		assert.Equal(t, versionBs, d.LatestSTR().Policies.Version)
+	}
+}
+
+func TestConfigBytesUpgrade(t *testing.T) {
+	c := NewConfig(nil)
+	plain := c.Bytes()
+	c.Upgrade = &Upgrade{Version: nextVersion, Epoch: 3}
+	announced := c.Bytes()
+	assert.NotEqual(t, plain, announced)
+	c.Upgrade = &Upgrade{Version: nextVersion, Epoch: 4}
+	assert.NotEqual(t, announced, c.Bytes())
+}
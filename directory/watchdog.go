@@ -0,0 +1,216 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package directory
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+var (
+	// ErrUpdateFailed is wrapped by the errors of epoch updates that
+	// failed to store the snapshot.
+	ErrUpdateFailed = errors.New("[directory] Epoch update failed")
+	// ErrReadOnly indicates that Register was refused because the
+	// Tree's watchdog put it in read-only mode. See WatchdogConfig.
+	ErrReadOnly = errors.New("[directory] Directory is read-only")
+)
+
+// A WatchdogConfig configures the watchdog of the epoch updates Tree.Run
+// makes. The TBs a Tree issues promise that their bindings are included
+// in the next snapshot, so an update that is late or fails breaks the
+// directory's promises; the watchdog tells the operator, and can stop
+// the Tree from making more promises until the updates recover.
+type WatchdogConfig struct {
+	// Deadline is how long an epoch update may take. An alert is sent
+	// as soon as it's exceeded, even if the update never finishes.
+	// A Deadline of 0 disables it.
+	Deadline time.Duration
+	// MaxFailures is the number of consecutive failed updates after
+	// which the Tree is unhealthy. Values below 1 mean 1.
+	MaxFailures int
+	// ReadOnly makes the Tree refuse registrations with ErrReadOnly
+	// while it's unhealthy.
+	ReadOnly bool
+	// PromiseDeadline is how long the binding of a TB may take to be
+	// included in a signed STR after the TB was issued. A warning alert
+	// is sent for every snapshot whose slowest fulfilled promise took
+	// more than the fraction PromiseWarning of the deadline, and
+	// a critical one if it took longer than the deadline. Values of
+	// PromiseWarning outside (0, 1) mean 0.8. A PromiseDeadline of 0
+	// disables it.
+	PromiseDeadline time.Duration
+	PromiseWarning  float64
+	// Alerts receives a critical alert whenever an update exceeds the
+	// deadline, or the consecutive failures reach MaxFailures, and the
+	// alerts about the promise deadline. It may be nil.
+	Alerts alert.Sink
+}
+
+// Health describes the health of a Tree's epoch updates, as observed by
+// its watchdog. A Tree is unhealthy after an update exceeded the
+// deadline or too many updates failed in a row, until an update
+// succeeds in time.
+type Health struct {
+	Healthy  bool
+	ReadOnly bool
+	// Failures is the number of consecutive failed updates.
+	Failures int
+	// MissedDeadlines is the number of updates that exceeded the
+	// deadline since the Tree was opened.
+	MissedDeadlines uint64
+	// LatePromises is the number of snapshots that fulfilled a promise
+	// after the promise deadline since the Tree was opened.
+	LatePromises uint64
+	// FailedTimestamps is the number of archival attestations Update
+	// made that couldn't be timestamped since the Tree was opened. They
+	// don't make the Tree unhealthy.
+	FailedTimestamps uint64
+	// LastUpdate is when the latest update started, and LastDuration
+	// how long it took.
+	LastUpdate   time.Time     `json:",omitempty"`
+	LastDuration time.Duration `json:",omitempty"`
+	// LastError is the error of the latest update, if it failed.
+	LastError string `json:",omitempty"`
+}
+
+// A watchdog tracks the Health of a Tree's epoch updates. It has its own
+// lock, since it's read while the Tree's lock is held by an update.
+type watchdog struct {
+	WatchdogConfig
+	mu     sync.Mutex
+	health Health
+	now    func() time.Time
+}
+
+func newWatchdog(c WatchdogConfig) *watchdog {
+	if c.MaxFailures < 1 {
+		c.MaxFailures = 1
+	}
+	return &watchdog{WatchdogConfig: c, health: Health{Healthy: true}, now: time.Now}
+}
+
+// WithWatchdog makes Run watch its epoch updates as configured by c.
+// See Tree.Health.
+func WithWatchdog(c WatchdogConfig) Option {
+	return func(o *options) error {
+		o.watchdog = &c
+		return nil
+	}
+}
+
+// Health returns the health of the Tree's epoch updates. A Tree opened
+// without WithWatchdog is always healthy.
+func (d *Tree) Health() Health {
+	if d.watchdog == nil {
+		return Health{Healthy: true}
+	}
+	d.watchdog.mu.Lock()
+	defer d.watchdog.mu.Unlock()
+	return d.watchdog.health
+}
+
+// readOnly reports whether the watchdog put the Tree in read-only mode.
+func (d *Tree) readOnly() bool {
+	return d.watchdog != nil && d.Health().ReadOnly
+}
+
+// scheduledUpdate takes the snapshot of an epoch scheduled by Run,
+// watched by the Tree's watchdog, if any, and returns the error of
+// Update, which the watchdog handled if there is one.
+func (d *Tree) scheduledUpdate() error {
+	if d.watchdog == nil {
+		_, err := d.Update()
+		return err
+	}
+	w := d.watchdog
+	epoch := d.LatestSTR().Epoch + 1
+	dirID := d.id()
+
+	start := w.now()
+	var timer *time.Timer
+	if w.Deadline > 0 {
+		timer = time.AfterFunc(w.Deadline, func() { w.missedDeadline(dirID, epoch) })
+	}
+	_, err := d.Update()
+	missed := timer != nil && !timer.Stop()
+	w.finish(dirID, epoch, start, w.now().Sub(start), missed, err)
+	return err
+}
+
+// id returns the hex-encoded identifier of the Tree's directory.
+func (d *Tree) id() string {
+	_, first := d.pad.STRListRoot()
+	return hex.EncodeToString(first[:])
+}
+
+// missedDeadline is called when the update of epoch exceeds the
+// deadline.
+func (w *watchdog) missedDeadline(dirID string, epoch merkletree.Epoch) {
+	w.mu.Lock()
+	w.health.MissedDeadlines++
+	w.setUnhealthy()
+	w.mu.Unlock()
+	w.alert(dirID, epoch, fmt.Sprintf("epoch update exceeded its deadline of %s", w.Deadline), nil)
+}
+
+// finish records the result of the update of epoch that started at
+// start and took took.
+func (w *watchdog) finish(dirID string, epoch merkletree.Epoch, start time.Time, took time.Duration,
+	missed bool, err error) {
+	w.mu.Lock()
+	w.health.LastUpdate, w.health.LastDuration = start, took
+	w.health.LastError = ""
+	var failed bool
+	switch {
+	case err != nil:
+		w.health.Failures++
+		w.health.LastError = err.Error()
+		if w.health.Failures >= w.MaxFailures {
+			failed = w.health.Failures == w.MaxFailures
+			w.setUnhealthy()
+		}
+	case !missed:
+		w.health = Health{
+			Healthy:          true,
+			MissedDeadlines:  w.health.MissedDeadlines,
+			LatePromises:     w.health.LatePromises,
+			FailedTimestamps: w.health.FailedTimestamps,
+			LastUpdate:       start,
+			LastDuration:     took,
+		}
+	default:
+		w.health.Failures = 0
+	}
+	failures := w.health.Failures
+	w.mu.Unlock()
+	if failed {
+		w.alert(dirID, epoch, fmt.Sprintf("%d consecutive epoch updates failed", failures), err)
+	}
+}
+
+// setUnhealthy marks the Tree unhealthy, and read-only if configured.
+// w.mu must be held.
+func (w *watchdog) setUnhealthy() {
+	w.health.Healthy = false
+	w.health.ReadOnly = w.ReadOnly
+}
+
+func (w *watchdog) alert(dirID string, epoch merkletree.Epoch, msg string, err error) {
+	_ = alert.Send(w.Alerts, &alert.Alert{
+		Kind:      alert.UpdateFailed,
+		Severity:  alert.Critical,
+		Time:      w.now(),
+		Directory: dirID,
+		Epoch:     epoch,
+		Message:   msg,
+		Err:       err,
+	})
+}
@@ -0,0 +1,126 @@
+package directory
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+type epochFunc func(report *EpochReport)
+
+func (f epochFunc) ObserveRequest(int, protocol.ErrorCode, time.Duration) {}
+
+func (f epochFunc) ObserveEpoch(report *EpochReport) { f(report) }
+
+type alertRecorder struct {
+	mu     sync.Mutex
+	alerts []*alert.Alert
+}
+
+func (r *alertRecorder) Send(a *alert.Alert) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+func (r *alertRecorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.alerts)
+}
+
+func openWatched(t *testing.T, c WatchdogConfig, observe func(*EpochReport), opts ...Option) *Tree {
+	d, err := Open(append([]Option{
+		WithSigningKey(crypto.NewStaticTestSigningKey()),
+		WithVRFKey(crypto.NewStaticTestVRFKey()),
+		WithMetrics(epochFunc(observe)),
+		WithWatchdog(c),
+	}, opts...)...)
+	require.NoError(t, err)
+	return d
+}
+
+func TestWatchdog_Failures(t *testing.T) {
+	alerts := new(alertRecorder)
+	store := &failingStore{MemNodeStore: merkletree.NewMemNodeStore()}
+	d := openWatched(t, WatchdogConfig{MaxFailures: 2, ReadOnly: true, Alerts: alerts},
+		func(*EpochReport) {}, WithNodeStore(store))
+	_, err := d.Register("alice", []byte("key"))
+	require.NoError(t, err)
+	store.fail = true
+
+	d.scheduledUpdate()
+	h := d.Health()
+	assert.True(t, h.Healthy)
+	assert.Equal(t, 1, h.Failures)
+	assert.Contains(t, h.LastError, "store failed")
+
+	d.scheduledUpdate()
+	h = d.Health()
+	assert.False(t, h.Healthy)
+	assert.True(t, h.ReadOnly)
+	assert.Equal(t, 2, h.Failures)
+	require.Equal(t, 1, alerts.len())
+	assert.Equal(t, alert.UpdateFailed, alerts.alerts[0].Kind)
+	assert.Equal(t, alert.Critical, alerts.alerts[0].Severity)
+	assert.True(t, errors.Is(alerts.alerts[0].Err, ErrUpdateFailed))
+
+	_, err = d.Register("bob", []byte("key"))
+	assert.Equal(t, ErrReadOnly, err)
+	res := d.HandleRegistration(&RegistrationRequest{Username: "bob", Key: []byte("key")})
+	assert.Equal(t, protocol.ErrDirectory, res.Error)
+
+	// further failures don't repeat the alert
+	d.scheduledUpdate()
+	assert.Equal(t, 1, alerts.len())
+
+	store.fail = false
+	d.scheduledUpdate()
+	assert.Equal(t, Health{Healthy: true, LastUpdate: d.Health().LastUpdate,
+		LastDuration: d.Health().LastDuration}, d.Health())
+	_, err = d.Register("bob", []byte("key"))
+	assert.NoError(t, err)
+}
+
+func TestWatchdog_Deadline(t *testing.T) {
+	alerts := new(alertRecorder)
+	delay := 50 * time.Millisecond
+	d := openWatched(t, WatchdogConfig{Deadline: 10 * time.Millisecond, ReadOnly: true, Alerts: alerts},
+		func(*EpochReport) { time.Sleep(delay) })
+
+	d.scheduledUpdate()
+	require.Eventually(t, func() bool { return alerts.len() == 1 }, time.Second, time.Millisecond)
+	h := d.Health()
+	assert.False(t, h.Healthy)
+	assert.True(t, h.ReadOnly)
+	assert.Equal(t, uint64(1), h.MissedDeadlines)
+	assert.Zero(t, h.Failures)
+	assert.Equal(t, alert.UpdateFailed, alerts.alerts[0].Kind)
+	assert.Equal(t, d.LatestSTR().Epoch, alerts.alerts[0].Epoch)
+	_, err := d.Register("alice", []byte("key"))
+	assert.Equal(t, ErrReadOnly, err)
+
+	delay = 0
+	d.scheduledUpdate()
+	h = d.Health()
+	assert.True(t, h.Healthy)
+	assert.False(t, h.ReadOnly)
+	assert.Equal(t, uint64(1), h.MissedDeadlines)
+}
+
+func TestTree_HealthWithoutWatchdog(t *testing.T) {
+	d := NewTestTree(t)
+	d.scheduledUpdate()
+	assert.Equal(t, Health{Healthy: true}, d.Health())
+	assert.False(t, d.readOnly())
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+	"github.com/ORBAT/cloniks/protocol/auditlog"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+	"github.com/ORBAT/cloniks/protocol/client"
+)
+
+// dirSize is the number of snapshots the directory keeps.
+const dirSize = 64
+
+// A Book is a transparent address book. It wires together the three
+// parties of the CONIKS protocols: a directory mapping names to public
+// keys, an auditor that keeps a copy of the directory's STR history,
+// and a client that checks every response it gets from either of them.
+//
+// In a real deployment each party runs on a different machine and the
+// messages below travel over the network; here they are plain function
+// calls.
+type Book struct {
+	dir   *directory.Tree
+	aud   auditlog.ConiksAuditLog
+	dirID [hashed.HashSizeByte]byte
+	cc    *client.ConsistencyChecks
+}
+
+// NewBook creates a directory with fresh keys, registers it with a new
+// auditor, and creates a client that trusts the directory's genesis
+// STR. Alerts raised by the client are written to alerts.
+func NewBook(alerts io.Writer) (*Book, error) {
+	vrfKey, err := vrf.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	signKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := directory.New(vrfKey, signKey, dirSize)
+	if err != nil {
+		return nil, err
+	}
+	pk := signKey.Public()
+	genesis := dir.LatestSTR()
+
+	aud := auditlog.New()
+	if err := aud.InitHistory("addressbook", pk,
+		[]*directory.SignedTreeRoot{genesis}); err != nil {
+		return nil, err
+	}
+
+	dirID, err := auditor.ComputeDirectoryIdentity(genesis)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := client.NewFromGenesis(genesis, pk)
+	if err != nil {
+		return nil, err
+	}
+	cc.Alerts = &alert.LogSink{W: alerts, Plain: true}
+
+	return &Book{
+		dir:   dir,
+		aud:   aud,
+		dirID: dirID,
+		cc:    cc,
+	}, nil
+}
+
+// Epoch returns the latest epoch the client has verified.
+func (b *Book) Epoch() merkletree.Epoch {
+	return b.cc.VerifiedSTR().Epoch
+}
+
+// Register asks the directory to bind name to key, and verifies the
+// directory's answer. If name is already taken, Register verifies the
+// proof the directory returns and reports protocol.ReqNameExisted.
+func (b *Book) Register(name string, key []byte) error {
+	resp, err := b.dir.Register(name, key)
+	if err != nil && !directory.IsKeyExistsError(err) {
+		return err
+	}
+	if resp.Existing {
+		// we don't know the key bound to the name yet
+		key = nil
+	}
+	msg := resp.Response()
+	if err := b.cc.HandleResponse(directory.RegistrationType, msg, name, key); err != nil {
+		return err
+	}
+	if msg.Error != protocol.ReqSuccess {
+		return msg.Error
+	}
+	return nil
+}
+
+// Lookup asks the directory for the key bound to name in the latest
+// epoch, verifies the directory's answer, and returns the key.
+// The key comes from the temporary binding if name was registered
+// in the latest epoch.
+func (b *Book) Lookup(name string) ([]byte, error) {
+	msg := b.dir.KeyLookup(&directory.KeyLookupRequest{Username: name})
+	if err := b.cc.HandleResponse(directory.KeyLookupType, msg, name, nil); err != nil {
+		return nil, err
+	}
+	if msg.Error != protocol.ReqSuccess {
+		return nil, msg.Error
+	}
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if df.TB != nil {
+		return df.TB.Value, nil
+	}
+	return df.AP[0].Leaf.Value, nil
+}
+
+// NextEpoch makes the directory take a new snapshot and publish the
+// new STR, which both the auditor and the client then audit.
+func (b *Book) NextEpoch() error {
+	if _, err := b.dir.Update(); err != nil {
+		return err
+	}
+	latest := b.dir.LatestSTR().Epoch
+	msg := b.dir.GetSTRHistory(&directory.STRHistoryRequest{
+		StartEpoch: latest,
+		EndEpoch:   latest,
+	})
+	if err := b.aud.Audit(b.dirID, msg); err != nil {
+		return fmt.Errorf("auditor: %w", err)
+	}
+	strs := msg.DirectoryResponse.(*directory.STRHistoryRange).STR
+	if err := b.cc.AuditDirectory(strs); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	b.cc.Update(strs[len(strs)-1])
+	return nil
+}
+
+// CrossCheck fetches the auditor's copy of the STR for the client's
+// latest epoch and checks that the directory didn't equivocate, i.e.
+// that the client and the auditor saw the same history.
+func (b *Book) CrossCheck() error {
+	epoch := b.Epoch()
+	msg := b.aud.GetObservedSTRs(&directory.AuditingRequest{
+		DirInitSTRHash: b.dirID,
+		StartEpoch:     epoch,
+		EndEpoch:       epoch,
+	})
+	return b.cc.CheckEquivocation(msg)
+}
@@ -0,0 +1,92 @@
+// Command addressbook is a transparent address book: a small
+// interactive demo of a CONIKS directory, auditor and client talking to
+// each other in a single process. Type "help" at the prompt for a list
+// of commands.
+//
+// It is meant as a starting point for integrators: Book shows which
+// messages each party sends, and which checks the client runs on the
+// responses.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `commands:
+  register <name> <key>  bind name to key
+  lookup <name>          look up and verify the key bound to name
+  epoch                  start a new epoch
+  audit                  cross-check the directory's STRs with the auditor
+  help                   show this message
+  quit                   exit
+`
+
+func main() {
+	if err := run(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run reads commands from in and writes the results to out until in is
+// exhausted or it reads a quit command.
+func run(in io.Reader, out io.Writer) error {
+	book, err := NewBook(out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(out, "transparent address book; type \"help\" for commands\n")
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprintf(out, "epoch %d> ", book.Epoch())
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return nil
+		}
+		exec(book, out, args)
+	}
+}
+
+func exec(book *Book, out io.Writer, args []string) {
+	switch {
+	case args[0] == "register" && len(args) == 3:
+		if err := book.Register(args[1], []byte(args[2])); err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(out, "registered %s; the directory promised to include it in epoch %d\n",
+			args[1], book.Epoch()+1)
+	case args[0] == "lookup" && len(args) == 2:
+		key, err := book.Lookup(args[1])
+		if err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(out, "%s => %s (verified)\n", args[1], key)
+	case args[0] == "epoch" && len(args) == 1:
+		if err := book.NextEpoch(); err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(out, "now in epoch %d\n", book.Epoch())
+	case args[0] == "audit" && len(args) == 1:
+		if err := book.CrossCheck(); err != nil {
+			fmt.Fprintf(out, "error: %v\n", err)
+			return
+		}
+		fmt.Fprintf(out, "the auditor saw the same STR for epoch %d\n", book.Epoch())
+	default:
+		fmt.Fprint(out, usage)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestRun(t *testing.T) {
+	script := strings.Join([]string{
+		"register alice alice-key",
+		"register alice other-key",
+		"lookup alice",
+		"lookup bob",
+		"epoch",
+		"lookup alice",
+		"register bob bob-key",
+		"epoch",
+		"epoch",
+		"lookup bob",
+		"audit",
+		"quit",
+		"lookup alice",
+	}, "\n")
+
+	var out bytes.Buffer
+	if err := run(strings.NewReader(script), &out); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"registered alice; the directory promised to include it in epoch 1",
+		"error: " + protocol.ReqNameExisted.Error(),
+		"alice => alice-key (verified)",
+		"error: " + protocol.ReqNameNotFound.Error(),
+		"now in epoch 1",
+		"now in epoch 3",
+		"bob => bob-key (verified)",
+		"the auditor saw the same STR for epoch 3",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expect output to contain %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Count(got, "alice => alice-key") != 2 {
+		t.Errorf("Expect commands after quit to be ignored, got:\n%s", got)
+	}
+	if strings.Contains(got, "[critical]") || strings.Contains(got, "[warning]") {
+		t.Errorf("Expect no alerts, got:\n%s", got)
+	}
+}
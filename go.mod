@@ -4,11 +4,13 @@ go 1.15
 
 require (
 	github.com/golang/snappy v0.0.0-20170215233205-553a64147049 // indirect
+	github.com/klauspost/compress v1.13.6
 	github.com/onsi/ginkgo v1.14.2 // indirect
 	github.com/onsi/gomega v1.10.3 // indirect
 	github.com/stretchr/testify v1.6.1
 	github.com/syndtr/goleveldb v0.0.0-20171214120811-34011bf325bc
 	github.com/zeebo/blake3 v0.1.0
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	google.golang.org/grpc v1.38.0
 	lukechampine.com/frand v1.3.0
 )
@@ -0,0 +1,10 @@
+//go:build race
+// +build race
+
+// Package race reports whether the race detector is enabled, so that
+// the tests of allocations can be skipped when its instrumentation
+// allocates.
+package race
+
+// Enabled is set if the race detector is enabled.
+const Enabled = true
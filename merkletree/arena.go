@@ -0,0 +1,89 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+// A TreeOption sets an optional parameter of a MerkleTree. See
+// NewMerkleTreeWithIndexSize and NewMerkleTreeFromSorted.
+type TreeOption func(*MerkleTree)
+
+// WithNodeArena makes the tree allocate its nodes in chunks of chunk
+// nodes of each kind instead of one by one, which cuts the number of
+// allocations, and thus the work of the garbage collector, during bulk
+// loads and updates (see the BulkLoad and EpochUpdate benchmarks). The
+// price is memory: a chunk is only freed once none of its nodes is in
+// use, so the nodes that a tree replaces are freed later, if at all, the
+// more so the larger the chunks. A chunk of 0 or less means the default
+// of 1024.
+//
+// The clones of the tree get arenas of their own (see MerkleTree.Clone),
+// which allocate nothing until the clone is modified.
+func WithNodeArena(chunk int) TreeOption {
+	if chunk <= 0 {
+		chunk = defaultArenaChunk
+	}
+	return func(m *MerkleTree) {
+		m.arena = &nodeArena{chunk: chunk}
+	}
+}
+
+const defaultArenaChunk = 1024
+
+// A nodeArena allocates the nodes of one tree from chunks of nodes.
+// Unlike the tree, it's not safe for concurrent use, so the tree only
+// uses it while it has exclusive access. A nil nodeArena allocates each
+// node on its own.
+type nodeArena struct {
+	chunk     int
+	interiors []interiorNode
+	leaves    []userLeafNode
+	empties   []emptyNode
+}
+
+// fresh returns an empty arena with the chunk size of a, or nil if a is
+// nil.
+func (a *nodeArena) fresh() *nodeArena {
+	if a == nil {
+		return nil
+	}
+	return &nodeArena{chunk: a.chunk}
+}
+
+// interior returns a new zero interiorNode.
+func (a *nodeArena) interior() *interiorNode {
+	if a == nil {
+		return new(interiorNode)
+	}
+	if len(a.interiors) == 0 {
+		a.interiors = make([]interiorNode, a.chunk)
+	}
+	n := &a.interiors[0]
+	a.interiors = a.interiors[1:]
+	return n
+}
+
+// leaf returns a new zero userLeafNode.
+func (a *nodeArena) leaf() *userLeafNode {
+	if a == nil {
+		return new(userLeafNode)
+	}
+	if len(a.leaves) == 0 {
+		a.leaves = make([]userLeafNode, a.chunk)
+	}
+	n := &a.leaves[0]
+	a.leaves = a.leaves[1:]
+	return n
+}
+
+// empty returns a new zero emptyNode.
+func (a *nodeArena) empty() *emptyNode {
+	if a == nil {
+		return new(emptyNode)
+	}
+	if len(a.empties) == 0 {
+		a.empties = make([]emptyNode, a.chunk)
+	}
+	n := &a.empties[0]
+	a.empties = a.empties[1:]
+	return n
+}
@@ -0,0 +1,144 @@
+package merkletree
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func TestNodeArena(t *testing.T) {
+	entries := batchEntries(200, 0, valuePrefix)
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize, WithNodeArena(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := m.Set(e.Index, e.Key, e.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaves, next := sortedLeaves(m, true)
+	built, err := NewMerkleTreeFromSorted(MinIndexSize, m.nonce, next, WithNodeArena(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != len(entries) || !bytes.Equal(built.Hash(), m.Hash()) {
+		t.Fatal("Expect the same tree with an arena")
+	}
+
+	// the clone allocates from its own arena, so neither tree changes
+	// the other
+	hash := copyOfBs(m.Hash())
+	c := mustClone(t, m)
+	if c.arena == nil || c.arena == m.arena {
+		t.Fatal("Expect the clone to have an arena of its own")
+	}
+	if err := c.SetBatch(batchEntries(100, 200, valuePrefix)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Delete(entries[0].Index); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Hash(), hash) {
+		t.Error("Expect the original tree not to change with its clone")
+	}
+	for _, e := range entries[1:] {
+		if err := mustGet(t, c, e.Index).Verify(e.Key, e.Value, c.Hash()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPADWithNodeArena(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10, WithTreeOptions(WithNodeArena(8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for _, e := range batchEntries(50, 50*i, valuePrefix) {
+			if err := pad.Set(e.Key, e.Value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pad.Update(nil)
+	}
+	if err := pad.reshuffle(); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	for _, e := range batchEntries(150, 0, valuePrefix) {
+		ap, err := pad.Lookup(e.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ap.Verify(e.Key, e.Value, pad.LatestSTR().TreeHash[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// benchGC runs f b.N times, and reports the time the garbage collector
+// stopped the world for per run.
+func benchGC(b *testing.B, f func()) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gcs/op")
+}
+
+func benchBulkLoad(b *testing.B, opts ...TreeOption) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := m.SetBatch(batchEntries(100000, 0, valuePrefix)); err != nil {
+		b.Fatal(err)
+	}
+	leaves, _ := sortedLeaves(m, true)
+	benchGC(b, func() {
+		j := 0
+		if _, err := NewMerkleTreeFromSorted(MinIndexSize, m.nonce, func() (Leaf, error) {
+			if j == len(leaves) {
+				return Leaf{}, io.EOF
+			}
+			j++
+			return leaves[j-1], nil
+		}, opts...); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkBulkLoad100K(b *testing.B)      { benchBulkLoad(b) }
+func BenchmarkBulkLoad100KArena(b *testing.B) { benchBulkLoad(b, WithNodeArena(0)) }
+
+func benchEpochUpdate(b *testing.B, opts ...TreeOption) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := m.SetBatch(batchEntries(100000, 0, valuePrefix)); err != nil {
+		b.Fatal(err)
+	}
+	updates := batchEntries(10000, 95000, []byte("new value"))
+	benchGC(b, func() {
+		// a snapshot, and the bindings of the next epoch
+		m.Clone()
+		if err := m.SetBatch(updates); err != nil {
+			b.Fatal(err)
+		}
+		m.Hash()
+	})
+}
+
+func BenchmarkEpochUpdate100K(b *testing.B)      { benchEpochUpdate(b) }
+func BenchmarkEpochUpdate100KArena(b *testing.B) { benchEpochUpdate(b, WithNodeArena(0)) }
@@ -0,0 +1,110 @@
+package merkletree
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// ErrUnknownAssocData indicates that the associated data of an STR is of
+// a type that isn't registered with RegisterAssocData.
+var ErrUnknownAssocData = errors.New("[merkletree] Unknown type of associated data")
+
+// An AssocDataDecoder parses the JSON encoding of the associated data of
+// an STR, e.g. into a *directory.Config. Stores that serialize STRs need
+// one, since the associated data isn't part of an STR's own encoding.
+type AssocDataDecoder func(data []byte) (AssocData, error)
+
+// A TypedAssocData is AssocData of a type registered with
+// RegisterAssocData, which it identifies itself by, so that the STRs
+// carrying it can be serialized with MarshalSTR and fully reconstructed
+// by anybody who receives them.
+type TypedAssocData interface {
+	AssocData
+	// AssocDataType returns the ID the type is registered under.
+	AssocDataType() string
+}
+
+// assocDataTypes maps the registered type IDs to their decoders.
+var assocDataTypes = struct {
+	sync.RWMutex
+	decoders map[string]AssocDataDecoder
+}{decoders: make(map[string]AssocDataDecoder)}
+
+// RegisterAssocData registers decode as the decoder of the associated
+// data of type typeID, usually in the init function of the package that
+// implements the type. Type IDs should be qualified with the package,
+// e.g. "coniks.directory.Config". Like database/sql.Register, it panics
+// if decode is nil or typeID is already registered.
+func RegisterAssocData(typeID string, decode AssocDataDecoder) {
+	if decode == nil {
+		panic("[merkletree] RegisterAssocData with a nil decoder for " + typeID)
+	}
+	assocDataTypes.Lock()
+	defer assocDataTypes.Unlock()
+	if _, ok := assocDataTypes.decoders[typeID]; ok {
+		panic("[merkletree] RegisterAssocData called twice for " + typeID)
+	}
+	assocDataTypes.decoders[typeID] = decode
+}
+
+// DecodeAssocData parses data, the JSON encoding of associated data of
+// type typeID, with the decoder registered for the type. It returns
+// ErrUnknownAssocData if the type isn't registered.
+func DecodeAssocData(typeID string, data []byte) (AssocData, error) {
+	assocDataTypes.RLock()
+	decode, ok := assocDataTypes.decoders[typeID]
+	assocDataTypes.RUnlock()
+	if !ok {
+		return nil, ErrUnknownAssocData
+	}
+	return decode(data)
+}
+
+// typedSTR is the encoding of MarshalSTR: the STR, and its associated
+// data tagged with its type.
+type typedSTR struct {
+	STR    *SignedTreeRoot
+	AdType string          `json:",omitempty"`
+	Ad     json.RawMessage `json:",omitempty"`
+}
+
+// MarshalSTR serializes str as JSON along with its associated data, which
+// must be nil or a TypedAssocData, so that UnmarshalSTR can reconstruct
+// it, and the signature of str can be verified again. It returns
+// ErrUnknownAssocData for any other associated data.
+func MarshalSTR(str *SignedTreeRoot) ([]byte, error) {
+	enc := typedSTR{STR: str}
+	if str.Ad != nil {
+		ad, ok := str.Ad.(TypedAssocData)
+		if !ok {
+			return nil, ErrUnknownAssocData
+		}
+		var err error
+		if enc.Ad, err = json.Marshal(ad); err != nil {
+			return nil, err
+		}
+		enc.AdType = ad.AssocDataType()
+	}
+	return json.Marshal(enc)
+}
+
+// UnmarshalSTR decodes an STR serialized with MarshalSTR, parsing its
+// associated data with the decoder registered for its type. It returns
+// ErrMalformedSTR if data isn't such an encoding, ErrUnknownAssocData if
+// the type of the associated data isn't registered, and otherwise the
+// error of the decoder.
+func UnmarshalSTR(data []byte) (*SignedTreeRoot, error) {
+	var enc typedSTR
+	if err := json.Unmarshal(data, &enc); err != nil || enc.STR == nil ||
+		(enc.AdType == "") != (enc.Ad == nil) {
+		return nil, ErrMalformedSTR
+	}
+	if enc.AdType != "" {
+		var err error
+		if enc.STR.Ad, err = DecodeAssocData(enc.AdType, enc.Ad); err != nil {
+			return nil, err
+		}
+	}
+	return enc.STR, nil
+}
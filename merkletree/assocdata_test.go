@@ -0,0 +1,129 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// typedTestAd is a TypedAssocData registered under typedTestAdType.
+type typedTestAd struct {
+	Data string
+}
+
+const typedTestAdType = "coniks.merkletree.typedTestAd"
+
+func (t *typedTestAd) Bytes() []byte {
+	return []byte(t.Data)
+}
+
+func (t *typedTestAd) AssocDataType() string {
+	return typedTestAdType
+}
+
+func init() {
+	RegisterAssocData(typedTestAdType, func(data []byte) (AssocData, error) {
+		var ad typedTestAd
+		if err := json.Unmarshal(data, &ad); err != nil {
+			return nil, err
+		}
+		return &ad, nil
+	})
+}
+
+func TestMarshalSTRTypedAssocData(t *testing.T) {
+	pad, err := NewPAD(&typedTestAd{"policies"}, staticSigningKey, staticVRFKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	enc, err := MarshalSTR(pad.LatestSTR())
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, err := UnmarshalSTR(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad, ok := str.Ad.(*typedTestAd)
+	if !ok || ad.Data != "policies" {
+		t.Fatal("Expect the associated data to be decoded, got", str.Ad)
+	}
+	if !bytes.Equal(str.Bytes(), pad.LatestSTR().Bytes()) {
+		t.Error("Expect the decoded STR to serialize like the original")
+	}
+	if !staticSigningKey.Public().Verify(str.Bytes(), str.Signature[:]) {
+		t.Error("Expect the signature of the decoded STR to verify")
+	}
+	if !str.VerifyHashChain(pad.GetSTR(0)) {
+		t.Error("Expect the decoded STR to keep its hash chain")
+	}
+}
+
+func TestMarshalSTRUnknownAssocData(t *testing.T) {
+	pad, err := NewPAD(TestAd{"abc"}, staticSigningKey, staticVRFKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MarshalSTR(pad.LatestSTR()); err != ErrUnknownAssocData {
+		t.Error("Expect", ErrUnknownAssocData, "got", err)
+	}
+
+	enc, err := json.Marshal(typedSTR{
+		STR:    pad.LatestSTR(),
+		AdType: "coniks.merkletree.unregistered",
+		Ad:     json.RawMessage(`{}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalSTR(enc); err != ErrUnknownAssocData {
+		t.Error("Expect", ErrUnknownAssocData, "got", err)
+	}
+}
+
+func TestMarshalSTRNoAssocData(t *testing.T) {
+	pad, err := NewPAD(TestAd{"abc"}, staticSigningKey, staticVRFKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := *pad.LatestSTR()
+	bare.Ad = nil
+	enc, err := MarshalSTR(&bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, err := UnmarshalSTR(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str.Ad != nil || str.Epoch != 0 {
+		t.Error("Expect the genesis STR without associated data, got", str)
+	}
+	if str.TreeHash != bare.TreeHash {
+		t.Error("Expect", bare.TreeHash, "got", str.TreeHash)
+	}
+}
+
+func TestUnmarshalSTRMalformed(t *testing.T) {
+	for _, data := range []string{
+		``,
+		`[]`,
+		`{}`,
+		`{"STR":{},"AdType":"` + typedTestAdType + `"}`,
+		`{"STR":{},"Ad":{}}`,
+	} {
+		if _, err := UnmarshalSTR([]byte(data)); err != ErrMalformedSTR {
+			t.Error("Expect", ErrMalformedSTR, "for", data, "got", err)
+		}
+	}
+}
+
+func TestRegisterAssocDataTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expect registering a type twice to panic")
+		}
+	}()
+	RegisterAssocData(typedTestAdType, func([]byte) (AssocData, error) { return nil, nil })
+}
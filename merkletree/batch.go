@@ -0,0 +1,251 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/ORBAT/cloniks/conv"
+)
+
+// An Entry is a key/value binding to be set at Index with SetBatch.
+type Entry struct {
+	Index Index
+	Key   []byte
+	Value []byte
+}
+
+// SetBatch inserts or updates the bindings of entries, which is faster
+// than calling Set for each of them: the entries are sorted by index, so
+// that every node on their paths is visited and marked dirty only once,
+// and a commitment is generated only for the last entry for each index.
+// The resulting tree is the same as after calling Set for each entry in
+// order, so a later entry for an index replaces an earlier one, and the
+// leaves record the same epochs.
+//
+// SetBatch returns ErrIndexLength or ErrIndexCollision like Set does.
+// m isn't modified if any of the entries is invalid. It returns an error
+// wrapping ErrNodeLoad if a node on the path of an entry can't be loaded
+// from m's NodeStore, in which case only some of the entries may have
+// been inserted.
+func (m *MerkleTree) SetBatch(entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	leaves := make([]*userLeafNode, 0, len(entries))
+	// the leaves the new ones replace, if any
+	existing := make([]*userLeafNode, 0, len(entries))
+	byIndex := make(map[string]int, len(entries))
+	for _, e := range entries {
+		if err := e.Index.Validate(m.indexSize); err != nil {
+			return err
+		}
+		if i, ok := byIndex[string(e.Index)]; ok {
+			if !bytes.Equal(leaves[i].key, e.Key) {
+				return ErrIndexCollision
+			}
+			leaves[i].value = e.Value
+			continue
+		}
+		old, err := m.leafAt(e.Index)
+		if err != nil {
+			return err
+		}
+		if old != nil && !bytes.Equal(old.key, e.Key) {
+			return ErrIndexCollision
+		}
+		byIndex[string(e.Index)] = len(leaves)
+		existing = append(existing, old)
+		leaf := m.arena.leaf()
+		*leaf = userLeafNode{
+			node:  node{gen: m.gen},
+			key:   e.Key,
+			value: e.Value,
+			index: e.Index,
+		}
+		leaves = append(leaves, leaf)
+	}
+	for i, leaf := range leaves {
+		leaf.key = copyOfBs(leaf.key)
+		leaf.value = copyOfBs(leaf.value)
+		leaf.commitment = newCommit(m.rand, leaf.key, leaf.value)
+		m.stamp(leaf, existing[i])
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		return bytes.Compare(leaves[i].index, leaves[j].index) < 0
+	})
+	if len(leaves) > 0 {
+		m.ownRoot()
+		root, err := m.insertBatch(m.root, 0, leaves)
+		m.root = root.(*interiorNode)
+		return err
+	}
+	return nil
+}
+
+// leafAt returns the user leaf node at index, or nil if there is none,
+// or the error of loading a node on the path of index.
+func (m *MerkleTree) leafAt(index []byte) (*userLeafNode, error) {
+	var nodePointer merkleNode = m.root
+	for depth := uint32(0); ; depth++ {
+		switch n := nodePointer.(type) {
+		case *interiorNode:
+			child, err := m.childOf(n, conv.GetNthBit(index, depth))
+			if err != nil {
+				return nil, err
+			}
+			nodePointer = child
+		case *userLeafNode:
+			if bytes.Equal(n.index, index) {
+				return n, nil
+			}
+			return nil, nil
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// insertBatch inserts leaves, which are sorted by index and all belong
+// below nodePointer, into the subtree rooted at nodePointer, which is at
+// level. It returns the new root of the subtree, which is a copy of
+// nodePointer if m may not modify it. If a node can't be loaded, it
+// returns the error along with the subtree holding the leaves inserted
+// so far, which is still valid.
+func (m *MerkleTree) insertBatch(nodePointer merkleNode, level uint32,
+	leaves []*userLeafNode) (merkleNode, error) {
+	switch n := nodePointer.(type) {
+	case *interiorNode:
+		n = m.ownInterior(n)
+		// the leaves going left come first, since they're sorted
+		split := sort.Search(len(leaves), func(i int) bool {
+			return conv.GetNthBit(leaves[i].index, level)
+		})
+		for _, right := range []bool{false, true} {
+			part := leaves[:split]
+			if right {
+				part = leaves[split:]
+			}
+			if len(part) == 0 {
+				continue
+			}
+			child, err := m.childOf(n, right)
+			if err != nil {
+				return n, err
+			}
+			child, err = m.insertBatch(child, level+1, part)
+			m.setChild(n, right, child)
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	case *userLeafNode:
+		i := sort.Search(len(leaves), func(i int) bool {
+			return bytes.Compare(leaves[i].index, n.index) >= 0
+		})
+		if i == len(leaves) || !bytes.Equal(leaves[i].index, n.index) {
+			// push the existing leaf down along with the new ones
+			leaves = append(leaves[:i:i], append([]*userLeafNode{m.ownLeaf(n)}, leaves[i:]...)...)
+		} else {
+			// the existing leaf is replaced
+			m.drop(n)
+		}
+		return m.placeLeaves(level, leaves)
+	case *emptyNode:
+		m.drop(n)
+		return m.placeLeaves(level, leaves)
+	default:
+		panic(ErrInvalidTree)
+	}
+}
+
+// placeLeaves builds the subtree at level for leaves, which are sorted
+// by index, in place of an empty node. Its nodes are all new, so
+// nothing is loaded, but the error of insertBatch is passed on.
+func (m *MerkleTree) placeLeaves(level uint32, leaves []*userLeafNode) (merkleNode, error) {
+	if len(leaves) == 1 {
+		leaves[0].level = level
+		return leaves[0], nil
+	}
+	return m.insertBatch(m.newInteriorNode(level, leaves[0].index), level, leaves)
+}
+
+// SetBatch computes the private indices of the keys of entries, and sets
+// their bindings with MerkleTree.SetBatch. The Index of the entries is
+// ignored. Like Set, it ensures that the bindings will be included in
+// the next PAD snapshot. The batch is atomic: if any entry is invalid,
+// none of them is set. Only a NodeStore failure can leave it partially
+// applied, like MerkleTree.SetBatch. The indices are computed in bulk, in parallel if
+// the PAD was created WithIndexWorkers, which makes SetBatch the faster
+// way to set many bindings at once, e.g. when registration volume is
+// high.
+func (pad *PAD) SetBatch(entries []Entry) error {
+	indexed := make([]Entry, len(entries))
+	pad.forEachWorker(len(entries), func(i int) {
+		e := entries[i]
+		index, _ := pad.computePrivateIndex(e.Key)
+		indexed[i] = Entry{Index: index, Key: e.Key, Value: e.Value}
+	})
+	if err := pad.tree.SetBatch(indexed); err != nil {
+		return err
+	}
+	pad.insertions += uint64(len(entries))
+	return nil
+}
+
+// SetBindings is SetBatch for the bindings of the keys of bindings to
+// their values. The bindings are set in the order of their keys, so that
+// its result doesn't depend on the map's iteration order.
+func (pad *PAD) SetBindings(bindings map[string][]byte) error {
+	keys := make([]string, 0, len(bindings))
+	for key := range bindings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = Entry{Key: []byte(key), Value: bindings[key]}
+	}
+	return pad.SetBatch(entries)
+}
+
+// WithIndexWorkers makes SetBatch compute the private indices with up to
+// n goroutines, which speeds up large batches when computing an index is
+// expensive, as it is with a VRF. The PAD's Indexer must then be safe for
+// concurrent use, as VRFIndexer and HashIndexer are. With n <= 1, the
+// indices are computed sequentially, which is the default.
+func WithIndexWorkers(n int) PADOption {
+	return func(pad *PAD) error {
+		pad.indexWorkers = n
+		return nil
+	}
+}
+
+// forEachWorker calls f(i) for every i in [0, n), using up to
+// pad.indexWorkers goroutines, and waits for all of the calls to return.
+func (pad *PAD) forEachWorker(n int, f func(i int)) {
+	workers := pad.indexWorkers
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				f(i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,216 @@
+package merkletree
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// batchEntries returns n entries with keys and indices derived from
+// [from, from+n).
+func batchEntries(n, from int, value []byte) []Entry {
+	entries := make([]Entry, n)
+	for i := range entries {
+		key := conv.UInt32ToBytes(uint32(from + i))
+		entries[i] = Entry{Index: hashed.Digest(key)[:MinIndexSize], Key: key, Value: value}
+	}
+	return entries
+}
+
+func dump(t *testing.T, m *MerkleTree) string {
+	t.Helper()
+	var sb strings.Builder
+	if err := m.Dump(&sb); err != nil {
+		t.Fatal(err)
+	}
+	return sb.String()
+}
+
+func TestSetBatchMatchesSet(t *testing.T) {
+	batched, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequential := mustClone(t, batched)
+	existing := batchEntries(100, 0, []byte("old"))
+	for _, e := range existing {
+		if err := batched.Set(e.Index, e.Key, e.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// updates of existing bindings, new bindings, and a binding that's
+	// set twice in the batch
+	entries := append(batchEntries(300, 50, []byte("new")), Entry{existing[60].Index, existing[60].Key, []byte("newer")})
+	if err := batched.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range append(existing, entries...) {
+		if err := sequential.Set(e.Index, e.Key, e.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the salts of the commitments are random
+	var leaves int
+	batched.visitLeafNodes(func(n *userLeafNode) {
+		leaves++
+		seq := mustLeafAt(t, sequential, n.index)
+		if seq == nil || !bytes.Equal(seq.value, n.value) {
+			t.Fatalf("Expect the leaf %x in both trees", n.index)
+		}
+		seq.commitment = n.commitment
+	})
+	if leaves != 350 {
+		t.Error("Expect 350 leaves, got", leaves)
+	}
+	batched.recomputeHash()
+	sequential.recomputeHash()
+	if !bytes.Equal(batched.hash, sequential.hash) {
+		t.Error("Expect the same root hash")
+	}
+	if batchedDump, seqDump := dump(t, batched), dump(t, sequential); batchedDump != seqDump {
+		t.Errorf("Expect the same tree, got\n%s\nand\n%s", batchedDump, seqDump)
+	}
+	if leaf := mustLeafAt(t, batched, existing[60].Index); !bytes.Equal(leaf.value, []byte("newer")) {
+		t.Errorf("Expect the last value for a key, got %q", leaf.value)
+	}
+	for _, e := range entries[:10] {
+		ap := mustGet(t, batched, e.Index)
+		if err := ap.Verify(e.Key, ap.Leaf.Value, batched.hash); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSetBatchErrors(t *testing.T) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := batchEntries(10, 0, valuePrefix)
+	if err := m.SetBatch(existing); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	before := dump(t, m)
+
+	fresh := batchEntries(10, 10, valuePrefix)
+	for _, tc := range []struct {
+		name  string
+		entry Entry
+		want  error
+	}{
+		{"index length", Entry{Index: []byte("short"), Key: []byte("key")}, ErrIndexLength},
+		{"collision in tree", Entry{Index: existing[3].Index, Key: []byte("other")}, ErrIndexCollision},
+		{"collision in batch", Entry{Index: fresh[3].Index, Key: []byte("other")}, ErrIndexCollision},
+	} {
+		if err := m.SetBatch(append(fresh[:len(fresh):len(fresh)], tc.entry)); err != tc.want {
+			t.Error(tc.name, "expect", tc.want, "got", err)
+		}
+		m.recomputeHash()
+		if after := dump(t, m); after != before {
+			t.Error(tc.name, "expect the tree to be unchanged")
+		}
+	}
+}
+
+func TestPADSetBatch(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{{Key: []byte("alice"), Value: []byte("a")}, {Key: []byte("bob"), Value: []byte("b")}}
+	if err := pad.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	for _, e := range entries {
+		ap, err := pad.Lookup(e.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ap.Verify(e.Key, e.Value, pad.LatestSTR().TreeHash[:]); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPADSetBatchParallel(t *testing.T) {
+	bindings := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		bindings[keyPrefix+strconv.Itoa(i)] = append([]byte(string(valuePrefix)), byte(i))
+	}
+	for _, workers := range []int{0, 1, 4, 500} {
+		pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10, WithIndexWorkers(workers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pad.SetBindings(bindings); err != nil {
+			t.Fatal(err)
+		}
+		if pad.Insertions() != uint64(len(bindings)) {
+			t.Fatal("Expect", len(bindings), "insertions, got", pad.Insertions())
+		}
+		pad.Update(nil)
+		// Lookup computes the indices one by one
+		for key, value := range bindings {
+			ap, err := pad.Lookup([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ap.ProofType() != ProofOfInclusion {
+				t.Fatal(workers, "workers: expect", key, "to be included")
+			}
+			if err := ap.Verify([]byte(key), value, pad.LatestSTR().TreeHash[:]); err != nil {
+				t.Fatal(workers, "workers:", err)
+			}
+		}
+	}
+}
+
+func BenchmarkPADSetBatch1000(b *testing.B) {
+	entries := batchEntries(1000, 0, valuePrefix)
+	for _, workers := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 1, WithIndexWorkers(workers))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := pad.SetBatch(entries); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTreeSet1000(b *testing.B) {
+	entries := batchEntries(1000, 0, valuePrefix)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m, _ := NewMerkleTreeWithIndexSize(MinIndexSize)
+		for _, e := range entries {
+			if err := m.Set(e.Index, e.Key, e.Value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkTreeSetBatch1000(b *testing.B) {
+	entries := batchEntries(1000, 0, valuePrefix)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m, _ := NewMerkleTreeWithIndexSize(MinIndexSize)
+		if err := m.SetBatch(entries); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+var (
+	// ErrUnsortedLeaves indicates that the leaves given to
+	// NewMerkleTreeFromSorted aren't sorted by index, or that an index
+	// appears twice.
+	ErrUnsortedLeaves = errors.New("[merkletree] Leaves are not sorted by index")
+)
+
+// A Leaf is a user leaf node for NewMerkleTreeFromSorted. Only the
+// index and the commitment are needed to compute the tree's hash, so
+// Key and Value may be nil, e.g. when bootstrapping a replica from
+// another tree's commitments. The tree can then serve proofs of absence,
+// but its proofs of inclusion lack the value. AddedEpoch and
+// ChangedEpoch are the epochs the leaf records; see ProofNode.
+type Leaf struct {
+	Index        Index
+	Commitment   hashed.Commit
+	Key          []byte
+	Value        []byte
+	AddedEpoch   Epoch
+	ChangedEpoch Epoch
+}
+
+// NewMerkleTreeFromSorted builds a Merkle prefix tree bottom-up from the
+// leaves returned by next, which must be sorted by index and returns
+// io.EOF after the last leaf. This is much faster than inserting the
+// leaves one by one, and the leaves don't need to be in memory all at
+// once. The tree is the same as if the leaves had been inserted into an
+// empty tree, and its hash is computed as it's built.
+//
+// The tree accepts indices of indexSize bytes, and uses the given nonce,
+// so that a tree with the same leaves and nonce has the same hash. If
+// nonce is nil, a secure random nonce is generated. The tree has the
+// optional parameters opts.
+// NewMerkleTreeFromSorted returns ErrInvalidIndexSize if indexSize is
+// not in [MinIndexSize, DefaultIndexSize], ErrIndexLength if an index
+// isn't indexSize bytes long, ErrUnsortedLeaves if the indices aren't
+// strictly increasing, and any other error returned by next.
+func NewMerkleTreeFromSorted(indexSize int, nonce []byte,
+	next func() (Leaf, error), opts ...TreeOption) (*MerkleTree, error) {
+	m, err := NewMerkleTreeWithIndexSize(indexSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if nonce != nil {
+		m.nonce = copyOfBs(nonce)
+	}
+	s := &leafStream{next: next, indexSize: indexSize}
+	left, err := buildSubtree(m, s, 1, childPrefix(nil, 0, false))
+	if err != nil {
+		return nil, err
+	}
+	right, err := buildSubtree(m, s, 1, childPrefix(nil, 0, true))
+	if err != nil {
+		return nil, err
+	}
+	m.root.leftChild, m.root.rightChild = left, right
+	m.root.leftHash, m.root.rightHash = left.hash(m), right.hash(m)
+	m.root.setShape(m)
+	m.forget(m.root)
+	m.hash = hashed.Digest(m.root.leftHash, m.root.rightHash)
+	return m, nil
+}
+
+// A KV is a binding of Key to Value at the lookup Index for Build.
+type KV = Entry
+
+// Build builds a Merkle prefix tree bottom-up from pairs, which must be
+// sorted by index, e.g. to import the users of a directory. It's much
+// faster than setting the bindings one by one or with SetBatch, since
+// every node is created once and its hash computed once, as it's built.
+// The tree is the same as if the bindings had been set in an empty tree,
+// with new commitments, in its first epoch, and its hash is computed.
+// The indices must all have the same size, which becomes the index size
+// of the tree, or DefaultIndexSize if pairs is empty; the tree has
+// a secure random nonce and the optional parameters opts.
+// Build returns ErrInvalidIndexSize if the index size isn't in
+// [MinIndexSize, DefaultIndexSize], ErrIndexLength if an index has
+// another size, and ErrUnsortedLeaves if the indices aren't strictly
+// increasing. See NewMerkleTreeFromSorted for leaves with commitments.
+func Build(pairs []KV, opts ...TreeOption) (*MerkleTree, error) {
+	indexSize := DefaultIndexSize
+	if len(pairs) > 0 {
+		indexSize = len(pairs[0].Index)
+	}
+	i := 0
+	rnd := randomness(opts)
+	return NewMerkleTreeFromSorted(indexSize, nil, func() (Leaf, error) {
+		if i == len(pairs) {
+			return Leaf{}, io.EOF
+		}
+		kv := &pairs[i]
+		i++
+		return Leaf{
+			Index:      kv.Index,
+			Commitment: newCommit(rnd, kv.Key, kv.Value),
+			Key:        kv.Key,
+			Value:      kv.Value,
+		}, nil
+	}, opts...)
+}
+
+// buildSubtree builds the subtree of m at level for the leaves of s
+// whose first level bits are those of prefix. The leaves of the subtree
+// are the next ones in s, since s is sorted.
+func buildSubtree(m *MerkleTree, s *leafStream, level uint32,
+	prefix []byte) (merkleNode, error) {
+	first, err := s.peek(0)
+	if err != nil {
+		return nil, err
+	}
+	if first == nil || !hasPrefix(first.Index, prefix, level) {
+		n := m.arena.empty()
+		*n = emptyNode{node: node{gen: m.gen, level: level}, index: prefix}
+		return n, nil
+	}
+	second, err := s.peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if second == nil || !hasPrefix(second.Index, prefix, level) {
+		leaf, n := s.pop(), m.arena.leaf()
+		*n = userLeafNode{
+			node:         node{gen: m.gen, level: level},
+			key:          leaf.Key,
+			value:        leaf.Value,
+			index:        leaf.Index,
+			commitment:   leaf.Commitment,
+			addedEpoch:   leaf.AddedEpoch,
+			changedEpoch: leaf.ChangedEpoch,
+		}
+		return n, nil
+	}
+
+	// first is invalidated by building the left subtree
+	index := first.Index
+	n := m.arena.interior()
+	n.node = node{gen: m.gen, level: level}
+	if n.leftChild, err = buildSubtree(m, s, level+1, childPrefix(index, level, false)); err != nil {
+		return nil, err
+	}
+	if n.rightChild, err = buildSubtree(m, s, level+1, childPrefix(index, level, true)); err != nil {
+		return nil, err
+	}
+	n.leftHash, n.rightHash = n.leftChild.hash(m), n.rightChild.hash(m)
+	n.setShape(m)
+	return n, nil
+}
+
+// hasPrefix returns true iff the first bits bits of index and prefix are
+// the same.
+func hasPrefix(index, prefix []byte, bits uint32) bool {
+	whole := bits / 8
+	if !bytes.Equal(index[:whole], prefix[:whole]) {
+		return false
+	}
+	for i := whole * 8; i < bits; i++ {
+		if conv.GetNthBit(index, i) != conv.GetNthBit(prefix, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// A leafStream buffers the leaves returned by next, so that they can be
+// peeked at, and checks that they're sorted.
+type leafStream struct {
+	next      func() (Leaf, error)
+	indexSize int
+	buf       []Leaf
+	last      []byte // index of the last leaf read from next
+	eof       bool
+}
+
+// peek returns the i+1th next leaf without removing it, or nil if there
+// are no more leaves. The returned pointer is only valid until the next
+// call to pop.
+func (s *leafStream) peek(i int) (*Leaf, error) {
+	for len(s.buf) <= i && !s.eof {
+		leaf, err := s.next()
+		if err == io.EOF {
+			s.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := leaf.Index.Validate(s.indexSize); err != nil {
+			return nil, err
+		}
+		if s.last != nil && bytes.Compare(s.last, leaf.Index) >= 0 {
+			return nil, ErrUnsortedLeaves
+		}
+		// next may reuse its buffers
+		leaf.Index = copyOfBs(leaf.Index)
+		leaf.Key = copyOfBs(leaf.Key)
+		leaf.Value = copyOfBs(leaf.Value)
+		leaf.Commitment.Salt = copyOfBs(leaf.Commitment.Salt)
+		leaf.Commitment.Hash = copyOfBs(leaf.Commitment.Hash)
+		s.last = leaf.Index
+		s.buf = append(s.buf, leaf)
+	}
+	if len(s.buf) <= i {
+		return nil, nil
+	}
+	return &s.buf[i], nil
+}
+
+// pop removes the next leaf, which must have been peeked at.
+func (s *leafStream) pop() Leaf {
+	leaf := s.buf[0]
+	s.buf = append(s.buf[:0], s.buf[1:]...)
+	return leaf
+}
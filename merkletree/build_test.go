@@ -0,0 +1,219 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"testing"
+)
+
+// sortedLeaves returns the leaves of m in index order, and a function
+// returning them one by one.
+func sortedLeaves(m *MerkleTree, withValues bool) ([]Leaf, func() (Leaf, error)) {
+	var leaves []Leaf
+	m.visitLeafNodes(func(n *userLeafNode) {
+		leaf := Leaf{Index: n.index, Commitment: n.commitment}
+		if withValues {
+			leaf.Key, leaf.Value = n.key, n.value
+		}
+		leaves = append(leaves, leaf)
+	})
+	sort.Slice(leaves, func(i, j int) bool { return bytes.Compare(leaves[i].Index, leaves[j].Index) < 0 })
+	i := 0
+	return leaves, func() (Leaf, error) {
+		if i == len(leaves) {
+			return Leaf{}, io.EOF
+		}
+		i++
+		return leaves[i-1], nil
+	}
+}
+
+func TestNewMerkleTreeFromSorted(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 500} {
+		want, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := want.SetBatch(batchEntries(n, 0, valuePrefix)); err != nil {
+			t.Fatal(err)
+		}
+		want.recomputeHash()
+
+		_, next := sortedLeaves(want, true)
+		got, err := NewMerkleTreeFromSorted(MinIndexSize, want.nonce, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.hash, want.hash) {
+			t.Fatal(n, "leaves: expect the same root hash")
+		}
+		// the hashes are computed while building
+		got.recomputeHash()
+		if !bytes.Equal(got.hash, want.hash) {
+			t.Fatal(n, "leaves: expect the same root hash after recomputing")
+		}
+		if gotDump, wantDump := dump(t, got), dump(t, want); gotDump != wantDump {
+			t.Fatalf("%d leaves: expect the same tree, got\n%s\nwant\n%s", n, gotDump, wantDump)
+		}
+		if n == 0 {
+			continue
+		}
+		e := batchEntries(1, n-1, valuePrefix)[0]
+		if err := mustGet(t, got, e.Index).Verify(e.Key, e.Value, want.hash); err != nil {
+			t.Error(err)
+		}
+		// the built tree can be updated as usual
+		if err := got.Set(batchEntries(1, n, nil)[0].Index, []byte("new"), valuePrefix); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestNewMerkleTreeFromSortedCommitmentsOnly(t *testing.T) {
+	want, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := want.SetBatch(batchEntries(50, 0, valuePrefix)); err != nil {
+		t.Fatal(err)
+	}
+	want.recomputeHash()
+	_, next := sortedLeaves(want, false)
+	got, err := NewMerkleTreeFromSorted(MinIndexSize, want.nonce, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.hash, want.hash) {
+		t.Fatal("Expect the same root hash")
+	}
+	absent := batchEntries(1, 1000, nil)[0]
+	if err := mustGet(t, got, absent.Index).Verify(absent.Key, nil, want.hash); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewMerkleTreeFromSortedErrors(t *testing.T) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetBatch(batchEntries(10, 0, valuePrefix)); err != nil {
+		t.Fatal(err)
+	}
+	leaves, _ := sortedLeaves(m, true)
+	failure := errors.New("read failure")
+	for _, tc := range []struct {
+		name   string
+		leaves []Leaf
+		err    error
+		want   error
+	}{
+		{"unsorted", []Leaf{leaves[1], leaves[0]}, nil, ErrUnsortedLeaves},
+		{"duplicate", []Leaf{leaves[0], leaves[0]}, nil, ErrUnsortedLeaves},
+		{"index length", []Leaf{{Index: []byte("short")}}, nil, ErrIndexLength},
+		{"read error", leaves[:2], failure, failure},
+	} {
+		i := 0
+		_, err := NewMerkleTreeFromSorted(MinIndexSize, nil, func() (Leaf, error) {
+			if i == len(tc.leaves) {
+				if tc.err != nil {
+					return Leaf{}, tc.err
+				}
+				return Leaf{}, io.EOF
+			}
+			i++
+			return tc.leaves[i-1], nil
+		})
+		if err != tc.want {
+			t.Error(tc.name, "expect", tc.want, "got", err)
+		}
+	}
+	if _, err := NewMerkleTreeFromSorted(1, nil, nil); err != ErrInvalidIndexSize {
+		t.Error("Expect", ErrInvalidIndexSize, "got", err)
+	}
+}
+
+// sortedEntries returns n entries sorted by index.
+func sortedEntries(n int) []KV {
+	pairs := batchEntries(n, 0, valuePrefix)
+	sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i].Index, pairs[j].Index) < 0 })
+	return pairs
+}
+
+func TestBuild(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 500} {
+		pairs := sortedEntries(n)
+		m, err := Build(pairs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.CheckInvariants(); err != nil {
+			t.Fatal(n, "pairs:", err)
+		}
+		set, err := NewMerkleTreeWithIndexSize(m.IndexSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := set.SetBatch(pairs); err != nil {
+			t.Fatal(err)
+		}
+		got, want := treeStats(t, m), treeStats(t, set)
+		if got.Leaves != want.Leaves || got.Nodes != want.Nodes || got.MaxDepth != want.MaxDepth {
+			t.Fatal(n, "pairs: expect the shape", want, "got", got)
+		}
+		for _, kv := range pairs {
+			ap := mustGet(t, m, kv.Index)
+			if err := ap.Verify(kv.Key, kv.Value, m.Hash()); err != nil {
+				t.Fatal(n, "pairs: expect the binding of", kv.Key, "to verify, got", err)
+			}
+		}
+		if n == 0 && m.IndexSize() != DefaultIndexSize {
+			t.Error("Expect an empty tree with the default index size, got", m.IndexSize())
+		}
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	pairs := sortedEntries(3)
+	for _, tc := range []struct {
+		name  string
+		pairs []KV
+		want  error
+	}{
+		{"unsorted", []KV{pairs[1], pairs[0]}, ErrUnsortedLeaves},
+		{"duplicate", []KV{pairs[0], pairs[0]}, ErrUnsortedLeaves},
+		{"short index", []KV{{Index: pairs[0].Index[:1]}}, ErrInvalidIndexSize},
+		{"mixed index sizes", []KV{pairs[0], {Index: append(pairs[1].Index, 0)}}, ErrIndexLength},
+	} {
+		if _, err := Build(tc.pairs); err != tc.want {
+			t.Error(tc.name, "expect", tc.want, "got", err)
+		}
+	}
+}
+
+func BenchmarkNewMerkleTreeFromSorted1000(b *testing.B) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := m.SetBatch(batchEntries(1000, 0, valuePrefix)); err != nil {
+		b.Fatal(err)
+	}
+	leaves, _ := sortedLeaves(m, true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := 0
+		if _, err := NewMerkleTreeFromSorted(MinIndexSize, m.nonce, func() (Leaf, error) {
+			if j == len(leaves) {
+				return Leaf{}, io.EOF
+			}
+			j++
+			return leaves[j-1], nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
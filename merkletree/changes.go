@@ -0,0 +1,96 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import "bytes"
+
+// A ChangeKind tells how a binding changed between two trees.
+type ChangeKind int
+
+const (
+	// Added bindings are only in the later tree.
+	Added ChangeKind = iota
+	// Modified bindings are in both trees with different keys or values.
+	Modified
+	// Removed bindings are only in the earlier tree.
+	Removed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Removed:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// A Change is a binding that differs between two trees. Old is its leaf
+// in the earlier tree, and is nil if it was Added; New its leaf in the
+// later tree, and is nil if it was Removed.
+type Change struct {
+	Kind     ChangeKind
+	Index    Index
+	Old, New *Leaf
+}
+
+// Changes returns the bindings that were added, modified or removed
+// between the trees a and b, sorted by index. Like Diff, it skips the
+// subtrees whose hashes are the same in both trees, so comparing the
+// trees of consecutive snapshots only visits the paths to the leaves
+// that changed; trees with different nonces share no hashes, and are
+// compared in full. A binding that was set again to the same key and
+// value only has a new commitment, and isn't a change. Neither tree is
+// modified, so they must not be stale. The leaves of the changes share
+// their bytes with the trees, and must not be modified.
+func Changes(a, b *MerkleTree) []Change {
+	defer rlockTrees(a, b)()
+	var changes []Change
+	diffNodes(a, a.root, a.hash, b, b.root, b.hash, func(old, new *userLeafNode) {
+		switch {
+		case old == nil:
+			l := new.leaf()
+			changes = append(changes, Change{Kind: Added, Index: l.Index, New: &l})
+		case new == nil:
+			l := old.leaf()
+			changes = append(changes, Change{Kind: Removed, Index: l.Index, Old: &l})
+		case !bytes.Equal(old.key, new.key) || !bytes.Equal(old.value, new.value):
+			o, n := old.leaf(), new.leaf()
+			changes = append(changes, Change{Kind: Modified, Index: n.Index, Old: &o, New: &n})
+		}
+	})
+	return changes
+}
+
+// Changes returns the Changes between the trees of the snapshots of the
+// epochs from and to, which needn't be consecutive. It returns
+// ErrSTRNotFound if there's no snapshot for either epoch, and an
+// ErrEpochPruned if the tree of either has been pruned.
+func (pad *PAD) Changes(from, to Epoch) ([]Change, error) {
+	a, err := pad.snapshotTree(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := pad.snapshotTree(to)
+	if err != nil {
+		return nil, err
+	}
+	return Changes(a, b), nil
+}
+
+// snapshotTree returns the tree of the snapshot of epoch. It returns
+// ErrSTRNotFound if there's no snapshot for epoch, and an ErrEpochPruned
+// if its tree has been pruned, unless it's loaded from the PAD's
+// SnapshotStore.
+func (pad *PAD) snapshotTree(epoch Epoch) (*MerkleTree, error) {
+	str, err := pad.snapshot(epoch)
+	if err != nil {
+		return nil, err
+	}
+	return str.tree, nil
+}
@@ -0,0 +1,81 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	from, to := deltaTrees(t)
+	changes := Changes(from, to)
+	kinds := make(map[ChangeKind]int)
+	for i, c := range changes {
+		kinds[c.Kind]++
+		if i > 0 && bytes.Compare(changes[i-1].Index, c.Index) >= 0 {
+			t.Fatal("Expect the changes to be sorted")
+		}
+		switch c.Kind {
+		case Added:
+			if c.Old != nil || c.New == nil || !bytes.Equal(c.New.Value, valuePrefix) {
+				t.Error("Unexpected addition", c)
+			}
+		case Modified:
+			if !bytes.Equal(c.Old.Value, valuePrefix) || !bytes.Equal(c.New.Value, []byte("changed")) ||
+				!bytes.Equal(c.Old.Key, c.New.Key) {
+				t.Error("Unexpected modification", c)
+			}
+		case Removed:
+			if c.New != nil || c.Old == nil || !bytes.Equal(c.Old.Index, c.Index) {
+				t.Error("Unexpected removal", c)
+			}
+		}
+	}
+	if kinds[Added] != 10 || kinds[Modified] != 5 || kinds[Removed] != 5 {
+		t.Errorf("Expect 10 additions, 5 modifications and 5 removals, got %v", kinds)
+	}
+
+	// the other way around, additions and removals swap
+	backKinds := make(map[ChangeKind]int)
+	for _, c := range Changes(to, from) {
+		backKinds[c.Kind]++
+	}
+	if backKinds[Added] != 5 || backKinds[Modified] != 5 || backKinds[Removed] != 10 {
+		t.Errorf("Expect the reverse changes, got %v", backKinds)
+	}
+	if len(Changes(to, to)) != 0 {
+		t.Error("Expect no changes between a tree and itself")
+	}
+
+	// setting the same values again only changes the commitments
+	same := mustClone(t, to)
+	if err := same.SetBatch(batchEntries(5, 0, []byte("changed"))); err != nil {
+		t.Fatal(err)
+	}
+	same.recomputeHash()
+	if bytes.Equal(same.hash, to.hash) || len(Changes(to, same)) != 0 {
+		t.Error("Expect new commitments not to be changes")
+	}
+}
+
+func TestPADChanges(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := pad.Set([]byte(keyPrefix+string(rune('a'+i))), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+	}
+	changes, err := pad.Changes(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Kind != Added || changes[1].Kind != Added {
+		t.Errorf("Expect 2 additions, got %v", changes)
+	}
+	if _, err := pad.Changes(0, 4); err != ErrSTRNotFound {
+		t.Error("Expect", ErrSTRNotFound, "got", err)
+	}
+}
@@ -0,0 +1,245 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// ErrMalformedProof indicates that a CompressedAuthPath can't be
+// decompressed or decoded.
+var ErrMalformedProof = errors.New("[merkletree] Malformed compressed authentication path")
+
+// A CompressedAuthPath is an AuthenticationPath that omits the hashes of
+// the siblings that are empty branches. Their hashes only depend on the
+// tree nonce and the position of the sibling, so the verifier recomputes
+// them. Near the leaves of a sparse tree most siblings are empty, so
+// this shrinks deep proofs considerably.
+type CompressedAuthPath struct {
+	TreeNonce []byte
+	// Empty has a bit for each level of Leaf, in the order of
+	// conv.GetNthBit, which is set if the sibling at that level is an
+	// empty branch. The bits past Leaf.Level must be clear.
+	Empty []byte
+	// Siblings are the hashes of the siblings that aren't empty branches,
+	// from the root down.
+	Siblings    [][hashed.HashSizeByte]byte
+	LookupIndex Index
+	VrfProof    []byte
+	Leaf        *ProofNode
+}
+
+// Compress returns the compressed form of ap. The hashes of ap past the
+// level of its leaf are dropped, since Verify doesn't use them. Compress
+// returns ErrIndicesMismatch if ap has no leaf or fewer hashes than the
+// level of its leaf, since such a path can't be verified anyway.
+func (ap *AuthenticationPath) Compress() (*CompressedAuthPath, error) {
+	if ap.Leaf == nil || int(ap.Leaf.Level) > len(ap.PrunedTree) ||
+		int(ap.Leaf.Level) > len(ap.Leaf.Index)*8 {
+		return nil, ErrIndicesMismatch
+	}
+	c := &CompressedAuthPath{
+		TreeNonce:   ap.TreeNonce,
+		Empty:       make([]byte, (ap.Leaf.Level+7)/8),
+		LookupIndex: ap.LookupIndex,
+		VrfProof:    ap.VrfProof,
+		Leaf:        ap.Leaf,
+	}
+	for l, hash := range ap.PrunedTree[:ap.Leaf.Level] {
+		if bytes.Equal(hash[:], emptySiblingHash(ap.TreeNonce, ap.Leaf.Index, uint32(l))) {
+			c.Empty[l/8] |= 0x80 >> (l % 8)
+		} else {
+			c.Siblings = append(c.Siblings, hash)
+		}
+	}
+	return c, nil
+}
+
+// Decompress returns the AuthenticationPath c is the compressed form of.
+// It returns ErrMalformedProof if c has no leaf, if Empty doesn't have
+// exactly one bit per level of the leaf, or if c doesn't have a hash for
+// each of the other siblings. The result isn't verified; see Verify.
+func (c *CompressedAuthPath) Decompress() (*AuthenticationPath, error) {
+	if c.Leaf == nil || int(c.Leaf.Level) > len(c.Leaf.Index)*8 ||
+		len(c.Empty) != int(c.Leaf.Level+7)/8 {
+		return nil, ErrMalformedProof
+	}
+	if rest := c.Leaf.Level % 8; rest != 0 && c.Empty[len(c.Empty)-1]&(0xff>>rest) != 0 {
+		return nil, ErrMalformedProof
+	}
+	ap := &AuthenticationPath{
+		TreeNonce:   c.TreeNonce,
+		PrunedTree:  make([][hashed.HashSizeByte]byte, c.Leaf.Level),
+		LookupIndex: c.LookupIndex,
+		VrfProof:    c.VrfProof,
+		Leaf:        c.Leaf,
+	}
+	siblings := c.Siblings
+	for l := uint32(0); l < c.Leaf.Level; l++ {
+		switch {
+		case conv.GetNthBit(c.Empty, l):
+			copy(ap.PrunedTree[l][:], emptySiblingHash(c.TreeNonce, c.Leaf.Index, l))
+		case len(siblings) == 0:
+			return nil, ErrMalformedProof
+		default:
+			ap.PrunedTree[l] = siblings[0]
+			siblings = siblings[1:]
+		}
+	}
+	if len(siblings) != 0 {
+		return nil, ErrMalformedProof
+	}
+	return ap, nil
+}
+
+// Verify decompresses c and verifies the result like
+// AuthenticationPath.Verify.
+func (c *CompressedAuthPath) Verify(key, value, treeHash []byte) error {
+	ap, err := c.Decompress()
+	if err != nil {
+		return err
+	}
+	return ap.Verify(key, value, treeHash)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding
+// consists of the tree nonce, the lookup index, the VRF proof, the leaf's
+// level, whether it's empty, its index, value, commitment and epochs, the bitmap
+// of empty siblings and the hashes of the other siblings. Lengths are
+// implied by the level where possible, and prefixed otherwise; all
+// integers are big-endian.
+func (c *CompressedAuthPath) MarshalBinary() ([]byte, error) {
+	if c.Leaf == nil {
+		return nil, ErrMalformedProof
+	}
+	var bs []byte
+	for _, f := range [][]byte{c.TreeNonce, c.LookupIndex, c.VrfProof} {
+		bs = appendUint32(bs, uint32(len(f)))
+		bs = append(bs, f...)
+	}
+	bs = appendUint32(bs, c.Leaf.Level)
+	if c.Leaf.IsEmpty {
+		bs = append(bs, 1)
+	} else {
+		bs = append(bs, 0)
+	}
+	for _, f := range [][]byte{c.Leaf.Index, c.Leaf.Value, c.Leaf.Commitment.Salt, c.Leaf.Commitment.Hash} {
+		bs = appendUint32(bs, uint32(len(f)))
+		bs = append(bs, f...)
+	}
+	bs = appendUint64(bs, uint64(c.Leaf.AddedEpoch))
+	bs = appendUint64(bs, uint64(c.Leaf.ChangedEpoch))
+	bs = append(bs, c.Empty...)
+	for _, hash := range c.Siblings {
+		bs = append(bs, hash[:]...)
+	}
+	return bs, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It returns
+// ErrMalformedProof if data isn't exactly the encoding of
+// a CompressedAuthPath that Decompress accepts. c is only modified if
+// UnmarshalBinary succeeds.
+func (c *CompressedAuthPath) UnmarshalBinary(data []byte) error {
+	tr := &treeReader{r: bytes.NewReader(data)}
+	next := CompressedAuthPath{TreeNonce: tr.field(), LookupIndex: tr.field(), VrfProof: tr.field()}
+	leaf := &ProofNode{Level: tr.uint32()}
+	switch isEmpty := tr.read(1); {
+	case tr.err != nil:
+	case isEmpty[0] > 1:
+		return ErrMalformedProof
+	default:
+		leaf.IsEmpty = isEmpty[0] == 1
+	}
+	leaf.Index, leaf.Value = tr.field(), tr.field()
+	leaf.Commitment = hashed.Commit{Salt: tr.field(), Hash: tr.field()}
+	leaf.AddedEpoch, leaf.ChangedEpoch = Epoch(tr.uint64()), Epoch(tr.uint64())
+	if tr.err != nil || int(leaf.Level) > len(leaf.Index)*8 {
+		return ErrMalformedProof
+	}
+	next.Leaf = leaf
+	next.Empty = tr.read(int(leaf.Level+7) / 8)
+	var empty int
+	for l := uint32(0); l < leaf.Level && tr.err == nil; l++ {
+		if conv.GetNthBit(next.Empty, l) {
+			empty++
+		}
+	}
+	for i := empty; i < int(leaf.Level) && tr.err == nil; i++ {
+		var hash [hashed.HashSizeByte]byte
+		copy(hash[:], tr.read(hashed.HashSizeByte))
+		next.Siblings = append(next.Siblings, hash)
+	}
+	if tr.err != nil || tr.n != int64(len(data)) {
+		return ErrMalformedProof
+	}
+	if _, err := next.Decompress(); err != nil {
+		return err
+	}
+	*c = next
+	return nil
+}
+
+// ErrMalformedTree indicates that a serialized MerkleTree couldn't be
+// parsed, or that the tree it describes doesn't have the hash it was
+// serialized with.
+var ErrMalformedTree = errors.New("[merkletree] Malformed serialized tree")
+
+// maxFieldSize bounds the length of the keys and values a treeReader
+// accepts, so that a malformed length can't exhaust memory.
+const maxFieldSize = 1 << 24
+
+// A treeReader reads the parts of a serialized tree from r, counting the
+// bytes read. After the first error, which is kept in err, its methods
+// return zero values.
+type treeReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+// read reads the next l bytes.
+func (r *treeReader) read(l int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	bs := make([]byte, l)
+	n, err := io.ReadFull(r.r, bs)
+	r.n += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	r.err = err
+	return bs
+}
+
+func (r *treeReader) uint32() uint32 {
+	if bs := r.read(4); r.err == nil {
+		return binary.BigEndian.Uint32(bs)
+	}
+	return 0
+}
+
+func (r *treeReader) uint64() uint64 {
+	if bs := r.read(8); r.err == nil {
+		return binary.BigEndian.Uint64(bs)
+	}
+	return 0
+}
+
+// field reads a length-prefixed field. An empty field is nil.
+func (r *treeReader) field() []byte {
+	l := r.uint32()
+	if r.err != nil || l == 0 {
+		return nil
+	}
+	if l > maxFieldSize {
+		r.err = ErrMalformedTree
+		return nil
+	}
+	return r.read(int(l))
+}
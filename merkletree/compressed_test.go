@@ -0,0 +1,129 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// compressedPaths returns a tree with 100 leaves, two of which only
+// differ in the fourth to last bit of their indices, and proofs for those
+// two, for an index near them that isn't in the tree, and for a few other
+// leaves.
+func compressedPaths(t *testing.T) (*MerkleTree, []*AuthenticationPath) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := batchEntries(100, 0, valuePrefix)
+	deep := append(Index{}, entries[0].Index...)
+	deep[len(deep)-1] ^= 8
+	entries = append(entries, Entry{Index: deep, Key: []byte("deep"), Value: valuePrefix})
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	absent := append(Index{}, deep...)
+	absent[len(absent)-1] ^= 1
+	paths := []*AuthenticationPath{mustGet(t, m, entries[0].Index), mustGet(t, m, deep), mustGet(t, m, absent)}
+	for _, e := range entries[1:5] {
+		paths = append(paths, mustGet(t, m, e.Index))
+	}
+	return m, paths
+}
+
+func TestCompressedAuthPath(t *testing.T) {
+	m, paths := compressedPaths(t)
+	for i, ap := range paths {
+		c, err := ap.Compress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 && len(c.Siblings) > len(ap.PrunedTree)/4 {
+			t.Errorf("Path %d: expect most of the %d siblings to be empty, got %d hashes",
+				i, len(ap.PrunedTree), len(c.Siblings))
+		}
+		bs, err := c.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded CompressedAuthPath
+		if err := decoded.UnmarshalBinary(bs); err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := decoded.Decompress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for l := range ap.PrunedTree {
+			if decompressed.PrunedTree[l] != ap.PrunedTree[l] {
+				t.Fatalf("Path %d: expect the same hash at level %d", i, l)
+			}
+		}
+		key, value := ap.Leaf.Value, ap.Leaf.Value
+		if ap.ProofType() == ProofOfInclusion {
+			key = mustLeafAt(t, m, ap.LookupIndex).key
+		}
+		if err := decoded.Verify(key, value, m.hash); err != nil {
+			t.Errorf("Path %d: %v", i, err)
+		}
+	}
+}
+
+func TestCompressedAuthPathErrors(t *testing.T) {
+	m, paths := compressedPaths(t)
+	ap := paths[1]
+	c, err := ap.Compress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := *c
+	flipped.Empty = append([]byte{}, c.Empty...)
+	flipped.Empty[0] ^= 0x80
+	padded := *c
+	padded.Empty = append([]byte{}, c.Empty...)
+	padded.Empty[len(padded.Empty)-1] |= 1
+	extra := *c
+	extra.Siblings = append(c.Siblings, [hashed.HashSizeByte]byte{})
+	for _, tc := range []struct {
+		name string
+		c    *CompressedAuthPath
+		want error
+	}{
+		{"flipped", &flipped, ErrMalformedProof},
+		{"padding", &padded, ErrMalformedProof},
+		{"extra sibling", &extra, ErrMalformedProof},
+		{"no leaf", &CompressedAuthPath{}, ErrMalformedProof},
+	} {
+		if err := tc.c.Verify(mustLeafAt(t, m, ap.LookupIndex).key, ap.Leaf.Value, m.hash); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	if ap.Leaf.Level%8 == 0 {
+		t.Fatal("Expect the leaf level not to be a multiple of 8")
+	}
+
+	var decoded CompressedAuthPath
+	for _, data := range [][]byte{bs[:len(bs)-1], append(bs, 0)} {
+		if err := decoded.UnmarshalBinary(data); err != ErrMalformedProof {
+			t.Errorf("Expect ErrMalformedProof, got %v", err)
+		}
+	}
+	if decoded.Leaf != nil {
+		t.Error("Expect UnmarshalBinary not to modify the path on errors")
+	}
+
+	short := *ap
+	short.PrunedTree = ap.PrunedTree[:ap.Leaf.Level-1]
+	if _, err := short.Compress(); err != ErrIndicesMismatch {
+		t.Errorf("Expect ErrIndicesMismatch, got %v", err)
+	}
+	if !bytes.Equal(c.LookupIndex, ap.LookupIndex) {
+		t.Error("Expect the compressed path to keep the lookup index")
+	}
+}
@@ -0,0 +1,224 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/conv"
+)
+
+var (
+	// ErrIndexNotFound indicates that the tree has no user leaf with the
+	// index to delete.
+	ErrIndexNotFound = errors.New("[merkletree] Index not found")
+	// ErrInvalidRemoval indicates that a RemovalProof doesn't prove that
+	// only the leaf with its index was removed.
+	ErrInvalidRemoval = errors.New("[merkletree] The proof of removal is invalid")
+)
+
+// A RemovalProof proves that the user leaf with an index was removed
+// from a tree, and that nothing else changed. Before is the proof of its
+// inclusion in the tree before the removal, and After the proof of its
+// absence afterwards. See RemovalProof.Verify.
+type RemovalProof struct {
+	Before *AuthenticationPath
+	After  *AuthenticationPath
+}
+
+// Delete removes the user leaf with the given index from m, and returns
+// a proof of its removal against the hashes of m before and after it.
+// The branch of the leaf collapses like it would had the leaf never been
+// inserted: if the leaf had a user leaf sibling, the sibling moves up as
+// long as the other child of its parent is empty. m is thus the same as
+// a tree built from the remaining leaves.
+//
+// Delete computes the hash of m before and after the removal, so
+// deleting many leaves one by one is slower than inserting them.
+// It returns ErrIndexLength if index isn't IndexSize() bytes long,
+// ErrIndexNotFound if m has no leaf with index, and an error wrapping
+// ErrNodeLoad if a node it needs can't be loaded from m's NodeStore. The
+// leaf is still there if the error is returned before the removal, but
+// not if it's returned computing the hash after it, in which case m is
+// stale until its hash can be computed (see Refresh).
+func (m *MerkleTree) Delete(index Index) (*RemovalProof, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := index.Validate(m.indexSize); err != nil {
+		return nil, err
+	}
+	if m.stale() {
+		if _, err := m.recomputeHash(); err != nil {
+			return nil, err
+		}
+	}
+	before, err := m.get(index)
+	if err != nil {
+		return nil, err
+	}
+	if before.ProofType() != ProofOfInclusion {
+		return nil, ErrIndexNotFound
+	}
+	if err := m.removeLeaf(index); err != nil {
+		return nil, err
+	}
+	if _, err := m.recomputeHash(); err != nil {
+		return nil, err
+	}
+	after, err := m.get(index)
+	if err != nil {
+		return nil, err
+	}
+	return &RemovalProof{Before: before, After: after}, nil
+}
+
+// removeLeaf replaces the user leaf with index, which m must have, with
+// an empty node, and collapses its branch. The siblings of the path are
+// loaded before anything is removed, so if one of them can't be loaded,
+// removeLeaf returns the error and m keeps the same leaves.
+func (m *MerkleTree) removeLeaf(index Index) error {
+	m.ownRoot()
+	// path[d] is the interior node at level d on the path of index, and
+	// siblings[d] its child off the path
+	path := []*interiorNode{m.root}
+	var siblings []merkleNode
+	n := m.root
+	for depth := uint32(0); ; depth++ {
+		direction := conv.GetNthBit(index, depth)
+		sibling, err := m.childOf(n, !direction)
+		if err != nil {
+			return err
+		}
+		siblings = append(siblings, sibling)
+		child, err := m.childOf(n, direction)
+		if err != nil {
+			return err
+		}
+		switch child := child.(type) {
+		case *interiorNode:
+			child = m.ownInterior(child)
+			m.setChild(n, direction, child)
+			n = child
+			path = append(path, n)
+		case *userLeafNode:
+			m.drop(child)
+			empty := m.arena.empty()
+			*empty = emptyNode{
+				node:  node{gen: m.gen, level: depth + 1},
+				index: childPrefix(index, depth, direction),
+			}
+			m.setChild(n, direction, empty)
+			m.collapse(path, siblings, index)
+			return nil
+		default:
+			panic(ErrInvalidTree)
+		}
+	}
+}
+
+// collapse replaces the interior nodes on path, the path of index,
+// whose subtree holds at most one user leaf with that leaf or an empty
+// node, from the bottom up. The root never collapses. The children of
+// the nodes on path are in memory, except for their siblings off the
+// path, which removeLeaf loaded.
+func (m *MerkleTree) collapse(path []*interiorNode, siblings []merkleNode, index Index) {
+	for d := len(path) - 1; d > 0; d-- {
+		direction := conv.GetNthBit(index, uint32(d))
+		left, right := path[d].child(direction), siblings[d]
+		if direction {
+			left, right = right, left
+		}
+		var replacement merkleNode
+		switch {
+		case isEmpty(left) && isEmpty(right):
+			empty := m.arena.empty()
+			*empty = emptyNode{
+				node:  node{gen: m.gen, level: uint32(d)},
+				index: childPrefix(index, uint32(d-1), conv.GetNthBit(index, uint32(d-1))),
+			}
+			replacement = empty
+		case isEmpty(left) && right.kind() == userLeafNodeKind:
+			replacement = m.movedLeaf(right.(*userLeafNode), d)
+		case isEmpty(right) && left.kind() == userLeafNodeKind:
+			replacement = m.movedLeaf(left.(*userLeafNode), d)
+		default:
+			return
+		}
+		m.releaseChildren(path[d])
+		m.setChild(path[d-1], conv.GetNthBit(index, uint32(d-1)), replacement)
+	}
+}
+
+// movedLeaf returns n moved up to level.
+func (m *MerkleTree) movedLeaf(n *userLeafNode, level int) *userLeafNode {
+	n = m.ownLeaf(n)
+	n.level = uint32(level)
+	return n
+}
+
+// Verify returns nil iff p proves that the user leaf with index was
+// removed from the tree with the hash before, which resulted in the tree
+// with the hash after, and that nothing else changed: After must prove
+// the absence of index with the same nonce and the same path as Before,
+// except that the leaf is replaced with an empty node, or that its
+// sibling moved up over empty branches as far as it can.
+//
+// It returns ErrUnequalTreeHashes if either proof doesn't match its
+// hash, ErrIndicesMismatch if either isn't for index, and
+// ErrInvalidRemoval for any other inconsistency.
+func (p *RemovalProof) Verify(index Index, before, after []byte) error {
+	b, a := p.Before, p.After
+	if b == nil || a == nil || b.Leaf == nil || a.Leaf == nil {
+		return ErrInvalidRemoval
+	}
+	if !bytes.Equal(b.LookupIndex, index) || !bytes.Equal(a.LookupIndex, index) {
+		return ErrIndicesMismatch
+	}
+	if b.ProofType() != ProofOfInclusion || !a.ProofType().IsAbsence() ||
+		!bytes.Equal(b.TreeNonce, a.TreeNonce) {
+		return ErrInvalidRemoval
+	}
+	l, k := b.Leaf.Level, a.Leaf.Level
+	if l == 0 || int(l) != len(b.PrunedTree) || int(l) > len(index)*8 || int(k) != len(a.PrunedTree) {
+		return ErrInvalidRemoval
+	}
+	if !bytes.Equal(b.authPathHash(), before) {
+		return ErrUnequalTreeHashes
+	}
+	if err := a.Verify(nil, nil, after); err != nil {
+		return err
+	}
+
+	if a.Leaf.IsEmpty {
+		// the leaf is replaced with an empty node, and its sibling is no
+		// empty node, since the branch would collapse otherwise
+		if k != l || !bytes.Equal(a.Leaf.Index, childPrefix(index, l-1, conv.GetNthBit(index, l-1))) ||
+			l > 1 && bytes.Equal(b.PrunedTree[l-1][:], emptySiblingHash(a.TreeNonce, index, l-1)) {
+			return ErrInvalidRemoval
+		}
+	} else {
+		// the sibling of the leaf moved up to level k
+		moved := *a.Leaf
+		moved.Level = l
+		if k == 0 || k >= l || !hasPrefix(moved.Index, index, l-1) ||
+			conv.GetNthBit(moved.Index, l-1) == conv.GetNthBit(index, l-1) ||
+			!bytes.Equal(moved.hash(a.TreeNonce), b.PrunedTree[l-1][:]) {
+			return ErrInvalidRemoval
+		}
+		// over empty branches only, and as far as it can
+		for j := k - 1; j < l-1; j++ {
+			isEmptySibling := bytes.Equal(b.PrunedTree[j][:], emptySiblingHash(a.TreeNonce, index, j))
+			if j >= k && !isEmptySibling || j == k-1 && k > 1 && isEmptySibling {
+				return ErrInvalidRemoval
+			}
+		}
+	}
+	for j := uint32(0); j < k; j++ {
+		if a.PrunedTree[j] != b.PrunedTree[j] {
+			return ErrInvalidRemoval
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package merkletree
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDelete(t *testing.T) {
+	const n = 200
+	entries := batchEntries(n, 0, valuePrefix)
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	original := mustClone(t, m)
+
+	for i, e := range entries {
+		before := copyOfBs(m.hash)
+		p, err := m.Delete(e.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Verify(e.Index, before, m.hash); err != nil {
+			t.Fatalf("Deleting leaf %d: %v", i, err)
+		}
+		if i%50 != 0 {
+			continue
+		}
+		// the tree is the same as if the leaf had never been inserted
+		_, next := sortedLeaves(m, true)
+		want, err := NewMerkleTreeFromSorted(MinIndexSize, m.nonce, next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotDump, wantDump := dump(t, m), dump(t, want); gotDump != wantDump {
+			t.Fatalf("After deleting %d leaves: expect\n%s\ngot\n%s", i+1, wantDump, gotDump)
+		}
+		if !bytes.Equal(m.hash, want.hash) {
+			t.Fatalf("After deleting %d leaves: expect the same root hash", i+1)
+		}
+	}
+	if _, err := m.Delete(entries[0].Index); err != ErrIndexNotFound {
+		t.Errorf("Expect ErrIndexNotFound, got %v", err)
+	}
+	if _, err := m.Delete(entries[0].Index[1:]); err != ErrIndexLength {
+		t.Errorf("Expect ErrIndexLength, got %v", err)
+	}
+	// clones are unaffected
+	if err := mustGet(t, original, entries[0].Index).Verify(entries[0].Key, entries[0].Value, original.hash); err != nil {
+		t.Error(err)
+	}
+}
+
+// collapsingTree returns a tree whose leaves a and b share their first 4
+// bits, and c, whose first bit differs.
+func collapsingTree(t *testing.T) (m *MerkleTree, a, b, c Index) {
+	index := func(first byte) Index {
+		i := make(Index, MinIndexSize)
+		i[0] = first
+		return i
+	}
+	a, b, c = index(0x00), index(0x08), index(0x80)
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []Index{a, b, c} {
+		if err := m.Set(i, i, valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.recomputeHash()
+	return m, a, b, c
+}
+
+func TestDeleteCollapses(t *testing.T) {
+	m, a, b, _ := collapsingTree(t)
+	if got := mustGet(t, m, b).Leaf.Level; got != 5 {
+		t.Fatalf("Expect b at level 5, got %d", got)
+	}
+	before := copyOfBs(m.hash)
+	p, err := m.Delete(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(a, before, m.hash); err != nil {
+		t.Fatal(err)
+	}
+	// b moves up to the root's child
+	if got := mustGet(t, m, b); got.ProofType() != ProofOfInclusion || got.Leaf.Level != 1 {
+		t.Fatalf("Expect b at level 1, got %+v", got.Leaf)
+	}
+	if p.After.ProofType() != ProofOfAbsenceConflict || p.After.Leaf.Level != 1 {
+		t.Fatalf("Expect a proof of absence ending in b, got %+v", p.After.Leaf)
+	}
+}
+
+func TestRemovalProofVerify(t *testing.T) {
+	m, a, b, c := collapsingTree(t)
+	before := copyOfBs(m.hash)
+	p, err := m.Delete(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := copyOfBs(m.hash)
+
+	other, _, _, _ := collapsingTree(t)
+	other.nonce = m.nonce
+	other.recomputeHash()
+	if _, err := other.Delete(c); err != nil {
+		t.Fatal(err)
+	}
+	// b didn't move as far as it can
+	stuck := *p.After
+	stuck.Leaf = &ProofNode{Level: 4, Index: b, Commitment: p.After.Leaf.Commitment}
+	stuck.PrunedTree = p.Before.PrunedTree[:4]
+
+	for _, tc := range []struct {
+		name          string
+		p             *RemovalProof
+		index         Index
+		before, after []byte
+		want          error
+	}{
+		{"valid", p, a, before, after, nil},
+		{"swapped hashes", p, a, after, before, ErrUnequalTreeHashes},
+		{"wrong index", p, b, before, after, ErrIndicesMismatch},
+		{"no change", &RemovalProof{Before: p.Before, After: p.Before}, a, before, before, ErrInvalidRemoval},
+		{"reversed", &RemovalProof{Before: p.After, After: p.Before}, a, after, before, ErrInvalidRemoval},
+		{"other change", &RemovalProof{Before: p.Before, After: mustGet(t, other, a)}, a, before, other.hash, ErrInvalidRemoval},
+		{"stuck sibling", &RemovalProof{Before: p.Before, After: &stuck}, a, before, nil, ErrUnequalTreeHashes},
+		{"missing", &RemovalProof{Before: p.Before}, a, before, after, ErrInvalidRemoval},
+	} {
+		if err := tc.p.Verify(tc.index, tc.before, tc.after); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	// even against the hash it matches
+	if err := (&RemovalProof{Before: p.Before, After: &stuck}).Verify(a, before, stuck.authPathHash()); err != ErrInvalidRemoval {
+		t.Errorf("stuck sibling: expect ErrInvalidRemoval, got %v", err)
+	}
+}
+
+func TestDeleteWithNodeStore(t *testing.T) {
+	store := NewMemNodeStore()
+	entries := batchEntries(20, 0, valuePrefix)
+	m, err := NewMerkleTreeFromSorted(MinIndexSize, nil, func() (Leaf, error) { return Leaf{}, io.EOF })
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.store = store
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(store, m.hash, m.nonce, MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := copyOfBs(loaded.hash)
+	p, err := loaded.Delete(entries[3].Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(entries[3].Index, before, loaded.hash); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.released) == 0 {
+		t.Error("Expect the replaced stored nodes to be released")
+	}
+}
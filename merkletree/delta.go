@@ -0,0 +1,344 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// ErrMalformedDelta indicates that a Delta couldn't be parsed, or can't
+// be applied to a tree.
+var ErrMalformedDelta = errors.New("[merkletree] Malformed tree delta")
+
+// A Delta is the difference between two trees, usually the trees of two
+// consecutive epochs: the user leaves that were set or changed, and the
+// indices of those that were removed. Both are sorted by index. A full
+// Delta doesn't build on a previous tree, and Set holds all of the
+// leaves of the tree.
+//
+// The structure of a Merkle prefix tree is determined by the indices of
+// its leaves, so applying a Delta to the tree it was computed from
+// reproduces the other tree exactly, including its hash.
+type Delta struct {
+	Nonce   []byte
+	Full    bool
+	Set     []Leaf
+	Removed []Index
+}
+
+// Diff returns the Delta that turns the tree from into to. It's a full
+// Delta if from is nil or has a different nonce than to, e.g. across
+// a reshuffle. Subtrees whose hashes are the same in both trees are
+// skipped, so diffing the trees of consecutive snapshots only visits
+// the paths to the leaves that changed. Neither tree is modified, so
+// they must not be stale. The leaves of the Delta share their bytes with
+// to, and must not be modified. Diff returns an error wrapping
+// ErrNodeLoad if a node it visits can't be loaded from the NodeStore of
+// its tree.
+func Diff(from, to *MerkleTree) (*Delta, error) {
+	defer rlockTrees(from, to)()
+	d := &Delta{Nonce: copyOfBs(to.nonce)}
+	if from == nil || !bytes.Equal(from.nonce, to.nonce) {
+		d.Full = true
+		if _, err := to.iterateULNs(to.root, func(n *userLeafNode) bool {
+			d.Set = append(d.Set, n.leaf())
+			return true
+		}); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	if err := d.diff(from, from.root, from.hash, to, to.root, to.hash); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// rlockTrees locks the trees a and b for reading, and returns the
+// function unlocking them. a may be nil, or the same tree as b.
+func rlockTrees(a, b *MerkleTree) (unlock func()) {
+	if a == nil || a == b {
+		b.mu.RLock()
+		return b.mu.RUnlock
+	}
+	a.mu.RLock()
+	b.mu.RLock()
+	return func() {
+		b.mu.RUnlock()
+		a.mu.RUnlock()
+	}
+}
+
+func (n *userLeafNode) leaf() Leaf {
+	return Leaf{Index: n.index, Commitment: n.commitment, Key: n.key, Value: n.value,
+		AddedEpoch: n.addedEpoch, ChangedEpoch: n.changedEpoch}
+}
+
+// diff adds the differences between the node a of from and the node b
+// of to, which have the hashes aHash and bHash and the same prefix, to
+// d.
+func (d *Delta) diff(from *MerkleTree, a merkleNode, aHash []byte, to *MerkleTree, b merkleNode, bHash []byte) error {
+	return diffNodes(from, a, aHash, to, b, bHash, func(old, new *userLeafNode) {
+		switch {
+		case new == nil:
+			d.Removed = append(d.Removed, old.index)
+		case old == nil || !bytes.Equal(old.commitment.Hash, new.commitment.Hash) ||
+			!bytes.Equal(old.key, new.key) || !bytes.Equal(old.value, new.value) ||
+			old.addedEpoch != new.addedEpoch || old.changedEpoch != new.changedEpoch:
+			d.Set = append(d.Set, new.leaf())
+		}
+	})
+}
+
+// diffNodes calls f, in the order of their indices, for each pair of
+// user leaves with the same index in the subtrees of the node a of from
+// and the node b of to, which have the hashes aHash and bHash and the
+// same prefix, and for each leaf that's only in one of them, with nil in
+// place of the other. Subtrees with the same hash in both trees are
+// skipped. diffNodes returns the error of loading a node.
+func diffNodes(from *MerkleTree, a merkleNode, aHash []byte, to *MerkleTree, b merkleNode, bHash []byte,
+	f func(old, new *userLeafNode)) error {
+	if aHash != nil && bytes.Equal(aHash, bHash) {
+		return nil
+	}
+	ai, aInterior := a.(*interiorNode)
+	bi, bInterior := b.(*interiorNode)
+	if aInterior && bInterior {
+		for _, right := range []bool{false, true} {
+			ac, err := from.childOf(ai, right)
+			if err != nil {
+				return err
+			}
+			bc, err := to.childOf(bi, right)
+			if err != nil {
+				return err
+			}
+			if err := diffNodes(from, ac, ai.childHash(right), to, bc, bi.childHash(right), f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// at most one of them is an interior node, so their subtrees are
+	// small: merge their leaves
+	var old, new []*userLeafNode
+	if _, err := from.iterateULNs(a, func(n *userLeafNode) bool {
+		old = append(old, n)
+		return true
+	}); err != nil {
+		return err
+	}
+	if _, err := to.iterateULNs(b, func(n *userLeafNode) bool {
+		new = append(new, n)
+		return true
+	}); err != nil {
+		return err
+	}
+	for len(old) > 0 || len(new) > 0 {
+		var c int
+		switch {
+		case len(old) == 0:
+			c = 1
+		case len(new) == 0:
+			c = -1
+		default:
+			c = bytes.Compare(old[0].index, new[0].index)
+		}
+		switch {
+		case c < 0:
+			f(old[0], nil)
+			old = old[1:]
+		case c > 0:
+			f(nil, new[0])
+			new = new[1:]
+		default:
+			f(old[0], new[0])
+			old, new = old[1:], new[1:]
+		}
+	}
+	return nil
+}
+
+// Apply returns the tree d turns m into, with its hash computed. m isn't
+// modified. A full d only takes the index size of m. Apply returns
+// ErrMalformedDelta if d isn't full and has a different nonce than m or
+// removes a leaf m doesn't have, or if a leaf of d has an invalid index
+// or a commitment that doesn't match its key and value. Like
+// NewMerkleTreeFromSorted, it returns ErrUnsortedLeaves if the leaves of
+// a full d aren't sorted. It returns an error wrapping ErrNodeLoad if a
+// node it needs can't be loaded from the NodeStore of m.
+func (m *MerkleTree) Apply(d *Delta) (*MerkleTree, error) {
+	indexSize := m.IndexSize()
+	for _, l := range d.Set {
+		if l.Index.Validate(indexSize) != nil || !l.Commitment.Verify(l.Key, l.Value) {
+			return nil, ErrMalformedDelta
+		}
+	}
+	if d.Full {
+		if len(d.Removed) != 0 {
+			return nil, ErrMalformedDelta
+		}
+		nonce := d.Nonce
+		if nonce == nil {
+			// not a random one
+			nonce = []byte{}
+		}
+		set := d.Set
+		return NewMerkleTreeFromSorted(indexSize, nonce, func() (Leaf, error) {
+			if len(set) == 0 {
+				return Leaf{}, io.EOF
+			}
+			l := set[0]
+			set = set[1:]
+			return l, nil
+		})
+	}
+	next, err := m.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(d.Nonce, next.nonce) {
+		return nil, ErrMalformedDelta
+	}
+	for _, index := range d.Removed {
+		if index.Validate(indexSize) != nil {
+			return nil, ErrMalformedDelta
+		}
+		existing, err := next.leafAt(index)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, ErrMalformedDelta
+		}
+		if err := next.removeLeaf(index); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range d.Set {
+		leaf := next.arena.leaf()
+		*leaf = userLeafNode{
+			key:          copyOfBs(l.Key),
+			value:        copyOfBs(l.Value),
+			index:        copyOfBs(l.Index),
+			commitment:   l.Commitment,
+			addedEpoch:   l.AddedEpoch,
+			changedEpoch: l.ChangedEpoch,
+		}
+		existing, err := next.leafAt(l.Index)
+		if err != nil {
+			return nil, err
+		}
+		if err := next.insertNode(l.Index, leaf, existing); err != nil {
+			if errors.Is(err, ErrNodeLoad) {
+				return nil, err
+			}
+			return nil, ErrMalformedDelta
+		}
+	}
+	if _, err := next.recomputeHash(); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Delta returns the Delta that turns the tree of the snapshot of the
+// epoch before epoch into the tree of the snapshot of epoch. The Delta
+// is full if full is set, if epoch is 0, or if the tree of the epoch
+// before has been pruned or evicted. Delta returns ErrSTRNotFound if
+// there's no snapshot for epoch, an ErrEpochPruned if its tree has
+// been pruned, and the error of Diff if a node can't be loaded.
+func (pad *PAD) Delta(epoch Epoch, full bool) (*Delta, error) {
+	tree, err := pad.snapshotTree(epoch)
+	if err != nil {
+		return nil, err
+	}
+	if full || epoch == 0 {
+		return Diff(nil, tree)
+	}
+	var from *MerkleTree
+	if prev, err := pad.snapshotTree(epoch - 1); err == nil {
+		from = prev
+	}
+	return Diff(from, tree)
+}
+
+// WriteTo serializes d to w in the format of MerkleTree.WriteTo: the
+// nonce, whether d is full, the number of leaves set and each of them
+// with its epochs, and the number of leaves removed and their indices, all big-endian
+// and length-prefixed. It returns the number of bytes written.
+func (d *Delta) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	bs := appendUint32(nil, uint32(len(d.Nonce)))
+	bs = append(bs, d.Nonce...)
+	if d.Full {
+		bs = append(bs, 1)
+	} else {
+		bs = append(bs, 0)
+	}
+	bs = appendUint64(bs, uint64(len(d.Set)))
+	for _, l := range d.Set {
+		for _, f := range [][]byte{l.Index, l.Key, l.Value, l.Commitment.Salt, l.Commitment.Hash} {
+			bs = appendUint32(bs, uint32(len(f)))
+			bs = append(bs, f...)
+		}
+		bs = appendUint64(bs, uint64(l.AddedEpoch))
+		bs = appendUint64(bs, uint64(l.ChangedEpoch))
+		if _, err := bw.Write(bs); err != nil {
+			return cw.n, err
+		}
+		bs = bs[:0]
+	}
+	bs = appendUint64(bs, uint64(len(d.Removed)))
+	for _, index := range d.Removed {
+		bs = appendUint32(bs, uint32(len(index)))
+		bs = append(bs, index...)
+	}
+	if _, err := bw.Write(bs); err != nil {
+		return cw.n, err
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadFrom replaces d with the Delta serialized by WriteTo that it reads
+// from r, and returns the number of bytes read. It reads nothing past
+// the end of the Delta, and returns ErrMalformedDelta if it can't be
+// parsed and io.ErrUnexpectedEOF if r ends before it does. The leaves
+// aren't verified; see MerkleTree.Apply.
+func (d *Delta) ReadFrom(r io.Reader) (int64, error) {
+	tr := &treeReader{r: r}
+	next := Delta{Nonce: tr.field()}
+	switch full := tr.read(1); {
+	case tr.err != nil:
+	case full[0] > 1:
+		return tr.n, ErrMalformedDelta
+	default:
+		next.Full = full[0] == 1
+	}
+	for i, n := uint64(0), tr.uint64(); i < n && tr.err == nil; i++ {
+		l := Leaf{Index: tr.field(), Key: tr.field(), Value: tr.field()}
+		l.Commitment = hashed.Commit{Salt: tr.field(), Hash: tr.field()}
+		l.AddedEpoch, l.ChangedEpoch = Epoch(tr.uint64()), Epoch(tr.uint64())
+		next.Set = append(next.Set, l)
+	}
+	for i, n := uint64(0), tr.uint64(); i < n && tr.err == nil; i++ {
+		next.Removed = append(next.Removed, tr.field())
+	}
+	switch tr.err {
+	case nil:
+		*d = next
+		return tr.n, nil
+	case ErrMalformedTree:
+		return tr.n, ErrMalformedDelta
+	default:
+		return tr.n, tr.err
+	}
+}
@@ -0,0 +1,161 @@
+package merkletree
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// deltaTrees returns a tree of 200 leaves, and a clone of it with 10
+// leaves added, 5 changed and 5 removed.
+func deltaTrees(t *testing.T) (from, to *MerkleTree) {
+	from, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := batchEntries(200, 0, valuePrefix)
+	if err := from.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	from.recomputeHash()
+	to = mustClone(t, from)
+	changed := batchEntries(5, 0, []byte("changed"))
+	if err := to.SetBatch(append(changed, batchEntries(10, 200, valuePrefix)...)); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries[100:105] {
+		if _, err := to.Delete(e.Index); err != nil {
+			t.Fatal(err)
+		}
+	}
+	to.recomputeHash()
+	return from, to
+}
+
+func TestDiffApply(t *testing.T) {
+	from, to := deltaTrees(t)
+	hash := copyOfBs(from.hash)
+	d := mustDiff(t, from, to)
+	if d.Full || len(d.Set) != 15 || len(d.Removed) != 5 {
+		t.Fatalf("Expect 15 leaves set and 5 removed, got %d and %d", len(d.Set), len(d.Removed))
+	}
+	for i := 1; i < len(d.Set); i++ {
+		if bytes.Compare(d.Set[i-1].Index, d.Set[i].Index) >= 0 {
+			t.Fatal("Expect the leaves to be sorted")
+		}
+	}
+	applied, err := from.Apply(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(applied.hash, to.hash) || dump(t, applied) != dump(t, to) {
+		t.Error("Expect the applied delta to reproduce the tree")
+	}
+	if !bytes.Equal(from.hash, hash) {
+		t.Error("Expect Apply not to modify the tree")
+	}
+	if d := mustDiff(t, to, to); len(d.Set) != 0 || len(d.Removed) != 0 {
+		t.Error("Expect no differences between a tree and itself")
+	}
+
+	full := mustDiff(t, nil, to)
+	if !full.Full || len(full.Set) != 205 {
+		t.Fatalf("Expect a full delta with 205 leaves, got %d", len(full.Set))
+	}
+	empty, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied, err = empty.Apply(full); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(applied.hash, to.hash) {
+		t.Error("Expect the applied full delta to reproduce the tree")
+	}
+}
+
+func TestDeltaSerialization(t *testing.T) {
+	from, to := deltaTrees(t)
+	for _, d := range []*Delta{mustDiff(t, from, to), mustDiff(t, nil, to)} {
+		var buf bytes.Buffer
+		n, err := d.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(buf.Len()) {
+			t.Errorf("Expect %d bytes written, got %d", buf.Len(), n)
+		}
+		bs := buf.Bytes()
+		var read Delta
+		if n, err := read.ReadFrom(bytes.NewReader(append(bs, 0xff))); err != nil || n != int64(len(bs)) {
+			t.Fatalf("Expect to read %d bytes, got %d, %v", len(bs), n, err)
+		}
+		applied, err := from.Apply(&read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(applied.hash, to.hash) {
+			t.Error("Expect the read delta to reproduce the tree")
+		}
+		if _, err := read.ReadFrom(bytes.NewReader(bs[:len(bs)-1])); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expect io.ErrUnexpectedEOF, got %v", err)
+		}
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	from, to := deltaTrees(t)
+	d := mustDiff(t, from, to)
+	other, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badCommitment := *d
+	badCommitment.Set = append([]Leaf{}, d.Set...)
+	badCommitment.Set[0].Value = []byte("forged")
+	unsorted := *mustDiff(t, nil, to)
+	unsorted.Set = append([]Leaf{}, unsorted.Set...)
+	unsorted.Set[0], unsorted.Set[1] = unsorted.Set[1], unsorted.Set[0]
+	for _, tc := range []struct {
+		name string
+		m    *MerkleTree
+		d    *Delta
+		want error
+	}{
+		{"other nonce", other, d, ErrMalformedDelta},
+		{"missing leaf", to, d, ErrMalformedDelta},
+		{"bad commitment", from, &badCommitment, ErrMalformedDelta},
+		{"unsorted", other, &unsorted, ErrUnsortedLeaves},
+	} {
+		if _, err := tc.m.Apply(tc.d); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestPADDelta(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"alice", "bob", "carol"} {
+		if err := pad.Set([]byte(key), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+	}
+	d, err := pad.Delta(3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Full || len(d.Set) != 1 || string(d.Set[0].Key) != "carol" {
+		t.Fatalf("Expect carol to be set, got %+v", d)
+	}
+	// the tree of epoch 1 has been evicted
+	if d, err = pad.Delta(2, false); err != nil || !d.Full || len(d.Set) != 2 {
+		t.Fatalf("Expect a full delta, got %+v, %v", d, err)
+	}
+	if _, err := pad.Delta(4, false); err != ErrSTRNotFound {
+		t.Errorf("Expect ErrSTRNotFound, got %v", err)
+	}
+}
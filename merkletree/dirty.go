@@ -0,0 +1,82 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import "sort"
+
+// dirtySides records which children of an interior node changed since
+// the hash of its tree was last computed.
+type dirtySides uint8
+
+const (
+	dirtyLeft dirtySides = 1 << iota
+	dirtyRight
+)
+
+// sideOf returns the dirtySides bit of the right child if right is true,
+// and of the left one otherwise.
+func sideOf(right bool) dirtySides {
+	if right {
+		return dirtyRight
+	}
+	return dirtyLeft
+}
+
+// markDirty records that the right child of n changed if right is true,
+// and the left one otherwise. n must be a node m may modify.
+func (m *MerkleTree) markDirty(n *interiorNode, right bool) {
+	if m.dirty == nil {
+		m.dirty = make(map[*interiorNode]dirtySides)
+	}
+	m.dirty[n] |= sideOf(right)
+}
+
+// isDirty returns true iff the right child of n changed since the hash
+// of m was last computed if right is true, or the left one otherwise.
+// The cached hash of a dirty child is that of the child it replaced, if
+// any.
+func (m *MerkleTree) isDirty(n *interiorNode, right bool) bool {
+	return m.dirty[n]&sideOf(right) != 0
+}
+
+// forget removes n, which is no longer in m, from the dirty nodes of m.
+func (m *MerkleTree) forget(n *interiorNode) {
+	delete(m.dirty, n)
+}
+
+// rehashDirty computes the hashes of the changed children of the dirty
+// nodes of m, from the deepest nodes up, so that those of the changed
+// interior nodes are ready by the time their parents need them. Every
+// node on the path of a change is dirty, so no other node is visited. A
+// node stays dirty until it's rehashed, so if a node can't be loaded to
+// compute the shape of a dirty node, rehashDirty returns the error with
+// that node and those above it still dirty, and can be called again.
+func (m *MerkleTree) rehashDirty() error {
+	nodes := make([]*interiorNode, 0, len(m.dirty))
+	for n := range m.dirty {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].level > nodes[j].level })
+	for _, n := range nodes {
+		sides := m.dirty[n]
+		for _, right := range []bool{false, true} {
+			if sides&sideOf(right) == 0 {
+				m.hashStats.Reused++
+				continue
+			}
+			// the changed children are in memory
+			h := n.child(right).hash(m)
+			if right {
+				n.rightHash = h
+			} else {
+				n.leftHash = h
+			}
+		}
+		if err := n.setShape(m); err != nil {
+			return err
+		}
+		delete(m.dirty, n)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package merkletree
+
+import (
+	"io"
+	"testing"
+)
+
+func TestDirtyNodes(t *testing.T) {
+	store := NewMemNodeStore()
+	entries := batchEntries(50, 0, valuePrefix)
+	m, err := NewMerkleTreeFromSorted(MinIndexSize, nil, func() (Leaf, error) { return Leaf{}, io.EOF })
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.store = store
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(store, m.hash, m.nonce, MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.stale() {
+		t.Fatal("Expect a loaded tree to have no dirty nodes")
+	}
+
+	e := entries[3]
+	for _, value := range []string{"one", "two"} {
+		if err := loaded.Set(e.Index, e.Key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the interior nodes on the path of the leaf, and only them
+	if level := mustLeafAt(t, loaded, e.Index).level; len(loaded.dirty) != int(level) {
+		t.Errorf("Expect the %d nodes on the path to be dirty, got %d", level, len(loaded.dirty))
+	}
+	// the stored nodes are released once, however often they're replaced
+	seen := make(map[string]bool)
+	for _, h := range loaded.released {
+		if seen[string(h)] {
+			t.Errorf("Expect %x to be released once", h)
+		}
+		seen[string(h)] = true
+	}
+	// those on the path, and the leaf
+	if len(seen) != len(loaded.dirty)+1 {
+		t.Errorf("Expect the %d replaced stored nodes to be released, got %d", len(loaded.dirty)+1, len(seen))
+	}
+
+	// the collapsed nodes aren't dirty anymore
+	for _, e := range entries[10:40] {
+		if _, err := loaded.Delete(e.Index); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loaded.Set(entries[5].Index, entries[5].Key, []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.stale() {
+		t.Error("Expect a refreshed tree to have no dirty nodes")
+	}
+	if err := loaded.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -16,6 +16,23 @@ This design does not support deletions, and individual snapshots are
 linked via a hash chain to commit the entire history. This PAD
 implementation also supports randomizing the order of directory entries
 by changing the VRF private key.
+Keys and values are arbitrary byte strings: the PAD knows nothing about
+usernames, which are a concept of the CONIKS directory built on top of it
+(see package directory), so it can be reused for other transparency logs.
+Applications that store structured values, e.g. key bundles, can store
+LeafValues with PAD.SetValue and decode them with PAD.LookupValue; the
+commitments are over their canonical encodings.
+Indices are computed by an Indexer: a VRF by default, or a much faster keyed
+hash (HashIndexer) for logs that don't need lookup privacy.
+PAD.At returns a read-only view of the snapshot of a single epoch, which
+lets servers build a response from exactly one snapshot.
+The PAD keeps recent snapshots in memory; with a SnapshotStore, such as
+the LevelDB-backed one in the snapshotdb package, older ones are spilled
+to it and loaded from it for lookups in their epochs. With an STRStore,
+such as the LevelDB-backed one in the strdb package, every STR is
+archived as well, so the STR of any epoch can be served.
+Snapshots share the nodes that didn't change between them, so taking a
+snapshot only copies the paths to the bindings set during the epoch.
 This protects the user's privacy against other malicious parties who
 wish to obtain information about users by querying the key directory.
 
@@ -25,15 +42,46 @@ This module implements the Merkle prefix tree, which is the data structure
 underlying our PAD implementation. It is a binary tree with
 two types of leaf nodes: empty node and user node. Each node
 contains the prefix of its lookup index and its level within the tree.
+A user node also records, as part of its hash, the epoch in which its key
+was first bound and the one in which it was last bound to a different
+value, so that its proofs show how long a binding has existed.
 It provides methods for
 inserting new key-value pairs, and for updating and looking up an existing
-key-value pair.
-The tree is append-only, meaning that user leaf nodes cannot be removed once
-inserted.
+key-value pair. Many pairs can be inserted at once with SetBatch, and
+NewMerkleTreeFromSorted builds a whole tree bottom-up from leaves sorted
+by index, e.g. to bootstrap a replica, and Build from key/value pairs
+sorted by index, e.g. to import a directory.
+By default the nodes of a tree live in memory; with a NodeStore, such as
+the LevelDB-backed one in the nodedb package, they're stored by hash and
+loaded lazily, so a tree can outgrow RAM. MerkleTree.WriteTo and ReadFrom
+export a tree to a stream and reconstruct it with the same hash, and
+MerkleTree.ForEachLeaf streams its bindings in index order.
+A MerkleTree is safe for concurrent use, so lookups can be served while
+bindings are set; they see the tree before or after each change.
+User leaf nodes are normally never removed once inserted, but
+MerkleTree.Delete removes one, collapsing its branch, and returns
+a RemovalProof with which clients can verify that nothing else changed.
+AuthenticationPath.Compress drops the hashes of empty siblings from
+a proof, which verifiers recompute from the tree nonce; in a sparse tree,
+that's most of the hashes of a deep path.
+MerkleTree.GetBatch proves many lookups at once with a MultiAuthPath,
+which shares the upper levels of their paths.
+The experimental ShardedTree splits the index space by prefix across
+several independent trees, which can be updated in parallel or hosted
+apart, and combines their roots into the single root an STR signs; its
+proofs add one layer proving the shard's root (see ShardedAuthPath).
 This Merkle prefix tree implementation is also privacy-preserving:
 the lookup index is a cryptographic transformation (VRF)
 of the search key, and values are concealed using cryptographic commitments.
 The VRF, commitment scheme and hash operations are provided by our crypto
 package (see https://godoc.org/github.com/ORBAT/cloniks/crypto).
+For debugging, MerkleTree.Dump and MerkleTree.DOT render a tree's
+structure, and DiffDOT highlights how a tree changed between epochs.
+
+Client Builds
+
+With the coniks_client build tag, the package only has what clients need to
+verify a directory, e.g. SignedTreeRoot, AuthenticationPath and
+MultiAuthPath, and leaves out the PAD, the MerkleTree and their storage.
 */
 package merkletree
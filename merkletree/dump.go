@@ -0,0 +1,241 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dumpHashLen is the number of bytes of hashes and indices shown by
+// Dump and the DOT exporters.
+const dumpHashLen = 4
+
+// dumpNode describes a node for Dump and the DOT exporters. Nodes are
+// identified by their prefix, i.e. the path from the root as a string
+// of 0s and 1s.
+type dumpNode struct {
+	prefix string
+	kind   nodeKind
+	level  uint32
+	hash   []byte
+	key    string
+	index  []byte
+}
+
+func shortHex(bs []byte) string {
+	if len(bs) > dumpHashLen {
+		return hex.EncodeToString(bs[:dumpHashLen]) + "…"
+	}
+	return hex.EncodeToString(bs)
+}
+
+func (n *dumpNode) kindName() string {
+	switch n.kind {
+	case interiorNodeKind:
+		return "interior"
+	case userLeafNodeKind:
+		return "leaf"
+	default:
+		return "empty"
+	}
+}
+
+// label returns a one-line description of n without its prefix.
+func (n *dumpNode) label() string {
+	s := fmt.Sprintf("%s level=%d hash=%s", n.kindName(), n.level, shortHex(n.hash))
+	if n.kind == userLeafNodeKind {
+		s += fmt.Sprintf(" key=%q index=%s", n.key, shortHex(n.index))
+	}
+	return s
+}
+
+// dotLabel returns a multi-line Graphviz label for n.
+func (n *dumpNode) dotLabel() string {
+	prefix := n.prefix
+	if prefix == "" {
+		prefix = "root"
+	}
+	lines := []string{prefix, fmt.Sprintf("L%d %s", n.level, shortHex(n.hash))}
+	switch n.kind {
+	case userLeafNodeKind:
+		lines = append(lines, fmt.Sprintf("%q", n.key), "i="+shortHex(n.index))
+	case emptyNodeKind:
+		lines = append(lines, "∅")
+	}
+	return strings.Replace(strings.Join(lines, `\n`), `"`, `\"`, -1)
+}
+
+func (n *dumpNode) dotID() string {
+	return "n" + n.prefix
+}
+
+// walk calls f on every node of m in pre-order, left before right, and
+// returns the error of loading a node from m's NodeStore, if any.
+func (m *MerkleTree) walk(f func(n *dumpNode)) error {
+	var visit func(n merkleNode, prefix string) error
+	visit = func(n merkleNode, prefix string) error {
+		d := &dumpNode{prefix: prefix, kind: n.kind(), hash: n.hash(m)}
+		switch n := n.(type) {
+		case *interiorNode:
+			d.level = n.level
+			f(d)
+			for _, right := range []bool{false, true} {
+				child, err := m.childOf(n, right)
+				if err != nil {
+					return err
+				}
+				bit := "0"
+				if right {
+					bit = "1"
+				}
+				if err := visit(child, prefix+bit); err != nil {
+					return err
+				}
+			}
+			return nil
+		case *userLeafNode:
+			d.level, d.key, d.index = n.level, string(n.key), n.index
+		case *emptyNode:
+			d.level, d.index = n.level, n.index
+		}
+		f(d)
+		return nil
+	}
+	return visit(m.root, "")
+}
+
+// Dump writes a human-readable description of m's structure to w, one
+// node per line, indented by level. Every line shows the node's prefix,
+// kind, level and a truncated hash; user leaf lines also show the key
+// and a truncated index. The output grows linearly with the size of
+// the tree, so Dump is meant for debugging small trees. It computes the
+// hashes of the nodes as it goes, so it has exclusive access to m.
+func (m *MerkleTree) Dump(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	if err := m.walk(func(n *dumpNode) {
+		fmt.Fprintf(bw, "%s[%s] %s\n", strings.Repeat("  ", len(n.prefix)), n.prefix, n.label())
+	}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// DOT writes m's structure to w as a Graphviz digraph, with the same
+// information per node as Dump.
+func (m *MerkleTree) DOT(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph merkletree {")
+	fmt.Fprintln(bw, "\tnode [fontname=monospace];")
+	if err := m.walk(func(n *dumpNode) {
+		writeDOTNode(bw, n, "")
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// Colors used by DiffDOT.
+const (
+	dotAdded   = "palegreen"
+	dotChanged = "orange"
+	dotRemoved = "lightpink"
+)
+
+// DiffDOT writes the structure of the tree to to w as a Graphviz
+// digraph, highlighting how it differs from the tree from, e.g. the
+// tree of the previous epoch. Nodes that don't exist in from are green,
+// nodes whose hash differs from the node with the same prefix in from
+// are orange, and nodes of from that no longer exist in to are drawn
+// dashed in pink. Unchanged nodes aren't highlighted.
+//
+// Note that all nodes differ if from and to have different nonces,
+// e.g. across a reshuffle.
+func DiffDOT(w io.Writer, from, to *MerkleTree) error {
+	old := make(map[string]*dumpNode)
+	if err := from.walk(func(n *dumpNode) {
+		old[n.prefix] = n
+	}); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph merkletree {")
+	fmt.Fprintln(bw, "\tnode [fontname=monospace];")
+	if err := to.walk(func(n *dumpNode) {
+		o, ok := old[n.prefix]
+		delete(old, n.prefix)
+		switch {
+		case !ok:
+			writeDOTNode(bw, n, fmt.Sprintf("style=filled, fillcolor=%s", dotAdded))
+		case string(o.hash) != string(n.hash):
+			writeDOTNode(bw, n, fmt.Sprintf("style=filled, fillcolor=%s", dotChanged))
+		default:
+			writeDOTNode(bw, n, "")
+		}
+	}); err != nil {
+		return err
+	}
+	// what's left was removed; walk from again to keep the output ordered
+	if err := from.walk(func(n *dumpNode) {
+		if _, ok := old[n.prefix]; ok {
+			writeDOTNode(bw, n, fmt.Sprintf("style=\"filled,dashed\", fillcolor=%s", dotRemoved))
+		}
+	}); err != nil {
+		return err
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// DiffDOT is like the DiffDOT function, but compares the trees of the
+// snapshots for epochs fromEpoch and toEpoch, where epochs after the
+// latest one are the latest one. It returns ErrSTRNotFound if either
+// snapshot isn't available, and an ErrEpochPruned if its tree has been
+// pruned.
+func (pad *PAD) DiffDOT(w io.Writer, fromEpoch, toEpoch Epoch) error {
+	if toEpoch > pad.latestSTR.Epoch {
+		toEpoch = pad.latestSTR.Epoch
+	}
+	if fromEpoch > pad.latestSTR.Epoch {
+		fromEpoch = pad.latestSTR.Epoch
+	}
+	from, err := pad.snapshotTree(fromEpoch)
+	if err != nil {
+		return err
+	}
+	to, err := pad.snapshotTree(toEpoch)
+	if err != nil {
+		return err
+	}
+	return DiffDOT(w, from, to)
+}
+
+// writeDOTNode writes n and the edge from its parent. The edge is
+// labeled with the last bit of n's prefix.
+func writeDOTNode(w io.Writer, n *dumpNode, attrs string) {
+	shape := "box"
+	switch n.kind {
+	case interiorNodeKind:
+		shape = "ellipse"
+	case emptyNodeKind:
+		shape = "plaintext"
+	}
+	if attrs != "" {
+		attrs = ", " + attrs
+	}
+	fmt.Fprintf(w, "\t%s [shape=%s, label=\"%s\"%s];\n", n.dotID(), shape, n.dotLabel(), attrs)
+	if n.prefix != "" {
+		parent := &dumpNode{prefix: n.prefix[:len(n.prefix)-1]}
+		fmt.Fprintf(w, "\t%s -> %s [label=%s];\n", parent.dotID(), n.dotID(), n.prefix[len(n.prefix)-1:])
+	}
+}
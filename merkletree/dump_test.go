@@ -0,0 +1,109 @@
+package merkletree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	m := newEmptyTreeForTest(t)
+	var buf bytes.Buffer
+	if err := m.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 ||
+		!strings.HasPrefix(lines[0], "[] interior level=0") ||
+		!strings.HasPrefix(lines[1], "  [0] empty level=1") ||
+		!strings.HasPrefix(lines[2], "  [1] empty level=1") {
+		t.Fatalf("Unexpected dump of an empty tree:\n%s", buf.String())
+	}
+
+	for _, key := range []string{"alice", "bob", "carol"} {
+		if err := m.Set(staticVRFKey.Compute([]byte(key)), []byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Reset()
+	if err := m.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"alice", "bob", "carol"} {
+		if strings.Count(buf.String(), `key="`+key+`"`) != 1 {
+			t.Errorf("Expect one leaf for %s:\n%s", key, buf.String())
+		}
+	}
+}
+
+func TestDOT(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+
+	var buf bytes.Buffer
+	if err := pad.LatestSTR().tree.DOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "digraph merkletree {") || !strings.Contains(out, `\"alice\"`) {
+		t.Fatalf("Unexpected DOT output:\n%s", out)
+	}
+	// root and two children
+	if n := strings.Count(out, " -> "); n != 2 {
+		t.Error("Expect 2 edges, got", n)
+	}
+
+	buf.Reset()
+	if err := pad.DiffDOT(&buf, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	out = buf.String()
+	// the root and alice's leaf (which replaced an empty node) changed,
+	// nothing was added or removed
+	if n := strings.Count(out, dotChanged); n != 2 {
+		t.Errorf("Expect 2 changed nodes, got %d:\n%s", n, out)
+	}
+	if strings.Contains(out, dotAdded) || strings.Contains(out, dotRemoved) {
+		t.Errorf("Expect no added or removed nodes:\n%s", out)
+	}
+
+	if err := pad.DiffDOT(&buf, 0, 5); err != nil {
+		t.Fatal(err) // later epochs map to the latest STR
+	}
+}
+
+func TestDiffDOTAddedAndRemoved(t *testing.T) {
+	from := newEmptyTreeForTest(t)
+	to := mustClone(t, from)
+	// two indices sharing their first byte push the first leaf down
+	a := make([]byte, DefaultIndexSize)
+	b := make([]byte, DefaultIndexSize)
+	b[1] = 0x80
+	if err := to.Set(a, []byte("a"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := to.Set(b, []byte("b"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DiffDOT(&buf, from, to); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), dotAdded) {
+		t.Errorf("Expect added nodes:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := DiffDOT(&buf, to, from); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), dotRemoved) {
+		t.Errorf("Expect removed nodes:\n%s", buf.String())
+	}
+}
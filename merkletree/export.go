@@ -0,0 +1,176 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// treeMagic starts every serialized MerkleTree, followed by the version
+// of the format.
+var treeMagic = []byte("coniks tree")
+
+const treeFormatVersion = 2
+
+var (
+	_ io.WriterTo   = (*MerkleTree)(nil)
+	_ io.ReaderFrom = (*MerkleTree)(nil)
+)
+
+// WriteTo serializes m to w, so that ReadFrom can reconstruct the exact
+// same tree later, and returns the number of bytes written. It computes
+// the hash of m if it's stale.
+//
+// A Merkle prefix tree's structure is determined by the indices of its
+// leaves, so the serialization consists of the index size and the nonce
+// of m, its user leaves in index order, each with its index, key, value,
+// commitment and epochs, and the root hash of m, against which ReadFrom checks
+// the reconstructed tree. All integers are big-endian. The nodes of
+// a tree with a NodeStore are loaded as needed, and WriteTo returns an
+// error wrapping ErrNodeLoad if one can't be.
+func (m *MerkleTree) WriteTo(w io.Writer) (int64, error) {
+	if err := m.rlockFresh(); err != nil {
+		return 0, err
+	}
+	defer m.mu.RUnlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	bs := append(append([]byte{}, treeMagic...), treeFormatVersion)
+	bs = appendUint32(bs, uint32(m.indexSize))
+	bs = appendUint32(bs, uint32(len(m.nonce)))
+	bs = append(bs, m.nonce...)
+	bs = appendUint64(bs, m.root.leaves)
+	if _, err := bw.Write(bs); err != nil {
+		return cw.n, err
+	}
+	var err error
+	_, loadErr := m.iterateULNs(m.root, func(n *userLeafNode) bool {
+		bs = append(bs[:0], n.index...)
+		for _, f := range [][]byte{n.key, n.value, n.commitment.Salt, n.commitment.Hash} {
+			bs = appendUint32(bs, uint32(len(f)))
+			bs = append(bs, f...)
+		}
+		bs = appendUint64(bs, uint64(n.addedEpoch))
+		bs = appendUint64(bs, uint64(n.changedEpoch))
+		_, err = bw.Write(bs)
+		return err == nil
+	})
+	if err != nil {
+		return cw.n, err
+	}
+	if loadErr != nil {
+		return cw.n, loadErr
+	}
+	if _, err := bw.Write(m.hash); err != nil {
+		return cw.n, err
+	}
+	err = bw.Flush()
+	return cw.n, err
+}
+
+// ReadFrom replaces m with the tree serialized by WriteTo that it reads
+// from r, and returns the number of bytes read. It reads nothing past
+// the end of the tree. The reconstructed tree is the same as the
+// serialized one, including its hash, but has no NodeStore.
+//
+// ReadFrom returns ErrMalformedTree if the serialization can't be parsed
+// or the reconstructed tree has a different hash than the serialized
+// one, io.ErrUnexpectedEOF if r ends before the tree does, and any other
+// error of r. m is only modified if ReadFrom succeeds.
+func (m *MerkleTree) ReadFrom(r io.Reader) (int64, error) {
+	tr := &treeReader{r: r}
+	header := tr.read(len(treeMagic) + 1)
+	if tr.err == nil && (!bytes.Equal(header[:len(treeMagic)], treeMagic) ||
+		header[len(treeMagic)] != treeFormatVersion) {
+		return tr.n, ErrMalformedTree
+	}
+	indexSize := int(tr.uint32())
+	nonce := tr.field()
+	leaves := tr.uint64()
+	if tr.err != nil {
+		return tr.n, tr.err
+	}
+	if nonce == nil {
+		// not a random one
+		nonce = []byte{}
+	}
+
+	var read uint64
+	built, err := NewMerkleTreeFromSorted(indexSize, nonce, func() (Leaf, error) {
+		if read == leaves {
+			return Leaf{}, io.EOF
+		}
+		read++
+		leaf := Leaf{Index: tr.read(indexSize)}
+		leaf.Key, leaf.Value = tr.field(), tr.field()
+		leaf.Commitment.Salt, leaf.Commitment.Hash = tr.field(), tr.field()
+		leaf.AddedEpoch, leaf.ChangedEpoch = Epoch(tr.uint64()), Epoch(tr.uint64())
+		if tr.err != nil {
+			return Leaf{}, tr.err
+		}
+		if leaf.Value != nil && !leaf.Commitment.Verify(leaf.Key, leaf.Value) {
+			return Leaf{}, ErrMalformedTree
+		}
+		return leaf, nil
+	})
+	switch {
+	case err == ErrInvalidIndexSize, err == ErrUnsortedLeaves:
+		return tr.n, ErrMalformedTree
+	case err != nil:
+		return tr.n, err
+	}
+	hash := tr.read(hashed.HashSizeByte)
+	if tr.err != nil {
+		return tr.n, tr.err
+	}
+	if !bytes.Equal(hash, built.hash) {
+		return tr.n, ErrMalformedTree
+	}
+	m.mu.Lock()
+	m.nonce, m.root, m.hash, m.indexSize = built.nonce, built.root, built.hash, built.indexSize
+	m.hashStats, m.gen, m.replaced, m.store = built.hashStats, built.gen, built.replaced, built.store
+	m.released, m.written, m.epoch, m.arena = built.released, built.written, built.epoch, built.arena
+	m.dirty = built.dirty
+	m.mu.Unlock()
+	return tr.n, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler with WriteTo.
+func (m *MerkleTree) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler with ReadFrom.
+// It returns ErrMalformedTree if data has bytes past the end of the
+// tree.
+func (m *MerkleTree) UnmarshalBinary(data []byte) error {
+	n, err := m.ReadFrom(bytes.NewReader(data))
+	if err == io.ErrUnexpectedEOF {
+		return ErrMalformedTree
+	}
+	if err == nil && n != int64(len(data)) {
+		return ErrMalformedTree
+	}
+	return err
+}
+
+// A countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
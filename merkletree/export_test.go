@@ -0,0 +1,201 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// vectorTree returns a tree with a fixed nonce and three fixed leaves
+// with different epochs,
+// whose serialization and hash are the test vectors.
+func vectorTree(t *testing.T) *MerkleTree {
+	var leaves []Leaf
+	for i, first := range []byte{0x00, 0x40, 0xc0} {
+		index := make([]byte, MinIndexSize)
+		index[0] = first
+		key := []byte{'k', byte('a' + i)}
+		value := []byte{'v', byte('a' + i)}
+		salt := bytes.Repeat([]byte{byte(i + 1)}, hashed.HashSizeByte)
+		leaves = append(leaves, Leaf{
+			Index:        index,
+			Key:          key,
+			Value:        value,
+			Commitment:   hashed.Commit{Salt: salt, Hash: hashed.CommitHash([][]byte{key, value}, salt)},
+			AddedEpoch:   Epoch(i),
+			ChangedEpoch: Epoch(2 * i),
+		})
+	}
+	m, err := NewMerkleTreeFromSorted(MinIndexSize, []byte("nonce"), func() (Leaf, error) {
+		if len(leaves) == 0 {
+			return Leaf{}, io.EOF
+		}
+		leaf := leaves[0]
+		leaves = leaves[1:]
+		return leaf, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func hexBytes(t *testing.T, s string) []byte {
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestTreeSerializationVector(t *testing.T) {
+	wantBytes := hexBytes(t, "636f6e696b7320747265650200000010000000056e6f6e636500000000000000030000000000000000000000"+
+		"0000000000000000026b61000000027661000000200101010101010101010101010101010101010101010101"+
+		"01010101010101010100000020633ffdac0bc542d39b4b2d81e3f993dfd6bf0b3f60e84d9f9a61b98a1f13bd"+
+		"020000000000000000000000000000000040000000000000000000000000000000000000026b620000000276"+
+		"6200000020020202020202020202020202020202020202020202020202020202020202020200000020e48e53"+
+		"6c205fe74cabd83b54b14ae6f5567a34d33c78d5dd1c2eba54fd94132f000000000000000100000000000000"+
+		"02c0000000000000000000000000000000000000026b63000000027663000000200303030303030303030303"+
+		"030303030303030303030303030303030303030303000000207a342cb884ae1f69f6b269cf01a3b91e133ec1"+
+		"173aa3d9c03356a4614d6e2a130000000000000002000000000000000483538b7a2948eaf3505ca2ac4e3b39"+
+		"da80e1eb555b75b1905ad8abd5f4086b27")
+	wantHash := hexBytes(t, "83538b7a2948eaf3505ca2ac4e3b39da80e1eb555b75b1905ad8abd5f4086b27")
+
+	m := vectorTree(t)
+	if !bytes.Equal(m.hash, wantHash) {
+		t.Fatalf("Expect the root hash %x, got %x", wantHash, m.hash)
+	}
+	got, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, wantBytes) {
+		t.Fatalf("Expect the serialization\n%x\ngot\n%x", wantBytes, got)
+	}
+
+	var read MerkleTree
+	if err := read.UnmarshalBinary(wantBytes); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read.hash, wantHash) {
+		t.Fatalf("Expect the root hash %x after reading, got %x", wantHash, read.hash)
+	}
+	read.recomputeHash()
+	if !bytes.Equal(read.hash, wantHash) {
+		t.Fatalf("Expect the root hash %x after recomputing, got %x", wantHash, read.hash)
+	}
+	if gotDump, wantDump := dump(t, &read), dump(t, m); gotDump != wantDump {
+		t.Fatalf("Expect the same tree, got\n%s\nwant\n%s", gotDump, wantDump)
+	}
+}
+
+func TestTreeSerializationRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 500} {
+		m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SetBatch(batchEntries(n, 0, valuePrefix)); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		written, err := m.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written != int64(buf.Len()) {
+			t.Errorf("%d leaves: expect %d bytes written, got %d", n, buf.Len(), written)
+		}
+		// trailing data isn't read
+		buf.WriteString("trailer")
+		got := new(MerkleTree)
+		read, err := got.ReadFrom(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != written || buf.String() != "trailer" {
+			t.Errorf("%d leaves: expect %d bytes read, got %d", n, written, read)
+		}
+		if !bytes.Equal(got.hash, m.hash) || !bytes.Equal(got.nonce, m.nonce) {
+			t.Fatal(n, "leaves: expect the same nonce and root hash")
+		}
+		if gotDump, wantDump := dump(t, got), dump(t, m); gotDump != wantDump {
+			t.Fatalf("%d leaves: expect the same tree, got\n%s\nwant\n%s", n, gotDump, wantDump)
+		}
+		if n == 0 {
+			continue
+		}
+		e := batchEntries(1, n-1, valuePrefix)[0]
+		if err := mustGet(t, got, e.Index).Verify(e.Key, e.Value, m.hash); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTreeSerializationWithNodeStore(t *testing.T) {
+	store := NewMemNodeStore()
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.store = store
+	if err := m.SetBatch(batchEntries(50, 0, valuePrefix)); err != nil {
+		t.Fatal(err)
+	}
+	want, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(store, m.hash, m.nonce, MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("Expect a loaded tree to serialize like the original")
+	}
+}
+
+func TestTreeSerializationMalformed(t *testing.T) {
+	good, err := vectorTree(t).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(i int) []byte {
+		bs := append([]byte{}, good...)
+		bs[i] ^= 1
+		return bs
+	}
+	hashStart := len(good) - hashed.HashSizeByte
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"magic", corrupt(0)},
+		{"version", corrupt(len(treeMagic))},
+		{"index size", corrupt(len(treeMagic) + 1)},
+		// the first leaf's value
+		{"value", corrupt(len(treeMagic) + 1 + 4 + 4 + 5 + 8 + MinIndexSize + 4 + 2 + 4)},
+		{"root hash", corrupt(hashStart)},
+		{"truncated", good[:hashStart]},
+		{"trailing data", append(append([]byte{}, good...), 0)},
+	} {
+		var m MerkleTree
+		if err := m.UnmarshalBinary(tc.data); err != ErrMalformedTree {
+			t.Errorf("%s: expect ErrMalformedTree, got %v", tc.name, err)
+		}
+	}
+	var m MerkleTree
+	if _, err := m.ReadFrom(bytes.NewReader(good[:hashStart])); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expect io.ErrUnexpectedEOF for a truncated tree, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package merkletree
+
+import (
+	"bytes"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+)
+
+// An Indexer computes the lookup index of a key in a PAD, and a proof
+// that the index is correct, which is returned in the key's
+// authentication paths as VrfProof. The PAD truncates indices to its
+// index size, so Index must return at least DefaultIndexSize bytes.
+type Indexer interface {
+	Index(key []byte) (index, proof []byte)
+}
+
+// A VRFIndexer computes private indices with a VRF. Only the holder of
+// the private key can compute the index of a key, which keeps other
+// keys in the tree private, but anybody with the public key can verify
+// an index using the proof. It's the Indexer NewPAD uses by default.
+type VRFIndexer struct {
+	Key vrf.PrivateKey
+}
+
+// Index returns the VRF output for key and its proof.
+func (ix VRFIndexer) Index(key []byte) (index, proof []byte) {
+	return ix.Key.Prove(key)
+}
+
+// A HashIndexer computes indices with a keyed hash, which is much faster
+// than a VRF. The hash key is public, so that clients can verify
+// indices, and thus anybody can compute the index of any key and learn
+// whether it's in the tree. Use it only if lookup privacy isn't needed.
+// The proofs it returns are empty.
+type HashIndexer struct {
+	Key []byte
+}
+
+// hashIndexContext separates index hashes from other uses of the key.
+const hashIndexContext = "cloniks merkletree index"
+
+// Index returns the keyed hash of key, and an empty proof.
+func (ix HashIndexer) Index(key []byte) (index, proof []byte) {
+	h := hashed.NewKeyed(hashIndexContext, ix.Key)
+	_, _ = h.Write(key)
+	return h.Sum(nil), nil
+}
+
+// Verify returns true iff index is a non-empty prefix of the index of key.
+func (ix HashIndexer) Verify(key, index []byte) bool {
+	want, _ := ix.Index(key)
+	return len(index) > 0 && len(index) <= len(want) && bytes.Equal(want[:len(index)], index)
+}
@@ -0,0 +1,13 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+// WithIndexer makes the PAD compute indices with ix instead of the VRF
+// key passed to NewPAD, which may then be nil.
+func WithIndexer(ix Indexer) PADOption {
+	return func(pad *PAD) error {
+		pad.indexer = ix
+		return nil
+	}
+}
@@ -0,0 +1,45 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHashIndexer(t *testing.T) {
+	ix := HashIndexer{Key: []byte("hash key")}
+	index, proof := ix.Index([]byte("alice"))
+	if len(index) != DefaultIndexSize || proof != nil {
+		t.Fatal("Unexpected index", index, proof)
+	}
+	if other, _ := (HashIndexer{Key: []byte("other key")}).Index([]byte("alice")); bytes.Equal(index, other) {
+		t.Error("Expect indices to depend on the hash key")
+	}
+	if !ix.Verify([]byte("alice"), index) || !ix.Verify([]byte("alice"), index[:MinIndexSize]) {
+		t.Error("Expect the index and its prefixes to verify")
+	}
+	if ix.Verify([]byte("bob"), index) || ix.Verify([]byte("alice"), nil) {
+		t.Error("Expect a wrong or empty index not to verify")
+	}
+}
+
+func TestPADWithHashIndexer(t *testing.T) {
+	ix := HashIndexer{Key: []byte("hash key")}
+	pad, err := NewPAD(TestAd{""}, signKey, nil, 10, WithIndexer(ix), WithIndexSize(MinIndexSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	ap, err := pad.Lookup([]byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ix.Verify([]byte("alice"), ap.LookupIndex) || len(ap.LookupIndex) != MinIndexSize || ap.VrfProof != nil {
+		t.Fatal("Unexpected lookup index", ap.LookupIndex, ap.VrfProof)
+	}
+	if err := ap.Verify([]byte("alice"), []byte("value"), pad.LatestSTR().TreeHash[:]); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,212 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// ErrBrokenInvariant indicates that a tree doesn't have the structure
+// its operations maintain. See MerkleTree.CheckInvariants.
+var ErrBrokenInvariant = errors.New("[merkletree] Tree invariant violated")
+
+// CheckInvariants walks m and checks that it has the structure the tree
+// operations maintain, returning an error wrapping ErrBrokenInvariant
+// that describes the first node which doesn't:
+//   - every node is one level below its parent, and interior nodes are
+//     above the last level the indices allow
+//   - every empty node has the index prefix of its path, and every user
+//     leaf node an index of IndexSize() bytes starting with it
+//   - every user leaf node's commitment opens to its key and value,
+//     unless it has neither (see Leaf), and it wasn't changed before it
+//     was added
+//   - the cached hashes of the children of interior nodes, and the hash
+//     of m, match those recomputed from the leaves, unless they were
+//     dropped because the children changed, in which case the nodes
+//     aren't shared with another tree
+//   - the cached shapes of interior nodes match their subtrees, and
+//     interior nodes below the root have at least two user leaf nodes
+//
+// Nodes don't know their parents (see node), so there are no parent
+// pointers to check. Nodes m only has in its NodeStore are loaded, but
+// not kept. CheckInvariants is meant for trees that were deserialized,
+// migrated or recovered after a crash, and for debugging proofs that
+// don't verify; it takes time linear in the size of m and doesn't
+// change it, but has exclusive access to it.
+func (m *MerkleTree) CheckInvariants() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.hashStats
+	defer func() { m.hashStats = stats }()
+	if m.root == nil {
+		return fmt.Errorf("%w: the tree has no root", ErrBrokenInvariant)
+	}
+	s, err := m.checkNode(m.root, 0, nil)
+	if err != nil {
+		return err
+	}
+	if s.dirtyNodes != len(m.dirty) {
+		return fmt.Errorf("%w: %d of the %d dirty nodes aren't in the tree",
+			ErrBrokenInvariant, len(m.dirty)-s.dirtyNodes, len(m.dirty))
+	}
+	if !s.dirty && m.hash != nil && !bytes.Equal(m.hash, s.hash) {
+		return fmt.Errorf("%w: the tree hash %x isn't that of the root", ErrBrokenInvariant, m.hash)
+	}
+	return nil
+}
+
+// subtree is what checkNode finds out about the subtree rooted at a
+// node: its hash, unless a node in it changed since its hash was last
+// computed, in which case it's dirty, the number of dirty interior
+// nodes in it, and its shape.
+type subtree struct {
+	hash       []byte
+	dirty      bool
+	dirtyNodes int
+	leaves     uint64
+	nodes      uint64
+	depth      uint32
+}
+
+// checkNode checks the invariants of the subtree rooted at n, which is
+// at level on the path with the index prefix prefix.
+func (m *MerkleTree) checkNode(n merkleNode, level uint32, prefix []byte) (subtree, error) {
+	broken := func(format string, args ...interface{}) (subtree, error) {
+		return subtree{}, fmt.Errorf("%w: node at level %d on path %x: %s",
+			ErrBrokenInvariant, level, prefix, fmt.Sprintf(format, args...))
+	}
+	if n.generation() > m.gen {
+		return broken("has the later generation %d", n.generation())
+	}
+	switch n := n.(type) {
+	case *emptyNode:
+		if n.level != level {
+			return broken("empty node has the level %d", n.level)
+		}
+		if level > 0 && !bytes.Equal(n.index, prefix) {
+			return broken("empty node has the index %x", n.index)
+		}
+		return subtree{hash: n.hash(m), nodes: 1}, nil
+	case *userLeafNode:
+		if n.level != level {
+			return broken("user leaf node has the level %d", n.level)
+		}
+		if len(n.index) != m.indexSize {
+			return broken("user leaf node has an index of %d bytes", len(n.index))
+		}
+		for i := uint32(0); i < level; i++ {
+			if conv.GetNthBit(n.index, i) != conv.GetNthBit(prefix, i) {
+				return broken("user leaf node has the index %x", n.index)
+			}
+		}
+		if (len(n.key) > 0 || len(n.value) > 0) && !n.commitment.Verify(n.key, n.value) {
+			return broken("user leaf node has a commitment to another key or value")
+		}
+		if n.changedEpoch < n.addedEpoch {
+			return broken("user leaf node was changed in epoch %d, before it was added in epoch %d",
+				n.changedEpoch, n.addedEpoch)
+		}
+		return subtree{hash: n.hash(m), leaves: 1, nodes: 1, depth: level}, nil
+	case *interiorNode:
+		if n.level != level {
+			return broken("interior node has the level %d", n.level)
+		}
+		if level >= uint32(m.indexSize)*8 {
+			return broken("interior node is below the last level")
+		}
+		s := subtree{nodes: 1}
+		var hashes [2][]byte
+		for i, right := range []bool{false, true} {
+			c, err := m.loadChild(n, right)
+			if err != nil {
+				return broken("loading child %d: %v", i, err)
+			}
+			cs, err := m.checkNode(c, level+1, childPrefix(prefix, level, right))
+			if err != nil {
+				return subtree{}, err
+			}
+			switch h := n.childHash(right); {
+			case m.isDirty(n, right):
+				s.dirty = true
+			case cs.dirty:
+				return broken("interior node has a cached hash of changed child %d", i)
+			case !bytes.Equal(h, cs.hash):
+				return broken("interior node has the wrong cached hash %x of child %d", h, i)
+			}
+			hashes[i] = cs.hash
+			s.dirtyNodes += cs.dirtyNodes
+			s.leaves += cs.leaves
+			s.nodes += cs.nodes
+			if cs.depth > s.depth {
+				s.depth = cs.depth
+			}
+		}
+		if s.dirty {
+			s.dirtyNodes++
+			if n.gen != m.gen {
+				return broken("interior node of generation %d changed", n.gen)
+			}
+			return s, nil
+		}
+		if level > 0 && s.leaves < 2 {
+			return broken("interior node has %d user leaf nodes", s.leaves)
+		}
+		if n.leaves != s.leaves || n.nodes != s.nodes || n.depth != s.depth {
+			return broken("interior node has the cached shape (%d, %d, %d) instead of (%d, %d, %d)",
+				n.leaves, n.nodes, n.depth, s.leaves, s.nodes, s.depth)
+		}
+		s.hash = hashed.Digest(hashes[0], hashes[1])
+		return s, nil
+	default:
+		return broken("unknown node %T", n)
+	}
+}
+
+// loadChild is like MerkleTree.childOf, but always loads the child from
+// m's NodeStore rather than its nodeCache, so that the stored node is
+// the one that's checked.
+func (m *MerkleTree) loadChild(n *interiorNode, right bool) (merkleNode, error) {
+	if c := n.child(right); c != nil {
+		return c, nil
+	}
+	if m.store == nil || n.childHash(right) == nil {
+		return nil, errors.New("the child is missing")
+	}
+	return loadNode(m.store, n.childHash(right))
+}
+
+// CheckInvariants checks the invariants of the trees of the snapshots
+// the PAD keeps in memory, from the oldest to the latest, and then of its
+// pending tree (see MerkleTree.CheckInvariants), loading their nodes
+// from the PAD's NodeStore if it has one. It also checks that the tree of
+// each snapshot has the hash its STR signs. It returns the number of
+// trees it checked, and an error wrapping ErrBrokenInvariant with the
+// epoch of the first tree that's broken. The snapshots in the PAD's
+// SnapshotStore aren't checked.
+func (pad *PAD) CheckInvariants() (int, error) {
+	checked := 0
+	for _, epoch := range pad.loadedEpochs {
+		str := pad.snapshots[epoch]
+		if str == nil || str.tree == nil {
+			continue
+		}
+		if err := str.tree.CheckInvariants(); err != nil {
+			return checked, fmt.Errorf("snapshot of epoch %d: %w", epoch, err)
+		}
+		if !bytes.Equal(str.tree.Hash(), str.TreeHash[:]) {
+			return checked, fmt.Errorf("%w: the tree of epoch %d doesn't have the hash of its STR",
+				ErrBrokenInvariant, epoch)
+		}
+		checked++
+	}
+	if err := pad.tree.CheckInvariants(); err != nil {
+		return checked, fmt.Errorf("pending tree: %w", err)
+	}
+	return checked + 1, nil
+}
@@ -0,0 +1,160 @@
+package merkletree
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckInvariants(t *testing.T) {
+	check := func(name string, m *MerkleTree) {
+		t.Helper()
+		if err := m.CheckInvariants(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("empty", m)
+	m.recomputeHash()
+	check("empty with hash", m)
+	entries := batchEntries(300, 0, valuePrefix)
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	check("stale", m)
+	m.recomputeHash()
+	check("hashed", m)
+
+	c := mustClone(t, m)
+	for _, e := range entries[:20] {
+		if _, err := c.Delete(e.Index); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.SetBatch(batchEntries(10, 1000, valuePrefix)); err != nil {
+		t.Fatal(err)
+	}
+	check("changed clone", c)
+	check("original", m)
+
+	_, next := sortedLeaves(m, false)
+	built, err := NewMerkleTreeFromSorted(MinIndexSize, m.nonce, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("replica", built)
+
+	stats := m.hashStats
+	if err := m.CheckInvariants(); err != nil || m.hashStats != stats {
+		t.Error("Expect the check not to count as hashing work")
+	}
+}
+
+func TestCheckInvariantsNodeStore(t *testing.T) {
+	store := NewMemNodeStore()
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 3, WithNodeStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := pad.Set([]byte(keyPrefix+string(rune('a'+i))), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil)
+	latest := pad.LatestSTR()
+	m, err := LoadMerkleTree(store, latest.TreeHash[:], latest.tree.nonce, pad.indexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if m.root.leftChild != nil || m.root.rightChild != nil {
+		t.Error("Expect the check not to keep the loaded nodes")
+	}
+
+	for h := range store.nodes {
+		delete(store.nodes, h)
+		break
+	}
+	if err := m.CheckInvariants(); !errors.Is(err, ErrBrokenInvariant) {
+		t.Error("Expect", ErrBrokenInvariant, "for a missing node, got", err)
+	}
+}
+
+func TestCheckInvariantsBroken(t *testing.T) {
+	firstLeaf := func(m *MerkleTree) (leaf *userLeafNode) {
+		m.visitLeafNodes(func(n *userLeafNode) {
+			if leaf == nil {
+				leaf = n
+			}
+		})
+		return
+	}
+	for _, tc := range []struct {
+		name    string
+		corrupt func(m *MerkleTree)
+	}{
+		{"tree hash", func(m *MerkleTree) { m.hash[0] ^= 1 }},
+		{"child hash", func(m *MerkleTree) { m.root.leftHash[0] ^= 1 }},
+		{"shape", func(m *MerkleTree) { m.root.leaves++ }},
+		{"level", func(m *MerkleTree) { firstLeaf(m).level++ }},
+		{"index", func(m *MerkleTree) { firstLeaf(m).index[0] ^= 0x80 }},
+		{"index size", func(m *MerkleTree) { leaf := firstLeaf(m); leaf.index = leaf.index[1:] }},
+		{"commitment", func(m *MerkleTree) { firstLeaf(m).value = []byte("other") }},
+		{"epochs", func(m *MerkleTree) { leaf := firstLeaf(m); leaf.addedEpoch = leaf.changedEpoch + 1 }},
+		{"changed shared node", func(m *MerkleTree) {
+			m.Clone()
+			m.root.leftHash = nil
+		}},
+		{"uncollapsed branch", func(m *MerkleTree) {
+			m.root.setChild(true, m.newInteriorNode(1, childPrefix(nil, 0, true)))
+			m.recomputeHash()
+		}},
+	} {
+		m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SetBatch(batchEntries(20, 0, valuePrefix)); err != nil {
+			t.Fatal(err)
+		}
+		m.recomputeHash()
+		tc.corrupt(m)
+		if err := m.CheckInvariants(); !errors.Is(err, ErrBrokenInvariant) {
+			t.Errorf("%s: expect %v, got %v", tc.name, ErrBrokenInvariant, err)
+		}
+	}
+}
+
+func TestPADCheckInvariants(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := pad.Set([]byte(keyPrefix+string(rune('a'+i))), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+	}
+	if n, err := pad.CheckInvariants(); err != nil || n != 5 {
+		t.Fatal("Expect 5 trees checked, got", n, err)
+	}
+
+	// the tree of a snapshot no longer has the hash its STR signs
+	str := pad.GetSTR(2)
+	str.TreeHash[0] ^= 1
+	if n, err := pad.CheckInvariants(); !errors.Is(err, ErrBrokenInvariant) || n != 2 {
+		t.Error("Expect", ErrBrokenInvariant, "after 2 trees, got", n, err)
+	}
+	str.TreeHash[0] ^= 1
+	pad.tree.root.leaves++
+	pad.tree.hash = nil
+	if _, err := pad.CheckInvariants(); !errors.Is(err, ErrBrokenInvariant) {
+		t.Error("Expect", ErrBrokenInvariant, "for the pending tree, got", err)
+	}
+}
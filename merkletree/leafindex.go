@@ -0,0 +1,106 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// WithLeafIndex makes the snapshots of the tree map the lookup index of
+// every user leaf node to the leaf and the interior nodes on its path.
+// Get then finds a bound index with a single map lookup, and collects
+// the hashes of the path by walking it up from the leaf, instead of
+// walking the tree down bit by bit, which cuts the latency of lookups in
+// deep trees. Lookups of unbound indices still walk the tree.
+//
+// Only snapshots have an index, since they never change: a PAD freezes
+// the tree of every STR it signs. The index of a snapshot is built by
+// the first lookup in it, which walks the whole tree, and takes about
+// 50 bytes plus 8 bytes per level for every leaf. A snapshot whose nodes
+// are in a NodeStore keeps the nodes of its index in memory.
+//
+// The clones of the tree have the option too.
+func WithLeafIndex() TreeOption {
+	return func(m *MerkleTree) {
+		m.leafIndexed = true
+	}
+}
+
+// A leafPath is a user leaf node and the interior nodes on its path, by
+// level: path[0] is the root.
+type leafPath struct {
+	leaf *userLeafNode
+	path []*interiorNode
+}
+
+// freeze marks m as a snapshot, which is never changed again, so that it
+// may build a leaf index if it has the option.
+func (m *MerkleTree) freeze() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.frozen = true
+}
+
+// getIndexed returns the AuthenticationPath for lookupIndex from the leaf
+// index of m, building it first if needed. It returns nil if m has no
+// leaf index, or lookupIndex isn't bound in m.
+func (m *MerkleTree) getIndexed(lookupIndex Index) *AuthenticationPath {
+	if !m.frozen || !m.leafIndexed {
+		return nil
+	}
+	m.leavesOnce.Do(m.buildLeafIndex)
+	lp, ok := m.leaves[string(lookupIndex)]
+	if !ok {
+		return nil
+	}
+	authPath := &AuthenticationPath{
+		TreeNonce:   m.nonce,
+		LookupIndex: lookupIndex,
+		PrunedTree:  make([][hashed.HashSizeByte]byte, len(lp.path)),
+		Leaf:        proofNode(lp.leaf, lookupIndex),
+	}
+	for depth := len(lp.path) - 1; depth >= 0; depth-- {
+		direction := conv.GetNthBit(lookupIndex, uint32(depth))
+		copy(authPath.PrunedTree[depth][:], lp.path[depth].childHash(!direction))
+	}
+	return authPath
+}
+
+// buildLeafIndex builds the leaf index of m. The caller must hold m, for
+// reading at least. If a node can't be loaded from m's NodeStore, m is
+// left without a leaf index, so lookups walk the tree instead, and
+// return the error if they need the node too.
+func (m *MerkleTree) buildLeafIndex() {
+	leaves := make(map[string]leafPath, m.root.leaves)
+	if m.indexLeaves(leaves, m.root, nil) == nil {
+		m.leaves = leaves
+	}
+}
+
+// indexLeaves adds the user leaf nodes under n, which is reached through
+// the interior nodes path, to leaves, or returns the error of loading
+// one of them.
+func (m *MerkleTree) indexLeaves(leaves map[string]leafPath, n merkleNode, path []*interiorNode) error {
+	switch n := n.(type) {
+	case *userLeafNode:
+		leaves[string(n.index)] = leafPath{leaf: n, path: append([]*interiorNode(nil), path...)}
+	case *interiorNode:
+		path = append(path, n)
+		for _, right := range []bool{false, true} {
+			child, err := m.childOf(n, right)
+			if err != nil {
+				return err
+			}
+			if err := m.indexLeaves(leaves, child, path); err != nil {
+				return err
+			}
+		}
+	case *emptyNode:
+		// nothing to index
+	default:
+		panic(ErrInvalidTree)
+	}
+	return nil
+}
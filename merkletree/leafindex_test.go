@@ -0,0 +1,71 @@
+package merkletree
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ORBAT/cloniks/conv"
+)
+
+func TestLeafIndex(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10, WithTreeOptions(WithLeafIndex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 200; i++ {
+		if err := pad.Set(conv.UInt32ToBytes(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil)
+	// a change in the pending tree doesn't affect the snapshot's index
+	if err := pad.Set(conv.UInt32ToBytes(0), []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	snap := pad.LatestSTR().tree
+	// a clone isn't frozen, so it walks the tree
+	walked := mustClone(t, snap)
+
+	var wg sync.WaitGroup
+	for i := uint32(0); i < 300; i++ {
+		wg.Add(1)
+		go func(i uint32) {
+			defer wg.Done()
+			key := conv.UInt32ToBytes(i)
+			index, _ := pad.computePrivateIndex(key)
+			got, want := mustGet(t, snap, index), mustGet(t, walked, index)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("key %d: expect %v, got %v", i, want, got)
+				return
+			}
+			var value []byte
+			if i < 200 {
+				value = []byte("value")
+			}
+			if err := got.VerifyBinding(snap.Hash(), got.TreeNonce, index, key, value); err != nil {
+				t.Errorf("key %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(snap.leaves) != 200 {
+		t.Error("Expect", 200, "indexed leaves, got", len(snap.leaves))
+	}
+	if walked.leaves != nil || pad.tree.leaves != nil {
+		t.Error("Expect no index for trees that aren't snapshots")
+	}
+}
+
+func BenchmarkTreeGetLeafIndex(b *testing.B) {
+	m, indices := benchTree(b, 100000)
+	snap := mustClone(b, m)
+	snap.leafIndexed = true
+	snap.freeze()
+	mustGet(b, snap, indices[0]) // build the index
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		snap.Get(indices[i%len(indices)])
+	}
+}
@@ -1,56 +1,160 @@
+//go:build !coniks_client
+// +build !coniks_client
+
 package merkletree
 
 import (
 	"bytes"
-	"errors"
+	"io"
+	"sync"
 
 	"github.com/ORBAT/cloniks/conv"
 	"github.com/ORBAT/cloniks/crypto/hashed"
 )
 
-var (
-	// ErrInvalidTree indicates a panic due to
-	// a malformed operation on the tree.
-	ErrInvalidTree = errors.New("[merkletree] Invalid tree")
-)
-
-const (
-	// EmptyBranchIdentifier is the domain separation prefix for
-	// empty node hashes.
-	EmptyBranchIdentifier = 'E'
-
-	// LeafIdentifier is the domain separation prefix for user
-	// leaf node hashes.
-	LeafIdentifier = 'L'
-)
-
 // MerkleTree represents the Merkle prefix tree data structure,
 // which includes the root node, its hash, and a random tree-specific
 // nonce.
+//
+// A MerkleTree is safe for concurrent use. Lookups such as Get, GetBatch
+// and ForEachLeaf only read the tree, and run concurrently with each
+// other, while changes such as Set and Clone have exclusive access, so
+// a lookup sees the tree either before or after a change. A lookup that
+// needs the hash of the tree computes it first if it's stale, which
+// takes exclusive access too.
 type MerkleTree struct {
-	nonce []byte
-	root  *interiorNode
-	hash  []byte
+	// mu guards the fields of the tree and its nodes: the methods that
+	// change them hold it exclusively, and those that only read them
+	// hold it shared. Unexported methods expect the caller to hold it.
+	mu        sync.RWMutex
+	nonce     []byte
+	root      *interiorNode
+	hash      []byte
+	indexSize int
+	// hashStats counts the hashing work of recomputeHash.
+	hashStats HashStats
+	// dirty are the interior nodes of m whose children changed since
+	// the hash of m was last computed, and the sides that changed.
+	dirty map[*interiorNode]dirtySides
+	// gen is the generation of the nodes m may modify.
+	gen uint64
+	// replaced is the approximate memory footprint of the nodes of
+	// other generations that m replaced or copied since it was last
+	// cloned, i.e. of the nodes it no longer shares with its clones.
+	replaced uint64
+	// store is the NodeStore m loads its nodes from, if any, and cache
+	// the nodes it loaded most recently, which m shares with its clones.
+	store NodeStore
+	cache *nodeCache
+	// released are the hashes of the stored nodes that m replaced since
+	// it was last cloned.
+	released [][]byte
+	// written are the hashes of the nodes Flush wrote to store since m
+	// was last cloned.
+	written [][]byte
+	// epoch is the epoch of the snapshot m becomes, which the leaves
+	// that Set adds or changes record.
+	epoch Epoch
+	// arena allocates the nodes of m, if it has one. See WithNodeArena.
+	arena *nodeArena
+	// leafIndexed is set if the snapshots of m have a leaf index, and
+	// frozen if m is such a snapshot. See WithLeafIndex.
+	leafIndexed bool
+	frozen      bool
+	// leaves is the leaf index of m, which leavesOnce builds.
+	leaves     map[string]leafPath
+	leavesOnce sync.Once
+	// rand is the source of the nonce and the salts of m, if it isn't
+	// the default. See WithRandomness.
+	rand io.Reader
 }
 
 // NewMerkleTree returns an empty Merkle prefix tree
 // with a secure random nonce. The tree root is an interior node
 // and its children are two empty leaf nodes.
+// The tree accepts indices of DefaultIndexSize bytes.
 func NewMerkleTree() (*MerkleTree, error) {
-	root := newInteriorNode(nil, 0, []bool{})
-	nonce := hashed.RandSlice()
+	return NewMerkleTreeWithIndexSize(DefaultIndexSize)
+}
+
+// NewMerkleTreeWithIndexSize is like NewMerkleTree, but the returned
+// tree accepts indices of indexSize bytes, and has the optional
+// parameters opts.
+// It returns ErrInvalidIndexSize if indexSize is not in
+// [MinIndexSize, DefaultIndexSize].
+func NewMerkleTreeWithIndexSize(indexSize int, opts ...TreeOption) (*MerkleTree, error) {
+	if indexSize < MinIndexSize || indexSize > DefaultIndexSize {
+		return nil, ErrInvalidIndexSize
+	}
 	m := &MerkleTree{
-		nonce: nonce,
-		root:  root,
+		indexSize: indexSize,
+		gen:       nextGen(),
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.nonce = randSlice(m.rand)
+	m.root = m.newInteriorNode(0, nil)
 	return m, nil
 }
 
+// Hash returns the root hash of m, which it computes first if m changed
+// since it was last computed, or nil if it can't, because the nodes it
+// needs can't be loaded from m's NodeStore (see Refresh).
+func (m *MerkleTree) Hash() []byte {
+	if err := m.rlockFresh(); err != nil {
+		return nil
+	}
+	defer m.mu.RUnlock()
+	return m.hash
+}
+
+// rlockFresh locks m for reading once its hash is up to date, which it
+// computes first if m is stale. The caller must RUnlock m, unless
+// rlockFresh returns the error of computing the hash, in which case m
+// isn't locked.
+func (m *MerkleTree) rlockFresh() error {
+	m.mu.RLock()
+	for m.stale() {
+		m.mu.RUnlock()
+		m.mu.Lock()
+		if m.stale() {
+			if _, err := m.recomputeHash(); err != nil {
+				m.mu.Unlock()
+				return err
+			}
+		}
+		m.mu.Unlock()
+		m.mu.RLock()
+	}
+	return nil
+}
+
+// IndexSize returns the size in bytes of the indices m accepts.
+func (m *MerkleTree) IndexSize() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.indexSize
+}
+
 // Get returns an AuthenticationPath used as a proof of inclusion/absence for the requested
-// lookupIndex.
-func (m *MerkleTree) Get(lookupIndex []byte) *AuthenticationPath {
-	lookupIndexBits := conv.ToBits(lookupIndex)
-	depth := 0
+// lookupIndex. It computes the hash of m first if it's stale, so that
+// the path proves the lookup against Hash(). Get returns an error
+// wrapping ErrNodeLoad if a node on the path can't be loaded from m's
+// NodeStore.
+func (m *MerkleTree) Get(lookupIndex Index) (*AuthenticationPath, error) {
+	if err := m.rlockFresh(); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+	return m.get(lookupIndex)
+}
+
+func (m *MerkleTree) get(lookupIndex Index) (*AuthenticationPath, error) {
+	if authPath := m.getIndexed(lookupIndex); authPath != nil {
+		return authPath, nil
+	}
+	var depth uint32 // = 0
 	var nodePointer merkleNode
 	nodePointer = m.root
 
@@ -66,15 +170,15 @@ func (m *MerkleTree) Get(lookupIndex []byte) *AuthenticationPath {
 			break searchLoop
 		}
 
-		direction := lookupIndexBits[depth]
+		direction := conv.GetNthBit(lookupIndex, depth)
 		var hashArr [hashed.HashSizeByte]byte
-		if direction {
-			copy(hashArr[:], nodePointer.(*interiorNode).leftHash)
-			nodePointer = nodePointer.(*interiorNode).rightChild
-		} else {
-			copy(hashArr[:], nodePointer.(*interiorNode).rightHash)
-			nodePointer = nodePointer.(*interiorNode).leftChild
+		n := nodePointer.(*interiorNode)
+		copy(hashArr[:], n.childHash(!direction))
+		child, err := m.childOf(n, direction)
+		if err != nil {
+			return nil, err
 		}
+		nodePointer = child
 		authPath.PrunedTree = append(authPath.PrunedTree, hashArr)
 		depth++
 	}
@@ -83,33 +187,42 @@ func (m *MerkleTree) Get(lookupIndex []byte) *AuthenticationPath {
 		panic(ErrInvalidTree)
 	}
 
-	switch nodePointer.kind() {
+	authPath.Leaf = proofNode(nodePointer, lookupIndex)
+	return authPath, nil
+}
+
+// proofNode returns the ProofNode of the leaf or empty branch n, in which
+// the search for lookupIndex ended. If n is a different leaf with
+// a matching prefix, the ProofNode doesn't open its commitment.
+func proofNode(n merkleNode, lookupIndex Index) *ProofNode {
+	switch n.kind() {
 	case userLeafNodeKind:
-		pNode := nodePointer.(*userLeafNode)
-		authPath.Leaf = &ProofNode{
-			Level:   pNode.level,
-			Index:   pNode.index,
-			Value:   pNode.value,
-			IsEmpty: false,
-			Commitment: pNode.commitment,
+		pNode := n.(*userLeafNode)
+		leaf := &ProofNode{
+			Level:        pNode.level,
+			Index:        pNode.index,
+			Value:        pNode.value,
+			IsEmpty:      false,
+			Commitment:   pNode.commitment,
+			AddedEpoch:   pNode.addedEpoch,
+			ChangedEpoch: pNode.changedEpoch,
 		}
 		if bytes.Equal(pNode.index, lookupIndex) {
-			return authPath
+			return leaf
 		}
 		// reached a different leaf with a matching prefix
-		// return a auth path including the leaf node without salt & value
-		authPath.Leaf.Value = nil
-		authPath.Leaf.Commitment.Salt = nil
-		return authPath
+		// return the leaf node without salt & value
+		leaf.Value = nil
+		leaf.Commitment.Salt = nil
+		return leaf
 	case emptyNodeKind:
-		pNode := nodePointer.(*emptyNode)
-		authPath.Leaf = &ProofNode{
-			Level:      pNode.level,
-			Index:      pNode.index,
-			Value:      nil,
-			IsEmpty:    true,
+		pNode := n.(*emptyNode)
+		return &ProofNode{
+			Level:   pNode.level,
+			Index:   pNode.index,
+			Value:   nil,
+			IsEmpty: true,
 		}
-		return authPath
 	}
 	panic(ErrInvalidTree)
 }
@@ -117,129 +230,250 @@ func (m *MerkleTree) Get(lookupIndex []byte) *AuthenticationPath {
 // Set inserts or updates the key and value of the given index. It will generate a new commitment
 // for the leaf node. In the case of an update, the leaf node's value and
 // commitment are replaced with the new value and newly generated
-// commitment.
-func (m *MerkleTree) Set(index []byte, key string, value []byte) error {
-	// TODO: see todo note in userLeafNode
-	commitment := hashed.NewCommit([]byte(key), value)
-	toAdd := userLeafNode{
-		key:        key,
+// commitment. The leaf records the epoch of m as the epoch in which the
+// key was added, unless it was already bound, and in which it was
+// changed, unless it was already bound to value.
+//
+// Set returns ErrIndexLength if index isn't IndexSize() bytes long,
+// ErrIndexCollision if index is already bound to a different key, and
+// an error wrapping ErrNodeLoad if a node on the path to index can't be
+// loaded from m's NodeStore, in which case m is left as it was.
+func (m *MerkleTree) Set(index Index, key, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := index.Validate(m.indexSize); err != nil {
+		return err
+	}
+	commitment := newCommit(m.rand, key, value)
+	toAdd := m.arena.leaf()
+	*toAdd = userLeafNode{
+		key:        copyOfBs(key),
 		value:      copyOfBs(value),
 		index:      index,
 		commitment: commitment,
 	}
-	m.insertNode(index, &toAdd)
-	return nil
+	existing, err := m.leafAt(index)
+	if err != nil {
+		return err
+	}
+	m.stamp(toAdd, existing)
+	return m.insertNode(index, toAdd, existing)
 }
 
-func (m *MerkleTree) insertNode(index []byte, toAdd *userLeafNode) {
-	indexBits := conv.ToBits(index)
-	var depth uint32 // = 0
-	var nodePointer merkleNode
-	nodePointer = m.root
+// stamp sets the epochs of leaf, which replaces existing if that isn't
+// nil, to the epoch of m, or keeps those of existing if leaf binds the
+// same key, or the same key and value.
+func (m *MerkleTree) stamp(leaf, existing *userLeafNode) {
+	leaf.addedEpoch, leaf.changedEpoch = m.epoch, m.epoch
+	if existing == nil || !bytes.Equal(existing.key, leaf.key) {
+		return
+	}
+	leaf.addedEpoch = existing.addedEpoch
+	if bytes.Equal(existing.value, leaf.value) {
+		leaf.changedEpoch = existing.changedEpoch
+	}
+}
 
-insertLoop:
-	for {
-		switch nodePointer.kind() {
-		case userLeafNodeKind:
+// insertNode inserts toAdd at index, where existing is the leaf that
+// leafAt found there. If a node on the path can't be loaded, the nodes
+// insertNode copied so far are equivalent to those they replaced, so m
+// keeps the same leaves.
+func (m *MerkleTree) insertNode(index []byte, toAdd, existing *userLeafNode) error {
+	if existing != nil && !bytes.Equal(existing.key, toAdd.key) {
+		return ErrIndexCollision
+	}
+	toAdd.gen = m.gen
+	m.ownRoot()
+	// n is at level depth
+	n := m.root
+	for depth := uint32(0); ; depth++ {
+		direction := conv.GetNthBit(index, depth)
+		child, err := m.childOf(n, direction)
+		if err != nil {
+			return err
+		}
+		switch child := child.(type) {
+		case *interiorNode:
+			child = m.ownInterior(child)
+			m.setChild(n, direction, child)
+			n = child
+		case *emptyNode:
+			m.drop(child)
+			toAdd.level = depth + 1
+			m.setChild(n, direction, toAdd)
+			return nil
+		case *userLeafNode:
+			if bytes.Equal(child.index, toAdd.index) {
+				// replace the leaf
+				m.drop(child)
+				toAdd.level = child.level
+				m.setChild(n, direction, toAdd)
+				return nil
+			}
 			// reached a "bottom" of the tree.
 			// add a new interior node and push the previous leaf down
 			// then continue insertion
-			currentNodeUL := nodePointer.(*userLeafNode)
-			if currentNodeUL.parent == nil {
-				panic(ErrInvalidTree)
-			}
-
-			if bytes.Equal(currentNodeUL.index, toAdd.index) {
-				// replace the value
-				toAdd.parent = currentNodeUL.parent
-				toAdd.level = currentNodeUL.level
-				*currentNodeUL = *toAdd
-				return
-			}
-
-			newInteriorNode := newInteriorNode(currentNodeUL.parent, depth, indexBits[:depth])
-
-			direction := conv.GetNthBit(currentNodeUL.index, depth)
-			if direction {
-				newInteriorNode.rightChild = currentNodeUL
-			} else {
-				newInteriorNode.leftChild = currentNodeUL
-			}
-			currentNodeUL.level = depth + 1
-			currentNodeUL.parent = newInteriorNode
-
-			if parent := newInteriorNode.parent.(*interiorNode); parent.leftChild == nodePointer {
-				parent.leftChild = newInteriorNode
-			} else {
-				parent.rightChild = newInteriorNode
-			}
-			nodePointer = newInteriorNode
-		case interiorNodeKind:
-			currentNodeI := nodePointer.(*interiorNode)
-			direction := indexBits[depth]
-			if direction { // go right
-				currentNodeI.rightHash = nil
-				if isEmpty(currentNodeI.rightChild) {
-					currentNodeI.rightChild = toAdd
-					toAdd.level = depth + 1
-					toAdd.parent = currentNodeI
-					break insertLoop
-				} else {
-					nodePointer = currentNodeI.rightChild
-				}
-			} else { // go left
-				currentNodeI.leftHash = nil
-				if isEmpty(currentNodeI.leftChild) {
-					currentNodeI.leftChild = toAdd
-					toAdd.level = depth + 1
-					toAdd.parent = currentNodeI
-					break insertLoop
-				} else {
-					nodePointer = currentNodeI.leftChild
-				}
-			}
-			depth += 1
+			newInteriorNode := m.newInteriorNode(depth+1, index)
+			leaf := m.ownLeaf(child)
+			leaf.level = depth + 2
+			m.setChild(newInteriorNode, conv.GetNthBit(leaf.index, depth+1), leaf)
+			m.setChild(n, direction, newInteriorNode)
+			n = newInteriorNode
 		default:
 			panic(ErrInvalidTree)
 		}
 	}
 }
 
+// ownInterior returns n if m may modify it, and otherwise a copy of n
+// that m may modify, which the caller must link in place of n.
+func (m *MerkleTree) ownInterior(n *interiorNode) *interiorNode {
+	if n.gen == m.gen {
+		return n
+	}
+	m.drop(n)
+	c := m.arena.interior()
+	*c = *n
+	c.gen = m.gen
+	return c
+}
+
+// drop accounts for n being removed from m.
+func (m *MerkleTree) drop(n merkleNode) {
+	if g := n.generation(); g != m.gen && g != storedGen {
+		m.replaced += nodeBytes(n)
+	}
+}
+
+// ownLeaf is ownInterior for user leaf nodes.
+func (m *MerkleTree) ownLeaf(n *userLeafNode) *userLeafNode {
+	if n.gen == m.gen {
+		return n
+	}
+	m.drop(n)
+	c := m.arena.leaf()
+	*c = *n
+	c.gen = m.gen
+	return c
+}
+
 // visits all leaf-nodes and calls callBack on each of them
 // doesn't modify the underlying tree m
-func (m *MerkleTree) visitLeafNodes(callBack func(*userLeafNode)) {
-	visitULNsInternal(m.root, callBack)
+// or returns the error of loading one of them from m's NodeStore
+func (m *MerkleTree) visitLeafNodes(callBack func(*userLeafNode)) error {
+	return m.visitULNsInternal(m.root, callBack)
 }
 
-func visitULNsInternal(nodePtr merkleNode, callBack func(*userLeafNode)) {
+func (m *MerkleTree) visitULNsInternal(nodePtr merkleNode, callBack func(*userLeafNode)) error {
 	switch nodePtr.kind() {
 	case userLeafNodeKind:
 		callBack(nodePtr.(*userLeafNode))
 	case interiorNodeKind:
-		if leftChild := nodePtr.(*interiorNode).leftChild; leftChild != nil {
-			visitULNsInternal(leftChild, callBack)
-		}
-		if rightChild := nodePtr.(*interiorNode).rightChild; rightChild != nil {
-			visitULNsInternal(rightChild, callBack)
+		for _, right := range []bool{false, true} {
+			child, err := m.childOf(nodePtr.(*interiorNode), right)
+			if err != nil {
+				return err
+			}
+			if err := m.visitULNsInternal(child, callBack); err != nil {
+				return err
+			}
 		}
 	case emptyNodeKind:
 		// do nothing
 	default:
 		panic(ErrInvalidTree)
 	}
+	return nil
+}
+
+// shape returns the level of the deepest user leaf node in m
+// and the number of user leaf nodes in m. They're cached along with the
+// hashes of the nodes, so m is only walked if its hash is stale, which
+// the callers only allow if m has no NodeStore, so the walk can't fail.
+func (m *MerkleTree) shape() (maxDepth uint32, leaves uint64) {
+	if !m.stale() {
+		return m.root.depth, m.root.leaves
+	}
+	_ = m.visitLeafNodes(func(n *userLeafNode) {
+		leaves++
+		if n.level > maxDepth {
+			maxDepth = n.level
+		}
+	})
+	return
+}
+
+// stale returns true iff m changed since its hash was last computed.
+func (m *MerkleTree) stale() bool {
+	return m.hash == nil || len(m.dirty) > 0
+}
+
+// Refresh brings the hash of m up to date with its changes, and returns
+// the work it took. A change records the interior nodes on its path in
+// the dirty nodes of m, along with the sides of their changed children,
+// so only those nodes are rehashed, and a tree that didn't change since
+// its hash was last computed isn't visited at all. m can thus be refreshed cheaply
+// at any time, e.g. to serve proofs with Get, which needs a fresh hash,
+// before m is snapshotted. Refresh returns an error wrapping ErrNodeLoad
+// if a node it needs can't be loaded from m's NodeStore, in which case
+// m stays stale.
+func (m *MerkleTree) Refresh() (HashStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.stale() {
+		return HashStats{}, nil
+	}
+	return m.recomputeHash()
 }
 
-func (m *MerkleTree) recomputeHash() {
+// recomputeHash computes the hash of m, and returns the work it took, or
+// the error of loading a node it needs, in which case m stays stale.
+func (m *MerkleTree) recomputeHash() (HashStats, error) {
+	m.hashStats = HashStats{}
+	if m.dirty[m.root] == 0 {
+		// nothing changed, so the root reuses the hashes of its children
+		m.hashStats.Reused += 2
+	}
+	if err := m.rehashDirty(); err != nil {
+		return m.hashStats, err
+	}
 	m.hash = m.root.hash(m)
+	return m.hashStats, nil
 }
 
 // Clone returns a copy of the tree m.
 // Any later change to the original tree m does not affect the cloned tree,
 // and vice versa.
-func (m *MerkleTree) Clone() *MerkleTree {
-	return &MerkleTree{
-		nonce: copyOfBs(m.nonce),
-		root:  m.root.clone(nil).(*interiorNode),
-		hash:  copyOfBs(m.hash),
+//
+// The trees share their nodes, so Clone takes constant time and memory:
+// each tree copies the nodes on the paths it changes afterwards, and
+// only them. Clone computes the hash of m if it's stale, so that the
+// shared nodes never change, and returns an error wrapping ErrNodeLoad
+// if it can't, like Refresh.
+func (m *MerkleTree) Clone() (*MerkleTree, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stale() {
+		if _, err := m.recomputeHash(); err != nil {
+			return nil, err
+		}
 	}
+	m.gen = nextGen()
+	m.replaced = 0
+	m.released = nil
+	m.written = nil
+	return &MerkleTree{
+		nonce:     copyOfBs(m.nonce),
+		root:      m.root,
+		hash:      copyOfBs(m.hash),
+		indexSize: m.indexSize,
+		gen:       nextGen(),
+		store:     m.store,
+		cache:     m.cache,
+		epoch:     m.epoch,
+		arena:     m.arena.fresh(),
+
+		leafIndexed: m.leafIndexed,
+		rand:        m.rand,
+	}, nil
 }
@@ -2,6 +2,8 @@ package merkletree
 
 import (
 	"bytes"
+	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/ORBAT/cloniks/conv"
@@ -22,7 +24,7 @@ func TestOneEntry(t *testing.T) {
 	val := []byte("value")
 	index := staticVRFKey.Compute([]byte(key))
 	t.Logf("idx %x", index)
-	if err := m.Set(index, key, val); err != nil {
+	if err := m.Set(index, []byte(key), val); err != nil {
 		t.Fatal(err)
 	}
 	m.recomputeHash()
@@ -40,7 +42,7 @@ func TestOneEntry(t *testing.T) {
 			"get", m.root.leftHash)
 	}
 
-	r := m.Get(index)
+	r := mustGet(t, m, index)
 	if r.Leaf.Value == nil {
 		t.Error("Cannot find value of key:", key)
 		return
@@ -63,6 +65,8 @@ func TestOneEntry(t *testing.T) {
 	h.Write(m.nonce)
 	h.Write(index)
 	h.Write(conv.UInt32ToBytes(1))
+	h.Write(Epoch(0).Bytes())
+	h.Write(Epoch(0).Bytes())
 	h.Write(commit[:])
 	h.Digest().Read(expect[:])
 
@@ -72,7 +76,7 @@ func TestOneEntry(t *testing.T) {
 			"get", m.root.leftHash)
 	}
 
-	r = m.Get([]byte("abc"))
+	r = mustGet(t, m, []byte("abc"))
 	if r.Leaf.Value != nil {
 		t.Error("Invalid look-up operation:", key)
 		return
@@ -92,20 +96,20 @@ func TestTwoEntries(t *testing.T) {
 	index2 := staticVRFKey.Compute([]byte(key2))
 	val2 := []byte("value2")
 
-	if err := m.Set(index1, key1, val1); err != nil {
+	if err := m.Set(index1, []byte(key1), val1); err != nil {
 		t.Fatal(err)
 	}
-	if err := m.Set(index2, key2, val2); err != nil {
+	if err := m.Set(index2, []byte(key2), val2); err != nil {
 		t.Fatal(err)
 	}
 
-	ap1 := m.Get(index1)
+	ap1 := mustGet(t, m, index1)
 	if ap1.Leaf.Value == nil {
 		t.Error("Cannot find key:", key1)
 		return
 	}
 
-	ap2 := m.Get(index2)
+	ap2 := mustGet(t, m, index2)
 	if ap2.Leaf.Value == nil {
 		t.Error("Cannot find key:", key2)
 		return
@@ -135,27 +139,27 @@ func TestThreeEntries(t *testing.T) {
 	index3 := staticVRFKey.Compute([]byte(key3))
 	val3 := []byte("value3")
 
-	if err := m.Set(index1, key1, val1); err != nil {
+	if err := m.Set(index1, []byte(key1), val1); err != nil {
 		t.Fatal(err)
 	}
-	if err := m.Set(index2, key2, val2); err != nil {
+	if err := m.Set(index2, []byte(key2), val2); err != nil {
 		t.Fatal(err)
 	}
-	if err := m.Set(index3, key3, val3); err != nil {
+	if err := m.Set(index3, []byte(key3), val3); err != nil {
 		t.Fatal(err)
 	}
 
-	ap1 := m.Get(index1)
+	ap1 := mustGet(t, m, index1)
 	if ap1.Leaf.Value == nil {
 		t.Error("Cannot find key:", index1)
 		return
 	}
-	ap2 := m.Get(index2)
+	ap2 := mustGet(t, m, index2)
 	if ap2.Leaf.Value == nil {
 		t.Error("Cannot find key:", index2)
 		return
 	}
-	ap3 := m.Get(index3)
+	ap3 := mustGet(t, m, index3)
 	if ap3.Leaf.Value == nil {
 		t.Error("Cannot find key:", index3)
 		return
@@ -193,16 +197,16 @@ func TestInsertExistedKey(t *testing.T) {
 	index1 := staticVRFKey.Compute([]byte(key1))
 	val1 := append([]byte(nil), "value"...)
 
-	if err := m.Set(index1, key1, val1); err != nil {
+	if err := m.Set(index1, []byte(key1), val1); err != nil {
 		t.Fatal(err)
 	}
 
 	val2 := []byte("new value")
-	if err := m.Set(index1, key1, val2); err != nil {
+	if err := m.Set(index1, []byte(key1), val2); err != nil {
 		t.Fatal(err)
 	}
 
-	ap := m.Get(index1)
+	ap := mustGet(t, m, index1)
 	if ap.Leaf.Value == nil {
 		t.Error("Cannot find key:", key1)
 		return
@@ -217,11 +221,11 @@ func TestInsertExistedKey(t *testing.T) {
 	}
 
 	val3 := []byte("new value 2")
-	if err := m.Set(index1, key1, val3); err != nil {
+	if err := m.Set(index1, []byte(key1), val3); err != nil {
 		t.Fatal(err)
 	}
 
-	ap = m.Get(index1)
+	ap = mustGet(t, m, index1)
 	if ap.Leaf.Value == nil {
 		t.Error("Cannot find key:", key1)
 		return
@@ -244,15 +248,15 @@ func TestTreeClone(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := m1.Set(index1, key1, val1); err != nil {
+	if err := m1.Set(index1, []byte(key1), val1); err != nil {
 		t.Fatal(err)
 	}
 	m1.recomputeHash()
 
 	// clone new tree and insert new value
-	m2 := m1.Clone()
+	m2 := mustClone(t, m1)
 
-	if err := m2.Set(index2, key2, val2); err != nil {
+	if err := m2.Set(index2, []byte(key2), val2); err != nil {
 		t.Fatal(err)
 	}
 	m2.recomputeHash()
@@ -268,7 +272,7 @@ func TestTreeClone(t *testing.T) {
 	}*/
 
 	// lookup
-	ap := m2.Get(index1)
+	ap := mustGet(t, m2, index1)
 	if ap.Leaf.Value == nil {
 		t.Error("Cannot find key:", key1)
 		return
@@ -277,7 +281,7 @@ func TestTreeClone(t *testing.T) {
 		t.Error(key1, "value mismatch\n")
 	}
 
-	ap = m2.Get(index2)
+	ap = mustGet(t, m2, index2)
 	if ap.Leaf.Value == nil {
 		t.Error("Cannot find key:", key2)
 		return
@@ -286,8 +290,427 @@ func TestTreeClone(t *testing.T) {
 		t.Error(key2, "value mismatch\n")
 	}
 
-	ap = m1.Get(index2)
-	if ap.ProofType() != ProofOfAbsence {
+	ap = mustGet(t, m1, index2)
+	if !ap.ProofType().IsAbsence() {
 		t.Error("wasn't supposed to find this in the old tree")
 	}
 }
+
+func TestTreeCloneSharesNodes(t *testing.T) {
+	m1, err := NewMerkleTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(0); i < 100; i++ {
+		if err := m1.Set(hashed.Digest(conv.UInt32ToBytes(i)), conv.UInt32ToBytes(i), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m2 := mustClone(t, m1)
+	hash := copyOfBs(m1.hash)
+	index := hashed.Digest(conv.UInt32ToBytes(0))
+	if err := m2.Set(index, conv.UInt32ToBytes(0), []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	m2.recomputeHash()
+
+	var visit func(n merkleNode, f func(merkleNode))
+	visit = func(n merkleNode, f func(merkleNode)) {
+		f(n)
+		if n, ok := n.(*interiorNode); ok {
+			visit(n.leftChild, f)
+			visit(n.rightChild, f)
+		}
+	}
+	shared := make(map[merkleNode]bool)
+	visit(m1.root, func(n merkleNode) { shared[n] = true })
+	var copied uint32
+	visit(m2.root, func(n merkleNode) {
+		if !shared[n] {
+			copied++
+		}
+	})
+	// only the path to the changed leaf is copied: the interior nodes
+	// above it and the leaf itself
+	if level := mustGet(t, m2, index).Leaf.Level; copied != level+1 {
+		t.Error("Expect", level+1, "copied nodes, got", copied)
+	}
+
+	if !bytes.Equal(m1.hash, hash) || !bytes.Equal(mustGet(t, m1, index).Leaf.Value, valuePrefix) {
+		t.Error("Expect the original tree to be unchanged")
+	}
+	if bytes.Equal(m2.hash, hash) || !bytes.Equal(mustGet(t, m2, index).Leaf.Value, []byte("new value")) {
+		t.Error("Expect the clone to be changed")
+	}
+}
+
+func TestSetIndexLengthAndCollision(t *testing.T) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := staticVRFKey.Compute([]byte("key"))
+	if err := m.Set(index, []byte("key"), []byte("value")); err != ErrIndexLength {
+		t.Fatal("Expect", ErrIndexLength, "got", err)
+	}
+
+	index = index[:MinIndexSize]
+	if err := m.Set(index, []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(index, []byte("other key"), []byte("value")); err != ErrIndexCollision {
+		t.Fatal("Expect", ErrIndexCollision, "got", err)
+	}
+	if err := m.Set(index, []byte("key"), []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChildPrefix(t *testing.T) {
+	index := hashed.Digest([]byte("index"))
+	bits := conv.ToBits(index)
+	for level := uint32(0); level < uint32(len(bits)); level++ {
+		for _, right := range []bool{false, true} {
+			want := conv.ToBytes(append(append([]bool{}, bits[:level]...), right))
+			if got := childPrefix(index, level, right); !bytes.Equal(got, want) {
+				t.Fatalf("level %d, right %v: expect %x, got %x", level, right, want, got)
+			}
+		}
+	}
+	if got := childPrefix(nil, 0, true); !bytes.Equal(got, []byte{0x80}) {
+		t.Errorf("Expect 80 for the root, got %x", got)
+	}
+}
+
+// benchTree returns a tree with n bindings and their indices.
+func benchTree(b *testing.B, n int) (*MerkleTree, [][]byte) {
+	m, err := NewMerkleTree()
+	if err != nil {
+		b.Fatal(err)
+	}
+	indices := make([][]byte, n)
+	for i := range indices {
+		indices[i] = hashed.Digest(conv.UInt32ToBytes(uint32(i)))
+		if err := m.Set(indices[i], conv.UInt32ToBytes(uint32(i)), valuePrefix); err != nil {
+			b.Fatal(err)
+		}
+	}
+	m.recomputeHash()
+	return m, indices
+}
+
+func BenchmarkTreeGet(b *testing.B) {
+	m, indices := benchTree(b, 100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Get(indices[i%len(indices)])
+	}
+}
+
+func BenchmarkTreeCloneAndSet(b *testing.B) {
+	m, indices := benchTree(b, 100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// a snapshot followed by a change only copies the changed path
+		m.Clone()
+		if err := m.Set(indices[i%len(indices)], conv.UInt32ToBytes(uint32(i%len(indices))), valuePrefix); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTreeSet(b *testing.B) {
+	m, indices := benchTree(b, 100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// replacing values walks the whole path without growing the tree
+		if err := m.Set(indices[i%len(indices)], conv.UInt32ToBytes(uint32(i%len(indices))), valuePrefix); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestForEachLeaf(t *testing.T) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more, err := m.ForEachLeaf(func(key, value []byte, index Index) bool {
+		t.Fatal("Unexpected leaf in an empty tree")
+		return true
+	}); err != nil || !more {
+		t.Error("Expect an empty tree to be iterated to the end")
+	}
+
+	entries := batchEntries(100, 0, valuePrefix)
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]bool)
+	var prev Index
+	if more, err := m.ForEachLeaf(func(key, value []byte, index Index) bool {
+		if prev != nil && bytes.Compare(prev, index) >= 0 {
+			t.Fatalf("Expect leaves in index order, got %x after %x", index, prev)
+		}
+		if !bytes.Equal(value, valuePrefix) {
+			t.Fatalf("Unexpected value %q", value)
+		}
+		prev = index
+		keys[string(key)] = true
+		return true
+	}); err != nil || !more {
+		t.Error("Expect the tree to be iterated to the end")
+	}
+	if len(keys) != len(entries) {
+		t.Fatalf("Expect %d leaves, got %d", len(entries), len(keys))
+	}
+	for _, e := range entries {
+		if !keys[string(e.Key)] {
+			t.Fatalf("Missing key %x", e.Key)
+		}
+	}
+
+	visited := 0
+	if more, err := m.ForEachLeaf(func(key, value []byte, index Index) bool {
+		visited++
+		return visited < 10
+	}); err != nil || more {
+		t.Error("Expect ForEachLeaf to report stopping early")
+	}
+	if visited != 10 {
+		t.Errorf("Expect 10 leaves to be visited, got %d", visited)
+	}
+}
+
+func TestLeafEpochs(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epochs := func(key string) (Epoch, Epoch) {
+		ap, err := pad.Lookup([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ap.Verify([]byte(key), ap.Leaf.Value, pad.LatestSTR().TreeHash[:]); err != nil {
+			t.Fatal(err)
+		}
+		return ap.Leaf.AddedEpoch, ap.Leaf.ChangedEpoch
+	}
+	check := func(key string, added, changed Epoch) {
+		t.Helper()
+		if a, c := epochs(key); a != added || c != changed {
+			t.Errorf("Expect %s to be added in epoch %d and changed in %d, got %d and %d",
+				key, added, changed, a, c)
+		}
+	}
+
+	if err := pad.Set([]byte("alice"), []byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	check("alice", 1, 1)
+
+	// setting the same value again doesn't change the binding
+	if err := pad.Set([]byte("alice"), []byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.SetBatch([]Entry{{Key: []byte("bob"), Value: []byte("key1")}}); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	check("alice", 1, 1)
+	check("bob", 2, 2)
+
+	if err := pad.Set([]byte("alice"), []byte("key2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.SetBatch([]Entry{{Key: []byte("bob"), Value: []byte("key1")}}); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	check("alice", 1, 3)
+	check("bob", 2, 2)
+
+	// the leaves keep their epochs across a reshuffle and serialization
+	if err := pad.reshuffle(); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	check("alice", 1, 3)
+	var read MerkleTree
+	bs, err := pad.latestSTR.tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := read.UnmarshalBinary(bs); err != nil {
+		t.Fatal(err)
+	}
+	if leaf := mustGet(t, &read, pad.Index([]byte("alice"))).Leaf; leaf.AddedEpoch != 1 || leaf.ChangedEpoch != 3 {
+		t.Errorf("Expect the epochs 1 and 3 after reading the tree, got %d and %d",
+			leaf.AddedEpoch, leaf.ChangedEpoch)
+	}
+}
+
+// TestConcurrentLookups looks up bindings while others are set, which the
+// race detector checks (go test -race).
+func TestConcurrentLookups(t *testing.T) {
+	for _, store := range []NodeStore{nil, NewMemNodeStore()} {
+		m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store != nil {
+			// and share the cache of loaded nodes
+			m.store, m.cache = store, newNodeCache(DefaultNodeCacheSize)
+		}
+		existing := batchEntries(100, 0, valuePrefix)
+		if err := m.SetBatch(existing); err != nil {
+			t.Fatal(err)
+		}
+		// with a NodeStore, the lookups load the nodes concurrently
+		if err := m.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		added := batchEntries(100, len(existing), valuePrefix)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for i := r; i < 2*len(existing); i += 4 {
+					e := existing[i%len(existing)]
+					ap, err := m.Get(e.Index)
+					if err == nil {
+						err = ap.Verify(e.Key, e.Value, ap.authPathHash())
+					}
+					if err != nil {
+						errs <- fmt.Errorf("lookup %d: %v", i, err)
+						return
+					}
+					if mp, err := m.GetBatch([][]byte{e.Index}); err != nil || mp.Leaves[0].Index == nil {
+						errs <- fmt.Errorf("batch lookup %d: no leaf: %v", i, err)
+						return
+					}
+					if i%20 == r {
+						leaves := 0
+						if _, err := m.ForEachLeaf(func(key, value []byte, index Index) bool {
+							leaves++
+							return true
+						}); err != nil {
+							errs <- fmt.Errorf("lookup %d: %v", i, err)
+							return
+						}
+						if st, err := m.Stats(); err != nil || leaves < len(existing) || st.Leaves < uint64(len(existing)) {
+							errs <- fmt.Errorf("lookup %d: %d leaves", i, leaves)
+							return
+						}
+						m.Hash()
+					}
+				}
+			}(r)
+		}
+		for i, e := range added {
+			if err := m.Set(e.Index, e.Key, e.Value); err != nil {
+				t.Fatal(err)
+			}
+			if i%10 == 0 {
+				m.Clone()
+				if err := m.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		hash := m.Hash()
+		for _, e := range append(existing, added...) {
+			if err := mustGet(t, m, e.Index).Verify(e.Key, e.Value, hash); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.CheckInvariants(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// mustGet is MerkleTree.Get for tests whose lookups can't fail.
+func mustGet(t testing.TB, m *MerkleTree, index Index) *AuthenticationPath {
+	t.Helper()
+	ap, err := m.Get(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ap
+}
+
+// mustGetBatch is MerkleTree.GetBatch for tests whose lookups can't fail.
+func mustGetBatch(t testing.TB, m *MerkleTree, indices [][]byte) *MultiAuthPath {
+	t.Helper()
+	mp, err := m.GetBatch(indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mp
+}
+
+// mustClone is MerkleTree.Clone for tests whose trees can be hashed.
+func mustClone(t testing.TB, m *MerkleTree) *MerkleTree {
+	t.Helper()
+	c, err := m.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// mustDiff is Diff for tests whose trees can be walked.
+func mustDiff(t testing.TB, from, to *MerkleTree) *Delta {
+	t.Helper()
+	d, err := Diff(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// padStats is PAD.Stats for tests whose pending trees can be walked.
+func padStats(t testing.TB, pad *PAD) PADStats {
+	t.Helper()
+	st, err := pad.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// mustLeafAt is MerkleTree.leafAt for tests whose lookups can't fail.
+func mustLeafAt(t testing.TB, m *MerkleTree, index Index) *userLeafNode {
+	t.Helper()
+	n, err := m.leafAt(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// treeStats is MerkleTree.Stats for tests whose trees can be walked.
+func treeStats(t testing.TB, m *MerkleTree) TreeStats {
+	t.Helper()
+	st, err := m.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
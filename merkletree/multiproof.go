@@ -0,0 +1,138 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// ErrMalformedMultiProof indicates that the leaves and hashes of
+// a MultiAuthPath don't describe a part of a tree, e.g. because hashes are
+// missing or left over, or because two lookups end in different leaves
+// at the same position.
+var ErrMalformedMultiProof = errors.New("[merkletree] Malformed multi-proof")
+
+// A MultiAuthPath proves the inclusion or absence of many lookup indices
+// in the same tree at once. The paths to the indices share their upper
+// levels, so instead of a sibling hash per level and index, it only
+// holds the hashes of the subtrees that none of the paths enter.
+// Monitoring many names against the same STR with a MultiAuthPath takes
+// a fraction of the space of the separate AuthenticationPaths.
+type MultiAuthPath struct {
+	TreeNonce []byte
+	// LookupIndices are the indices looked up, and Leaves the leaf or
+	// empty branch in which the search for each of them ended, like
+	// AuthenticationPath.Leaf. VrfProofs holds the proof of each index
+	// if they were computed from keys.
+	LookupIndices []Index
+	VrfProofs     [][]byte
+	Leaves        []*ProofNode
+	// Hashes are the hashes of the subtrees next to the paths, in
+	// depth-first, left-to-right order.
+	Hashes [][hashed.HashSizeByte]byte
+}
+
+// sortedLookups returns the positions of the lookup indices of mp,
+// sorted by index, so that the lookups that enter any subtree are
+// consecutive.
+func (mp *MultiAuthPath) sortedLookups() []int {
+	lookups := make([]int, len(mp.LookupIndices))
+	for i := range lookups {
+		lookups[i] = i
+	}
+	sort.SliceStable(lookups, func(a, b int) bool {
+		return bytes.Compare(mp.LookupIndices[lookups[a]], mp.LookupIndices[lookups[b]]) < 0
+	})
+	return lookups
+}
+
+// splitLookups returns the position of the first of the sorted lookups
+// that continues to the right at depth.
+func (mp *MultiAuthPath) splitLookups(lookups []int, depth uint32) int {
+	return sort.Search(len(lookups), func(i int) bool {
+		return conv.GetNthBit(mp.LookupIndices[lookups[i]], depth)
+	})
+}
+
+// ProofType returns the type of the proof for the i-th lookup index,
+// like AuthenticationPath.ProofType.
+func (mp *MultiAuthPath) ProofType(i int) ProofType {
+	return proofType(mp.Leaves[i], mp.LookupIndices[i])
+}
+
+// Verify verifies the proof for each lookup index, with the i-th key and
+// value, like AuthenticationPath.Verify, and then recomputes the tree's
+// root node from mp and compares it to treeHash. It returns
+// ErrMalformedMultiProof if the number of keys or values doesn't match
+// the number of indices, or mp isn't well-formed, and otherwise the
+// first error AuthenticationPath.Verify would return.
+//
+// This should be called after the VRF indices are verified successfully.
+func (mp *MultiAuthPath) Verify(keys, values [][]byte, treeHash []byte) error {
+	if len(keys) != len(mp.LookupIndices) || len(values) != len(mp.LookupIndices) ||
+		len(mp.Leaves) != len(mp.LookupIndices) {
+		return ErrMalformedMultiProof
+	}
+	for i, leaf := range mp.Leaves {
+		if leaf == nil {
+			return ErrMalformedMultiProof
+		}
+		if err := verifyLeaf(leaf, mp.LookupIndices[i], keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+	hashes := mp.Hashes
+	hash, err := mp.rootHash(&hashes, 0, mp.sortedLookups())
+	if err != nil {
+		return err
+	}
+	if len(hashes) != 0 {
+		return ErrMalformedMultiProof
+	}
+	if !bytes.Equal(treeHash, hash[:]) {
+		return ErrUnequalTreeHashes
+	}
+	return nil
+}
+
+// rootHash computes the hash of the node at depth that the lookups,
+// whose indices all share its prefix, enter, consuming the hashes of the
+// subtrees next to their paths. The leaves have been verified, so their
+// levels don't exceed the length of their lookup index.
+func (mp *MultiAuthPath) rootHash(hashes *[][hashed.HashSizeByte]byte, depth uint32, lookups []int) (hashed.Hash, error) {
+	if len(lookups) == 0 {
+		if len(*hashes) == 0 {
+			return hashed.Hash{}, ErrMalformedMultiProof
+		}
+		hash := (*hashes)[0]
+		*hashes = (*hashes)[1:]
+		return hash, nil
+	}
+	var leaf hashed.Hash
+	for _, i := range lookups {
+		if mp.Leaves[i].Level != depth {
+			continue
+		}
+		// all of them have to end in the same leaf
+		copy(leaf[:], mp.Leaves[i].hash(mp.TreeNonce))
+		for _, j := range lookups {
+			if mp.Leaves[j].Level != depth || !bytes.Equal(mp.Leaves[j].hash(mp.TreeNonce), leaf[:]) {
+				return hashed.Hash{}, ErrMalformedMultiProof
+			}
+		}
+		return leaf, nil
+	}
+	right := mp.splitLookups(lookups, depth)
+	left, err := mp.rootHash(hashes, depth+1, lookups[:right])
+	if err != nil {
+		return left, err
+	}
+	rightHash, err := mp.rootHash(hashes, depth+1, lookups[right:])
+	if err != nil {
+		return rightHash, err
+	}
+	return hashed.Sum(left[:], rightHash[:]), nil
+}
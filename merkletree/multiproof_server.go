@@ -0,0 +1,67 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// GetBatch returns the MultiAuthPath proving the inclusion or absence of
+// each of indices, like Get does for a single one, or the error of
+// loading a node on their paths.
+func (m *MerkleTree) GetBatch(indices [][]byte) (*MultiAuthPath, error) {
+	if err := m.rlockFresh(); err != nil {
+		return nil, err
+	}
+	defer m.mu.RUnlock()
+	mp := &MultiAuthPath{
+		TreeNonce:     m.nonce,
+		LookupIndices: make([]Index, len(indices)),
+		Leaves:        make([]*ProofNode, len(indices)),
+	}
+	for i, index := range indices {
+		mp.LookupIndices[i] = index
+	}
+	if err := m.getBatch(mp, m.root, m.hash, 0, mp.sortedLookups()); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+// getBatch adds the proofs for the lookups, whose indices all share the
+// prefix of the node n at depth, to mp. Only the children that lookups
+// go through are loaded; the others are just hashes in mp.
+func (m *MerkleTree) getBatch(mp *MultiAuthPath, n merkleNode, hash []byte, depth uint32, lookups []int) error {
+	if len(lookups) == 0 {
+		var hashArr [hashed.HashSizeByte]byte
+		copy(hashArr[:], hash)
+		mp.Hashes = append(mp.Hashes, hashArr)
+		return nil
+	}
+	if n.kind() != interiorNodeKind {
+		for _, i := range lookups {
+			mp.Leaves[i] = proofNode(n, mp.LookupIndices[i])
+		}
+		return nil
+	}
+	interior := n.(*interiorNode)
+	split := mp.splitLookups(lookups, depth)
+	for _, right := range []bool{false, true} {
+		part := lookups[:split]
+		if right {
+			part = lookups[split:]
+		}
+		var child merkleNode
+		if len(part) > 0 {
+			var err error
+			if child, err = m.childOf(interior, right); err != nil {
+				return err
+			}
+		}
+		if err := m.getBatch(mp, child, interior.childHash(right), depth+1, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
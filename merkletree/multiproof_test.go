@@ -0,0 +1,111 @@
+package merkletree
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// multiProofLookups returns a tree of 1000 leaves, and 50 of their
+// indices, 10 indices that aren't in the tree and a repeated one, along
+// with the keys and values to verify them with.
+func multiProofLookups(t *testing.T) (m *MerkleTree, indices, keys, values [][]byte) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := batchEntries(1000, 0, valuePrefix)
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	for i, e := range append(entries[:50:50], entries[7]) {
+		indices = append(indices, e.Index)
+		keys = append(keys, e.Key)
+		values = append(values, e.Value)
+		if i < 10 {
+			absent := batchEntries(1, 1000+i, nil)[0]
+			indices = append(indices, absent.Index)
+			keys = append(keys, absent.Key)
+			values = append(values, nil)
+		}
+	}
+	return m, indices, keys, values
+}
+
+func TestMultiAuthPath(t *testing.T) {
+	m, indices, keys, values := multiProofLookups(t)
+	mp := mustGetBatch(t, m, indices)
+	var separate int
+	for i, index := range indices {
+		ap := mustGet(t, m, index)
+		separate += len(ap.PrunedTree)
+		if !reflect.DeepEqual(mp.Leaves[i], ap.Leaf) {
+			t.Fatalf("Lookup %d: expect the leaf of Get", i)
+		}
+		if mp.ProofType(i) != ap.ProofType() {
+			t.Fatalf("Lookup %d: expect %v, got %v", i, ap.ProofType(), mp.ProofType(i))
+		}
+	}
+	if len(mp.Hashes)*2 > separate {
+		t.Errorf("Expect the multi-proof to need less than half of the %d hashes of separate paths, got %d",
+			separate, len(mp.Hashes))
+	}
+	if err := mp.Verify(keys, values, m.hash); err != nil {
+		t.Fatal(err)
+	}
+
+	none := mustGetBatch(t, m, nil)
+	if len(none.Hashes) != 1 {
+		t.Fatalf("Expect only the root hash, got %d hashes", len(none.Hashes))
+	}
+	if err := none.Verify(nil, nil, m.hash); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultiAuthPathErrors(t *testing.T) {
+	m, indices, keys, values := multiProofLookups(t)
+	mp := mustGetBatch(t, m, indices)
+	tamper := func(f func(mp *MultiAuthPath)) *MultiAuthPath {
+		tampered := *mp
+		tampered.Leaves = append([]*ProofNode{}, mp.Leaves...)
+		tampered.Hashes = append([][hashed.HashSizeByte]byte{}, mp.Hashes...)
+		f(&tampered)
+		return &tampered
+	}
+	otherValues := append([][]byte{}, values...)
+	otherValues[0] = []byte("other")
+	for _, tc := range []struct {
+		name   string
+		mp     *MultiAuthPath
+		values [][]byte
+		want   error
+	}{
+		{"other value", mp, otherValues, ErrBindingsDiffer},
+		{"missing value", mp, values[1:], ErrMalformedMultiProof},
+		{"tampered hash", tamper(func(mp *MultiAuthPath) {
+			mp.Hashes[3][0]++
+		}), values, ErrUnequalTreeHashes},
+		{"missing hash", tamper(func(mp *MultiAuthPath) {
+			mp.Hashes = mp.Hashes[1:]
+		}), values, ErrMalformedMultiProof},
+		{"extra hash", tamper(func(mp *MultiAuthPath) {
+			mp.Hashes = append(mp.Hashes, mp.Hashes[0])
+		}), values, ErrMalformedMultiProof},
+		{"missing leaf", tamper(func(mp *MultiAuthPath) {
+			mp.Leaves[2] = nil
+		}), values, ErrMalformedMultiProof},
+		{"diverging leaves", tamper(func(mp *MultiAuthPath) {
+			// the repeated lookup ends one level further down
+			moved := *mp.Leaves[len(mp.Leaves)-1]
+			moved.Level++
+			mp.Leaves[len(mp.Leaves)-1] = &moved
+		}), values, ErrMalformedMultiProof},
+	} {
+		if err := tc.mp.Verify(keys, tc.values, m.hash); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
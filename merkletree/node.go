@@ -1,13 +1,34 @@
+//go:build !coniks_client
+// +build !coniks_client
+
 package merkletree
 
 import (
+	"sync/atomic"
+	"unsafe"
+
 	"github.com/ORBAT/cloniks/conv"
 	"github.com/ORBAT/cloniks/crypto/hashed"
 )
 
+// Nodes are shared by the trees cloned from each other (see
+// MerkleTree.Clone), so they don't know their parents, and a tree may
+// only modify the nodes of its own generation. It copies the others
+// before changing them.
 type node struct {
-	parent merkleNode
-	level  uint32
+	gen   uint64
+	level uint32
+}
+
+func (n *node) generation() uint64 {
+	return n.gen
+}
+
+// generations is the last generation given to a MerkleTree.
+var generations uint64
+
+func nextGen() uint64 {
+	return atomic.AddUint64(&generations, 1)
 }
 
 type interiorNode struct {
@@ -16,17 +37,26 @@ type interiorNode struct {
 	rightChild merkleNode
 	leftHash   []byte
 	rightHash  []byte
+	// the shape of the subtree, which is cached along with the hashes:
+	// the number of user leaf nodes and of all nodes in it, and the
+	// level of its deepest user leaf node
+	leaves uint64
+	nodes  uint64
+	depth  uint32
 }
 
 type userLeafNode struct {
 	node
-	key        string
+	key        []byte
 	value      []byte
 	index      []byte
-	// TODO:
-	//  - epoch when this was added / changed
-	//  - in the future allowsUnsignedChanges & allowsPublicVisibility would be neat
-	commitment hashed.Commit
+	// addedEpoch is the epoch in which key was first bound, and
+	// changedEpoch the one in which it was last bound to a different
+	// value. Both are part of the hash, so proofs carry them.
+	// TODO: in the future allowsUnsignedChanges & allowsPublicVisibility would be neat
+	addedEpoch   Epoch
+	changedEpoch Epoch
+	commitment   hashed.Commit
 }
 
 type emptyNode struct {
@@ -34,34 +64,39 @@ type emptyNode struct {
 	index []byte
 }
 
-func newInteriorNode(parent merkleNode, level uint32, prefixBits []bool) *interiorNode {
-	prefixLeft := copyOfBools(prefixBits, false)
-	prefixRight := copyOfBools(prefixBits, true)
-	leftBranch := &emptyNode{
+// newInteriorNode creates an interior node of the generation of m at
+// level on the path of index, with two empty children.
+func (m *MerkleTree) newInteriorNode(level uint32, index []byte) *interiorNode {
+	leftBranch := m.arena.empty()
+	*leftBranch = emptyNode{
 		node: node{
+			gen:   m.gen,
 			level: level + 1,
 		},
-		index: conv.ToBytes(prefixLeft),
+		index: childPrefix(index, level, false),
 	}
 
-	rightBranch := &emptyNode{
+	rightBranch := m.arena.empty()
+	*rightBranch = emptyNode{
 		node: node{
+			gen:   m.gen,
 			level: level + 1,
 		},
-		index: conv.ToBytes(prefixRight),
+		index: childPrefix(index, level, true),
 	}
-	newNode := &interiorNode{
+	n := m.arena.interior()
+	*n = interiorNode{
 		node: node{
-			parent: parent,
-			level:  level,
+			gen:   m.gen,
+			level: level,
 		},
 		leftChild:  leftBranch,
 		rightChild: rightBranch,
+		nodes:      3,
 	}
-	leftBranch.parent = newNode
-	rightBranch.parent = newNode
-
-	return newNode
+	m.markDirty(n, false)
+	m.markDirty(n, true)
+	return n
 }
 
 type nodeKind uint8
@@ -76,36 +111,103 @@ const (
 type merkleNode interface {
 	kind() nodeKind
 	hash(*MerkleTree) []byte
-	clone(*interiorNode) merkleNode
+	generation() uint64
 }
 
 var _ merkleNode = (*userLeafNode)(nil)
 var _ merkleNode = (*interiorNode)(nil)
 var _ merkleNode = (*emptyNode)(nil)
 
+// hash returns the hash of n from the cached hashes of its children,
+// which must be up to date: n mustn't be dirty (see
+// MerkleTree.rehashDirty).
 func (n *interiorNode) hash(m *MerkleTree) []byte {
-	if n.leftHash == nil {
-		n.leftHash = n.leftChild.hash(m)
+	m.hashStats.Computed++
+	return hashed.Digest(n.leftHash, n.rightHash)
+}
+
+// setShape caches the shape of the subtree rooted at n, computed from
+// that of its children, which are loaded from m's NodeStore if needed.
+func (n *interiorNode) setShape(m *MerkleTree) error {
+	left, err := m.childOf(n, false)
+	if err != nil {
+		return err
 	}
-	if n.rightHash == nil {
-		n.rightHash = n.rightChild.hash(m)
+	right, err := m.childOf(n, true)
+	if err != nil {
+		return err
+	}
+	leftLeaves, leftNodes, leftDepth := shapeOf(left)
+	rightLeaves, rightNodes, rightDepth := shapeOf(right)
+	n.leaves = leftLeaves + rightLeaves
+	n.nodes = leftNodes + rightNodes + 1
+	n.depth = leftDepth
+	if rightDepth > n.depth {
+		n.depth = rightDepth
+	}
+	return nil
+}
+
+// shapeOf returns the number of user leaf nodes and of all nodes in the
+// subtree rooted at n, and the level of its deepest user leaf node.
+func shapeOf(n merkleNode) (leaves, nodes uint64, depth uint32) {
+	switch n := n.(type) {
+	case *interiorNode:
+		return n.leaves, n.nodes, n.depth
+	case *userLeafNode:
+		return 1, 1, n.level
+	default:
+		return 0, 1, 0
+	}
+}
+
+// child returns the right child of n if right is true, and the left
+// one otherwise, or nil if it's only in the tree's NodeStore (see
+// MerkleTree.childOf).
+func (n *interiorNode) child(right bool) merkleNode {
+	if right {
+		return n.rightChild
+	}
+	return n.leftChild
+}
+
+// childHash returns the hash of the right child of n if right is true,
+// and of the left one otherwise, as of when the hash of its tree was
+// last computed, or nil if n is new since then (see
+// MerkleTree.isDirty).
+func (n *interiorNode) childHash(right bool) []byte {
+	if right {
+		return n.rightHash
+	}
+	return n.leftHash
+}
+
+// setChild replaces the right child of n if right is true, and the left
+// one otherwise, with c. It doesn't mark the side as dirty (see
+// MerkleTree.setChild).
+func (n *interiorNode) setChild(right bool, c merkleNode) {
+	if right {
+		n.rightChild = c
+	} else {
+		n.leftChild = c
 	}
-	return hashed.Digest(n.leftHash, n.rightHash)
 }
 
-var emptyLeafBs = []byte{LeafIdentifier}
 func (n *userLeafNode) hash(m *MerkleTree) []byte {
+	m.hashStats.Computed++
 	return hashed.Digest(
 		emptyLeafBs,                         // K_leaf
 		[]byte(m.nonce),                     // K_n
 		[]byte(n.index),                     // i
 		[]byte(conv.UInt32ToBytes(n.level)), // l
+		n.addedEpoch.Bytes(),                // e_added
+		n.changedEpoch.Bytes(),              // e_changed
 		[]byte(n.commitment.Hash),           // commit(key|| value)
 	)
 }
 
-var emptyBranchBs = []byte{EmptyBranchIdentifier}
 func (n *emptyNode) hash(m *MerkleTree) []byte {
+	m.hashStats.Computed++
 	return hashed.Digest(
 		emptyBranchBs,                               // K_empty
 		[]byte(m.nonce),                     // K_n
@@ -114,45 +216,20 @@ func (n *emptyNode) hash(m *MerkleTree) []byte {
 	)
 }
 
-func (n *interiorNode) clone(parent *interiorNode) merkleNode {
-	newNode := &interiorNode{
-		node: node{
-			parent: parent,
-			level:  n.level,
-		},
-		leftHash:  copyOfBs(n.leftHash),
-		rightHash: copyOfBs(n.rightHash),
-	}
-	if n.leftChild == nil ||
-		n.rightChild == nil {
+// nodeBytes returns the approximate memory footprint of n in bytes,
+// including the slices it owns.
+func nodeBytes(n merkleNode) uint64 {
+	switch n := n.(type) {
+	case *userLeafNode:
+		return uint64(unsafe.Sizeof(*n)) + uint64(cap(n.key)+cap(n.value)+cap(n.index)+
+			cap(n.commitment.Salt)+cap(n.commitment.Hash))
+	case *interiorNode:
+		return uint64(unsafe.Sizeof(*n)) + uint64(cap(n.leftHash)+cap(n.rightHash))
+	case *emptyNode:
+		return uint64(unsafe.Sizeof(*n)) + uint64(cap(n.index))
+	default:
 		panic(ErrInvalidTree)
 	}
-	newNode.leftChild = n.leftChild.clone(newNode)
-	newNode.rightChild = n.rightChild.clone(newNode)
-	return newNode
-}
-
-func (n *userLeafNode) clone(parent *interiorNode) merkleNode {
-	return &userLeafNode{
-		node: node{
-			parent: parent,
-			level:  n.level,
-		},
-		key:        n.key,
-		value:      copyOfBs(n.value),
-		index:      copyOfBs(n.index),
-		commitment: n.commitment,
-	}
-}
-
-func (n *emptyNode) clone(parent *interiorNode) merkleNode {
-	return &emptyNode{
-		node: node{
-			parent: parent,
-			level:  n.level,
-		},
-		index: copyOfBs(n.index),
-	}
 }
 
 func (*userLeafNode) kind() nodeKind {
@@ -176,12 +253,3 @@ func copyOfBs(bs []byte) (c []byte) {
 	copy(c, bs)
 	return
 }
-
-func copyOfBools(bs []bool, extra ...bool) (c []bool) {
-	c = make([]bool, len(bs) + len(extra))
-	copy(c, bs)
-	if len(extra) != 0 {
-		copy(c[len(bs):], extra)
-	}
-	return
-}
\ No newline at end of file
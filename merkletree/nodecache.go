@@ -0,0 +1,94 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultNodeCacheSize is the number of loaded nodes the trees of a PAD
+// with a NodeStore cache, unless WithNodeCache sets another size.
+const DefaultNodeCacheSize = 1 << 14
+
+// WithNodeCache makes the trees of a PAD with a NodeStore cache the size
+// nodes they loaded from it most recently, instead of
+// DefaultNodeCacheSize. A size of 0 disables the cache, so every node is
+// loaded again whenever a lookup or an update walks it.
+func WithNodeCache(size int) PADOption {
+	return func(pad *PAD) error {
+		pad.cacheSize = size
+		return nil
+	}
+}
+
+// A nodeCache keeps the nodes a tree loaded from its NodeStore most
+// recently, so that the paths most lookups walk, e.g. those near the
+// root, aren't loaded and decoded again every time. Loaded nodes are
+// never modified (see MerkleTree.ownInterior), and nodes are
+// content-addressed, so a cache is shared by a tree and its clones. A
+// nodeCache is safe for concurrent use; a nil one caches nothing.
+type nodeCache struct {
+	mu    sync.Mutex
+	size  int
+	lru   *list.List // of *cachedNode, the most recently used first
+	nodes map[string]*list.Element
+}
+
+type cachedNode struct {
+	hash string
+	node merkleNode
+}
+
+// newNodeCache returns an empty nodeCache of size nodes, or nil if size
+// isn't positive.
+func newNodeCache(size int) *nodeCache {
+	if size <= 0 {
+		return nil
+	}
+	return &nodeCache{size: size, lru: list.New(), nodes: make(map[string]*list.Element)}
+}
+
+// get returns the node with hash h, or nil if it isn't cached.
+func (c *nodeCache) get(h []byte) merkleNode {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.nodes[string(h)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedNode).node
+}
+
+// add caches the node n with hash h, evicting the least recently used
+// node if the cache is full.
+func (c *nodeCache) add(h []byte, n merkleNode) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[string(h)]; ok {
+		return
+	}
+	c.nodes[string(h)] = c.lru.PushFront(&cachedNode{hash: string(h), node: n})
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedNode)
+		delete(c.nodes, oldest.hash)
+	}
+}
+
+// len returns the number of nodes in c.
+func (c *nodeCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
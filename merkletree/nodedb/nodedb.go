@@ -0,0 +1,52 @@
+// This module implements a merkletree.NodeStore that keeps the nodes
+// on disk in a LevelDB database, so that the size of a PAD isn't bounded
+// by RAM.
+
+package nodedb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// A Store is a merkletree.NodeStore backed by a LevelDB database. A Store
+// is safe for concurrent use.
+type Store struct {
+	db *leveldb.DB
+}
+
+var _ merkletree.NodeStore = (*Store)(nil)
+
+// Open opens the store in the directory path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get implements merkletree.NodeStore.
+func (s *Store) Get(h []byte) ([]byte, error) {
+	n, err := s.db.Get(h, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, merkletree.ErrNodeNotFound
+	}
+	return n, err
+}
+
+// Put implements merkletree.NodeStore.
+func (s *Store) Put(h, n []byte) error {
+	return s.db.Put(h, n, nil)
+}
+
+// Delete implements merkletree.NodeStore.
+func (s *Store) Delete(h []byte) error {
+	return s.db.Delete(h, nil)
+}
@@ -0,0 +1,68 @@
+package nodedb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+type testAd struct{}
+
+func (testAd) Bytes() []byte { return nil }
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get([]byte("missing")); err != merkletree.ErrNodeNotFound {
+		t.Fatalf("Expected ErrNodeNotFound, got %v", err)
+	}
+	if err := s.Delete([]byte("missing")); err != nil {
+		t.Fatal(err)
+	}
+
+	pad, err := merkletree.NewPAD(testAd{}, crypto.NewStaticTestSigningKey(),
+		crypto.NewStaticTestVRFKey(), 10, merkletree.WithNodeStore(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	str := pad.LatestSTR()
+	nonce := func() []byte {
+		ap, err := pad.Lookup([]byte("alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ap.TreeNonce
+	}()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the tree survives reopening the store
+	if s, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	m, err := merkletree.LoadMerkleTree(s, str.TreeHash[:], nonce, merkletree.DefaultIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap, err := m.Get(pad.Index([]byte("alice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ap.Leaf.Value, []byte("key")) {
+		t.Fatalf("Expected the binding to be loaded, got %+v", ap.Leaf)
+	}
+	if err := ap.Verify([]byte("alice"), []byte("key"), str.TreeHash[:]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,426 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+var (
+	// ErrNodeNotFound indicates that a NodeStore has no node with the
+	// requested hash.
+	ErrNodeNotFound = errors.New("[merkletree] Node not found")
+	// ErrMalformedNode indicates that a node read from a NodeStore
+	// couldn't be decoded.
+	ErrMalformedNode = errors.New("[merkletree] Malformed node")
+	// ErrNodeFormat indicates that a node read from a NodeStore was
+	// stored in an older format, which can't be decoded; the store must
+	// be rebuilt, e.g. from an export of the tree.
+	ErrNodeFormat = errors.New("[merkletree] Node stored in an unsupported format")
+	// ErrNodeLoad is wrapped by the errors of the lookups and updates of
+	// a tree whose nodes couldn't be loaded from its NodeStore.
+	ErrNodeLoad = errors.New("[merkletree] Could not load a node")
+)
+
+// A NodeStore stores the nodes of MerkleTrees, serialized, by their
+// hash. Since nodes are content-addressed, a node shared by several
+// snapshots of a PAD is stored once.
+//
+// Without a NodeStore, which is the default, all the nodes of a tree
+// stay in memory, so the size of a tree is bounded by RAM. With one,
+// a PAD writes the nodes of every snapshot to the store when it takes
+// the snapshot, and keeps only the roots of its trees in memory; the
+// other nodes are loaded lazily, whenever a lookup or an update walks
+// them, and the ones loaded most recently are cached (see WithNodeCache).
+// If the NodeStore fails, the lookup or the update returns an error
+// wrapping ErrNodeLoad, and the tree keeps its leaves, except where
+// MerkleTree.SetBatch and MerkleTree.Delete say otherwise.
+type NodeStore interface {
+	// Get returns the node with hash h, or ErrNodeNotFound if there is
+	// none. The caller may retain the returned slice.
+	Get(h []byte) ([]byte, error)
+	// Put stores the node n with hash h. Neither slice is modified or
+	// retained after Put returns.
+	Put(h, n []byte) error
+	// Delete removes the node with hash h. Deleting a node that isn't
+	// stored isn't an error.
+	Delete(h []byte) error
+}
+
+// A MemNodeStore is a NodeStore that keeps the nodes in memory. It's
+// mainly useful for tests. A MemNodeStore is safe for concurrent use.
+type MemNodeStore struct {
+	mu    sync.RWMutex
+	nodes map[string][]byte
+}
+
+var _ NodeStore = (*MemNodeStore)(nil)
+
+// NewMemNodeStore returns an empty MemNodeStore.
+func NewMemNodeStore() *MemNodeStore {
+	return &MemNodeStore{nodes: make(map[string][]byte)}
+}
+
+// Get implements NodeStore.
+func (s *MemNodeStore) Get(h []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n, ok := s.nodes[string(h)]
+	if !ok {
+		return nil, ErrNodeNotFound
+	}
+	return n, nil
+}
+
+// Put implements NodeStore.
+func (s *MemNodeStore) Put(h, n []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[string(h)] = copyOfBs(n)
+	return nil
+}
+
+// Delete implements NodeStore.
+func (s *MemNodeStore) Delete(h []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.nodes, string(h))
+	return nil
+}
+
+// Len returns the number of nodes in s.
+func (s *MemNodeStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.nodes)
+}
+
+// WithNodeStore makes the PAD store the nodes of its snapshots in store
+// and load them lazily, so that only the roots of its trees stay in
+// memory. The nodes that no retained snapshot contains anymore are
+// deleted from store when the last snapshot containing them is evicted
+// or pruned, after the EvictionFunc returns; the view passed to the
+// EvictionFunc is thus only usable until then.
+func WithNodeStore(store NodeStore) PADOption {
+	return func(pad *PAD) error {
+		pad.store = store
+		return nil
+	}
+}
+
+// LoadMerkleTree returns the tree with the root hash root and the nonce
+// nonce whose nodes are in store, e.g. one written by a PAD using
+// WithNodeStore. Its nodes are loaded lazily and cached like those of
+// a PAD's trees, and those it changes stay in memory until Flush writes
+// them to store.
+// It returns ErrInvalidIndexSize if indexSize is not in
+// [MinIndexSize, DefaultIndexSize], the error of store if the root
+// can't be loaded, and ErrNodeFormat if store was written in an older
+// format of the nodes.
+func LoadMerkleTree(store NodeStore, root, nonce []byte, indexSize int) (*MerkleTree, error) {
+	m, err := NewMerkleTreeWithIndexSize(indexSize)
+	if err != nil {
+		return nil, err
+	}
+	n, err := loadNode(store, root)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := n.(*interiorNode)
+	if !ok {
+		return nil, ErrMalformedNode
+	}
+	m.root, m.hash, m.nonce, m.store = r, copyOfBs(root), copyOfBs(nonce), store
+	m.dirty = nil
+	m.cache = newNodeCache(DefaultNodeCacheSize)
+	return m, nil
+}
+
+// Flush computes the hash of m if it's stale, writes the nodes m changed
+// since it was last flushed or cloned to its NodeStore, and removes them
+// from memory, except for the root. It does nothing if m has no
+// NodeStore.
+func (m *MerkleTree) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store == nil {
+		return nil
+	}
+	if m.stale() {
+		if _, err := m.recomputeHash(); err != nil {
+			return err
+		}
+	}
+	if m.root.gen != m.gen {
+		return nil
+	}
+	if err := m.store.Put(m.hash, encodeNode(m.root)); err != nil {
+		return err
+	}
+	m.written = append(m.written, m.hash)
+	return m.flushChildren(m.root)
+}
+
+// flushChildren writes the children of n that m owns, and their
+// subtrees, to m.store, and removes them from n.
+func (m *MerkleTree) flushChildren(n *interiorNode) error {
+	for _, right := range []bool{false, true} {
+		c := n.child(right)
+		if c == nil {
+			continue
+		}
+		if c.generation() == m.gen {
+			if err := m.store.Put(n.childHash(right), encodeNode(c)); err != nil {
+				return err
+			}
+			m.written = append(m.written, n.childHash(right))
+			if c, ok := c.(*interiorNode); ok {
+				if err := m.flushChildren(c); err != nil {
+					return err
+				}
+			}
+		}
+		// the nodes of other generations are stored already
+		if right {
+			n.rightChild = nil
+		} else {
+			n.leftChild = nil
+		}
+	}
+	return nil
+}
+
+// childOf returns the right child of n if right is true, and the left
+// one otherwise, loading it from m's NodeStore if it isn't in memory,
+// or an error wrapping ErrNodeLoad if it can't.
+// A loaded child isn't kept in n, so that lookups never modify the tree
+// and can run concurrently: a change copies the loaded nodes on its path
+// anyway (see MerkleTree.ownInterior). It's kept in the nodeCache of m
+// instead, which all lookups share.
+func (m *MerkleTree) childOf(n *interiorNode, right bool) (merkleNode, error) {
+	if c := n.child(right); c != nil {
+		return c, nil
+	}
+	h := n.childHash(right)
+	if m.store == nil || h == nil {
+		return nil, fmt.Errorf("%w: no NodeStore to load it from", ErrNodeLoad)
+	}
+	if c := m.cache.get(h); c != nil {
+		return c, nil
+	}
+	c, err := loadNode(m.store, h)
+	if err != nil {
+		return nil, fmt.Errorf("%w %x: %v", ErrNodeLoad, h, err)
+	}
+	m.cache.add(h, c)
+	return c, nil
+}
+
+// setChild replaces the right child of n if right is true, and the left
+// one otherwise, with c, and marks that side of n as dirty. If the
+// replaced child is stored in m's NodeStore, its hash is recorded in
+// m.released; a dirty side's cached hash is that of a child replaced
+// before, which is recorded already.
+func (m *MerkleTree) setChild(n *interiorNode, right bool, c merkleNode) {
+	if !m.isDirty(n, right) {
+		if h := n.childHash(right); m.store != nil && h != nil {
+			m.released = append(m.released, h)
+		}
+		m.markDirty(n, right)
+	}
+	n.setChild(right, c)
+}
+
+// releaseChildren records the hashes of the stored children of n, which
+// m removes along with n, in m.released, and forgets n if it's dirty.
+func (m *MerkleTree) releaseChildren(n *interiorNode) {
+	for _, right := range []bool{false, true} {
+		if h := n.childHash(right); m.store != nil && h != nil && !m.isDirty(n, right) {
+			m.released = append(m.released, h)
+		}
+	}
+	m.forget(n)
+}
+
+// ownRoot makes the root of m a node m may modify, recording the hash
+// of a replaced stored root like setChild.
+func (m *MerkleTree) ownRoot() {
+	if m.root.gen != m.gen && m.store != nil && m.hash != nil {
+		m.released = append(m.released, m.hash)
+	}
+	m.root = m.ownInterior(m.root)
+}
+
+// loadNode reads the node with hash h from store. Loaded nodes have the
+// generation storedGen.
+func loadNode(store NodeStore, h []byte) (merkleNode, error) {
+	bs, err := store.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(bs)
+}
+
+// storedGen is the generation of the nodes loaded from a NodeStore. No
+// tree owns it, so a tree copies a loaded node before changing it, and
+// the memory of loaded nodes isn't attributed to any snapshot.
+const storedGen = 0
+
+// nodeFormat is the version of the encoding of stored nodes, kept in the
+// high nibble of their first byte, above their kind. Nodes of version 0
+// didn't record the epochs of their leaves.
+const nodeFormat = 1
+
+// encodeNode serializes n for a NodeStore. The hashes of the children of
+// an interior node must be up to date.
+func encodeNode(n merkleNode) []byte {
+	bs := []byte{nodeFormat<<4 | byte(n.kind())}
+	switch n := n.(type) {
+	case *interiorNode:
+		bs = appendUint32(bs, n.level)
+		bs = appendUint64(bs, n.leaves)
+		bs = appendUint64(bs, n.nodes)
+		bs = appendUint32(bs, n.depth)
+		bs = append(bs, n.leftHash...)
+		bs = append(bs, n.rightHash...)
+	case *userLeafNode:
+		bs = appendUint32(bs, n.level)
+		bs = appendUint64(bs, uint64(n.addedEpoch))
+		bs = appendUint64(bs, uint64(n.changedEpoch))
+		for _, f := range [][]byte{n.index, n.key, n.value, n.commitment.Salt, n.commitment.Hash} {
+			bs = appendUint32(bs, uint32(len(f)))
+			bs = append(bs, f...)
+		}
+	case *emptyNode:
+		bs = appendUint32(bs, n.level)
+		bs = append(bs, n.index...)
+	default:
+		panic(ErrInvalidTree)
+	}
+	return bs
+}
+
+// decodeNode parses a node serialized by encodeNode. It returns
+// ErrNodeFormat for a node of another version of the encoding.
+func decodeNode(bs []byte) (merkleNode, error) {
+	if len(bs) < 5 {
+		return nil, ErrMalformedNode
+	}
+	if bs[0]>>4 != nodeFormat {
+		return nil, ErrNodeFormat
+	}
+	kind, level, bs := nodeKind(bs[0]&0x0f), binary.BigEndian.Uint32(bs[1:]), bs[5:]
+	nd := node{gen: storedGen, level: level}
+	switch kind {
+	case interiorNodeKind:
+		if len(bs) != 20+2*hashed.HashSizeByte {
+			return nil, ErrMalformedNode
+		}
+		return &interiorNode{
+			node:      nd,
+			leaves:    binary.BigEndian.Uint64(bs),
+			nodes:     binary.BigEndian.Uint64(bs[8:]),
+			depth:     binary.BigEndian.Uint32(bs[16:]),
+			leftHash:  copyOfBs(bs[20 : 20+hashed.HashSizeByte]),
+			rightHash: copyOfBs(bs[20+hashed.HashSizeByte:]),
+		}, nil
+	case userLeafNodeKind:
+		if len(bs) < 16 {
+			return nil, ErrMalformedNode
+		}
+		added, changed := Epoch(binary.BigEndian.Uint64(bs)), Epoch(binary.BigEndian.Uint64(bs[8:]))
+		bs = bs[16:]
+		var fields [5][]byte
+		for i := range fields {
+			if len(bs) < 4 {
+				return nil, ErrMalformedNode
+			}
+			l := binary.BigEndian.Uint32(bs)
+			if uint64(len(bs)-4) < uint64(l) {
+				return nil, ErrMalformedNode
+			}
+			if l > 0 {
+				fields[i] = copyOfBs(bs[4 : 4+l])
+			}
+			bs = bs[4+l:]
+		}
+		if len(bs) != 0 {
+			return nil, ErrMalformedNode
+		}
+		return &userLeafNode{
+			node:         nd,
+			index:        fields[0],
+			key:          fields[1],
+			value:        fields[2],
+			commitment:   hashed.Commit{Salt: fields[3], Hash: fields[4]},
+			addedEpoch:   added,
+			changedEpoch: changed,
+		}, nil
+	case emptyNodeKind:
+		return &emptyNode{node: nd, index: copyOfBs(bs)}, nil
+	default:
+		return nil, ErrMalformedNode
+	}
+}
+
+// releaseNodes deletes the nodes whose last snapshot was that of epoch
+// from the PAD's NodeStore.
+func (pad *PAD) releaseNodes(epoch Epoch) {
+	for _, h := range pad.released[epoch] {
+		if pad.releasedIn[string(h)] == epoch {
+			delete(pad.releasedIn, string(h))
+		}
+	}
+	pad.deleteNodes(pad.released[epoch])
+	delete(pad.released, epoch)
+}
+
+// keepWritten makes sure that the nodes the pending tree wrote to the
+// PAD's NodeStore when it was flushed aren't deleted along with older
+// snapshots. Nodes are content-addressed, so a node that the pending tree
+// or an earlier one replaced can be recreated with the same hash, e.g.
+// a leaf that moved up when MerkleTree.Delete removed its sibling moves
+// back down when another leaf is inserted there, and the new snapshot
+// contains it then.
+func (pad *PAD) keepWritten() {
+	if len(pad.tree.written) == 0 {
+		return
+	}
+	written := make(map[string]bool, len(pad.tree.written))
+	for _, h := range pad.tree.written {
+		written[string(h)] = true
+	}
+	pad.tree.released = withoutHashes(pad.tree.released, written)
+	for h := range written {
+		if epoch, ok := pad.releasedIn[h]; ok {
+			pad.released[epoch] = withoutHashes(pad.released[epoch], written)
+			delete(pad.releasedIn, h)
+		}
+	}
+}
+
+// withoutHashes removes the hashes in drop from hashes, in place.
+func withoutHashes(hashes [][]byte, drop map[string]bool) [][]byte {
+	kept := hashes[:0]
+	for _, h := range hashes {
+		if !drop[string(h)] {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// deleteNodes deletes the nodes with the given hashes from the PAD's
+// NodeStore.
+func (pad *PAD) deleteNodes(hashes [][]byte) {
+	for _, h := range hashes {
+		// a failed deletion only leaks the node
+		_ = pad.store.Delete(h)
+	}
+}
@@ -0,0 +1,381 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+func TestNodeEncoding(t *testing.T) {
+	m := staticTree(t)
+	if err := m.Set(staticVRFKey.Compute([]byte("key")), []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	nodes := []merkleNode{m.root}
+	m.visitLeafNodes(func(n *userLeafNode) { nodes = append(nodes, n) })
+	nodes = append(nodes, &emptyNode{node: node{level: 3}, index: []byte{0x40}})
+	for _, n := range nodes {
+		decoded, err := decodeNode(encodeNode(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded.hash(m), n.hash(m)) || !bytes.Equal(encodeNode(decoded), encodeNode(n)) {
+			t.Errorf("Expected %#v to survive encoding, got %#v", n, decoded)
+		}
+	}
+	interior, leaf := nodeFormat<<4|byte(interiorNodeKind), nodeFormat<<4|byte(userLeafNodeKind)
+	for _, bs := range [][]byte{nil, {interior, 0, 0, 0, 1}, {leaf, 0, 0, 0, 1, 0, 0, 1}} {
+		if _, err := decodeNode(bs); err != ErrMalformedNode {
+			t.Errorf("Expected ErrMalformedNode for %v, got %v", bs, err)
+		}
+	}
+
+	// nodes stored before the format was versioned
+	for _, n := range nodes {
+		bs := encodeNode(n)
+		bs[0] &= 0x0f
+		if _, err := decodeNode(bs); err != ErrNodeFormat {
+			t.Errorf("Expected ErrNodeFormat for %#v, got %v", n, err)
+		}
+	}
+	store := NewMemNodeStore()
+	m.store = store
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := store.Get(m.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[0] &= 0x0f
+	if err := store.Put(m.hash, bs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMerkleTree(store, m.hash, m.nonce, m.indexSize); !errors.Is(err, ErrNodeFormat) {
+		t.Errorf("Expected ErrNodeFormat from an old store, got %v", err)
+	}
+}
+
+// failingStore is a MemNodeStore whose Put fails while fail is set, and
+// whose Get fails while failGet is set. It counts the calls to Get.
+type failingStore struct {
+	*MemNodeStore
+	fail, failGet bool
+	gets          int
+}
+
+var errStoreFailed = errors.New("store failed")
+
+func (s *failingStore) Put(h, n []byte) error {
+	if s.fail {
+		return errStoreFailed
+	}
+	return s.MemNodeStore.Put(h, n)
+}
+
+func (s *failingStore) Get(h []byte) ([]byte, error) {
+	s.gets++
+	if s.failGet {
+		return nil, errStoreFailed
+	}
+	return s.MemNodeStore.Get(h)
+}
+
+func TestPADNodeStoreFailure(t *testing.T) {
+	store := &failingStore{MemNodeStore: NewMemNodeStore()}
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 3, WithNodeStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	store.fail = true
+	if _, err := pad.Update(nil); err != errStoreFailed {
+		t.Fatal("Expect", errStoreFailed, "got", err)
+	}
+	if pad.LatestSTR().Epoch != 0 {
+		t.Fatal("Expect no snapshot, got epoch", pad.LatestSTR().Epoch)
+	}
+	// the update can be retried once the store recovers
+	store.fail = false
+	if _, err := pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	str := pad.LatestSTR()
+	ap, err := pad.Lookup([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ap.Verify([]byte("key"), []byte("value"), str.TreeHash[:]); err != nil || str.Epoch != 1 {
+		t.Error("Expect the binding in epoch 1, got", str.Epoch, err)
+	}
+}
+
+func TestPADNodeLoadFailure(t *testing.T) {
+	key := func(i int) []byte { return []byte("key" + strconv.Itoa(i)) }
+	store := &failingStore{MemNodeStore: NewMemNodeStore()}
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 3, WithNodeStore(store), WithNodeCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := pad.Set(key(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	store.failGet = true
+	if _, err := pad.Lookup(key(0)); !errors.Is(err, ErrNodeLoad) {
+		t.Fatal("Expect", ErrNodeLoad, "got", err)
+	}
+	if err := pad.Set(key(50), []byte("value")); !errors.Is(err, ErrNodeLoad) {
+		t.Fatal("Expect", ErrNodeLoad, "got", err)
+	}
+	if err := pad.Set(key(0), []byte("new value")); !errors.Is(err, ErrNodeLoad) {
+		t.Fatal("Expect", ErrNodeLoad, "got", err)
+	}
+	if _, err := pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	// a change whose hash can't be computed fails the update
+	store.failGet = false
+	if err := pad.Set(key(1), []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	store.failGet = true
+	if _, err := pad.Update(nil); !errors.Is(err, ErrNodeLoad) {
+		t.Fatal("Expect", ErrNodeLoad, "got", err)
+	}
+	if pad.LatestSTR().Epoch != 2 {
+		t.Fatal("Expect no snapshot, got epoch", pad.LatestSTR().Epoch)
+	}
+
+	// and can be retried once the store recovers
+	store.failGet = false
+	if _, err := pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pad.CheckInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	str := pad.LatestSTR()
+	for i, value := range map[int]string{0: "value", 1: "new value", 49: "value"} {
+		ap, err := pad.Lookup(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ap.Verify(key(i), []byte(value), str.TreeHash[:]); err != nil {
+			t.Error("Expect", i, "to be bound to", value, "got", err)
+		}
+	}
+}
+
+func TestPADNodeCache(t *testing.T) {
+	key := func(i int) []byte { return []byte("key" + strconv.Itoa(i)) }
+	store := &failingStore{MemNodeStore: NewMemNodeStore()}
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 3, WithNodeStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := pad.Set(key(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pad.Lookup(key(0)); err != nil {
+		t.Fatal(err)
+	}
+	loaded := store.gets
+	if loaded == 0 || pad.tree.cache.len() != loaded {
+		t.Fatal("Expect the loaded nodes to be cached, got", pad.tree.cache.len(), "of", loaded)
+	}
+	// the cache is shared by the snapshots and the pending tree
+	if _, err := pad.Lookup(key(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set(key(0), []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	if store.gets != loaded {
+		t.Error("Expect no nodes to be loaded again, got", store.gets-loaded)
+	}
+}
+
+func TestNodeCacheEviction(t *testing.T) {
+	c := newNodeCache(2)
+	for _, h := range []string{"a", "b", "a", "c"} {
+		c.add([]byte(h), &emptyNode{})
+		c.get([]byte(h))
+	}
+	if c.len() != 2 || c.get([]byte("b")) != nil || c.get([]byte("a")) == nil || c.get([]byte("c")) == nil {
+		t.Error("Expect the least recently used node to be evicted")
+	}
+	if newNodeCache(0) != nil {
+		t.Error("Expect no cache of size 0")
+	}
+}
+
+func TestPADNodeStore(t *testing.T) {
+	store := NewMemNodeStore()
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 3, WithNodeStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(i int) []byte { return []byte("key" + strconv.Itoa(i)) }
+	for epoch := 0; epoch < 8; epoch++ {
+		for i := 0; i < 20; i++ {
+			// change some of the earlier bindings, and add new ones
+			if err := pad.Set(key(epoch*10+i), []byte("value"+strconv.Itoa(epoch))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pad.Update(nil)
+		if pad.tree.root.leftChild != nil || pad.tree.root.rightChild != nil {
+			t.Fatal("Expected only the root to stay in memory")
+		}
+	}
+
+	for _, epoch := range pad.loadedEpochs {
+		str := pad.snapshots[epoch]
+		for i := 0; i < 10*int(epoch)+20; i++ {
+			ap, err := pad.LookupInEpoch(key(i), epoch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ap.Verify(key(i), ap.Leaf.Value, str.TreeHash[:]); err != nil {
+				t.Fatalf("Epoch %d, key %d: %v", epoch, i, err)
+			}
+		}
+	}
+
+	// the store has exactly the nodes of the retained snapshots
+	if retained := retainedNodes(t, pad); store.Len() != len(retained) {
+		t.Errorf("Expected the store to have the %d nodes of the retained snapshots, got %d",
+			len(retained), store.Len())
+	}
+
+	latest := pad.LatestSTR()
+	m, err := LoadMerkleTree(store, latest.TreeHash[:], latest.tree.nonce, pad.indexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(pad.Index([]byte("new")), []byte("new"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(m.hash, latest.TreeHash[:]) {
+		t.Error("Expected the hash of the loaded tree to change")
+	}
+	ap := mustGet(t, m, pad.Index(key(0)))
+	if err := ap.Verify(key(0), []byte("value0"), m.hash); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadMerkleTree(store, make([]byte, hashed.HashSizeByte), nil, pad.indexSize); err != ErrNodeNotFound {
+		t.Errorf("Expected ErrNodeNotFound, got %v", err)
+	}
+}
+
+// retainedNodes returns the hashes of the nodes of the snapshots pad
+// retains.
+func retainedNodes(t *testing.T, pad *PAD) map[string]bool {
+	retained := make(map[string]bool)
+	for _, epoch := range pad.loadedEpochs {
+		m := pad.snapshots[epoch].tree
+		retained[string(m.hash)] = true
+		var visit func(n *interiorNode)
+		visit = func(n *interiorNode) {
+			for _, right := range []bool{false, true} {
+				retained[string(n.childHash(right))] = true
+				c, err := m.childOf(n, right)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c, ok := c.(*interiorNode); ok {
+					visit(c)
+				}
+			}
+		}
+		visit(m.root)
+	}
+	return retained
+}
+
+func TestPADNodeStoreRecreatedNode(t *testing.T) {
+	store := NewMemNodeStore()
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 4, WithNodeStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(i int) []byte { return []byte("key" + strconv.Itoa(i)) }
+	const n = 64
+	for i := 0; i < n; i++ {
+		if err := pad.Set(key(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update := func() {
+		if _, err := pad.Update(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update()
+
+	// delete a leaf whose sibling is a leaf, which moves up
+	deleted := -1
+	for i := 0; i < n && deleted < 0; i++ {
+		p, err := pad.Delete(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.After.Leaf.IsEmpty {
+			deleted = i
+		} else if err := pad.Set(key(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deleted < 0 {
+		t.Fatal("Expected a leaf with a leaf sibling")
+	}
+	update()
+	// inserting it again moves the sibling back down, which recreates
+	// the node the previous snapshot released
+	if err := pad.Set(key(deleted), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	// evict the snapshot that released it while the one that recreated
+	// it is retained
+	update()
+	update()
+	if pad.snapshots[1] != nil || pad.snapshots[3] == nil {
+		t.Fatal("Expected epoch 1 to be evicted and epoch 3 retained, got", pad.loadedEpochs)
+	}
+
+	latest := pad.LatestSTR()
+	for i := 0; i < n; i++ {
+		ap, err := pad.Lookup(key(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ap.Verify(key(i), []byte("value"), latest.TreeHash[:]); err != nil {
+			t.Fatalf("Key %d: %v", i, err)
+		}
+	}
+	if retained := retainedNodes(t, pad); store.Len() != len(retained) {
+		t.Errorf("Expected the store to have the %d nodes of the retained snapshots, got %d",
+			len(retained), store.Len())
+	}
+}
@@ -1,8 +1,12 @@
+//go:build !coniks_client
+// +build !coniks_client
+
 package merkletree
 
 import (
 	"bytes"
 	"errors"
+	"time"
 
 	"github.com/ORBAT/cloniks/crypto/hashed"
 	"github.com/ORBAT/cloniks/crypto/sign"
@@ -17,123 +21,431 @@ var (
 )
 
 // A PAD is a persistent authenticated dictionary of key/value bindings.
+// Keys and values are arbitrary byte strings; the PAD doesn't assign them
+// any meaning, so it can back any kind of transparency log that maps keys
+// to values, not just a CONIKS key directory.
 //
-// It includes the underlying MerkleTree, cached snapshots, the latest SignedTreeRoot, two key pairs
-// for signing and VRF computation, and additional developer-specified AssocData.
+// It includes the underlying MerkleTree, cached snapshots, the latest SignedTreeRoot, a signing key
+// pair, the Indexer computing lookup indices, and additional developer-specified AssocData.
 type PAD struct {
-	signKey      sign.PrivateKey
-	vrfKey       vrf.PrivateKey
+	signKey      sign.Signer
+	indexer      Indexer
 	tree         *MerkleTree // will be used to create the next STR
-	snapshots    map[uint64]*SignedTreeRoot
-	loadedEpochs []uint64 // slice of epochs in snapshots
-	latestSTR    *SignedTreeRoot
-	ad           AssocData
+	snapshots    map[Epoch]*SignedTreeRoot
+	stats        map[Epoch]TreeStats // stats of the trees in snapshots
+	loadedEpochs []Epoch             // slice of epochs in snapshots
+	numSnapshots uint64              // the maximum number of snapshots without a memory budget
+	// retention decides which snapshots keep their trees.
+	retention RetentionPolicy
+	// taken are the times at which the retained snapshots were taken.
+	taken map[Epoch]time.Time
+	now   func() time.Time
+	// reclaimed is the memory released by pruning trees so far.
+	reclaimed  GCStats
+	budget     memoryBudget
+	onEvict    EvictionFunc
+	latestSTR  *SignedTreeRoot
+	ad         AssocData
+	indexSize  int
+	insertions uint64 // bindings set since the latest snapshot
+	// refreshed is the hashing work of RefreshPending since the latest
+	// snapshot.
+	refreshed HashStats
+	// skipLinks holds, for every k, the hash of the latest STR whose
+	// epoch is a multiple of 2^k.
+	skipLinks [64]hashed.Hash
+	strList   STRList // lists all the STRs, including evicted ones
+	// store is the NodeStore the trees keep their nodes in, if any, and
+	// cacheSize the number of loaded nodes they cache.
+	store     NodeStore
+	cacheSize int
+	// released holds, for every retained snapshot, the hashes of the
+	// stored nodes that no later snapshot contains, and releasedIn the
+	// snapshot that released each of them.
+	released   map[Epoch][][]byte
+	releasedIn map[string]Epoch
+	// treeOpts are the optional parameters of the PAD's trees.
+	treeOpts []TreeOption
+	// spill is the SnapshotStore the snapshots removed from memory are
+	// spilled to, if any.
+	spill SnapshotStore
+	// strs is the STRStore every STR is archived in, if any.
+	strs STRStore
+	// indexWorkers is the number of goroutines SetBatch computes
+	// indices with.
+	indexWorkers int
+}
+
+// A PADOption sets an optional parameter of a PAD. See NewPAD.
+type PADOption func(*PAD) error
+
+// WithTreeOptions gives the trees of the PAD the optional parameters
+// opts, e.g. WithNodeArena.
+func WithTreeOptions(opts ...TreeOption) PADOption {
+	return func(pad *PAD) error {
+		pad.treeOpts = append(pad.treeOpts, opts...)
+		return nil
+	}
+}
+
+// WithIndexSize makes the PAD truncate the VRF output to indexSize bytes
+// when computing private indices. Shorter indices result in shorter
+// authentication paths at the cost of collision resistance.
+// indexSize must be in [MinIndexSize, DefaultIndexSize].
+func WithIndexSize(indexSize int) PADOption {
+	return func(pad *PAD) error {
+		if indexSize < MinIndexSize || indexSize > DefaultIndexSize {
+			return ErrInvalidIndexSize
+		}
+		pad.indexSize = indexSize
+		return nil
+	}
 }
 
 // NewPAD creates new PAD with the given associated data ad,
 // signing key pair signKey, VRF key pair vrfKey, and the
 // maximum capacity for the snapshot cache len.
-func NewPAD(ad AssocData, signKey sign.PrivateKey, vrfKey vrf.PrivateKey, numSnapshots uint64) (*PAD, error) {
+// Optional parameters can be given with opts. Indices are computed with
+// vrfKey unless another Indexer is given with WithIndexer.
+func NewPAD(ad AssocData, signKey sign.Signer, vrfKey vrf.PrivateKey, numSnapshots uint64,
+	opts ...PADOption) (*PAD, error) {
 	if ad == nil {
 		panic("[merkletree] PAD must be created with non-nil associated data")
 	}
 	var err error
 	pad := new(PAD)
 	pad.signKey = signKey
-	pad.vrfKey = vrfKey
-	pad.tree, err = NewMerkleTree()
+	pad.indexer = VRFIndexer{vrfKey}
+	pad.indexSize = DefaultIndexSize
+	pad.cacheSize = DefaultNodeCacheSize
+	for _, opt := range opts {
+		if err := opt(pad); err != nil {
+			return nil, err
+		}
+	}
+	if err := pad.checkSTRStore(); err != nil {
+		return nil, err
+	}
+	pad.tree, err = NewMerkleTreeWithIndexSize(pad.indexSize, pad.treeOpts...)
 	if err != nil {
 		return nil, err
 	}
+	pad.tree.store = pad.store
+	if pad.store != nil {
+		pad.tree.cache = newNodeCache(pad.cacheSize)
+	}
+	pad.released = make(map[Epoch][][]byte)
+	pad.releasedIn = make(map[string]Epoch)
 	pad.ad = ad
-	pad.snapshots = make(map[uint64]*SignedTreeRoot, numSnapshots)
-	pad.loadedEpochs = make([]uint64, 0, numSnapshots)
-	pad.updateInternal(nil, 0)
+	pad.snapshots = make(map[Epoch]*SignedTreeRoot, numSnapshots)
+	pad.stats = make(map[Epoch]TreeStats, numSnapshots)
+	pad.loadedEpochs = make([]Epoch, 0, numSnapshots)
+	pad.taken = make(map[Epoch]time.Time, numSnapshots)
+	pad.now = time.Now
+	pad.numSnapshots = numSnapshots
+	if _, err := pad.updateInternal(nil, 0); err != nil {
+		return nil, err
+	}
 	return pad, nil
 }
 
-func (pad *PAD) signTreeRoot(epoch uint64) {
-	var prevHash []byte
-	if pad.latestSTR == nil {
-		prevHash = hashed.RandSlice()
-	} else {
-		prevHash = hashed.Digest(pad.latestSTR.Signature)
+func (pad *PAD) signTreeRoot(epoch Epoch) (HashStats, error) {
+	var prevHash hashed.Hash // that of the genesis STR
+	if pad.latestSTR != nil {
+		prevHash = hashed.Sum(pad.latestSTR.Signature[:])
+	}
+	hashStats, err := pad.tree.recomputeHash()
+	if err != nil {
+		return hashStats, err
+	}
+	// the pending tree must be in the NodeStore before anything changes,
+	// so that the PAD is as it was if it isn't
+	if err := pad.tree.Flush(); err != nil {
+		return hashStats, err
+	}
+	// and so must the STR be in the STRStore
+	str := NewSTR(pad.signKey, pad.ad, pad.tree, epoch, prevHash, pad.skipHashes(epoch))
+	str.tree = nil
+	if err := pad.archiveSTR(str); err != nil {
+		return hashStats, err
+	}
+	hashStats.Computed += pad.refreshed.Computed
+	hashStats.Reused += pad.refreshed.Reused
+	pad.refreshed = HashStats{}
+	pad.retireReplaced()
+	// the hash is fresh after Flush, so cloning can't fail
+	str.tree, _ = pad.tree.Clone()
+	str.tree.freeze()
+	pad.tree.epoch = epoch + 1
+	pad.latestSTR = str
+	pad.linkSkips(pad.latestSTR)
+	pad.strList.Append(pad.latestSTR)
+	return hashStats, nil
+}
+
+// retireReplaced accounts for the nodes the pending tree replaced since
+// the previous snapshot: they're no longer shared with the pending tree,
+// so only that snapshot retains them.
+func (pad *PAD) retireReplaced() {
+	if pad.store != nil {
+		pad.keepWritten()
+	}
+	if prev := pad.latestSTR; prev != nil && prev.tree != nil {
+		if st, ok := pad.stats[prev.Epoch]; ok {
+			st.Bytes += pad.tree.replaced
+			pad.stats[prev.Epoch] = st
+		}
+		if pad.store != nil {
+			pad.released[prev.Epoch] = pad.tree.released
+			for _, h := range pad.tree.released {
+				pad.releasedIn[string(h)] = prev.Epoch
+			}
+		}
+	} else if pad.store != nil {
+		// no snapshot retains them
+		pad.deleteNodes(pad.tree.released)
 	}
-	pad.tree.recomputeHash()
-	m := pad.tree.Clone()
-	pad.latestSTR = NewSTR(pad.signKey, pad.ad, m, epoch, prevHash)
 }
 
-func (pad *PAD) updateInternal(ad AssocData, epoch uint64) {
+func (pad *PAD) updateInternal(ad AssocData, epoch Epoch) (UpdateStats, error) {
 	// Create STR with the `ad` that was used in the prev. Set()
 	// operation.
-	pad.signTreeRoot(epoch)
+	hashStats, err := pad.signTreeRoot(epoch)
+	if err != nil {
+		return UpdateStats{}, err
+	}
 	pad.snapshots[epoch] = pad.latestSTR
+	pad.stats[epoch] = pad.latestSTR.tree.snapshotStats()
 	pad.loadedEpochs = append(pad.loadedEpochs, epoch)
+	pad.taken[epoch] = pad.now()
+	_, err = pad.prune()
+	if budgetErr := pad.enforceBudget(); err == nil {
+		err = budgetErr
+	}
 	if ad != nil { // update the `ad` if necessary
 		pad.ad = ad
 	}
+	st := UpdateStats{Epoch: epoch, Insertions: pad.insertions, Hash: hashStats}
+	pad.insertions = 0
+	return st, err
 }
 
 // Update generates a new snapshot of the tree.
 // It should be called at the beginning of each epoch.
 // Specifically, it extends the hash chain by issuing
 // a new signed tree root. It may remove some older signed tree roots from
-// memory if the cached PAD snapshots exceeded the maximum capacity.
+// memory if the cached PAD snapshots exceeded the maximum capacity, or
+// the memory budget if one has been set with SetMemoryBudget.
 // ad should be nil if the PAD's associated data ad do not change.
-func (pad *PAD) Update(ad AssocData) {
+// Update returns the UpdateStats of the new snapshot, or the error of the
+// PAD's NodeStore, if it couldn't load or store the nodes of the tree,
+// or of its STRStore, if it couldn't archive the STR, in which case the
+// PAD takes no snapshot, and a later Update can try again. If the PAD's SnapshotStore couldn't store an older
+// snapshot the PAD is removing from memory before the new one is taken,
+// Update returns its error, wrapping ErrSpillFailed, and takes no
+// snapshot either; if it couldn't store one afterwards, the new snapshot
+// is taken, and Update returns its UpdateStats along with the error. The
+// older snapshot stays in memory until a later Update or CollectGarbage
+// stores it.
+func (pad *PAD) Update(ad AssocData) (UpdateStats, error) {
 	// delete older str(s) as needed
-	if len(pad.loadedEpochs) == cap(pad.loadedEpochs) {
-		n := cap(pad.loadedEpochs) / 2
-		for i := 0; i < n; i++ {
-			delete(pad.snapshots, pad.loadedEpochs[i])
+	if n := uint64(len(pad.loadedEpochs)); pad.budget.high == 0 && n >= pad.numSnapshots {
+		// keep the newer half, and always the latest snapshot
+		evict := n - (pad.numSnapshots - pad.numSnapshots/2)
+		if evict >= n {
+			evict = n - 1
+		}
+		if err := pad.evict(int(evict)); err != nil {
+			return UpdateStats{}, err
+		}
+	}
+	return pad.updateInternal(ad, pad.latestSTR.Epoch+1)
+}
+
+// SetAssocData sets the associated data of the STR the next Update
+// signs. Unlike the ad of Update, which only takes effect for the STR
+// after it, ad can thus describe the epoch the STR ends, e.g. with
+// statistics of its bindings.
+func (pad *PAD) SetAssocData(ad AssocData) {
+	pad.ad = ad
+}
+
+// RefreshPending brings the root hash of the pending tree, which holds
+// the bindings set since the latest snapshot and becomes the next one,
+// up to date, and returns it along with the work it took (see
+// MerkleTree.Refresh). The hash isn't signed, so it only serves
+// read-only checks of the pending bindings, e.g. with LookupPending. The
+// work is counted in the UpdateStats of the next snapshot too, whose
+// hash then only needs the changes made after the refresh. It returns
+// the error of loading a node from the PAD's NodeStore, like Refresh.
+func (pad *PAD) RefreshPending() ([]byte, HashStats, error) {
+	st, err := pad.tree.Refresh()
+	pad.refreshed.Computed += st.Computed
+	pad.refreshed.Reused += st.Reused
+	if err != nil {
+		return nil, st, err
+	}
+	return copyOfBs(pad.tree.hash), st, nil
+}
+
+// LookupPending is Lookup in the pending tree: it returns the
+// AuthenticationPath proving the inclusion or absence of key among the
+// bindings set so far, and the root hash it proves them against, which
+// it refreshes first (see RefreshPending), or the error of loading a
+// node from the PAD's NodeStore.
+func (pad *PAD) LookupPending(key []byte) (*AuthenticationPath, []byte, error) {
+	hash, _, err := pad.RefreshPending()
+	if err != nil {
+		return nil, nil, err
+	}
+	index, proof := pad.computePrivateIndex(key)
+	ap, err := pad.tree.Get(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	ap.VrfProof = proof
+	return ap, hash, nil
+}
+
+// Insertions returns the number of bindings set since the latest
+// snapshot.
+func (pad *PAD) Insertions() uint64 {
+	return pad.insertions
+}
+
+// evict removes the n oldest snapshots from memory, spilling them to
+// the SnapshotStore, if any. If the store fails, it stops at the failing
+// snapshot, which is kept, and returns the error.
+func (pad *PAD) evict(n int) error {
+	var err error
+	evicted := 0
+	for _, epoch := range pad.loadedEpochs[:n] {
+		if str := pad.snapshots[epoch]; str.tree != nil {
+			if err = pad.spillSnapshot(str); err != nil {
+				break
+			}
+			if pad.onEvict != nil {
+				pad.onEvict(pad.view(str))
+			}
 		}
-		pad.loadedEpochs = append(pad.loadedEpochs[:0], pad.loadedEpochs[n:]...)
+		if pad.store != nil {
+			pad.releaseNodes(epoch)
+		}
+		delete(pad.snapshots, epoch)
+		delete(pad.stats, epoch)
+		delete(pad.taken, epoch)
+		evicted++
 	}
-	pad.updateInternal(ad, pad.latestSTR.Epoch+1)
+	pad.loadedEpochs = append(pad.loadedEpochs[:0], pad.loadedEpochs[evicted:]...)
+	return err
 }
 
 // Set computes the private index for the given key using
 // the current VRF private key to create a new index-to-value binding,
 // and inserts it into the PAD's underlying Merkle tree. This ensures
 // the index-to-value binding will be included in the next PAD snapshot.
-func (pad *PAD) Set(key string, value []byte) error {
-	return pad.tree.Set(pad.Index(key), key, value)
+func (pad *PAD) Set(key, value []byte) error {
+	if err := pad.tree.Set(pad.Index(key), key, value); err != nil {
+		return err
+	}
+	pad.insertions++
+	return nil
+}
+
+// Delete removes the binding of the given key from the PAD's underlying
+// Merkle tree, so that the next PAD snapshot proves its absence, and
+// returns the proof of its removal from the pending tree. See
+// MerkleTree.Delete.
+func (pad *PAD) Delete(key []byte) (*RemovalProof, error) {
+	return pad.tree.Delete(pad.Index(key))
 }
 
 // Lookup searches the requested key in the latest snapshot of the PAD,
 // and returns the corresponding AuthenticationPath proving inclusion
 // or absence of the requested key.
-func (pad *PAD) Lookup(key string) (*AuthenticationPath, error) {
+func (pad *PAD) Lookup(key []byte) (*AuthenticationPath, error) {
 	return pad.LookupInEpoch(key, pad.latestSTR.Epoch)
 }
 
 // LookupInEpoch searches the requested key in the snapshot at the
-// requested epoch.
+// requested epoch, or in the latest snapshot if epoch is after the latest
+// one. Use At to get a view that never falls back to a different epoch.
 // It returns ErrorSTRNotFound if the signed tree root of the requested epoch
 // has been removed from memory, indicating to the server that the
-// STR for the requested epoch should be retrieved from persistent storage.
-func (pad *PAD) LookupInEpoch(key string, epoch uint64) (*AuthenticationPath, error) {
-	str := pad.GetSTR(epoch)
-	if str == nil {
-		return nil, ErrSTRNotFound
-	}
-	// TODO: If the vrf key is rotated, we'd need to use the key
-	// corresponding to the `epoch` here.  See #120
-	lookupIndex, proof := pad.computePrivateIndex(key, pad.vrfKey)
-	ap := str.tree.Get(lookupIndex)
-	ap.VrfProof = proof
-	return ap, nil
+// STR for the requested epoch should be retrieved from persistent storage,
+// and an ErrEpochPruned if only the signed tree root has been kept.
+// A PAD with a SnapshotStore loads such snapshots from the store instead.
+// A PAD with a NodeStore returns an error wrapping ErrNodeLoad if a node
+// on the path of key can't be loaded.
+func (pad *PAD) LookupInEpoch(key []byte, epoch Epoch) (*AuthenticationPath, error) {
+	if epoch > pad.latestSTR.Epoch {
+		epoch = pad.latestSTR.Epoch
+	}
+	view, err := pad.At(epoch)
+	if err != nil {
+		return nil, err
+	}
+	return view.Get(key)
+}
+
+// FirstChangeSince searches the snapshots after epoch since for the
+// first one in which the commitment to the requested key's value differs
+// from commitment, which is nil if the key was absent. It returns that
+// epoch and the AuthenticationPath for the key in it. If the commitment
+// is the same in every snapshot up to the latest one, FirstChangeSince
+// returns the latest epoch and a nil AuthenticationPath.
+// It returns ErrSTRNotFound if any of the snapshots has been removed
+// from memory, and an ErrEpochPruned if any of them has been pruned,
+// unless the PAD can load them from its SnapshotStore, and the error of
+// loading a node like LookupInEpoch.
+func (pad *PAD) FirstChangeSince(key, commitment []byte, since Epoch) (Epoch, *AuthenticationPath, error) {
+	lookupIndex, proof := pad.computePrivateIndex(key)
+	for epoch := since + 1; epoch <= pad.latestSTR.Epoch; epoch++ {
+		str, err := pad.snapshot(epoch)
+		if err != nil {
+			return 0, nil, err
+		}
+		ap, err := str.tree.Get(lookupIndex)
+		if err != nil {
+			return 0, nil, err
+		}
+		var current []byte
+		if ap.ProofType() == ProofOfInclusion {
+			current = ap.Leaf.Commitment.Hash
+		}
+		if !bytes.Equal(current, commitment) {
+			ap.VrfProof = proof
+			return epoch, ap, nil
+		}
+	}
+	return pad.latestSTR.Epoch, nil, nil
 }
 
 // GetSTR returns the signed tree root of the requested epoch.
-// This signed tree root is read from the cached snapshots of the PAD.
-// It returns nil if the signed tree root has been removed from the memory.
-func (pad *PAD) GetSTR(epoch uint64) *SignedTreeRoot {
+// This signed tree root is read from the cached snapshots of the PAD, or
+// loaded from its STRStore or its SnapshotStore if it has them.
+// It returns nil if the signed tree root has been removed from the memory,
+// and can't be loaded.
+func (pad *PAD) GetSTR(epoch Epoch) *SignedTreeRoot {
 	if epoch >= pad.latestSTR.Epoch {
 		return pad.latestSTR
 	}
-	return pad.snapshots[epoch]
+	if str := pad.snapshots[epoch]; str != nil {
+		return str
+	}
+	if pad.strs != nil {
+		if str, err := pad.strs.Get(epoch); err == nil {
+			return str
+		}
+	}
+	if pad.spill == nil {
+		return nil
+	}
+	str, err := pad.loadSnapshot(epoch)
+	if err != nil {
+		return nil
+	}
+	return str
 }
 
 // LatestSTR returns the latest signed tree root of the PAD.
@@ -141,36 +453,84 @@ func (pad *PAD) LatestSTR() *SignedTreeRoot {
 	return pad.latestSTR
 }
 
+// STRListRoot returns the root of the Merkle list of all the STRs the
+// PAD has issued, up to and including LatestSTR(), and the hash of its
+// first STR. See STRList.
+func (pad *PAD) STRListRoot() (root, first hashed.Hash) {
+	return pad.strList.Root(), pad.strList.First()
+}
+
 // Sign uses the _current_ signing key underlying the PAD to sign msg.
-func (pad *PAD) Sign(msg ...[]byte) []byte {
-	return pad.signKey.Sign(bytes.Join(msg, nil))
+func (pad *PAD) Sign(msg ...[]byte) (sig sign.Signature) {
+	copy(sig[:], pad.signKey.Sign(bytes.Join(msg, nil)))
+	return sig
+}
+
+// PublicKey returns the public key of the _current_ signing key
+// underlying the PAD.
+func (pad *PAD) PublicKey() sign.PublicKey {
+	return pad.signKey.Public()
+}
+
+// SetSigningKey replaces the signing key underlying the PAD with key,
+// starting with the STR the next Update signs. The STRs it signed
+// before keep their signatures.
+func (pad *PAD) SetSigningKey(key sign.Signer) {
+	pad.signKey = key
 }
 
-// Index uses the _current_ VRF private key of the PAD to compute
+// Index uses the _current_ Indexer of the PAD to compute
 // the private index for the requested key.
-func (pad *PAD) Index(key string) []byte {
-	index, _ := pad.computePrivateIndex(key, pad.vrfKey)
+func (pad *PAD) Index(key []byte) Index {
+	index, _ := pad.computePrivateIndex(key)
 	return index
 }
 
+// IndexSize returns the size of the PAD's private indices in bytes.
+func (pad *PAD) IndexSize() int {
+	return pad.indexSize
+}
+
 // reshuffle recomputes indices of keys and store them with their values
 // in new tree with new new position; swaps pad.tree if everything worked
-// out. If there is any error on the way (lack of entropy for randomness)
-// reshuffle will panic
-func (pad *PAD) reshuffle() {
-	newTree, err := NewMerkleTree()
+// out. The leaves keep their epochs. If there is any error on the way
+// (lack of entropy for randomness, or a node that can't be loaded)
+// reshuffle returns it and keeps the tree.
+func (pad *PAD) reshuffle() error {
+	newTree, err := NewMerkleTreeWithIndexSize(pad.indexSize, pad.treeOpts...)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	pad.tree.visitLeafNodes(func(n *userLeafNode) {
-		if err := newTree.Set(pad.Index(n.key), n.key, n.value); err != nil {
-			panic(err)
+	newTree.store, newTree.cache = pad.store, pad.tree.cache
+	newTree.epoch = pad.tree.epoch
+	var insertErr error
+	if err := pad.tree.visitLeafNodes(func(n *userLeafNode) {
+		index, leaf := pad.Index(n.key), newTree.arena.leaf()
+		*leaf = userLeafNode{
+			key:          copyOfBs(n.key),
+			value:        copyOfBs(n.value),
+			index:        index,
+			commitment:   newCommit(newTree.rand, n.key, n.value),
+			addedEpoch:   n.addedEpoch,
+			changedEpoch: n.changedEpoch,
+		}
+		// newTree is all in memory, so looking up index can't fail
+		existing, _ := newTree.leafAt(index)
+		if err := newTree.insertNode(index, leaf, existing); err != nil && insertErr == nil {
+			insertErr = err
 		}
-	})
+	}); err != nil {
+		return err
+	}
+	if insertErr != nil {
+		return insertErr
+	}
 	pad.tree = newTree
+	return nil
 }
 
-func (pad *PAD) computePrivateIndex(key string, vrfKey vrf.PrivateKey) (index, proof []byte) {
-	index, proof = vrfKey.Prove([]byte(key))
+func (pad *PAD) computePrivateIndex(key []byte) (index, proof []byte) {
+	index, proof = pad.indexer.Index(key)
+	index = index[:pad.indexSize]
 	return
 }
@@ -59,15 +59,15 @@ func TestPADHashChain(t *testing.T) {
 	}
 
 	for i := uint64(0); i < N; i++ {
-		str := pad.GetSTR(uint64(i))
+		str := pad.GetSTR(Epoch(i))
 		if str == nil {
 			t.Fatal("Cannot get STR #", i)
 		}
-		if !bytes.Equal(str.TreeHash, treeHashes[uint64(i)]) {
+		if !bytes.Equal(str.TreeHash[:], treeHashes[uint64(i)]) {
 			t.Fatal("Malformed PAD Update:", i)
 		}
 
-		if str.Epoch != uint64(i) {
+		if str.Epoch != Epoch(i) {
 			t.Fatal("Got invalid STR", "want", i, "got", str.Epoch)
 		}
 	}
@@ -84,7 +84,7 @@ func TestPADHashChain(t *testing.T) {
 	for i := uint64(0); i < N; i++ {
 		key := keyPrefix + strconv.FormatUint(i, 10)
 		val := append(valuePrefix, byte(i))
-		ap, _ := pad.Lookup(key)
+		ap, _ := pad.Lookup([]byte(key))
 		if ap.Leaf.Value == nil {
 			t.Fatal("Cannot find key:", key)
 		}
@@ -97,7 +97,7 @@ func TestPADHashChain(t *testing.T) {
 	for epoch := uint64(0); epoch < N; epoch++ {
 		for keyNum := uint64(0); keyNum < N; keyNum++ {
 			key := keyPrefix + strconv.FormatUint(keyNum, 10)
-			ap, err := pad.LookupInEpoch(key, epoch)
+			ap, err := pad.LookupInEpoch([]byte(key), Epoch(epoch))
 			if err != nil {
 				t.Error(err)
 			} else if keyNum < epoch && ap.Leaf.Value == nil {
@@ -158,23 +158,23 @@ func TestAssocDataChange(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := pad.Set(key1, val1); err != nil {
+	if err := pad.Set([]byte(key1), val1); err != nil {
 		t.Fatal(err)
 	}
 	// TODO: key change between epoch 1 and 2:
 	pad.Update(TestAd{""})
 
-	if err := pad.Set(key2, val2); err != nil {
+	if err := pad.Set([]byte(key2), val2); err != nil {
 		t.Fatal(err)
 	}
 	pad.Update(nil)
 
-	if err := pad.Set(key3, val3); err != nil {
+	if err := pad.Set([]byte(key3), val3); err != nil {
 		t.Fatal(err)
 	}
 	pad.Update(nil)
 
-	ap, _ := pad.Lookup(key1)
+	ap, _ := pad.Lookup([]byte(key1))
 	if ap.Leaf.Value == nil {
 		t.Error("Cannot find key:", key1)
 	}
@@ -182,7 +182,7 @@ func TestAssocDataChange(t *testing.T) {
 		t.Error(key1, "value mismatch")
 	}
 
-	ap, _ = pad.Lookup(key2)
+	ap, _ = pad.Lookup([]byte(key2))
 	if ap.Leaf.Value == nil {
 		t.Error("Cannot find key:", key2)
 	}
@@ -190,17 +190,17 @@ func TestAssocDataChange(t *testing.T) {
 		t.Error(key2, "value mismatch")
 	}
 
-	ap, err = pad.LookupInEpoch(key1, 1)
+	ap, err = pad.LookupInEpoch([]byte(key1), 1)
 	if err != nil {
 		t.Error(err)
 	} else if !bytes.Equal(ap.Leaf.Value, val1) {
 		t.Error(key1, "value mismatch")
 	}
-	ap, err = pad.LookupInEpoch(key2, 2)
+	ap, err = pad.LookupInEpoch([]byte(key2), 2)
 	if err != nil {
 		t.Error(err)
 	}
-	ap, err = pad.LookupInEpoch(key3, 3)
+	ap, err = pad.LookupInEpoch([]byte(key3), 3)
 	if err != nil {
 		t.Error(err)
 	} else if ap.Leaf.Value == nil {
@@ -210,6 +210,75 @@ func TestAssocDataChange(t *testing.T) {
 	}
 }
 
+func TestPADSetAssocData(t *testing.T) {
+	pad, err := NewPAD(TestAd{"initial"}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if pad.Insertions() != 1 {
+		t.Fatal("Expect 1 insertion, got", pad.Insertions())
+	}
+	pad.SetAssocData(TestAd{"epoch 1"})
+	pad.Update(nil)
+	if ad := pad.GetSTR(1).Ad.(TestAd); ad.data != "epoch 1" {
+		t.Error("Expect the STR to have the new associated data, got", ad.data)
+	}
+	if ad := pad.GetSTR(0).Ad.(TestAd); ad.data != "initial" {
+		t.Error("Expect the older STR to keep its associated data, got", ad.data)
+	}
+	if pad.Insertions() != 0 {
+		t.Error("Expect no insertions after the update, got", pad.Insertions())
+	}
+}
+
+func TestPADTruncatedIndices(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10, WithIndexSize(MinIndexSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pad.IndexSize() != MinIndexSize {
+		t.Fatal("Expect index size", MinIndexSize, "got", pad.IndexSize())
+	}
+
+	for i := 0; i < 10; i++ {
+		key := keyPrefix + strconv.Itoa(i)
+		if err := pad.Set([]byte(key), append(valuePrefix, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil)
+
+	pk, _ := vrfKey.Public()
+	str := pad.LatestSTR()
+	for i := 0; i < 10; i++ {
+		key := keyPrefix + strconv.Itoa(i)
+		ap, err := pad.Lookup([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ap.LookupIndex) != MinIndexSize {
+			t.Fatal("Expect index of", MinIndexSize, "bytes, got", len(ap.LookupIndex))
+		}
+		if !pk.VerifyTruncated([]byte(key), ap.LookupIndex, ap.VrfProof) {
+			t.Error("Cannot verify truncated index of", key)
+		}
+		if err := ap.Verify([]byte(key), append(valuePrefix, byte(i)), str.TreeHash[:]); err != nil {
+			t.Error(key, err)
+		}
+	}
+}
+
+func TestPADInvalidIndexSize(t *testing.T) {
+	for _, size := range []int{0, MinIndexSize - 1, DefaultIndexSize + 1} {
+		if _, err := NewPAD(TestAd{""}, signKey, vrfKey, 10, WithIndexSize(size)); err != ErrInvalidIndexSize {
+			t.Error("Expect", ErrInvalidIndexSize, "for size", size, "got", err)
+		}
+	}
+}
+
 func TestNewPADMissingAssocData(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -280,24 +349,22 @@ func benchPADUpdate(b *testing.B, entries uint64) {
 	}
 	// build the tree once:
 	pad.Update(nil)
-
-	// Insert 1000 additional entries (as described in section 5.3):
-	var i uint64
-	for i = 0; i < 1000; i++ {
-		key := keyPrefix + strconv.FormatUint(i+entries, 10)
-		value := append(valuePrefix, byte(i+entries))
-		if err := pad.Set(key, value); err != nil {
-			b.Fatal(err)
-		}
-	}
 	// clone current PAD's state:
-	orgTree := pad.tree.Clone()
+	orgTree := mustClone(b, pad.tree)
 	b.ResetTimer()
 
 	// now benchmark re-hashing the tree:
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
-		pad.tree = orgTree.Clone()
+		pad.tree = mustClone(b, orgTree)
+		// Insert 1000 additional entries (as described in section 5.3):
+		for j := uint64(0); j < 1000; j++ {
+			key := keyPrefix + strconv.FormatUint(j+entries, 10)
+			value := append(valuePrefix, byte(j+entries))
+			if err := pad.Set([]byte(key), value); err != nil {
+				b.Fatal(err)
+			}
+		}
 		b.StartTimer()
 		pad.Update(nil)
 	}
@@ -343,7 +410,7 @@ func benchPADLookup(b *testing.B, entries uint64) {
 			key = keyPrefix + strconv.Itoa(n%int(entries))
 		}
 		b.StartTimer()
-		_, err := pad.Lookup(key)
+		_, err := pad.Lookup([]byte(key))
 		if err != nil {
 			b.Fatalf("Coudldn't lookup key=%s", key)
 		}
@@ -371,7 +438,7 @@ func createPad(N uint64, keyPrefix string, valuePrefix []byte, snapLen uint64,
 	for i := uint64(0); i < N; i++ {
 		key := keyPrefix + strconv.FormatUint(i, 10)
 		value := append(valuePrefix, byte(i))
-		if err := pad.Set(key, value); err != nil {
+		if err := pad.Set([]byte(key), value); err != nil {
 			return nil, fmt.Errorf("Couldn't set key=%s and value=%s. Error: %v",
 				key, value, err)
 		}
@@ -387,3 +454,116 @@ func createPadSimple(N uint64, keyPrefix string, valuePrefix []byte,
 	snapLen uint64) (*PAD, error) {
 	return createPad(N, keyPrefix, valuePrefix, snapLen, nil, nil)
 }
+
+func TestPADFirstChangeSince(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil) // epoch 1
+	pad.Update(nil)
+	pad.Update(nil)
+	if err := pad.Set([]byte("alice"), []byte("new key")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil) // epoch 4
+
+	epoch, ap, err := pad.FirstChangeSince([]byte("alice"), nil, 0)
+	if err != nil || epoch != 1 || ap.ProofType() != ProofOfInclusion {
+		t.Fatal("Expect a change in epoch 1, got", epoch, ap, err)
+	}
+	commitment := ap.Leaf.Commitment.Hash
+	epoch, ap, err = pad.FirstChangeSince([]byte("alice"), commitment, 1)
+	if err != nil || epoch != 4 || !bytes.Equal(ap.Leaf.Value, []byte("new key")) {
+		t.Fatal("Expect a change in epoch 4, got", epoch, ap, err)
+	}
+	if err := ap.Verify([]byte("alice"), []byte("new key"), pad.GetSTR(4).TreeHash[:]); err != nil {
+		t.Error(err)
+	}
+	epoch, ap, err = pad.FirstChangeSince([]byte("alice"), ap.Leaf.Commitment.Hash, 4)
+	if err != nil || epoch != 4 || ap != nil {
+		t.Fatal("Expect no change, got", epoch, ap, err)
+	}
+	epoch, ap, err = pad.FirstChangeSince([]byte("bob"), nil, 0)
+	if err != nil || epoch != 4 || ap != nil {
+		t.Fatal("Expect bob to be absent throughout, got", epoch, ap, err)
+	}
+}
+
+func TestPADDelete(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := pad.Set([]byte(name), []byte("key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil) // epoch 1
+	before, _, err := pad.RefreshPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = append([]byte(nil), before...)
+	p, err := pad.Delete([]byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _, err := pad.RefreshPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(pad.Index([]byte("alice")), before, after); err != nil {
+		t.Error(err)
+	}
+	pad.Update(nil) // epoch 2
+
+	ap, err := pad.LookupInEpoch([]byte("alice"), 1)
+	if err != nil || ap.ProofType() != ProofOfInclusion {
+		t.Fatal("Expect alice to be included in epoch 1, got", ap, err)
+	}
+	ap, err = pad.Lookup([]byte("alice"))
+	if err != nil || !ap.ProofType().IsAbsence() {
+		t.Fatal("Expect alice to be absent in epoch 2, got", ap, err)
+	}
+	if err := ap.Verify([]byte("alice"), nil, pad.LatestSTR().TreeHash[:]); err != nil {
+		t.Error(err)
+	}
+	if ap, err := pad.Lookup([]byte("bob")); err != nil || ap.ProofType() != ProofOfInclusion {
+		t.Error("Expect bob to stay included, got", ap, err)
+	}
+	if _, err := pad.Delete([]byte("alice")); err != ErrIndexNotFound {
+		t.Error("Expect", ErrIndexNotFound, "got", err)
+	}
+}
+
+func TestPADBinaryKeys(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// e.g. a certificate transparency style log keyed by digests
+	keys := [][]byte{{0x00}, {0x00, 0x00}, {0xff, 0xfe, 0x00, 0x80}}
+	for i, key := range keys {
+		if err := pad.Set(key, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil)
+	for i, key := range keys {
+		ap, err := pad.Lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ap.ProofType() != ProofOfInclusion {
+			t.Fatal("Expect a proof of inclusion for", key)
+		}
+		if err := ap.Verify(key, []byte{byte(i)}, pad.LatestSTR().TreeHash[:]); err != nil {
+			t.Error(key, err)
+		}
+	}
+}
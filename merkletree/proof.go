@@ -20,6 +20,18 @@ var (
 	// ErrUnequalTreeHashes indicates that the hash computed from the authentication path
 	// and the hash taken from the signed tree root are different.
 	ErrUnequalTreeHashes = errors.New("[merkletree] The hashes computed from the authentication path and the STR are unequal")
+	// ErrDepthExceeded indicates that the authentication path is deeper than
+	// the maximum depth advertised in the STR.
+	ErrDepthExceeded = errors.New("[merkletree] The authentication path is deeper than the STR allows")
+	// ErrTreeNonceMismatch indicates that the authentication path is
+	// from a tree with another nonce than the expected one.
+	ErrTreeNonceMismatch = errors.New("[merkletree] The tree nonce of the authentication path is unexpected")
+	// ErrBindingAbsent indicates that an authentication path that should
+	// prove the inclusion of a binding proves its absence.
+	ErrBindingAbsent = errors.New("[merkletree] The authentication path proves the absence of an expected binding")
+	// ErrBindingPresent indicates that an authentication path that should
+	// prove the absence of a binding proves its inclusion.
+	ErrBindingPresent = errors.New("[merkletree] The authentication path proves the inclusion of an unexpected binding")
 )
 
 // ProofNode can be a user node or an empty node,
@@ -27,13 +39,18 @@ var (
 // of a given index. The type of that node can be determined
 // by the IsEmpty value. It also provides an opening of
 // the commitment if the returned AuthenticationPath
-// is a proof of inclusion.
+// is a proof of inclusion. The leaf of a user node also records
+// the epoch in which its key was first bound (AddedEpoch), and the one in
+// which it was last bound to a different value (ChangedEpoch), so that
+// clients can verify how long a binding has existed.
 type ProofNode struct {
-	Level      uint32
-	Index      []byte
-	Value      []byte
-	IsEmpty    bool
-	Commitment hashed.Commit
+	Level        uint32
+	Index        Index
+	Value        []byte
+	IsEmpty      bool
+	Commitment   hashed.Commit
+	AddedEpoch   Epoch
+	ChangedEpoch Epoch
 }
 
 func (n *ProofNode) hash(treeNonce []byte) []byte {
@@ -52,48 +69,74 @@ func (n *ProofNode) hash(treeNonce []byte) []byte {
 			[]byte(treeNonce),                   // K_n
 			[]byte(n.Index),                     // i
 			[]byte(conv.UInt32ToBytes(n.Level)), // l
+			n.AddedEpoch.Bytes(),                // e_added
+			n.ChangedEpoch.Bytes(),              // e_changed
 			[]byte(n.Commitment.Hash),           // commit(key|| value)
 		)
 	}
 }
 
 // A ProofType indicates whether an AuthenticationPath is
-// a proof of inclusion or a proof of absence.
+// a proof of inclusion or a proof of absence, and if the latter,
+// which kind of leaf proves the absence.
 type ProofType int
 
 const (
 	undeterminedProof ProofType = iota
-	ProofOfAbsence
+	// ProofOfInclusion means the path ends in a user leaf whose
+	// index equals the lookup index.
 	ProofOfInclusion
+	// ProofOfAbsenceEmpty means the path ends in an empty branch
+	// whose prefix matches the lookup index.
+	ProofOfAbsenceEmpty
+	// ProofOfAbsenceConflict means the path ends in a user leaf
+	// for a different index that shares a prefix with the lookup index.
+	ProofOfAbsenceConflict
 )
 
+// IsAbsence reports whether t is one of the proof of absence types.
+func (t ProofType) IsAbsence() bool {
+	return t == ProofOfAbsenceEmpty || t == ProofOfAbsenceConflict
+}
+
+func (t ProofType) String() string {
+	switch t {
+	case ProofOfInclusion:
+		return "ProofOfInclusion"
+	case ProofOfAbsenceEmpty:
+		return "ProofOfAbsenceEmpty"
+	case ProofOfAbsenceConflict:
+		return "ProofOfAbsenceConflict"
+	default:
+		return "UndeterminedProof"
+	}
+}
+
 // AuthenticationPath is a proof of inclusion or absence of requested index. A proof of inclusion is
 // when the leaf node's index equals the lookup index.
 type AuthenticationPath struct {
 	TreeNonce   []byte
 	PrunedTree  [][hashed.HashSizeByte]byte
-	LookupIndex []byte
+	LookupIndex Index
 	VrfProof    []byte
 	Leaf        *ProofNode
-
-	// proofType is used by ProofType() to memoize it.
-	// TODO: just calculate it up front.
-	proofType   ProofType
 }
 
 func (ap *AuthenticationPath) authPathHash() []byte {
-	hash := ap.Leaf.hash(ap.TreeNonce)
-	indexBits := conv.ToBits(ap.Leaf.Index)
+	// hashing into the same array keeps verification from allocating
+	// once per level
+	var hash hashed.Hash
+	copy(hash[:], ap.Leaf.hash(ap.TreeNonce))
 	depth := ap.Leaf.Level
 	for depth > 0 {
 		depth -= 1
-		if indexBits[depth] { // right child
-			hash = hashed.Digest(ap.PrunedTree[depth][:], hash)
+		if conv.GetNthBit(ap.Leaf.Index, depth) { // right child
+			hash = hashed.Sum(ap.PrunedTree[depth][:], hash[:])
 		} else {
-			hash = hashed.Digest(hash, ap.PrunedTree[depth][:])
+			hash = hashed.Sum(hash[:], ap.PrunedTree[depth][:])
 		}
 	}
-	return hash
+	return hash[:]
 }
 
 // Verify the proof for a key/value binding.
@@ -109,47 +152,168 @@ func (ap *AuthenticationPath) authPathHash() []byte {
 //
 // This should be called after the VRF index is verified successfully.
 func (ap *AuthenticationPath) Verify(key, value, treeHash []byte) error {
-	if ap.ProofType() == ProofOfAbsence {
+	if int(ap.Leaf.Level) > len(ap.PrunedTree) {
+		return ErrIndicesMismatch
+	}
+	if err := verifyLeaf(ap.Leaf, ap.LookupIndex, key, value); err != nil {
+		return err
+	}
+	if !bytes.Equal(treeHash, ap.authPathHash()) {
+		return ErrUnequalTreeHashes
+	}
+	return nil
+}
+
+// VerifyBinding verifies ap as a complete answer to the lookup of key
+// at lookupIndex in the tree with the nonce and the root hash treeHash,
+// without relying on any other layer: unlike Verify, it also checks
+// that ap is for lookupIndex in that tree, and that it proves what the
+// caller expects. A nil expectedValue expects ap to prove that key is
+// absent, and any other the inclusion of the binding of key to
+// expectedValue.
+//
+// It returns ErrIndicesMismatch if ap is for another index or
+// malformed, ErrTreeNonceMismatch if it's from a tree with another
+// nonce, and ErrUnequalTreeHashes if it doesn't hash to treeHash. An
+// authentic ap that proves the wrong thing results in ErrBindingAbsent
+// or ErrBindingPresent, and otherwise the errors of Verify apply.
+// lookupIndex still has to be verified against key by the caller, e.g.
+// with the VRF proof.
+func (ap *AuthenticationPath) VerifyBinding(treeHash, nonce []byte, lookupIndex Index, key,
+	expectedValue []byte) error {
+	if ap.Leaf == nil || !bytes.Equal(ap.LookupIndex, lookupIndex) ||
+		int(ap.Leaf.Level) > len(ap.PrunedTree) || int(ap.Leaf.Level) > len(ap.Leaf.Index)*8 {
+		return ErrIndicesMismatch
+	}
+	if !bytes.Equal(ap.TreeNonce, nonce) {
+		return ErrTreeNonceMismatch
+	}
+	if !bytes.Equal(treeHash, ap.authPathHash()) {
+		return ErrUnequalTreeHashes
+	}
+	switch absent := ap.ProofType().IsAbsence(); {
+	case absent && expectedValue != nil:
+		return ErrBindingAbsent
+	case !absent && expectedValue == nil:
+		return ErrBindingPresent
+	}
+	return verifyLeaf(ap.Leaf, lookupIndex, key, expectedValue)
+}
+
+// verifyLeaf verifies the leaf in which the search for lookupIndex
+// ended, as described in AuthenticationPath.Verify, except for the hash
+// of the tree.
+func verifyLeaf(leaf *ProofNode, lookupIndex Index, key, value []byte) error {
+	if int(leaf.Level) > len(lookupIndex)*8 ||
+		int(leaf.Level) > len(leaf.Index)*8 {
+		return ErrIndicesMismatch
+	}
+	if proofType(leaf, lookupIndex).IsAbsence() {
 		// Check if i and j match in the first l bits
-		indexBits := conv.ToBits(ap.Leaf.Index)
-		lookupIndexBits := conv.ToBits(ap.LookupIndex)
-		for i := 0; i < int(ap.Leaf.Level); i++ {
-			if indexBits[i] != lookupIndexBits[i] {
+		for i := uint32(0); i < leaf.Level; i++ {
+			if conv.GetNthBit(leaf.Index, i) != conv.GetNthBit(lookupIndex, i) {
 				return ErrIndicesMismatch
 			}
 		}
 		// expect the value is nil since we suppressed
 		// the salt & value (see Get())
-		if ap.Leaf.Value != nil {
+		if leaf.Value != nil {
 			return ErrBindingsDiffer
 		}
 	} else {
 		// Verify the key-value binding returned in the ProofNode
-		if !bytes.Equal(ap.Leaf.Value, value) {
+		if !bytes.Equal(leaf.Value, value) {
 			return ErrBindingsDiffer
 		}
-		if !ap.Leaf.Commitment.Verify(key, value) {
+		if !leaf.Commitment.Verify(key, value) {
 			return ErrUnverifiableCommitment
 		}
 	}
+	return nil
+}
 
-	if !bytes.Equal(treeHash, ap.authPathHash()) {
-		return ErrUnequalTreeHashes
+// Equal returns true iff ap and other are the same proof, i.e. prove
+// the same lookup against the same tree hash, without hashing either.
+// It's cheaper than verifying other, so a verifier that already verified
+// ap against a tree hash can skip verifying an equal proof against the
+// same tree hash.
+func (ap *AuthenticationPath) Equal(other *AuthenticationPath) bool {
+	if ap == other {
+		return true
 	}
-	return nil
+	if ap == nil || other == nil || len(ap.PrunedTree) != len(other.PrunedTree) ||
+		!bytes.Equal(ap.TreeNonce, other.TreeNonce) ||
+		!bytes.Equal(ap.LookupIndex, other.LookupIndex) ||
+		!bytes.Equal(ap.VrfProof, other.VrfProof) || !ap.Leaf.equal(other.Leaf) {
+		return false
+	}
+	for i := range ap.PrunedTree {
+		if ap.PrunedTree[i] != other.PrunedTree[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *ProofNode) equal(other *ProofNode) bool {
+	if n == nil || other == nil {
+		return n == other
+	}
+	return n.Level == other.Level && n.IsEmpty == other.IsEmpty &&
+		n.AddedEpoch == other.AddedEpoch && n.ChangedEpoch == other.ChangedEpoch &&
+		bytes.Equal(n.Index, other.Index) && bytes.Equal(n.Value, other.Value) &&
+		bytes.Equal(n.Commitment.Salt, other.Commitment.Salt) &&
+		bytes.Equal(n.Commitment.Hash, other.Commitment.Hash)
 }
 
-// ProofType returns the type of ap. It does a comparison
-// between the leaf index and the lookup index to determine
-// the proof type, and sets ap's proof type the first time this
-// method called, memoizing the proof type for subsequent calls.
+// ProofType returns the type of ap, as determined by its leaf:
+// an empty leaf makes ap a ProofOfAbsenceEmpty, and a user leaf makes
+// it a ProofOfInclusion if the leaf index equals the lookup index,
+// or a ProofOfAbsenceConflict otherwise.
+// ProofType doesn't verify ap; see Verify.
 func (ap *AuthenticationPath) ProofType() ProofType {
-	if ap.proofType == undeterminedProof {
-		if bytes.Equal(ap.LookupIndex, ap.Leaf.Index) {
-			ap.proofType = ProofOfInclusion
-		} else {
-			ap.proofType = ProofOfAbsence
-		}
+	return proofType(ap.Leaf, ap.LookupIndex)
+}
+
+func proofType(leaf *ProofNode, lookupIndex Index) ProofType {
+	switch {
+	case leaf == nil:
+		return undeterminedProof
+	case leaf.IsEmpty:
+		return ProofOfAbsenceEmpty
+	case bytes.Equal(lookupIndex, leaf.Index):
+		return ProofOfInclusion
+	default:
+		return ProofOfAbsenceConflict
+	}
+}
+
+// emptySiblingHash returns the hash of an empty sibling at level+1 of
+// the node at that level on the path of index.
+func emptySiblingHash(nonce []byte, index Index, level uint32) []byte {
+	n := &ProofNode{
+		Level:   level + 1,
+		Index:   childPrefix(index, level, !conv.GetNthBit(index, level)),
+		IsEmpty: true,
+	}
+	return n.hash(nonce)
+}
+
+var emptyLeafBs = []byte{LeafIdentifier}
+
+var emptyBranchBs = []byte{EmptyBranchIdentifier}
+
+// childPrefix returns the first level bits of index followed by the
+// bit right, padded with zeros to whole bytes: the index of the left or
+// right child at level+1 of the node at level on the path of index.
+// index may be nil for the root.
+func childPrefix(index []byte, level uint32, right bool) []byte {
+	prefix := make([]byte, level/8+1)
+	copy(prefix, index)
+	last := &prefix[level/8]
+	*last &^= 0xff >> (level % 8)
+	if right {
+		*last |= 0x80 >> (level % 8)
 	}
-	return ap.proofType
+	return prefix
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/internal/race"
 )
 
 type mockProof struct {
@@ -60,7 +61,7 @@ func setupTestProofs(t *testing.T) (*MerkleTree, []*mockProof) {
 		key := keyPrefix + strconv.FormatUint(i, 10)
 		val := append(valuePrefix, byte(i))
 		index := staticVRFKey.Compute([]byte(key))
-		if err := m.Set(index, key, val); err != nil {
+		if err := m.Set(index, []byte(key), val); err != nil {
 			t.Fatal(err)
 		}
 		tuple = append(tuple, &mockProof{key, val, index, ProofOfInclusion})
@@ -72,7 +73,7 @@ func setupTestProofs(t *testing.T) (*MerkleTree, []*mockProof) {
 	for {
 		absentKey = RandStringBytesMaskImprSrc(3)
 		absentIndex = staticVRFKey.Compute([]byte(absentKey))
-		proof := m.Get(absentIndex)
+		proof := mustGet(t, m, absentIndex)
 		// assert these indices share the same prefix in the first bit
 		if bytes.Equal(conv.ToBytes(conv.ToBits(sharedPrefix)[:proof.Leaf.Level]),
 			conv.ToBytes(conv.ToBits(absentIndex)[:proof.Leaf.Level])) {
@@ -80,7 +81,11 @@ func setupTestProofs(t *testing.T) (*MerkleTree, []*mockProof) {
 		}
 	}
 
-	tuple = append(tuple, &mockProof{absentKey, nil, absentIndex, ProofOfAbsence})
+	absentType := ProofOfAbsenceConflict
+	if mustGet(t, m, absentIndex).Leaf.IsEmpty {
+		absentType = ProofOfAbsenceEmpty
+	}
+	tuple = append(tuple, &mockProof{absentKey, nil, absentIndex, absentType})
 	m.recomputeHash()
 	return m, tuple
 }
@@ -89,7 +94,7 @@ func TestVerifyProof(t *testing.T) {
 	m, tests := setupTestProofs(t)
 
 	for _, tt := range tests {
-		proof := m.Get(tt.index)
+		proof := mustGet(t, m, tt.index)
 		if got, want := proof.ProofType(), tt.want; got != want {
 			t.Error("TestVerifyProof() Get failed with tuple(", tt.key, tt.value, tt.want, ")")
 		}
@@ -106,7 +111,7 @@ func TestProofVerificationErrors(t *testing.T) {
 
 	// ProofOfInclusion
 	// assert proof of inclusion
-	proof1 := m.Get(index)
+	proof1 := mustGet(t, m, index)
 	if proof1.ProofType() != ProofOfInclusion {
 		t.Fatal("Expect a proof of inclusion")
 	}
@@ -131,9 +136,9 @@ func TestProofVerificationErrors(t *testing.T) {
 
 	// ProofOfAbsence
 	index, key, value = tuple[N].index, tuple[N].key, tuple[N].value
-	proof2 := m.Get(index) // shares the same prefix with leaf node key1
+	proof2 := mustGet(t, m, index) // shares the same prefix with leaf node key1
 	// assert proof of absence
-	if proof2.ProofType() != ProofOfAbsence {
+	if !proof2.ProofType().IsAbsence() {
 		t.Fatal("Expect a proof of absence")
 	}
 	// - ErrBindingsDiffer
@@ -148,3 +153,160 @@ func TestProofVerificationErrors(t *testing.T) {
 		t.Error("Expect", ErrIndicesMismatch, "got", err)
 	}
 }
+
+func TestProofTypes(t *testing.T) {
+	m := newEmptyTreeForTest(t)
+	included := make([]byte, DefaultIndexSize) // 0000...
+	if err := m.Set(included, []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+
+	conflicting := make([]byte, DefaultIndexSize) // 0100..., ends at the leaf of 0000...
+	conflicting[0] = 0x40
+	empty := make([]byte, DefaultIndexSize) // 1000..., ends at the root's empty right child
+	empty[0] = 0x80
+
+	for _, tc := range []struct {
+		index []byte
+		key   string
+		value []byte
+		want  ProofType
+	}{
+		{included, "key", []byte("value"), ProofOfInclusion},
+		{conflicting, "other", nil, ProofOfAbsenceConflict},
+		{empty, "other", nil, ProofOfAbsenceEmpty},
+	} {
+		ap := mustGet(t, m, tc.index)
+		if got := ap.ProofType(); got != tc.want {
+			t.Errorf("Expect %v, got %v", tc.want, got)
+		}
+		if got := ap.ProofType().IsAbsence(); got != (tc.want != ProofOfInclusion) {
+			t.Errorf("Unexpected IsAbsence() %v for %v", got, tc.want)
+		}
+		if err := ap.Verify([]byte(tc.key), tc.value, m.hash); err != nil {
+			t.Errorf("Verify() failed for %v: %v", tc.want, err)
+		}
+	}
+}
+
+func TestVerifyBinding(t *testing.T) {
+	m, tuple := setupTestProofs(t)
+	included, absent := tuple[0], tuple[N]
+	otherIndex := append([]byte{}, included.index...)
+	otherIndex[len(otherIndex)-1] ^= 1
+	otherHash := append([]byte{}, m.hash...)
+	otherHash[0] ^= 1
+
+	for _, tc := range []struct {
+		name  string
+		proof *mockProof
+		nonce []byte
+		index []byte
+		hash  []byte
+		value []byte
+		want  error
+	}{
+		{"inclusion", included, m.nonce, included.index, m.hash, included.value, nil},
+		{"absence", absent, m.nonce, absent.index, m.hash, nil, nil},
+		{"other index", included, m.nonce, otherIndex, m.hash, included.value, ErrIndicesMismatch},
+		{"other nonce", included, otherHash, included.index, m.hash, included.value, ErrTreeNonceMismatch},
+		{"other tree", included, m.nonce, included.index, otherHash, included.value, ErrUnequalTreeHashes},
+		{"unexpected absence", absent, m.nonce, absent.index, m.hash, []byte("value"), ErrBindingAbsent},
+		{"unexpected inclusion", included, m.nonce, included.index, m.hash, nil, ErrBindingPresent},
+		{"other value", included, m.nonce, included.index, m.hash, []byte("value"), ErrBindingsDiffer},
+	} {
+		ap := mustGet(t, m, tc.proof.index)
+		err := ap.VerifyBinding(tc.hash, tc.nonce, tc.index, []byte(tc.proof.key), tc.value)
+		if err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+
+	ap := mustGet(t, m, included.index)
+	ap.Leaf = nil
+	if err := ap.VerifyBinding(m.hash, m.nonce, included.index, []byte(included.key),
+		included.value); err != ErrIndicesMismatch {
+		t.Error("Expect", ErrIndicesMismatch, "got", err)
+	}
+}
+
+func TestAuthPathEqual(t *testing.T) {
+	m, tuple := setupTestProofs(t)
+	ap := mustGet(t, m, tuple[0].index)
+	if !ap.Equal(mustGet(t, m, tuple[0].index)) {
+		t.Fatal("Expect the proofs of the same lookup to be equal")
+	}
+	if ap.Equal(mustGet(t, m, tuple[1].index)) || ap.Equal(nil) {
+		t.Error("Expect the proofs of other lookups to differ")
+	}
+	for _, tamper := range []func(ap *AuthenticationPath){
+		func(ap *AuthenticationPath) { ap.PrunedTree[0][0] ^= 1 },
+		func(ap *AuthenticationPath) { ap.VrfProof = []byte("proof") },
+		func(ap *AuthenticationPath) { ap.Leaf.Value = []byte("value") },
+		func(ap *AuthenticationPath) { ap.Leaf.ChangedEpoch++ },
+		func(ap *AuthenticationPath) { ap.Leaf.Commitment.Salt = []byte("salt") },
+	} {
+		other := mustGet(t, m, tuple[0].index)
+		tamper(other)
+		if ap.Equal(other) {
+			t.Error("Expect a tampered proof to differ")
+		}
+	}
+}
+
+func BenchmarkAuthPathVerify(b *testing.B) {
+	m, indices := benchTree(b, 100000)
+	aps := make([]*AuthenticationPath, 1000)
+	for i := range aps {
+		aps[i] = mustGet(b, m, indices[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % len(aps)
+		if err := aps[j].Verify(conv.UInt32ToBytes(uint32(j)), valuePrefix, m.hash); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestProofAllocs keeps the allocations of serving and verifying proofs
+// from growing with the depth of the path.
+func TestProofAllocs(t *testing.T) {
+	if race.Enabled {
+		t.Skip("the race detector allocates")
+	}
+	const (
+		// the path, its leaf, and the growth of PrunedTree up to 16
+		// levels
+		getBudget = 7
+		// hashing the leaf and opening the commitment
+		verifyBudget = 5
+	)
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := batchEntries(1000, 0, valuePrefix)
+	if err := m.SetBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	e := entries[len(entries)/2]
+	ap := mustGet(t, m, e.Index)
+	if len(ap.PrunedTree) < 8 || len(ap.PrunedTree) > 16 {
+		t.Fatalf("Expect a path of 8 to 16 levels, got %d", len(ap.PrunedTree))
+	}
+	if allocs := testing.AllocsPerRun(100, func() { mustGet(t, m, e.Index) }); allocs > getBudget {
+		t.Errorf("Expect Get to allocate at most %d times, got %v", getBudget, allocs)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := ap.Verify(e.Key, e.Value, m.hash); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > verifyBudget {
+		t.Errorf("Expect Verify to allocate at most %d times, got %v", verifyBudget, allocs)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"io"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// WithRandomness makes the tree read the nonce and the salts of its
+// commitments from rnd instead of a secure random source, e.g. to
+// generate reproducible test vectors. A tree with predictable nonces and
+// salts leaks its bindings, so rnd must never be predictable in
+// production. Reads from rnd must not fail.
+//
+// The clones of the tree read from rnd too. Since only the tree that
+// isn't a snapshot yet reads from it, rnd needn't be safe for concurrent
+// use.
+func WithRandomness(rnd io.Reader) TreeOption {
+	return func(m *MerkleTree) {
+		m.rand = rnd
+	}
+}
+
+// randomness returns the source of randomness the options opts give a
+// tree, or nil for the default.
+func randomness(opts []TreeOption) io.Reader {
+	var m MerkleTree
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return m.rand
+}
+
+// randSlice returns 32 random bytes from rnd, or from a secure random
+// source if rnd is nil.
+func randSlice(rnd io.Reader) []byte {
+	if rnd == nil {
+		return hashed.RandSlice()
+	}
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rnd, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// newCommit commits to key and value with a salt from rnd, like
+// hashed.NewCommit.
+func newCommit(rnd io.Reader, key, value []byte) hashed.Commit {
+	salt := randSlice(rnd)
+	return hashed.Commit{Salt: salt, Hash: hashed.CommitHash([][]byte{key, value}, salt)}
+}
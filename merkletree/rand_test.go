@@ -0,0 +1,31 @@
+package merkletree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/ORBAT/cloniks/conv"
+)
+
+func TestWithRandomness(t *testing.T) {
+	hash := func(seed int64) []byte {
+		m, err := NewMerkleTreeWithIndexSize(DefaultIndexSize, WithRandomness(rand.New(rand.NewSource(seed))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint32(0); i < 10; i++ {
+			key := conv.UInt32ToBytes(i)
+			if err := m.Set(staticVRFKey.Compute(key), key, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return m.Hash()
+	}
+	if !bytes.Equal(hash(1), hash(1)) {
+		t.Error("Expect the same randomness to give the same tree")
+	}
+	if bytes.Equal(hash(1), hash(2)) {
+		t.Error("Expect different randomness to give different trees")
+	}
+}
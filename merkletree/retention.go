@@ -0,0 +1,242 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+var (
+	// ErrInvalidMemoryBudget indicates that the low watermark of a
+	// memory budget is above the high one.
+	ErrInvalidMemoryBudget = errors.New("[merkletree] invalid memory budget")
+	// ErrNoSnapshotStore indicates that a RetentionPolicy archives the
+	// snapshots of a PAD that has no SnapshotStore to archive them in.
+	ErrNoSnapshotStore = errors.New("[merkletree] no snapshot store to archive snapshots in")
+)
+
+// An ErrEpochPruned is returned for lookups in an epoch whose snapshot
+// only retains its STR, because its tree has fallen out of the window of
+// full snapshots (see RetentionPolicy). Nearest is the nearest
+// epoch whose snapshot can still serve lookups.
+type ErrEpochPruned struct {
+	Epoch   Epoch
+	Nearest Epoch
+}
+
+func (e ErrEpochPruned) Error() string {
+	return fmt.Sprintf("[merkletree] the tree of epoch %d has been pruned; the nearest full snapshot is of epoch %d",
+		e.Epoch, e.Nearest)
+}
+
+// A RetentionPolicy decides which snapshots of a PAD keep their trees,
+// and can serve lookups. The trees of the others are pruned: they're
+// released from memory, and the snapshots only retain their STRs, which
+// makes the STR history much cheaper to retain than full snapshots.
+// Lookups in their epochs return an ErrEpochPruned, unless the PAD has
+// a SnapshotStore to load the pruned trees from. The latest snapshot
+// always keeps its tree, and the zero RetentionPolicy keeps every tree.
+type RetentionPolicy struct {
+	// Epochs is the number of latest snapshots that keep their trees,
+	// or 0 for no limit.
+	Epochs uint64
+	// MaxAge is how long after it was taken a snapshot keeps its tree,
+	// or 0 for no limit. Snapshots age between updates too, so their
+	// trees are pruned by CollectGarbage.
+	MaxAge time.Duration
+	// Archive keeps every snapshot forever: the pruned trees are
+	// spilled to the PAD's SnapshotStore, which it must have, and
+	// lookups in their epochs are served from it.
+	Archive bool
+}
+
+// GCStats describes the memory released by pruning the trees of
+// snapshots.
+type GCStats struct {
+	// Pruned is the number of snapshots whose trees were pruned.
+	Pruned uint64
+	// Bytes is the approximate memory footprint of the pruned trees,
+	// counted as in PADStats.
+	Bytes uint64
+}
+
+// SetRetentionPolicy makes the PAD retain the trees of its snapshots as
+// decided by policy, and prunes the trees outside it right away. It
+// returns ErrNoSnapshotStore if policy archives the snapshots but the
+// PAD has no SnapshotStore, and an error wrapping ErrSpillFailed if the
+// SnapshotStore couldn't store a pruned tree, in which case the policy
+// is set, but the tree is kept until the next prune. The EvictionFunc,
+// if any, is called for every pruned tree.
+func (pad *PAD) SetRetentionPolicy(policy RetentionPolicy) error {
+	if policy.Archive && pad.spill == nil {
+		return ErrNoSnapshotStore
+	}
+	pad.retention = policy
+	_, err := pad.prune()
+	return err
+}
+
+// SetFullSnapshots makes the PAD keep the trees of only the n latest
+// snapshots, which can serve lookups, as a RetentionPolicy with the
+// Epochs n does. The rest of the current policy is kept.
+// If n is 0, which is the default, the number of snapshots doesn't
+// limit which of them keep their trees.
+// It returns an error wrapping ErrSpillFailed if the SnapshotStore
+// couldn't store a pruned tree, as SetRetentionPolicy does.
+func (pad *PAD) SetFullSnapshots(n uint64) error {
+	pad.retention.Epochs = n
+	_, err := pad.prune()
+	return err
+}
+
+// CollectGarbage prunes the trees of the snapshots that have fallen out
+// of the PAD's RetentionPolicy, and returns the memory it released.
+// Update prunes the snapshots too, but those that are only too old are
+// pruned by CollectGarbage until the next update, so it's meant to be
+// called periodically, e.g. by directory.Tree.RunGC. Like the other
+// methods of PAD, it must not be called concurrently with them.
+// If the SnapshotStore couldn't store a tree, CollectGarbage returns the
+// memory released before along with an error wrapping ErrSpillFailed,
+// and the tree and the newer ones are kept until the next call.
+func (pad *PAD) CollectGarbage() (GCStats, error) {
+	return pad.prune()
+}
+
+// prune removes the trees of the snapshots outside the retention
+// policy, oldest first, and returns the memory it released. It stops at
+// the first tree the SnapshotStore couldn't store, so that the pruned
+// snapshots stay the oldest ones.
+func (pad *PAD) prune() (GCStats, error) {
+	var st GCStats
+	outside := pad.loadedEpochs[:pad.outsideRetention()]
+	first := len(outside)
+	for first > 0 && pad.snapshots[outside[first-1]].tree != nil {
+		// older ones have been pruned before
+		first--
+	}
+	var err error
+	for _, epoch := range outside[first:] {
+		str := pad.snapshots[epoch]
+		if err = pad.spillSnapshot(str); err != nil {
+			break
+		}
+		if pad.onEvict != nil {
+			pad.onEvict(pad.view(str))
+		}
+		if pad.store != nil {
+			pad.releaseNodes(epoch)
+		}
+		str.tree = nil
+		st.Pruned++
+		st.Bytes += pad.stats[epoch].Bytes
+		pad.stats[epoch] = TreeStats{}
+	}
+	pad.reclaimed.Pruned += st.Pruned
+	pad.reclaimed.Bytes += st.Bytes
+	return st, err
+}
+
+// outsideRetention returns the number of the oldest snapshots in memory
+// whose trees the retention policy doesn't keep.
+func (pad *PAD) outsideRetention() int {
+	latest := len(pad.loadedEpochs) - 1
+	n := 0
+	if keep := pad.retention.Epochs; keep > 0 && uint64(len(pad.loadedEpochs)) > keep {
+		n = len(pad.loadedEpochs) - int(keep)
+	}
+	if pad.retention.MaxAge > 0 {
+		oldest := pad.now().Add(-pad.retention.MaxAge)
+		for n < latest && pad.taken[pad.loadedEpochs[n]].Before(oldest) {
+			n++
+		}
+	}
+	return n
+}
+
+// pruned returns the ErrEpochPruned for the pruned snapshot str.
+func (pad *PAD) pruned(str *SignedTreeRoot) ErrEpochPruned {
+	nearest := pad.latestSTR.Epoch
+	for _, epoch := range pad.loadedEpochs {
+		if pad.snapshots[epoch].tree != nil {
+			nearest = epoch
+			break
+		}
+	}
+	return ErrEpochPruned{Epoch: str.Epoch, Nearest: nearest}
+}
+
+// An EvictionFunc is called with a view of a snapshot just before its
+// tree is removed from memory, whether the whole snapshot is evicted or
+// only its tree is pruned, so that a persistence layer can archive the
+// snapshot. It's called once for every snapshot, oldest first, by the
+// goroutine calling PAD.Update. The tree stays in memory for as long as
+// the view is retained.
+type EvictionFunc func(view ReadOnlyTree)
+
+// SetEvictionFunc makes the PAD call f for every snapshot whose tree is
+// removed from memory. f may be nil.
+func (pad *PAD) SetEvictionFunc(f EvictionFunc) {
+	pad.onEvict = f
+}
+
+// A memoryBudget bounds the memory used by the snapshots of a PAD.
+type memoryBudget struct {
+	low, high uint64
+}
+
+// SetMemoryBudget makes the retention of snapshots adaptive: instead of
+// keeping a fixed number of snapshots, the PAD keeps as many as fit in
+// the budget. When the approximate memory footprint of the snapshots
+// (see PADStats) exceeds the high watermark high, the oldest snapshots
+// are evicted until it's at most the low watermark low. The latest
+// snapshot is never evicted. The gap between the watermarks keeps the
+// PAD from evicting a snapshot on every update.
+// The number of snapshots passed to NewPAD then only sets the initial
+// capacity. If high is 0, the budget is removed, and at most that
+// number of snapshots is kept again.
+// SetMemoryBudget returns ErrInvalidMemoryBudget if low is above high,
+// and an error wrapping ErrSpillFailed if the SnapshotStore couldn't
+// store an evicted snapshot, in which case the budget is set, but the
+// snapshot is kept until the next eviction.
+func (pad *PAD) SetMemoryBudget(low, high uint64) error {
+	if low > high {
+		return ErrInvalidMemoryBudget
+	}
+	pad.budget = memoryBudget{low: low, high: high}
+	return pad.enforceBudget()
+}
+
+// enforceBudget evicts the oldest snapshots if the memory budget has
+// been exceeded.
+func (pad *PAD) enforceBudget() error {
+	if pad.budget.high == 0 {
+		return nil
+	}
+	costs := make([]uint64, len(pad.loadedEpochs))
+	var total uint64
+	for i, epoch := range pad.loadedEpochs {
+		costs[i] = pad.stats[epoch].Bytes + strBytes(pad.snapshots[epoch])
+		total += costs[i]
+	}
+	if total <= pad.budget.high {
+		return nil
+	}
+	n := 0
+	for ; n < len(costs)-1 && total > pad.budget.low; n++ {
+		total -= costs[n]
+	}
+	return pad.evict(n)
+}
+
+// strBytes approximates the memory footprint of str without its tree,
+// so that snapshots whose trees have been pruned count against the
+// memory budget too.
+func strBytes(str *SignedTreeRoot) uint64 {
+	return uint64(unsafe.Sizeof(*str)) + uint64(cap(str.SkipHashes))*hashed.HashSizeByte
+}
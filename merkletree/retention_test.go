@@ -0,0 +1,232 @@
+package merkletree
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+func TestPADSetFullSnapshots(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		pad.Update(nil)
+	}
+	pad.SetFullSnapshots(2) // epochs 4 and 5
+	pad.Update(nil)         // epochs 5 and 6
+
+	want := ErrEpochPruned{Epoch: 4, Nearest: 5}
+	var pruned ErrEpochPruned
+	if _, err := pad.At(4); !errors.As(err, &pruned) || pruned != want {
+		t.Fatal("Expect", want, "got", err)
+	}
+	if _, err := pad.LookupInEpoch([]byte("alice"), 0); !errors.As(err, &pruned) || pruned.Nearest != 5 {
+		t.Error("Expect the snapshot of epoch 0 to be pruned, got", err)
+	}
+	if _, _, err := pad.FirstChangeSince([]byte("alice"), nil, 3); !errors.As(err, &pruned) || pruned.Epoch != 4 {
+		t.Error("Expect the snapshot of epoch 4 to be pruned, got", err)
+	}
+	// the STRs are kept
+	for epoch := Epoch(0); epoch <= 6; epoch++ {
+		if str := pad.GetSTR(epoch); str == nil || str.Epoch != epoch {
+			t.Fatal("Expect the STR of epoch", epoch)
+		}
+	}
+	for _, epoch := range []Epoch{5, 6} {
+		view, err := pad.At(epoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ap, err := view.Get([]byte("alice")); err != nil || ap.ProofType() != ProofOfInclusion {
+			t.Error("Expect a proof of inclusion in epoch", epoch, err)
+		}
+	}
+	st := padStats(t, pad)
+	if st.Snapshots[4].Bytes != 0 || st.Snapshots[5].Bytes == 0 {
+		t.Error("Expect only the full snapshots to use memory", st.Snapshots)
+	}
+
+	pad.SetFullSnapshots(0)
+	pad.Update(nil)
+	if _, err := pad.At(5); err != nil {
+		t.Error("Expect the snapshot of epoch 5 to be kept in full, got", err)
+	}
+}
+
+func TestPADMemoryBudget(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evicted []Epoch
+	pad.SetEvictionFunc(func(view ReadOnlyTree) {
+		if ap, err := view.Get([]byte("alice")); view.Epoch() > 0 && (err != nil || ap.ProofType() != ProofOfInclusion) {
+			t.Error("Expect a full snapshot of epoch", view.Epoch(), err)
+		}
+		evicted = append(evicted, view.Epoch())
+	})
+	// changing alice's key in every epoch makes every snapshot but the
+	// latest retain the same nodes
+	update := func() {
+		t.Helper()
+		value := []byte{'k', byte(pad.LatestSTR().Epoch)}
+		if err := pad.Set([]byte("alice"), value); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+	}
+	update() // epoch 1
+	update() // epoch 2, and epoch 0 is evicted
+	st := padStats(t, pad)
+	// the STRs for even epochs are larger by at least one skip hash
+	cost := st.Snapshots[0].Bytes + strBytes(pad.GetSTR(1)) + hashed.HashSizeByte
+
+	if err := pad.SetMemoryBudget(3*cost, 2*cost); err != ErrInvalidMemoryBudget {
+		t.Error("Expect", ErrInvalidMemoryBudget, "got", err)
+	}
+	// room for 4 snapshots, more than the 2 passed to NewPAD
+	if err := pad.SetMemoryBudget(2*cost, 4*cost); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	update() // epoch 4
+	if !equalEpochs(evicted, []Epoch{0}) || len(padStats(t, pad).Snapshots) != 4 {
+		t.Fatal("Expect no evictions within the budget, got", evicted, padStats(t, pad).Snapshots)
+	}
+	update() // epoch 5, over the high watermark
+	if len(padStats(t, pad).Snapshots) != 2 || padStats(t, pad).Bytes()-padStats(t, pad).Pending.Bytes > 2*cost {
+		t.Error("Expect eviction down to the low watermark, got", padStats(t, pad).Snapshots)
+	}
+	if want := []Epoch{0, 1, 2, 3}; !equalEpochs(evicted, want) {
+		t.Error("Expect", want, "to be evicted, got", evicted)
+	}
+
+	// pruned trees are passed to the EvictionFunc once
+	evicted = nil
+	pad.SetFullSnapshots(1)
+	update()
+	update()
+	if want := []Epoch{4, 5, 6}; !equalEpochs(evicted, want) {
+		t.Error("Expect", want, "to be evicted, got", evicted)
+	}
+
+	// without a budget, the PAD keeps at most 2 snapshots again
+	if err := pad.SetMemoryBudget(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		pad.Update(nil)
+	}
+	if n := len(padStats(t, pad).Snapshots); n > 2 {
+		t.Error("Expect at most 2 snapshots, got", n)
+	}
+}
+
+func TestPADRetentionPolicy(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	pad.now = func() time.Time { return now }
+	pad.taken[0] = now
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Minute)
+		if err := pad.Set([]byte("alice"), []byte{'k', byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+	}
+	// epochs 0 to 4 were taken a minute apart, the latest just now
+	if err := pad.SetRetentionPolicy(RetentionPolicy{Epochs: 4, Archive: true}); err != ErrNoSnapshotStore {
+		t.Error("Expect", ErrNoSnapshotStore, "got", err)
+	}
+	if err := pad.SetRetentionPolicy(RetentionPolicy{MaxAge: 150 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	before := padStats(t, pad)
+	if _, err := pad.At(2); err != nil {
+		t.Fatal("Expect the snapshot of epoch 2 to keep its tree, got", err)
+	}
+	var pruned ErrEpochPruned
+	if _, err := pad.At(1); !errors.As(err, &pruned) || pruned.Nearest != 2 {
+		t.Fatal("Expect the snapshot of epoch 1 to be pruned, got", err)
+	}
+
+	// snapshots age between updates
+	now = now.Add(time.Hour)
+	st, err := pad.CollectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Pruned != 2 {
+		t.Error("Expect the trees of epochs 2 and 3 to be pruned, got", st)
+	}
+	var want uint64
+	for _, e := range before.Snapshots[2:4] {
+		want += e.Bytes
+	}
+	if st.Bytes != want {
+		t.Error("Expect", want, "bytes to be reclaimed, got", st.Bytes)
+	}
+	if _, err := pad.At(4); err != nil {
+		t.Error("Expect the latest snapshot to keep its tree, got", err)
+	}
+	if st, _ := pad.CollectGarbage(); st != (GCStats{}) {
+		t.Error("Expect nothing more to be pruned, got", st)
+	}
+	if total := padStats(t, pad).Reclaimed; total.Pruned != 4 || total.Bytes < want {
+		t.Error("Expect the trees of 4 snapshots to be reclaimed in total, got", total)
+	}
+	for epoch := Epoch(0); epoch <= 4; epoch++ {
+		if str := pad.GetSTR(epoch); str == nil || str.Epoch != epoch {
+			t.Fatal("Expect the STR of epoch", epoch)
+		}
+	}
+}
+
+func TestPADRetentionPolicyArchive(t *testing.T) {
+	store := NewMemSnapshotStore()
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10, WithSnapshotStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.SetRetentionPolicy(RetentionPolicy{Epochs: 1, Archive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		pad.Update(nil)
+	}
+	if store.Len() != 3 || padStats(t, pad).Reclaimed.Pruned != 3 {
+		t.Fatal("Expect the pruned trees to be archived, got", store.Len())
+	}
+	ap, err := pad.LookupInEpoch([]byte("alice"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.ProofType() != ProofOfInclusion {
+		t.Error("Expect a proof of inclusion from the archive")
+	}
+}
+
+func equalEpochs(a, b []Epoch) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"sync"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+)
+
+// A ShardedTree is an experimental Merkle prefix tree whose index space
+// is split by the first bits bits of the indices across 2^bits
+// independent MerkleTrees, the shards. Each shard has its own nonce and
+// root hash, so shards can be updated in parallel, or hosted on
+// different machines that only exchange their root hashes. The root
+// hash of the ShardedTree combines those of its shards in a binary hash
+// tree (see CombineShardRoots), and is signed in STRs like the root hash
+// of a MerkleTree.
+//
+// A proof from a ShardedTree is a ShardedAuthPath: the AuthenticationPath
+// from the shard of the index, and one more layer proving the shard's
+// root hash against the combined one.
+type ShardedTree struct {
+	bits   int
+	shards []*MerkleTree
+	hash   []byte
+}
+
+// NewShardedTree returns an empty ShardedTree with 2^bits shards that
+// accept indices of indexSize bytes. It returns ErrInvalidShardBits if
+// bits isn't in [1, MaxShardBits], and ErrInvalidIndexSize if indexSize
+// isn't in [MinIndexSize, DefaultIndexSize].
+func NewShardedTree(bits, indexSize int) (*ShardedTree, error) {
+	if bits < 1 || bits > MaxShardBits {
+		return nil, ErrInvalidShardBits
+	}
+	s := &ShardedTree{bits: bits, shards: make([]*MerkleTree, 1<<bits)}
+	for i := range s.shards {
+		m, err := NewMerkleTreeWithIndexSize(indexSize)
+		if err != nil {
+			return nil, err
+		}
+		s.shards[i] = m
+	}
+	return s, nil
+}
+
+// Bits returns the number of index bits s splits the index space by.
+func (s *ShardedTree) Bits() int {
+	return s.bits
+}
+
+// Shard returns the shard i of s. Changing it changes s.
+func (s *ShardedTree) Shard(i int) *MerkleTree {
+	return s.shards[i]
+}
+
+// Set sets the binding of key to value at index in its shard, like
+// MerkleTree.Set.
+func (s *ShardedTree) Set(index Index, key, value []byte) error {
+	if err := index.Validate(s.shards[0].indexSize); err != nil {
+		return err
+	}
+	s.hash = nil
+	return s.shards[ShardOf(index, s.bits)].Set(index, key, value)
+}
+
+// SetBatch sets the bindings of entries with the MerkleTree.SetBatch of
+// their shards, which run in parallel. s isn't modified if an entry has
+// an index of the wrong length. If an entry's index collides with
+// another key, SetBatch returns ErrIndexCollision, and only the shard of
+// that entry isn't modified.
+func (s *ShardedTree) SetBatch(entries []Entry) error {
+	byShard := make([][]Entry, len(s.shards))
+	for _, e := range entries {
+		if err := e.Index.Validate(s.shards[0].indexSize); err != nil {
+			return err
+		}
+		shard := ShardOf(e.Index, s.bits)
+		byShard[shard] = append(byShard[shard], e)
+	}
+	s.hash = nil
+	errs := make([]error, len(s.shards))
+	s.each(func(i int, m *MerkleTree) {
+		if len(byShard[i]) > 0 {
+			errs[i] = m.SetBatch(byShard[i])
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// each calls f for each shard of s in parallel, and waits for all of
+// them to return.
+func (s *ShardedTree) each(f func(i int, m *MerkleTree)) {
+	var wg sync.WaitGroup
+	wg.Add(len(s.shards))
+	for i, m := range s.shards {
+		go func(i int, m *MerkleTree) {
+			defer wg.Done()
+			f(i, m)
+		}(i, m)
+	}
+	wg.Wait()
+}
+
+// Hash returns the root hash of s, which combines the root hashes of its
+// shards. The hashes of the shards that changed since they were last
+// computed are computed in parallel.
+func (s *ShardedTree) Hash() []byte {
+	stale := s.hash == nil
+	for _, m := range s.shards {
+		stale = stale || m.stale()
+	}
+	if !stale {
+		return s.hash
+	}
+	roots := make([][]byte, len(s.shards))
+	s.each(func(i int, m *MerkleTree) {
+		roots[i] = m.Hash()
+	})
+	s.hash = CombineShardRoots(roots)
+	return s.hash
+}
+
+// Clone returns a copy of s whose shards are clones of those of s. See
+// MerkleTree.Clone.
+func (s *ShardedTree) Clone() *ShardedTree {
+	c := &ShardedTree{bits: s.bits, shards: make([]*MerkleTree, len(s.shards))}
+	for i, m := range s.shards {
+		// shards have no NodeStore, so cloning them can't fail
+		c.shards[i], _ = m.Clone()
+	}
+	c.hash = copyOfBs(s.Hash())
+	return c
+}
+
+// shape returns the level of the deepest user leaf in the shards of s,
+// and the number of user leaves in all of them.
+func (s *ShardedTree) shape() (maxDepth uint32, leaves uint64) {
+	for _, m := range s.shards {
+		depth, n := m.shape()
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		leaves += n
+	}
+	return
+}
+
+// Get returns the ShardedAuthPath proving the inclusion or absence of
+// lookupIndex in s.
+func (s *ShardedTree) Get(lookupIndex Index) *ShardedAuthPath {
+	s.Hash()
+	shard := ShardOf(lookupIndex, s.bits)
+	// shards have no NodeStore, so the lookup can't fail
+	ap, _ := s.shards[shard].Get(lookupIndex)
+	p := &ShardedAuthPath{AP: ap}
+	copy(p.ShardRoot[:], s.shards[shard].hash)
+	// the hashes of the subtrees of shards at each level of the hash
+	// tree that combines them, from the bottom up
+	level := make([][]byte, len(s.shards))
+	for i, m := range s.shards {
+		level[i] = m.hash
+	}
+	siblings := make([][hashed.HashSizeByte]byte, s.bits)
+	for depth := s.bits - 1; depth >= 0; depth-- {
+		copy(siblings[depth][:], level[shard^1])
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = hashed.Digest(shardBs, level[2*i], level[2*i+1])
+		}
+		level, shard = next, shard/2
+	}
+	p.ShardPath = siblings
+	return p
+}
+
+// NewShardedSTR is NewSTR for the ShardedTree s, whose root hash it
+// signs. The STR doesn't retain s, so it can't serve proofs like the
+// STRs of a PAD.
+func NewShardedSTR(key sign.Signer, ad AssocData, s *ShardedTree, epoch Epoch, prevHash hashed.Hash,
+	skips []hashed.Hash) *SignedTreeRoot {
+	maxDepth, leaves := s.shape()
+	return newSTR(key, ad, nil, s.Hash(), maxDepth, leaves, epoch, prevHash, skips)
+}
@@ -0,0 +1,88 @@
+package merkletree
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+func TestShardedTree(t *testing.T) {
+	if _, err := NewShardedTree(0, DefaultIndexSize); err != ErrInvalidShardBits {
+		t.Fatal("Expect", ErrInvalidShardBits, "got", err)
+	}
+	s, err := NewShardedTree(3, DefaultIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []Entry
+	for i := 0; i < 50; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		entries = append(entries, Entry{Index: hashed.Digest(key), Key: key, Value: []byte("value")})
+	}
+	if err := s.SetBatch(entries[:40]); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries[40:] {
+		if err := s.Set(e.Index, e.Key, e.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots := make([][]byte, 8)
+	for i := range roots {
+		roots[i] = s.Shard(i).Hash()
+	}
+	if !bytes.Equal(s.Hash(), CombineShardRoots(roots)) {
+		t.Error("Expect the hash of the tree to combine the roots of its shards")
+	}
+	for _, e := range entries {
+		p := s.Get(e.Index)
+		if p.AP.ProofType() != ProofOfInclusion {
+			t.Fatal("Expect a proof of inclusion of", string(e.Key))
+		}
+		if err := p.Verify(e.Key, e.Value, s.Hash()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	absent := hashed.Digest([]byte("absent"))
+	if err := s.Get(absent).Verify([]byte("absent"), nil, s.Hash()); err != nil {
+		t.Error(err)
+	}
+
+	p := s.Get(entries[0].Index)
+	tampered := *p
+	tampered.ShardPath = append(p.ShardPath[:0:0], p.ShardPath...)
+	tampered.ShardPath[1][0] ^= 1
+	if err := tampered.Verify(entries[0].Key, entries[0].Value, s.Hash()); err != ErrUnequalTreeHashes {
+		t.Error("Expect", ErrUnequalTreeHashes, "got", err)
+	}
+	// the proof of a shard's root is bound to the shard of the index
+	other := *p
+	other.AP = s.Get(entries[1].Index).AP
+	if ShardOf(entries[0].Index, 3) != ShardOf(entries[1].Index, 3) {
+		if err := other.Verify(entries[1].Key, entries[1].Value, s.Hash()); err != ErrUnequalTreeHashes {
+			t.Error("Expect", ErrUnequalTreeHashes, "got", err)
+		}
+	}
+
+	snapshot := s.Clone()
+	if err := s.Set(entries[0].Index, entries[0].Key, []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(snapshot.Hash(), s.Hash()) {
+		t.Error("Expect the clone not to change with the tree")
+	}
+	if err := snapshot.Get(entries[0].Index).Verify(entries[0].Key, entries[0].Value, snapshot.Hash()); err != nil {
+		t.Error(err)
+	}
+
+	str := NewShardedSTR(signKey, TestAd{""}, s, 1, hashed.Hash{}, nil)
+	if !bytes.Equal(str.TreeHash[:], s.Hash()) || str.LeafCount != 50 {
+		t.Error("Expect the STR to sign the hash and shape of the tree")
+	}
+	if !signKey.Public().Verify(str.Bytes(), str.Signature[:]) {
+		t.Error("Expect a valid signature")
+	}
+}
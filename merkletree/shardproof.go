@@ -0,0 +1,97 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// ErrInvalidShardBits indicates that the requested number of shard bits
+// is outside of [1, MaxShardBits].
+var ErrInvalidShardBits = errors.New("[merkletree] Invalid number of shard bits")
+
+const (
+	// ShardIdentifier is the domain separation prefix for the hashes
+	// that combine the roots of shards.
+	ShardIdentifier = 'S'
+
+	// MaxShardBits is the largest number of index bits a ShardedTree
+	// can split the index space by, i.e. it has at most 2^MaxShardBits
+	// shards.
+	MaxShardBits = 8
+)
+
+var shardBs = []byte{ShardIdentifier}
+
+// ShardOf returns the number of the shard of index in a ShardedTree that
+// splits the index space by bits bits: the first bits bits of index.
+func ShardOf(index Index, bits int) int {
+	shard := 0
+	for i := uint32(0); i < uint32(bits); i++ {
+		shard <<= 1
+		if conv.GetNthBit(index, i) {
+			shard |= 1
+		}
+	}
+	return shard
+}
+
+// CombineShardRoots returns the root hash of a ShardedTree whose shards
+// have the root hashes roots, in the order of their numbers. The number
+// of roots must be a power of two. Hosts of shards that only exchange
+// the root hashes of their shards can compute the root hash to be signed
+// with it.
+func CombineShardRoots(roots [][]byte) []byte {
+	level := roots
+	for len(level) > 1 {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = hashed.Digest(shardBs, level[2*i], level[2*i+1])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// A ShardedAuthPath proves the inclusion or absence of a lookup index in
+// a ShardedTree: AP proves it in the shard of the index, whose root hash
+// is ShardRoot, and ShardPath proves ShardRoot against the root hash of
+// the ShardedTree. ShardPath holds the sibling hashes in the hash tree
+// that combines the roots of the shards, from the top down, so that its
+// length is the number of shard bits.
+type ShardedAuthPath struct {
+	AP        *AuthenticationPath
+	ShardRoot hashed.Hash
+	ShardPath [][hashed.HashSizeByte]byte
+}
+
+// Verify verifies p like AuthenticationPath.Verify, except that AP is
+// verified against ShardRoot, and treeHash, the root hash of the
+// ShardedTree taken from an STR, against ShardRoot and ShardPath. It
+// returns ErrUnequalTreeHashes if either doesn't match, and
+// ErrInvalidShardBits if ShardPath is empty or longer than MaxShardBits.
+func (p *ShardedAuthPath) Verify(key, value, treeHash []byte) error {
+	if len(p.ShardPath) < 1 || len(p.ShardPath) > MaxShardBits {
+		return ErrInvalidShardBits
+	}
+	if p.AP == nil || p.AP.Leaf == nil || len(p.AP.LookupIndex)*8 < len(p.ShardPath) {
+		return ErrIndicesMismatch
+	}
+	if err := p.AP.Verify(key, value, p.ShardRoot[:]); err != nil {
+		return err
+	}
+	hash := p.ShardRoot[:]
+	for depth := len(p.ShardPath) - 1; depth >= 0; depth-- {
+		if conv.GetNthBit(p.AP.LookupIndex, uint32(depth)) {
+			hash = hashed.Digest(shardBs, p.ShardPath[depth][:], hash)
+		} else {
+			hash = hashed.Digest(shardBs, hash, p.ShardPath[depth][:])
+		}
+	}
+	if !bytes.Equal(hash, treeHash) {
+		return ErrUnequalTreeHashes
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package merkletree
+
+import (
+	"math/bits"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// skipLevels returns the number of skip hashes in the STR for epoch: one
+// for every k >= 1 for which epoch is a multiple of 2^k.
+func skipLevels(epoch Epoch) int {
+	if epoch == 0 {
+		return 0
+	}
+	return bits.TrailingZeros64(uint64(epoch))
+}
+
+// SkipEpochs returns the epochs of the STRs the STR for epoch links to,
+// newest first: the previous epoch, whose STR's hash is PreviousSTRHash,
+// followed by epoch-2^k for every skip hash k in SkipHashes.
+func SkipEpochs(epoch Epoch) []Epoch {
+	if epoch == 0 {
+		return nil
+	}
+	epochs := []Epoch{epoch - 1}
+	for k := 1; k <= skipLevels(epoch); k++ {
+		epochs = append(epochs, epoch-Epoch(1)<<k)
+	}
+	return epochs
+}
+
+// SkipPath returns the epochs of the STRs linking the STR for epoch from
+// to the STR for epoch to, oldest first, excluding from and including to.
+// Every STR in the path links to the one before it either as its
+// previous STR or with a skip hash, so a client that has verified the
+// STR for from only has to verify O(log(to-from)) STRs instead of every
+// STR up to to. See SignedTreeRoot.VerifySkip. SkipPath returns nil if
+// to isn't after from.
+func SkipPath(from, to Epoch) []Epoch {
+	var path []Epoch
+	for ep := to; ep > from; {
+		path = append(path, ep)
+		k := skipLevels(ep)
+		for ep-from < Epoch(1)<<k {
+			k--
+		}
+		ep -= Epoch(1) << k
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// VerifySkip reports whether str links to the older STR older, i.e.
+// whether older is the previous STR of str (see VerifyHashChain), or one
+// of the skip hashes of str is the hash of older's signature.
+func (str *SignedTreeRoot) VerifySkip(older *SignedTreeRoot) bool {
+	if older.Epoch >= str.Epoch {
+		return false
+	}
+	d := str.Epoch - older.Epoch
+	if d == 1 {
+		return str.VerifyHashChain(older)
+	}
+	k := bits.TrailingZeros64(uint64(d))
+	if d != Epoch(1)<<k || k > len(str.SkipHashes) {
+		return false
+	}
+	return hashed.Sum(older.Signature[:]) == str.SkipHashes[k-1]
+}
@@ -0,0 +1,27 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// skipHashes returns the skip hashes of the STR for epoch.
+func (pad *PAD) skipHashes(epoch Epoch) []hashed.Hash {
+	n := skipLevels(epoch)
+	if n == 0 {
+		return nil
+	}
+	return append([]hashed.Hash(nil), pad.skipLinks[1:n+1]...)
+}
+
+// linkSkips makes str the STR the skip hashes of later STRs link to:
+// for every k for which its epoch is a multiple of 2^k, the next STR
+// whose epoch is a multiple of 2^k links to str.
+func (pad *PAD) linkSkips(str *SignedTreeRoot) {
+	hash := hashed.Sum(str.Signature[:])
+	for k := 0; k < len(pad.skipLinks) && uint64(str.Epoch)%(uint64(1)<<k) == 0; k++ {
+		pad.skipLinks[k] = hash
+	}
+}
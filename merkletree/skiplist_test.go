@@ -0,0 +1,109 @@
+package merkletree
+
+import (
+	"math/bits"
+	"testing"
+)
+
+func TestSkipEpochs(t *testing.T) {
+	for _, tc := range []struct {
+		epoch Epoch
+		want  []Epoch
+	}{
+		{0, nil},
+		{1, []Epoch{0}},
+		{2, []Epoch{1, 0}},
+		{3, []Epoch{2}},
+		{12, []Epoch{11, 10, 8}},
+		{16, []Epoch{15, 14, 12, 8, 0}},
+	} {
+		if got := SkipEpochs(tc.epoch); !equalEpochs(got, tc.want) {
+			t.Error("Expect epoch", tc.epoch, "to link to", tc.want, "got", got)
+		}
+	}
+}
+
+func TestSkipPath(t *testing.T) {
+	if path := SkipPath(5, 5); path != nil {
+		t.Error("Expect no path, got", path)
+	}
+	if want, path := []Epoch{6}, SkipPath(5, 6); !equalEpochs(path, want) {
+		t.Error("Expect", want, "got", path)
+	}
+	if want, path := []Epoch{4, 8, 16, 32, 33}, SkipPath(3, 33); !equalEpochs(path, want) {
+		t.Error("Expect", want, "got", path)
+	}
+
+	for _, tc := range []struct{ from, to Epoch }{
+		{0, 1 << 20}, {1, 1 << 20}, {1000, 5000}, {12345, 1<<20 - 1},
+	} {
+		path := SkipPath(tc.from, tc.to)
+		if path[len(path)-1] != tc.to {
+			t.Fatal("Expect the path to end at", tc.to, "got", path)
+		}
+		prev := tc.from
+		for _, ep := range path {
+			if !containsEpoch(SkipEpochs(ep), prev) {
+				t.Fatal("Expect epoch", ep, "to link to", prev)
+			}
+			prev = ep
+		}
+		if max := 2 * bits.Len64(uint64(tc.to-tc.from)); len(path) > max {
+			t.Error("Expect at most", max, "STRs from", tc.from, "to", tc.to, "got", len(path))
+		}
+	}
+}
+
+func containsEpoch(epochs []Epoch, epoch Epoch) bool {
+	for _, ep := range epochs {
+		if ep == epoch {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPADSkipHashes(t *testing.T) {
+	const epochs = 40
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, epochs+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < epochs; i++ {
+		pad.Update(nil)
+	}
+	for to := Epoch(1); to <= epochs; to++ {
+		str := pad.GetSTR(to)
+		if len(str.SkipHashes) != len(SkipEpochs(to))-1 {
+			t.Fatal("Expect", len(SkipEpochs(to))-1, "skip hashes in epoch", to, "got", len(str.SkipHashes))
+		}
+		for _, from := range SkipEpochs(to) {
+			if !str.VerifySkip(pad.GetSTR(from)) {
+				t.Fatal("Expect epoch", to, "to link to", from)
+			}
+		}
+		for from := Epoch(0); from < to; from++ {
+			prev := pad.GetSTR(from)
+			for _, ep := range SkipPath(from, to) {
+				if !pad.GetSTR(ep).VerifySkip(prev) {
+					t.Fatal("Expect a valid path from", from, "to", to)
+				}
+				prev = pad.GetSTR(ep)
+			}
+		}
+	}
+
+	// an STR doesn't link to epochs it has no skip hash for, nor to
+	// STRs that don't match its skip hash
+	if pad.GetSTR(12).VerifySkip(pad.GetSTR(9)) {
+		t.Error("Expect epoch 12 not to link to epoch 9")
+	}
+	if pad.GetSTR(8).VerifySkip(pad.GetSTR(8)) || pad.GetSTR(8).VerifySkip(pad.GetSTR(16)) {
+		t.Error("Expect an STR only to link to older STRs")
+	}
+	forged := *pad.GetSTR(8)
+	forged.Signature[0]++
+	if pad.GetSTR(16).VerifySkip(&forged) {
+		t.Error("Expect epoch 16 not to link to a forged STR for epoch 8")
+	}
+}
@@ -0,0 +1,81 @@
+// This module implements a merkletree.SnapshotStore that keeps the
+// snapshots a PAD evicts on disk in a LevelDB database, so that lookups
+// in old epochs don't need the whole history in RAM.
+
+package snapshotdb
+
+import (
+	"bytes"
+
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// A Store is a merkletree.SnapshotStore backed by a LevelDB database.
+// Each snapshot is stored under its epoch, as its tree serialized with
+// MerkleTree.WriteTo followed by its STR encoded with
+// merkletree.MarshalSTR, so its associated data must be
+// a merkletree.TypedAssocData. A Store is safe for concurrent use.
+type Store struct {
+	db *leveldb.DB
+}
+
+var _ merkletree.SnapshotStore = (*Store)(nil)
+
+// Open opens the store in the directory path, creating it if needed.
+// The associated data of the loaded STRs is parsed with the decoder
+// registered for its type (see merkletree.RegisterAssocData).
+func Open(path string) (*Store, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// PutSnapshot implements merkletree.SnapshotStore.
+func (s *Store) PutSnapshot(str *merkletree.SignedTreeRoot, m *merkletree.MerkleTree) error {
+	enc, err := merkletree.MarshalSTR(str)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+	buf.Write(enc)
+	return s.db.Put(str.Epoch.Bytes(), buf.Bytes(), nil)
+}
+
+// GetSnapshot implements merkletree.SnapshotStore. It returns
+// merkletree.ErrMalformedTree if the stored snapshot can't be parsed,
+// and merkletree.ErrUnknownAssocData if the type of the associated data
+// of its STR isn't registered.
+func (s *Store) GetSnapshot(epoch merkletree.Epoch) (*merkletree.SignedTreeRoot, *merkletree.MerkleTree, error) {
+	bs, err := s.db.Get(epoch.Bytes(), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, merkletree.ErrSTRNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bytes.NewReader(bs)
+	m := new(merkletree.MerkleTree)
+	if _, err := m.ReadFrom(r); err != nil {
+		return nil, nil, err
+	}
+	str, err := merkletree.UnmarshalSTR(bs[len(bs)-r.Len():])
+	if err == merkletree.ErrMalformedSTR {
+		return nil, nil, merkletree.ErrMalformedTree
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return str, m, nil
+}
@@ -0,0 +1,77 @@
+package snapshotdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+type testAd struct {
+	Data string
+}
+
+func (ad *testAd) Bytes() []byte { return []byte(ad.Data) }
+
+const testAdType = "coniks.merkletree.snapshotdb.testAd"
+
+func (ad *testAd) AssocDataType() string { return testAdType }
+
+func init() {
+	merkletree.RegisterAssocData(testAdType, func(data []byte) (merkletree.AssocData, error) {
+		ad := new(testAd)
+		return ad, json.Unmarshal(data, ad)
+	})
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.GetSnapshot(0); err != merkletree.ErrSTRNotFound {
+		t.Fatalf("Expected ErrSTRNotFound, got %v", err)
+	}
+
+	pad, err := merkletree.NewPAD(&testAd{"ad"}, crypto.NewStaticTestSigningKey(),
+		crypto.NewStaticTestVRFKey(), 2, merkletree.WithSnapshotStore(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	str := pad.LatestSTR()
+	for i := 0; i < 3; i++ {
+		pad.Update(nil)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the evicted snapshot survives reopening the store
+	if s, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	loaded, m, err := s.GetSnapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Signature != str.Signature || loaded.Ad.(*testAd).Data != "ad" {
+		t.Fatalf("Expected the STR of epoch 1, got %+v", loaded)
+	}
+	if !crypto.NewStaticTestSigningKey().Public().Verify(loaded.Bytes(), loaded.Signature[:]) {
+		t.Fatal("Expected the loaded STR to verify")
+	}
+	ap, err := m.Get(pad.Index([]byte("alice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ap.Verify([]byte("alice"), []byte("key"), loaded.TreeHash[:]); err != nil {
+		t.Fatal(err)
+	}
+}
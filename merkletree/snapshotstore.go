@@ -0,0 +1,153 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrSpillFailed is wrapped by the errors of a SnapshotStore that
+// couldn't store a snapshot the PAD is removing from memory. The PAD then
+// keeps the snapshot in memory, and stores it again when it's next due
+// to be removed.
+var ErrSpillFailed = errors.New("[merkletree] Could not spill a snapshot to the snapshot store")
+
+// A SnapshotStore keeps the snapshots a PAD removes from memory, making
+// its history two-tiered: the recent snapshots stay in memory, and older
+// ones are spilled to the store when they're evicted, or when their
+// trees are pruned (see PAD.SetFullSnapshots). Lookups in their epochs,
+// and their STRs, are then loaded from the store as needed instead of
+// failing with ErrSTRNotFound or an ErrEpochPruned. Loaded snapshots
+// aren't kept in memory, so the store decides what lookups in old
+// epochs cost.
+type SnapshotStore interface {
+	// PutSnapshot stores the snapshot with the STR str and the tree m.
+	// It must not modify or retain m after it returns, since the nodes
+	// of m may be deleted from a NodeStore then.
+	PutSnapshot(str *SignedTreeRoot, m *MerkleTree) error
+	// GetSnapshot returns the STR and the tree of the snapshot of epoch,
+	// or ErrSTRNotFound if there is none.
+	GetSnapshot(epoch Epoch) (*SignedTreeRoot, *MerkleTree, error)
+}
+
+// WithSnapshotStore makes the PAD spill the snapshots it removes from
+// memory to store, and load them from it. See SnapshotStore.
+func WithSnapshotStore(store SnapshotStore) PADOption {
+	return func(pad *PAD) error {
+		pad.spill = store
+		return nil
+	}
+}
+
+// A MemSnapshotStore is a SnapshotStore that keeps the snapshots in
+// memory, serialized. It's mainly useful for tests. A MemSnapshotStore
+// is safe for concurrent use.
+type MemSnapshotStore struct {
+	mu        sync.RWMutex
+	snapshots map[Epoch]memSnapshot
+}
+
+// A memSnapshot is a snapshot in a MemSnapshotStore: its STR without the
+// tree, and the tree serialized with WriteTo.
+type memSnapshot struct {
+	str  SignedTreeRoot
+	tree []byte
+}
+
+var _ SnapshotStore = (*MemSnapshotStore)(nil)
+
+// NewMemSnapshotStore returns an empty MemSnapshotStore.
+func NewMemSnapshotStore() *MemSnapshotStore {
+	return &MemSnapshotStore{snapshots: make(map[Epoch]memSnapshot)}
+}
+
+// PutSnapshot implements SnapshotStore.
+func (s *MemSnapshotStore) PutSnapshot(str *SignedTreeRoot, m *MerkleTree) error {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+	snap := memSnapshot{str: *str, tree: buf.Bytes()}
+	snap.str.tree = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[str.Epoch] = snap
+	return nil
+}
+
+// GetSnapshot implements SnapshotStore.
+func (s *MemSnapshotStore) GetSnapshot(epoch Epoch) (*SignedTreeRoot, *MerkleTree, error) {
+	s.mu.RLock()
+	snap, ok := s.snapshots[epoch]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil, ErrSTRNotFound
+	}
+	m := new(MerkleTree)
+	if _, err := m.ReadFrom(bytes.NewReader(snap.tree)); err != nil {
+		return nil, nil, err
+	}
+	str := snap.str
+	return &str, m, nil
+}
+
+// Len returns the number of snapshots in s.
+func (s *MemSnapshotStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.snapshots)
+}
+
+// spillSnapshot stores str, whose tree is about to be removed from
+// memory, in the PAD's SnapshotStore, if it has one. The PAD can't serve
+// the epoch of str without it, so if the store fails, it returns an
+// error wrapping ErrSpillFailed, and the tree must be kept.
+func (pad *PAD) spillSnapshot(str *SignedTreeRoot) error {
+	if pad.spill == nil {
+		return nil
+	}
+	if err := pad.spill.PutSnapshot(str, str.tree); err != nil {
+		return fmt.Errorf("%w: epoch %d: %v", ErrSpillFailed, str.Epoch, err)
+	}
+	return nil
+}
+
+// snapshot returns the STR of epoch with its tree, loading it from the
+// PAD's SnapshotStore if it's no longer in memory. It returns
+// ErrSTRNotFound if there's no snapshot for epoch, and an ErrEpochPruned
+// if its tree has been pruned and the PAD has no SnapshotStore.
+func (pad *PAD) snapshot(epoch Epoch) (*SignedTreeRoot, error) {
+	if epoch > pad.latestSTR.Epoch {
+		return nil, ErrSTRNotFound
+	}
+	str := pad.GetSTR(epoch)
+	switch {
+	case str != nil && str.tree != nil:
+		return str, nil
+	case pad.spill == nil && str == nil:
+		return nil, ErrSTRNotFound
+	case pad.spill == nil:
+		return nil, pad.pruned(str)
+	}
+	return pad.loadSnapshot(epoch)
+}
+
+// loadSnapshot loads the snapshot of epoch from the PAD's SnapshotStore.
+// It returns ErrMalformedTree if the store returns a tree that isn't the
+// one of the STR.
+func (pad *PAD) loadSnapshot(epoch Epoch) (*SignedTreeRoot, error) {
+	str, m, err := pad.spill.GetSnapshot(epoch)
+	if err != nil {
+		return nil, err
+	}
+	if str.Epoch != epoch || !bytes.Equal(m.hash, str.TreeHash[:]) {
+		return nil, ErrMalformedTree
+	}
+	loaded := *str
+	loaded.tree = m
+	return &loaded, nil
+}
@@ -0,0 +1,222 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// newSpillingPAD returns a PAD that keeps 2 snapshots in memory and
+// spills the others to a MemSnapshotStore, after binding key<i> to
+// value<i> in epoch i for the given number of epochs.
+func newSpillingPAD(t *testing.T, epochs int, opts ...PADOption) (*PAD, *MemSnapshotStore) {
+	store := NewMemSnapshotStore()
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 2, append(opts, WithSnapshotStore(store))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= epochs; i++ {
+		if err := pad.Set([]byte(keyPrefix+strconv.Itoa(i)), append(valuePrefix, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+	}
+	return pad, store
+}
+
+func TestPADSnapshotStore(t *testing.T) {
+	var strs []*SignedTreeRoot
+	store := NewMemSnapshotStore()
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 2, WithSnapshotStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs = append(strs, pad.LatestSTR())
+	for i := 1; i <= 6; i++ {
+		if err := pad.Set([]byte(keyPrefix+strconv.Itoa(i)), append(valuePrefix, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+		strs = append(strs, pad.LatestSTR())
+	}
+	if store.Len() == 0 || len(pad.loadedEpochs) > 2 {
+		t.Fatal("Expect the older snapshots to be spilled, got", store.Len())
+	}
+
+	for epoch, want := range strs {
+		str := pad.GetSTR(Epoch(epoch))
+		if str == nil || str.Signature != want.Signature {
+			t.Fatal("Expect the STR of epoch", epoch, "got", str)
+		}
+		for i := 1; i <= 6; i++ {
+			key := []byte(keyPrefix + strconv.Itoa(i))
+			ap, err := pad.LookupInEpoch(key, Epoch(epoch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i > epoch {
+				if !ap.ProofType().IsAbsence() {
+					t.Error("Expect", string(key), "to be absent in epoch", epoch)
+				}
+				continue
+			}
+			if err := ap.Verify(key, append(valuePrefix, byte(i)), str.TreeHash[:]); err != nil {
+				t.Error("epoch", epoch, "key", string(key), err)
+			}
+		}
+	}
+	if epoch, ap, err := pad.FirstChangeSince([]byte(keyPrefix+"3"), nil, 0); err != nil || epoch != 3 || ap == nil {
+		t.Error("Expect the binding to change in epoch 3, got", epoch, err)
+	}
+	if changes, err := pad.Changes(1, 2); err != nil || len(changes) != 1 {
+		t.Error("Expect 1 change between the spilled epochs, got", changes, err)
+	}
+	if _, err := pad.At(7); err != ErrSTRNotFound {
+		t.Error("Expect", ErrSTRNotFound, "got", err)
+	}
+}
+
+func TestPADSnapshotStorePruned(t *testing.T) {
+	pad, store := newSpillingPAD(t, 1, WithNodeStore(NewMemNodeStore()))
+	pad.SetFullSnapshots(1)
+	for i := 0; i < 3; i++ {
+		pad.Update(nil)
+	}
+	if store.Len() != 4 {
+		t.Fatal("Expect every pruned or evicted snapshot to be spilled once, got", store.Len())
+	}
+	// the nodes of the spilled trees have been released from the
+	// NodeStore, but the store has its own copies
+	view, err := pad.At(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap, err := view.Get([]byte(keyPrefix + "1")); err != nil || ap.ProofType() != ProofOfInclusion {
+		t.Error("Expect a proof of inclusion in the pruned epoch, got", err)
+	}
+}
+
+// swappingStore is a SnapshotStore that returns the tree of another
+// epoch.
+type swappingStore struct {
+	*MemSnapshotStore
+}
+
+func (s swappingStore) GetSnapshot(epoch Epoch) (*SignedTreeRoot, *MerkleTree, error) {
+	str, _, err := s.MemSnapshotStore.GetSnapshot(epoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, m, err := s.MemSnapshotStore.GetSnapshot(epoch + 1)
+	return str, m, err
+}
+
+func TestPADSnapshotStoreErrors(t *testing.T) {
+	store := swappingStore{NewMemSnapshotStore()}
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 2, WithSnapshotStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if err := pad.Set([]byte(keyPrefix+strconv.Itoa(i)), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+		pad.Update(nil)
+	}
+	if _, err := pad.At(0); !errors.Is(err, ErrMalformedTree) {
+		t.Error("Expect", ErrMalformedTree, "got", err)
+	}
+	if str := pad.GetSTR(0); str != nil {
+		t.Error("Expect no STR from a store returning the wrong tree, got", str)
+	}
+
+	if _, _, err := NewMemSnapshotStore().GetSnapshot(0); err != ErrSTRNotFound {
+		t.Error("Expect", ErrSTRNotFound, "got", err)
+	}
+}
+
+func TestMemSnapshotStore(t *testing.T) {
+	_, store := newSpillingPAD(t, 4, WithNodeStore(NewMemNodeStore()))
+	str, m, err := store.GetSnapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str.tree != nil || !bytes.Equal(m.hash, str.TreeHash[:]) {
+		t.Error("Expect the STR without its tree, and the tree of the STR")
+	}
+	if m.store != nil {
+		t.Error("Expect a copy of the tree in memory")
+	}
+}
+
+// failingSnapshotStore is a MemSnapshotStore whose PutSnapshot fails
+// while fail is set.
+type failingSnapshotStore struct {
+	*MemSnapshotStore
+	fail bool
+}
+
+func (s *failingSnapshotStore) PutSnapshot(str *SignedTreeRoot, m *MerkleTree) error {
+	if s.fail {
+		return errStoreFailed
+	}
+	return s.MemSnapshotStore.PutSnapshot(str, m)
+}
+
+func TestPADSnapshotStoreFailure(t *testing.T) {
+	store := &failingSnapshotStore{MemSnapshotStore: NewMemSnapshotStore(), fail: true}
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 2, WithSnapshotStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot of epoch 0 is evicted before the one of epoch 2 is
+	// taken
+	if _, err := pad.Update(nil); !errors.Is(err, ErrSpillFailed) {
+		t.Fatal("Expect", ErrSpillFailed, "got", err)
+	}
+	if epoch := pad.LatestSTR().Epoch; epoch != 1 {
+		t.Fatal("Expect no snapshot to be taken, got epoch", epoch)
+	}
+	if _, err := pad.At(0); err != nil {
+		t.Error("Expect the snapshot of epoch 0 to stay in memory, got", err)
+	}
+
+	// the trees of epochs 0 and 1 are pruned after the snapshots of
+	// epochs 1 and 2 are taken
+	store = &failingSnapshotStore{MemSnapshotStore: NewMemSnapshotStore(), fail: true}
+	pad, err = NewPAD(TestAd{""}, signKey, vrfKey, 10, WithSnapshotStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.SetFullSnapshots(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pad.Update(nil); !errors.Is(err, ErrSpillFailed) {
+		t.Fatal("Expect", ErrSpillFailed, "got", err)
+	}
+	st, err := pad.Update(nil)
+	if !errors.Is(err, ErrSpillFailed) || st.Epoch != 2 {
+		t.Fatal("Expect the snapshot of epoch 2 to be taken along with", ErrSpillFailed, "got", st.Epoch, err)
+	}
+	if _, err := pad.At(1); err != nil {
+		t.Error("Expect the tree of epoch 1 to stay in memory, got", err)
+	}
+	if gc, err := pad.CollectGarbage(); !errors.Is(err, ErrSpillFailed) || gc.Pruned != 0 {
+		t.Error("Expect nothing to be pruned while the store fails, got", gc, err)
+	}
+
+	store.fail = false
+	if gc, err := pad.CollectGarbage(); err != nil || gc.Pruned != 2 {
+		t.Error("Expect the trees of epochs 0 and 1 to be pruned, got", gc, err)
+	}
+	if store.Len() != 2 {
+		t.Error("Expect the snapshots of epochs 0 and 1 to be spilled, got", store.Len())
+	}
+	if _, err := pad.At(1); err != nil {
+		t.Error("Expect the tree of epoch 1 to be loaded from the store, got", err)
+	}
+}
@@ -0,0 +1,173 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"unsafe"
+)
+
+// TreeStats describes the size of a MerkleTree.
+type TreeStats struct {
+	// Leaves is the number of user leaf nodes.
+	Leaves uint64
+	// Nodes is the number of nodes of any kind: interior, user leaf
+	// and empty nodes, and Interior that of interior nodes.
+	Nodes    uint64
+	Interior uint64
+	// MaxDepth is the level of the deepest user leaf node, and
+	// AverageDepth the average level of the user leaf nodes, which grows
+	// with the logarithm of their number unless the indices cluster.
+	// AverageDepth is zero in the stats of snapshots, which aren't
+	// walked (see PADStats).
+	MaxDepth     uint32
+	AverageDepth float64
+	// Bytes is the approximate memory footprint of the nodes in bytes.
+	// It counts the nodes and the slices they own, but not allocator
+	// overhead, so the actual footprint is somewhat larger.
+	Bytes uint64
+}
+
+// EpochStats is the TreeStats of the snapshot at Epoch.
+type EpochStats struct {
+	Epoch Epoch
+	TreeStats
+}
+
+// PADStats describes the memory use of a PAD. The snapshots share the
+// nodes that didn't change between them with each other and with the
+// pending tree, so every snapshot only adds the memory of the nodes that
+// were replaced in the following epoch, and the memory use grows with
+// the number of bindings and the number of changes in the retained
+// snapshots.
+type PADStats struct {
+	// Snapshots has the stats of every snapshot retained in memory,
+	// oldest first. The Bytes of a snapshot are only those of the nodes
+	// that no later snapshot or the pending tree shares, i.e. those that
+	// would be freed by evicting it along with all older snapshots.
+	// The stats of snapshots whose trees have been pruned are zero.
+	Snapshots []EpochStats
+	// Pending has the stats of the tree that will become the next
+	// snapshot.
+	Pending TreeStats
+	// Reclaimed is the memory released by pruning the trees of
+	// snapshots since the PAD was created (see RetentionPolicy).
+	Reclaimed GCStats
+}
+
+// Bytes returns the approximate memory footprint of all the trees of
+// the PAD in bytes.
+func (s PADStats) Bytes() uint64 {
+	total := s.Pending.Bytes
+	for _, e := range s.Snapshots {
+		total += e.Bytes
+	}
+	return total
+}
+
+// HashStats counts the work of recomputing the hash of a MerkleTree.
+// Only the hashes of the subtrees that changed since the hash was last
+// computed are recomputed.
+type HashStats struct {
+	// Computed is the number of node hashes computed.
+	Computed uint64
+	// Reused is the number of subtree hashes reused because the
+	// subtrees didn't change.
+	Reused uint64
+}
+
+// UpdateStats describes the snapshot taken by PAD.Update.
+type UpdateStats struct {
+	// Epoch is the epoch of the snapshot.
+	Epoch Epoch
+	// Insertions is the number of bindings set with Set or SetBatch
+	// since the previous snapshot, including ones that replaced a
+	// value.
+	Insertions uint64
+	// Hash is the work of computing the tree hash of the snapshot.
+	Hash HashStats
+}
+
+// Stats walks m and returns its TreeStats. The Bytes include the nodes
+// m shares with its clones, but only those in memory: nodes that m has
+// to load from its NodeStore are counted, but their memory isn't.
+// Stats returns an error wrapping ErrNodeLoad if one of them can't be
+// loaded.
+func (m *MerkleTree) Stats() (TreeStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	st := TreeStats{Bytes: m.ownBytes()}
+	var depths uint64
+	if err := m.statsInternal(m.root, &st, &depths, true); err != nil {
+		return TreeStats{}, err
+	}
+	if st.Leaves > 0 {
+		st.AverageDepth = float64(depths) / float64(st.Leaves)
+	}
+	return st, nil
+}
+
+// snapshotStats returns the TreeStats of m, which was just cloned, without
+// walking it. The Bytes are only those of m itself, since all its nodes
+// are shared with the clone.
+func (m *MerkleTree) snapshotStats() TreeStats {
+	maxDepth, leaves := m.shape()
+	_, nodes, _ := shapeOf(m.root)
+	// every interior node has two children
+	return TreeStats{Leaves: leaves, Nodes: nodes, Interior: nodes / 2, MaxDepth: maxDepth, Bytes: m.ownBytes()}
+}
+
+// ownBytes returns the approximate memory footprint of m without its
+// nodes.
+func (m *MerkleTree) ownBytes() uint64 {
+	return uint64(unsafe.Sizeof(*m)) + uint64(cap(m.nonce)+cap(m.hash))
+}
+
+// statsInternal adds the nodes of the subtree rooted at nodePtr to st,
+// and the levels of its user leaf nodes to depths.
+func (m *MerkleTree) statsInternal(nodePtr merkleNode, st *TreeStats, depths *uint64, resident bool) error {
+	st.Nodes++
+	if resident {
+		st.Bytes += nodeBytes(nodePtr)
+	}
+	switch n := nodePtr.(type) {
+	case *userLeafNode:
+		st.Leaves++
+		*depths += uint64(n.level)
+		if n.level > st.MaxDepth {
+			st.MaxDepth = n.level
+		}
+	case *interiorNode:
+		st.Interior++
+		for _, right := range []bool{false, true} {
+			child, err := m.childOf(n, right)
+			if err != nil {
+				return err
+			}
+			if err := m.statsInternal(child, st, depths, resident && n.child(right) != nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stats returns the PADStats of the PAD. The stats of a snapshot are
+// computed when the snapshot is taken, so only the pending tree is
+// walked, and Stats returns the error of loading its nodes, like
+// MerkleTree.Stats.
+func (pad *PAD) Stats() (PADStats, error) {
+	pending, err := pad.tree.Stats()
+	if err != nil {
+		return PADStats{}, err
+	}
+	st := PADStats{
+		Snapshots: make([]EpochStats, 0, len(pad.loadedEpochs)),
+		Pending:   pending,
+		Reclaimed: pad.reclaimed,
+	}
+	for _, epoch := range pad.loadedEpochs {
+		st.Snapshots = append(st.Snapshots, EpochStats{epoch, pad.stats[epoch]})
+	}
+	return st, nil
+}
@@ -0,0 +1,186 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPADStats(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := pad.Set([]byte(keyPrefix+string(rune('a'+i))), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil) // epoch 1
+
+	st := padStats(t, pad)
+	if len(st.Snapshots) != 2 {
+		t.Fatal("Expect 2 snapshots, got", len(st.Snapshots))
+	}
+	empty, full := st.Snapshots[0], st.Snapshots[1]
+	// an empty tree is a root with two empty children
+	if empty.Epoch != 0 || empty.Leaves != 0 || empty.Nodes != 3 {
+		t.Error("Unexpected stats for epoch 0", empty)
+	}
+	if full.Epoch != 1 || full.Leaves != 10 || full.Leaves != pad.GetSTR(1).LeafCount {
+		t.Error("Unexpected stats for epoch 1", full)
+	}
+	// every interior node has two children
+	if full.Nodes%2 != 1 || full.Nodes <= full.Leaves {
+		t.Error("Unexpected node count", full.Nodes)
+	}
+	// the latest snapshot shares all its nodes with the pending tree,
+	// while the empty one retains the nodes replaced by the insertions
+	if st.Pending.Leaves != full.Leaves || st.Pending.Nodes != full.Nodes ||
+		full.Bytes >= empty.Bytes || st.Pending.Bytes <= empty.Bytes {
+		t.Error("Unexpected stats", st)
+	}
+	if st.Bytes() != empty.Bytes+full.Bytes+st.Pending.Bytes {
+		t.Error("Unexpected total", st.Bytes())
+	}
+
+	// a change only makes the snapshot retain the changed path
+	if err := pad.Set([]byte(keyPrefix+"a"), []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil) // epoch 2
+	retained := padStats(t, pad).Snapshots[1].Bytes - full.Bytes
+	if retained == 0 || retained >= st.Pending.Bytes/2 {
+		t.Error("Expect the snapshot of epoch 1 to retain only the changed path, got", retained)
+	}
+
+	for i := 0; i < 2; i++ {
+		pad.Update(nil)
+	}
+	// the snapshots of epochs 0 and 1 have been evicted
+	st = padStats(t, pad)
+	if len(st.Snapshots) != 3 || st.Snapshots[0].Epoch != 2 {
+		t.Error("Unexpected snapshots", st.Snapshots)
+	}
+}
+
+func TestPADUpdateStats(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := pad.Set([]byte(keyPrefix+string(rune('a'+i))), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := pad.Update(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Epoch != 1 || st.Insertions != 10 {
+		t.Fatal("Unexpected stats for epoch 1", st)
+	}
+	// every node of the new tree is hashed
+	if nodes := padStats(t, pad).Snapshots[1].Nodes; st.Hash.Computed != nodes || st.Hash.Reused != 0 {
+		t.Error("Expect", nodes, "hashes computed, got", st.Hash)
+	}
+
+	if err := pad.Set([]byte(keyPrefix+"a"), []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if st.Epoch != 2 || st.Insertions != 1 {
+		t.Fatal("Unexpected stats for epoch 2", st)
+	}
+	// only the path to the changed leaf is hashed again
+	if st.Hash.Computed == 0 || st.Hash.Computed > 2*uint64(pad.GetSTR(2).MaxDepth)+1 || st.Hash.Reused == 0 {
+		t.Error("Expect only the changed path to be hashed, got", st.Hash)
+	}
+
+	if st, _ := pad.Update(nil); st.Insertions != 0 || st.Hash.Computed != 1 || st.Hash.Reused != 2 {
+		t.Error("Expect only the root to be hashed without changes, got", st)
+	}
+}
+
+func TestPADRefreshPending(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := pad.Set([]byte(keyPrefix+string(rune('a'+i))), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil)
+
+	key := []byte(keyPrefix + "a")
+	if err := pad.Set(key, []byte("new value")); err != nil {
+		t.Fatal(err)
+	}
+	hash, refreshed, err := pad.RefreshPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the path to the changed leaf is hashed
+	if refreshed.Computed == 0 || refreshed.Computed > 2*uint64(pad.LatestSTR().MaxDepth)+3 {
+		t.Error("Expect only the changed path to be hashed, got", refreshed)
+	}
+	if again, st, _ := pad.RefreshPending(); !bytes.Equal(again, hash) || st != (HashStats{}) {
+		t.Error("Expect an unchanged tree not to be hashed again, got", st)
+	}
+
+	ap, apHash, err := pad.LookupPending(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(apHash, hash) {
+		t.Fatal("Expect the proof against the refreshed hash")
+	}
+	if err := ap.Verify(key, []byte("new value"), hash); err != nil {
+		t.Fatal(err)
+	}
+	if ap, _ := pad.Lookup(key); !bytes.Equal(ap.Leaf.Value, valuePrefix) {
+		t.Error("Expect the snapshot to be unchanged")
+	}
+
+	st, err := pad.Update(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pad.LatestSTR().TreeHash[:], hash) {
+		t.Error("Expect the signed tree hash to be the refreshed one")
+	}
+	// the refresh is counted, and only the root is hashed again
+	if st.Hash.Computed != refreshed.Computed+1 || st.Hash.Reused != refreshed.Reused+2 {
+		t.Error("Expect the refresh and the root to be counted, got", st.Hash, "after", refreshed)
+	}
+}
+
+func TestTreeStatsShape(t *testing.T) {
+	m, err := NewMerkleTreeWithIndexSize(MinIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := treeStats(t, m); st.Interior != 1 || st.MaxDepth != 0 || st.AverageDepth != 0 {
+		t.Error("Unexpected stats for an empty tree", st)
+	}
+	if err := m.SetBatch(batchEntries(1000, 0, valuePrefix)); err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	st := treeStats(t, m)
+	maxDepth, leaves := m.shape()
+	if st.Leaves != leaves || st.MaxDepth != maxDepth || st.Nodes != 2*st.Interior+1 {
+		t.Error("Unexpected shape", st)
+	}
+	// random indices put 1000 leaves about 10 levels deep
+	if st.AverageDepth < 8 || st.AverageDepth > 14 || float64(st.MaxDepth) < st.AverageDepth {
+		t.Error("Unexpected average depth", st.AverageDepth)
+	}
+	if snap := m.snapshotStats(); snap.Interior != st.Interior || snap.MaxDepth != st.MaxDepth {
+		t.Error("Expect the snapshot stats to agree, got", snap)
+	}
+}
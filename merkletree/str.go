@@ -1,8 +1,7 @@
 package merkletree
 
 import (
-	"bytes"
-
+	"github.com/ORBAT/cloniks/chain"
 	"github.com/ORBAT/cloniks/conv"
 	"github.com/ORBAT/cloniks/crypto/hashed"
 	"github.com/ORBAT/cloniks/crypto/sign"
@@ -17,35 +16,34 @@ type AssocData interface {
 // epoch. Signed tree roots contain the current root node, the current and previous epochs, the hash
 // of the previous STR, its signature, and developer-specified associated data. The epoch number is
 // a counter from 0, and increases by 1 when a new signed tree root is issued by the PAD.
+//
+// STRs also contain a signed measurement of the tree's shape: the level of the deepest leaf
+// (MaxDepth) and the number of leaves (LeafCount). Clients can use MaxDepth to reject authentication
+// paths that are deeper than advertised, and auditors can use both to watch for adversarial
+// clustering of indices.
+//
+// Besides the hash of the previous STR, the STR for an epoch that is a multiple of 2^k contains skip
+// hashes (SkipHashes) of the STRs for the epochs epoch-2^k, which form a skip list over the hash
+// chain. A client catching up over many epochs can follow them to verify only a logarithmic number
+// of STRs. See SkipPath.
 type SignedTreeRoot struct {
-	tree            *MerkleTree
-	TreeHash        []byte
-	Epoch           uint64
-	PreviousEpoch   uint64
-	PreviousSTRHash []byte
-	Signature       []byte
+	tree            *strTree
+	TreeHash        hashed.Hash
+	Epoch           Epoch
+	PreviousEpoch   Epoch
+	PreviousSTRHash hashed.Hash
+	MaxDepth        uint32
+	LeafCount       uint64
+	SkipHashes      []hashed.Hash `json:",omitempty"`
+	Signature       sign.Signature
 	Ad              AssocData `json:"-"`
 }
 
-// NewSTR constructs a SignedTreeRoot with the given signing key pair,
-// associated data, MerkleTree, epoch, previous STR hash, and
-// digitally signs the STR using the given signing key.
-func NewSTR(key sign.PrivateKey, ad AssocData, m *MerkleTree, epoch uint64, prevHash []byte) *SignedTreeRoot {
-	prevEpoch := epoch - 1
-	if epoch == 0 {
-		prevEpoch = 0
-	}
-	str := &SignedTreeRoot{
-		tree:            m,
-		TreeHash:        m.hash,
-		Epoch:           epoch,
-		PreviousEpoch:   prevEpoch,
-		PreviousSTRHash: prevHash,
-		Ad:              ad,
-	}
-	bytesPreSig := str.Bytes()
-	str.Signature = key.Sign(bytesPreSig)
-	return str
+// IsGenesis returns true iff str is a well-formed genesis STR (see
+// NewGenesisSTR). It doesn't verify the signature of str.
+func (str *SignedTreeRoot) IsGenesis() bool {
+	return str.Epoch == 0 && str.PreviousEpoch == 0 &&
+		str.PreviousSTRHash == hashed.Hash{} && len(str.SkipHashes) == 0
 }
 
 // Bytes serializes the signed tree root and its associated data into a specified format for
@@ -56,24 +54,69 @@ func (str *SignedTreeRoot) Bytes() []byte {
 }
 
 // SerializeInternal serializes the signed tree root into a specified format.
+// The integers are in the native endianness of the platform, and the skip
+// hashes aren't length-prefixed, so it's only kept as the signing input of
+// protocol version 0.1. Use MarshalBinary to transmit or store an STR.
 func (str *SignedTreeRoot) SerializeInternal() []byte {
 	var strBytes []byte
-	strBytes = append(strBytes, conv.ULongToBytes(str.Epoch)...) // t - epoch number
+	strBytes = append(strBytes, str.Epoch.Bytes()...) // t - epoch number
 	if str.Epoch > 0 {
-		strBytes = append(strBytes, conv.ULongToBytes(str.PreviousEpoch)...) // t_prev - previous epoch number
+		strBytes = append(strBytes, str.PreviousEpoch.Bytes()...) // t_prev - previous epoch number
+	}
+	strBytes = append(strBytes, str.TreeHash[:]...)                  // root
+	strBytes = append(strBytes, str.PreviousSTRHash[:]...)           // previous STR hash
+	strBytes = append(strBytes, conv.UInt32ToBytes(str.MaxDepth)...) // level of the deepest leaf
+	strBytes = append(strBytes, conv.ULongToBytes(str.LeafCount)...) // number of leaves
+	for _, skip := range str.SkipHashes {
+		strBytes = append(strBytes, skip[:]...) // hash of the STR for epoch t-2^k
 	}
-	strBytes = append(strBytes, str.TreeHash...)        // root
-	strBytes = append(strBytes, str.PreviousSTRHash...) // previous STR hash
 	return strBytes
 }
 
+// VerifyDepth returns ErrDepthExceeded if the leaf of ap is deeper than
+// the maximum depth advertised in str.
+func (str *SignedTreeRoot) VerifyDepth(ap *AuthenticationPath) error {
+	return str.verifyLevel(ap.Leaf)
+}
+
+// VerifyMultiDepth is VerifyDepth for each leaf of mp.
+func (str *SignedTreeRoot) VerifyMultiDepth(mp *MultiAuthPath) error {
+	for _, leaf := range mp.Leaves {
+		if err := str.verifyLevel(leaf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (str *SignedTreeRoot) verifyLevel(leaf *ProofNode) error {
+	maxDepth := str.MaxDepth
+	if maxDepth == 0 {
+		// the root always has two children, even if the tree is empty
+		maxDepth = 1
+	}
+	if leaf.Level > maxDepth {
+		return ErrDepthExceeded
+	}
+	return nil
+}
+
 // VerifyHashChain computes the hash of savedSTR's signature,
 // and compares it to the hash of previous STR included
 // in the issued STR. The hash chain is valid if
 // these two hash values are equal and consecutive.
+// See chain.Follows.
 func (str *SignedTreeRoot) VerifyHashChain(savedSTR *SignedTreeRoot) bool {
-	hash := hashed.Digest(savedSTR.Signature)
-	return str.PreviousEpoch == savedSTR.Epoch &&
-		str.Epoch == savedSTR.Epoch+1 &&
-		bytes.Equal(hash, str.PreviousSTRHash)
+	return chain.Follows(savedSTR.Link(), str.Link())
+}
+
+// Link returns what str contributes to the hash chain of its PAD's STRs.
+// The hash of an STR is the hash of its signature.
+func (str *SignedTreeRoot) Link() chain.Link {
+	return chain.Link{
+		Epoch:     uint64(str.Epoch),
+		PrevEpoch: uint64(str.PreviousEpoch),
+		PrevHash:  str.PreviousSTRHash,
+		Hash:      hashed.Sum(str.Signature[:]),
+	}
 }
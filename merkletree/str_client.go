@@ -0,0 +1,8 @@
+//go:build coniks_client
+// +build coniks_client
+
+package merkletree
+
+// strTree stands in for the snapshot an STR roots in client builds,
+// which don't have MerkleTrees. It's always nil there.
+type strTree struct{}
@@ -0,0 +1,55 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+)
+
+// strTree is the snapshot an STR roots, which only PADs keep.
+type strTree = MerkleTree
+
+// NewSTR constructs a SignedTreeRoot with the given signing key pair,
+// associated data, MerkleTree, epoch, previous STR hash, skip hashes, and
+// digitally signs the STR using the given signing key.
+func NewSTR(key sign.Signer, ad AssocData, m *MerkleTree, epoch Epoch, prevHash hashed.Hash,
+	skips []hashed.Hash) *SignedTreeRoot {
+	maxDepth, leaves := m.shape()
+	return newSTR(key, ad, m, m.hash, maxDepth, leaves, epoch, prevHash, skips)
+}
+
+// NewGenesisSTR constructs the genesis STR of the MerkleTree m, i.e. the
+// STR for epoch 0, and signs it with key. There's no STR before it, so
+// its PreviousEpoch is 0, its PreviousSTRHash is the zero Hash, and it
+// has no skip hashes (see IsGenesis). The genesis STRs of different
+// trees still differ, since their tree hashes depend on the random
+// nonces of the trees.
+func NewGenesisSTR(key sign.Signer, ad AssocData, m *MerkleTree) *SignedTreeRoot {
+	return NewSTR(key, ad, m, 0, hashed.Hash{}, nil)
+}
+
+// newSTR signs the STR of the tree m, if any, with the root hash
+// treeHash and the given shape.
+func newSTR(key sign.Signer, ad AssocData, m *MerkleTree, treeHash []byte, maxDepth uint32,
+	leaves uint64, epoch Epoch, prevHash hashed.Hash, skips []hashed.Hash) *SignedTreeRoot {
+	var prevEpoch Epoch // the genesis STR has no previous epoch
+	if epoch > 0 {
+		prevEpoch = epoch - 1
+	}
+	str := &SignedTreeRoot{
+		tree:            m,
+		Epoch:           epoch,
+		PreviousEpoch:   prevEpoch,
+		PreviousSTRHash: prevHash,
+		MaxDepth:        maxDepth,
+		LeafCount:       leaves,
+		SkipHashes:      skips,
+		Ad:              ad,
+	}
+	copy(str.TreeHash[:], treeHash)
+	bytesPreSig := str.Bytes()
+	copy(str.Signature[:], key.Sign(bytesPreSig))
+	return str
+}
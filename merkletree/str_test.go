@@ -3,6 +3,8 @@ package merkletree
 import (
 	"strconv"
 	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
 )
 
 func TestVerifyHashChain(t *testing.T) {
@@ -19,14 +21,14 @@ func TestVerifyHashChain(t *testing.T) {
 	for i := uint64(1); i < N; i++ {
 		key := keyPrefix + strconv.FormatUint(i, 10)
 		value := append(valuePrefix, byte(i))
-		if err := pad.Set(key, value); err != nil {
+		if err := pad.Set([]byte(key), value); err != nil {
 			t.Fatal(err)
 		}
 		pad.Update(nil)
 
 		// verify STR signature
 		str := pad.LatestSTR()
-		if !pk.Verify(str.Bytes(), str.Signature) {
+		if !pk.Verify(str.Bytes(), str.Signature[:]) {
 			t.Fatal("Invalid STR signature at epoch", i)
 		}
 
@@ -37,3 +39,96 @@ func TestVerifyHashChain(t *testing.T) {
 		savedSTR = str
 	}
 }
+
+func TestGenesisSTR(t *testing.T) {
+	pad, err := NewPAD(TestAd{"abc"}, staticSigningKey, staticVRFKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := pad.LatestSTR()
+	if !genesis.IsGenesis() || genesis.PreviousSTRHash != (hashed.Hash{}) {
+		t.Fatal("Expect the first STR of a PAD to be a genesis STR, got", genesis)
+	}
+	m, err := NewMerkleTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.recomputeHash()
+	if str := NewGenesisSTR(staticSigningKey, TestAd{"abc"}, m); !str.IsGenesis() ||
+		!staticSigningKey.Public().Verify(str.Bytes(), str.Signature[:]) {
+		t.Error("Expect a validly signed genesis STR")
+	}
+
+	pad.Update(nil)
+	str1 := pad.LatestSTR()
+	if str1.IsGenesis() || !str1.VerifyHashChain(genesis) {
+		t.Error("Expect the STR of epoch 1 to extend the genesis STR")
+	}
+	// nothing precedes the genesis STR
+	if genesis.VerifyHashChain(str1) || genesis.VerifyHashChain(genesis) {
+		t.Error("Expect the genesis STR not to extend any STR")
+	}
+	forged := *genesis
+	forged.PreviousSTRHash[0] ^= 1
+	skipping := *genesis
+	skipping.SkipHashes = []hashed.Hash{{}}
+	for _, str := range []*SignedTreeRoot{&forged, &skipping} {
+		if str.IsGenesis() {
+			t.Error("Expect a malformed genesis STR to be rejected")
+		}
+	}
+}
+
+func TestSTRTreeShape(t *testing.T) {
+	pad, err := NewPAD(TestAd{"abc"}, staticSigningKey, staticVRFKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := pad.LatestSTR()
+	if str.MaxDepth != 0 || str.LeafCount != 0 {
+		t.Fatal("Expect empty shape for epoch 0, got", str.MaxDepth, str.LeafCount)
+	}
+	ap, _ := pad.Lookup([]byte("absent"))
+	if err := str.VerifyDepth(ap); err != nil {
+		t.Fatal("Expect proof of absence in empty tree to pass the depth check, got", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := pad.Set([]byte(keyPrefix+strconv.Itoa(i)), valuePrefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pad.Update(nil)
+	str = pad.LatestSTR()
+	if str.LeafCount != 20 {
+		t.Fatal("Expect 20 leaves, got", str.LeafCount)
+	}
+
+	var deepest uint32
+	for i := 0; i < 20; i++ {
+		ap, _ := pad.Lookup([]byte(keyPrefix + strconv.Itoa(i)))
+		if err := str.VerifyDepth(ap); err != nil {
+			t.Error(err)
+		}
+		if ap.Leaf.Level > deepest {
+			deepest = ap.Leaf.Level
+		}
+	}
+	if deepest != str.MaxDepth {
+		t.Fatal("Expect max depth", deepest, "got", str.MaxDepth)
+	}
+
+	ap, _ = pad.Lookup([]byte(keyPrefix + "0"))
+	ap.Leaf.Level = str.MaxDepth + 1
+	if err := str.VerifyDepth(ap); err != ErrDepthExceeded {
+		t.Error("Expect", ErrDepthExceeded, "got", err)
+	}
+
+	// the shape is covered by the signature
+	pk := staticSigningKey.Public()
+	forged := *str
+	forged.MaxDepth++
+	if pk.Verify(forged.Bytes(), forged.Signature[:]) {
+		t.Error("Signature verified with a modified max depth")
+	}
+}
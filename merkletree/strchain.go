@@ -0,0 +1,57 @@
+package merkletree
+
+import (
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+)
+
+var (
+	// ErrBadSTRSignature indicates that an STR isn't signed with the
+	// PAD's signing key.
+	ErrBadSTRSignature = errors.New("[merkletree] Invalid STR signature")
+	// ErrBrokenSTRChain indicates that an STR isn't the one for the epoch
+	// after the STR before it, or doesn't commit to it.
+	ErrBrokenSTRChain = errors.New("[merkletree] The STRs don't form a hash chain")
+)
+
+// VerifySTRChain verifies that strs are the STRs for the epochs after
+// that of trustedStart, in order, and that each is signed with v and
+// extends the hash chain from trustedStart (see VerifyHashChain). The
+// signature of trustedStart itself isn't verified. If v is a
+// sign.PublicKey, the signatures are verified as a batch, and only if
+// the batch is invalid one by one; if v is nil, they aren't verified,
+// e.g. because the caller has already done so.
+//
+// It returns ErrMalformedSTR if an STR is nil, and otherwise the
+// ErrBadSTRSignature or ErrBrokenSTRChain of the earliest STR that fails.
+func VerifySTRChain(v sign.Verifier, strs []*SignedTreeRoot, trustedStart *SignedTreeRoot) error {
+	if trustedStart == nil {
+		return ErrMalformedSTR
+	}
+	for _, str := range strs {
+		if str == nil {
+			return ErrMalformedSTR
+		}
+	}
+	if pk, ok := v.(sign.PublicKey); ok {
+		var batch sign.Batch
+		for _, str := range strs {
+			batch.Add(pk, str.Bytes(), str.Signature[:])
+		}
+		if batch.Verify() {
+			v = nil
+		}
+	}
+	prev := trustedStart
+	for _, str := range strs {
+		if v != nil && !v.Verify(str.Bytes(), str.Signature[:]) {
+			return ErrBadSTRSignature
+		}
+		if !str.VerifyHashChain(prev) {
+			return ErrBrokenSTRChain
+		}
+		prev = str
+	}
+	return nil
+}
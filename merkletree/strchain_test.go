@@ -0,0 +1,68 @@
+package merkletree
+
+import (
+	"testing"
+)
+
+// countingVerifier verifies signatures with the static signing key one
+// at a time, and counts them.
+type countingVerifier struct {
+	calls int
+}
+
+func (v *countingVerifier) Verify(message, sig []byte) bool {
+	v.calls++
+	return staticSigningKey.Public().Verify(message, sig)
+}
+
+func TestVerifySTRChain(t *testing.T) {
+	pad, err := NewPAD(TestAd{"abc"}, staticSigningKey, staticVRFKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := []*SignedTreeRoot{pad.LatestSTR()}
+	for i := 0; i < 5; i++ {
+		pad.Update(nil)
+		strs = append(strs, pad.LatestSTR())
+	}
+	pk := staticSigningKey.Public()
+	if err := VerifySTRChain(pk, strs[1:], strs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySTRChain(pk, strs[3:], strs[2]); err != nil {
+		t.Error("Expect a range to verify from any trusted STR, got", err)
+	}
+	if err := VerifySTRChain(pk, nil, strs[0]); err != nil {
+		t.Error("Expect an empty range to verify, got", err)
+	}
+	v := new(countingVerifier)
+	if err := VerifySTRChain(v, strs[1:], strs[0]); err != nil || v.calls != 5 {
+		t.Error("Expect the verifier to verify each STR, got", v.calls, err)
+	}
+
+	forged := *strs[3]
+	forged.Signature[0]++
+	gap := []*SignedTreeRoot{strs[1], strs[3]}
+	for _, tc := range []struct {
+		name  string
+		strs  []*SignedTreeRoot
+		start *SignedTreeRoot
+		want  error
+	}{
+		{"gap", gap, strs[0], ErrBrokenSTRChain},
+		{"wrong start", strs[2:], strs[0], ErrBrokenSTRChain},
+		{"bad signature", []*SignedTreeRoot{strs[1], strs[2], &forged}, strs[0], ErrBadSTRSignature},
+		// the earliest failure is reported
+		{"bad signature after gap", []*SignedTreeRoot{strs[2], &forged}, strs[0], ErrBrokenSTRChain},
+		{"nil STR", []*SignedTreeRoot{strs[1], nil}, strs[0], ErrMalformedSTR},
+		{"nil start", strs[1:], nil, ErrMalformedSTR},
+	} {
+		if err := VerifySTRChain(pk, tc.strs, tc.start); err != tc.want {
+			t.Error(tc.name, "Expect", tc.want, "got", err)
+		}
+	}
+	// without a verifier, only the links are checked
+	if err := VerifySTRChain(nil, []*SignedTreeRoot{strs[1], strs[2], &forged}, strs[0]); err != nil {
+		t.Error("Expect only the hash chain to be checked, got", err)
+	}
+}
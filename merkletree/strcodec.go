@@ -0,0 +1,167 @@
+package merkletree
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+)
+
+// STREncodingVersion is the version of the canonical STR encoding that
+// MarshalBinary produces.
+const STREncodingVersion byte = 1
+
+// ErrMalformedSTR indicates that an STR is missing or can't be decoded,
+// e.g. because its encoding is truncated, has trailing bytes or an
+// unknown version.
+var ErrMalformedSTR = errors.New("[merkletree] Malformed STR")
+
+// RawAssocData is the associated data of a decoded STR, kept as the
+// bytes it serializes to, since only the application can parse it.
+type RawAssocData []byte
+
+// Bytes returns ad.
+func (ad RawAssocData) Bytes() []byte {
+	return ad
+}
+
+// CanonicalBytes returns the canonical encoding of the fields of str and
+// its associated data, i.e. MarshalBinary without the signature. Unlike
+// Bytes, it's unambiguous and the same on every platform:
+//
+//	version      1 byte, STREncodingVersion
+//	epoch        8 bytes
+//	prev epoch   8 bytes
+//	tree hash    32 bytes
+//	prev hash    32 bytes
+//	max depth    4 bytes
+//	leaf count   8 bytes
+//	skip hashes  4-byte count, then 32 bytes each
+//	ad           4-byte length, then Ad.Bytes()
+//
+// All integers are big-endian. The STRs of protocol version 0.1 are still
+// signed over Bytes, so that existing signatures verify; a protocol
+// version that signs CanonicalBytes instead must be announced like any
+// other upgrade.
+func (str *SignedTreeRoot) CanonicalBytes() []byte {
+	var ad []byte
+	if str.Ad != nil {
+		ad = str.Ad.Bytes()
+	}
+	bs := make([]byte, 0, 1+8+8+2*hashed.HashSizeByte+4+8+
+		4+len(str.SkipHashes)*hashed.HashSizeByte+4+len(ad)+sign.SignatureSize)
+	bs = append(bs, STREncodingVersion)
+	bs = appendUint64(bs, uint64(str.Epoch))
+	bs = appendUint64(bs, uint64(str.PreviousEpoch))
+	bs = append(bs, str.TreeHash[:]...)
+	bs = append(bs, str.PreviousSTRHash[:]...)
+	bs = appendUint32(bs, str.MaxDepth)
+	bs = appendUint64(bs, str.LeafCount)
+	bs = appendUint32(bs, uint32(len(str.SkipHashes)))
+	for _, skip := range str.SkipHashes {
+		bs = append(bs, skip[:]...)
+	}
+	bs = appendUint32(bs, uint32(len(ad)))
+	return append(bs, ad...)
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding is
+// CanonicalBytes followed by the signature of str.
+func (str *SignedTreeRoot) MarshalBinary() ([]byte, error) {
+	return append(str.CanonicalBytes(), str.Signature[:]...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. The associated
+// data of the decoded STR is a RawAssocData, so its signature verifies
+// with Bytes, but the application has to parse it to inspect it. It
+// returns ErrMalformedSTR if data isn't an encoding MarshalBinary
+// produces.
+func (str *SignedTreeRoot) UnmarshalBinary(data []byte) error {
+	d := strDecoder{data: data}
+	if d.byte() != STREncodingVersion {
+		return ErrMalformedSTR
+	}
+	decoded := SignedTreeRoot{
+		Epoch:         Epoch(d.uint64()),
+		PreviousEpoch: Epoch(d.uint64()),
+	}
+	d.hash(&decoded.TreeHash)
+	d.hash(&decoded.PreviousSTRHash)
+	decoded.MaxDepth = d.uint32()
+	decoded.LeafCount = d.uint64()
+	// each skip hash takes HashSizeByte bytes, so a count the data can't
+	// hold is rejected before allocating
+	n := int64(d.uint32())
+	if n*hashed.HashSizeByte > int64(len(d.data)) {
+		return ErrMalformedSTR
+	}
+	if n > 0 {
+		decoded.SkipHashes = make([]hashed.Hash, n)
+		for i := range decoded.SkipHashes {
+			d.hash(&decoded.SkipHashes[i])
+		}
+	}
+	decoded.Ad = RawAssocData(d.bytes(int64(d.uint32())))
+	copy(decoded.Signature[:], d.bytes(sign.SignatureSize))
+	if d.err || len(d.data) != 0 {
+		return ErrMalformedSTR
+	}
+	*str = decoded
+	return nil
+}
+
+// strDecoder reads the fields of an encoded STR. Reading past the end of
+// the data sets err instead of failing, so that UnmarshalBinary checks
+// it once.
+type strDecoder struct {
+	data []byte
+	err  bool
+}
+
+func (d *strDecoder) bytes(n int64) []byte {
+	if d.err || n > int64(len(d.data)) {
+		d.err = true
+		return nil
+	}
+	bs := append([]byte(nil), d.data[:n]...)
+	d.data = d.data[n:]
+	return bs
+}
+
+func (d *strDecoder) byte() byte {
+	if bs := d.bytes(1); bs != nil {
+		return bs[0]
+	}
+	return 0
+}
+
+func (d *strDecoder) uint32() uint32 {
+	if bs := d.bytes(4); bs != nil {
+		return binary.BigEndian.Uint32(bs)
+	}
+	return 0
+}
+
+func (d *strDecoder) uint64() uint64 {
+	if bs := d.bytes(8); bs != nil {
+		return binary.BigEndian.Uint64(bs)
+	}
+	return 0
+}
+
+func (d *strDecoder) hash(h *hashed.Hash) {
+	copy(h[:], d.bytes(hashed.HashSizeByte))
+}
+
+func appendUint32(bs []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(bs, b[:]...)
+}
+
+func appendUint64(bs []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(bs, b[:]...)
+}
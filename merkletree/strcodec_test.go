@@ -0,0 +1,197 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+var updateVectors = flag.Bool("update", false, "regenerate testdata/str_vectors.json")
+
+var strVectorsPath = filepath.Join("testdata", "str_vectors.json")
+
+// strVector is a published test vector of the canonical STR encoding.
+// The fields are hex-encoded. The signatures are placeholders, since the
+// bytes that protocol version 0.1 signs depend on the platform.
+type strVector struct {
+	Name            string
+	Epoch           Epoch
+	PreviousEpoch   Epoch
+	TreeHash        string
+	PreviousSTRHash string
+	MaxDepth        uint32
+	LeafCount       uint64
+	SkipHashes      []string
+	Ad              string
+	Signature       string
+	Encoding        string
+}
+
+func fillHash(b byte) hashed.Hash {
+	var h hashed.Hash
+	for i := range h {
+		h[i] = b + byte(i)
+	}
+	return h
+}
+
+// vectorSTRs returns the STRs of the test vectors: a genesis STR, a
+// regular one, and one with skip hashes and larger integers.
+func vectorSTRs() map[string]*SignedTreeRoot {
+	strs := map[string]*SignedTreeRoot{
+		"genesis": {
+			TreeHash: fillHash(0x10),
+			Ad:       RawAssocData("genesis"),
+		},
+		"epoch 1": {
+			TreeHash:        fillHash(0x20),
+			Epoch:           1,
+			PreviousSTRHash: fillHash(0x30),
+			MaxDepth:        3,
+			LeafCount:       5,
+			Ad:              RawAssocData{},
+		},
+		"skip hashes": {
+			TreeHash:        fillHash(0x40),
+			Epoch:           0x0102030405060708,
+			PreviousEpoch:   0x0102030405060707,
+			PreviousSTRHash: fillHash(0x50),
+			MaxDepth:        0x01020304,
+			LeafCount:       0x1112131415161718,
+			SkipHashes:      []hashed.Hash{fillHash(0x60), fillHash(0x70)},
+			Ad:              RawAssocData{0x00, 0xff},
+		},
+	}
+	for _, str := range strs {
+		copy(str.Signature[:], bytes.Repeat(str.TreeHash[:1], len(str.Signature)))
+	}
+	return strs
+}
+
+func toVector(name string, str *SignedTreeRoot) strVector {
+	enc, _ := str.MarshalBinary()
+	v := strVector{
+		Name:            name,
+		Epoch:           str.Epoch,
+		PreviousEpoch:   str.PreviousEpoch,
+		TreeHash:        hex.EncodeToString(str.TreeHash[:]),
+		PreviousSTRHash: hex.EncodeToString(str.PreviousSTRHash[:]),
+		MaxDepth:        str.MaxDepth,
+		LeafCount:       str.LeafCount,
+		Ad:              hex.EncodeToString(str.Ad.Bytes()),
+		Signature:       hex.EncodeToString(str.Signature[:]),
+		Encoding:        hex.EncodeToString(enc),
+	}
+	for _, skip := range str.SkipHashes {
+		v.SkipHashes = append(v.SkipHashes, hex.EncodeToString(skip[:]))
+	}
+	return v
+}
+
+// TestSTRVectors checks the published test vectors, so that changes of
+// the encoding don't go unnoticed. Run the test with -update to
+// regenerate them after deliberate changes.
+func TestSTRVectors(t *testing.T) {
+	strs := vectorSTRs()
+	if *updateVectors {
+		var vectors []strVector
+		for _, name := range []string{"genesis", "epoch 1", "skip hashes"} {
+			vectors = append(vectors, toVector(name, strs[name]))
+		}
+		bs, err := json.MarshalIndent(vectors, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(strVectorsPath, append(bs, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err := ioutil.ReadFile(strVectorsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []strVector
+	if err := json.Unmarshal(bs, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != len(strs) {
+		t.Fatal("Expect", len(strs), "vectors, got", len(vectors))
+	}
+	for _, v := range vectors {
+		if want := toVector(v.Name, strs[v.Name]); !reflect.DeepEqual(v, want) {
+			t.Error("Expect vector", want, "got", v)
+			continue
+		}
+		enc, _ := hex.DecodeString(v.Encoding)
+		var str SignedTreeRoot
+		if err := str.UnmarshalBinary(enc); err != nil {
+			t.Error(v.Name, err)
+			continue
+		}
+		if got := toVector(v.Name, &str); !reflect.DeepEqual(got, v) {
+			t.Error("Expect", v, "got", got)
+		}
+		if str.Signature != strs[v.Name].Signature {
+			t.Error("Expect the signature of", v.Name, "to round-trip")
+		}
+	}
+}
+
+func TestSTRUnmarshalMalformed(t *testing.T) {
+	enc, _ := vectorSTRs()["skip hashes"].MarshalBinary()
+	badVersion := append([]byte{STREncodingVersion + 1}, enc[1:]...)
+	// the skip hash count is after the version, epochs, hashes and shape
+	hugeSkips := append([]byte(nil), enc...)
+	copy(hugeSkips[1+8+8+2*hashed.HashSizeByte+4+8:], []byte{0xff, 0xff, 0xff, 0xff})
+	for name, data := range map[string][]byte{
+		"empty":       nil,
+		"truncated":   enc[:len(enc)-1],
+		"trailing":    append(append([]byte(nil), enc...), 0),
+		"version":     badVersion,
+		"skip hashes": hugeSkips,
+	} {
+		var str SignedTreeRoot
+		if err := str.UnmarshalBinary(data); err != ErrMalformedSTR {
+			t.Error("Expect", ErrMalformedSTR, "for", name, "got", err)
+		}
+	}
+
+	var str SignedTreeRoot
+	if err := str.UnmarshalBinary(enc); err != nil {
+		t.Fatal(err)
+	}
+	if reenc, _ := str.MarshalBinary(); !bytes.Equal(reenc, enc) {
+		t.Error("Expect the encoding to round-trip")
+	}
+}
+
+func TestSTRMarshalPAD(t *testing.T) {
+	pad, err := NewPAD(TestAd{"abc"}, staticSigningKey, staticVRFKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		pad.Update(nil)
+	}
+	enc, err := pad.LatestSTR().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var str SignedTreeRoot
+	if err := str.UnmarshalBinary(enc); err != nil {
+		t.Fatal(err)
+	}
+	if !staticSigningKey.Public().Verify(str.Bytes(), str.Signature[:]) {
+		t.Error("Expect the signature of the decoded STR to verify")
+	}
+	if !str.VerifyHashChain(pad.GetSTR(3)) || len(str.SkipHashes) == 0 {
+		t.Error("Expect the decoded STR to keep its hash chain and skip hashes, got", str)
+	}
+}
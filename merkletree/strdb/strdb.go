@@ -0,0 +1,126 @@
+// This module implements a merkletree.STRStore that keeps the STRs on
+// disk in a LevelDB database, so that the STR history of a PAD or an
+// auditor survives process restarts.
+
+package strdb
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// A Store is a merkletree.STRStore backed by a LevelDB database. Each
+// STR is stored under its big-endian epoch, so the keys sort by epoch,
+// and encoded with merkletree.MarshalSTR, so its associated data must be
+// a merkletree.TypedAssocData. A Store is safe for concurrent use.
+type Store struct {
+	db *leveldb.DB
+	mu sync.Mutex // serializes Append
+}
+
+var _ merkletree.STRStore = (*Store)(nil)
+
+// Open opens the store in the directory path, creating it if needed.
+// The associated data of the loaded STRs is parsed with the decoder
+// registered for its type (see merkletree.RegisterAssocData).
+func Open(path string) (*Store, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func key(epoch merkletree.Epoch) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], uint64(epoch))
+	return k[:]
+}
+
+// Append implements merkletree.STRStore.
+func (s *Store) Append(str *merkletree.SignedTreeRoot) error {
+	bs, err := merkletree.MarshalSTR(str)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest, err := s.Latest()
+	switch {
+	case err == nil && str.Epoch != latest.Epoch+1:
+		return merkletree.ErrSTROutOfOrder
+	case err != nil && err != merkletree.ErrSTRNotFound:
+		return err
+	}
+	return s.db.Put(key(str.Epoch), bs, nil)
+}
+
+// Get implements merkletree.STRStore. It returns
+// merkletree.ErrMalformedTree if the stored STR can't be parsed, and
+// merkletree.ErrUnknownAssocData if the type of its associated data
+// isn't registered.
+func (s *Store) Get(epoch merkletree.Epoch) (*merkletree.SignedTreeRoot, error) {
+	bs, err := s.db.Get(key(epoch), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, merkletree.ErrSTRNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.decode(bs)
+}
+
+// Latest implements merkletree.STRStore.
+func (s *Store) Latest() (*merkletree.SignedTreeRoot, error) {
+	it := s.db.NewIterator(nil, nil)
+	defer it.Release()
+	if !it.Last() {
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+		return nil, merkletree.ErrSTRNotFound
+	}
+	return s.decode(it.Value())
+}
+
+// Range implements merkletree.STRStore.
+func (s *Store) Range(start, end merkletree.Epoch) ([]*merkletree.SignedTreeRoot, error) {
+	if start > end {
+		return nil, merkletree.ErrSTRNotFound
+	}
+	strs := make([]*merkletree.SignedTreeRoot, 0, end-start+1)
+	it := s.db.NewIterator(nil, nil)
+	defer it.Release()
+	for ok := it.Seek(key(start)); ok && len(strs) <= int(end-start); ok = it.Next() {
+		str, err := s.decode(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	if len(strs) != int(end-start+1) || strs[0].Epoch != start {
+		return nil, merkletree.ErrSTRNotFound
+	}
+	return strs, nil
+}
+
+// decode parses a stored STR.
+func (s *Store) decode(bs []byte) (*merkletree.SignedTreeRoot, error) {
+	str, err := merkletree.UnmarshalSTR(bs)
+	if err == merkletree.ErrMalformedSTR {
+		return nil, merkletree.ErrMalformedTree
+	}
+	return str, err
+}
@@ -0,0 +1,83 @@
+package strdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+type testAd struct {
+	Data string
+}
+
+func (ad *testAd) Bytes() []byte { return []byte(ad.Data) }
+
+const testAdType = "coniks.merkletree.strdb.testAd"
+
+func (ad *testAd) AssocDataType() string { return testAdType }
+
+func init() {
+	merkletree.RegisterAssocData(testAdType, func(data []byte) (merkletree.AssocData, error) {
+		ad := new(testAd)
+		return ad, json.Unmarshal(data, ad)
+	})
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Latest(); err != merkletree.ErrSTRNotFound {
+		t.Fatalf("Expected ErrSTRNotFound, got %v", err)
+	}
+
+	pad, err := merkletree.NewPAD(&testAd{"ad"}, crypto.NewStaticTestSigningKey(),
+		crypto.NewStaticTestVRFKey(), 2, merkletree.WithSTRStore(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := []*merkletree.SignedTreeRoot{pad.LatestSTR()}
+	for i := 0; i < 300; i++ {
+		pad.Update(nil)
+		strs = append(strs, pad.LatestSTR())
+	}
+	if err := s.Append(strs[3]); err != merkletree.ErrSTROutOfOrder {
+		t.Fatalf("Expected ErrSTROutOfOrder, got %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the history survives reopening the store
+	if s, err = Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	latest, err := s.Latest()
+	if err != nil || latest.Signature != strs[300].Signature {
+		t.Fatalf("Expected the STR of epoch 300, got %+v, %v", latest, err)
+	}
+	loaded, err := s.Range(0, 300)
+	if err != nil || len(loaded) != len(strs) {
+		t.Fatalf("Expected %d STRs, got %d, %v", len(strs), len(loaded), err)
+	}
+	for i, str := range loaded {
+		if str.Signature != strs[i].Signature || str.Ad.(*testAd).Data != "ad" {
+			t.Fatalf("Expected the STR of epoch %d, got %+v", i, str)
+		}
+		if !bytes.Equal(str.Bytes(), strs[i].Bytes()) {
+			t.Fatalf("Expected the STR of epoch %d to round-trip", i)
+		}
+	}
+	if _, err := s.Range(299, 301); err != merkletree.ErrSTRNotFound {
+		t.Fatalf("Expected ErrSTRNotFound, got %v", err)
+	}
+	if _, err := s.Get(301); err != merkletree.ErrSTRNotFound {
+		t.Fatalf("Expected ErrSTRNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package merkletree
+
+import (
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+var (
+	strListLeafPrefix = []byte{0}
+	strListNodePrefix = []byte{1}
+)
+
+// An STRList is a Merkle list of the hashes of a PAD's STRs: its Root is
+// the root of a binary hash tree over the hashes of the STRs for epochs
+// 0 through Len()-1, built like the Merkle tree hash of RFC 6962. The
+// hash of an STR is the hash of its signature, as in PreviousSTRHash.
+//
+// Appending an STR takes O(log n) time, and the list only keeps the
+// roots of O(log n) perfect subtrees, so a PAD can commit to its whole
+// history without keeping the STRs in memory.
+type STRList struct {
+	n     uint64
+	first hashed.Hash
+	peaks []hashed.Hash // roots of the perfect subtrees, largest first
+}
+
+// Append appends str, which must be the STR for epoch l.Len(), to l.
+func (l *STRList) Append(str *SignedTreeRoot) {
+	strHash := hashed.Sum(str.Signature[:])
+	if l.n == 0 {
+		l.first = strHash
+	}
+	node := hashed.Sum(strListLeafPrefix, strHash[:])
+	for size := l.n; size&1 == 1; size >>= 1 {
+		last := l.peaks[len(l.peaks)-1]
+		l.peaks = l.peaks[:len(l.peaks)-1]
+		node = hashed.Sum(strListNodePrefix, last[:], node[:])
+	}
+	l.peaks = append(l.peaks, node)
+	l.n++
+}
+
+// Len returns the number of STRs in l.
+func (l *STRList) Len() uint64 {
+	return l.n
+}
+
+// First returns the hash of the first STR in l, i.e. the identity of
+// the directory whose STRs l lists, or the zero Hash if l is empty.
+func (l *STRList) First() hashed.Hash {
+	return l.first
+}
+
+// Root returns the root of l, or the zero Hash if l is empty.
+func (l *STRList) Root() hashed.Hash {
+	if len(l.peaks) == 0 {
+		return hashed.Hash{}
+	}
+	root := l.peaks[len(l.peaks)-1]
+	for i := len(l.peaks) - 2; i >= 0; i-- {
+		root = hashed.Sum(strListNodePrefix, l.peaks[i][:], root[:])
+	}
+	return root
+}
@@ -0,0 +1,59 @@
+package merkletree
+
+import (
+	"math/bits"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+)
+
+// listRoot computes the Merkle tree hash of RFC 6962 over the hashes of
+// strs.
+func listRoot(strs []*SignedTreeRoot) hashed.Hash {
+	if len(strs) == 1 {
+		strHash := hashed.Sum(strs[0].Signature[:])
+		return hashed.Sum(strListLeafPrefix, strHash[:])
+	}
+	// the largest power of two smaller than len(strs)
+	k := 1 << (bits.Len(uint(len(strs)-1)) - 1)
+	left, right := listRoot(strs[:k]), listRoot(strs[k:])
+	return hashed.Sum(strListNodePrefix, left[:], right[:])
+}
+
+func TestSTRList(t *testing.T) {
+	var l STRList
+	if !l.Root().IsZero() || !l.First().IsZero() || l.Len() != 0 {
+		t.Fatal("Expect an empty list")
+	}
+
+	const epochs = 40
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, epochs+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strs []*SignedTreeRoot
+	for ep := Epoch(0); ep <= epochs; ep++ {
+		if ep > 0 {
+			pad.Update(nil)
+		}
+		strs = append(strs, pad.GetSTR(ep))
+		l.Append(pad.GetSTR(ep))
+		if l.Len() != uint64(ep)+1 {
+			t.Fatal("Expect", ep+1, "STRs, got", l.Len())
+		}
+		if want := listRoot(strs); l.Root() != want {
+			t.Fatal("Expect the Merkle tree hash of", len(strs), "STRs")
+		}
+		if root, first := pad.STRListRoot(); root != l.Root() || first != hashed.Sum(strs[0].Signature[:]) {
+			t.Fatal("Expect the PAD to list its STRs in epoch", ep)
+		}
+	}
+
+	// any change to the history changes the root
+	forged := *strs[7]
+	forged.Signature[0]++
+	strs[7] = &forged
+	if listRoot(strs) == l.Root() {
+		t.Error("Expect a different root for a forged history")
+	}
+}
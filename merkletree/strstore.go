@@ -0,0 +1,156 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrSTROutOfOrder indicates that an STR was appended to an STRStore
+	// that doesn't end with the STR of the epoch before it.
+	ErrSTROutOfOrder = errors.New("[merkletree] STR isn't the next one in the store")
+	// ErrSTRStoreNotEmpty indicates that a PAD was created with an
+	// STRStore that already holds the STRs of another PAD.
+	ErrSTRStoreNotEmpty = errors.New("[merkletree] STR store isn't empty")
+)
+
+// An STRStore archives a chain of STRs, e.g. on disk, so that the STR
+// history outlives the process that issued or observed it. A PAD
+// created WithSTRStore appends every STR it signs to its store, and
+// loads the STRs it no longer keeps in memory from it, so it can serve
+// the STR of any epoch. An auditor can keep the STRs it verified in one
+// and restore them when it restarts.
+//
+// The STRs in an STRStore have consecutive epochs; the first one can be
+// of any epoch. The STRs an STRStore returns have no trees, i.e. lookups
+// in their epochs still need a SnapshotStore.
+type STRStore interface {
+	// Append appends str to the store. It returns ErrSTROutOfOrder if the
+	// store isn't empty and str isn't the STR for the epoch after the
+	// latest one in the store.
+	Append(str *SignedTreeRoot) error
+	// Get returns the STR of epoch, or ErrSTRNotFound if there is none.
+	Get(epoch Epoch) (*SignedTreeRoot, error)
+	// Latest returns the STR of the latest epoch in the store, or
+	// ErrSTRNotFound if the store is empty.
+	Latest() (*SignedTreeRoot, error)
+	// Range returns the STRs of the epochs [start, end], in order, or
+	// ErrSTRNotFound if the store doesn't hold all of them.
+	Range(start, end Epoch) ([]*SignedTreeRoot, error)
+}
+
+// WithSTRStore makes the PAD append every STR it signs to store, and
+// load the STRs it no longer keeps in memory from it. The store must be
+// empty, or NewPAD returns ErrSTRStoreNotEmpty: a PAD can't continue the
+// history of another one. See STRStore.
+func WithSTRStore(store STRStore) PADOption {
+	return func(pad *PAD) error {
+		pad.strs = store
+		return nil
+	}
+}
+
+// A MemSTRStore is an STRStore that keeps the STRs in memory. It's mainly
+// useful for tests. A MemSTRStore is safe for concurrent use.
+type MemSTRStore struct {
+	mu   sync.RWMutex
+	strs []SignedTreeRoot // the STRs without their trees
+}
+
+var _ STRStore = (*MemSTRStore)(nil)
+
+// NewMemSTRStore returns an empty MemSTRStore.
+func NewMemSTRStore() *MemSTRStore {
+	return new(MemSTRStore)
+}
+
+// Append implements STRStore.
+func (s *MemSTRStore) Append(str *SignedTreeRoot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.strs); n > 0 && str.Epoch != s.strs[n-1].Epoch+1 {
+		return ErrSTROutOfOrder
+	}
+	stored := *str
+	stored.tree = nil
+	s.strs = append(s.strs, stored)
+	return nil
+}
+
+// Get implements STRStore.
+func (s *MemSTRStore) Get(epoch Epoch) (*SignedTreeRoot, error) {
+	strs, err := s.Range(epoch, epoch)
+	if err != nil {
+		return nil, err
+	}
+	return strs[0], nil
+}
+
+// Latest implements STRStore.
+func (s *MemSTRStore) Latest() (*SignedTreeRoot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.strs) == 0 {
+		return nil, ErrSTRNotFound
+	}
+	str := s.strs[len(s.strs)-1]
+	return &str, nil
+}
+
+// Range implements STRStore.
+func (s *MemSTRStore) Range(start, end Epoch) ([]*SignedTreeRoot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.strs) == 0 || start > end || start < s.strs[0].Epoch ||
+		end > s.strs[len(s.strs)-1].Epoch {
+		return nil, ErrSTRNotFound
+	}
+	first := s.strs[0].Epoch
+	strs := make([]*SignedTreeRoot, 0, end-start+1)
+	for _, str := range s.strs[start-first : end-first+1] {
+		str := str
+		strs = append(strs, &str)
+	}
+	return strs, nil
+}
+
+// Len returns the number of STRs in s.
+func (s *MemSTRStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.strs)
+}
+
+// checkSTRStore returns ErrSTRStoreNotEmpty if the PAD's STRStore
+// already holds STRs, and the error of the store if it fails.
+func (pad *PAD) checkSTRStore() error {
+	if pad.strs == nil {
+		return nil
+	}
+	switch _, err := pad.strs.Latest(); err {
+	case nil:
+		return ErrSTRStoreNotEmpty
+	case ErrSTRNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+// archiveSTR appends str, which the PAD just signed, to its STRStore,
+// if it has one, and returns the error of the store if it fails. A
+// history with a gap can't be served, so the PAD must not take the
+// snapshot of str then.
+func (pad *PAD) archiveSTR(str *SignedTreeRoot) error {
+	if pad.strs == nil {
+		return nil
+	}
+	if err := pad.strs.Append(str); err != nil {
+		return fmt.Errorf("[merkletree] archiving the STR of epoch %d: %w", str.Epoch, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package merkletree
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemSTRStore(t *testing.T) {
+	s := NewMemSTRStore()
+	if _, err := s.Latest(); err != ErrSTRNotFound {
+		t.Fatal("Expect", ErrSTRNotFound, "got", err)
+	}
+	for _, epoch := range []Epoch{3, 4, 5} {
+		if err := s.Append(&SignedTreeRoot{Epoch: epoch}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Append(&SignedTreeRoot{Epoch: 7}); err != ErrSTROutOfOrder {
+		t.Fatal("Expect", ErrSTROutOfOrder, "got", err)
+	}
+	if latest, err := s.Latest(); err != nil || latest.Epoch != 5 {
+		t.Fatal("Expect the STR of epoch 5, got", latest, err)
+	}
+	if str, err := s.Get(4); err != nil || str.Epoch != 4 {
+		t.Fatal("Expect the STR of epoch 4, got", str, err)
+	}
+
+	for _, tc := range []struct {
+		start, end Epoch
+		want       int
+	}{
+		{3, 5, 3},
+		{4, 4, 1},
+		{2, 4, 0},
+		{4, 6, 0},
+		{5, 4, 0},
+	} {
+		strs, err := s.Range(tc.start, tc.end)
+		if tc.want == 0 {
+			if err != ErrSTRNotFound {
+				t.Error("Expect", ErrSTRNotFound, "for", tc.start, tc.end, "got", err)
+			}
+			continue
+		}
+		if err != nil || len(strs) != tc.want || strs[0].Epoch != tc.start {
+			t.Error("Expect", tc.want, "STRs from epoch", tc.start, "got", strs, err)
+		}
+	}
+}
+
+func TestPADSTRStore(t *testing.T) {
+	store := NewMemSTRStore()
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 2, WithSTRStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := []*SignedTreeRoot{pad.LatestSTR()}
+	for i := 0; i < 5; i++ {
+		pad.Update(nil)
+		strs = append(strs, pad.LatestSTR())
+	}
+	if store.Len() != len(strs) {
+		t.Fatal("Expect", len(strs), "archived STRs, got", store.Len())
+	}
+
+	// the evicted STRs are served from the store, but their trees aren't
+	for epoch, want := range strs {
+		str := pad.GetSTR(Epoch(epoch))
+		if str == nil || str.Signature != want.Signature {
+			t.Fatal("Expect the STR of epoch", epoch, "got", str)
+		}
+	}
+	want := ErrEpochPruned{Epoch: 0, Nearest: 4}
+	var pruned ErrEpochPruned
+	if _, err := pad.LookupInEpoch([]byte(keyPrefix), 0); !errors.As(err, &pruned) || pruned != want {
+		t.Error("Expect", want, "got", err)
+	}
+
+	// a PAD can't continue the history of another one
+	if _, err := NewPAD(TestAd{""}, signKey, vrfKey, 2, WithSTRStore(store)); err != ErrSTRStoreNotEmpty {
+		t.Error("Expect", ErrSTRStoreNotEmpty, "got", err)
+	}
+}
+
+// failingSTRStore is a MemSTRStore whose Append fails while fail is set.
+type failingSTRStore struct {
+	*MemSTRStore
+	fail bool
+}
+
+func (s *failingSTRStore) Append(str *SignedTreeRoot) error {
+	if s.fail {
+		return errStoreFailed
+	}
+	return s.MemSTRStore.Append(str)
+}
+
+func TestPADSTRStoreFailure(t *testing.T) {
+	store := &failingSTRStore{MemSTRStore: NewMemSTRStore()}
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 3, WithSTRStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	store.fail = true
+	if _, err := pad.Update(nil); !errors.Is(err, errStoreFailed) {
+		t.Fatal("Expect", errStoreFailed, "got", err)
+	}
+	if epoch := pad.LatestSTR().Epoch; epoch != 0 {
+		t.Fatal("Expect no snapshot to be taken, got epoch", epoch)
+	}
+
+	// the update is retried, and the history has no gap
+	store.fail = false
+	st, err := pad.Update(nil)
+	if err != nil || st.Epoch != 1 || st.Insertions != 1 {
+		t.Fatal("Expect the snapshot of epoch 1 with 1 insertion, got", st, err)
+	}
+	if archived, err := store.Get(1); err != nil || archived.Signature != pad.LatestSTR().Signature {
+		t.Error("Expect the STR of epoch 1 to be archived, got", archived, err)
+	}
+	if err := VerifySTRChain(signKey.Public(), []*SignedTreeRoot{pad.LatestSTR()}, pad.GetSTR(0)); err != nil {
+		t.Error(err)
+	}
+}
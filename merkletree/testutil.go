@@ -1,9 +1,13 @@
+//go:build !coniks_client
+// +build !coniks_client
+
 package merkletree
 
 import (
 	"testing"
 
 	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/hashed"
 )
 
 var keyPrefix = "key"
@@ -18,9 +22,13 @@ func StaticPAD(t *testing.T, ad AssocData) *PAD {
 	if err != nil {
 		t.Fatal(err)
 	}
-	str := NewSTR(pad.signKey, pad.ad, staticTree(t), 0, []byte{})
+	str := NewSTR(pad.signKey, pad.ad, staticTree(t), 0, hashed.Hash{}, nil)
 	pad.latestSTR = str
+	pad.linkSkips(str)
+	pad.strList = STRList{}
+	pad.strList.Append(str)
 	pad.snapshots[0] = pad.latestSTR
+	pad.stats[0] = str.tree.snapshotStats()
 	return pad
 }
 
@@ -0,0 +1,104 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strconv"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+)
+
+// An Epoch is the number of a PAD snapshot. The first snapshot is of
+// epoch 0, and each update of the PAD starts the next epoch. It's a
+// distinct type so that epochs don't get mixed up with counts, e.g. of
+// snapshots or leaves.
+type Epoch uint64
+
+// ParseEpoch parses the decimal representation of an epoch, as returned
+// by Epoch.String.
+func ParseEpoch(s string) (Epoch, error) {
+	e, err := strconv.ParseUint(s, 10, 64)
+	return Epoch(e), err
+}
+
+// String returns the decimal representation of e.
+func (e Epoch) String() string {
+	return strconv.FormatUint(uint64(e), 10)
+}
+
+// Bytes serializes e for signing, in the byte order of conv.ULongToBytes.
+func (e Epoch) Bytes() []byte {
+	return conv.ULongToBytes(uint64(e))
+}
+
+// An Index is the lookup index of a key in a Merkle prefix tree, which
+// determines the path from the root to the key's leaf. It's a distinct
+// type so that indices don't get mixed up with keys, both of which are
+// byte strings. An Index is []byte underneath, and is serialized as one.
+type Index []byte
+
+// ParseIndex parses the hexadecimal representation of an index, as
+// returned by Index.String.
+func ParseIndex(s string) (Index, error) {
+	return hex.DecodeString(s)
+}
+
+// String returns the hexadecimal representation of i.
+func (i Index) String() string {
+	return hex.EncodeToString(i)
+}
+
+// Validate returns ErrIndexLength if i isn't size bytes long.
+func (i Index) Validate(size int) error {
+	if len(i) != size {
+		return ErrIndexLength
+	}
+	return nil
+}
+
+// Equal reports whether i and other are the same index.
+func (i Index) Equal(other Index) bool {
+	return bytes.Equal(i, other)
+}
+
+// Bit returns the nth bit of i, counting from the most significant bit
+// of the first byte. The bit determines the direction taken at level n
+// of the path of i: true is right.
+func (i Index) Bit(n uint32) bool {
+	return conv.GetNthBit(i, n)
+}
+
+var (
+	// ErrInvalidTree indicates a panic due to
+	// a malformed operation on the tree.
+	ErrInvalidTree = errors.New("[merkletree] Invalid tree")
+	// ErrInvalidIndexSize indicates that the requested index size
+	// is outside of [MinIndexSize, DefaultIndexSize].
+	ErrInvalidIndexSize = errors.New("[merkletree] Invalid index size")
+	// ErrIndexLength indicates that an index doesn't have the
+	// length the tree was configured with.
+	ErrIndexLength = errors.New("[merkletree] Index has the wrong length")
+	// ErrIndexCollision indicates that the index being set is already
+	// bound to a different key, which can happen with truncated indices.
+	ErrIndexCollision = errors.New("[merkletree] Index is already bound to a different key")
+)
+
+const (
+	// EmptyBranchIdentifier is the domain separation prefix for
+	// empty node hashes.
+	EmptyBranchIdentifier = 'E'
+
+	// LeafIdentifier is the domain separation prefix for user
+	// leaf node hashes.
+	LeafIdentifier = 'L'
+
+	// DefaultIndexSize is the size of lookup indices in bytes
+	// if nothing else is configured, i.e. the full VRF output.
+	DefaultIndexSize = vrf.Size
+	// MinIndexSize is the smallest allowed lookup index size in bytes.
+	// Indices are truncated VRF outputs, so shorter indices mean
+	// shorter proofs but a higher chance of collisions.
+	MinIndexSize = 16
+)
@@ -0,0 +1,51 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ORBAT/cloniks/conv"
+)
+
+func TestEpoch(t *testing.T) {
+	e := Epoch(1234)
+	if e.String() != "1234" {
+		t.Fatalf("Expect 1234, got %s", e)
+	}
+	if !bytes.Equal(e.Bytes(), conv.ULongToBytes(1234)) {
+		t.Fatal("Expect the bytes of an epoch to be those of its uint64")
+	}
+	parsed, err := ParseEpoch(e.String())
+	if err != nil || parsed != e {
+		t.Fatalf("Expect to parse %s, got %d, %v", e, parsed, err)
+	}
+	if _, err := ParseEpoch("-1"); err == nil {
+		t.Fatal("Expect an error parsing a negative epoch")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := pad.Index([]byte("key"))
+	if err := index.Validate(pad.IndexSize()); err != nil {
+		t.Fatal(err)
+	}
+	if err := index[:len(index)-1].Validate(pad.IndexSize()); err != ErrIndexLength {
+		t.Fatalf("Expect ErrIndexLength, got %v", err)
+	}
+	parsed, err := ParseIndex(index.String())
+	if err != nil || !parsed.Equal(index) {
+		t.Fatalf("Expect to parse %s, got %s, %v", index, parsed, err)
+	}
+	if _, err := ParseIndex("not hex"); err == nil {
+		t.Fatal("Expect an error parsing an index that isn't hex")
+	}
+	for i := uint32(0); i < uint32(len(index))*8; i++ {
+		if index.Bit(i) != conv.GetNthBit(index, i) {
+			t.Fatalf("Expect bit %d of %s to be that of GetNthBit", i, index)
+		}
+	}
+}
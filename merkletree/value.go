@@ -0,0 +1,66 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrNonCanonicalValue indicates that the value in a leaf isn't the
+// canonical encoding of the LeafValue it decodes to.
+var ErrNonCanonicalValue = errors.New("[merkletree] The leaf value isn't canonically encoded")
+
+// A LeafValue is a structured value that an application stores in the
+// leaves of a PAD, e.g. a bundle of a user's keys, instead of an opaque
+// byte string. The PAD stores, and commits to, its canonical encoding,
+// so that clients that decode the same LeafValue agree on its commitment.
+type LeafValue interface {
+	// Bytes returns the canonical encoding of the value. Equal values
+	// must have equal encodings.
+	Bytes() []byte
+	// Validate returns an error if the value mustn't be stored.
+	Validate() error
+}
+
+// A LeafDecoder decodes the canonical encoding of a LeafValue.
+type LeafDecoder func(bs []byte) (LeafValue, error)
+
+// RawValue is the LeafValue of an opaque byte string, which is its own
+// encoding.
+type RawValue []byte
+
+// Bytes returns v.
+func (v RawValue) Bytes() []byte {
+	return v
+}
+
+// Validate accepts any byte string.
+func (v RawValue) Validate() error {
+	return nil
+}
+
+// DecodeRawValue is the LeafDecoder of RawValues.
+func DecodeRawValue(bs []byte) (LeafValue, error) {
+	return RawValue(bs), nil
+}
+
+// DecodeLeafValue decodes the value of the leaf of ap with decode. It
+// returns a nil LeafValue if ap proves the absence of its lookup index,
+// the error of decode, or of the Validate method of the decoded value,
+// if any, and ErrNonCanonicalValue if the value isn't the canonical
+// encoding of the decoded one. DecodeLeafValue doesn't verify ap.
+func (ap *AuthenticationPath) DecodeLeafValue(decode LeafDecoder) (LeafValue, error) {
+	if ap.ProofType() != ProofOfInclusion {
+		return nil, nil
+	}
+	v, err := decode(ap.Leaf.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(v.Bytes(), ap.Leaf.Value) {
+		return nil, ErrNonCanonicalValue
+	}
+	return v, nil
+}
@@ -0,0 +1,30 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+// SetValue is Set for a structured value: it stores the canonical
+// encoding of v, after checking that v is valid. It returns the error of
+// v.Validate() if v isn't.
+func (pad *PAD) SetValue(key []byte, v LeafValue) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return pad.Set(key, v.Bytes())
+}
+
+// LookupValue is Lookup for a structured value: it also returns the
+// value of key in the latest snapshot, decoded with decode, or nil if
+// key is absent. It returns the errors of Lookup and
+// AuthenticationPath.DecodeLeafValue.
+func (pad *PAD) LookupValue(key []byte, decode LeafDecoder) (LeafValue, *AuthenticationPath, error) {
+	ap, err := pad.Lookup(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := ap.DecodeLeafValue(decode)
+	if err != nil {
+		return nil, ap, err
+	}
+	return v, ap, nil
+}
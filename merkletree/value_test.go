@@ -0,0 +1,102 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// keyBundle is a LeafValue of a user's signing and encryption keys,
+// encoded as the length of the signing key followed by both keys.
+type keyBundle struct {
+	signing, encryption []byte
+}
+
+var errBadSigningKey = errors.New("bad signing key")
+
+func (b *keyBundle) Bytes() []byte {
+	bs := append([]byte{byte(len(b.signing))}, b.signing...)
+	return append(bs, b.encryption...)
+}
+
+func (b *keyBundle) Validate() error {
+	if len(b.signing) == 0 || len(b.signing) > 255 {
+		return errBadSigningKey
+	}
+	return nil
+}
+
+func decodeKeyBundle(bs []byte) (LeafValue, error) {
+	if len(bs) == 0 || len(bs) < 1+int(bs[0]) {
+		return nil, errors.New("truncated key bundle")
+	}
+	n := 1 + int(bs[0])
+	return &keyBundle{signing: bs[1:n], encryption: bs[n:]}, nil
+}
+
+func TestPADLeafValues(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &keyBundle{signing: []byte("alice's signing key"), encryption: []byte("alice's encryption key")}
+	if err := pad.SetValue([]byte("alice"), alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.SetValue([]byte("bob"), &keyBundle{encryption: []byte("key")}); err != errBadSigningKey {
+		t.Error("Expect", errBadSigningKey, "got", err)
+	}
+	// decodes to a valid bundle, but with an empty signing key
+	if err := pad.Set([]byte("carol"), []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+
+	v, ap, err := pad.LookupValue([]byte("alice"), decodeKeyBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := v.(*keyBundle)
+	if !bytes.Equal(got.signing, alice.signing) || !bytes.Equal(got.encryption, alice.encryption) {
+		t.Error("Expect alice's bundle, got", got)
+	}
+	// the commitment is over the canonical encoding
+	if err := ap.Verify([]byte("alice"), alice.Bytes(), pad.LatestSTR().TreeHash[:]); err != nil {
+		t.Error(err)
+	}
+
+	if v, ap, err := pad.LookupValue([]byte("bob"), decodeKeyBundle); err != nil || v != nil ||
+		!ap.ProofType().IsAbsence() {
+		t.Error("Expect no value for bob, got", v, err)
+	}
+	if _, _, err := pad.LookupValue([]byte("carol"), decodeKeyBundle); err != errBadSigningKey {
+		t.Error("Expect", errBadSigningKey, "got", err)
+	}
+	if v, _, err := pad.LookupValue([]byte("alice"), DecodeRawValue); err != nil ||
+		!bytes.Equal(v.Bytes(), alice.Bytes()) {
+		t.Error("Expect the raw encoding of alice's bundle, got", v, err)
+	}
+}
+
+func TestNonCanonicalLeafValue(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("\x01kextra")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil)
+	// decodes the signing key, but drops the rest
+	lossy := func(bs []byte) (LeafValue, error) {
+		v, err := decodeKeyBundle(bs)
+		if err != nil {
+			return nil, err
+		}
+		v.(*keyBundle).encryption = nil
+		return v, nil
+	}
+	if _, _, err := pad.LookupValue([]byte("alice"), lossy); err != ErrNonCanonicalValue {
+		t.Error("Expect", ErrNonCanonicalValue, "got", err)
+	}
+}
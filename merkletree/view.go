@@ -0,0 +1,146 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package merkletree
+
+// A ReadOnlyTree is an immutable view of the PAD snapshot of a single
+// epoch. Everything read through a view comes from the same snapshot, so
+// a response built from one can't mix proofs and STRs of different
+// epochs, and later updates of the PAD don't affect it. The nodes of a
+// snapshot of a PAD with a NodeStore are loaded as needed, so the
+// methods reading them return an error wrapping ErrNodeLoad if one of
+// them can't be loaded.
+type ReadOnlyTree interface {
+	// Epoch returns the epoch of the snapshot.
+	Epoch() Epoch
+	// STR returns the signed tree root of the snapshot.
+	STR() *SignedTreeRoot
+	// Get searches the requested key in the snapshot, and returns the
+	// AuthenticationPath proving inclusion or absence of the key.
+	Get(key []byte) (*AuthenticationPath, error)
+	// GetIndex is like Get, but searches the lookup index index, which
+	// must be of the PAD's index size, instead of the key's. The
+	// AuthenticationPath has no VrfProof.
+	GetIndex(index Index) (*AuthenticationPath, error)
+	// GetBatch searches all of the requested keys in the snapshot, and
+	// returns a single MultiAuthPath proving the inclusion or absence of
+	// each of them.
+	GetBatch(keys [][]byte) (*MultiAuthPath, error)
+	// Iterate calls f for each key/value binding in the snapshot in
+	// lookup index order, until f returns false. f must not modify key
+	// or value.
+	Iterate(f func(key, value []byte) bool) error
+}
+
+// A snapshotView is the ReadOnlyTree of a single STR.
+type snapshotView struct {
+	str       *SignedTreeRoot
+	indexer   Indexer
+	indexSize int
+}
+
+var _ ReadOnlyTree = (*snapshotView)(nil)
+
+// At returns a read-only view of the snapshot at the requested epoch.
+// It returns ErrSTRNotFound if the epoch is after the latest one, or if
+// its signed tree root has been removed from memory, and an
+// ErrEpochPruned if only its signed tree root has been kept. A PAD with
+// a SnapshotStore loads such snapshots from the store instead, and
+// returns the error of the store if it can't.
+func (pad *PAD) At(epoch Epoch) (ReadOnlyTree, error) {
+	str, err := pad.snapshot(epoch)
+	if err != nil {
+		return nil, err
+	}
+	return pad.view(str), nil
+}
+
+func (pad *PAD) view(str *SignedTreeRoot) *snapshotView {
+	// TODO: If the vrf key is rotated, we'd need to use the key
+	// corresponding to str.Epoch here.  See #120
+	return &snapshotView{str: str, indexer: pad.indexer, indexSize: pad.indexSize}
+}
+
+func (v *snapshotView) Epoch() Epoch {
+	return v.str.Epoch
+}
+
+func (v *snapshotView) STR() *SignedTreeRoot {
+	return v.str
+}
+
+func (v *snapshotView) Get(key []byte) (*AuthenticationPath, error) {
+	lookupIndex, proof := v.indexer.Index(key)
+	ap, err := v.str.tree.Get(lookupIndex[:v.indexSize])
+	if err != nil {
+		return nil, err
+	}
+	ap.VrfProof = proof
+	return ap, nil
+}
+
+func (v *snapshotView) GetIndex(index Index) (*AuthenticationPath, error) {
+	return v.str.tree.Get(index)
+}
+
+func (v *snapshotView) GetBatch(keys [][]byte) (*MultiAuthPath, error) {
+	indices := make([][]byte, len(keys))
+	proofs := make([][]byte, len(keys))
+	for i, key := range keys {
+		lookupIndex, proof := v.indexer.Index(key)
+		indices[i], proofs[i] = lookupIndex[:v.indexSize], proof
+	}
+	mp, err := v.str.tree.GetBatch(indices)
+	if err != nil {
+		return nil, err
+	}
+	mp.VrfProofs = proofs
+	return mp, nil
+}
+
+func (v *snapshotView) Iterate(f func(key, value []byte) bool) error {
+	_, err := v.str.tree.ForEachLeaf(func(key, value []byte, _ Index) bool {
+		return f(key, value)
+	})
+	return err
+}
+
+// ForEachLeaf calls f with the key, value and index of each user leaf
+// in m in index order, until f returns false, and returns false iff it
+// stopped early. f must not modify key, value or index, and must not
+// call the methods of m, which is locked for reading meanwhile. The nodes of a tree with a NodeStore are loaded as needed,
+// so the whole tree doesn't have to fit in memory, and ForEachLeaf
+// stops with an error wrapping ErrNodeLoad if one can't be.
+func (m *MerkleTree) ForEachLeaf(f func(key, value []byte, index Index) bool) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.iterateULNs(m.root, func(n *userLeafNode) bool {
+		return f(n.key, n.value, n.index)
+	})
+}
+
+// iterateULNs is visitULNsInternal that stops as soon as callBack
+// returns false. It returns false if it stopped early, or the error of
+// loading a node.
+func (m *MerkleTree) iterateULNs(nodePtr merkleNode, callBack func(*userLeafNode) bool) (bool, error) {
+	switch nodePtr.kind() {
+	case userLeafNodeKind:
+		return callBack(nodePtr.(*userLeafNode)), nil
+	case interiorNodeKind:
+		n := nodePtr.(*interiorNode)
+		for _, right := range []bool{false, true} {
+			child, err := m.childOf(n, right)
+			if err != nil {
+				return false, err
+			}
+			if more, err := m.iterateULNs(child, callBack); !more || err != nil {
+				return more, err
+			}
+		}
+		return true, nil
+	case emptyNodeKind:
+		return true, nil
+	default:
+		panic(ErrInvalidTree)
+	}
+}
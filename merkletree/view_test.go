@@ -0,0 +1,88 @@
+package merkletree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPADAt(t *testing.T) {
+	pad, err := NewPAD(TestAd{""}, signKey, vrfKey, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil) // epoch 1
+	view, err := pad.At(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("alice"), []byte("new key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pad.Set([]byte("bob"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	pad.Update(nil) // epoch 2
+
+	// the view is unaffected by the update
+	if view.Epoch() != 1 || view.STR() != pad.GetSTR(1) {
+		t.Fatal("Unexpected snapshot", view.Epoch())
+	}
+	ap, err := view.Get([]byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ap.Verify([]byte("alice"), []byte("key"), view.STR().TreeHash[:]); err != nil {
+		t.Error(err)
+	}
+	if ap, err := view.Get([]byte("bob")); err != nil || !ap.ProofType().IsAbsence() {
+		t.Error("Expect bob to be absent in epoch 1")
+	}
+	byIndex, err := view.GetIndex(ap.LookupIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byIndex.ProofType() != ProofOfInclusion || !bytes.Equal(byIndex.Leaf.Value, []byte("key")) ||
+		byIndex.VrfProof != nil {
+		t.Error("Expect a proof of inclusion without a VRF proof by index")
+	}
+	var n int
+	if err := view.Iterate(func(key, value []byte) bool {
+		n++
+		if !bytes.Equal(key, []byte("alice")) || !bytes.Equal(value, []byte("key")) {
+			t.Errorf("Unexpected binding %q: %q", key, value)
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Error("Expect 1 binding, got", n)
+	}
+
+	latest, err := pad.At(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = 0
+	if err := latest.Iterate(func(key, value []byte) bool {
+		n++
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Error("Expect Iterate to stop after the first binding, got", n)
+	}
+
+	if _, err := pad.At(3); err != ErrSTRNotFound {
+		t.Error("Expect", ErrSTRNotFound, "for a future epoch, got", err)
+	}
+	pad.Update(nil)
+	pad.Update(nil) // evicts epochs 0 and 1
+	if _, err := pad.At(1); err != ErrSTRNotFound {
+		t.Error("Expect", ErrSTRNotFound, "for an evicted epoch, got", err)
+	}
+}
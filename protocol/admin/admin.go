@@ -0,0 +1,151 @@
+// This module implements the admin socket of a directory server: an
+// HTTP interface on a Unix socket, which only the operators who can
+// access the socket's file can reach, for operational tasks that aren't
+// part of the protocol. A Server serves it, and a Client uses it, e.g.
+// in scheduled integrity checks.
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/ORBAT/cloniks/directory"
+)
+
+// DefaultSamples is the number of names whose proofs a check verifies by
+// default.
+const DefaultSamples = 100
+
+// ErrCheckFailed is returned by Client.Check if any of the checks failed.
+var ErrCheckFailed = errors.New("[admin] Integrity check failed")
+
+// A Server serves the admin interface of a Tree:
+//
+//	POST /check?samples=N   run Tree.Check and return the JSON
+//	                        directory.CheckReport
+//
+// Like Tree.Run, it holds mu while using the Tree.
+type Server struct {
+	Tree *directory.Tree
+	Mu   sync.Locker
+}
+
+// Handler returns the HTTP handler of s.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", s.handleCheck)
+	return mux
+}
+
+func (s *Server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	samples := DefaultSamples
+	if v := r.URL.Query().Get("samples"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid samples", http.StatusBadRequest)
+			return
+		}
+		samples = n
+	}
+	s.Mu.Lock()
+	report := s.Tree.Check(samples, nil)
+	s.Mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Listen listens on the Unix socket path, replacing a stale socket a
+// server left behind, and makes it accessible to its owner only.
+func Listen(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve serves the admin interface of s on l until ctx is done, and then
+// returns ctx.Err().
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: s.Handler()}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return ctx.Err()
+}
+
+// A Client uses the admin interface on the Unix socket Socket.
+type Client struct {
+	Socket string
+}
+
+func (c *Client) post(ctx context.Context, path string) ([]byte, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", c.Socket)
+		},
+	}}
+	req, err := http.NewRequest(http.MethodPost, "http://admin"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", path, resp.Status)
+	}
+	return body, nil
+}
+
+// Check runs the integrity checks of the Tree, verifying the proofs of
+// up to samples names, and returns the report. If any of the checks
+// failed, it returns the report along with an error wrapping
+// ErrCheckFailed that names them.
+func (c *Client) Check(ctx context.Context, samples int) (*directory.CheckReport, error) {
+	body, err := c.post(ctx, "/check?samples="+strconv.Itoa(samples))
+	if err != nil {
+		return nil, err
+	}
+	var report directory.CheckReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	if failed := report.Failed(); len(failed) > 0 {
+		return &report, fmt.Errorf("%w: %v", ErrCheckFailed, failed)
+	}
+	return &report, nil
+}
@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+)
+
+func serve(t *testing.T, d *directory.Tree) *Client {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &Server{Tree: d, Mu: new(sync.Mutex)}
+	go func() { _ = s.Serve(ctx, l) }()
+	return &Client{Socket: path}
+}
+
+func TestCheck(t *testing.T) {
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), crypto.NewStaticTestSigningKey(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := d.Register(name, []byte("key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Update()
+	c := serve(t, d)
+
+	report, err := c.Check(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Epoch != 1 || len(report.Checks) != 4 || !report.OK() {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if proofs := report.Checks[3]; proofs.Name != directory.CheckProofs || proofs.Checked != 3 {
+		t.Error("Expect 3 proofs checked, got", proofs)
+	}
+
+	d.LatestSTR().Signature[0] ^= 1
+	report, err = c.Check(context.Background(), 10)
+	if !errors.Is(err, ErrCheckFailed) || report == nil || report.OK() {
+		t.Error("Expect", ErrCheckFailed, "got", err)
+	}
+}
+
+func TestListenStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	for i := 0; i < 2; i++ {
+		l, err := Listen(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a crashed server leaves its socket behind
+		if ul, ok := l.(interface{ SetUnlinkOnClose(bool) }); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,187 @@
+// This module implements alerts that CONIKS auditors and client monitors
+// deliver to humans when they detect directory misbehavior, such as
+// equivocation, broken registration promises or unexpected key changes,
+// together with a pluggable Sink interface and built-in sinks for logs,
+// webhooks and email.
+
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// A Kind classifies an alert.
+type Kind int
+
+// These are the kinds of alerts.
+const (
+	// CheckFailed is any failed consistency check without a more specific kind.
+	CheckFailed Kind = iota
+	// Equivocation means the directory presented diverging STR histories.
+	Equivocation
+	// BadSignature means the directory's signature on an STR or TB is invalid.
+	BadSignature
+	// BrokenPromise means the directory didn't include a binding it
+	// had promised to include with a temporary binding.
+	BrokenPromise
+	// KeyChange means a binding's key differs from what the client expected.
+	KeyChange
+	// ConflictingIdentity means there are several initial STRs for the
+	// same directory address.
+	ConflictingIdentity
+	// UpdateFailed means a directory's epoch update exceeded its deadline
+	// or failed, so the directory may break its promises.
+	UpdateFailed
+	// SlowPromise means a directory fulfilled the promises of its
+	// temporary bindings close to or after its promise deadline.
+	SlowPromise
+	// TimestampFailed means a directory couldn't timestamp the archival
+	// attestation of its STR history, so the previous attestation is
+	// its latest until the next one is timestamped.
+	TimestampFailed
+)
+
+var kindNames = map[Kind]string{
+	CheckFailed:         "check-failed",
+	Equivocation:        "equivocation",
+	BadSignature:        "bad-signature",
+	BrokenPromise:       "broken-promise",
+	KeyChange:           "key-change",
+	ConflictingIdentity: "conflicting-identity",
+	UpdateFailed:        "update-failed",
+	SlowPromise:         "slow-promise",
+	TimestampFailed:     "timestamp-failed",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// A Severity indicates how urgently an alert needs attention.
+type Severity int
+
+// These are the alert severities.
+const (
+	Info Severity = iota
+	Warning
+	Critical
+)
+
+var severityNames = map[Severity]string{
+	Info:     "info",
+	Warning:  "warning",
+	Critical: "critical",
+}
+
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// An Alert describes an event that a human should know about.
+type Alert struct {
+	Kind     Kind
+	Severity Severity
+	Time     time.Time
+	// Directory identifies the directory concerned, e.g. by its address
+	// or the hex-encoded hash of its initial STR, if known.
+	Directory string
+	// Epoch is the epoch in which the event was detected.
+	Epoch merkletree.Epoch
+	// Name is the username concerned, if any.
+	Name    string
+	Message string
+	// Err is the error that caused the alert, if any.
+	Err error
+}
+
+// FromCheck creates an alert for the error err returned by a consistency
+// check. It returns nil if err doesn't indicate directory misbehavior,
+// i.e. if err is nil or one of the request result codes.
+func FromCheck(err error, epoch merkletree.Epoch, name string) *Alert {
+	code, ok := err.(protocol.ErrorCode)
+	if err == nil || ok && code < protocol.CheckBadSignature {
+		return nil
+	}
+	a := &Alert{
+		Kind:     CheckFailed,
+		Severity: Warning,
+		Time:     time.Now(),
+		Epoch:    epoch,
+		Name:     name,
+		Message:  err.Error(),
+		Err:      err,
+	}
+	switch err {
+	case protocol.CheckBadSTR:
+		a.Kind, a.Severity = Equivocation, Critical
+	case protocol.CheckBadSignature:
+		a.Kind, a.Severity = BadSignature, Critical
+	case protocol.CheckBrokenPromise:
+		a.Kind, a.Severity = BrokenPromise, Critical
+	case protocol.CheckEarlyKeyChange, protocol.CheckEarlyReregistration:
+		a.Kind, a.Severity = KeyChange, Critical
+	case protocol.CheckCapabilityDowngrade, protocol.CheckBadUpgrade, protocol.CheckBadBindingEpochs,
+		protocol.CheckBadPolicySchedule, protocol.CheckBadApproval, protocol.CheckBadKeyRotation:
+		a.Severity = Critical
+	case protocol.CheckBindingsDiffer:
+		a.Kind = KeyChange
+	}
+	return a
+}
+
+// Summary returns a one-line human-readable description of a.
+func (a *Alert) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", a.Severity, a.Kind)
+	if a.Directory != "" {
+		fmt.Fprintf(&b, " directory=%s", a.Directory)
+	}
+	fmt.Fprintf(&b, " epoch=%d", a.Epoch)
+	if a.Name != "" {
+		fmt.Fprintf(&b, " name=%q", a.Name)
+	}
+	if a.Message != "" {
+		fmt.Fprintf(&b, ": %s", a.Message)
+	}
+	return b.String()
+}
+
+type jsonAlert struct {
+	Kind      string           `json:"kind"`
+	Severity  string           `json:"severity"`
+	Time      time.Time        `json:"time"`
+	Directory string           `json:"directory,omitempty"`
+	Epoch     merkletree.Epoch `json:"epoch"`
+	Name      string           `json:"name,omitempty"`
+	Message   string           `json:"message,omitempty"`
+	Err       string           `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes a with its kind and severity as strings.
+func (a *Alert) MarshalJSON() ([]byte, error) {
+	j := jsonAlert{
+		Kind:      a.Kind.String(),
+		Severity:  a.Severity.String(),
+		Time:      a.Time,
+		Directory: a.Directory,
+		Epoch:     a.Epoch,
+		Name:      a.Name,
+		Message:   a.Message,
+	}
+	if a.Err != nil {
+		j.Err = a.Err.Error()
+	}
+	return json.Marshal(j)
+}
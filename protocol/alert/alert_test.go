@@ -0,0 +1,129 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestFromCheck(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		wantNil  bool
+		kind     Kind
+		severity Severity
+	}{
+		{nil, true, 0, 0},
+		{protocol.ReqNameNotFound, true, 0, 0},
+		{protocol.ErrMalformedMessage, true, 0, 0},
+		{protocol.CheckBadSTR, false, Equivocation, Critical},
+		{protocol.CheckBadSignature, false, BadSignature, Critical},
+		{protocol.CheckBrokenPromise, false, BrokenPromise, Critical},
+		{protocol.CheckBindingsDiffer, false, KeyChange, Warning},
+		{protocol.CheckBadAuthPath, false, CheckFailed, Warning},
+		{errors.New("other"), false, CheckFailed, Warning},
+	} {
+		a := FromCheck(tc.err, 3, "alice")
+		if (a == nil) != tc.wantNil {
+			t.Errorf("FromCheck(%v) = %v", tc.err, a)
+			continue
+		}
+		if a != nil && (a.Kind != tc.kind || a.Severity != tc.severity || a.Epoch != 3 || a.Name != "alice") {
+			t.Errorf("FromCheck(%v) = %+v", tc.err, a)
+		}
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := &LogSink{W: &buf}
+	if err := s.Send(FromCheck(protocol.CheckBadSTR, 1, "")); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["kind"] != "equivocation" || got["severity"] != "critical" {
+		t.Error("Unexpected log line", buf.String())
+	}
+
+	buf.Reset()
+	s.Plain = true
+	if err := s.Send(FromCheck(protocol.CheckBrokenPromise, 1, "bob")); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "[critical] broken-promise epoch=1 name=\"bob\"") {
+		t.Error("Unexpected log line", buf.String())
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		got, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := &WebhookSink{URL: srv.URL}
+	if err := s.Send(FromCheck(protocol.CheckBadSTR, 1, "")); err == nil {
+		t.Error("Expect an error for a 403 response")
+	}
+	s.Header = http.Header{"Authorization": {"secret"}}
+	if err := s.Send(FromCheck(protocol.CheckBadSTR, 1, "")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(got, []byte(`"kind":"equivocation"`)) {
+		t.Error("Unexpected webhook payload", string(got))
+	}
+}
+
+func TestSMTPSink(t *testing.T) {
+	var gotTo []string
+	var gotMsg []byte
+	s := &SMTPSink{
+		Addr: "mail.example.com:25",
+		From: "auditor@example.com",
+		To:   []string{"ops@example.com"},
+		sendMail: func(addr string, _ smtp.Auth, from string, to []string, msg []byte) error {
+			gotTo, gotMsg = to, msg
+			return nil
+		},
+	}
+	if err := s.Send(FromCheck(protocol.CheckBindingsDiffer, 7, "carol")); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotTo) != 1 || gotTo[0] != "ops@example.com" {
+		t.Error("Unexpected recipients", gotTo)
+	}
+	if !bytes.Contains(gotMsg, []byte("Subject: [coniks] [warning] key-change epoch=7")) {
+		t.Error("Unexpected message", string(gotMsg))
+	}
+}
+
+func TestMulti(t *testing.T) {
+	var n int
+	count := SinkFunc(func(*Alert) error { n++; return nil })
+	fail := SinkFunc(func(*Alert) error { return errors.New("fail") })
+	if err := Multi(count, fail, count).Send(&Alert{}); err == nil {
+		t.Error("Expect an error")
+	}
+	if n != 2 {
+		t.Error("Expect all sinks to be tried, got", n)
+	}
+	if err := Send(nil, &Alert{}); err != nil {
+		t.Error(err)
+	}
+}
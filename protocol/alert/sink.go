@@ -0,0 +1,156 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Sink delivers alerts.
+type Sink interface {
+	Send(a *Alert) error
+}
+
+// SinkFunc adapts an ordinary function to the Sink interface.
+type SinkFunc func(a *Alert) error
+
+// Send calls f(a).
+func (f SinkFunc) Send(a *Alert) error {
+	return f(a)
+}
+
+// Send delivers a to s if both are non-nil. It is a convenience for
+// components with an optional Sink.
+func Send(s Sink, a *Alert) error {
+	if s == nil || a == nil {
+		return nil
+	}
+	return s.Send(a)
+}
+
+// Multi returns a Sink that delivers alerts to all sinks. Its Send()
+// tries every sink and returns the first error encountered.
+func Multi(sinks ...Sink) Sink {
+	return SinkFunc(func(a *Alert) error {
+		var firstErr error
+		for _, s := range sinks {
+			if err := s.Send(a); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	})
+}
+
+// LogSink writes alerts as JSON lines (or, if Plain is set, as
+// one-line summaries) to W. It is safe for concurrent use.
+type LogSink struct {
+	W     io.Writer
+	Plain bool
+	mu    sync.Mutex
+}
+
+// NewStderrSink returns a LogSink writing structured alerts to os.Stderr.
+func NewStderrSink() *LogSink {
+	return &LogSink{W: os.Stderr}
+}
+
+// Send writes a to s.W.
+func (s *LogSink) Send(a *Alert) error {
+	var line []byte
+	if s.Plain {
+		line = []byte(a.Summary())
+	} else {
+		var err error
+		if line, err = json.Marshal(a); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.W.Write(append(line, '\n'))
+	return err
+}
+
+// WebhookSink POSTs alerts as JSON to URL.
+type WebhookSink struct {
+	URL string
+	// Header is added to every request, e.g. for authorization.
+	Header http.Header
+	// Client is used to send the requests. If nil, a client with a
+	// 10 second timeout is used.
+	Client *http.Client
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Send POSTs a to s.URL. It returns an error if the request fails
+// or the response status isn't 2xx.
+func (s *WebhookSink) Send(a *Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vs := range s.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("[alert] webhook %s returned %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// SMTPSink emails alerts to To via the SMTP server at Addr (host:port).
+type SMTPSink struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+	To   []string
+
+	// sendMail is smtp.SendMail; tests replace it.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// Send emails a summary of a and its JSON encoding.
+func (s *SMTPSink) Send(a *Alert) error {
+	body, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [coniks] %s\r\n", a.Summary())
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(body)
+	msg.WriteString("\r\n")
+
+	send := s.sendMail
+	if send == nil {
+		send = smtp.SendMail
+	}
+	return send(s.Addr, s.Auth, s.From, s.To, msg.Bytes())
+}
@@ -0,0 +1,320 @@
+// This module implements a persistent archive of the directory proofs
+// a CONIKS client verified. Every proof is stored compressed, with the
+// time it was verified, so that the user can later demonstrate exactly
+// what the directory served them, e.g. in a dispute about a key the
+// directory claims they registered.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/client"
+)
+
+var (
+	// ErrNotAProof indicates that a response doesn't contain a
+	// directory proof, and can't be archived.
+	ErrNotAProof = errors.New("[archive] The response doesn't contain a directory proof")
+	// ErrMalformedEntry indicates that an archived proof couldn't be
+	// decoded.
+	ErrMalformedEntry = errors.New("[archive] Malformed archive entry")
+	// ErrBadSignature indicates that an exported proof contains an STR or
+	// a temporary binding that isn't signed with the directory's key.
+	ErrBadSignature = errors.New("[archive] Invalid signature in exported proof")
+)
+
+// An Entry is a proof that the client verified.
+type Entry struct {
+	// Time is when the proof was verified.
+	Time time.Time
+	// Type is the type of the request the proof answered,
+	// e.g. directory.KeyLookupType.
+	Type     int
+	Username string
+	Error    protocol.ErrorCode
+	Proof    *directory.DirectoryProof
+}
+
+// Epoch returns the latest epoch e's proof is for.
+func (e *Entry) Epoch() merkletree.Epoch {
+	if len(e.Proof.STR) == 0 {
+		return 0
+	}
+	return e.Proof.STR[len(e.Proof.STR)-1].Epoch
+}
+
+// A Policy determines which entries Prune removes. Zero values mean no
+// limit.
+type Policy struct {
+	// MaxAge is how long entries are kept.
+	MaxAge time.Duration
+	// MaxEntries is the number of entries kept; the oldest ones are
+	// removed first.
+	MaxEntries int
+}
+
+// A Filter selects archived entries. Zero values match everything.
+type Filter struct {
+	Username string
+	// Since and Until bound the time an entry was verified, inclusive.
+	Since, Until time.Time
+}
+
+func (f *Filter) match(e *Entry) bool {
+	return (f.Username == "" || f.Username == e.Username) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || !e.Time.After(f.Until))
+}
+
+// An Archive stores proofs in a LevelDB database, ordered by the time
+// they were verified. Each entry is stored as gzip-compressed JSON.
+// An Archive is safe for concurrent use.
+type Archive struct {
+	Policy Policy
+
+	db  *leveldb.DB
+	mu  sync.Mutex
+	seq uint64
+	now func() time.Time
+}
+
+var _ client.Archiver = (*Archive)(nil)
+
+// Open opens the archive in the directory path, creating it if needed,
+// and prunes it according to policy.
+func Open(path string, policy Policy) (*Archive, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{Policy: policy, db: db}
+	if _, err := a.Prune(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close closes the archive.
+func (a *Archive) Close() error {
+	return a.db.Close()
+}
+
+func (a *Archive) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+// entryKey orders entries by time. seq keeps entries added in the same
+// nanosecond apart.
+func entryKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// Archive stores msg, a verified response to a request of type
+// requestType for uname. It implements client.Archiver.
+func (a *Archive) Archive(requestType int, uname string, msg *directory.Response) error {
+	df, ok := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if !ok {
+		return ErrNotAProof
+	}
+	return a.Add(&Entry{
+		Time:     a.clock(),
+		Type:     requestType,
+		Username: uname,
+		Error:    msg.Error,
+		Proof:    df,
+	})
+}
+
+// Add stores e.
+func (a *Archive) Add(e *Entry) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(e); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.seq++
+	k := entryKey(e.Time, a.seq)
+	a.mu.Unlock()
+	return a.db.Put(k, buf.Bytes(), nil)
+}
+
+func decodeEntry(v []byte) (*Entry, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return nil, ErrMalformedEntry
+	}
+	bs, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, ErrMalformedEntry
+	}
+	var e Entry
+	if err := json.Unmarshal(bs, &e); err != nil {
+		return nil, ErrMalformedEntry
+	}
+	if err := e.check(); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// check checks that a decoded entry is well-formed, i.e. that it has
+// an STR for every authentication path.
+func (e *Entry) check() error {
+	if e.Proof == nil || len(e.Proof.AP) != len(e.Proof.STR) {
+		return ErrMalformedEntry
+	}
+	for i, str := range e.Proof.STR {
+		if e.Proof.AP[i] == nil || e.Proof.AP[i].Leaf == nil ||
+			str == nil || str.SignedTreeRoot == nil || str.Policies == nil {
+			return ErrMalformedEntry
+		}
+	}
+	return nil
+}
+
+// Entries returns the archived entries that match f, oldest first.
+func (a *Archive) Entries(f Filter) ([]*Entry, error) {
+	var r util.Range
+	if !f.Since.IsZero() {
+		r.Start = entryKey(f.Since, 0)
+	}
+	if !f.Until.IsZero() {
+		r.Limit = entryKey(f.Until.Add(time.Nanosecond), 0)
+	}
+	it := a.db.NewIterator(&r, nil)
+	defer it.Release()
+	var es []*Entry
+	for it.Next() {
+		e, err := decodeEntry(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if f.match(e) {
+			es = append(es, e)
+		}
+	}
+	return es, it.Error()
+}
+
+// Prune removes the entries that are older than a.Policy.MaxAge, and
+// then the oldest entries in excess of a.Policy.MaxEntries. It returns
+// the number of entries removed.
+func (a *Archive) Prune() (int, error) {
+	var keys [][]byte
+	it := a.db.NewIterator(nil, nil)
+	for it.Next() {
+		keys = append(keys, append([]byte(nil), it.Key()...))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+
+	drop := 0
+	if a.Policy.MaxAge > 0 {
+		cutoff := entryKey(a.clock().Add(-a.Policy.MaxAge), 0)
+		for drop < len(keys) && bytes.Compare(keys[drop], cutoff) < 0 {
+			drop++
+		}
+	}
+	if max := a.Policy.MaxEntries; max > 0 && len(keys)-drop > max {
+		drop = len(keys) - max
+	}
+	if drop == 0 {
+		return 0, nil
+	}
+	batch := new(leveldb.Batch)
+	for _, k := range keys[:drop] {
+		batch.Delete(k)
+	}
+	return drop, a.db.Write(batch, nil)
+}
+
+// A Bundle is a self-contained export of archived proofs, which anybody
+// can check with the directory's public signing key.
+type Bundle struct {
+	// SignKey is the public signing key the bundle claims the directory
+	// has. It only identifies the directory; Verify checks the proofs
+	// against a key the verifier trusts instead.
+	SignKey sign.PublicKey
+	Entries []*Entry
+}
+
+// Export writes the entries matching f to w as a JSON-encoded Bundle.
+func (a *Archive) Export(w io.Writer, signKey sign.PublicKey, f Filter) error {
+	es, err := a.Entries(f)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(&Bundle{SignKey: signKey, Entries: es})
+}
+
+// ReadBundle decodes a bundle written by Export.
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	var b Bundle
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return nil, err
+	}
+	for _, e := range b.Entries {
+		if e == nil {
+			return nil, ErrMalformedEntry
+		}
+		if err := e.check(); err != nil {
+			return nil, err
+		}
+	}
+	return &b, nil
+}
+
+// Verify checks that every STR in the bundle is signed with signKey, the
+// directory's public signing key, which the verifier must obtain
+// independently of the bundle, that every authentication path is valid
+// for the STR of the same epoch, and that every temporary binding is
+// signed with signKey too. It returns the index of the first entry that
+// fails, and the error.
+func (b *Bundle) Verify(signKey sign.PublicKey) (int, error) {
+	for i, e := range b.Entries {
+		for j, str := range e.Proof.STR {
+			if !signKey.Verify(str.Bytes(), str.Signature[:]) {
+				return i, ErrBadSignature
+			}
+			if err := client.VerifyAuthPath(e.Username, nil, e.Proof.AP[j], str); err != nil {
+				return i, err
+			}
+		}
+		if tb := e.Proof.TB; tb != nil && len(e.Proof.STR) > 0 {
+			str := e.Proof.STR[len(e.Proof.STR)-1]
+			if !signKey.Verify(tb.Bytes(str.Signature), tb.Signature[:]) {
+				return i, ErrBadSignature
+			}
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,164 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/client"
+)
+
+var signKey = crypto.NewStaticTestSigningKey()
+
+// clock is a fake clock that advances by a minute whenever it's read.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time {
+	c.t = c.t.Add(time.Minute)
+	return c.t
+}
+
+// archived returns an archive with the proofs for registering alice
+// and bob and looking up alice in the next epoch, verified by a client
+// that archives them.
+func archived(t *testing.T, policy Policy) (*Archive, *clock) {
+	a, err := Open(t.TempDir(), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	c := &clock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a.now = c.now
+
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), signKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := client.New(d.LatestSTR(), true, signKey.Public())
+	cc.Archive = a
+	for _, name := range []string{"alice", "bob"} {
+		resp, err := d.Register(name, []byte(name+"'s key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), name, []byte(name+"'s key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Update()
+	msg := d.KeyLookup(&directory.KeyLookupRequest{Username: "alice"})
+	if err := cc.HandleResponse(directory.KeyLookupType, msg, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	return a, c
+}
+
+func TestArchive(t *testing.T) {
+	a, c := archived(t, Policy{})
+	es, err := a.Entries(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 3 {
+		t.Fatal("Expect 3 entries, got", len(es))
+	}
+	if es[0].Username != "alice" || es[0].Type != directory.RegistrationType || es[0].Proof.TB == nil ||
+		es[2].Type != directory.KeyLookupType || es[2].Epoch() != 1 || es[2].Error != protocol.ReqSuccess {
+		t.Fatalf("Unexpected entries %+v %+v", es[0], es[2])
+	}
+	if !es[0].Time.Before(es[1].Time) {
+		t.Error("Expect entries in the order they were verified")
+	}
+
+	es, err = a.Entries(Filter{Username: "alice"})
+	if err != nil || len(es) != 2 {
+		t.Fatal("Expect 2 entries for alice, got", len(es), err)
+	}
+	es, err = a.Entries(Filter{Since: c.t, Until: c.t})
+	if err != nil || len(es) != 1 || es[0].Type != directory.KeyLookupType {
+		t.Fatal("Expect the lookup only, got", es, err)
+	}
+}
+
+func TestArchivePrune(t *testing.T) {
+	// the entries are 3, 2 and 1 minutes old when Prune reads the clock
+	a, _ := archived(t, Policy{})
+	a.Policy = Policy{MaxAge: 90 * time.Second}
+	if n, err := a.Prune(); err != nil || n != 2 {
+		t.Fatal("Expect 2 entries to be pruned, got", n, err)
+	}
+
+	a, _ = archived(t, Policy{MaxEntries: 1})
+	if n, err := a.Prune(); err != nil || n != 2 {
+		t.Fatal("Expect 2 entries to be pruned, got", n, err)
+	}
+	es, err := a.Entries(Filter{})
+	if err != nil || len(es) != 1 || es[0].Type != directory.KeyLookupType {
+		t.Fatal("Expect the lookup to be kept, got", es, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	a, _ := archived(t, Policy{})
+	var buf bytes.Buffer
+	if err := a.Export(&buf, signKey.Public(), Filter{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.Bytes()
+
+	b, err := ReadBundle(bytes.NewReader(exported))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Entries) != 2 {
+		t.Fatal("Expect 2 entries, got", len(b.Entries))
+	}
+	if i, err := b.Verify(signKey.Public()); err != nil {
+		t.Fatal("Entry", i, err)
+	}
+
+	// a bundle claiming a different key for alice
+	b, _ = ReadBundle(bytes.NewReader(exported))
+	b.Entries[1].Proof.AP[0].Leaf.Value = []byte("evil")
+	if i, err := b.Verify(signKey.Public()); i != 1 || err != protocol.CheckBadCommitment {
+		t.Error("Expect", protocol.CheckBadCommitment, "for entry 1, got", i, err)
+	}
+
+	b, _ = ReadBundle(bytes.NewReader(exported))
+	b.Entries[0].Proof.TB.Value = []byte("evil")
+	if i, err := b.Verify(signKey.Public()); i != 0 || err != ErrBadSignature {
+		t.Error("Expect", ErrBadSignature, "for entry 0, got", i, err)
+	}
+
+	// a bundle re-signed by a forger, which claims that the forger's key
+	// is the directory's
+	evilKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ReadBundle(bytes.NewReader(exported))
+	b.SignKey = evilKey.Public()
+	for _, e := range b.Entries {
+		for _, str := range e.Proof.STR {
+			copy(str.Signature[:], evilKey.Sign(str.Bytes()))
+		}
+		if tb := e.Proof.TB; tb != nil {
+			str := e.Proof.STR[len(e.Proof.STR)-1]
+			copy(tb.Signature[:], evilKey.Sign(tb.Bytes(str.Signature)))
+		}
+	}
+	if i, err := b.Verify(evilKey.Public()); err != nil {
+		t.Fatal("Expect the forged bundle to verify with the forger's key, got entry", i, err)
+	}
+	if i, err := b.Verify(signKey.Public()); i != 0 || err != ErrBadSignature {
+		t.Error("Expect", ErrBadSignature, "for entry 0, got", i, err)
+	}
+
+	if _, err := ReadBundle(bytes.NewReader([]byte(`{"Entries":[{}]}`))); err != ErrMalformedEntry {
+		t.Error("Expect", ErrMalformedEntry, "got", err)
+	}
+}
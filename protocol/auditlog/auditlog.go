@@ -6,17 +6,33 @@
 package auditlog
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ORBAT/cloniks/chain"
 	"github.com/ORBAT/cloniks/crypto/hashed"
 	"github.com/ORBAT/cloniks/crypto/sign"
 	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
 	"github.com/ORBAT/cloniks/protocol"
 	"github.com/ORBAT/cloniks/protocol/auditor"
 )
 
+// ErrArchive indicates that the merkletree.STRStore of a directory
+// history failed to archive a verified STR.
+var ErrArchive = errors.New("[auditlog] Could not archive the STR")
+
 type directoryHistory struct {
 	*auditor.AudState
 	addr      string
-	snapshots map[uint64]*directory.SignedTreeRoot
+	signKey   sign.PublicKey
+	snapshots map[merkletree.Epoch]*directory.SignedTreeRoot
+	chain     *chain.Chain // the links of the snapshots
+	// store archives the snapshots, if the history was initialized
+	// with InitHistoryWithStore.
+	store merkletree.STRStore
 }
 
 // A ConiksAuditLog maintains the histories
@@ -29,7 +45,7 @@ type directoryHistory struct {
 // chronological order.
 type ConiksAuditLog map[[hashed.HashSizeByte]byte]*directoryHistory
 
-// caller validates that initSTR is for epoch 0.
+// caller validates that initSTR is a genesis STR.
 func newDirectoryHistory(addr string,
 	signKey sign.PublicKey,
 	initSTR *directory.SignedTreeRoot) *directoryHistory {
@@ -37,26 +53,46 @@ func newDirectoryHistory(addr string,
 	h := &directoryHistory{
 		AudState:  a,
 		addr:      addr,
-		snapshots: make(map[uint64]*directory.SignedTreeRoot),
+		signKey:   signKey,
+		snapshots: make(map[merkletree.Epoch]*directory.SignedTreeRoot),
+		chain:     chain.New(initSTR.Link()),
 	}
 	h.updateVerifiedSTR(initSTR)
 	return h
 }
 
 // updateVerifiedSTR inserts the latest verified STR into a directory
-// history; assumes the STRs have been validated by the caller.
-func (h *directoryHistory) updateVerifiedSTR(newVerified *directory.SignedTreeRoot) {
+// history; assumes the STRs have been validated by the caller, except
+// that it returns the error of chain.Chain.Append, and leaves h
+// unchanged, if newVerified doesn't extend the hash chain of h. If h has
+// a store, newVerified is archived in it first, and if that fails,
+// updateVerifiedSTR returns an ErrArchive and leaves h unchanged too.
+func (h *directoryHistory) updateVerifiedSTR(newVerified *directory.SignedTreeRoot) error {
+	link := newVerified.Link()
+	if h.store != nil && chain.Follows(h.chain.Head(), link) {
+		if err := h.store.Append(newVerified.SignedTreeRoot); err != nil {
+			return fmt.Errorf("%w: %v", ErrArchive, err)
+		}
+	}
+	if err := h.chain.Append(link); err != nil {
+		return err
+	}
 	h.Update(newVerified)
 	h.snapshots[newVerified.Epoch] = newVerified
+	return nil
 }
 
 // insertRange inserts the given range of STRs snaps
-// into the directoryHistory h.
+// into the directoryHistory h, up to the first one that doesn't
+// extend its hash chain, whose error it returns.
 // insertRange() assumes that snaps has been audited by Audit().
-func (h *directoryHistory) insertRange(snaps []*directory.SignedTreeRoot) {
+func (h *directoryHistory) insertRange(snaps []*directory.SignedTreeRoot) error {
 	for i := 0; i < len(snaps); i++ {
-		h.updateVerifiedSTR(snaps[i])
+		if err := h.updateVerifiedSTR(snaps[i]); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // Audit checks that a directory's STR history
@@ -86,7 +122,12 @@ func (h *directoryHistory) Audit(msg *directory.Response) error {
 	// TODO: we should be storing inconsistent STRs nonetheless
 	// so clients can detect inconsistencies -- or auditors
 	// should blow the whistle and not store the bad STRs
-	h.insertRange(strs.STR)
+	if err := h.insertRange(strs.STR); err != nil {
+		if errors.Is(err, ErrArchive) {
+			return err
+		}
+		return protocol.CheckBadSTR
+	}
 
 	return nil
 }
@@ -123,36 +164,146 @@ func (l ConiksAuditLog) get(dirInitHash [hashed.HashSizeByte]byte) (*directoryHi
 // containing the pinned initial STR as well as the saved directory's
 // STR history so far, in chronological order.
 // InitHistory() returns an ErrAuditLog if the auditor attempts to create
-// a new history for a known directory, and nil otherwise.
+// a new history for a known directory, a CheckBadSTR if snaps don't form
+// a hash chain, and nil otherwise.
 func (l ConiksAuditLog) InitHistory(addr string, signKey sign.PublicKey,
 	snaps []*directory.SignedTreeRoot) error {
+	dirInitHash, h, err := l.restoreHistory(addr, signKey, snaps)
+	if err != nil {
+		return err
+	}
+	l.set(dirInitHash, h)
+	return nil
+}
+
+// InitHistoryWithStore is like InitHistory, but it archives the
+// directory's STR history in store, so that it survives restarts of the
+// auditor. The history is initialized with the STRs already in store,
+// e.g. those archived before the auditor restarted, followed by snaps,
+// which must continue them, and may then be empty. The STRs of snaps,
+// and every STR the history is updated with later, are appended to
+// store. The STRs of store are restored with directory.NewDirSTR, so
+// a store that serializes them must parse their policies with the
+// decoder registered for directory.ConfigType, like strdb does.
+// Besides the errors of InitHistory, InitHistoryWithStore() returns
+// the error of store if it fails to load the STRs, and an ErrArchive
+// if it fails to append them.
+func (l ConiksAuditLog) InitHistoryWithStore(addr string, signKey sign.PublicKey,
+	snaps []*directory.SignedTreeRoot, store merkletree.STRStore) error {
+	var archived []*directory.SignedTreeRoot
+	switch latest, err := store.Latest(); err {
+	case nil:
+		strs, err := store.Range(0, latest.Epoch)
+		if err != nil {
+			return err
+		}
+		for _, str := range strs {
+			archived = append(archived, directory.NewDirSTR(str))
+		}
+	case merkletree.ErrSTRNotFound:
+	default:
+		return err
+	}
+
+	all := append(archived, snaps...)
+	dirInitHash, h, err := l.restoreHistory(addr, signKey, all)
+	if err != nil {
+		return err
+	}
+	for _, str := range all[len(archived):] {
+		if err := store.Append(str.SignedTreeRoot); err != nil {
+			return fmt.Errorf("%w: %v", ErrArchive, err)
+		}
+	}
+	h.store = store
+	l.set(dirInitHash, h)
+	return nil
+}
+
+// restoreHistory creates the directory history that InitHistory inserts
+// into l, and returns it with the directory's identifier.
+func (l ConiksAuditLog) restoreHistory(addr string, signKey sign.PublicKey,
+	snaps []*directory.SignedTreeRoot) ([hashed.HashSizeByte]byte, *directoryHistory, error) {
 	// make sure we're getting an initial STR at the very least
-	if len(snaps) < 1 || snaps[0].Epoch != 0 {
-		return protocol.ErrMalformedMessage
+	if len(snaps) < 1 {
+		return [hashed.HashSizeByte]byte{}, nil, protocol.ErrMalformedMessage
 	}
 
-	// compute the hash of the initial STR
-	dirInitHash := auditor.ComputeDirectoryIdentity(snaps[0])
+	// compute the hash of the initial STR, which must be the
+	// directory's genesis STR
+	dirInitHash, err := auditor.ComputeDirectoryIdentity(snaps[0])
+	if err != nil {
+		return dirInitHash, nil, err
+	}
 
 	// error if we want to create a new entry for a directory
 	// we already know
 	h, ok := l.get(dirInitHash)
 	if ok {
-		return protocol.ErrAuditLog
+		return dirInitHash, nil, protocol.ErrAuditLog
 	}
 
 	// create the new directory history
 	h = newDirectoryHistory(addr, signKey, snaps[0])
 
-	// TODO: re-verify all snaps although auditor should have
-	// already done so in the past? After all, if we have
-	// more than one snapshot, this means that the auditor is
-	// re-initializing its state from disk, and it wouldn't have
-	// saved those STRs if they didn't pass the Audit() checks.
-	h.insertRange(snaps[1:])
-	l.set(dirInitHash, h)
+	// The saved snaps must still be validly signed, following the
+	// rotations of the signing key, and form a hash chain, which catches
+	// a history corrupted on disk.
+	if err := h.VerifySTRRange(snaps[0], snaps[1:]); err != nil {
+		return dirInitHash, nil, err
+	}
+	if err := h.insertRange(snaps[1:]); err != nil {
+		return dirInitHash, nil, protocol.CheckBadSTR
+	}
+	return dirInitHash, h, nil
+}
 
-	return nil
+// InitFromIdentity creates a new directory history for the directory
+// with the identity id, e.g. learned from another auditor (see
+// GetDirectories), and inserts it into the audit log l, so that the
+// auditor starts auditing the directory from its initial STR.
+// InitFromIdentity() returns the error of id.Verify() if id is invalid,
+// and an ErrAuditLog if the directory is already known.
+func (l ConiksAuditLog) InitFromIdentity(id *directory.DirectoryIdentity) error {
+	if err := id.Verify(); err != nil {
+		return err
+	}
+	return l.InitHistory(id.Addr, id.SignKey, []*directory.SignedTreeRoot{id.InitSTR})
+}
+
+// GetDirectories returns the identities of all directories in the log,
+// ordered by address, in response to the DirectoriesRequest req received
+// from another CONIKS auditor.
+func (l ConiksAuditLog) GetDirectories(req *directory.DirectoriesRequest) *directory.Response {
+	ids := make([]*directory.DirectoryIdentity, 0, len(l))
+	for _, h := range l {
+		ids = append(ids, &directory.DirectoryIdentity{
+			Addr:    h.addr,
+			SignKey: h.signKey,
+			InitSTR: h.snapshots[0],
+		})
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Addr != ids[j].Addr {
+			return ids[i].Addr < ids[j].Addr
+		}
+		a, b := ids[i].ID(), ids[j].ID()
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+	return directory.NewDirectoryIdentitiesResponse(ids)
+}
+
+// Audit audits the STRs in msg, received from the CONIKS directory
+// with the identifier dirInitHash, and appends them to the directory's
+// history if the checks pass. See directoryHistory.Audit() for details.
+// Audit() returns a ReqUnknownDirectory if the log doesn't contain
+// a history for dirInitHash.
+func (l ConiksAuditLog) Audit(dirInitHash [hashed.HashSizeByte]byte, msg *directory.Response) error {
+	h, ok := l.get(dirInitHash)
+	if !ok {
+		return protocol.ReqUnknownDirectory
+	}
+	return h.Audit(msg)
 }
 
 // GetObservedSTRs gets a range of observed STRs for the CONIKS directory
@@ -192,3 +343,75 @@ func (l ConiksAuditLog) GetObservedSTRs(req *directory.AuditingRequest) *directo
 
 	return directory.NewSTRHistoryRange(strs)
 }
+
+// AttestRollup checks the Rollup r of the CONIKS directory identified
+// by r.DirInitSTRHash against the directory's history in the log, and
+// returns the log's Attestation of r, signed with the auditor's signing
+// key key, if r is consistent with it: the directory must have signed
+// r, r.STR must be the STR the log observed for its epoch, and
+// r.ListRoot must be the root of the merkletree.STRList of the observed
+// STRs for epochs 0 through r.STR.Epoch.
+//
+// AttestRollup returns a ReqUnknownDirectory if the log doesn't contain
+// a history for the directory, an ErrMalformedMessage if the log hasn't
+// observed r.STR's epoch yet, a CheckBadSignature if the directory's
+// signature of r is invalid, and a CheckBadSTR if r is inconsistent
+// with the history.
+func (l ConiksAuditLog) AttestRollup(r *directory.Rollup, key sign.Signer) (*directory.Attestation, error) {
+	h, ok := l.get(r.DirInitSTRHash)
+	if !ok {
+		return nil, protocol.ReqUnknownDirectory
+	}
+	if r.STR == nil || r.STR.Epoch > h.VerifiedSTR().Epoch {
+		return nil, protocol.ErrMalformedMessage
+	}
+	if !h.Verify(r.Bytes(), r.Signature[:]) {
+		return nil, protocol.CheckBadSignature
+	}
+	if str := h.snapshots[r.STR.Epoch]; str.Signature != r.STR.Signature ||
+		!bytes.Equal(str.Bytes(), r.STR.Bytes()) {
+		return nil, protocol.CheckBadSTR
+	}
+
+	var list merkletree.STRList
+	for ep := merkletree.Epoch(0); ep <= r.STR.Epoch; ep++ {
+		list.Append(h.snapshots[ep].SignedTreeRoot)
+	}
+	if list.Root() != r.ListRoot {
+		return nil, protocol.CheckBadSTR
+	}
+	return attest(key, r.AttestationBytes()), nil
+}
+
+// AttestSTR returns the log's Attestation of the STR str of the CONIKS
+// directory identified by dirInitHash, signed with the auditor's signing
+// key key, if str is the STR the log observed for its epoch. Clients
+// that don't check the directory's STR history themselves, such as
+// a client.LightClient, accept str if enough auditors attested to it.
+//
+// AttestSTR returns a ReqUnknownDirectory if the log doesn't contain
+// a history for the directory, an ErrMalformedMessage if the log hasn't
+// observed str's epoch yet, and a CheckBadSTR if the log observed
+// a different STR for it.
+func (l ConiksAuditLog) AttestSTR(dirInitHash [hashed.HashSizeByte]byte, str *directory.SignedTreeRoot,
+	key sign.Signer) (*directory.Attestation, error) {
+	h, ok := l.get(dirInitHash)
+	if !ok {
+		return nil, protocol.ReqUnknownDirectory
+	}
+	if str.Epoch > h.VerifiedSTR().Epoch {
+		return nil, protocol.ErrMalformedMessage
+	}
+	if observed := h.snapshots[str.Epoch]; observed.Signature != str.Signature ||
+		!bytes.Equal(observed.Bytes(), str.Bytes()) {
+		return nil, protocol.CheckBadSTR
+	}
+	return attest(key, str.AttestationBytes()), nil
+}
+
+// attest signs msg with the auditor's signing key key.
+func attest(key sign.Signer, msg []byte) *directory.Attestation {
+	var sig sign.Signature
+	copy(sig[:], key.Sign(msg))
+	return &directory.Attestation{Auditor: key.Public(), Signature: sig}
+}
@@ -4,7 +4,9 @@ import (
 	"testing"
 
 	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
 	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
 	"github.com/ORBAT/cloniks/protocol"
 	"github.com/ORBAT/cloniks/protocol/auditor"
 )
@@ -19,7 +21,7 @@ func TestUpdateHistory(t *testing.T) {
 	d, aud, hist := NewTestAuditLog(t, 0)
 
 	// update the directory so we can update the audit log
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	d.Update()
 	h, _ := aud.get(dirInitHash)
 	resp := directory.NewSTRHistoryRange([]*directory.SignedTreeRoot{d.LatestSTR()})
@@ -31,11 +33,45 @@ func TestUpdateHistory(t *testing.T) {
 	}
 }
 
+func TestAuditUnknownDirectory(t *testing.T) {
+	d, aud, _ := NewTestAuditLog(t, 0)
+	resp := directory.NewSTRHistoryRange([]*directory.SignedTreeRoot{d.LatestSTR()})
+	if err := aud.Audit([hashed.HashSizeByte]byte{}, resp); err != protocol.ReqUnknownDirectory {
+		t.Fatal("Expect", protocol.ReqUnknownDirectory, "got", err)
+	}
+}
+
 func TestInsertPriorHistory(t *testing.T) {
 	// create basic test directory and audit log with 11 STRs
 	NewTestAuditLog(t, 10)
 }
 
+func TestInsertBrokenHistory(t *testing.T) {
+	d := directory.NewTestTree(t)
+	snaps := []*directory.SignedTreeRoot{d.LatestSTR()}
+	for i := 0; i < 3; i++ {
+		d.Update()
+		snaps = append(snaps, d.LatestSTR())
+	}
+	forged := *snaps[2].SignedTreeRoot
+	forged.Signature[0]++
+	for _, tc := range []struct {
+		name  string
+		snaps []*directory.SignedTreeRoot
+		want  error
+	}{
+		{"gap", []*directory.SignedTreeRoot{snaps[0], snaps[1], snaps[3]}, protocol.CheckBadSTR},
+		{"reordered", []*directory.SignedTreeRoot{snaps[0], snaps[2], snaps[1]}, protocol.CheckBadSTR},
+		{"bad signature", []*directory.SignedTreeRoot{snaps[0], snaps[1], directory.NewDirSTR(&forged)},
+			protocol.CheckBadSignature},
+	} {
+		err := New().InitHistory("test-server", staticSigningKey.Public(), tc.snaps)
+		if err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
 func TestInsertExistingHistory(t *testing.T) {
 	// create basic test directory and audit log with 1 STR
 	_, aud, hist := NewTestAuditLog(t, 0)
@@ -55,8 +91,8 @@ func TestAuditLogBadEpochRange(t *testing.T) {
 	d.Update()
 
 	resp := d.GetSTRHistory(&directory.STRHistoryRequest{
-		StartEpoch: uint64(0),
-		EndEpoch:   uint64(1)})
+		StartEpoch: 0,
+		EndEpoch:   1})
 
 	if resp.Error != protocol.ReqSuccess {
 		t.Fatalf("Error occurred while fetching STR history: %s", resp.Error)
@@ -72,7 +108,7 @@ func TestAuditLogBadEpochRange(t *testing.T) {
 	}
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	h, _ := aud.get(dirInitHash)
 
 	err := h.Audit(resp)
@@ -93,12 +129,12 @@ func TestGetLatestObservedSTR(t *testing.T) {
 	d, aud, hist := NewTestAuditLog(t, 0)
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 
 	res := aud.GetObservedSTRs(&directory.AuditingRequest{
 		DirInitSTRHash: dirInitHash,
-		StartEpoch:     uint64(d.LatestSTR().Epoch),
-		EndEpoch:       uint64(d.LatestSTR().Epoch)})
+		StartEpoch:     d.LatestSTR().Epoch,
+		EndEpoch:       d.LatestSTR().Epoch})
 	if res.Error != protocol.ReqSuccess {
 		t.Fatal("Unable to get latest observed STR")
 	}
@@ -117,12 +153,12 @@ func TestGetObservedSTRInEpoch(t *testing.T) {
 	_, aud, hist := NewTestAuditLog(t, 10)
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 
 	res := aud.GetObservedSTRs(&directory.AuditingRequest{
 		DirInitSTRHash: dirInitHash,
-		StartEpoch:     uint64(6),
-		EndEpoch:       uint64(8)})
+		StartEpoch:     6,
+		EndEpoch:       8})
 
 	if res.Error != protocol.ReqSuccess {
 		t.Fatal("Unable to get latest range of STRs")
@@ -145,12 +181,12 @@ func TestGetObservedSTRMultipleEpochs(t *testing.T) {
 	d, aud, hist := NewTestAuditLog(t, 1)
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 
 	// first AuditingRequest
 	res := aud.GetObservedSTRs(&directory.AuditingRequest{
 		DirInitSTRHash: dirInitHash,
-		StartEpoch:     uint64(0),
+		StartEpoch:     0,
 		EndEpoch:       d.LatestSTR().Epoch})
 
 	if res.Error != protocol.ReqSuccess {
@@ -205,16 +241,16 @@ func TestGetObservedSTRUnknown(t *testing.T) {
 	var unknown [hashed.HashSizeByte]byte
 	res := aud.GetObservedSTRs(&directory.AuditingRequest{
 		DirInitSTRHash: unknown,
-		StartEpoch:     uint64(d.LatestSTR().Epoch),
-		EndEpoch:       uint64(d.LatestSTR().Epoch)})
+		StartEpoch:     d.LatestSTR().Epoch,
+		EndEpoch:       d.LatestSTR().Epoch})
 	if res.Error != protocol.ReqUnknownDirectory {
 		t.Fatal("Expect ReqUnknownDirectory for latest STR")
 	}
 
 	res = aud.GetObservedSTRs(&directory.AuditingRequest{
 		DirInitSTRHash: unknown,
-		StartEpoch:     uint64(6),
-		EndEpoch:       uint64(8)})
+		StartEpoch:     6,
+		EndEpoch:       8})
 	if res.Error != protocol.ReqUnknownDirectory {
 		t.Fatal("Expect ReqUnknownDirectory for older STR")
 	}
@@ -226,20 +262,20 @@ func TestGetObservedSTRMalformed(t *testing.T) {
 	_, aud, hist := NewTestAuditLog(t, 10)
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 
 	// also test the epoch range
 	res := aud.GetObservedSTRs(&directory.AuditingRequest{
 		DirInitSTRHash: dirInitHash,
-		StartEpoch:     uint64(6),
-		EndEpoch:       uint64(4)})
+		StartEpoch:     6,
+		EndEpoch:       4})
 	if res.Error != protocol.ErrMalformedMessage {
 		t.Fatal("Expect ErrMalformedMessage for bad end epoch")
 	}
 	res = aud.GetObservedSTRs(&directory.AuditingRequest{
 		DirInitSTRHash: dirInitHash,
-		StartEpoch:     uint64(6),
-		EndEpoch:       uint64(11)})
+		StartEpoch:     6,
+		EndEpoch:       11})
 	if res.Error != protocol.ErrMalformedMessage {
 		t.Fatal("Expect ErrMalformedMessage for out-of-bounds epoch range")
 	}
@@ -254,12 +290,11 @@ func TestVerifyHashChainBadPrevSTRHash(t *testing.T) {
 	// modify the latest STR so that the consistency check fails
 	str := d.LatestSTR()
 	str2 := *str.SignedTreeRoot
-	str2.PreviousSTRHash = append([]byte{}, str.PreviousSTRHash...)
 	str2.PreviousSTRHash[0]++
 	str.SignedTreeRoot = &str2
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	h, _ := aud.get(dirInitHash)
 
 	// try to verify a new STR with a bad previous STR hash:
@@ -283,7 +318,7 @@ func TestVerifyHashChainBadPrevEpoch(t *testing.T) {
 	str.SignedTreeRoot = &str2
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	h, _ := aud.get(dirInitHash)
 
 	// try to verify a new STR with a bad previous STR hash:
@@ -307,7 +342,7 @@ func TestVerifyHashChainBadCurEpoch(t *testing.T) {
 	str.SignedTreeRoot = &str2
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	h, _ := aud.get(dirInitHash)
 
 	// try to verify a new STR with a bad previous STR hash:
@@ -324,8 +359,8 @@ func TestSTRHistoryRequestLatest(t *testing.T) {
 
 	d.Update()
 	resp := d.GetSTRHistory(&directory.STRHistoryRequest{
-		StartEpoch: uint64(d.LatestSTR().Epoch),
-		EndEpoch:   uint64(d.LatestSTR().Epoch)})
+		StartEpoch: d.LatestSTR().Epoch,
+		EndEpoch:   d.LatestSTR().Epoch})
 
 	if resp.Error != protocol.ReqSuccess {
 		t.Fatalf("Error occurred getting the latest STR from the directory: %s", resp.Error)
@@ -337,7 +372,7 @@ func TestSTRHistoryRequestLatest(t *testing.T) {
 	}
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	h, _ := aud.get(dirInitHash)
 
 	err := h.Audit(resp)
@@ -356,8 +391,8 @@ func TestSTRHistoryRequestRangeLatest(t *testing.T) {
 	}
 
 	resp := d.GetSTRHistory(&directory.STRHistoryRequest{
-		StartEpoch: uint64(4),
-		EndEpoch:   uint64(d.LatestSTR().Epoch)})
+		StartEpoch: 4,
+		EndEpoch:   d.LatestSTR().Epoch})
 
 	if resp.Error != protocol.ReqSuccess {
 		t.Fatalf("Error occurred getting the latest STR from the directory: %s", resp.Error)
@@ -373,7 +408,7 @@ func TestSTRHistoryRequestRangeLatest(t *testing.T) {
 	}
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	h, _ := aud.get(dirInitHash)
 
 	err := h.Audit(resp)
@@ -392,8 +427,8 @@ func TestSTRHistoryRequestInEpoch(t *testing.T) {
 	}
 
 	resp := d.GetSTRHistory(&directory.STRHistoryRequest{
-		StartEpoch: uint64(4),
-		EndEpoch:   uint64(5)})
+		StartEpoch: 4,
+		EndEpoch:   5})
 
 	if resp.Error != protocol.ReqSuccess {
 		t.Fatalf("Error occurred getting the latest STR from the directory: %s", resp.Error)
@@ -409,7 +444,7 @@ func TestSTRHistoryRequestInEpoch(t *testing.T) {
 	}
 
 	// compute the hash of the initial STR for later lookups
-	dirInitHash := auditor.ComputeDirectoryIdentity(hist[0])
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
 	h, _ := aud.get(dirInitHash)
 
 	err := h.Audit(resp)
@@ -417,3 +452,158 @@ func TestSTRHistoryRequestInEpoch(t *testing.T) {
 		t.Fatalf("Error occurred auditing the latest STR: %s", err.Error())
 	}
 }
+
+func TestAttestRollup(t *testing.T) {
+	d, aud, _ := NewTestAuditLog(t, 8)
+	auditorKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := d.Rollup()
+	att, err := aud.AttestRollup(r, auditorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !att.Auditor.Verify(r.AttestationBytes(), att.Signature[:]) {
+		t.Error("Expect a valid attestation")
+	}
+
+	// a rollup of another history, signed by the directory
+	forged := *r
+	forged.ListRoot[0]++
+	forged.Signature = sign.Signature{}
+	copy(forged.Signature[:], staticSigningKey.Sign(forged.Bytes()))
+	if _, err := aud.AttestRollup(&forged, auditorKey); err != protocol.CheckBadSTR {
+		t.Error("Expect", protocol.CheckBadSTR, "got", err)
+	}
+	forged.Signature[0]++
+	if _, err := aud.AttestRollup(&forged, auditorKey); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+
+	unknown := *r
+	unknown.DirInitSTRHash[0]++
+	if _, err := aud.AttestRollup(&unknown, auditorKey); err != protocol.ReqUnknownDirectory {
+		t.Error("Expect", protocol.ReqUnknownDirectory, "got", err)
+	}
+	// the auditor hasn't observed the latest epoch yet
+	d.Update()
+	if _, err := aud.AttestRollup(d.Rollup(), auditorKey); err != protocol.ErrMalformedMessage {
+		t.Error("Expect", protocol.ErrMalformedMessage, "got", err)
+	}
+}
+
+func TestAttestSTR(t *testing.T) {
+	d, aud, hist := NewTestAuditLog(t, 8)
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
+	auditorKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	str := hist[3]
+	att, err := aud.AttestSTR(dirInitHash, str, auditorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !att.Auditor.Verify(str.AttestationBytes(), att.Signature[:]) {
+		t.Error("Expect a valid attestation")
+	}
+
+	inner := *str.SignedTreeRoot
+	inner.TreeHash[0]++
+	forged := directory.SignedTreeRoot{SignedTreeRoot: &inner, Policies: str.Policies}
+	copy(forged.Signature[:], staticSigningKey.Sign(forged.Bytes()))
+	if _, err := aud.AttestSTR(dirInitHash, &forged, auditorKey); err != protocol.CheckBadSTR {
+		t.Error("Expect", protocol.CheckBadSTR, "got", err)
+	}
+	dirInitHash[0]++
+	if _, err := aud.AttestSTR(dirInitHash, str, auditorKey); err != protocol.ReqUnknownDirectory {
+		t.Error("Expect", protocol.ReqUnknownDirectory, "got", err)
+	}
+	dirInitHash[0]--
+	// the auditor hasn't observed the latest epoch yet
+	d.Update()
+	if _, err := aud.AttestSTR(dirInitHash, d.LatestSTR(), auditorKey); err != protocol.ErrMalformedMessage {
+		t.Error("Expect", protocol.ErrMalformedMessage, "got", err)
+	}
+}
+
+func TestGetDirectoriesAndInitFromIdentity(t *testing.T) {
+	_, aud, hist := NewTestAuditLog(t, 2)
+	resp := aud.GetDirectories(&directory.DirectoriesRequest{})
+	if resp.Error != protocol.ReqSuccess {
+		t.Fatal("Expect", protocol.ReqSuccess, "got", resp.Error)
+	}
+	ids := resp.DirectoryResponse.(*directory.DirectoryIdentities).Directories
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
+	if len(ids) != 1 || ids[0].Addr != "test-server" || ids[0].InitSTR != hist[0] ||
+		ids[0].ID() != dirInitHash {
+		t.Fatal("Expect the identity of the test directory, got", ids)
+	}
+
+	newLog := New()
+	if err := newLog.InitFromIdentity(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := newLog.InitFromIdentity(ids[0]); err != protocol.ErrAuditLog {
+		t.Error("Expect", protocol.ErrAuditLog, "got", err)
+	}
+	forged := *ids[0]
+	forged.SignKey = sign.PublicKey(make([]byte, len(forged.SignKey)))
+	if err := New().InitFromIdentity(&forged); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+	forged.InitSTR = hist[1]
+	if err := New().InitFromIdentity(&forged); err != protocol.ErrMalformedMessage {
+		t.Error("Expect", protocol.ErrMalformedMessage, "got", err)
+	}
+}
+
+func TestInitHistoryWithStore(t *testing.T) {
+	d := directory.NewTestTree(t)
+	store := merkletree.NewMemSTRStore()
+	aud := New()
+	pk := staticSigningKey.Public()
+	if err := aud.InitHistoryWithStore("test-server", pk, []*directory.SignedTreeRoot{d.LatestSTR()},
+		store); err != nil {
+		t.Fatal(err)
+	}
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(d.LatestSTR())
+	for i := 0; i < 3; i++ {
+		d.Update()
+		resp := directory.NewSTRHistoryRange([]*directory.SignedTreeRoot{d.LatestSTR()})
+		if err := aud.Audit(dirInitHash, resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.Len() != 4 {
+		t.Fatal("Expect 4 archived STRs, got", store.Len())
+	}
+
+	// a restarted auditor restores the history from the store
+	restored := New()
+	if err := restored.InitHistoryWithStore("test-server", pk, nil, store); err != nil {
+		t.Fatal(err)
+	}
+	h, ok := restored.get(dirInitHash)
+	if !ok || h.VerifiedSTR().Signature != d.LatestSTR().Signature {
+		t.Fatal("Expect the history to be restored")
+	}
+	res := restored.GetObservedSTRs(&directory.AuditingRequest{
+		DirInitSTRHash: dirInitHash, StartEpoch: 0, EndEpoch: 3})
+	if res.Error != protocol.ReqSuccess {
+		t.Fatal("Expect", protocol.ReqSuccess, "got", res.Error)
+	}
+
+	// and keeps archiving the STRs it verifies
+	d.Update()
+	resp := directory.NewSTRHistoryRange([]*directory.SignedTreeRoot{d.LatestSTR()})
+	if err := restored.Audit(dirInitHash, resp); err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := store.Latest(); err != nil || latest.Signature != d.LatestSTR().Signature {
+		t.Error("Expect the latest STR to be archived, got", latest, err)
+	}
+}
@@ -22,7 +22,9 @@ func NewTestAuditLog(t *testing.T, numEpochs int) (*directory.Tree, ConiksAuditL
 	var snaps []*directory.SignedTreeRoot
 	for ep := 0; ep < numEpochs; ep++ {
 		snaps = append(snaps, d.LatestSTR())
-		d.Update()
+		if _, err := d.Update(); err != nil {
+			t.Fatal(err)
+		}
 	}
 	// always include the actual latest STR
 	snaps = append(snaps, d.LatestSTR())
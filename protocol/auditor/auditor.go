@@ -5,23 +5,50 @@
 package auditor
 
 import (
+	"bytes"
+	"math/bits"
 	"reflect"
 
 	"github.com/ORBAT/cloniks/crypto/sign"
 	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
 	"github.com/ORBAT/cloniks/protocol"
 )
 
+// DepthSlack is the number of levels by which an STR's maximum leaf depth
+// may exceed twice the binary logarithm of its leaf count before
+// CheckTreeShape considers the tree suspicious. With uniformly
+// distributed indices, an honest tree exceeds this bound with a
+// probability of roughly 2^-DepthSlack.
+const DepthSlack = 20
+
 // Auditor provides a generic interface allowing different
 // auditor types to implement specific auditing functionality.
 type Auditor interface {
 	AuditDirectory([]*directory.SignedTreeRoot) error
 }
 
-// AudState verifies the hash chain of a specific directory.
+// A SignatureCache remembers STRs whose signatures have been verified,
+// so that an AudState doesn't verify them again. Implementations must
+// only report an STR as verified if it's identical to one that was
+// added, including its signature.
+type SignatureCache interface {
+	Contains(str *directory.SignedTreeRoot) bool
+	Add(str *directory.SignedTreeRoot)
+}
+
+// AudState verifies the hash chain of a specific directory. It follows
+// the rotations of the directory's signing key (see
+// directory.KeyRotation): signKey is the key that signed verifiedSTR.
 type AudState struct {
 	signKey     sign.PublicKey
+	verifier    sign.Verifier // replaces signKey if set
 	verifiedSTR *directory.SignedTreeRoot
+	sigCache    SignatureCache
+	// audited is the latest STR AuditDirectory verified, and auditedKey
+	// the key that signed it
+	audited    *directory.SignedTreeRoot
+	auditedKey sign.PublicKey
 }
 
 var _ Auditor = (*AudState)(nil)
@@ -36,9 +63,45 @@ func New(signKey sign.PublicKey, verified *directory.SignedTreeRoot) *AudState {
 }
 
 // Verify verifies a signature sig on message using the underlying
-// public-key of the AudState.
+// public-key of the AudState, i.e. the key that signed the verified STR.
 func (a *AudState) Verify(message, sig []byte) bool {
-	return a.signKey.Verify(message, sig)
+	return a.verifyWith(a.signKey, message, sig)
+}
+
+// UseVerifier makes a verify signatures with v instead of the signing
+// key it was created with, one at a time instead of in batches. It's
+// meant for tests that need signature verification to fail, e.g. with
+// a cryptotest.Verifier. A nil v restores the signing key.
+func (a *AudState) UseVerifier(v sign.Verifier) {
+	a.verifier = v
+}
+
+// UseSignatureCache makes a skip verifying the signatures of STRs that
+// are in c, and add the STRs it verifies to c. The hash chain of every
+// STR is checked regardless. A nil c disables caching.
+func (a *AudState) UseSignatureCache(c SignatureCache) {
+	a.sigCache = c
+}
+
+// SignKey returns the directory's public signing key that signed the
+// verified STR.
+func (a *AudState) SignKey() sign.PublicKey {
+	return a.signKey
+}
+
+// verifySignature verifies str's signature with key, unless str is
+// cached.
+func (a *AudState) verifySignature(key sign.PublicKey, str *directory.SignedTreeRoot) bool {
+	if a.sigCache != nil && a.sigCache.Contains(str) {
+		return true
+	}
+	if !a.verifyWith(key, str.Bytes(), str.Signature[:]) {
+		return false
+	}
+	if a.sigCache != nil {
+		a.sigCache.Add(str)
+	}
+	return true
 }
 
 // VerifiedSTR returns the newly verified STR.
@@ -46,11 +109,39 @@ func (a *AudState) VerifiedSTR() *directory.SignedTreeRoot {
 	return a.verifiedSTR
 }
 
-// Update updates the auditor's verifiedSTR to newSTR
+// verifyWith verifies sig on message with key, or with a's verifier if
+// it has one.
+func (a *AudState) verifyWith(key sign.PublicKey, message, sig []byte) bool {
+	if a.verifier != nil {
+		return a.verifier.Verify(message, sig)
+	}
+	return key.Verify(message, sig)
+}
+
+// Update updates the auditor's verifiedSTR to newSTR, and its signing
+// key to the one that signed newSTR: the key AuditDirectory verified
+// newSTR with, if it was the latest STR it verified, or the key the
+// verified STR announced for newSTR, if newSTR follows it.
 func (a *AudState) Update(newSTR *directory.SignedTreeRoot) {
+	switch {
+	case a.audited != nil && a.audited == newSTR:
+		a.signKey = a.auditedKey
+	case a.verifiedSTR != nil && newSTR.Epoch == a.verifiedSTR.Epoch+1:
+		a.signKey = directory.KeyAt(a.verifiedSTR, newSTR.Epoch, a.signKey)
+	}
+	a.audited, a.auditedKey = nil, nil
 	a.verifiedSTR = newSTR
 }
 
+// keyOf returns the key that signs str, if str is the verified STR or
+// the one after it, and otherwise the key that signed the verified STR.
+func (a *AudState) keyOf(str *directory.SignedTreeRoot) sign.PublicKey {
+	if str.Epoch == a.verifiedSTR.Epoch+1 {
+		return directory.KeyAt(a.verifiedSTR, str.Epoch, a.signKey)
+	}
+	return a.signKey
+}
+
 // compareWithVerified checks whether the received STR is the same as
 // the verified STR in the AudState using reflect.DeepEqual().
 func (a *AudState) compareWithVerified(str *directory.SignedTreeRoot) error {
@@ -61,21 +152,133 @@ func (a *AudState) compareWithVerified(str *directory.SignedTreeRoot) error {
 }
 
 // verifySTRConsistency checks the consistency between 2 snapshots.
-// It uses the signing key signKey to verify the STR's signature.
-// The signKey param either comes from a client's
+// It uses the signing key key that signed prevSTR, or the key prevSTR
+// announced for str's epoch, to verify the STR's signature.
+// The key either comes from a client's
 // pinned signing key in its consistency state,
 // or an auditor's pinned signing key in its history.
-func (a *AudState) verifySTRConsistency(prevSTR, str *directory.SignedTreeRoot) error {
+func (a *AudState) verifySTRConsistency(prevSTR, str *directory.SignedTreeRoot, key sign.PublicKey) error {
 	// verify STR's signature
-	if !a.signKey.Verify(str.Bytes(), str.Signature) {
+	if !a.verifySignature(directory.KeyAt(prevSTR, str.Epoch, key), str) {
 		return protocol.CheckBadSignature
 	}
-	if str.VerifyHashChain(prevSTR) {
-		return nil
+	if !str.VerifyHashChain(prevSTR) {
+		return protocol.CheckBadSTR
 	}
+	return CheckPolicies(prevSTR, str)
+}
 
-	// TODO: verify the directory's policies as well. See #115
-	return protocol.CheckBadSTR
+// CheckPolicies checks that the policies in str may follow those in
+// prevSTR, the STR before it: the directory may only withdraw
+// capabilities in an STR that flags a policy change or in one whose
+// policies prevSTR announced, must change its policies as announced (see
+// checkSchedule), may only change its protocol version as announced
+// (see checkUpgrade), must announce signing key rotations properly (see
+// checkKeyRotation), and must be approved by its operators if it's
+// co-managed (see checkApprovals).
+// CheckPolicies() returns protocol.CheckCapabilityDowngrade if it
+// withdraws capabilities otherwise, protocol.CheckBadPolicySchedule if
+// the policies or their announcements change otherwise,
+// protocol.CheckBadUpgrade if the version or the announcement changes
+// otherwise, protocol.CheckBadKeyRotation if a key rotation is announced
+// or withdrawn otherwise, protocol.CheckBadApproval if it lacks
+// approvals, and nil if the check passes.
+func CheckPolicies(prevSTR, str *directory.SignedTreeRoot) error {
+	if prevSTR.Policies.Capabilities.Withdrawn(str.Policies.Capabilities) != 0 &&
+		!str.Policies.PolicyChange && prevSTR.Policies.ScheduledAt(str.Epoch) == nil {
+		return protocol.CheckCapabilityDowngrade
+	}
+	if err := checkSchedule(prevSTR, str); err != nil {
+		return err
+	}
+	if err := checkUpgrade(prevSTR, str); err != nil {
+		return err
+	}
+	if err := checkKeyRotation(prevSTR, str); err != nil {
+		return err
+	}
+	return checkApprovals(prevSTR, str)
+}
+
+// checkKeyRotation checks that a signing key rotation str announces is
+// for a later epoch than that of str, and is signed with its new key. An
+// announcement of prevSTR may only be withdrawn or changed in an STR that
+// flags a policy change. Whether str is signed with the right key is up
+// to the caller (see directory.KeyAt).
+func checkKeyRotation(prevSTR, str *directory.SignedTreeRoot) error {
+	prev, next := prevSTR.Policies.KeyRotation, str.Policies.KeyRotation
+	if next != nil && (next.Epoch <= str.Epoch || !next.Verify()) {
+		return protocol.CheckBadKeyRotation
+	}
+	if prev != nil && prev.Epoch != str.Epoch && !prev.Equal(next) && !str.Policies.PolicyChange {
+		return protocol.CheckBadKeyRotation
+	}
+	return nil
+}
+
+// checkApprovals checks that str has the approvals the operator policy
+// of prevSTR requires, or if prevSTR has none, that of str itself (see
+// directory.Operators).
+func checkApprovals(prevSTR, str *directory.SignedTreeRoot) error {
+	o := prevSTR.Policies.Operators
+	if o == nil {
+		o = str.Policies.Operators
+	}
+	if o != nil && !o.Approved(str.Proposal(), str.Policies.Approvals) {
+		return protocol.CheckBadApproval
+	}
+	return nil
+}
+
+// checkSchedule checks that str has the policies prevSTR announced for
+// its epoch, if any, and that its own announcements are for later epochs
+// in order. The announcements of prevSTR for later epochs may only be
+// withdrawn or changed in an STR that flags a policy change.
+func checkSchedule(prevSTR, str *directory.SignedTreeRoot) error {
+	prev, next := prevSTR.Policies, str.Policies
+	for i, u := range next.Schedule {
+		if u.Epoch <= str.Epoch || i > 0 && u.Epoch <= next.Schedule[i-1].Epoch {
+			return protocol.CheckBadPolicySchedule
+		}
+	}
+	for _, u := range prev.Schedule {
+		switch {
+		case u.Epoch == str.Epoch:
+			if !u.Matches(next) {
+				return protocol.CheckBadPolicySchedule
+			}
+		case u.Epoch > str.Epoch:
+			if !u.Equal(next.ScheduledAt(u.Epoch)) && !next.PolicyChange {
+				return protocol.CheckBadPolicySchedule
+			}
+		}
+	}
+	return nil
+}
+
+// checkUpgrade checks that str switches to the protocol version
+// announced in prevSTR exactly at the announced epoch, and otherwise
+// keeps the version of prevSTR. An announcement must be for a later
+// epoch than that of its STR, and may only be withdrawn or changed in an
+// STR that flags a policy change.
+func checkUpgrade(prevSTR, str *directory.SignedTreeRoot) error {
+	prev, next := prevSTR.Policies, str.Policies
+	if next.Upgrade != nil && next.Upgrade.Epoch <= str.Epoch {
+		return protocol.CheckBadUpgrade
+	}
+	if up := prev.Upgrade; up != nil && up.Epoch == str.Epoch {
+		if !bytes.Equal(next.Version, up.Version) {
+			return protocol.CheckBadUpgrade
+		}
+		return nil
+	}
+	if !bytes.Equal(next.Version, prev.Version) {
+		return protocol.CheckBadUpgrade
+	}
+	if prev.Upgrade != nil && !prev.Upgrade.Equal(next.Upgrade) && !next.PolicyChange {
+		return protocol.CheckBadUpgrade
+	}
+	return nil
 }
 
 // CheckSTRAgainstVerified checks an STR str against the a.verifiedSTR.
@@ -100,7 +303,7 @@ func (a *AudState) CheckSTRAgainstVerified(str *directory.SignedTreeRoot) error
 		}
 	case str.Epoch == a.verifiedSTR.Epoch+1:
 		// Otherwise, expect that we've entered a new epoch
-		if err := a.verifySTRConsistency(a.verifiedSTR, str); err != nil {
+		if err := a.verifySTRConsistency(a.verifiedSTR, str, a.signKey); err != nil {
 			return err
 		}
 	default:
@@ -114,29 +317,139 @@ func (a *AudState) CheckSTRAgainstVerified(str *directory.SignedTreeRoot) error
 // of a directory's STRs. It begins by verifying the STR consistency between
 // the given prevSTR and the first STR in the given range, and
 // then verifies the consistency between each subsequent STR pair.
+// The signatures are verified with the key that signed prevSTR, following
+// the key rotations the range announces; prevSTR is assumed to be signed
+// with the key that signed the verified STR, unless it's the STR after it.
+//
+// The signatures of the whole range are verified as a batch first, and
+// the hash chain with merkletree.VerifySTRChain. If the batch is invalid,
+// VerifySTRRange falls back to checking the range STR by STR to find the
+// first inconsistency.
 func (a *AudState) VerifySTRRange(prevSTR *directory.SignedTreeRoot, strs []*directory.SignedTreeRoot) error {
+	_, err := a.verifySTRRange(prevSTR, a.keyOf(prevSTR), strs)
+	return err
+}
+
+// verifySTRRange is VerifySTRRange with the key key that signed prevSTR.
+// It returns the key that signed the last STR in strs.
+func (a *AudState) verifySTRRange(prevSTR *directory.SignedTreeRoot, key sign.PublicKey,
+	strs []*directory.SignedTreeRoot) (sign.PublicKey, error) {
+	if last, ok := a.verifySignatures(prevSTR, key, strs); ok {
+		// the signatures are verified, so only the links are left
+		if err := merkletree.VerifySTRChain(nil, merkleSTRs(strs), prevSTR.SignedTreeRoot); err != nil {
+			return nil, protocol.CheckBadSTR
+		}
+		prev := prevSTR
+		for _, str := range strs {
+			if err := CheckPolicies(prev, str); err != nil {
+				return nil, err
+			}
+			prev = str
+		}
+		return last, nil
+	}
+
 	prev := prevSTR
 	for i := 0; i < len(strs); i++ {
 		str := strs[i]
 		if str == nil {
-			return protocol.ErrMalformedMessage
+			return nil, protocol.ErrMalformedMessage
 		}
 
 		// verify the consistency of each STR in the range
-		if err := a.verifySTRConsistency(prev, str); err != nil {
-			return err
+		if err := a.verifySTRConsistency(prev, str, key); err != nil {
+			return nil, err
 		}
 
+		key = directory.KeyAt(prev, str.Epoch, key)
 		prev = str
 	}
 
+	return key, nil
+}
+
+// merkleSTRs returns the merkletree STRs of strs, which must not be nil.
+func merkleSTRs(strs []*directory.SignedTreeRoot) []*merkletree.SignedTreeRoot {
+	ms := make([]*merkletree.SignedTreeRoot, len(strs))
+	for i, str := range strs {
+		ms[i] = str.SignedTreeRoot
+	}
+	return ms
+}
+
+// VerifySTRSkips checks the consistency of a path of a directory's STRs
+// that skips epochs, e.g. the response to a directory.STRSkipRequest.
+// Each STR in strs must be validly signed and link to the one before
+// it, and the first one to prevSTR, either as its previous STR or with
+// a skip hash. See merkletree.SkipPath. The path can only follow the key
+// rotations that take effect in an STR on it right after the one that
+// announced them, so a client that lagged behind a rotation has to
+// catch up with VerifySTRRange instead.
+func (a *AudState) VerifySTRSkips(prevSTR *directory.SignedTreeRoot, strs []*directory.SignedTreeRoot) error {
+	if _, ok := a.verifySignatures(prevSTR, a.keyOf(prevSTR), strs); !ok {
+		for _, str := range strs {
+			if str == nil {
+				return protocol.ErrMalformedMessage
+			}
+		}
+		return protocol.CheckBadSignature
+	}
+	prev := prevSTR
+	for _, str := range strs {
+		if !str.VerifySkip(prev) {
+			return protocol.CheckBadSTR
+		}
+		prev = str
+	}
 	return nil
 }
 
+// verifySignatures reports whether all STRs in strs are non-nil and
+// validly signed, the first one with the key that key, the key that
+// signed prevSTR, rotates to (see directory.KeyAt), and each later one
+// with the key the one before it rotates to. It returns the key of the
+// last STR. It verifies the signatures of the STRs that aren't in the
+// signature cache as a batch.
+func (a *AudState) verifySignatures(prevSTR *directory.SignedTreeRoot, key sign.PublicKey,
+	strs []*directory.SignedTreeRoot) (sign.PublicKey, bool) {
+	var batch sign.Batch
+	var uncached []*directory.SignedTreeRoot
+	prev := prevSTR
+	for _, str := range strs {
+		if str == nil {
+			return nil, false
+		}
+		key = directory.KeyAt(prev, str.Epoch, key)
+		prev = str
+		if a.sigCache != nil && a.sigCache.Contains(str) {
+			continue
+		}
+		if a.verifier != nil {
+			if !a.verifier.Verify(str.Bytes(), str.Signature[:]) {
+				return nil, false
+			}
+		} else {
+			batch.Add(key, str.Bytes(), str.Signature[:])
+		}
+		uncached = append(uncached, str)
+	}
+	if !batch.Verify() {
+		return nil, false
+	}
+	if a.sigCache != nil {
+		for _, str := range uncached {
+			a.sigCache.Add(str)
+		}
+	}
+	return key, true
+}
+
 // AuditDirectory validates a range of STRs received from a CONIKS directory.
 // AuditDirectory() checks the consistency of the oldest STR in the range
 // against the verifiedSTR, and verifies the remaining
-// range if the message contains more than one STR.
+// range if the message contains more than one STR, following the
+// rotations of the directory's signing key. Updating a to the latest STR
+// of the range then makes a verify with the key that signed it.
 // AuditDirectory() returns the appropriate consistency check error
 // if any of the checks fail, or nil if the checks pass.
 func (a *AudState) AuditDirectory(strs []*directory.SignedTreeRoot) error {
@@ -149,13 +462,38 @@ func (a *AudState) AuditDirectory(strs []*directory.SignedTreeRoot) error {
 	if err := a.CheckSTRAgainstVerified(strs[0]); err != nil {
 		return err
 	}
+	key := a.keyOf(strs[0])
 
 	// verify the entire range if we have received more than one STR
 	if len(strs) > 1 {
-		if err := a.VerifySTRRange(strs[0], strs[1:]); err != nil {
+		var err error
+		if key, err = a.verifySTRRange(strs[0], key, strs[1:]); err != nil {
 			return err
 		}
 	}
 
+	a.audited, a.auditedKey = strs[len(strs)-1], key
+	return nil
+}
+
+// CheckTreeShape checks the tree shape measurement (maximum leaf depth and
+// leaf count) included in str. The shape is inconsistent if a non-empty
+// tree has a depth of 0 or vice versa, or if the depth exceeds the index
+// size given in the directory's policies. It is suspicious if the depth
+// is far greater than what uniformly distributed indices would produce,
+// which may indicate that the directory (or someone registering names)
+// is clustering indices to make proofs excessively long.
+// CheckTreeShape() returns protocol.CheckBadSTR for an inconsistent
+// shape, protocol.CheckSuspiciousTreeShape for a suspicious one, and
+// nil otherwise.
+func CheckTreeShape(str *directory.SignedTreeRoot) error {
+	if (str.LeafCount == 0) != (str.MaxDepth == 0) ||
+		str.MaxDepth > str.Policies.IndexSize*8 {
+		return protocol.CheckBadSTR
+	}
+	bound := 2*bits.Len64(str.LeafCount) + DepthSlack
+	if int(str.MaxDepth) > bound {
+		return protocol.CheckSuspiciousTreeShape
+	}
 	return nil
 }
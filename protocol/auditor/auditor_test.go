@@ -1,10 +1,13 @@
 package auditor
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
 	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
 	"github.com/ORBAT/cloniks/protocol"
 )
 
@@ -24,7 +27,6 @@ func TestAuditBadSTRSignature(t *testing.T) {
 	// modify the latest STR so that the consistency check fails
 	str := d.LatestSTR()
 	str2 := *str.SignedTreeRoot
-	str2.Signature = append([]byte{}, str.Signature...)
 	str2.Signature[0]++
 	str.SignedTreeRoot = &str2
 
@@ -47,7 +49,6 @@ func TestAuditBadSameEpoch(t *testing.T) {
 	str := d.LatestSTR()
 	// modify the pinned STR so that the consistency check should fail.
 	str2 := *str.SignedTreeRoot
-	str2.Signature = append([]byte{}, str.Signature...)
 	str2.Signature[0]++
 	str.SignedTreeRoot = &str2
 
@@ -87,8 +88,8 @@ func TestAuditBadNewSTREpoch(t *testing.T) {
 	// try to re-audit only STR epoch 2:
 	// case str.Epoch < verifiedSTR.Epoch in checkAgainstVerifiedSTR()
 	resp := d.GetSTRHistory(&directory.STRHistoryRequest{
-		StartEpoch: uint64(2),
-		EndEpoch:   uint64(2)})
+		StartEpoch: 2,
+		EndEpoch:   2})
 
 	strs := resp.DirectoryResponse.(*directory.STRHistoryRange)
 	err = aud.AuditDirectory(strs.STR)
@@ -116,8 +117,8 @@ func TestAuditMalformedSTRRange(t *testing.T) {
 	}
 
 	resp := d.GetSTRHistory(&directory.STRHistoryRequest{
-		StartEpoch: uint64(4),
-		EndEpoch:   uint64(d.LatestSTR().Epoch)})
+		StartEpoch: 4,
+		EndEpoch:   d.LatestSTR().Epoch})
 
 	if resp.Error != protocol.ReqSuccess {
 		t.Fatalf("Error occurred getting the latest STR from the directory: %s", resp.Error)
@@ -134,3 +135,361 @@ func TestAuditMalformedSTRRange(t *testing.T) {
 		t.Error("Expect", protocol.ErrMalformedMessage, "got", err1)
 	}
 }
+
+func TestVerifySTRRangeBatch(t *testing.T) {
+	d := directory.NewTestTree(t)
+	pk := staticSigningKey.Public()
+	genesis := d.LatestSTR()
+	var strs []*directory.SignedTreeRoot
+	for i := 0; i < 40; i++ {
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+
+	badSig := func(str *directory.SignedTreeRoot) *directory.SignedTreeRoot {
+		bad := *str.SignedTreeRoot
+		bad.Signature[0]++
+		return &directory.SignedTreeRoot{SignedTreeRoot: &bad, Policies: str.Policies}
+	}
+	// withChanges returns a copy of strs with the given replacements
+	withChanges := func(changes map[int]*directory.SignedTreeRoot) []*directory.SignedTreeRoot {
+		c := append([]*directory.SignedTreeRoot{}, strs...)
+		for i, str := range changes {
+			c[i] = str
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name string
+		strs []*directory.SignedTreeRoot
+		want error
+	}{
+		{"valid", strs, nil},
+		{"bad signature", withChanges(map[int]*directory.SignedTreeRoot{30: badSig(strs[30])}), protocol.CheckBadSignature},
+		// the first inconsistency in the range determines the error
+		{"bad signature before broken chain", withChanges(map[int]*directory.SignedTreeRoot{
+			10: badSig(strs[10]), 30: strs[31], 31: strs[30]}), protocol.CheckBadSignature},
+		{"broken chain before bad signature", withChanges(map[int]*directory.SignedTreeRoot{
+			10: strs[11], 11: strs[10], 30: badSig(strs[30])}), protocol.CheckBadSTR},
+		{"broken chain", withChanges(map[int]*directory.SignedTreeRoot{10: strs[11], 11: strs[10]}), protocol.CheckBadSTR},
+	} {
+		if err := New(pk, genesis).VerifySTRRange(genesis, tc.strs); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestCheckTreeShape(t *testing.T) {
+	d := directory.NewTestTree(t)
+	str := d.LatestSTR()
+	if err := CheckTreeShape(str); err != nil {
+		t.Fatal("Expect empty tree to pass, got", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		maxDepth  uint32
+		leafCount uint64
+		want      error
+	}{
+		{"balanced", 8, 100, nil},
+		{"depth without leaves", 1, 0, protocol.CheckBadSTR},
+		{"leaves without depth", 0, 1, protocol.CheckBadSTR},
+		{"deeper than index", str.Policies.IndexSize*8 + 1, 1000, protocol.CheckBadSTR},
+		{"clustered", 2*7 + DepthSlack + 1, 100, protocol.CheckSuspiciousTreeShape},
+	} {
+		shaped := *str.SignedTreeRoot
+		shaped.MaxDepth = tc.maxDepth
+		shaped.LeafCount = tc.leafCount
+		if err := CheckTreeShape(directory.NewDirSTR(&shaped)); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestCapabilityDowngrade(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithCapabilities(directory.CapBatchLookup|directory.CapKeyChange),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aud := New(staticSigningKey.Public(), d.LatestSTR())
+	d.SetCapabilities(directory.CapKeyChange)
+	d.Update()
+	d.Update()
+	res := d.GetSTRHistory(&directory.STRHistoryRequest{StartEpoch: 1, EndEpoch: 2})
+	strs := res.DirectoryResponse.(*directory.STRHistoryRange).STR
+	if !strs[0].Policies.PolicyChange || strs[1].Policies.PolicyChange {
+		t.Fatal("Expect only the STR withdrawing the capability to flag a policy change")
+	}
+	if err := aud.AuditDirectory(strs); err != nil {
+		t.Error("Expect a flagged withdrawal to pass, got", err)
+	}
+	if err := CheckPolicies(aud.VerifiedSTR(), strs[1]); err != protocol.CheckCapabilityDowngrade {
+		t.Error("Expect", protocol.CheckCapabilityDowngrade, "got", err)
+	}
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	v1, v2 := []byte(protocol.Version), []byte("0.2")
+	str := func(epoch merkletree.Epoch, version []byte, up *directory.Upgrade, policyChange bool) *directory.SignedTreeRoot {
+		return &directory.SignedTreeRoot{
+			SignedTreeRoot: &merkletree.SignedTreeRoot{Epoch: epoch},
+			Policies:       &directory.Config{Version: version, Upgrade: up, PolicyChange: policyChange},
+		}
+	}
+	at := func(epoch merkletree.Epoch) *directory.Upgrade {
+		return &directory.Upgrade{Version: v2, Epoch: epoch}
+	}
+	for _, tc := range []struct {
+		name      string
+		prev, str *directory.SignedTreeRoot
+		want      error
+	}{
+		{"no upgrade", str(1, v1, nil, false), str(2, v1, nil, false), nil},
+		{"announcement", str(1, v1, nil, false), str(2, v1, at(4), false), nil},
+		{"kept announcement", str(2, v1, at(4), false), str(3, v1, at(4), false), nil},
+		{"upgrade", str(3, v1, at(4), false), str(4, v2, nil, false), nil},
+		{"unannounced upgrade", str(3, v1, nil, false), str(4, v2, nil, false), protocol.CheckBadUpgrade},
+		{"early upgrade", str(2, v1, at(4), false), str(3, v2, nil, false), protocol.CheckBadUpgrade},
+		{"missed upgrade", str(3, v1, at(4), false), str(4, v1, nil, false), protocol.CheckBadUpgrade},
+		{"other version", str(3, v1, at(4), false), str(4, []byte("0.3"), nil, false), protocol.CheckBadUpgrade},
+		{"stale announcement", str(1, v1, nil, false), str(2, v1, at(2), false), protocol.CheckBadUpgrade},
+		{"silent cancellation", str(2, v1, at(4), false), str(3, v1, nil, false), protocol.CheckBadUpgrade},
+		{"silent postponement", str(2, v1, at(4), false), str(3, v1, at(5), false), protocol.CheckBadUpgrade},
+		{"flagged cancellation", str(2, v1, at(4), false), str(3, v1, nil, true), nil},
+	} {
+		if err := CheckPolicies(tc.prev, tc.str); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestCheckKeyRotation(t *testing.T) {
+	oldKey := staticSigningKey.Public()
+	newKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := func(epoch merkletree.Epoch, r *directory.KeyRotation, policyChange bool) *directory.SignedTreeRoot {
+		return &directory.SignedTreeRoot{
+			SignedTreeRoot: &merkletree.SignedTreeRoot{Epoch: epoch},
+			Policies:       &directory.Config{KeyRotation: r, PolicyChange: policyChange},
+		}
+	}
+	at := func(epoch merkletree.Epoch) *directory.KeyRotation {
+		r := &directory.KeyRotation{OldKey: oldKey, NewKey: newKey.Public(), Epoch: epoch}
+		copy(r.Signature[:], newKey.Sign(r.Bytes()))
+		return r
+	}
+	unsigned := at(4)
+	unsigned.Signature[0] ^= 1
+	for _, tc := range []struct {
+		name      string
+		prev, str *directory.SignedTreeRoot
+		want      error
+	}{
+		{"announcement", str(1, nil, false), str(2, at(4), false), nil},
+		{"kept announcement", str(2, at(4), false), str(3, at(4), false), nil},
+		{"rotation", str(3, at(4), false), str(4, nil, false), nil},
+		{"stale announcement", str(1, nil, false), str(2, at(2), false), protocol.CheckBadKeyRotation},
+		{"unsigned announcement", str(1, nil, false), str(2, unsigned, false), protocol.CheckBadKeyRotation},
+		{"silent cancellation", str(2, at(4), false), str(3, nil, false), protocol.CheckBadKeyRotation},
+		{"silent postponement", str(2, at(4), false), str(3, at(5), false), protocol.CheckBadKeyRotation},
+		{"flagged cancellation", str(2, at(4), false), str(3, nil, true), nil},
+	} {
+		if err := CheckPolicies(tc.prev, tc.str); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestAuditKeyRotation(t *testing.T) {
+	d := directory.NewTestTree(t)
+	pk := staticSigningKey.Public()
+	newKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ScheduleKeyRotation(newKey, 3); err != nil {
+		t.Fatal(err)
+	}
+	genesis := d.LatestSTR()
+	var strs []*directory.SignedTreeRoot
+	for i := 0; i < 4; i++ {
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+
+	// a range across the rotation
+	aud := New(pk, genesis)
+	if err := aud.AuditDirectory(strs); err != nil {
+		t.Fatal("Expect the announced rotation to pass, got", err)
+	}
+	aud.Update(strs[len(strs)-1])
+	if !bytes.Equal(aud.SignKey(), newKey.Public()) {
+		t.Error("Expect the auditor to follow the rotation, got", aud.SignKey())
+	}
+
+	// one STR at a time
+	aud = New(pk, genesis)
+	for _, str := range strs {
+		if err := aud.AuditDirectory([]*directory.SignedTreeRoot{str}); err != nil {
+			t.Fatal("Expect STR", str.Epoch, "to pass, got", err)
+		}
+		aud.Update(str)
+	}
+	if !bytes.Equal(aud.SignKey(), newKey.Public()) {
+		t.Error("Expect the auditor to follow the rotation, got", aud.SignKey())
+	}
+
+	// the old key may not sign after the rotation
+	forged := *strs[2].SignedTreeRoot
+	copy(forged.Signature[:], staticSigningKey.Sign(forged.Bytes()))
+	aud = New(pk, strs[1])
+	if err := aud.AuditDirectory([]*directory.SignedTreeRoot{directory.NewDirSTR(&forged)}); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+	if err := New(pk, genesis).VerifySTRRange(genesis, []*directory.SignedTreeRoot{strs[0], strs[1],
+		directory.NewDirSTR(&forged)}); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	str := func(epoch merkletree.Epoch, interval uint64, policyChange bool, schedule ...*directory.PolicyUpdate) *directory.SignedTreeRoot {
+		return &directory.SignedTreeRoot{
+			SignedTreeRoot: &merkletree.SignedTreeRoot{Epoch: epoch},
+			Policies: &directory.Config{MinKeyChangeInterval: interval, Capabilities: directory.CapDeletion,
+				PolicyChange: policyChange, Schedule: schedule},
+		}
+	}
+	at := func(epoch merkletree.Epoch, interval uint64) *directory.PolicyUpdate {
+		return &directory.PolicyUpdate{Epoch: epoch, MinKeyChangeInterval: interval, Capabilities: directory.CapDeletion}
+	}
+	withdrawal := &directory.PolicyUpdate{Epoch: 4}
+	for _, tc := range []struct {
+		name      string
+		prev, str *directory.SignedTreeRoot
+		want      error
+	}{
+		{"announcement", str(1, 0, false), str(2, 0, false, at(4, 2), at(5, 3)), nil},
+		{"kept announcement", str(2, 0, false, at(4, 2)), str(3, 0, false, at(4, 2)), nil},
+		{"change", str(3, 0, false, at(4, 2), at(5, 3)), str(4, 2, false, at(5, 3)), nil},
+		{"announced withdrawal", str(3, 0, false, withdrawal), func() *directory.SignedTreeRoot {
+			s := str(4, 0, false)
+			s.Policies.Capabilities = 0
+			return s
+		}(), nil},
+		{"missed change", str(3, 0, false, at(4, 2)), str(4, 0, false), protocol.CheckBadPolicySchedule},
+		{"other change", str(3, 0, false, at(4, 2)), str(4, 3, false), protocol.CheckBadPolicySchedule},
+		{"stale announcement", str(1, 0, false), str(2, 0, false, at(2, 2)), protocol.CheckBadPolicySchedule},
+		{"unordered announcements", str(1, 0, false), str(2, 0, false, at(5, 2), at(4, 2)), protocol.CheckBadPolicySchedule},
+		{"silent cancellation", str(2, 0, false, at(4, 2)), str(3, 0, false), protocol.CheckBadPolicySchedule},
+		{"silent change", str(2, 0, false, at(4, 2)), str(3, 0, false, at(4, 3)), protocol.CheckBadPolicySchedule},
+		{"flagged cancellation", str(2, 0, false, at(4, 2)), str(3, 0, true), nil},
+	} {
+		if err := CheckPolicies(tc.prev, tc.str); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestAuditSchedule(t *testing.T) {
+	d := directory.NewTestTree(t)
+	pk := crypto.NewStaticTestSigningKey().Public()
+	if err := d.SchedulePolicy(3, &directory.Config{MinKeyChangeInterval: 2}); err != nil {
+		t.Fatal(err)
+	}
+	aud := New(pk, d.LatestSTR())
+	var strs []*directory.SignedTreeRoot
+	for i := 0; i < 4; i++ {
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+	if err := aud.AuditDirectory(strs); err != nil {
+		t.Error("Expect the announced policy change to pass, got", err)
+	}
+}
+
+func TestCheckApprovals(t *testing.T) {
+	var keys []sign.PrivateKey
+	policy := &directory.Operators{Threshold: 2}
+	for i := 0; i < 3; i++ {
+		k, err := sign.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+		policy.Keys = append(policy.Keys, k.Public())
+	}
+	str := func(epoch merkletree.Epoch, o *directory.Operators, approvers ...sign.PrivateKey) *directory.SignedTreeRoot {
+		s := &directory.SignedTreeRoot{
+			SignedTreeRoot: &merkletree.SignedTreeRoot{Epoch: epoch},
+			Policies:       &directory.Config{Operators: o},
+		}
+		s.TreeHash[0] = byte(epoch)
+		for _, k := range approvers {
+			s.Policies.Approvals = append(s.Policies.Approvals, s.Proposal().Approve(k))
+		}
+		return s
+	}
+	other, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := str(2, policy, keys[0], keys[1])
+	forged.TreeHash[1] = 1
+	for _, tc := range []struct {
+		name      string
+		prev, str *directory.SignedTreeRoot
+		want      error
+	}{
+		{"not co-managed", str(1, nil), str(2, nil), nil},
+		{"introduction", str(1, nil), str(2, policy, keys[0], keys[2]), nil},
+		{"approved", str(1, policy), str(2, policy, keys[1], keys[2]), nil},
+		{"approved removal", str(1, policy), str(2, nil, keys[0], keys[1]), nil},
+		{"unapproved introduction", str(1, nil), str(2, policy, keys[0]), protocol.CheckBadApproval},
+		{"unapproved", str(1, policy), str(2, policy), protocol.CheckBadApproval},
+		{"repeated approval", str(1, policy), str(2, policy, keys[0], keys[0]), protocol.CheckBadApproval},
+		{"approval by other", str(1, policy), str(2, policy, keys[0], other), protocol.CheckBadApproval},
+		{"approval of other root", str(1, policy), forged, protocol.CheckBadApproval},
+		{"unapproved removal", str(1, policy), str(2, nil), protocol.CheckBadApproval},
+	} {
+		if err := CheckPolicies(tc.prev, tc.str); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestAuditCoManaged(t *testing.T) {
+	d := directory.NewTestTree(t)
+	pk := crypto.NewStaticTestSigningKey().Public()
+	operator, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetOperators(&directory.Operators{Keys: []sign.PublicKey{operator.Public()}, Threshold: 1}); err != nil {
+		t.Fatal(err)
+	}
+	aud := New(pk, d.LatestSTR())
+	var strs []*directory.SignedTreeRoot
+	for i := 0; i < 3; i++ {
+		p, err := d.Propose()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Approve(p.Approve(operator)); err != nil {
+			t.Fatal(err)
+		}
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+	if err := aud.AuditDirectory(strs); err != nil {
+		t.Error("Expect the approved STRs to pass, got", err)
+	}
+}
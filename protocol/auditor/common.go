@@ -1,21 +1,19 @@
 package auditor
 
 import (
-	"fmt"
-
 	"github.com/ORBAT/cloniks/crypto/hashed"
 	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
 )
 
 // ComputeDirectoryIdentity returns the hash of
 // the directory's initial STR as a byte array.
-// It panics if the STR isn't an initial STR (i.e. str.Epoch != 0).
-func ComputeDirectoryIdentity(str *directory.SignedTreeRoot) [hashed.HashSizeByte]byte {
-	if str.Epoch != 0 {
-		panic(fmt.Sprintf("[coniks] Expect epoch 0, got %x", str.Epoch))
+// It returns protocol.ErrMalformedMessage if str isn't a well-formed
+// genesis STR (see merkletree.SignedTreeRoot.IsGenesis).
+func ComputeDirectoryIdentity(str *directory.SignedTreeRoot) ([hashed.HashSizeByte]byte, error) {
+	if !str.IsGenesis() {
+		return [hashed.HashSizeByte]byte{}, protocol.ErrMalformedMessage
 	}
 
-	var initSTRHash [hashed.HashSizeByte]byte
-	copy(initSTRHash[:], hashed.Digest(str.Signature))
-	return initSTRHash
+	return hashed.Sum(str.Signature[:]), nil
 }
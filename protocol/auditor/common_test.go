@@ -1,49 +1,37 @@
 package auditor
 
 import (
-	"bytes"
-	"encoding/hex"
 	"testing"
 
+	"github.com/ORBAT/cloniks/crypto/hashed"
 	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
 )
 
 func TestComputeDirectoryIdentity(t *testing.T) {
-	// TODO:
-	t.Skip("figure out test vector for this")
 	d := directory.NewTestTree(t)
 	str0 := d.LatestSTR()
 	d.Update()
 	str1 := d.LatestSTR()
+	forged := *str0.SignedTreeRoot
+	forged.PreviousSTRHash[0] ^= 1
 
 	for _, tc := range []struct {
 		name string
 		str  *directory.SignedTreeRoot
-		want []byte
+		want error
 	}{
-		{"normal", str0, hex2bin("fd0584f79054f8113f21e5450e0ad21c9221fc159334c7bc1644e3e2a0fb5060")},
-		{"panic", str1, []byte{}},
+		{"genesis", str0, nil},
+		{"later epoch", str1, protocol.ErrMalformedMessage},
+		{"previous hash", &directory.SignedTreeRoot{SignedTreeRoot: &forged, Policies: str0.Policies},
+			protocol.ErrMalformedMessage},
 	} {
-		t.Run(tc.name, func(t *testing.T) {
-			if tc.name == "panic" {
-				defer func() {
-					if r := recover(); r == nil {
-						t.Errorf("The code did not panic")
-					}
-				}()
-			}
-			if got, want := ComputeDirectoryIdentity(tc.str), tc.want; !bytes.Equal(got[:], want) {
-				t.Errorf("ComputeDirectoryIdentity() = %x, want %x", got, want)
-			}
-		})
+		id, err := ComputeDirectoryIdentity(tc.str)
+		if err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+		if err == nil && id != hashed.Sum(tc.str.Signature[:]) {
+			t.Errorf("%s: expect the hash of the signature, got %x", tc.name, id)
+		}
 	}
 }
-
-// decode hex string to byte array
-func hex2bin(h string) []byte {
-	result, err := hex.DecodeString(h)
-	if err != nil {
-		panic(err)
-	}
-	return result
-}
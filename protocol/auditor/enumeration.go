@@ -0,0 +1,316 @@
+package auditor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ProbeZBound is the absolute value of the test statistics above which
+// ProbeEnumeration reports a finding. An honest directory exceeds it
+// with a probability of roughly 6*10^-5 per statistic.
+const ProbeZBound = 4
+
+// probeBits is the number of index bits below its level that
+// ProbeEnumeration counts for each user leaf revealed by a proof of
+// absence.
+const probeBits = 32
+
+// A SendFunc sends a request to a CONIKS directory and returns its
+// response, like the Send method of a client.Transport.
+type SendFunc func(ctx context.Context, req *directory.Request) (*directory.Response, error)
+
+// A ProbeConfig configures ProbeEnumeration.
+type ProbeConfig struct {
+	// Lookups is the number of random names to look up.
+	Lookups int
+	// Known are names the auditor knows to be registered, e.g. because
+	// it registered them itself. They're looked up in turn between the
+	// random names, so that the latencies of the two can be compared.
+	// Without them, latencies aren't compared.
+	Known []string
+	// Rand is the source of the random names. It defaults to
+	// crypto/rand.Reader.
+	Rand io.Reader
+	// NewName, if set, returns a random name instead of one read from
+	// Rand. A directory may recognize the default names, which are
+	// hex-encoded, and treat them differently from real ones.
+	NewName func() (string, error)
+
+	now func() time.Time
+}
+
+func (c *ProbeConfig) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *ProbeConfig) name() (string, error) {
+	if c.NewName != nil {
+		return c.NewName()
+	}
+	r := c.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	bs := make([]byte, 16)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// An EnumerationReport is the result of ProbeEnumeration.
+type EnumerationReport struct {
+	// Epoch is the epoch of the last STR the directory responded with.
+	Epoch merkletree.Epoch
+	// Lookups is the number of random names looked up, and Empty,
+	// Conflicts and Registered the number of them whose proofs ended in
+	// an empty node, ended in another user's leaf, or were proofs of
+	// inclusion.
+	Lookups, Empty, Conflicts, Registered int
+	// Attachments is the number of proofs of absence that came with a
+	// temporary binding, revocation or tombstone.
+	Attachments int
+	// Bits is the number of index bits of the revealed user leaves below
+	// their level, OneBits the number of them that are set, and BitBias
+	// the z-score of OneBits. The indices of a directory's users are
+	// uniformly distributed, so these bits reveal nothing about which
+	// names are registered unless they're biased.
+	Bits, OneBits int
+	BitBias       float64
+	// AbsentLatency and KnownLatency are the mean latencies of the
+	// lookups of random and known names, and LatencyT the Welch's
+	// t statistic of their difference. They're only set if the
+	// ProbeConfig had Known names.
+	AbsentLatency, KnownLatency time.Duration
+	LatencyT                    float64
+	// Findings describes the results that exceed ProbeZBound, and any
+	// other sign that the directory leaks registered names.
+	Findings []string
+}
+
+// Passed returns true iff r has no findings.
+func (r *EnumerationReport) Passed() bool {
+	return len(r.Findings) == 0
+}
+
+// String returns a human-readable report.
+func (r *EnumerationReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Enumeration probe at epoch %d: %d lookups\n", r.Epoch, r.Lookups)
+	fmt.Fprintf(&b, "  proofs of absence: %d empty, %d conflicting; registered: %d\n",
+		r.Empty, r.Conflicts, r.Registered)
+	fmt.Fprintf(&b, "  revealed index bits: %d of %d set (z = %.2f)\n", r.OneBits, r.Bits, r.BitBias)
+	if r.KnownLatency != 0 {
+		fmt.Fprintf(&b, "  mean latency: %v absent, %v known (t = %.2f)\n",
+			r.AbsentLatency, r.KnownLatency, r.LatencyT)
+	}
+	if r.Passed() {
+		b.WriteString("  PASSED\n")
+		return b.String()
+	}
+	for _, f := range r.Findings {
+		fmt.Fprintf(&b, "  FINDING: %s\n", f)
+	}
+	return b.String()
+}
+
+// ProbeEnumeration looks up cfg.Lookups random names, which are almost
+// certainly not registered, in the directory send sends requests to,
+// and checks statistically that the responses don't leak which names
+// are registered beyond what the protocol allows: that the user leaves
+// revealed by proofs of absence have uniformly distributed indices,
+// that proofs of absence come with nothing else, and that lookups of
+// registered names don't take longer or shorter than others.
+//
+// Every response must carry a valid proof for its name under an STR
+// that passes CheckSTRAgainstVerified; a's verified STR is updated as
+// the directory moves on. ProbeEnumeration returns the error of send,
+// the error code of a response other than ReqSuccess or ReqNameNotFound,
+// protocol.ErrMalformedMessage for a response without exactly one
+// proof and STR, or the consistency check error of the first invalid
+// response. The statistics are only meaningful for at least a few
+// hundred lookups in a directory with more users than that.
+func (a *AudState) ProbeEnumeration(ctx context.Context, send SendFunc, cfg ProbeConfig) (*EnumerationReport, error) {
+	r := &EnumerationReport{}
+	var absent, known []float64
+	for i := 0; i < cfg.Lookups; i++ {
+		name, err := cfg.name()
+		if err != nil {
+			return nil, err
+		}
+		df, latency, err := a.probe(ctx, send, &cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		absent = append(absent, latency)
+		r.add(df)
+
+		if len(cfg.Known) == 0 {
+			continue
+		}
+		name = cfg.Known[i%len(cfg.Known)]
+		df, latency, err = a.probe(ctx, send, &cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		if df.AP[0].ProofType() != merkletree.ProofOfInclusion {
+			r.Findings = append(r.Findings, fmt.Sprintf("known name %q isn't registered", name))
+		}
+		known = append(known, latency)
+	}
+	r.Epoch = a.verifiedSTR.Epoch
+	r.finish(absent, known)
+	return r, nil
+}
+
+// finish computes the statistics of r from the latencies of the lookups
+// of random and known names, and adds its findings.
+func (r *EnumerationReport) finish(absent, known []float64) {
+	if r.Attachments > 0 {
+		r.Findings = append(r.Findings,
+			fmt.Sprintf("%d proofs of absence came with other data", r.Attachments))
+	}
+	if r.Bits > 0 {
+		r.BitBias = (float64(r.OneBits) - float64(r.Bits)/2) / math.Sqrt(float64(r.Bits)/4)
+		if math.Abs(r.BitBias) > ProbeZBound {
+			r.Findings = append(r.Findings,
+				fmt.Sprintf("the indices of revealed user leaves are biased (z = %.2f)", r.BitBias))
+		}
+	}
+	if len(known) > 1 && len(absent) > 1 {
+		ma, va := meanVariance(absent)
+		mk, vk := meanVariance(known)
+		r.AbsentLatency, r.KnownLatency = time.Duration(ma), time.Duration(mk)
+		r.LatencyT = welchT(mk, vk, len(known), ma, va, len(absent))
+		if math.Abs(r.LatencyT) > ProbeZBound {
+			r.Findings = append(r.Findings,
+				fmt.Sprintf("lookups of registered names take %v instead of %v (t = %.2f)",
+					r.KnownLatency, r.AbsentLatency, r.LatencyT))
+		}
+	}
+}
+
+// probe looks up name, verifies the response, and returns its proof and
+// how long it took in nanoseconds.
+func (a *AudState) probe(ctx context.Context, send SendFunc, cfg *ProbeConfig,
+	name string) (*directory.DirectoryProof, float64, error) {
+	start := cfg.clock()
+	res, err := send(ctx, &directory.Request{
+		Type:    directory.KeyLookupType,
+		Request: &directory.KeyLookupRequest{Username: name},
+	})
+	latency := float64(cfg.clock().Sub(start))
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.Error != protocol.ReqSuccess && res.Error != protocol.ReqNameNotFound {
+		return nil, 0, res.Error
+	}
+	df, ok := res.DirectoryResponse.(*directory.DirectoryProof)
+	if !ok || len(df.AP) != 1 || len(df.STR) != 1 || df.AP[0] == nil || df.AP[0].Leaf == nil {
+		return nil, 0, protocol.ErrMalformedMessage
+	}
+	str := df.STR[0]
+	if err := a.CheckSTRAgainstVerified(str); err != nil {
+		return nil, 0, err
+	}
+	a.Update(str)
+	if err := verifyProof(name, df.AP[0], str); err != nil {
+		return nil, 0, err
+	}
+	return df, latency, nil
+}
+
+// add counts the proof of a random name in r.
+func (r *EnumerationReport) add(df *directory.DirectoryProof) {
+	r.Lookups++
+	ap := df.AP[0]
+	switch ap.ProofType() {
+	case merkletree.ProofOfInclusion:
+		r.Registered++
+		return
+	case merkletree.ProofOfAbsenceEmpty:
+		r.Empty++
+	case merkletree.ProofOfAbsenceConflict:
+		r.Conflicts++
+		// the bits below the leaf's level aren't determined by the
+		// structure of the tree
+		end := ap.Leaf.Level + probeBits
+		if max := uint32(len(ap.Leaf.Index) * 8); end > max {
+			end = max
+		}
+		for i := ap.Leaf.Level; i < end; i++ {
+			r.Bits++
+			if conv.GetNthBit(ap.Leaf.Index, i) {
+				r.OneBits++
+			}
+		}
+	}
+	if df.TB != nil || df.Revocation != nil || df.Deletion != nil {
+		r.Attachments++
+	}
+}
+
+// verifyProof verifies that ap is a valid proof of inclusion or absence
+// of uname in the tree committed to by str, like client.VerifyAuthPath.
+func verifyProof(uname string, ap *merkletree.AuthenticationPath, str *directory.SignedTreeRoot) error {
+	if len(ap.LookupIndex) != int(str.Policies.IndexSize) {
+		return protocol.CheckBadLookupIndex
+	}
+	if !str.Policies.VerifyIndex([]byte(uname), ap.LookupIndex, ap.VrfProof) {
+		return protocol.CheckBadVRFProof
+	}
+	if err := str.VerifyDepth(ap); err != nil {
+		return protocol.CheckBadTreeDepth
+	}
+	switch err := ap.Verify([]byte(uname), ap.Leaf.Value, str.TreeHash[:]); err {
+	case nil:
+		return nil
+	case merkletree.ErrBindingsDiffer:
+		return protocol.CheckBindingsDiffer
+	case merkletree.ErrUnverifiableCommitment:
+		return protocol.CheckBadCommitment
+	case merkletree.ErrIndicesMismatch:
+		return protocol.CheckBadLookupIndex
+	default:
+		return protocol.CheckBadAuthPath
+	}
+}
+
+func meanVariance(xs []float64) (mean, variance float64) {
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	for _, x := range xs {
+		variance += (x - mean) * (x - mean)
+	}
+	return mean, variance / float64(len(xs)-1)
+}
+
+// welchT returns Welch's t statistic of the difference of the means of
+// two samples.
+func welchT(m1, v1 float64, n1 int, m2, v2 float64, n2 int) float64 {
+	se := math.Sqrt(v1/float64(n1) + v2/float64(n2))
+	switch {
+	case m1 == m2:
+		return 0
+	case se == 0:
+		return math.Copysign(math.Inf(1), m1-m2)
+	}
+	return (m1 - m2) / se
+}
@@ -0,0 +1,147 @@
+package auditor
+
+import (
+	"context"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// probedTree returns a directory with n registered users, the names of
+// some of them, and a SendFunc for it that advances the clock of cfg by
+// a millisecond per lookup, and by extra(res) more if extra isn't nil.
+func probedTree(t *testing.T, n int, cfg *ProbeConfig,
+	extra func(res *directory.Response) time.Duration) (*directory.Tree, []string, SendFunc) {
+	d := directory.NewTestTree(t)
+	var known []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%d", i)
+		if _, err := d.Register(name, []byte("key")); err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 0 {
+			known = append(known, name)
+		}
+	}
+	d.Update()
+
+	now := time.Unix(0, 0)
+	cfg.now = func() time.Time { return now }
+	cfg.Rand = mrand.New(mrand.NewSource(1))
+	send := func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		res := d.HandleRequest(req)
+		now = now.Add(time.Millisecond)
+		if extra != nil {
+			now = now.Add(extra(res))
+		}
+		return res, nil
+	}
+	return d, known, send
+}
+
+func TestProbeEnumeration(t *testing.T) {
+	var cfg ProbeConfig
+	d, known, send := probedTree(t, 300, &cfg, nil)
+	cfg.Lookups, cfg.Known = 300, known
+	aud := New(staticSigningKey.Public(), d.LatestSTR())
+	r, err := aud.ProbeEnumeration(context.Background(), send, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Passed() {
+		t.Fatalf("Expect an honest directory to pass, got\n%s", r)
+	}
+	if r.Lookups != 300 || r.Empty+r.Conflicts != 300 || r.Conflicts == 0 || r.Bits == 0 {
+		t.Errorf("Unexpected counts in\n%s", r)
+	}
+	if r.Epoch != d.LatestSTR().Epoch || r.KnownLatency != time.Millisecond {
+		t.Errorf("Unexpected epoch or latency in\n%s", r)
+	}
+	if !strings.Contains(r.String(), "PASSED") {
+		t.Errorf("Expect the report to say it passed, got\n%s", r)
+	}
+}
+
+func TestProbeEnumerationTiming(t *testing.T) {
+	var cfg ProbeConfig
+	// registered names take a bit longer, most of the time
+	jitter := mrand.New(mrand.NewSource(2))
+	d, known, send := probedTree(t, 100, &cfg, func(res *directory.Response) time.Duration {
+		if res.Error == protocol.ReqSuccess && jitter.Intn(4) != 0 {
+			return time.Millisecond
+		}
+		return 0
+	})
+	aud := New(staticSigningKey.Public(), d.LatestSTR())
+	cfg.Lookups, cfg.Known = 100, known
+	r, err := aud.ProbeEnumeration(context.Background(), send, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Passed() || r.LatencyT < ProbeZBound {
+		t.Fatalf("Expect a timing finding, got\n%s", r)
+	}
+}
+
+func TestProbeEnumerationAttachments(t *testing.T) {
+	var cfg ProbeConfig
+	d, _, send := probedTree(t, 10, &cfg, nil)
+	aud := New(staticSigningKey.Public(), d.LatestSTR())
+	attaching := func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		res, err := send(ctx, req)
+		res.DirectoryResponse.(*directory.DirectoryProof).TB = &directory.TemporaryBinding{}
+		return res, err
+	}
+	cfg.Lookups = 5
+	r, err := aud.ProbeEnumeration(context.Background(), attaching, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Attachments != 5 || r.Passed() {
+		t.Fatalf("Expect 5 attachments, got\n%s", r)
+	}
+}
+
+func TestProbeEnumerationBadProof(t *testing.T) {
+	var cfg ProbeConfig
+	d, _, send := probedTree(t, 10, &cfg, nil)
+	aud := New(staticSigningKey.Public(), d.LatestSTR())
+	forging := func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		res, err := send(ctx, req)
+		ap := *res.DirectoryResponse.(*directory.DirectoryProof).AP[0]
+		ap.VrfProof = append([]byte{}, ap.VrfProof...)
+		ap.VrfProof[0]++
+		res.DirectoryResponse.(*directory.DirectoryProof).AP[0] = &ap
+		return res, err
+	}
+	cfg.Lookups = 1
+	if _, err := aud.ProbeEnumeration(context.Background(), forging, cfg); err != protocol.CheckBadVRFProof {
+		t.Errorf("Expect %v, got %v", protocol.CheckBadVRFProof, err)
+	}
+}
+
+func TestEnumerationReportBias(t *testing.T) {
+	// the revealed leaves all have indices with set bits
+	index := make(merkletree.Index, merkletree.MinIndexSize)
+	for i := range index {
+		index[i] = 0xff
+	}
+	df := &directory.DirectoryProof{AP: []*merkletree.AuthenticationPath{{
+		LookupIndex: make(merkletree.Index, merkletree.MinIndexSize),
+		Leaf:        &merkletree.ProofNode{Level: 1, Index: index},
+	}}}
+	r := &EnumerationReport{}
+	for i := 0; i < 10; i++ {
+		r.add(df)
+	}
+	r.finish(nil, nil)
+	if r.Conflicts != 10 || r.Bits != 10*probeBits || r.OneBits != r.Bits || r.Passed() {
+		t.Fatalf("Expect biased indices, got\n%s", r)
+	}
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrNoQuorum indicates that fewer of the trusted auditors than required
+// attested to a Rollup.
+var ErrNoQuorum = errors.New("[client] Not enough auditors attested to the rollup")
+
+// Bootstrap creates the ConsistencyChecks of a new client of the
+// directory with the public signing key signKey from the directory's
+// Rollup r, instead of from the directory's initial STR. The client
+// then verifies the directory's responses starting from r.STR, without
+// having downloaded the STR history before it.
+//
+// Since the client can't check the history r commits to by itself,
+// Bootstrap only accepts r if at least quorum of the auditors with the
+// public keys auditors attested to it in atts. Each auditor counts
+// once, and attestations of other auditors are ignored. Bootstrap
+// returns CheckBadSignature if the directory's signature of r or r.STR
+// is invalid, and ErrNoQuorum if quorum isn't positive or there are too
+// few valid attestations.
+func Bootstrap(r *directory.Rollup, atts []directory.Attestation, signKey sign.PublicKey,
+	auditors []sign.PublicKey, quorum int) (*ConsistencyChecks, error) {
+	if r.STR == nil {
+		return nil, protocol.ErrMalformedMessage
+	}
+	if !signKey.Verify(r.Bytes(), r.Signature[:]) || !signKey.Verify(r.STR.Bytes(), r.STR.Signature[:]) {
+		return nil, protocol.CheckBadSignature
+	}
+	if quorum < 1 || countAttestations(r.AttestationBytes(), atts, auditors) < quorum {
+		return nil, ErrNoQuorum
+	}
+	return New(r.STR, true, signKey), nil
+}
+
+// countAttestations returns the number of auditors whose attestation of
+// msg is in atts.
+func countAttestations(msg []byte, atts []directory.Attestation, auditors []sign.PublicKey) int {
+	attested := make(map[string]bool)
+	for _, auditor := range auditors {
+		if attested[string(auditor)] {
+			continue
+		}
+		for _, att := range atts {
+			if bytes.Equal(att.Auditor, auditor) && auditor.Verify(msg, att.Signature[:]) {
+				attested[string(auditor)] = true
+				break
+			}
+		}
+	}
+	return len(attested)
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/auditlog"
+)
+
+func TestNewFromGenesis(t *testing.T) {
+	d := directory.NewTestTree(t)
+	genesis := d.LatestSTR()
+	d.Update()
+	otherKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := NewFromGenesis(genesis, staticSigningKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.CheckSTRAgainstVerified(d.LatestSTR()); err != nil {
+		t.Error("Expect the client to accept the STR after the genesis STR, got", err)
+	}
+	for _, tc := range []struct {
+		name string
+		str  *directory.SignedTreeRoot
+		key  sign.PublicKey
+		want error
+	}{
+		{"later STR", d.LatestSTR(), staticSigningKey.Public(), protocol.ErrMalformedMessage},
+		{"other key", genesis, otherKey.Public(), protocol.CheckBadSignature},
+		{"nil", nil, staticSigningKey.Public(), protocol.ErrMalformedMessage},
+	} {
+		if _, err := NewFromGenesis(tc.str, tc.key); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	d, _ := monitored(t, 20)
+	aud := auditlog.New()
+	history := d.GetSTRHistory(&directory.STRHistoryRequest{EndEpoch: d.LatestSTR().Epoch}).
+		DirectoryResponse.(*directory.STRHistoryRange).STR
+	if err := aud.InitHistory("test-server", staticSigningKey.Public(), history); err != nil {
+		t.Fatal(err)
+	}
+
+	r := d.HandleRequest(&directory.Request{Type: directory.RollupType, Request: &directory.RollupRequest{}}).
+		DirectoryResponse.(*directory.Rollup)
+	var auditors []sign.PublicKey
+	var atts []directory.Attestation
+	for i := 0; i < 3; i++ {
+		key, err := sign.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auditors = append(auditors, key.Public())
+		if i < 2 {
+			att, err := aud.AttestRollup(r, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			atts = append(atts, *att)
+		}
+	}
+
+	// the same auditor only counts once
+	if _, err := Bootstrap(r, []directory.Attestation{atts[0], atts[0]}, staticSigningKey.Public(),
+		auditors, 2); err != ErrNoQuorum {
+		t.Error("Expect", ErrNoQuorum, "got", err)
+	}
+	// and only trusted auditors count
+	if _, err := Bootstrap(r, atts, staticSigningKey.Public(), auditors[1:], 2); err != ErrNoQuorum {
+		t.Error("Expect", ErrNoQuorum, "got", err)
+	}
+	forged := *r
+	forged.ListRoot[0]++
+	if _, err := Bootstrap(&forged, atts, staticSigningKey.Public(), auditors, 2); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+
+	cc, err := Bootstrap(r, atts, staticSigningKey.Public(), auditors, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.VerifiedSTR().Epoch != d.LatestSTR().Epoch {
+		t.Fatal("Expect the client to start from the latest epoch, got", cc.VerifiedSTR().Epoch)
+	}
+	d.Update()
+	if err := cc.HandleResponse(directory.KeyLookupType, d.KeyLookup(&directory.KeyLookupRequest{Username: alice}),
+		alice, key); err != nil {
+		t.Error(err)
+	}
+}
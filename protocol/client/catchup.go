@@ -0,0 +1,42 @@
+package client
+
+import (
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// CatchUp verifies the directory's response msg to the STRSkipRequest
+// req, which lets a client that went offline for many epochs catch up
+// by verifying a logarithmic number of STRs instead of all of them.
+// req.StartEpoch must be the epoch of the client's verified STR.
+//
+// CatchUp verifies the signature of every STR in msg, and that each of
+// them links to the one before it, and the first one to the verified
+// STR. If they do, the client's verified STR is updated to the latest
+// STR in msg. Note that CatchUp doesn't verify any bindings in the
+// skipped epochs; it only establishes that the latest STR extends the
+// hash chain the client has verified so far.
+func (cc *ConsistencyChecks) CatchUp(req *directory.STRSkipRequest, msg *directory.Response) error {
+	return cc.alert(cc.catchUp(req, msg), "")
+}
+
+func (cc *ConsistencyChecks) catchUp(req *directory.STRSkipRequest, msg *directory.Response) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	if req.StartEpoch != cc.VerifiedSTR().Epoch {
+		return protocol.ErrMalformedMessage
+	}
+	strs, ok := msg.DirectoryResponse.(*directory.STRHistoryRange)
+	if !ok || msg.Error != protocol.ReqSuccess {
+		return protocol.ErrMalformedMessage
+	}
+	if len(strs.STR) == 0 {
+		return nil
+	}
+	if err := cc.VerifySTRSkips(cc.VerifiedSTR(), strs.STR); err != nil {
+		return err
+	}
+	cc.Update(strs.STR[len(strs.STR)-1])
+	return nil
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestCatchUp(t *testing.T) {
+	d, cc := monitored(t, 60)
+	req := &directory.STRSkipRequest{StartEpoch: 1, EndEpoch: 100}
+	msg := d.HandleRequest(&directory.Request{Type: directory.STRSkipType, Request: req})
+	strs := msg.DirectoryResponse.(*directory.STRHistoryRange).STR
+	if len(strs) != len(merkletree.SkipPath(1, 61)) || len(strs) > 10 {
+		t.Fatal("Expect a short path to epoch 61, got", len(strs), "STRs")
+	}
+
+	// a path missing an STR doesn't link
+	broken := directory.NewSTRHistoryRange(append(strs[:1:1], strs[2:]...))
+	if err := cc.CatchUp(req, broken); err != protocol.CheckBadSTR {
+		t.Error("Expect", protocol.CheckBadSTR, "got", err)
+	}
+	// nor does one with a forged STR
+	forged := *strs[1].SignedTreeRoot
+	forged.Signature[0]++
+	tampered := append([]*directory.SignedTreeRoot{}, strs...)
+	tampered[1] = directory.NewDirSTR(&forged)
+	if err := cc.CatchUp(req, directory.NewSTRHistoryRange(tampered)); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+	if cc.VerifiedSTR().Epoch != 1 {
+		t.Fatal("Expect the verified STR to be unchanged, got epoch", cc.VerifiedSTR().Epoch)
+	}
+
+	if err := cc.CatchUp(req, msg); err != nil {
+		t.Fatal(err)
+	}
+	if cc.VerifiedSTR().Epoch != 61 {
+		t.Fatal("Expect verified epoch 61, got", cc.VerifiedSTR().Epoch)
+	}
+
+	// the client must be up to date with the request
+	if err := cc.CatchUp(req, msg); err != protocol.ErrMalformedMessage {
+		t.Error("Expect", protocol.ErrMalformedMessage, "got", err)
+	}
+	// and the monitoring proofs after catching up are checked against
+	// the latest STR
+	d.Update()
+	if err := cc.HandleResponse(directory.MonitoringType, monitor(d, 62), alice, key); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+)
+
+// The names of the built-in checks HandleResponse runs on every
+// response, in this order.
+const (
+	// CheckSTRs audits the STRs of the response against the verified
+	// STR, and makes the latest of them the verified STR.
+	CheckSTRs = "strs"
+	// CheckProofs verifies the authentication paths of the response.
+	CheckProofs = "proofs"
+	// CheckPromises verifies the temporary bindings of the response,
+	// and that the directory kept the earlier ones.
+	CheckPromises = "promises"
+)
+
+var (
+	// ErrDuplicateCheck indicates that a check with the same name is
+	// already in the pipeline.
+	ErrDuplicateCheck = errors.New("[client] A check with the same name already exists")
+)
+
+// A CheckFunc checks a directory response that the checks before it in
+// the pipeline have verified, e.g. to enforce a policy on the format of
+// keys. It returns an error if the response must be rejected.
+type CheckFunc func(v *Verified) error
+
+// Verified is a directory response to a request of the client, as given
+// to a CheckFunc.
+type Verified struct {
+	// RequestType is the type of the request, e.g.
+	// directory.KeyLookupType.
+	RequestType int
+	// Username is the username the request was for.
+	Username string
+	// Key is the key the client expected the username to be bound to,
+	// or nil if it trusts the key in the response on first use.
+	Key []byte
+	// Response is the response of the directory.
+	Response *directory.Response
+	// Proof is the DirectoryProof of Response.
+	Proof *directory.DirectoryProof
+}
+
+// Value returns the key the response binds the username to: the value
+// of the last authentication path if it's a proof of inclusion, or that
+// of the temporary binding otherwise. It returns nil if the username
+// isn't bound to any key.
+func (v *Verified) Value() []byte {
+	if len(v.Proof.AP) > 0 {
+		if ap := v.Proof.AP[len(v.Proof.AP)-1]; ap.ProofType() == merkletree.ProofOfInclusion {
+			return ap.Leaf.Value
+		}
+	}
+	if v.Proof.TB != nil {
+		return v.Proof.TB.Value
+	}
+	return nil
+}
+
+// A CheckError is the error of the check Name, other than a built-in
+// one, for a response.
+type CheckError struct {
+	Name string
+	Err  error
+}
+
+func (e CheckError) Error() string {
+	return "[client] check " + e.Name + " failed: " + e.Err.Error()
+}
+
+func (e CheckError) Unwrap() error {
+	return e.Err
+}
+
+// A check is a named stage of the pipeline HandleResponse runs.
+type check struct {
+	name string
+	run  func(cc *ConsistencyChecks, v *Verified) error
+}
+
+// builtinChecks are the checks every response goes through before the
+// ones added with AddCheck.
+var builtinChecks = []check{
+	{CheckSTRs, func(cc *ConsistencyChecks, v *Verified) error {
+		return cc.updateSTR(v.RequestType, v.Response)
+	}},
+	{CheckProofs, func(cc *ConsistencyChecks, v *Verified) error {
+		return cc.checkConsistency(v.RequestType, v.Response, v.Username, v.Key)
+	}},
+	{CheckPromises, func(cc *ConsistencyChecks, v *Verified) error {
+		return cc.updateTBs(v.RequestType, v.Response, v.Username, v.Key)
+	}},
+}
+
+// AddCheck appends the check f named name to the pipeline HandleResponse
+// runs on every response, after the built-in checks and the checks added
+// before it, so f only sees responses all of them have accepted.
+// If f returns an error, HandleResponse returns it as a CheckError, and
+// doesn't record the binding in the response as verified, nor any other
+// state the response would have changed, such as the verified STR.
+// AddCheck returns ErrDuplicateCheck if the pipeline already has a check
+// named name.
+func (cc *ConsistencyChecks) AddCheck(name string, f CheckFunc) error {
+	for _, n := range cc.Checks() {
+		if n == name {
+			return ErrDuplicateCheck
+		}
+	}
+	cc.checks = append(cc.checks, check{name, func(cc *ConsistencyChecks, v *Verified) error {
+		if err := f(v); err != nil {
+			return CheckError{Name: name, Err: err}
+		}
+		return nil
+	}})
+	return nil
+}
+
+// Checks returns the names of the checks in the pipeline HandleResponse
+// runs, in order.
+func (cc *ConsistencyChecks) Checks() []string {
+	names := make([]string, 0, len(builtinChecks)+len(cc.checks))
+	for _, c := range builtinChecks {
+		names = append(names, c.name)
+	}
+	for _, c := range cc.checks {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// runChecks runs v through the pipeline, stopping at the first error.
+// The built-in checks update the verified STR and the TBs of cc as they
+// go, so that the checks after them see the new state, but cc only keeps
+// it if every check accepts v: otherwise runChecks restores the state cc
+// had before.
+func (cc *ConsistencyChecks) runChecks(v *Verified) error {
+	saved := cc.checkpoint(v.Username)
+	for _, c := range builtinChecks {
+		if err := c.run(cc, v); err != nil {
+			cc.restore(v.Username, saved)
+			return err
+		}
+	}
+	for _, c := range cc.checks {
+		if err := c.run(cc, v); err != nil {
+			cc.restore(v.Username, saved)
+			return err
+		}
+	}
+	return nil
+}
+
+// A checkpoint is the state of a ConsistencyChecks that the built-in
+// checks change when they verify a response for one username.
+type checkpoint struct {
+	aud      auditor.AudState
+	tb       *directory.TemporaryBinding
+	tbSTR    sign.Signature
+	deletion *directory.Deletion
+}
+
+func (cc *ConsistencyChecks) checkpoint(uname string) checkpoint {
+	return checkpoint{
+		aud:      *cc.AudState,
+		tb:       cc.TBs[uname],
+		tbSTR:    cc.TBSTRs[uname],
+		deletion: cc.Deletions[uname],
+	}
+}
+
+// restore reverts the state of cc for uname to the checkpoint c.
+func (cc *ConsistencyChecks) restore(uname string, c checkpoint) {
+	*cc.AudState = c.aud
+	if c.tb != nil {
+		cc.setTB(uname, c.tb, c.tbSTR)
+	} else if cc.TBs != nil {
+		cc.deleteTB(uname)
+	}
+	if c.deletion != nil {
+		cc.Deletions[uname] = c.deletion
+	} else {
+		delete(cc.Deletions, uname)
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+var errShortKey = errors.New("keys must be at least 4 bytes")
+
+func TestAddCheck(t *testing.T) {
+	d, cc := monitored(t, 0)
+	var seen []*Verified
+	if err := cc.AddCheck("key format", func(v *Verified) error {
+		seen = append(seen, v)
+		if len(v.Value()) < 4 {
+			return errShortKey
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.AddCheck(CheckProofs, func(*Verified) error { return nil }); err != ErrDuplicateCheck {
+		t.Fatal("Expect", ErrDuplicateCheck, "got", err)
+	}
+	if want := []string{CheckSTRs, CheckProofs, CheckPromises, "key format"}; !reflect.DeepEqual(cc.Checks(), want) {
+		t.Fatal("Expect checks", want, "got", cc.Checks())
+	}
+
+	// alice was registered before the check was added
+	savedSTR, tb := cc.VerifiedSTR(), cc.TBs[alice]
+	if tb == nil {
+		t.Fatal("Expect a TB for alice")
+	}
+	d.Update()
+	err := cc.HandleResponse(directory.KeyLookupType,
+		d.KeyLookup(&directory.KeyLookupRequest{Username: alice}), alice, key)
+	var checkErr CheckError
+	if !errors.As(err, &checkErr) || checkErr.Name != "key format" || !errors.Is(err, errShortKey) {
+		t.Fatal("Expect the key format check to fail, got", err)
+	}
+	if len(seen) != 1 || !bytes.Equal(seen[0].Value(), key) || seen[0].Proof == nil {
+		t.Fatal("Expect the check to see the verified key")
+	}
+	// the rejected response changed nothing
+	if cc.VerifiedSTR() != savedSTR {
+		t.Error("Expect the verified STR to stay at epoch", savedSTR.Epoch, "got", cc.VerifiedSTR().Epoch)
+	}
+	if cc.TBs[alice] != tb {
+		t.Error("Expect alice's TB to be kept")
+	}
+
+	// built-in checks run first
+	seen = nil
+	forged := d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	forged.DirectoryResponse.(*directory.DirectoryProof).AP[0].Leaf.Value = []byte("other key")
+	if err := cc.HandleResponse(directory.KeyLookupType, forged, alice, key); err != protocol.CheckBindingsDiffer {
+		t.Fatal("Expect", protocol.CheckBindingsDiffer, "got", err)
+	}
+	if len(seen) != 0 {
+		t.Fatal("Expect the check to only see verified responses")
+	}
+
+	bob, bobKey := "bob", []byte("bob's key")
+	resp, err := d.Register(bob, bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), bob, bobKey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seen[0].Value(), bobKey) {
+		t.Fatal("Expect the value of the TB, got", seen[0].Value())
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serverSymbols are the prefixes of the symbols of the server-side code
+// that client builds, i.e. with the coniks_client build tag, must not
+// contain.
+var serverSymbols = map[string][]string{
+	"github.com/ORBAT/cloniks/directory": {
+		"directory.Tree", "directory.(*Tree)", "directory.Open", "directory.New",
+		"directory.(*Session)", "directory.(*Subscription)",
+	},
+	"github.com/ORBAT/cloniks/merkletree": {
+		"merkletree.(*PAD)", "merkletree.NewPAD", "merkletree.(*MerkleTree)",
+		"merkletree.NewMerkleTree", "merkletree.(*ShardedTree)", "merkletree.NewSTR",
+	},
+	"github.com/ORBAT/cloniks/protocol/client": {
+		"client.LocalTransport",
+	},
+}
+
+// serverPackages are the packages with server-side storage, which client
+// builds must not depend on.
+var serverPackages = []string{
+	"github.com/ORBAT/cloniks/merkletree/nodedb",
+	"github.com/ORBAT/cloniks/merkletree/snapshotdb",
+	"github.com/ORBAT/cloniks/merkletree/strdb",
+	"github.com/ORBAT/cloniks/protocol/auditlog",
+}
+
+func goTool(t *testing.T, args ...string) string {
+	out, err := exec.Command("go", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// TestClientBuild checks that the client builds without the server-side
+// tree mutation, storage and scheduling code.
+func TestClientBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds packages with the go tool")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go tool not found")
+	}
+	deps := goTool(t, "list", "-tags", "coniks_client", "-deps", "github.com/ORBAT/cloniks/protocol/client")
+	for _, dep := range strings.Fields(deps) {
+		for _, pkg := range serverPackages {
+			if dep == pkg {
+				t.Error("Expect the client build not to depend on", pkg)
+			}
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "clientbuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for pkg, prefixes := range serverSymbols {
+		archive := filepath.Join(dir, filepath.Base(pkg)+".a")
+		goTool(t, "build", "-tags", "coniks_client", "-o", archive, pkg)
+		for _, line := range strings.Split(goTool(t, "tool", "nm", archive), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			sym := strings.TrimPrefix(fields[len(fields)-1], "github.com/ORBAT/cloniks/")
+			sym = sym[strings.LastIndex(sym, "/")+1:]
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(sym, prefix+".") || sym == prefix {
+					t.Error("Expect the client build of", pkg, "not to contain", sym)
+				}
+			}
+		}
+	}
+}
@@ -7,11 +7,13 @@ package client
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/ORBAT/cloniks/crypto/sign"
 	"github.com/ORBAT/cloniks/directory"
 	"github.com/ORBAT/cloniks/merkletree"
 	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
 	"github.com/ORBAT/cloniks/protocol/auditor"
 )
 
@@ -35,6 +37,57 @@ type ConsistencyChecks struct {
 	// extensions settings
 	useTBs bool
 	TBs    map[string]*directory.TemporaryBinding
+	// TBSTRs are the signatures of the STRs the TBs were issued under,
+	// by username. A client that saves its TBs must save and restore
+	// TBSTRs along with them: without the signature, a TB superseding a
+	// restored one can't be verified, and the promise counts as broken.
+	TBSTRs map[string]sign.Signature
+
+	// Transitions are the key transitions the client expects, by
+	// username. See HandleTransition.
+	Transitions map[string]*directory.KeyTransition
+
+	// Revocations are the revocations of keys the client has seen
+	// attached to responses, by username. See ErrKeyRevoked.
+	Revocations map[string]*directory.Revocation
+
+	// Deletions are the tombstones of deleted bindings the client has
+	// seen, by username. See ErrNameDeleted.
+	Deletions map[string]*directory.Deletion
+
+	// Reattestations are the latest re-attestations of bindings the
+	// client has seen attached to responses, by username. See
+	// ReattestationDue.
+	Reattestations map[string]*directory.Reattestation
+
+	// Alerts receives an alert whenever a check detects directory
+	// misbehavior. It may be nil.
+	Alerts alert.Sink
+
+	// STRCache remembers the STRs whose signatures have been verified.
+	STRCache *STRCache
+
+	// VRFCache remembers the VRF proofs of lookup indices that have
+	// been verified. If it's nil, every proof is verified.
+	VRFCache *VRFCache
+
+	// MonitorParallelism bounds the number of goroutines verifying
+	// the authentication paths of a monitoring response. If it's zero,
+	// GOMAXPROCS goroutines are used.
+	MonitorParallelism int
+
+	// Archive, if set, stores every response that HandleResponse
+	// verified, e.g. so that the user can later show what the directory
+	// served them.
+	Archive Archiver
+
+	// checks are the checks added with AddCheck.
+	checks []check
+}
+
+// An Archiver stores verified directory responses.
+type Archiver interface {
+	Archive(requestType int, uname string, msg *directory.Response) error
 }
 
 // New creates an instance of ConsistencyChecks using
@@ -51,13 +104,36 @@ func New(savedSTR *directory.SignedTreeRoot, useTBs bool, signKey sign.PublicKey
 		Bindings: make(map[string][]byte),
 		useTBs:   useTBs,
 		TBs:      nil,
+		STRCache: NewSTRCache(DefaultSTRCacheSize),
+		VRFCache: NewVRFCache(DefaultVRFCacheSize),
+
+		Transitions: make(map[string]*directory.KeyTransition),
+		Revocations: make(map[string]*directory.Revocation),
+		Deletions:   make(map[string]*directory.Deletion),
+
+		Reattestations: make(map[string]*directory.Reattestation),
 	}
+	a.UseSignatureCache(cc.STRCache)
 	if useTBs {
 		cc.TBs = make(map[string]*directory.TemporaryBinding)
+		cc.TBSTRs = make(map[string]sign.Signature)
 	}
 	return cc
 }
 
+// NewFromGenesis creates the ConsistencyChecks of a new client of the
+// directory with the public signing key signKey from the directory's
+// genesis STR, which the client pins. It returns the error of
+// directory.SignedTreeRoot.VerifyGenesis if genesis isn't the validly
+// signed genesis STR of the directory. Use New to restore the
+// consistency state of a client from persistent storage instead.
+func NewFromGenesis(genesis *directory.SignedTreeRoot, signKey sign.PublicKey) (*ConsistencyChecks, error) {
+	if err := genesis.VerifyGenesis(signKey); err != nil {
+		return nil, err
+	}
+	return New(genesis, true, signKey), nil
+}
+
 // CheckEquivocation checks for possible equivocation between
 // an auditors' observed STRs and the client's own view.
 // CheckEquivocation() first verifies the STR range received
@@ -67,6 +143,10 @@ func New(savedSTR *directory.SignedTreeRoot, useTBs bool, signKey sign.PublicKey
 // CheckEquivocation() is called when a client receives a response to a
 // message.AuditingRequest from an auditor.
 func (cc *ConsistencyChecks) CheckEquivocation(msg *directory.Response) error {
+	return cc.alert(cc.checkEquivocation(msg), "")
+}
+
+func (cc *ConsistencyChecks) checkEquivocation(msg *directory.Response) error {
 	if err := msg.Validate(); err != nil {
 		return err
 	}
@@ -92,7 +172,9 @@ func (cc *ConsistencyChecks) CheckEquivocation(msg *directory.Response) error {
 // If the status code is not in the Errors array, it means
 // the directory has successfully handled the request.
 // The verifier will then check the consistency (i.e. binding validity
-// and non-equivocation) of the response.
+// and non-equivocation) of the response by running it through the
+// pipeline of checks: the built-in ones, i.e. CheckSTRs, CheckProofs and
+// CheckPromises, followed by the ones added with AddCheck().
 //
 // HandleResponse() will panic if it is called with an int
 // that isn't a valid/known request type.
@@ -100,26 +182,65 @@ func (cc *ConsistencyChecks) CheckEquivocation(msg *directory.Response) error {
 // Note that the consistency state will be updated regardless of
 // whether the checks pass / fail, since a response message contains
 // cryptographic proof of having been issued nonetheless.
+//
+// If cc.Archive is set, verified responses are archived, and
+// HandleResponse returns any error from the archiver.
+//
+// If a verified response binds uname to a key that has been revoked,
+// HandleResponse returns ErrKeyRevoked; see Revoked. If a verified key
+// lookup response returns a deleted binding, it returns ErrNameDeleted;
+// see Deleted. If it returns an expired binding, it returns
+// ErrBindingExpired; see ReattestationDue.
 func (cc *ConsistencyChecks) HandleResponse(requestType int, msg *directory.Response,
+	uname string, key []byte) error {
+	if err := cc.alert(cc.handleResponse(requestType, msg, uname, key), uname); err != nil {
+		return err
+	}
+	if cc.Archive != nil {
+		if err := cc.Archive.Archive(requestType, uname, msg); err != nil {
+			return fmt.Errorf("[client] archiving the response: %w", err)
+		}
+	}
+	if err := cc.checkRevocation(msg, uname); err != nil {
+		return err
+	}
+	if err := cc.checkDeletion(requestType, msg, uname); err != nil {
+		return err
+	}
+	return cc.checkReattestation(requestType, msg, uname)
+}
+
+// alert sends an alert to cc.Alerts if err indicates directory
+// misbehavior, and returns err.
+func (cc *ConsistencyChecks) alert(err error, uname string) error {
+	if a := alert.FromCheck(err, cc.VerifiedSTR().Epoch, uname); a != nil {
+		_ = alert.Send(cc.Alerts, a)
+	}
+	return err
+}
+
+func (cc *ConsistencyChecks) handleResponse(requestType int, msg *directory.Response,
 	uname string, key []byte) error {
 	if err := msg.Validate(); err != nil {
 		return err
 	}
+	var df *directory.DirectoryProof
 	switch requestType {
 	case directory.RegistrationType, directory.KeyLookupType, directory.KeyLookupInEpochType, directory.MonitoringType:
-		if _, ok := msg.DirectoryResponse.(*directory.DirectoryProof); !ok {
+		var ok bool
+		if df, ok = msg.DirectoryResponse.(*directory.DirectoryProof); !ok {
 			return protocol.ErrMalformedMessage
 		}
 	default:
 		panic("[coniks] Unknown request type")
 	}
-	if err := cc.updateSTR(requestType, msg); err != nil {
-		return err
-	}
-	if err := cc.checkConsistency(requestType, msg, uname, key); err != nil {
-		return err
-	}
-	if err := cc.updateTBs(requestType, msg, uname, key); err != nil {
+	if err := cc.runChecks(&Verified{
+		RequestType: requestType,
+		Username:    uname,
+		Key:         key,
+		Response:    msg,
+		Proof:       df,
+	}); err != nil {
 		return err
 	}
 	recvKey, _ := msg.GetKey()
@@ -139,6 +260,16 @@ func (cc *ConsistencyChecks) updateSTR(requestType int, msg *directory.Response)
 			return err
 		}
 
+	case directory.MonitoringType:
+		df := msg.DirectoryResponse.(*directory.DirectoryProof)
+		if len(df.STR) == 0 || len(df.AP) != len(df.STR) {
+			return protocol.ErrMalformedMessage
+		}
+		if err := cc.AuditDirectory(df.STR); err != nil {
+			return err
+		}
+		str = df.STR[len(df.STR)-1]
+
 	default:
 		panic("[coniks] Unknown request type")
 	}
@@ -157,6 +288,8 @@ func (cc *ConsistencyChecks) checkConsistency(requestType int, msg *directory.Re
 		err = cc.verifyRegistration(msg, uname, key)
 	case directory.KeyLookupType:
 		err = cc.verifyKeyLookup(msg, uname, key)
+	case directory.MonitoringType:
+		err = cc.verifyMonitoring(msg, uname, key)
 	default:
 		panic("[coniks] Unknown request type")
 	}
@@ -174,13 +307,19 @@ func (cc *ConsistencyChecks) verifyRegistration(msg *directory.Response,
 	proofType := ap.ProofType()
 	switch {
 	case msg.Error == protocol.ReqNameExisted && proofType == merkletree.ProofOfInclusion:
-	case msg.Error == protocol.ReqNameExisted && proofType == merkletree.ProofOfAbsence && cc.useTBs:
-	case msg.Error == protocol.ReqSuccess && proofType == merkletree.ProofOfAbsence:
+	case msg.Error == protocol.ReqNameExisted && proofType.IsAbsence() && cc.useTBs:
+	case msg.Error == protocol.ReqSuccess && proofType.IsAbsence():
+	case msg.Error == protocol.ReqSuccess && proofType == merkletree.ProofOfInclusion && df.Deletion != nil:
+		// the registration replaces a deleted binding
+		if err := cc.checkReregistration(df.Deletion, uname, ap.Leaf.Value, key, str.Epoch+1, str); err != nil {
+			return err
+		}
+		key = ap.Leaf.Value
 	default:
 		return protocol.ErrMalformedMessage
 	}
 
-	return verifyAuthPath(uname, key, ap, str)
+	return cc.verifyAuthPath(uname, key, ap, str)
 }
 
 func (cc *ConsistencyChecks) verifyKeyLookup(msg *directory.Response,
@@ -193,38 +332,161 @@ func (cc *ConsistencyChecks) verifyKeyLookup(msg *directory.Response,
 
 	proofType := ap.ProofType()
 	switch {
-	case msg.Error == protocol.ReqNameNotFound && proofType == merkletree.ProofOfAbsence:
+	case msg.Error == protocol.ReqNameNotFound && proofType.IsAbsence():
 	// FIXME: This would be changed when we support key changes
 	case msg.Error == protocol.ReqSuccess && proofType == merkletree.ProofOfInclusion:
-	case msg.Error == protocol.ReqSuccess && proofType == merkletree.ProofOfAbsence && cc.useTBs:
+	case msg.Error == protocol.ReqSuccess && proofType.IsAbsence() && cc.useTBs:
 	default:
 		return protocol.ErrMalformedMessage
 	}
 
-	return verifyAuthPath(uname, key, ap, str)
+	key = cc.expectedKey(uname, key, str.Epoch)
+	if del := cc.Deletions[uname]; del != nil && key != nil && bytes.Equal(del.Key, key) &&
+		proofType == merkletree.ProofOfInclusion && !bytes.Equal(ap.Leaf.Value, key) {
+		// the deleted name has been registered again
+		if err := cc.checkReregistration(del, uname, key, ap.Leaf.Value, str.Epoch, str); err != nil {
+			return err
+		}
+		key = nil
+	}
+	return cc.verifyAuthPath(uname, key, ap, str)
+}
+
+// VerifyAuthPath verifies that ap proves the binding of uname to key,
+// or its absence, in the tree committed to by str. The lookup index is
+// verified with the index function declared in str's policies, i.e.
+// usually the VRF. If key is nil, whatever key ap binds uname to is
+// accepted. The epochs of the leaf must not be later than the epoch of
+// str, nor may the binding have changed before it was added.
+func VerifyAuthPath(uname string, key []byte, ap *merkletree.AuthenticationPath, str *directory.SignedTreeRoot) error {
+	return verifyAuthPath(uname, key, ap, str, nil)
 }
 
-func verifyAuthPath(uname string, key []byte, ap *merkletree.AuthenticationPath, str *directory.SignedTreeRoot) error {
-	// verify VRF Index
-	vrfKey := str.Policies.VrfPublicKey
-	if !vrfKey.Verify([]byte(uname), ap.LookupIndex, ap.VrfProof) {
-		return protocol.CheckBadVRFProof
-	}
+// verifyAuthPath is VerifyAuthPath for cc, which verifies the VRF proof
+// of ap with its VRFCache.
+func (cc *ConsistencyChecks) verifyAuthPath(uname string, key []byte, ap *merkletree.AuthenticationPath,
+	str *directory.SignedTreeRoot) error {
+	return verifyAuthPath(uname, key, ap, str, cc.VRFCache)
+}
 
+// verifyAuthPath is VerifyAuthPath, with the VRF proof of ap verified
+// with vrfs.
+func verifyAuthPath(uname string, key []byte, ap *merkletree.AuthenticationPath, str *directory.SignedTreeRoot,
+	vrfs *VRFCache) error {
+	if err := verifyLookup(uname, ap, str, vrfs); err != nil {
+		return err
+	}
 	if key == nil {
 		// key is nil when the user does lookup for the first time.
 		// Accept the received key as TOFU
 		key = ap.Leaf.Value
 	}
 
-	switch err := ap.Verify([]byte(uname), key, str.TreeHash); err {
+	return checkError(ap.Verify([]byte(uname), key, str.TreeHash[:]))
+}
+
+// VerifyShardedAuthPath is VerifyAuthPath for a proof from a directory
+// whose tree is an experimental merkletree.ShardedTree: the
+// authentication path in the shard of uname is verified the same way,
+// and the extra layer of p proves the shard's root against the tree hash
+// in str. It returns protocol.ErrMalformedMessage if p has no
+// authentication path, and protocol.CheckBadAuthPath if it has the wrong
+// number of shard layers.
+func VerifyShardedAuthPath(uname string, key []byte, p *merkletree.ShardedAuthPath, str *directory.SignedTreeRoot) error {
+	if p.AP == nil || p.AP.Leaf == nil {
+		return protocol.ErrMalformedMessage
+	}
+	if err := verifyLookup(uname, p.AP, str, nil); err != nil {
+		return err
+	}
+	if key == nil {
+		key = p.AP.Leaf.Value
+	}
+	err := p.Verify([]byte(uname), key, str.TreeHash[:])
+	if err == merkletree.ErrInvalidShardBits {
+		return protocol.CheckBadAuthPath
+	}
+	return checkError(err)
+}
+
+// verifyLookup verifies the lookup index of ap, the depth of its leaf
+// and the epochs of the leaf's binding, as VerifyAuthPath does before
+// verifying the path itself. The VRF proof is verified with vrfs.
+func verifyLookup(uname string, ap *merkletree.AuthenticationPath, str *directory.SignedTreeRoot,
+	vrfs *VRFCache) error {
+	// verify the lookup index
+	if len(ap.LookupIndex) != int(str.Policies.IndexSize) {
+		return protocol.CheckBadLookupIndex
+	}
+	if !vrfs.VerifyIndex(str.Policies, []byte(uname), ap.LookupIndex, ap.VrfProof) {
+		return protocol.CheckBadVRFProof
+	}
+
+	// reject pathological proofs that are deeper than advertised
+	if err := str.VerifyDepth(ap); err != nil {
+		return protocol.CheckBadTreeDepth
+	}
+	return verifyLeafEpochs(ap.Leaf, str)
+}
+
+// VerifyMultiAuthPath is VerifyAuthPath for a MultiAuthPath proving the
+// binding of each of unames to the key at the same position in keys, or
+// its absence, at once. A nil key accepts whatever key mp binds its name
+// to. It returns protocol.ErrMalformedMessage if mp doesn't have
+// a lookup index, VRF proof and leaf for each name.
+func VerifyMultiAuthPath(unames []string, keys [][]byte, mp *merkletree.MultiAuthPath, str *directory.SignedTreeRoot) error {
+	if len(keys) != len(unames) || len(mp.LookupIndices) != len(unames) ||
+		len(mp.VrfProofs) != len(unames) || len(mp.Leaves) != len(unames) {
+		return protocol.ErrMalformedMessage
+	}
+	names := make([][]byte, len(unames))
+	values := make([][]byte, len(unames))
+	for i, uname := range unames {
+		if mp.Leaves[i] == nil {
+			return protocol.ErrMalformedMessage
+		}
+		if len(mp.LookupIndices[i]) != int(str.Policies.IndexSize) {
+			return protocol.CheckBadLookupIndex
+		}
+		if !str.Policies.VerifyIndex([]byte(uname), mp.LookupIndices[i], mp.VrfProofs[i]) {
+			return protocol.CheckBadVRFProof
+		}
+		if err := verifyLeafEpochs(mp.Leaves[i], str); err != nil {
+			return err
+		}
+		names[i], values[i] = []byte(uname), keys[i]
+		if values[i] == nil {
+			values[i] = mp.Leaves[i].Value
+		}
+	}
+	if err := str.VerifyMultiDepth(mp); err != nil {
+		return protocol.CheckBadTreeDepth
+	}
+	return checkError(mp.Verify(names, values, str.TreeHash[:]))
+}
+
+// verifyLeafEpochs returns protocol.CheckBadBindingEpochs if the user
+// leaf n of a proof claims that its binding was added or changed after
+// the epoch of str, the snapshot whose tree it's in, or changed before
+// it was added.
+func verifyLeafEpochs(n *merkletree.ProofNode, str *directory.SignedTreeRoot) error {
+	if !n.IsEmpty && (n.ChangedEpoch > str.Epoch || n.AddedEpoch > n.ChangedEpoch) {
+		return protocol.CheckBadBindingEpochs
+	}
+	return nil
+}
+
+// checkError converts an error of verifying an authentication path to
+// the corresponding check error.
+func checkError(err error) error {
+	switch err {
 	case merkletree.ErrBindingsDiffer:
 		return protocol.CheckBindingsDiffer
 	case merkletree.ErrUnverifiableCommitment:
 		return protocol.CheckBadCommitment
 	case merkletree.ErrIndicesMismatch:
 		return protocol.CheckBadLookupIndex
-	case merkletree.ErrUnequalTreeHashes:
+	case merkletree.ErrUnequalTreeHashes, merkletree.ErrMalformedMultiProof:
 		return protocol.CheckBadAuthPath
 	case nil:
 		return nil
@@ -241,31 +503,43 @@ func (cc *ConsistencyChecks) updateTBs(requestType int, msg *directory.Response,
 	switch requestType {
 	case directory.RegistrationType:
 		df := msg.DirectoryResponse.(*directory.DirectoryProof)
-		if df.AP[0].ProofType() == merkletree.ProofOfAbsence {
+		if df.AP[0].ProofType().IsAbsence() || df.Deletion != nil {
 			if err := cc.verifyReturnedPromise(df, key); err != nil {
 				return err
 			}
-			cc.TBs[uname] = df.TB
+			cc.setTB(uname, df.TB, df.STR[0].Signature)
 		}
 		return nil
 
 	case directory.KeyLookupType:
 		df := msg.DirectoryResponse.(*directory.DirectoryProof)
 		ap := df.AP[0]
-		str := df.STR[0]
 		proofType := ap.ProofType()
 		switch {
 		case msg.Error == protocol.ReqSuccess && proofType == merkletree.ProofOfInclusion:
-			if err := cc.verifyFulfilledPromise(uname, str, ap); err != nil {
+			if err := cc.verifyFulfilledPromise(uname, ap, df.TB); err != nil {
 				return err
 			}
-			delete(cc.TBs, uname)
+			cc.deleteTB(uname)
 
-		case msg.Error == protocol.ReqSuccess && proofType == merkletree.ProofOfAbsence:
+		case msg.Error == protocol.ReqSuccess && proofType.IsAbsence():
 			if err := cc.verifyReturnedPromise(df, key); err != nil {
 				return err
 			}
-			cc.TBs[uname] = df.TB
+			cc.setTB(uname, df.TB, df.STR[0].Signature)
+		}
+
+	case directory.MonitoringType:
+		df := msg.DirectoryResponse.(*directory.DirectoryProof)
+		// the first proof of inclusion must fulfill a pending promise
+		for _, ap := range df.AP {
+			if ap.ProofType() == merkletree.ProofOfInclusion {
+				if err := cc.verifyFulfilledPromise(uname, ap, df.TB); err != nil {
+					return err
+				}
+				cc.deleteTB(uname)
+				break
+			}
 		}
 
 	default:
@@ -274,16 +548,49 @@ func (cc *ConsistencyChecks) updateTBs(requestType int, msg *directory.Response,
 	return nil
 }
 
+// setTB stores the promise tb for uname, issued under the STR with the
+// signature strSig.
+func (cc *ConsistencyChecks) setTB(uname string, tb *directory.TemporaryBinding,
+	strSig sign.Signature) {
+	cc.TBs[uname] = tb
+	cc.TBSTRs[uname] = strSig
+}
+
+// deleteTB forgets the promise for uname.
+func (cc *ConsistencyChecks) deleteTB(uname string) {
+	delete(cc.TBs, uname)
+	delete(cc.TBSTRs, uname)
+}
+
 // verifyFulfilledPromise verifies issued TBs were inserted
-// in the directory as promised.
-func (cc *ConsistencyChecks) verifyFulfilledPromise(uname string, str *directory.SignedTreeRoot,
-	ap *merkletree.AuthenticationPath) error {
+// in the directory as promised: the proof of inclusion ap must bind the
+// promised index to the promised value. If the directory bound the name
+// more than once in the TB's epoch, the value may instead be that of the
+// TB superseding returned along with ap, which must be signed under the
+// same STR as the client's TB, and be a later change (see
+// directory.TemporaryBinding), so the client must look the name up in the
+// epoch after its TB's, while the directory still returns that TB. The
+// STR's policies aren't consulted, since the directory signs them.
+func (cc *ConsistencyChecks) verifyFulfilledPromise(uname string, ap *merkletree.AuthenticationPath,
+	superseding *directory.TemporaryBinding) error {
 	// FIXME: Which epoch did this lookup happen in?
-	if tb, ok := cc.TBs[uname]; ok {
-		if !bytes.Equal(ap.LookupIndex, tb.Index) ||
-			!bytes.Equal(ap.Leaf.Value, tb.Value) {
-			return protocol.CheckBrokenPromise
-		}
+	tb, ok := cc.TBs[uname]
+	if !ok {
+		return nil
+	}
+	if !bytes.Equal(ap.LookupIndex, tb.Index) {
+		return protocol.CheckBrokenPromise
+	}
+	if bytes.Equal(ap.Leaf.Value, tb.Value) {
+		return nil
+	}
+	if superseding == nil || superseding.Change <= tb.Change ||
+		!bytes.Equal(superseding.Index, tb.Index) || !bytes.Equal(superseding.Value, ap.Leaf.Value) {
+		return protocol.CheckBrokenPromise
+	}
+	strSig, ok := cc.TBSTRs[uname]
+	if !ok || !cc.Verify(superseding.Bytes(strSig), superseding.Signature[:]) {
+		return protocol.CheckBrokenPromise
 	}
 	return nil
 }
@@ -300,16 +607,22 @@ func (cc *ConsistencyChecks) verifyFulfilledPromise(uname string, str *directory
 // These above checks should be performed before calling this method.
 func (cc *ConsistencyChecks) verifyReturnedPromise(df *directory.DirectoryProof,
 	key []byte) error {
-	ap := df.AP[0]
-	str := df.STR[0]
-	tb := df.TB
-
-	if tb == nil {
+	if df.TB == nil {
 		return protocol.CheckBadPromise
 	}
+	return VerifyPromise(cc, key, df.TB, df.AP[0], df.STR[0])
+}
 
+// VerifyPromise verifies that tb, returned along with the proof of
+// absence ap and str, is a promise signed with v to bind the lookup index
+// of ap to key. If key is nil, whatever key tb promises is accepted.
+// It returns protocol.CheckBadSignature for a bad signature,
+// protocol.CheckBadPromise if tb is for a different index, and
+// protocol.CheckBindingsDiffer if it promises a different key.
+func VerifyPromise(v sign.Verifier, key []byte, tb *directory.TemporaryBinding,
+	ap *merkletree.AuthenticationPath, str *directory.SignedTreeRoot) error {
 	// verify TB's Signature
-	if !cc.Verify(tb.Bytes(str.Signature), tb.Signature) {
+	if !v.Verify(tb.Bytes(str.Signature), tb.Signature[:]) {
 		return protocol.CheckBadSignature
 	}
 
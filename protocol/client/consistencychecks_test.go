@@ -1 +1,343 @@
 package client
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/cryptotest"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/internal/race"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+var staticSigningKey = crypto.NewStaticTestSigningKey()
+
+func TestCheckEquivocationAlerts(t *testing.T) {
+	d := directory.NewTestTree(t)
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	var alerts []*alert.Alert
+	cc.Alerts = alert.SinkFunc(func(a *alert.Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	})
+
+	d.Update()
+	if err := cc.CheckEquivocation(directory.NewSTRHistoryRange(
+		[]*directory.SignedTreeRoot{d.LatestSTR()})); err != nil {
+		t.Fatal(err)
+	}
+	cc.Update(d.LatestSTR())
+	if len(alerts) != 0 {
+		t.Fatal("Expect no alerts, got", alerts)
+	}
+
+	// a validly signed STR for the same epoch from a forked history
+	forked := directory.NewTestTree(t)
+	forked.Update()
+	err := cc.CheckEquivocation(directory.NewSTRHistoryRange(
+		[]*directory.SignedTreeRoot{forked.LatestSTR()}))
+	if err != protocol.CheckBadSTR {
+		t.Fatal("Expect", protocol.CheckBadSTR, "got", err)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != alert.Equivocation || alerts[0].Epoch != 1 {
+		t.Fatal("Expect an equivocation alert, got", alerts)
+	}
+}
+
+func TestHashIndexDirectory(t *testing.T) {
+	d, err := directory.NewWithHashIndex(staticSigningKey, 10, []byte("hash key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	resp, err := d.Register("alice", []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), "alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	d.Update()
+	msg := d.KeyLookup(&directory.KeyLookupRequest{Username: "alice"})
+	ap := msg.DirectoryResponse.(*directory.DirectoryProof).AP[0]
+	str := msg.DirectoryResponse.(*directory.DirectoryProof).STR[0]
+	if err := VerifyAuthPath("alice", []byte("key"), ap, str); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAuthPath("bob", nil, ap, str); err != protocol.CheckBadVRFProof {
+		t.Error("Expect", protocol.CheckBadVRFProof, "got", err)
+	}
+	if err := cc.HandleResponse(directory.KeyLookupType, msg, "alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailingCrypto(t *testing.T) {
+	vrfKey := crypto.NewStaticTestVRFKey()
+	d, err := directory.Open(
+		directory.WithSigningKey(&cryptotest.Signer{
+			Key: staticSigningKey, Fail: cryptotest.Containing([]byte("forged key"))}),
+		directory.WithVRFKey(vrfKey),
+		directory.WithIndexer(&cryptotest.Indexer{Key: vrfKey, Mismatch: cryptotest.Keys("bob")}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+
+	// the TB of mallory is signed with the wrong key
+	resp, err := d.Register("mallory", []byte("forged key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), "mallory",
+		[]byte("forged key")); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+
+	// the index of bob doesn't match its VRF proof
+	if resp, err = d.Register("bob", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), "bob",
+		key); err != protocol.CheckBadVRFProof {
+		t.Error("Expect", protocol.CheckBadVRFProof, "got", err)
+	}
+
+	// the client rejects all signatures
+	if resp, err = d.Register(alice, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), alice, key); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	cc.UseVerifier(&cryptotest.Verifier{Key: staticSigningKey.Public(),
+		Fail: func([]byte) bool { return true }})
+	if err := cc.HandleResponse(directory.KeyLookupType,
+		d.KeyLookup(&directory.KeyLookupRequest{Username: alice}), alice, key); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+}
+
+// TestVerifyAuthPathAllocs keeps the garbage of verifying a lookup in
+// check, for both kinds of index.
+func TestVerifyAuthPathAllocs(t *testing.T) {
+	if race.Enabled {
+		t.Skip("the race detector allocates")
+	}
+	hashIndexed, err := directory.NewWithHashIndex(staticSigningKey, 10, []byte("hash key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		d      *directory.Tree
+		budget float64
+	}{
+		{"VRF", directory.NewTestTree(t), 10},
+		{"hash", hashIndexed, 8},
+	} {
+		for i := 0; i < 200; i++ {
+			if _, err := tc.d.Register("user"+strconv.Itoa(i), []byte("key")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tc.d.Update()
+		df := tc.d.KeyLookup(&directory.KeyLookupRequest{Username: "user100"}).
+			DirectoryResponse.(*directory.DirectoryProof)
+		allocs := testing.AllocsPerRun(50, func() {
+			if err := VerifyAuthPath("user100", []byte("key"), df.AP[0], df.STR[0]); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs > tc.budget {
+			t.Errorf("%s: expect VerifyAuthPath to allocate at most %v times, got %v", tc.name, tc.budget, allocs)
+		}
+	}
+}
+
+func TestVerifyMultiAuthPath(t *testing.T) {
+	d := directory.NewTestTree(t)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := d.Register(name, []byte(name+"'s key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Update()
+	names := []string{"alice", "bob", "carol", "dave"}
+	mp, str, err := d.KeyLookupBatch(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := [][]byte{[]byte("alice's key"), nil, []byte("carol's key"), nil}
+	if err := VerifyMultiAuthPath(names, keys, mp, str); err != nil {
+		t.Fatal(err)
+	}
+	if mp.ProofType(3) != merkletree.ProofOfAbsenceEmpty && mp.ProofType(3) != merkletree.ProofOfAbsenceConflict {
+		t.Error("Expect a proof of absence for dave")
+	}
+
+	for _, tc := range []struct {
+		name  string
+		names []string
+		keys  [][]byte
+		want  error
+	}{
+		{"other key", names, [][]byte{[]byte("bob's key"), nil, nil, nil}, protocol.CheckBindingsDiffer},
+		{"other name", []string{"alice", "bob", "carol", "eve"}, keys, protocol.CheckBadVRFProof},
+		{"missing key", names, keys[1:], protocol.ErrMalformedMessage},
+	} {
+		if err := VerifyMultiAuthPath(tc.names, tc.keys, mp, str); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	tampered := *mp
+	tampered.Hashes = append(mp.Hashes[:len(mp.Hashes):len(mp.Hashes)], [32]byte{})
+	if err := VerifyMultiAuthPath(names, keys, &tampered, str); err != protocol.CheckBadAuthPath {
+		t.Errorf("Expect %v, got %v", protocol.CheckBadAuthPath, err)
+	}
+}
+
+func TestVerifyShardedAuthPath(t *testing.T) {
+	vrfKey := crypto.NewStaticTestVRFKey()
+	vrfPublic, _ := vrfKey.Public()
+	s, err := merkletree.NewShardedTree(2, merkletree.DefaultIndexSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		index, _ := vrfKey.Prove([]byte(name))
+		if err := s.Set(index, []byte(name), []byte(name+"'s key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := directory.NewConfig(vrfPublic)
+	str := &directory.SignedTreeRoot{
+		SignedTreeRoot: merkletree.NewShardedSTR(staticSigningKey, config, s, 0, [32]byte{}, nil),
+		Policies:       config,
+	}
+	get := func(name string) *merkletree.ShardedAuthPath {
+		index, proof := vrfKey.Prove([]byte(name))
+		p := s.Get(index)
+		p.AP.VrfProof = proof
+		return p
+	}
+
+	if err := VerifyShardedAuthPath("alice", []byte("alice's key"), get("alice"), str); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyShardedAuthPath("dave", nil, get("dave"), str); err != nil {
+		t.Fatal(err)
+	}
+	noShards := get("alice")
+	noShards.ShardPath = nil
+	for _, tc := range []struct {
+		name string
+		p    *merkletree.ShardedAuthPath
+		want error
+	}{
+		{"other key", get("alice"), protocol.CheckBindingsDiffer},
+		{"other name", get("bob"), protocol.CheckBadVRFProof},
+		{"no shard layer", noShards, protocol.CheckBadAuthPath},
+		{"no path", &merkletree.ShardedAuthPath{}, protocol.ErrMalformedMessage},
+	} {
+		if err := VerifyShardedAuthPath("alice", []byte("bob's key"), tc.p, str); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestSupersededPromise(t *testing.T) {
+	for _, changes := range []uint64{0, 2} {
+		d, err := directory.Open(
+			directory.WithSigningKey(staticSigningKey),
+			directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+			directory.WithMaxChangesPerEpoch(changes),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a contact looks up alice's first key
+		cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+		if _, err := d.Register("alice", []byte("key")); err != nil {
+			t.Fatal(err)
+		}
+		msg := d.KeyLookup(&directory.KeyLookupRequest{Username: "alice"})
+		if err := cc.HandleResponse(directory.KeyLookupType, msg, "alice", nil); err != nil {
+			t.Fatal(err)
+		}
+		if changes == 0 {
+			// the directory can't bind alice again, but may break its
+			// promise anyway
+			tb := *cc.TBs["alice"]
+			tb.Value = []byte("new key")
+			cc.TBs["alice"] = &tb
+		} else if _, err := d.Register("alice", []byte("new key")); err != nil {
+			t.Fatal(err)
+		}
+		// the contact's client restarts with its saved promises
+		restored := New(cc.VerifiedSTR(), true, staticSigningKey.Public())
+		restored.TBs, restored.TBSTRs = cc.TBs, cc.TBSTRs
+		cc = restored
+
+		d.Update()
+		msg = d.KeyLookup(&directory.KeyLookupRequest{Username: "alice"})
+		err = cc.HandleResponse(directory.KeyLookupType, msg, "alice", nil)
+		if changes == 0 && err != protocol.CheckBrokenPromise {
+			t.Error("Expect", protocol.CheckBrokenPromise, "got", err)
+		}
+		if changes == 2 && err != nil {
+			t.Error("Expect the superseded promise to pass, got", err)
+		}
+	}
+}
+
+func TestBrokenPromiseWithChanges(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithMaxChangesPerEpoch(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	if _, err := d.Register("alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	msg := d.KeyLookup(&directory.KeyLookupRequest{Username: "alice"})
+	if err := cc.HandleResponse(directory.KeyLookupType, msg, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	// the directory allows two changes per epoch, but includes a key it
+	// never promised
+	promised := cc.TBs["alice"]
+	tb := *promised
+	tb.Value = []byte("unpromised key")
+	cc.TBs["alice"] = &tb
+	d.Update()
+
+	msg = d.KeyLookup(&directory.KeyLookupRequest{Username: "alice"})
+	if err := cc.HandleResponse(directory.KeyLookupType, msg, "alice", nil); err != protocol.CheckBrokenPromise {
+		t.Error("Expect", protocol.CheckBrokenPromise, "got", err)
+	}
+
+	// nor can it claim that a TB it didn't sign superseded the promise
+	cc.TBs["alice"] = &tb
+	msg = d.KeyLookup(&directory.KeyLookupRequest{Username: "alice"})
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	df.TB = &directory.TemporaryBinding{
+		Index:     promised.Index,
+		Value:     df.AP[0].Leaf.Value,
+		Change:    2,
+		Signature: promised.Signature,
+	}
+	if err := cc.HandleResponse(directory.KeyLookupType, msg, "alice", nil); err != protocol.CheckBrokenPromise {
+		t.Error("Expect", protocol.CheckBrokenPromise, "got", err)
+	}
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrNameDeleted indicates that the binding a key lookup response
+// returns has been deleted by its owner, so the client must not use it.
+var ErrNameDeleted = errors.New("[client] The binding has been deleted")
+
+// checkDeletion verifies the tombstone attached to the verified key
+// lookup response msg for uname, if any. A valid tombstone is recorded in
+// cc.Deletions, and causes checkDeletion to return ErrNameDeleted; an
+// invalid one protocol.ErrMalformedMessage. The tombstones in
+// registration responses are verified by verifyRegistration.
+func (cc *ConsistencyChecks) checkDeletion(requestType int, msg *directory.Response, uname string) error {
+	if requestType != directory.KeyLookupType {
+		return nil
+	}
+	df, ok := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if !ok || df.Deletion == nil {
+		return nil
+	}
+	if !df.Deletion.Deletes(uname, lookedUpKey(msg, df)) {
+		return protocol.ErrMalformedMessage
+	}
+	cc.Deletions[uname] = df.Deletion
+	return ErrNameDeleted
+}
+
+// checkReregistration verifies that the binding of uname to oldKey that
+// del deleted may be replaced by the binding to newKey in epoch under the
+// policies of str. It returns protocol.ErrMalformedMessage if del doesn't
+// delete the binding, and protocol.CheckEarlyReregistration if newKey is
+// the deleted key, or epoch is before the end of the quarantine.
+func (cc *ConsistencyChecks) checkReregistration(del *directory.Deletion, uname string,
+	oldKey, newKey []byte, epoch merkletree.Epoch, str *directory.SignedTreeRoot) error {
+	if !del.Deletes(uname, oldKey) {
+		return protocol.ErrMalformedMessage
+	}
+	if bytes.Equal(newKey, oldKey) || epoch < del.QuarantineEnd(str.Policies) {
+		return protocol.CheckEarlyReregistration
+	}
+	return nil
+}
+
+// Deleted reports whether the client has learned that the binding of
+// uname to key has been deleted.
+func (cc *ConsistencyChecks) Deleted(uname string, key []byte) bool {
+	del := cc.Deletions[uname]
+	return del != nil && bytes.Equal(del.Key, key)
+}
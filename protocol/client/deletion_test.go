@@ -0,0 +1,93 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestDeletion(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithDeletionQuarantine(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	aliceKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := []byte(aliceKey.Public())
+	if _, err := d.Register(alice, pub); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	lookup := func() *directory.Response {
+		return d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	}
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	del := &directory.Deletion{Username: alice, Key: pub, Epoch: d.LatestSTR().Epoch + 1}
+	del.Sign(aliceKey)
+	if err := d.Delete(del); err != nil {
+		t.Fatal(err)
+	}
+	res := lookup()
+	forged := *del
+	forged.Epoch++
+	res.DirectoryResponse.(*directory.DirectoryProof).Deletion = &forged
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, pub); err != protocol.ErrMalformedMessage {
+		t.Fatalf("Expected a forged tombstone to fail with ErrMalformedMessage, got %v", err)
+	}
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != ErrNameDeleted {
+		t.Fatalf("Expected ErrNameDeleted, got %v", err)
+	}
+	if !cc.Deleted(alice, pub) || cc.Deleted(alice, key) {
+		t.Fatalf("Expected only the deleted binding to be recorded, got %+v", cc.Deletions)
+	}
+
+	// the client keeps seeing the tombstone until the name is registered
+	// again
+	for i := 0; i < 2; i++ {
+		d.Update()
+		if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != ErrNameDeleted {
+			t.Fatalf("Expected ErrNameDeleted, got %v", err)
+		}
+	}
+	newKey := []byte("new key")
+	resp, err := d.Register(alice, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registering := New(d.LatestSTR(), true, staticSigningKey.Public())
+	if err := registering.HandleResponse(directory.RegistrationType, resp.Response(), alice, newKey); err != nil {
+		t.Fatalf("Expected the registration replacing the deleted binding to pass, got %v", err)
+	}
+	d.Update()
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != nil {
+		t.Fatalf("Expected the new binding to be accepted after the quarantine, got %v", err)
+	}
+
+	// a rebinding before the end of the quarantine is directory
+	// misbehavior
+	early := *del
+	early.Epoch = d.LatestSTR().Epoch
+	if err := cc.checkReregistration(&early, alice, pub, newKey, early.Epoch+1, d.LatestSTR()); err != protocol.ErrMalformedMessage {
+		t.Errorf("Expected an unsigned tombstone to fail with ErrMalformedMessage, got %v", err)
+	}
+	early.Sign(aliceKey)
+	if err := cc.checkReregistration(&early, alice, pub, newKey, early.Epoch+1, d.LatestSTR()); err != protocol.CheckEarlyReregistration {
+		t.Errorf("Expected CheckEarlyReregistration, got %v", err)
+	}
+	if err := cc.checkReregistration(del, alice, pub, pub, early.Epoch+1, d.LatestSTR()); err != protocol.CheckEarlyReregistration {
+		t.Errorf("Expected rebinding the deleted key to fail with CheckEarlyReregistration, got %v", err)
+	}
+}
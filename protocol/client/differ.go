@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+// A Differ probes a directory deployment for split views: it sends the
+// same key lookup to the primary server and to each of its mirrors or
+// auditors, verifies every response on its own, and reports where they
+// diverge, along with the responses as evidence that anybody with the
+// directory's public signing key can check. It's a tool for researchers
+// and journalists rather than for regular clients, which don't trust
+// any single response either, but only keep their own view.
+type Differ struct {
+	// Endpoints are probed in order; the first one is the primary.
+	Endpoints []Endpoint
+	// SignKey is the directory's public signing key.
+	SignKey sign.PublicKey
+
+	now func() time.Time
+}
+
+// NewDiffer returns a Differ for the directory with the public signing
+// key signKey, served by primary and others.
+func NewDiffer(signKey sign.PublicKey, primary Endpoint, others ...Endpoint) *Differ {
+	return &Differ{
+		Endpoints: append([]Endpoint{primary}, others...),
+		SignKey:   signKey,
+	}
+}
+
+func (d *Differ) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+// A DivergenceKind is a way in which the responses of two endpoints
+// diverge.
+type DivergenceKind int
+
+const (
+	// DivergentSTR means that the endpoints served different STRs for the
+	// same epoch, both signed by the directory. The Divergence's Evidence
+	// proves that the directory equivocated.
+	DivergentSTR DivergenceKind = iota
+	// DivergentAnswer means that the endpoints served the same STR, but
+	// answered the lookup differently, e.g. only one of them returned
+	// a temporary binding.
+	DivergentAnswer
+	// UnverifiedResponse means that one endpoint's response failed
+	// verification while the other's passed.
+	UnverifiedResponse
+)
+
+func (k DivergenceKind) String() string {
+	switch k {
+	case DivergentSTR:
+		return "DivergentSTR"
+	case DivergentAnswer:
+		return "DivergentAnswer"
+	case UnverifiedResponse:
+		return "UnverifiedResponse"
+	default:
+		return fmt.Sprintf("DivergenceKind(%d)", int(k))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler, so that reports name
+// the kinds.
+func (k DivergenceKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// A Divergence reports that the responses of two endpoints diverge.
+type Divergence struct {
+	Kind      DivergenceKind
+	Endpoints [2]string
+	// Epoch is the epoch of the STRs the responses are for, that of the
+	// verified one for an UnverifiedResponse.
+	Epoch merkletree.Epoch
+	// Evidence proves a DivergentSTR; it's nil for the other kinds.
+	Evidence *evidence.Bundle `json:",omitempty"`
+}
+
+// An EndpointResult is the response of one endpoint to a Differ's
+// lookup, and the result of verifying it.
+type EndpointResult struct {
+	Endpoint string
+	// Err is the error of sending the request or of verifying the
+	// response, if either failed, and Failure its message.
+	Err     error  `json:"-"`
+	Failure string `json:",omitempty"`
+	// Code is the error code of the response.
+	Code protocol.ErrorCode
+	// Key is the key the verified response binds the username to, or nil
+	// if it proves that the name isn't registered.
+	Key []byte `json:",omitempty"`
+	// Proof is the response as served, if it contains one.
+	Proof *directory.DirectoryProof `json:",omitempty"`
+}
+
+// STR returns the STR the proof in r is for, or nil if r has none.
+func (r *EndpointResult) STR() *directory.SignedTreeRoot {
+	if r.Proof == nil || len(r.Proof.STR) == 0 {
+		return nil
+	}
+	return r.Proof.STR[0]
+}
+
+// verified reports whether r's response was received and verified.
+func (r *EndpointResult) verified() bool {
+	return r.Err == nil && r.Proof != nil
+}
+
+// A DiffReport is the result of a Differ's probe. It's self-contained,
+// so it can be shared as is: its JSON encoding (see Write) has every
+// response, and the evidence of every divergent STR.
+type DiffReport struct {
+	Time     time.Time
+	SignKey  sign.PublicKey
+	Username string
+	Results  []*EndpointResult
+	// Divergences are the ways in which the results diverge, in the order
+	// of the endpoints.
+	Divergences []*Divergence
+}
+
+// Diverged reports whether any responses diverged.
+func (r *DiffReport) Diverged() bool {
+	return len(r.Divergences) > 0
+}
+
+// Write writes the JSON encoding of r to w.
+func (r *DiffReport) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Lookup sends a KeyLookupRequest for uname to every endpoint, verifies
+// each response independently, i.e. checks the directory's signature of
+// the STR and the authentication path against it, and compares the
+// responses pairwise. It only returns an error if ctx is done; endpoints
+// that can't be reached are reported in the result.
+//
+// Responses for different epochs don't diverge, since an endpoint may
+// lag behind the others.
+func (d *Differ) Lookup(ctx context.Context, uname string) (*DiffReport, error) {
+	report := &DiffReport{
+		Time:     d.clock(),
+		SignKey:  d.SignKey,
+		Username: uname,
+	}
+	req := &directory.Request{
+		Type:    directory.KeyLookupType,
+		Request: &directory.KeyLookupRequest{Username: uname},
+	}
+	for _, e := range d.Endpoints {
+		res := &EndpointResult{Endpoint: e.Name}
+		resp, err := e.Send(ctx, req)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			res.Err = err
+		} else {
+			res.Code = resp.Error
+			res.Proof, _ = resp.DirectoryResponse.(*directory.DirectoryProof)
+			// a fresh LightClient without auditors verifies the response
+			// by itself, without comparing it to the other ones
+			lc := &LightClient{signKey: d.SignKey}
+			res.Key, res.Err = lc.verifyLookup(uname, nil, resp, nil)
+		}
+		if res.Err != nil {
+			res.Failure = res.Err.Error()
+		}
+		report.Results = append(report.Results, res)
+	}
+	for i, a := range report.Results {
+		for _, b := range report.Results[i+1:] {
+			if div := d.compare(a, b); div != nil {
+				report.Divergences = append(report.Divergences, div)
+			}
+		}
+	}
+	return report, nil
+}
+
+// compare returns how the results a and b diverge, or nil if they don't.
+func (d *Differ) compare(a, b *EndpointResult) *Divergence {
+	div := &Divergence{Endpoints: [2]string{a.Endpoint, b.Endpoint}}
+	switch {
+	case a.verified() && b.verified():
+	case a.verified() && b.Proof != nil:
+		div.Kind, div.Epoch = UnverifiedResponse, a.STR().Epoch
+		return div
+	case b.verified() && a.Proof != nil:
+		div.Kind, div.Epoch = UnverifiedResponse, b.STR().Epoch
+		return div
+	default:
+		// an endpoint that can't be reached, or doesn't serve a proof,
+		// doesn't diverge
+		return nil
+	}
+	strA, strB := a.STR(), b.STR()
+	if strA.Epoch != strB.Epoch {
+		return nil
+	}
+	div.Epoch = strA.Epoch
+	if !bytes.Equal(strA.Bytes(), strB.Bytes()) || strA.Signature != strB.Signature {
+		bundle, err := evidence.NewBundle(d.SignKey, []*directory.SignedTreeRoot{strA},
+			[]*directory.SignedTreeRoot{strB})
+		if err != nil {
+			return nil
+		}
+		div.Kind, div.Evidence = DivergentSTR, bundle
+		return div
+	}
+	if a.Code != b.Code || !bytes.Equal(a.Key, b.Key) {
+		div.Kind = DivergentAnswer
+		return div
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// tamperingTransport serves the responses of t with the looked up key
+// replaced.
+func tamperingTransport(t Transport) Transport {
+	return TransportFunc(func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		resp, err := t.Send(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		df := *resp.DirectoryResponse.(*directory.DirectoryProof)
+		ap := *df.AP[0]
+		leaf := *ap.Leaf
+		leaf.Value = []byte("forged key")
+		ap.Leaf = &leaf
+		df.AP = append(df.AP[:0:0], &ap)
+		return &directory.Response{Error: resp.Error, DirectoryResponse: &df}, nil
+	})
+}
+
+func TestDiffer(t *testing.T) {
+	d := directory.NewTestTree(t)
+	forked := directory.NewTestTree(t)
+	if _, err := d.Register("alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forked.Register("alice", []byte("other key")); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	forked.Update()
+
+	var calls int
+	differ := NewDiffer(staticSigningKey.Public(),
+		Endpoint{"primary", LocalTransport(d)},
+		Endpoint{"same", LocalTransport(d)},
+		Endpoint{"unreachable", failingTransport(&calls)})
+	report, err := differ.Lookup(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Diverged() {
+		t.Fatal("Expect consistent endpoints not to diverge, got", report.Divergences)
+	}
+	if res := report.Results[0]; res.Err != nil || res.Code != protocol.ReqSuccess ||
+		!bytes.Equal(res.Key, []byte("key")) {
+		t.Fatal("Expect the primary's binding to verify, got", res)
+	}
+	if res := report.Results[2]; res.Err == nil || res.Failure == "" {
+		t.Error("Expect the unreachable endpoint to be reported, got", res)
+	}
+
+	differ.Endpoints = append(differ.Endpoints,
+		Endpoint{"forked", LocalTransport(forked)},
+		Endpoint{"tampering", tamperingTransport(LocalTransport(d))})
+	if report, err = differ.Lookup(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[[2]string]DivergenceKind{
+		{"primary", "forked"}:    DivergentSTR,
+		{"primary", "tampering"}: UnverifiedResponse,
+		{"same", "forked"}:       DivergentSTR,
+		{"same", "tampering"}:    UnverifiedResponse,
+		{"forked", "tampering"}:  UnverifiedResponse,
+	}
+	if len(report.Divergences) != len(want) {
+		t.Fatal("Expect", len(want), "divergences, got", report.Divergences)
+	}
+	for _, div := range report.Divergences {
+		if kind, ok := want[div.Endpoints]; !ok || kind != div.Kind || div.Epoch != 1 {
+			t.Error("Unexpected divergence", div)
+		}
+		if div.Kind != DivergentSTR {
+			continue
+		}
+		if eq, err := div.Evidence.Verify(staticSigningKey.Public()); err != nil || eq.Epoch != 1 {
+			t.Error("Expect the evidence to prove an equivocation in epoch 1, got", eq, err)
+		}
+	}
+
+	// the shared report has the evidence
+	var buf bytes.Buffer
+	if err := report.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var shared struct {
+		Divergences []struct {
+			Kind     string
+			Evidence json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &shared); err != nil {
+		t.Fatal(err)
+	}
+	if div := shared.Divergences[0]; div.Kind != "DivergentSTR" || len(div.Evidence) == 0 {
+		t.Error("Expect the report to name the divergence and include its evidence, got", div)
+	}
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+// ErrDistrusted indicates that a request was refused because its
+// directory or endpoint is on the client's DistrustList.
+var ErrDistrusted = errors.New("[client] The directory or endpoint is distrusted")
+
+// A DistrustEntry records why a directory or a server endpoint is
+// distrusted. Exactly one of Directory and Endpoint is set.
+type DistrustEntry struct {
+	// Directory is the identifier of the distrusted directory, i.e. the
+	// hash of its initial STR.
+	Directory hashed.Hash
+	// Endpoint is the name of the distrusted endpoint, as in Endpoint.
+	Endpoint string `json:",omitempty"`
+	Reason   string
+	Time     time.Time
+	// Evidence has the STRs proving the misbehavior, if any, serialized
+	// with evidence.MarshalSTR.
+	Evidence [][]byte `json:",omitempty"`
+}
+
+// A DistrustList is a client's list of the directories and endpoints it
+// permanently distrusts after verified misbehavior, and refuses to talk
+// to; see Guard and MirrorTransport.Distrust. A DistrustList opened with
+// OpenDistrustList is saved to its file on every change. Lists can be
+// exported and imported, so that an organization can distribute a shared
+// one. A DistrustList is safe for concurrent use.
+type DistrustList struct {
+	path string
+
+	mu          sync.Mutex
+	directories map[hashed.Hash]DistrustEntry
+	endpoints   map[string]DistrustEntry
+	now         func() time.Time
+}
+
+// NewDistrustList returns an empty DistrustList that isn't saved.
+func NewDistrustList() *DistrustList {
+	return &DistrustList{
+		directories: make(map[hashed.Hash]DistrustEntry),
+		endpoints:   make(map[string]DistrustEntry),
+	}
+}
+
+// OpenDistrustList opens the DistrustList saved in the file path, or
+// creates an empty one if the file doesn't exist yet. The list is saved
+// to path whenever it changes.
+func OpenDistrustList(path string) (*DistrustList, error) {
+	l := NewDistrustList()
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		defer f.Close()
+		if err := l.Import(f); err != nil {
+			return nil, err
+		}
+	}
+	l.path = path
+	return l, nil
+}
+
+func (l *DistrustList) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// DistrustDirectory permanently distrusts the directory with the
+// identifier dirID for reason, with the optional serialized STRs
+// evidence proving its misbehavior. Distrusting a directory again
+// doesn't change its entry. DistrustDirectory only returns an error if
+// the list can't be saved.
+func (l *DistrustList) DistrustDirectory(dirID [hashed.HashSizeByte]byte, reason string, evidence ...[]byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.directories[dirID]; ok {
+		return nil
+	}
+	l.directories[dirID] = DistrustEntry{
+		Directory: dirID,
+		Reason:    reason,
+		Time:      l.clock(),
+		Evidence:  evidence,
+	}
+	return l.save()
+}
+
+// DistrustSplitView permanently distrusts the directory with the
+// identifier dirID, whose endpoints served the split view err, with the
+// conflicting STRs as evidence.
+func (l *DistrustList) DistrustSplitView(dirID [hashed.HashSizeByte]byte, err *SplitViewError) error {
+	a, errA := evidence.MarshalSTR(err.Equivocation.A)
+	b, errB := evidence.MarshalSTR(err.Equivocation.B)
+	if errA != nil || errB != nil {
+		return evidence.ErrMalformedSTR
+	}
+	return l.DistrustDirectory(dirID, err.Error(), a, b)
+}
+
+// DistrustEndpoint permanently distrusts the endpoint name for reason,
+// e.g. a mirror that served STRs that aren't signed by the directory.
+// Distrusting an endpoint again doesn't change its entry.
+// DistrustEndpoint only returns an error if the list can't be saved.
+func (l *DistrustList) DistrustEndpoint(name, reason string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.endpoints[name]; ok {
+		return nil
+	}
+	l.endpoints[name] = DistrustEntry{
+		Endpoint: name,
+		Reason:   reason,
+		Time:     l.clock(),
+	}
+	return l.save()
+}
+
+// DirectoryDistrusted reports whether the directory with the identifier
+// dirID is distrusted.
+func (l *DistrustList) DirectoryDistrusted(dirID [hashed.HashSizeByte]byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.directories[dirID]
+	return ok
+}
+
+// EndpointDistrusted reports whether the endpoint name is distrusted.
+func (l *DistrustList) EndpointDistrusted(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.endpoints[name]
+	return ok
+}
+
+// Entries returns all entries of l, oldest first.
+func (l *DistrustList) Entries() []DistrustEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.entries()
+}
+
+func (l *DistrustList) entries() []DistrustEntry {
+	entries := make([]DistrustEntry, 0, len(l.directories)+len(l.endpoints))
+	for _, e := range l.directories {
+		entries = append(entries, e)
+	}
+	for _, e := range l.endpoints {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		if entries[i].Endpoint != entries[j].Endpoint {
+			return entries[i].Endpoint < entries[j].Endpoint
+		}
+		return string(entries[i].Directory[:]) < string(entries[j].Directory[:])
+	})
+	return entries
+}
+
+// Export writes the entries of l to w as JSON.
+func (l *DistrustList) Export(w io.Writer) error {
+	return json.NewEncoder(w).Encode(l.Entries())
+}
+
+// Import adds the entries exported to r to l, e.g. from an
+// organization's shared list, and saves l. Entries for directories and
+// endpoints that are already distrusted are ignored. The evidence of the
+// entries isn't verified, so r must come from a trusted source.
+func (l *DistrustList) Import(r io.Reader) error {
+	var entries []DistrustEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range entries {
+		if e.Endpoint != "" {
+			if _, ok := l.endpoints[e.Endpoint]; !ok {
+				l.endpoints[e.Endpoint] = e
+			}
+		} else if _, ok := l.directories[e.Directory]; !ok {
+			l.directories[e.Directory] = e
+		}
+	}
+	return l.save()
+}
+
+// save writes l to its file, if any, replacing the file atomically.
+// l.mu must be held.
+func (l *DistrustList) save() error {
+	if l.path == "" {
+		return nil
+	}
+	bs, err := json.Marshal(l.entries())
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+// Guard returns a Transport that sends requests to the directory with
+// the identifier dirID through t, unless the directory is distrusted,
+// in which case it refuses them with ErrDistrusted.
+func (l *DistrustList) Guard(dirID [hashed.HashSizeByte]byte, t Transport) Transport {
+	return TransportFunc(func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		if l.DirectoryDistrusted(dirID) {
+			return nil, ErrDistrusted
+		}
+		return t.Send(ctx, req)
+	})
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+func TestDistrustList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distrust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "distrust.json")
+
+	l, err := OpenDistrustList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(100, 0).UTC()
+	l.now = func() time.Time { return now }
+	dirID := [32]byte{1}
+	if err := l.DistrustDirectory(dirID, "equivocated", []byte("evidence")); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	if err := l.DistrustEndpoint("mirror", "bad signatures"); err != nil {
+		t.Fatal(err)
+	}
+	// distrusting again doesn't change the entry
+	if err := l.DistrustEndpoint("mirror", "other reason"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the list survives a restart
+	l, err = OpenDistrustList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.DirectoryDistrusted(dirID) || l.DirectoryDistrusted([32]byte{2}) ||
+		!l.EndpointDistrusted("mirror") || l.EndpointDistrusted("primary") {
+		t.Fatal("Unexpected distrust list", l.Entries())
+	}
+	entries := l.Entries()
+	if len(entries) != 2 || entries[0].Directory != dirID || entries[0].Reason != "equivocated" ||
+		!bytes.Equal(entries[0].Evidence[0], []byte("evidence")) ||
+		entries[1].Endpoint != "mirror" || entries[1].Reason != "bad signatures" {
+		t.Error("Unexpected entries", entries)
+	}
+
+	// an organization shares its list
+	var shared bytes.Buffer
+	if err := l.Export(&shared); err != nil {
+		t.Fatal(err)
+	}
+	other := NewDistrustList()
+	if err := other.DistrustEndpoint("primary", "local reason"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Import(&shared); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.Entries()) != 3 || !other.DirectoryDistrusted(dirID) || !other.EndpointDistrusted("mirror") {
+		t.Error("Expect the imported entries to be added, got", other.Entries())
+	}
+	if err := other.Import(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("Expect an error for a malformed list")
+	}
+}
+
+func TestDistrustTransports(t *testing.T) {
+	d := directory.NewTestTree(t)
+	forked := directory.NewTestTree(t)
+	d.Update()
+	forked.Update()
+	genesis := d.GetSTRHistory(&directory.STRHistoryRequest{}).DirectoryResponse.(*directory.STRHistoryRange).STR[0]
+	dirID, _ := auditor.ComputeDirectoryIdentity(genesis)
+	l := NewDistrustList()
+
+	guarded := l.Guard(dirID, LocalTransport(d))
+	if _, err := guarded.Send(context.Background(), lookup("alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	var primaryCalls int
+	tr := NewMirrorTransport(staticSigningKey.Public(),
+		Endpoint{"primary", failingTransport(&primaryCalls)},
+		Endpoint{"mirror", LocalTransport(d)},
+		Endpoint{"forked", LocalTransport(forked)})
+	tr.Distrust = l
+	if err := l.DistrustEndpoint("primary", "unreachable"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Send(context.Background(), lookup("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if primaryCalls != 0 {
+		t.Error("Expect the distrusted primary to be skipped, got", primaryCalls, "calls")
+	}
+
+	var splitErr *SplitViewError
+	if err := tr.CheckSplitView(context.Background(), 1); !errors.As(err, &splitErr) {
+		t.Fatal("Expect a split view error, got", err)
+	}
+	if err := l.DistrustSplitView(dirID, splitErr); err != nil {
+		t.Fatal(err)
+	}
+	e := l.Entries()[1]
+	if len(e.Evidence) != 2 {
+		t.Fatal("Expect the conflicting STRs as evidence, got", e.Evidence)
+	}
+	if _, err := evidence.VerifyEquivocation(staticSigningKey.Public(), e.Evidence[0], e.Evidence[1]); err != nil {
+		t.Error("Expect the evidence to prove the equivocation, got", err)
+	}
+	if _, err := guarded.Send(context.Background(), lookup("alice")); err != ErrDistrusted {
+		t.Error("Expect", ErrDistrusted, "got", err)
+	}
+
+	for _, name := range []string{"mirror", "forked"} {
+		if err := l.DistrustEndpoint(name, "split view"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tr.Send(context.Background(), lookup("alice")); err != ErrDistrusted {
+		t.Error("Expect", ErrDistrusted, "got", err)
+	}
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+// ErrInvalidQuorum indicates that a LightClient was created with
+// a quorum that isn't between 1 and the number of its auditors.
+var ErrInvalidQuorum = errors.New("[client] Quorum must be between 1 and the number of auditors")
+
+// A LightClient verifies the directory's responses to key lookups on
+// devices too constrained to keep the consistency state of
+// ConsistencyChecks. It only verifies the lookup proofs itself, and
+// delegates checking the directory's STR history for consistency and
+// equivocation to a quorum of auditors it trusts: it only accepts an STR
+// that enough of them attested to, i.e. vouched is part of the linear
+// STR history they observed. See auditlog.ConiksAuditLog.AttestSTR.
+//
+// A LightClient neither monitors bindings nor keeps an STR history, so
+// it relies on the auditors to detect most misbehavior of the directory.
+// It only keeps the latest STR it accepted.
+type LightClient struct {
+	signKey  sign.PublicKey
+	auditors []sign.PublicKey
+	quorum   int
+	latest   *directory.SignedTreeRoot
+
+	// Alerts receives an alert whenever a check detects directory
+	// misbehavior. It may be nil.
+	Alerts alert.Sink
+}
+
+// NewLightClient creates a LightClient for the directory with the public
+// signing key signKey, which accepts the STRs that at least quorum of
+// the auditors with the public keys auditors attested to. It returns
+// ErrInvalidQuorum if quorum isn't between 1 and len(auditors).
+func NewLightClient(signKey sign.PublicKey, auditors []sign.PublicKey, quorum int) (*LightClient, error) {
+	if quorum < 1 || quorum > len(auditors) {
+		return nil, ErrInvalidQuorum
+	}
+	return &LightClient{
+		signKey:  signKey,
+		auditors: append([]sign.PublicKey{}, auditors...),
+		quorum:   quorum,
+	}, nil
+}
+
+// LatestSTR returns the STR of the latest epoch lc accepted, or nil if
+// it hasn't accepted any.
+func (lc *LightClient) LatestSTR() *directory.SignedTreeRoot {
+	return lc.latest
+}
+
+// VerifyLookup verifies the directory's response msg to
+// a KeyLookupRequest or a KeyLookupInEpochRequest for uname, given the
+// auditors' attestations atts of the STR the lookup proof is for, and
+// returns the key uname is bound to, or nil if uname isn't registered.
+// If key isn't nil, the binding must be to key; otherwise whatever key
+// the directory returns is accepted.
+//
+// VerifyLookup verifies the directory's signature of the STR, that
+// enough auditors attested to it, and the authentication path, or the
+// TB if uname was registered in the latest epoch. It returns
+// ErrNoQuorum if too few of lc's auditors attested to the STR, and the
+// consistency check error of any other failed check.
+func (lc *LightClient) VerifyLookup(uname string, key []byte, msg *directory.Response,
+	atts []directory.Attestation) ([]byte, error) {
+	value, err := lc.verifyLookup(uname, key, msg, atts)
+	if err == ErrNoQuorum {
+		// the auditors may just not have observed the STR yet
+		return nil, err
+	}
+	var epoch merkletree.Epoch
+	if lc.latest != nil {
+		epoch = lc.latest.Epoch
+	}
+	if a := alert.FromCheck(err, epoch, uname); a != nil {
+		_ = alert.Send(lc.Alerts, a)
+	}
+	return value, err
+}
+
+func (lc *LightClient) verifyLookup(uname string, key []byte, msg *directory.Response,
+	atts []directory.Attestation) ([]byte, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	df, ok := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if !ok || len(df.AP) == 0 || len(df.STR) == 0 {
+		return nil, protocol.ErrMalformedMessage
+	}
+	// the proof is for the first STR, which is the latest one for
+	// a KeyLookupRequest, and the requested one for a
+	// KeyLookupInEpochRequest
+	ap, str := df.AP[0], df.STR[0]
+
+	if !lc.signKey.Verify(str.Bytes(), str.Signature[:]) {
+		return nil, protocol.CheckBadSignature
+	}
+	if lc.latest != nil && str.Epoch == lc.latest.Epoch && str.Signature != lc.latest.Signature {
+		// the auditors vouched for two different STRs for the epoch
+		return nil, protocol.CheckBadSTR
+	}
+	if countAttestations(str.AttestationBytes(), atts, lc.auditors) < lc.quorum {
+		return nil, ErrNoQuorum
+	}
+
+	proofType := ap.ProofType()
+	switch {
+	case msg.Error == protocol.ReqNameNotFound && proofType.IsAbsence():
+	case msg.Error == protocol.ReqSuccess && proofType == merkletree.ProofOfInclusion:
+	case msg.Error == protocol.ReqSuccess && proofType.IsAbsence() && df.TB != nil:
+	default:
+		return nil, protocol.ErrMalformedMessage
+	}
+	if err := VerifyAuthPath(uname, key, ap, str); err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	switch {
+	case proofType == merkletree.ProofOfInclusion:
+		value = ap.Leaf.Value
+	case df.TB != nil && msg.Error == protocol.ReqSuccess:
+		// uname was registered in the latest epoch, and the directory
+		// promised to include the binding in the next one
+		tb := df.TB
+		if !lc.signKey.Verify(tb.Bytes(str.Signature), tb.Signature[:]) {
+			return nil, protocol.CheckBadSignature
+		}
+		if !bytes.Equal(tb.Index, ap.LookupIndex) {
+			return nil, protocol.CheckBadPromise
+		}
+		if key != nil && !bytes.Equal(tb.Value, key) {
+			return nil, protocol.CheckBindingsDiffer
+		}
+		value = tb.Value
+	}
+
+	if lc.latest == nil || str.Epoch > lc.latest.Epoch {
+		lc.latest = str
+	}
+	return value, nil
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+	"github.com/ORBAT/cloniks/protocol/auditlog"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+)
+
+func TestNewLightClient(t *testing.T) {
+	auditors := []sign.PublicKey{staticSigningKey.Public()}
+	for _, quorum := range []int{0, 2} {
+		if _, err := NewLightClient(staticSigningKey.Public(), auditors, quorum); err != ErrInvalidQuorum {
+			t.Error("Expect", ErrInvalidQuorum, "for quorum", quorum, "got", err)
+		}
+	}
+}
+
+func TestLightClient(t *testing.T) {
+	d, _ := monitored(t, 5)
+	aud := auditlog.New()
+	history := d.GetSTRHistory(&directory.STRHistoryRequest{EndEpoch: d.LatestSTR().Epoch}).
+		DirectoryResponse.(*directory.STRHistoryRange).STR
+	if err := aud.InitHistory("test-server", staticSigningKey.Public(), history); err != nil {
+		t.Fatal(err)
+	}
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(history[0])
+
+	var auditorKeys []sign.PrivateKey
+	var auditors []sign.PublicKey
+	for i := 0; i < 3; i++ {
+		key, err := sign.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auditorKeys = append(auditorKeys, key)
+		auditors = append(auditors, key.Public())
+	}
+	attest := func(str *directory.SignedTreeRoot, n int) []directory.Attestation {
+		var atts []directory.Attestation
+		for _, key := range auditorKeys[:n] {
+			att, err := aud.AttestSTR(dirInitHash, str, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			atts = append(atts, *att)
+		}
+		return atts
+	}
+
+	lc, err := NewLightClient(staticSigningKey.Public(), auditors, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alerts []*alert.Alert
+	lc.Alerts = alert.SinkFunc(func(a *alert.Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	})
+
+	resp := d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	str := d.LatestSTR()
+	if _, err := lc.VerifyLookup(alice, key, resp, attest(str, 1)); err != ErrNoQuorum {
+		t.Error("Expect", ErrNoQuorum, "got", err)
+	}
+	value, err := lc.VerifyLookup(alice, nil, resp, attest(str, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != string(key) {
+		t.Error("Expect", key, "got", value)
+	}
+	if lc.LatestSTR().Signature != str.Signature {
+		t.Error("Expect the client to accept the latest STR")
+	}
+	if _, err := lc.VerifyLookup(alice, []byte("other"), resp, attest(str, 2)); err != protocol.CheckBindingsDiffer {
+		t.Error("Expect", protocol.CheckBindingsDiffer, "got", err)
+	}
+
+	resp = d.KeyLookup(&directory.KeyLookupRequest{Username: "bob"})
+	value, err = lc.VerifyLookup("bob", nil, resp, attest(str, 2))
+	if err != nil || value != nil {
+		t.Error("Expect bob not to be registered, got", value, err)
+	}
+
+	// a registration in the latest epoch is verified against its TB
+	if _, err := d.Register("bob", key); err != nil {
+		t.Fatal(err)
+	}
+	resp = d.KeyLookup(&directory.KeyLookupRequest{Username: "bob"})
+	if value, err := lc.VerifyLookup("bob", key, resp, attest(str, 2)); err != nil || string(value) != string(key) {
+		t.Error("Expect bob's key from the TB, got", value, err)
+	}
+	resp.DirectoryResponse.(*directory.DirectoryProof).TB.Signature[0]++
+	if _, err := lc.VerifyLookup("bob", key, resp, attest(str, 2)); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+
+	if len(alerts) == 0 {
+		t.Error("Expect alerts for the failed checks")
+	}
+	alerts = nil
+
+	// an STR the auditors didn't observe doesn't reach a quorum
+	d.Update()
+	resp = d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	if _, err := lc.VerifyLookup(alice, key, resp, nil); err != ErrNoQuorum {
+		t.Error("Expect", ErrNoQuorum, "got", err)
+	}
+	if len(alerts) != 0 {
+		t.Error("Expect no alert for a missing quorum, got", alerts)
+	}
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// A CachedLookup is the verified result of a key lookup.
+type CachedLookup struct {
+	// Key is the key bound to the name, or nil if the name isn't
+	// registered.
+	Key []byte
+	// Epoch is that of the STR the result was verified against.
+	Epoch merkletree.Epoch
+	// Expires is when the epoch is scheduled to end, i.e. when the
+	// result may become stale.
+	Expires time.Time
+}
+
+// A LookupCache caches verified key lookup results until the epoch they
+// were verified in ends, so that applications don't need to ask the
+// directory for a key every time they use it. Only results verified
+// against an STR whose Config has a NextUpdate are cached, since for
+// others the client can't know when they become stale. A cached result
+// is never served after its epoch's scheduled end, nor after the client
+// verified an STR for a later epoch. A LookupCache is safe for
+// concurrent use.
+type LookupCache struct {
+	// ClockSkew is subtracted from the scheduled end of epochs, to
+	// account for the difference between the directory's clock and the
+	// client's.
+	ClockSkew time.Duration
+
+	mu      sync.Mutex
+	entries map[string]CachedLookup
+	latest  merkletree.Epoch
+	now     func() time.Time
+}
+
+// NewLookupCache returns an empty LookupCache.
+func NewLookupCache() *LookupCache {
+	return &LookupCache{entries: make(map[string]CachedLookup)}
+}
+
+func (c *LookupCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Get returns the cached result for name, if it hasn't expired.
+func (c *LookupCache) Get(name string) (CachedLookup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return CachedLookup{}, false
+	}
+	if e.Epoch < c.latest || !c.clock().Before(e.Expires) {
+		delete(c.entries, name)
+		return CachedLookup{}, false
+	}
+	return e, true
+}
+
+// Add caches key as the verified result of the lookup of name against
+// str, and reports whether it was cached, i.e. whether str has
+// a NextUpdate that isn't over yet. Adding a result for a later epoch
+// expires all results for earlier ones.
+func (c *LookupCache) Add(name string, key []byte, str *directory.SignedTreeRoot) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if str.Epoch > c.latest {
+		c.latest = str.Epoch
+	}
+	if str.Policies.NextUpdate == 0 || str.Epoch < c.latest {
+		return false
+	}
+	expires := time.Unix(0, str.Policies.NextUpdate).Add(-c.ClockSkew)
+	if !c.clock().Before(expires) {
+		return false
+	}
+	c.entries[name] = CachedLookup{Key: key, Epoch: str.Epoch, Expires: expires}
+	return true
+}
+
+// Invalidate removes the cached result for name, e.g. after the
+// application learned that the user's key changed.
+func (c *LookupCache) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name)
+}
+
+// Lookup returns the key bound to name, or nil if name isn't registered.
+// It serves the result from c if it's cached, and otherwise looks name
+// up in the directory through t, verifies the response with cc, and
+// caches the result. If the key has been revoked, it returns
+// ErrKeyRevoked, even for a cached result, and likewise ErrNameDeleted if
+// the binding has been deleted. Errors of the directory other than ReqNameNotFound
+// are returned as their protocol.ErrorCode, and failed checks as their
+// errors.
+func (c *LookupCache) Lookup(ctx context.Context, cc *ConsistencyChecks, t Transport, name string) ([]byte, error) {
+	if e, ok := c.Get(name); ok {
+		if cc.Revoked(name, e.Key) {
+			c.Invalidate(name)
+			return nil, ErrKeyRevoked
+		}
+		if cc.Deleted(name, e.Key) {
+			c.Invalidate(name)
+			return nil, ErrNameDeleted
+		}
+		return e.Key, nil
+	}
+	resp, err := t.Send(ctx, &directory.Request{
+		Type:    directory.KeyLookupType,
+		Request: &directory.KeyLookupRequest{Username: name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != protocol.ReqSuccess && resp.Error != protocol.ReqNameNotFound {
+		return nil, resp.Error
+	}
+	if err := cc.HandleResponse(directory.KeyLookupType, resp, name, nil); err != nil {
+		return nil, err
+	}
+	df := resp.DirectoryResponse.(*directory.DirectoryProof)
+	key := lookedUpKey(resp, df)
+	c.Add(name, key, df.STR[0])
+	return key, nil
+}
+
+// lookedUpKey returns the key a verified key lookup response binds the
+// name to, or nil if the name isn't registered.
+func lookedUpKey(resp *directory.Response, df *directory.DirectoryProof) []byte {
+	switch {
+	case resp.Error == protocol.ReqNameNotFound:
+		return nil
+	case df.AP[0].ProofType() == merkletree.ProofOfInclusion:
+		return df.AP[0].Leaf.Value
+	case df.TB != nil:
+		return df.TB.Value
+	}
+	return nil
+}
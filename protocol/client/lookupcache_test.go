@@ -0,0 +1,90 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+)
+
+func TestLookupCache(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithScheduler(directory.Interval(time.Hour)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	if _, err := d.Register(alice, key); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+
+	var calls int
+	tr := TransportFunc(func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		calls++
+		return d.HandleRequest(req), nil
+	})
+	c := NewLookupCache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+	lookupAll := func(names ...string) {
+		t.Helper()
+		for _, name := range names {
+			got, err := c.Lookup(ctx, cc, tr, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string][]byte{alice: key}[name]; !bytes.Equal(got, want) {
+				t.Fatalf("Expected %q for %s, got %q", want, name, got)
+			}
+		}
+	}
+
+	lookupAll(alice, "bob", alice, "bob")
+	if calls != 2 {
+		t.Fatalf("Expected the cached results to be served, got %d requests", calls)
+	}
+	if e, ok := c.Get(alice); !ok || e.Epoch != 2 || !e.Expires.Equal(d.NextEpoch()) {
+		t.Errorf("Unexpected cached result %+v", e)
+	}
+
+	// results expire when their epoch is scheduled to end
+	now = d.NextEpoch()
+	lookupAll(alice)
+	if calls != 3 {
+		t.Fatalf("Expected an expired result to be looked up again, got %d requests", calls)
+	}
+
+	// verifying a later epoch expires the results of earlier ones
+	now = time.Now()
+	d.Update()
+	lookupAll("carol", "bob")
+	if calls != 5 {
+		t.Fatalf("Expected a result of an earlier epoch to be looked up again, got %d requests", calls)
+	}
+
+	c.Invalidate("bob")
+	if _, ok := c.Get("bob"); ok {
+		t.Error("Expected an invalidated result not to be served")
+	}
+	c.ClockSkew = 2 * time.Hour
+	if c.Add(alice, key, d.LatestSTR()) {
+		t.Error("Expected a result expiring within the clock skew not to be cached")
+	}
+	c.ClockSkew = 0
+	unscheduled := *d.LatestSTR()
+	config := *unscheduled.Policies
+	config.NextUpdate = 0
+	unscheduled.Policies = &config
+	if c.Add(alice, key, &unscheduled) {
+		t.Error("Expected a result without a scheduled epoch end not to be cached")
+	}
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// model is a map-based reference model of the directory's semantics:
+// a name registered in an epoch is promised right away, is bound in the
+// snapshot of the next epoch, and can't be registered again.
+type model struct {
+	pending map[string][]byte
+	// epochs holds the bindings in the snapshot of each epoch.
+	epochs []map[string][]byte
+}
+
+func newModel() *model {
+	return &model{
+		pending: make(map[string][]byte),
+		epochs:  []map[string][]byte{{}},
+	}
+}
+
+func (m *model) latest() map[string][]byte {
+	return m.epochs[len(m.epochs)-1]
+}
+
+// register returns whether registering name succeeds.
+func (m *model) register(name string, key []byte) bool {
+	if m.latest()[name] != nil || m.pending[name] != nil {
+		return false
+	}
+	m.pending[name] = key
+	return true
+}
+
+func (m *model) update() {
+	next := make(map[string][]byte, len(m.latest())+len(m.pending))
+	for name, key := range m.latest() {
+		next[name] = key
+	}
+	for name, key := range m.pending {
+		next[name] = key
+	}
+	m.epochs = append(m.epochs, next)
+	m.pending = make(map[string][]byte)
+}
+
+// differential applies a random sequence of operations to a directory
+// and to the model in lockstep. Every response of the directory must
+// verify, and prove what the model expects.
+type differential struct {
+	t     *testing.T
+	rnd   *rand.Rand
+	d     *directory.Tree
+	m     *model
+	cc    *ConsistencyChecks
+	names []string
+	strs  []*directory.SignedTreeRoot
+}
+
+// newDifferential returns a differential driven by the given seed, for
+// at most steps operations. The directory keeps the snapshots of all the
+// epochs they can reach, since the model doesn't evict any.
+func newDifferential(t *testing.T, seed int64, steps int) *differential {
+	// unlike that of NewTestTree, the genesis STR of a new Tree commits
+	// to its (empty) tree, so that lookups in epoch 0 verify
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), staticSigningKey, uint64(steps)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 12)
+	for i := range names {
+		names[i] = fmt.Sprintf("user%d", i)
+	}
+	return &differential{
+		t:     t,
+		rnd:   rand.New(rand.NewSource(seed)),
+		d:     d,
+		m:     newModel(),
+		cc:    New(d.LatestSTR(), true, staticSigningKey.Public()),
+		names: names,
+		strs:  []*directory.SignedTreeRoot{d.LatestSTR()},
+	}
+}
+
+func (s *differential) fatalf(op, name string, format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Fatalf("epoch %d, %s %q: %s", len(s.m.epochs)-1, op, name, fmt.Sprintf(format, args...))
+}
+
+func (s *differential) step() {
+	name := s.names[s.rnd.Intn(len(s.names))]
+	switch n := s.rnd.Intn(10); {
+	case n < 3:
+		s.register(name)
+	case n < 6:
+		s.lookup(name)
+	case n < 8:
+		s.lookupInEpoch(name)
+	default:
+		s.update()
+	}
+}
+
+func (s *differential) register(name string) {
+	s.t.Helper()
+	key := []byte(fmt.Sprintf("key of %s #%d", name, s.rnd.Int()))
+	want := s.m.register(name, key)
+	resp, err := s.d.Register(name, key)
+	switch {
+	case want && err != nil:
+		s.fatalf("register", name, "expect success, got %v", err)
+	case !want && !directory.IsKeyExistsError(err):
+		s.fatalf("register", name, "expect %v, got %v", directory.ErrKeyExists(name), err)
+	}
+	str := resp.STR
+	if want {
+		if !resp.AuthPath.ProofType().IsAbsence() {
+			s.fatalf("register", name, "expect a proof of absence")
+		}
+		if err := VerifyAuthPath(name, nil, resp.AuthPath, str); err != nil {
+			s.fatalf("register", name, "%v", err)
+		}
+		if err := VerifyPromise(staticSigningKey.Public(), key, resp.TB, resp.AuthPath, str); err != nil {
+			s.fatalf("register", name, "%v", err)
+		}
+		return
+	}
+	if bound := s.m.latest()[name]; bound != nil {
+		if err := VerifyAuthPath(name, bound, resp.AuthPath, str); err != nil ||
+			resp.AuthPath.ProofType() != merkletree.ProofOfInclusion {
+			s.fatalf("register", name, "expect a proof of the existing binding, got %v", err)
+		}
+		return
+	}
+	if err := VerifyPromise(staticSigningKey.Public(), s.m.pending[name], resp.TB, resp.AuthPath, str); err != nil {
+		s.fatalf("register", name, "expect the pending promise, got %v", err)
+	}
+}
+
+func (s *differential) lookup(name string) {
+	s.t.Helper()
+	msg := s.d.KeyLookup(&directory.KeyLookupRequest{Username: name})
+	bound, pending := s.m.latest()[name], s.m.pending[name]
+	wantCode := protocol.ReqSuccess
+	if bound == nil && pending == nil {
+		wantCode = protocol.ReqNameNotFound
+	}
+	if msg.Error != wantCode {
+		s.fatalf("lookup", name, "expect %v, got %v", wantCode, msg.Error)
+	}
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	ap, str := df.AP[0], df.STR[0]
+	if str.Epoch != merkletree.Epoch(len(s.m.epochs)-1) {
+		s.fatalf("lookup", name, "expect the latest STR, got epoch %d", str.Epoch)
+	}
+	if err := ap.VerifyBinding(str.TreeHash[:], ap.TreeNonce, ap.LookupIndex, []byte(name), bound); err != nil {
+		s.fatalf("lookup", name, "%v", err)
+	}
+	if pending != nil && bound == nil {
+		if df.TB == nil || !bytes.Equal(df.TB.Value, pending) {
+			s.fatalf("lookup", name, "expect the pending promise, got %v", df.TB)
+		}
+	}
+	key := bound
+	if key == nil {
+		key = pending
+	}
+	if err := s.cc.HandleResponse(directory.KeyLookupType, msg, name, key); err != nil {
+		s.fatalf("lookup", name, "client rejects the response: %v", err)
+	}
+}
+
+func (s *differential) lookupInEpoch(name string) {
+	s.t.Helper()
+	ep := merkletree.Epoch(s.rnd.Intn(len(s.m.epochs)))
+	msg := s.d.KeyLookupInEpoch(&directory.KeyLookupInEpochRequest{Username: name, Epoch: ep})
+	bound := s.m.epochs[ep][name]
+	wantCode := protocol.ReqSuccess
+	if bound == nil {
+		wantCode = protocol.ReqNameNotFound
+	}
+	if msg.Error != wantCode {
+		s.fatalf("lookup in epoch", name, "epoch %d: expect %v, got %v", ep, wantCode, msg.Error)
+	}
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if len(df.STR) != len(s.m.epochs)-int(ep) {
+		s.fatalf("lookup in epoch", name, "epoch %d: expect STRs through the latest epoch, got %d",
+			ep, len(df.STR))
+	}
+	for i, str := range df.STR {
+		if str.Signature != s.strs[int(ep)+i].Signature {
+			s.fatalf("lookup in epoch", name, "epoch %d: STR %d differs from the one published",
+				ep, str.Epoch)
+		}
+	}
+	ap, str := df.AP[0], df.STR[0]
+	if err := VerifyAuthPath(name, bound, ap, str); err != nil {
+		s.fatalf("lookup in epoch", name, "epoch %d: %v", ep, err)
+	}
+	if err := ap.VerifyBinding(str.TreeHash[:], ap.TreeNonce, ap.LookupIndex, []byte(name), bound); err != nil {
+		s.fatalf("lookup in epoch", name, "epoch %d: %v", ep, err)
+	}
+}
+
+func (s *differential) update() {
+	s.t.Helper()
+	s.m.update()
+	s.d.Update()
+	str := s.d.LatestSTR()
+	// the client follows every epoch, as it would by fetching the STR
+	// history before a lookup
+	if err := s.cc.AuditDirectory([]*directory.SignedTreeRoot{str}); err != nil {
+		s.fatalf("update", "", "client rejects the STR: %v", err)
+	}
+	s.cc.Update(str)
+	s.strs = append(s.strs, str)
+	// every binding of the model is in the new snapshot
+	for _, name := range s.names {
+		ap := s.d.KeyLookupInEpoch(&directory.KeyLookupInEpochRequest{Username: name,
+			Epoch: str.Epoch}).DirectoryResponse.(*directory.DirectoryProof).AP[0]
+		if err := ap.VerifyBinding(str.TreeHash[:], ap.TreeNonce, ap.LookupIndex, []byte(name),
+			s.m.latest()[name]); err != nil {
+			s.fatalf("update", name, "%v", err)
+		}
+	}
+}
+
+func TestDifferentialAgainstModel(t *testing.T) {
+	steps := 200
+	if testing.Short() {
+		steps = 50
+	}
+	for seed := int64(1); seed <= 4; seed++ {
+		t.Run(fmt.Sprint("seed ", seed), func(t *testing.T) {
+			s := newDifferential(t, seed, steps)
+			for i := 0; i < steps; i++ {
+				s.step()
+			}
+		})
+	}
+}
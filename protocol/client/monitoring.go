@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// verifyMonitoring verifies the authentication paths in a response to
+// a MonitoringRequest, one per epoch, against the STR for the same epoch.
+// Before its registration, uname must be absent; once included, it must
+// stay bound to the same key, except for the expected key transitions
+// (see HandleTransition), until it's deleted: it may be absent again from
+// the epoch of the deletion on if the response comes with the tombstone
+// of its last binding, which is then recorded in cc.Deletions, and must
+// stay absent. If key is nil, the key of the first proof of inclusion is
+// accepted (TOFU).
+//
+// The paths are verified concurrently by up to cc.MonitorParallelism
+// goroutines, but the result doesn't depend on scheduling: if several
+// epochs fail, verifyMonitoring returns the error for the earliest one.
+// On mostly idle directories, most paths don't need to be verified at
+// all; see unchangedEpochs.
+func (cc *ConsistencyChecks) verifyMonitoring(msg *directory.Response,
+	uname string, key []byte) error {
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if msg.Error != protocol.ReqSuccess {
+		return protocol.ErrMalformedMessage
+	}
+
+	// the order of proof types is cheap to check up front
+	included := false
+	var deleted *directory.Deletion
+	for i, ap := range df.AP {
+		switch {
+		case ap.ProofType() == merkletree.ProofOfInclusion:
+			if deleted != nil {
+				return protocol.CheckBindingsDiffer
+			}
+			if key == nil {
+				key = ap.Leaf.Value
+			}
+			included = true
+		case included && deleted == nil:
+			// only their owners can remove bindings
+			if deleted = removedBy(df, uname, df.AP[i-1].Leaf.Value, df.STR[i].Epoch); deleted == nil {
+				return protocol.CheckBindingsDiffer
+			}
+		}
+	}
+
+	unchanged := cc.unchangedEpochs(df, uname, key)
+	errs := make([]error, len(df.AP))
+	// first is the index of the earliest failure found so far;
+	// later epochs needn't be verified once it's known
+	first := int64(len(df.AP))
+	parallelFor(len(df.AP), cc.monitorParallelism(), func(i int) {
+		if unchanged[i] || int64(i) > atomic.LoadInt64(&first) {
+			return
+		}
+		want := cc.expectedKey(uname, key, df.STR[i].Epoch)
+		if errs[i] = cc.verifyAuthPath(uname, want, df.AP[i], df.STR[i]); errs[i] != nil {
+			for {
+				cur := atomic.LoadInt64(&first)
+				if int64(i) >= cur || atomic.CompareAndSwapInt64(&first, cur, int64(i)) {
+					break
+				}
+			}
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	if deleted != nil {
+		cc.Deletions[uname] = deleted
+	}
+	return nil
+}
+
+// removedBy returns the tombstone attached to the monitoring proof df if
+// it deletes the binding of uname to key, as of epoch or earlier, and nil
+// otherwise.
+func removedBy(df *directory.DirectoryProof, uname string, key []byte, epoch merkletree.Epoch) *directory.Deletion {
+	if del := df.Deletion; del != nil && del.Epoch <= epoch && del.Deletes(uname, key) {
+		return del
+	}
+	return nil
+}
+
+// unchangedEpochs returns, for every epoch of the monitoring proof df,
+// whether its authentication path can be skipped because nothing changed
+// since the epoch before: in an idle epoch, the tree and thus the path
+// stay the same, and a path equal to the one before, checked against an
+// STR with the same tree hash, depth and policies for the same key,
+// verifies iff the one before does. Only the first epoch of such a run
+// needs to be verified, and the rest only need their STRs to extend the
+// hash chain, which updateSTR audits anyway. Comparing paths byte by
+// byte is much cheaper than verifying their VRF proofs and hashing them.
+func (cc *ConsistencyChecks) unchangedEpochs(df *directory.DirectoryProof, uname string, key []byte) []bool {
+	unchanged := make([]bool, len(df.AP))
+	for i := 1; i < len(df.AP); i++ {
+		prev, str := df.STR[i-1], df.STR[i]
+		unchanged[i] = str.Epoch > prev.Epoch && sameRoot(prev, str) && df.AP[i].Equal(df.AP[i-1]) &&
+			bytes.Equal(cc.expectedKey(uname, key, prev.Epoch), cc.expectedKey(uname, key, str.Epoch))
+	}
+	return unchanged
+}
+
+// sameRoot returns true iff a and b commit to the same tree under the
+// same policies, so that any authentication path verifies against both
+// or neither, as long as its leaf isn't from after either epoch.
+func sameRoot(a, b *directory.SignedTreeRoot) bool {
+	if a.TreeHash != b.TreeHash || a.MaxDepth != b.MaxDepth {
+		return false
+	}
+	if a.Policies == b.Policies {
+		return true
+	}
+	if a.Policies == nil || b.Policies == nil {
+		return false
+	}
+	return bytes.Equal(epochless(a.Policies).Bytes(), epochless(b.Policies).Bytes())
+}
+
+// epochless returns a copy of p without the fields that describe the
+// epoch of its STR rather than the directory's policies: NextUpdate,
+// Stats and Approvals.
+func epochless(p *directory.Config) *directory.Config {
+	c := *p
+	c.NextUpdate, c.Stats, c.Approvals = 0, nil, nil
+	return &c
+}
+
+func (cc *ConsistencyChecks) monitorParallelism() int {
+	if cc.MonitorParallelism > 0 {
+		return cc.MonitorParallelism
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// parallelFor calls f(i) for every i in [0, n) using at most workers
+// goroutines. Indices are handed out in increasing order.
+func parallelFor(n, workers int, f func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
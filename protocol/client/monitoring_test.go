@@ -0,0 +1,316 @@
+package client
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// monitored returns a test directory where alice has been registered
+// with key in epoch 1, and that has been updated n times since, and
+// a client that has only seen the STR for epoch 1.
+func monitored(t *testing.T, n int) (*directory.Tree, *ConsistencyChecks) {
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), staticSigningKey, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	resp, err := d.Register(alice, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.HandleResponse(directory.RegistrationType, resp.Response(), alice, key); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		d.Update()
+	}
+	return d, cc
+}
+
+var (
+	alice = "alice"
+	key   = []byte("key")
+)
+
+func monitor(d *directory.Tree, start merkletree.Epoch) *directory.Response {
+	return d.Monitor(&directory.MonitoringRequest{
+		Username:   alice,
+		StartEpoch: start,
+		EndEpoch:   d.LatestSTR().Epoch,
+	})
+}
+
+func TestMonitoring(t *testing.T) {
+	d, cc := monitored(t, 40)
+	if err := cc.HandleResponse(directory.MonitoringType, monitor(d, 2), alice, key); err != nil {
+		t.Fatal(err)
+	}
+	if cc.VerifiedSTR().Epoch != 41 {
+		t.Error("Expect verified epoch 41, got", cc.VerifiedSTR().Epoch)
+	}
+	if len(cc.TBs) != 0 {
+		t.Error("Expect the temporary binding to be fulfilled")
+	}
+
+	// TOFU
+	cc = New(d.GetSTRHistory(&directory.STRHistoryRequest{StartEpoch: 1, EndEpoch: 1}).
+		DirectoryResponse.(*directory.STRHistoryRange).STR[0], true, staticSigningKey.Public())
+	if err := cc.HandleResponse(directory.MonitoringType, monitor(d, 2), alice, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMonitoringKeyRotation(t *testing.T) {
+	d, cc := monitored(t, 0)
+	newKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ScheduleKeyRotation(newKey, 4); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		d.Update()
+	}
+	if err := cc.HandleResponse(directory.MonitoringType, monitor(d, 2), alice, key); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cc.SignKey(), newKey.Public()) {
+		t.Fatal("Expect the client to follow the rotation, got", cc.SignKey())
+	}
+	// later STRs verify with the new key
+	d.Update()
+	if err := cc.HandleResponse(directory.KeyLookupType, d.KeyLookup(&directory.KeyLookupRequest{Username: alice}),
+		alice, key); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMonitoringRemovedBinding(t *testing.T) {
+	d, cc := monitored(t, 3)
+	msg := monitor(d, 1)
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	// present the absence proof for epoch 1 as the latest one
+	df.AP = append(df.AP[1:], df.AP[0])
+	err := cc.verifyMonitoring(msg, alice, key)
+	if err != protocol.CheckBindingsDiffer {
+		t.Fatal("Expect", protocol.CheckBindingsDiffer, "got", err)
+	}
+}
+
+func TestMonitoringDeletion(t *testing.T) {
+	// the directory keeps deleted bindings in its tree, so use a PAD that
+	// removes one to see the client accept its absence
+	vrfKey := crypto.NewStaticTestVRFKey()
+	vrfPublic, _ := vrfKey.Public()
+	pad, err := merkletree.NewPAD(directory.NewConfig(vrfPublic), staticSigningKey, vrfKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := directory.NewDirSTR(pad.LatestSTR())
+	aliceKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := []byte(aliceKey.Public())
+	if err := pad.Set([]byte(alice), pub); err != nil {
+		t.Fatal(err)
+	}
+	mustUpdatePAD(t, pad) // epoch 1
+	mustUpdatePAD(t, pad)
+	if _, err := pad.Delete([]byte(alice)); err != nil {
+		t.Fatal(err)
+	}
+	mustUpdatePAD(t, pad) // epoch 3
+	mustUpdatePAD(t, pad)
+	del := &directory.Deletion{Username: alice, Key: pub, Epoch: 3}
+	del.Sign(aliceKey)
+
+	monitorPAD := func(del *directory.Deletion) *directory.Response {
+		var aps []*merkletree.AuthenticationPath
+		var strs []*directory.SignedTreeRoot
+		for epoch := merkletree.Epoch(1); epoch <= 4; epoch++ {
+			ap, err := pad.LookupInEpoch([]byte(alice), epoch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			aps = append(aps, ap)
+			strs = append(strs, directory.NewDirSTR(pad.GetSTR(epoch)))
+		}
+		res := directory.NewMonitoringProof(aps, strs)
+		res.DirectoryResponse.(*directory.DirectoryProof).Deletion = del
+		return res
+	}
+
+	late := *del
+	late.Epoch = 4
+	late.Sign(aliceKey)
+	forged := *del
+	forged.Key = key
+	for name, tombstone := range map[string]*directory.Deletion{
+		"no tombstone":   nil,
+		"later deletion": &late,
+		"other key":      &forged,
+	} {
+		cc := New(genesis, true, staticSigningKey.Public())
+		if err := cc.HandleResponse(directory.MonitoringType, monitorPAD(tombstone), alice, pub); err != protocol.CheckBindingsDiffer {
+			t.Error(name, "Expect", protocol.CheckBindingsDiffer, "got", err)
+		}
+	}
+
+	cc := New(genesis, true, staticSigningKey.Public())
+	if err := cc.HandleResponse(directory.MonitoringType, monitorPAD(del), alice, pub); err != nil {
+		t.Fatal(err)
+	}
+	if cc.VerifiedSTR().Epoch != 4 {
+		t.Error("Expect verified epoch 4, got", cc.VerifiedSTR().Epoch)
+	}
+	if !cc.Deleted(alice, pub) {
+		t.Error("Expect the tombstone to be recorded")
+	}
+
+	// once removed, the binding can't reappear
+	cc = New(genesis, true, staticSigningKey.Public())
+	msg := monitorPAD(del)
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	df.AP[3] = df.AP[1]
+	if err := cc.verifyMonitoring(msg, alice, pub); err != protocol.CheckBindingsDiffer {
+		t.Error("Expect", protocol.CheckBindingsDiffer, "got", err)
+	}
+}
+
+func mustUpdatePAD(t *testing.T, pad *merkletree.PAD) {
+	if _, err := pad.Update(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMonitoringEarliestError(t *testing.T) {
+	d, cc := monitored(t, 64)
+	// tamper with the proofs for the epochs vrfEpoch and valueEpoch of
+	// a response that starts at epoch 2
+	tamper := func(msg *directory.Response, vrfEpoch, valueEpoch int) {
+		aps := msg.DirectoryResponse.(*directory.DirectoryProof).AP
+		for i, ap := range aps {
+			cp := *ap
+			leaf := *ap.Leaf
+			cp.Leaf = &leaf
+			switch i + 2 {
+			case vrfEpoch:
+				cp.VrfProof = append([]byte(nil), ap.VrfProof...)
+				cp.VrfProof[0] ^= 1
+			case valueEpoch:
+				leaf.Value = []byte("evil")
+			}
+			aps[i] = &cp
+		}
+	}
+
+	for _, tc := range []struct {
+		vrfEpoch, valueEpoch int
+		want                 error
+	}{
+		{10, 50, protocol.CheckBadVRFProof},
+		{50, 10, protocol.CheckBindingsDiffer},
+		{65, 2, protocol.CheckBindingsDiffer},
+	} {
+		for _, parallelism := range []int{1, 2, 8, 100} {
+			cc.MonitorParallelism = parallelism
+			msg := monitor(d, 2)
+			tamper(msg, tc.vrfEpoch, tc.valueEpoch)
+			if err := cc.verifyMonitoring(msg, alice, key); err != tc.want {
+				t.Error(tc.vrfEpoch, tc.valueEpoch, parallelism, "Expect", tc.want, "got", err)
+			}
+		}
+	}
+}
+
+func TestSameRoot(t *testing.T) {
+	d := directory.NewTestTree(t)
+	d.Update()
+	str := d.LatestSTR()
+	with := func(f func(p *directory.Config)) *directory.SignedTreeRoot {
+		policies := *str.Policies
+		f(&policies)
+		return &directory.SignedTreeRoot{SignedTreeRoot: str.SignedTreeRoot, Policies: &policies}
+	}
+
+	// a scheduled or co-managed directory's idle epochs have the same root
+	scheduled := with(func(p *directory.Config) {
+		p.NextUpdate = 42
+		p.Stats = &directory.ActivityStats{Epsilon: 1, Registrations: 3}
+		p.Approvals = []*directory.Approval{{}}
+	})
+	if !sameRoot(str, scheduled) || !sameRoot(scheduled, str) {
+		t.Error("Expect the epoch's schedule, stats and approvals to be ignored")
+	}
+	if resized := with(func(p *directory.Config) { p.IndexSize-- }); sameRoot(str, resized) {
+		t.Error("Expect other policies to be compared")
+	}
+}
+
+func TestUnchangedEpochs(t *testing.T) {
+	d, cc := monitored(t, 2)
+	if _, err := d.Register("bob", key); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		d.Update()
+	}
+	// epochs 1 to 6: alice is absent, registered in epoch 2, unchanged
+	// in epoch 3, bob is registered in epoch 4, then idle epochs
+	msg := monitor(d, 1)
+	df := msg.DirectoryResponse.(*directory.DirectoryProof)
+	want := []bool{false, false, true, false, true, true}
+	got := cc.unchangedEpochs(df, alice, key)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Expect", want, "got", got)
+	}
+	if err := cc.verifyMonitoring(msg, alice, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key transition changes the expected key, so the paths must be
+	// verified again
+	cc.Transitions[alice] = &directory.KeyTransition{OldKey: key, NewKey: []byte("new key"), Epoch: 6}
+	if got := cc.unchangedEpochs(df, alice, key); got[5] {
+		t.Error("Expect epoch 6 to be verified after the transition")
+	}
+
+	// the shortcut doesn't hide a proof that doesn't match the STR
+	msg = monitor(d, 1)
+	df = msg.DirectoryResponse.(*directory.DirectoryProof)
+	cp := *df.AP[1]
+	leaf := *cp.Leaf
+	leaf.Value = []byte("evil")
+	cp.Leaf = &leaf
+	for i := 1; i < len(df.AP); i++ {
+		df.AP[i] = &cp
+	}
+	delete(cc.Transitions, alice)
+	if err := cc.verifyMonitoring(msg, alice, key); err != protocol.CheckBindingsDiffer {
+		t.Error("Expect", protocol.CheckBindingsDiffer, "got", err)
+	}
+}
+
+func TestParallelFor(t *testing.T) {
+	for _, workers := range []int{0, 1, 3, 64} {
+		seen := make([]int, 50)
+		parallelFor(len(seen), workers, func(i int) {
+			seen[i]++
+		})
+		for i, n := range seen {
+			if n != 1 {
+				t.Fatal(workers, "workers: expect index", i, "to be visited once, got", n)
+			}
+		}
+	}
+}
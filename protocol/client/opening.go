@@ -0,0 +1,52 @@
+package client
+
+import (
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// VerifyOpening verifies the directory's response msg to the user's
+// directory.OpeningRequest req, and returns the opening of the
+// commitment to their binding in req.Epoch. key is the key the user
+// registered, and str the STR for req.Epoch the client verified, e.g.
+// its VerifiedSTR() or one it archived.
+//
+// It returns the error code of msg if the directory didn't open the
+// commitment, protocol.ErrMalformedMessage if msg isn't a proof for
+// req.Epoch, and protocol.CheckBadSTR if it's for another STR than str.
+// If the proof doesn't bind req.Username to exactly key, it returns
+// protocol.CheckBindingsDiffer, and if the commitment doesn't open to
+// it, protocol.CheckBadCommitment; either means the directory committed
+// to other key material than the user registered.
+func VerifyOpening(req *directory.OpeningRequest, key []byte, str *directory.SignedTreeRoot,
+	msg *directory.Response) (hashed.Commit, error) {
+	if err := msg.Validate(); err != nil {
+		return hashed.Commit{}, err
+	}
+	if msg.Error != protocol.ReqSuccess {
+		return hashed.Commit{}, msg.Error
+	}
+	df, ok := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if !ok || len(df.AP) != 1 || len(df.STR) == 0 || str.Epoch != req.Epoch {
+		return hashed.Commit{}, protocol.ErrMalformedMessage
+	}
+	if df.STR[0].Epoch != req.Epoch {
+		return hashed.Commit{}, protocol.ErrMalformedMessage
+	}
+	if df.STR[0].Signature != str.Signature {
+		return hashed.Commit{}, protocol.CheckBadSTR
+	}
+	ap := df.AP[0]
+	if ap.Leaf == nil {
+		return hashed.Commit{}, protocol.ErrMalformedMessage
+	}
+	if ap.ProofType() != merkletree.ProofOfInclusion {
+		return hashed.Commit{}, protocol.CheckBindingsDiffer
+	}
+	if err := VerifyAuthPath(req.Username, key, ap, str); err != nil {
+		return hashed.Commit{}, err
+	}
+	return ap.Leaf.Commitment, nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestVerifyOpening(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := []byte(aliceKey.Public())
+	if _, err := d.Register(alice, pub); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	str := d.LatestSTR()
+	d.Update()
+
+	req := &directory.OpeningRequest{Username: alice, Epoch: str.Epoch}
+	req.Sign(aliceKey)
+	open := func() *directory.Response {
+		return d.HandleRequest(&directory.Request{Type: directory.OpeningType, Request: req})
+	}
+	commit, err := VerifyOpening(req, pub, str, open())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commit.Verify([]byte(alice), pub) {
+		t.Error("Expect the opening of the commitment to alice's key")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		key    []byte
+		str    *directory.SignedTreeRoot
+		tamper func(df *directory.DirectoryProof)
+		want   error
+	}{
+		{"other key", []byte("key"), str, nil, protocol.CheckBindingsDiffer},
+		{"other STR", pub, d.LatestSTR(), nil, protocol.ErrMalformedMessage},
+		{"forked STR", pub, str, func(df *directory.DirectoryProof) {
+			forked := *df.STR[0].SignedTreeRoot
+			forked.Signature[0] ^= 1
+			df.STR[0] = &directory.SignedTreeRoot{SignedTreeRoot: &forked, Policies: df.STR[0].Policies}
+		}, protocol.CheckBadSTR},
+		{"other salt", pub, str, func(df *directory.DirectoryProof) {
+			df.AP[0].Leaf.Commitment.Salt = []byte("salt")
+		}, protocol.CheckBadCommitment},
+	} {
+		msg := open()
+		if tc.tamper != nil {
+			tc.tamper(msg.DirectoryResponse.(*directory.DirectoryProof))
+		}
+		if _, err := VerifyOpening(req, tc.key, tc.str, msg); err != tc.want {
+			t.Error(tc.name, "Expect", tc.want, "got", err)
+		}
+	}
+
+	rejected := &directory.OpeningRequest{Username: alice, Epoch: str.Epoch}
+	rejected.Sign(staticSigningKey)
+	msg := d.HandleRequest(&directory.Request{Type: directory.OpeningType, Request: rejected})
+	if _, err := VerifyOpening(rejected, pub, str, msg); err != protocol.ReqRejected {
+		t.Error("Expect", protocol.ReqRejected, "got", err)
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrBindingExpired indicates that the binding a key lookup response
+// returns has expired because its owner didn't re-attest it in time, so
+// the client must not use it until they do.
+var ErrBindingExpired = errors.New("[client] The binding has expired")
+
+// checkReattestation verifies the re-attestation attached to the
+// verified key lookup or monitoring response msg for uname, if any,
+// which attests the binding in the latest epoch of msg, and records
+// a valid one in cc.Reattestations; an invalid one causes it to return
+// protocol.ErrMalformedMessage. If the directory has
+// a ReattestationInterval, checkReattestation returns ErrBindingExpired
+// if the binding the latest authentication path of msg proves has
+// expired by the epoch of the response's STR, which it derives from the
+// leaf and the re-attestation (see directory.Config.BindingExpiry), so
+// a directory can't hide the expiry by omitting both. A binding the
+// directory flags as expired is expired too.
+func (cc *ConsistencyChecks) checkReattestation(requestType int, msg *directory.Response, uname string) error {
+	if requestType != directory.KeyLookupType && requestType != directory.MonitoringType {
+		return nil
+	}
+	df, ok := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if !ok {
+		return nil
+	}
+	str := df.STR[len(df.STR)-1]
+	if str.Policies.ReattestationInterval == 0 {
+		if df.Reattestation != nil || df.Expired {
+			return protocol.ErrMalformedMessage
+		}
+		return nil
+	}
+	ap := df.AP[len(df.AP)-1]
+	key := lookedUpKey(msg, df)
+	if requestType == directory.MonitoringType {
+		key = ap.Leaf.Value
+	}
+	r := df.Reattestation
+	if r != nil {
+		if !r.Attests(uname, key) {
+			return protocol.ErrMalformedMessage
+		}
+		if prev := cc.Reattestations[uname]; prev == nil || !bytes.Equal(prev.Key, r.Key) || prev.Epoch < r.Epoch {
+			cc.Reattestations[uname] = r
+		}
+	}
+	if df.Expired {
+		return ErrBindingExpired
+	}
+	// a binding that's only promised by a TB was just made
+	if ap.ProofType() == merkletree.ProofOfInclusion && bytes.Equal(ap.Leaf.Value, key) &&
+		str.Epoch >= str.Policies.BindingExpiry(ap.Leaf, r) {
+		return ErrBindingExpired
+	}
+	return nil
+}
+
+// ReattestationDue reports whether the owner of the binding of uname to
+// key should re-attest it (see directory.Reattestation), because the
+// binding expires within margin epochs after the verified STR, or the
+// client hasn't seen it re-attested yet. Owners monitoring their
+// binding call it after every monitoring response, and re-attest it with a
+// directory.ReattestationRequest when it returns true. It returns false
+// if the directory doesn't require re-attestations.
+func (cc *ConsistencyChecks) ReattestationDue(uname string, key []byte, margin uint64) bool {
+	str := cc.VerifiedSTR()
+	if str.Policies.ReattestationInterval == 0 {
+		return false
+	}
+	r := cc.Reattestations[uname]
+	if r == nil || !bytes.Equal(r.Key, key) {
+		return true
+	}
+	return uint64(str.Epoch)+margin >= uint64(r.Expiry(str.Policies))
+}
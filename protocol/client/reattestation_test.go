@@ -0,0 +1,111 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestReattestation(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithReattestationInterval(3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	aliceKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := []byte(aliceKey.Public())
+	if _, err := d.Register(alice, pub); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	lookup := func() *directory.Response {
+		return d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	}
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != nil {
+		t.Fatal(err)
+	}
+	if !cc.ReattestationDue(alice, pub, 0) {
+		t.Error("Expect a binding that was never re-attested to be due")
+	}
+
+	r := &directory.Reattestation{Username: alice, Key: pub, Epoch: d.LatestSTR().Epoch + 1}
+	r.Sign(aliceKey)
+	if err := d.Reattest(r); err != nil {
+		t.Fatal(err)
+	}
+	res := lookup()
+	forged := *r
+	forged.Epoch += 10
+	res.DirectoryResponse.(*directory.DirectoryProof).Reattestation = &forged
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, pub); err != protocol.ErrMalformedMessage {
+		t.Fatalf("Expect a forged re-attestation to fail with ErrMalformedMessage, got %v", err)
+	}
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != nil {
+		t.Fatal(err)
+	}
+	// r expires 3 epochs after epoch 2
+	if cc.Reattestations[alice] != r || cc.ReattestationDue(alice, pub, 1) || !cc.ReattestationDue(alice, pub, 4) {
+		t.Fatalf("Unexpected reminders for %+v", cc.Reattestations[alice])
+	}
+
+	for d.LatestSTR().Epoch < 4 {
+		d.Update()
+		if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Update()
+	if err := cc.HandleResponse(directory.KeyLookupType, lookup(), alice, pub); err != ErrBindingExpired {
+		t.Fatalf("Expect ErrBindingExpired, got %v", err)
+	}
+	// a directory hiding the expiry is caught by the re-attestation
+	res = lookup()
+	res.DirectoryResponse.(*directory.DirectoryProof).Expired = false
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, pub); err != ErrBindingExpired {
+		t.Fatalf("Expect ErrBindingExpired, got %v", err)
+	}
+	// and by the leaf if it hides the re-attestation too
+	res = lookup()
+	res.DirectoryResponse.(*directory.DirectoryProof).Expired = false
+	res.DirectoryResponse.(*directory.DirectoryProof).Reattestation = nil
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, pub); err != ErrBindingExpired {
+		t.Fatalf("Expect ErrBindingExpired without the re-attestation, got %v", err)
+	}
+	mon := d.Monitor(&directory.MonitoringRequest{Username: alice, StartEpoch: d.LatestSTR().Epoch, EndEpoch: d.LatestSTR().Epoch})
+	if err := cc.HandleResponse(directory.MonitoringType, mon, alice, pub); err != ErrBindingExpired {
+		t.Fatalf("Expect ErrBindingExpired for monitoring, got %v", err)
+	}
+	if !cc.ReattestationDue(alice, pub, 0) {
+		t.Error("Expect an expired binding to be due")
+	}
+}
+
+func TestReattestationDisabled(t *testing.T) {
+	d := directory.NewTestTree(t)
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	if _, err := d.Register(alice, key); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	res := d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, key); err != nil {
+		t.Fatal(err)
+	}
+	if cc.ReattestationDue(alice, key, 100) {
+		t.Error("Expect no reminders without a re-attestation interval")
+	}
+	res.DirectoryResponse.(*directory.DirectoryProof).Expired = true
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, key); err != protocol.ErrMalformedMessage {
+		t.Errorf("Expect an expiry without an interval to fail with ErrMalformedMessage, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrKeyRevoked indicates that the key a response binds the user to has
+// been revoked, so the client must not encrypt to it.
+var ErrKeyRevoked = errors.New("[client] The key has been revoked")
+
+// checkRevocation verifies the revocation attached to the verified
+// response msg for uname, if any. A valid revocation is recorded in
+// cc.Revocations, and causes checkRevocation to return ErrKeyRevoked; an
+// invalid one protocol.ErrMalformedMessage.
+func (cc *ConsistencyChecks) checkRevocation(msg *directory.Response, uname string) error {
+	df, ok := msg.DirectoryResponse.(*directory.DirectoryProof)
+	if !ok || df.Revocation == nil {
+		return nil
+	}
+	r := df.Revocation
+	if !r.Revokes(uname, lookedUpKey(msg, df)) {
+		return protocol.ErrMalformedMessage
+	}
+	cc.Revocations[uname] = r
+	return ErrKeyRevoked
+}
+
+// Revoked reports whether the client has learned that key, bound to
+// uname, has been revoked.
+func (cc *ConsistencyChecks) Revoked(uname string, key []byte) bool {
+	r := cc.Revocations[uname]
+	return r != nil && bytes.Equal(r.Key, key)
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestKeyRevocation(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithScheduler(directory.Interval(time.Hour)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	aliceKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := []byte(aliceKey.Public())
+	if _, err := d.Register(alice, pub); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+
+	c := NewLookupCache()
+	tr := TransportFunc(func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		return d.HandleRequest(req), nil
+	})
+	if _, err := c.Lookup(context.Background(), cc, tr, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &directory.Revocation{Username: alice, Key: pub, Epoch: d.LatestSTR().Epoch}
+	r.Sign(aliceKey)
+	if err := d.Revoke(r); err != nil {
+		t.Fatal(err)
+	}
+	res := d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	df := res.DirectoryResponse.(*directory.DirectoryProof)
+	forged := *df.Revocation
+	forged.Epoch++
+	df.Revocation = &forged
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, pub); err != protocol.ErrMalformedMessage {
+		t.Fatalf("Expected a forged revocation to fail with ErrMalformedMessage, got %v", err)
+	}
+	if cc.Revoked(alice, pub) {
+		t.Fatal("Expected a forged revocation not to be recorded")
+	}
+
+	// the cache serves the key until the client sees the revocation,
+	// which it does in the same epoch
+	if _, err := c.Lookup(context.Background(), cc, tr, alice); err != nil {
+		t.Fatal(err)
+	}
+	res = d.KeyLookup(&directory.KeyLookupRequest{Username: alice})
+	if err := cc.HandleResponse(directory.KeyLookupType, res, alice, pub); err != ErrKeyRevoked {
+		t.Fatalf("Expected ErrKeyRevoked, got %v", err)
+	}
+	if !cc.Revoked(alice, pub) || cc.Revoked(alice, key) {
+		t.Fatalf("Expected only the revoked key to be recorded, got %+v", cc.Revocations)
+	}
+	if _, err := c.Lookup(context.Background(), cc, tr, alice); err != ErrKeyRevoked {
+		t.Fatalf("Expected the cached key to be refused, got %v", err)
+	}
+	if _, ok := c.Get(alice); ok {
+		t.Error("Expected the revoked key to be evicted from the cache")
+	}
+}
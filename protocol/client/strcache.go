@@ -0,0 +1,90 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+)
+
+// DefaultSTRCacheSize is the number of epochs whose verified STRs a
+// ConsistencyChecks remembers by default.
+const DefaultSTRCacheSize = 256
+
+// An STRCache is an LRU cache of STRs whose signatures have been
+// verified, keyed by epoch. It stores a digest of each STR and its
+// signature, so that a different STR for a cached epoch is a cache miss.
+// It is safe for concurrent use.
+type STRCache struct {
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List // of *strCacheEntry, most recently used first
+	byEpoch map[merkletree.Epoch]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type strCacheEntry struct {
+	epoch  merkletree.Epoch
+	digest []byte
+}
+
+var _ auditor.SignatureCache = (*STRCache)(nil)
+
+// NewSTRCache returns an STRCache holding at most size STRs.
+func NewSTRCache(size int) *STRCache {
+	return &STRCache{
+		size:    size,
+		lru:     list.New(),
+		byEpoch: make(map[merkletree.Epoch]*list.Element),
+	}
+}
+
+func strDigest(str *directory.SignedTreeRoot) []byte {
+	return hashed.Digest(str.Bytes(), str.Signature[:])
+}
+
+// Contains reports whether str was added to c and hasn't been evicted.
+func (c *STRCache) Contains(str *directory.SignedTreeRoot) bool {
+	digest := strDigest(str)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byEpoch[str.Epoch]; ok && bytes.Equal(e.Value.(*strCacheEntry).digest, digest) {
+		c.lru.MoveToFront(e)
+		c.hits++
+		return true
+	}
+	c.misses++
+	return false
+}
+
+// Add adds str to c, replacing any STR for the same epoch, and evicts
+// the least recently used STR if c is full.
+func (c *STRCache) Add(str *directory.SignedTreeRoot) {
+	entry := &strCacheEntry{epoch: str.Epoch, digest: strDigest(str)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byEpoch[str.Epoch]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.byEpoch[str.Epoch] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.byEpoch, oldest.Value.(*strCacheEntry).epoch)
+	}
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *STRCache) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// history returns the STRs of a test directory for epochs [0, n].
+func history(t *testing.T, n int) []*directory.SignedTreeRoot {
+	d := directory.NewTestTree(t)
+	strs := []*directory.SignedTreeRoot{d.LatestSTR()}
+	for i := 0; i < n; i++ {
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+	return strs
+}
+
+func TestSTRCacheLRU(t *testing.T) {
+	strs := history(t, 3)
+	c := NewSTRCache(2)
+	c.Add(strs[0])
+	c.Add(strs[1])
+	if !c.Contains(strs[0]) { // makes strs[1] the least recently used
+		t.Fatal("Expect epoch 0 to be cached")
+	}
+	c.Add(strs[2])
+	if c.Contains(strs[1]) {
+		t.Error("Expect epoch 1 to be evicted")
+	}
+	if !c.Contains(strs[0]) || !c.Contains(strs[2]) {
+		t.Error("Expect epochs 0 and 2 to be cached")
+	}
+	if hits, misses := c.Stats(); hits != 3 || misses != 1 {
+		t.Error("Expect 3 hits and 1 miss, got", hits, misses)
+	}
+}
+
+func TestSTRCacheRangeVerification(t *testing.T) {
+	strs := history(t, 4)
+	cc := New(strs[0], true, staticSigningKey.Public())
+
+	if err := cc.VerifySTRRange(strs[0], strs[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if hits, misses := cc.STRCache.Stats(); hits != 0 || misses != 4 {
+		t.Fatal("Expect 4 misses, got", hits, misses)
+	}
+	if err := cc.VerifySTRRange(strs[0], strs[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if hits, _ := cc.STRCache.Stats(); hits != 4 {
+		t.Fatal("Expect 4 hits, got", hits)
+	}
+
+	forked := history(t, 2)
+	tampered := *strs[2].SignedTreeRoot
+	tampered.LeafCount++
+
+	for _, tc := range []struct {
+		name string
+		prev *directory.SignedTreeRoot
+		strs []*directory.SignedTreeRoot
+		want error
+	}{
+		// all of these STRs are cached, but the hash chain is still checked
+		{"gap", strs[0], []*directory.SignedTreeRoot{strs[2]}, protocol.CheckBadSTR},
+		{"wrong order", strs[1], []*directory.SignedTreeRoot{strs[3], strs[2]}, protocol.CheckBadSTR},
+		{"repeated epoch", strs[1], []*directory.SignedTreeRoot{strs[2], strs[2]}, protocol.CheckBadSTR},
+		// a validly signed STR for a cached epoch isn't a cache hit
+		{"fork", strs[1], []*directory.SignedTreeRoot{forked[2]}, protocol.CheckBadSTR},
+		{"tampered", strs[1], []*directory.SignedTreeRoot{{SignedTreeRoot: &tampered, Policies: strs[2].Policies}},
+			protocol.CheckBadSignature},
+	} {
+		if err := cc.VerifySTRRange(tc.prev, tc.strs); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
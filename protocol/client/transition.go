@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrTransitionMismatch indicates that a key transition the directory
+// stores for a user is signed with neither the key the client knows the
+// user to be bound to, nor does it change to that key.
+var ErrTransitionMismatch = errors.New("[client] The key transition doesn't match the known binding")
+
+// HandleTransition verifies msg, the directory's response to a key
+// lookup of directory.TransitionName(uname), and returns the key
+// transition it contains, or nil if uname hasn't announced one. key is
+// the key the client knows uname to be bound to.
+//
+// A transition from key is recorded in cc.Transitions, and from its
+// epoch on, the checks expect uname to be bound to the new key instead
+// of key, so the change isn't reported as directory misbehavior. A past
+// transition to key is returned but not recorded. For any other
+// transition, HandleTransition returns ErrTransitionMismatch. Failed
+// checks of msg are returned as for HandleResponse.
+//
+// If the transition happens less than the MinKeyChangeInterval of the
+// verified STR's Config after the previous change of uname's key, or if
+// its Since contradicts the previous transition the client recorded,
+// HandleTransition returns protocol.CheckEarlyKeyChange: the directory
+// should have rejected the transition.
+//
+// Only key lookups and monitoring expect the new key; in particular,
+// the LightClient doesn't know about transitions.
+func (cc *ConsistencyChecks) HandleTransition(msg *directory.Response, uname string, key []byte) (*directory.KeyTransition, error) {
+	name := directory.TransitionName(uname)
+	if err := cc.HandleResponse(directory.KeyLookupType, msg, name, nil); err != nil {
+		return nil, err
+	}
+	value := lookedUpKey(msg, msg.DirectoryResponse.(*directory.DirectoryProof))
+	if value == nil {
+		return nil, nil
+	}
+	t, err := directory.ParseKeyTransition(uname, value)
+	if err != nil {
+		return nil, protocol.ErrMalformedMessage
+	}
+	if err := cc.alert(cc.checkKeyChangeInterval(uname, t), uname); err != nil {
+		return t, err
+	}
+	switch {
+	case bytes.Equal(t.OldKey, key):
+		cc.Transitions[uname] = t
+	case !bytes.Equal(t.NewKey, key):
+		return t, ErrTransitionMismatch
+	}
+	return t, nil
+}
+
+// expectedKey returns the key uname must be bound to in epoch, given
+// that the client knows it to be bound to key: the new key of a recorded
+// transition from key if it happened by epoch, and key otherwise.
+func (cc *ConsistencyChecks) expectedKey(uname string, key []byte, epoch merkletree.Epoch) []byte {
+	if t := cc.Transitions[uname]; t != nil && key != nil &&
+		epoch >= t.Epoch && bytes.Equal(key, t.OldKey) {
+		return t.NewKey
+	}
+	return key
+}
+
+// checkKeyChangeInterval returns protocol.CheckEarlyKeyChange if the
+// transition t of uname violates the directory's minimum key change
+// interval, and nil otherwise.
+func (cc *ConsistencyChecks) checkKeyChangeInterval(uname string, t *directory.KeyTransition) error {
+	if t.Epoch < t.Since || uint64(t.Epoch-t.Since) < cc.VerifiedSTR().Policies.MinKeyChangeInterval {
+		return protocol.CheckEarlyKeyChange
+	}
+	if prev := cc.Transitions[uname]; prev != nil && bytes.Equal(prev.NewKey, t.OldKey) && prev.Epoch != t.Since {
+		return protocol.CheckEarlyKeyChange
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestKeyTransition(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	oldKey, err := sign.GenerateKey(bytes.NewReader(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPub, newKey := []byte(oldKey.Public()), []byte("new key")
+	if _, err := d.Register(alice, oldPub); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	start := d.LatestSTR().Epoch
+
+	lookupTransition := func(key []byte) (*directory.KeyTransition, error) {
+		return cc.HandleTransition(d.KeyLookup(&directory.KeyLookupRequest{
+			Username: directory.TransitionName(alice),
+		}), alice, key)
+	}
+	if tr, err := lookupTransition(oldPub); tr != nil || err != nil {
+		t.Fatalf("Expected no transition, got %+v, %v", tr, err)
+	}
+
+	tr := &directory.KeyTransition{Username: alice, OldKey: oldPub, NewKey: newKey, Since: start, Epoch: start + 2}
+	tr.Sign(oldKey)
+	if err := d.AnnounceTransition(tr); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	if _, err := lookupTransition([]byte("other key")); err != ErrTransitionMismatch {
+		t.Fatalf("Expected ErrTransitionMismatch, got %v", err)
+	}
+	if _, err := lookupTransition(newKey); err != nil || len(cc.Transitions) != 0 {
+		t.Fatalf("Expected a past transition not to be recorded, got %v, %v", err, cc.Transitions)
+	}
+	if _, err := lookupTransition(oldPub); err != nil || cc.Transitions[alice] == nil {
+		t.Fatalf("Expected the transition to be recorded, got %v, %v", err, cc.Transitions)
+	}
+
+	d.Update()
+	lookupAlice := func() error {
+		return cc.HandleResponse(directory.KeyLookupType,
+			d.KeyLookup(&directory.KeyLookupRequest{Username: alice}), alice, oldPub)
+	}
+	if err := lookupAlice(); err != nil {
+		t.Fatalf("Expected the new key to be accepted, got %v", err)
+	}
+	monitor := d.Monitor(&directory.MonitoringRequest{
+		Username:   alice,
+		StartEpoch: start,
+		EndEpoch:   d.LatestSTR().Epoch,
+	})
+	monitoring := New(monitor.DirectoryResponse.(*directory.DirectoryProof).STR[0], true, staticSigningKey.Public())
+	monitoring.Transitions = cc.Transitions
+	if err := monitoring.HandleResponse(directory.MonitoringType, monitor, alice, oldPub); err != nil {
+		t.Fatalf("Expected monitoring across the transition to pass, got %v", err)
+	}
+
+	delete(cc.Transitions, alice)
+	if err := lookupAlice(); err != protocol.CheckBindingsDiffer {
+		t.Fatalf("Expected an unannounced change to fail with CheckBindingsDiffer, got %v", err)
+	}
+}
+
+func TestKeyChangeInterval(t *testing.T) {
+	d, err := directory.Open(
+		directory.WithSigningKey(staticSigningKey),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithMinKeyChangeInterval(4),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	prev := &directory.KeyTransition{Username: alice, OldKey: []byte("old"), NewKey: key, Since: 1, Epoch: 5}
+	cc.Transitions[alice] = prev
+	for _, tc := range []struct {
+		since, epoch merkletree.Epoch
+		want         error
+	}{
+		{5, 9, nil},
+		{5, 8, protocol.CheckEarlyKeyChange},
+		// the directory can't hide the previous change
+		{1, 9, protocol.CheckEarlyKeyChange},
+		{9, 5, protocol.CheckEarlyKeyChange},
+	} {
+		tr := &directory.KeyTransition{Username: alice, OldKey: key, NewKey: []byte("new"), Since: tc.since, Epoch: tc.epoch}
+		if err := cc.checkKeyChangeInterval(alice, tr); err != tc.want {
+			t.Errorf("Since %d, epoch %d: expected %v, got %v", tc.since, tc.epoch, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+var (
+	// ErrNoEndpoints indicates that a MirrorTransport has no endpoints.
+	ErrNoEndpoints = errors.New("[client] No endpoints to send the request to")
+)
+
+// A Transport sends requests to a CONIKS directory and returns its
+// responses. Implementations return an error only if the request
+// couldn't be delivered or the response couldn't be received; errors
+// reported by the directory are in the response's Error.
+type Transport interface {
+	Send(ctx context.Context, req *directory.Request) (*directory.Response, error)
+}
+
+// TransportFunc adapts an ordinary function to the Transport interface.
+type TransportFunc func(ctx context.Context, req *directory.Request) (*directory.Response, error)
+
+// Send calls f(ctx, req).
+func (f TransportFunc) Send(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+	return f(ctx, req)
+}
+
+// An Endpoint is a named Transport to one server of a directory.
+type Endpoint struct {
+	Name string
+	Transport
+}
+
+// DefaultCooldown is how long a MirrorTransport skips an endpoint after
+// it failed, unless MirrorTransport.Cooldown is set.
+const DefaultCooldown = 30 * time.Second
+
+// A MirrorTransport sends requests to a directory that is served by
+// a primary server and any number of mirrors. It sends each request to
+// the first healthy endpoint, primary first, and fails over to the next
+// one if the endpoint can't be reached or reports an internal error.
+// Failed endpoints are skipped for a cooldown period, unless all
+// endpoints have failed.
+//
+// Mirrors give a directory an easy way to show different clients
+// different views, so a MirrorTransport can also check that all
+// endpoints serve the same STRs; see CheckSplitView.
+type MirrorTransport struct {
+	// Endpoints are tried in order; the first one is the primary.
+	Endpoints []Endpoint
+	// SignKey is the directory's public signing key, used to verify
+	// STRs when comparing them across endpoints.
+	SignKey sign.PublicKey
+	// CrossCheck makes Send call CheckSplitView for the latest epoch
+	// in every successful response.
+	CrossCheck bool
+	// Cooldown is how long a failed endpoint is skipped. If zero,
+	// DefaultCooldown is used.
+	Cooldown time.Duration
+	// Alerts receives an alert when a split view is detected. It may be nil.
+	Alerts alert.Sink
+	// Distrust, if set, lists the endpoints the transport never sends
+	// requests to. It may be nil.
+	Distrust *DistrustList
+
+	mu       sync.Mutex
+	failedAt map[string]time.Time
+	now      func() time.Time
+}
+
+var _ Transport = (*MirrorTransport)(nil)
+
+// NewMirrorTransport returns a MirrorTransport for the directory with the
+// public signing key signKey, served by primary and mirrors.
+func NewMirrorTransport(signKey sign.PublicKey, primary Endpoint, mirrors ...Endpoint) *MirrorTransport {
+	return &MirrorTransport{
+		Endpoints: append([]Endpoint{primary}, mirrors...),
+		SignKey:   signKey,
+	}
+}
+
+func (t *MirrorTransport) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+func (t *MirrorTransport) cooldown() time.Duration {
+	if t.Cooldown > 0 {
+		return t.Cooldown
+	}
+	return DefaultCooldown
+}
+
+// healthy reports whether the endpoint name isn't cooling down.
+func (t *MirrorTransport) healthy(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failed, ok := t.failedAt[name]
+	return !ok || t.clock().Sub(failed) >= t.cooldown()
+}
+
+func (t *MirrorTransport) setFailed(name string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !failed {
+		delete(t.failedAt, name)
+		return
+	}
+	if t.failedAt == nil {
+		t.failedAt = make(map[string]time.Time)
+	}
+	t.failedAt[name] = t.clock()
+}
+
+// distrusted reports whether the endpoint name is on t.Distrust.
+func (t *MirrorTransport) distrusted(name string) bool {
+	return t.Distrust != nil && t.Distrust.EndpointDistrusted(name)
+}
+
+// Healthy returns the names of the endpoints that aren't cooling down
+// after a failure or distrusted, in the order they are tried.
+func (t *MirrorTransport) Healthy() []string {
+	var names []string
+	for _, e := range t.Endpoints {
+		if t.healthy(e.Name) && !t.distrusted(e.Name) {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+// order returns the endpoints in the order Send tries them: healthy
+// endpoints first, then the ones cooling down as a last resort.
+// Distrusted endpoints aren't tried at all.
+func (t *MirrorTransport) order() []Endpoint {
+	var healthy, cooling []Endpoint
+	for _, e := range t.Endpoints {
+		if t.distrusted(e.Name) {
+			continue
+		}
+		if t.healthy(e.Name) {
+			healthy = append(healthy, e)
+		} else {
+			cooling = append(cooling, e)
+		}
+	}
+	return append(healthy, cooling...)
+}
+
+// Send sends req to the first endpoint that answers it, and returns
+// its response. An endpoint fails if its transport returns an error or
+// it responds with ErrDirectory. If all endpoints fail, Send returns
+// the last error, or the last ErrDirectory response, and if all of them
+// are distrusted, ErrDistrusted.
+//
+// If t.CrossCheck is set, Send also checks the response's latest STR
+// against the other endpoints, and returns a *SplitViewError if they
+// disagree.
+func (t *MirrorTransport) Send(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+	if len(t.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	endpoints := t.order()
+	if len(endpoints) == 0 {
+		return nil, ErrDistrusted
+	}
+	var lastResp *directory.Response
+	var lastErr error
+	for _, e := range endpoints {
+		resp, err := e.Send(ctx, req)
+		if err == nil && resp.Error != protocol.ErrDirectory {
+			t.setFailed(e.Name, false)
+			if t.CrossCheck {
+				if str := latestSTR(resp); str != nil {
+					if err := t.CheckSplitView(ctx, str.Epoch); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return resp, nil
+		}
+		t.setFailed(e.Name, true)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nil {
+			lastResp, lastErr = nil, fmt.Errorf("[client] endpoint %s: %w", e.Name, err)
+		} else {
+			lastResp, lastErr = resp, nil
+		}
+	}
+	return lastResp, lastErr
+}
+
+// latestSTR returns the STR for the latest epoch in resp, if any.
+func latestSTR(resp *directory.Response) *directory.SignedTreeRoot {
+	var strs []*directory.SignedTreeRoot
+	switch r := resp.DirectoryResponse.(type) {
+	case *directory.DirectoryProof:
+		strs = r.STR
+	case *directory.STRHistoryRange:
+		strs = r.STR
+	case *directory.BindingUnchanged:
+		strs = r.STR
+	}
+	if len(strs) == 0 {
+		return nil
+	}
+	return strs[len(strs)-1]
+}
+
+// A SplitViewError reports that two endpoints of the same directory
+// served different STRs for the same epoch, both signed by the
+// directory.
+type SplitViewError struct {
+	Endpoints [2]string
+	// Equivocation is the cryptographic proof of the split view.
+	Equivocation *evidence.Equivocation
+}
+
+func (e *SplitViewError) Error() string {
+	return fmt.Sprintf("[client] endpoints %s and %s serve different STRs for epoch %d",
+		e.Endpoints[0], e.Endpoints[1], e.Equivocation.Epoch)
+}
+
+// Unwrap returns protocol.CheckBadSTR, so that errors.Is(err,
+// protocol.CheckBadSTR) holds for split views.
+func (e *SplitViewError) Unwrap() error {
+	return protocol.CheckBadSTR
+}
+
+// CheckSplitView asks every endpoint for its STR for epoch and checks
+// that all of them are the same. It returns a *SplitViewError for the
+// first pair of validly signed STRs that differ.
+//
+// Endpoints that are distrusted, can't be reached, don't have the epoch
+// yet, or return an STR that isn't signed with t.SignKey don't take part
+// in the comparison; the latter two are marked as failed.
+func (t *MirrorTransport) CheckSplitView(ctx context.Context, epoch merkletree.Epoch) error {
+	req := &directory.Request{
+		Type:    directory.STRType,
+		Request: &directory.STRHistoryRequest{StartEpoch: epoch, EndEpoch: epoch},
+	}
+	var refName string
+	var ref []byte
+	for _, e := range t.Endpoints {
+		if t.distrusted(e.Name) {
+			continue
+		}
+		resp, err := e.Send(ctx, req)
+		if err != nil {
+			t.setFailed(e.Name, true)
+			continue
+		}
+		str := latestSTR(resp)
+		if resp.Error != protocol.ReqSuccess || str == nil || str.Epoch != epoch {
+			// the endpoint may be lagging behind
+			continue
+		}
+		bs, err := evidence.MarshalSTR(str)
+		if err != nil {
+			continue
+		}
+		if ref == nil {
+			if !t.SignKey.Verify(str.Bytes(), str.Signature[:]) {
+				t.setFailed(e.Name, true)
+				continue
+			}
+			refName, ref = e.Name, bs
+			continue
+		}
+		eq, err := evidence.VerifyEquivocation(t.SignKey, ref, bs)
+		switch err {
+		case nil:
+			splitErr := &SplitViewError{Endpoints: [2]string{refName, e.Name}, Equivocation: eq}
+			_ = alert.Send(t.Alerts, &alert.Alert{
+				Kind:      alert.Equivocation,
+				Severity:  alert.Critical,
+				Time:      t.clock(),
+				Directory: refName,
+				Epoch:     epoch,
+				Message:   splitErr.Error(),
+				Err:       splitErr,
+			})
+			return splitErr
+		case evidence.ErrBadSignature, evidence.ErrMalformedSTR:
+			t.setFailed(e.Name, true)
+		}
+	}
+	return nil
+}
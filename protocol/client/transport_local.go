@@ -0,0 +1,22 @@
+//go:build !coniks_client
+// +build !coniks_client
+
+package client
+
+import (
+	"context"
+
+	"github.com/ORBAT/cloniks/directory"
+)
+
+// LocalTransport returns a Transport that hands requests to the
+// in-process directory d. It isn't safe for concurrent use unless
+// nothing else uses d concurrently.
+func LocalTransport(d *directory.Tree) Transport {
+	return TransportFunc(func(ctx context.Context, req *directory.Request) (*directory.Response, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return d.HandleRequest(req), nil
+	})
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+func failingTransport(calls *int) Transport {
+	return TransportFunc(func(context.Context, *directory.Request) (*directory.Response, error) {
+		*calls++
+		return nil, errUnreachable
+	})
+}
+
+func lookup(name string) *directory.Request {
+	return &directory.Request{Type: directory.KeyLookupType, Request: &directory.KeyLookupRequest{Username: name}}
+}
+
+func TestMirrorTransportFailover(t *testing.T) {
+	d := directory.NewTestTree(t)
+	if _, err := d.Register("alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+
+	var primaryCalls int
+	now := time.Unix(0, 0)
+	tr := NewMirrorTransport(staticSigningKey.Public(),
+		Endpoint{"primary", failingTransport(&primaryCalls)},
+		Endpoint{"broken", TransportFunc(func(context.Context, *directory.Request) (*directory.Response, error) {
+			return directory.NewErrorResponse(protocol.ErrDirectory), nil
+		})},
+		Endpoint{"mirror", LocalTransport(d)})
+	tr.now = func() time.Time { return now }
+
+	resp, err := tr.Send(context.Background(), lookup("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != protocol.ReqSuccess {
+		t.Fatal("Expect", protocol.ReqSuccess, "got", resp.Error)
+	}
+	if h := tr.Healthy(); len(h) != 1 || h[0] != "mirror" {
+		t.Fatal("Expect only the mirror to be healthy, got", h)
+	}
+
+	// directory answers other than internal errors don't fail over
+	resp, err = tr.Send(context.Background(), lookup("bob"))
+	if err != nil || resp.Error != protocol.ReqNameNotFound {
+		t.Fatal("Expect", protocol.ReqNameNotFound, "got", resp, err)
+	}
+	if primaryCalls != 1 {
+		t.Error("Expect the primary to be skipped while cooling down, got", primaryCalls, "calls")
+	}
+
+	now = now.Add(DefaultCooldown)
+	if _, err := tr.Send(context.Background(), lookup("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if primaryCalls != 2 {
+		t.Error("Expect the primary to be retried after the cooldown, got", primaryCalls, "calls")
+	}
+
+	// with no healthy endpoints, all of them are tried anyway
+	tr.Endpoints = tr.Endpoints[:1]
+	if _, err := tr.Send(context.Background(), lookup("alice")); !errors.Is(err, errUnreachable) {
+		t.Error("Expect", errUnreachable, "got", err)
+	}
+	if primaryCalls != 3 {
+		t.Error("Expect the primary to be tried as a last resort, got", primaryCalls, "calls")
+	}
+
+	if _, err := (&MirrorTransport{}).Send(context.Background(), lookup("alice")); err != ErrNoEndpoints {
+		t.Error("Expect", ErrNoEndpoints, "got", err)
+	}
+}
+
+func TestMirrorTransportSplitView(t *testing.T) {
+	d := directory.NewTestTree(t)
+	// a mirror showing a different history from epoch 1 on
+	forked := directory.NewTestTree(t)
+	// a mirror that hasn't caught up yet
+	lagging := directory.NewTestTree(t)
+	d.Update()
+	forked.Update()
+
+	var alerts []*alert.Alert
+	tr := NewMirrorTransport(staticSigningKey.Public(),
+		Endpoint{"primary", LocalTransport(d)},
+		Endpoint{"lagging", LocalTransport(lagging)},
+		Endpoint{"same", LocalTransport(d)})
+	tr.CrossCheck = true
+	tr.Alerts = alert.SinkFunc(func(a *alert.Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	})
+
+	if _, err := tr.Send(context.Background(), lookup("alice")); err != nil {
+		t.Fatal("Expect consistent mirrors to pass, got", err)
+	}
+
+	tr.Endpoints = append(tr.Endpoints, Endpoint{"forked", LocalTransport(forked)})
+	_, err := tr.Send(context.Background(), lookup("alice"))
+	var splitErr *SplitViewError
+	if !errors.As(err, &splitErr) {
+		t.Fatal("Expect a split view error, got", err)
+	}
+	if splitErr.Endpoints != [2]string{"primary", "forked"} || splitErr.Equivocation.Epoch != 1 {
+		t.Errorf("Unexpected split view %v", splitErr)
+	}
+	if !errors.Is(err, protocol.CheckBadSTR) {
+		t.Error("Expect a split view to be a", protocol.CheckBadSTR)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != alert.Equivocation {
+		t.Error("Expect an equivocation alert, got", alerts)
+	}
+
+	// the genesis STR is the same everywhere
+	if err := tr.CheckSplitView(context.Background(), 0); err != nil {
+		t.Error(err)
+	}
+}
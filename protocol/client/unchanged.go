@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bytes"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// VerifyBindingUnchanged verifies the directory's response msg to the
+// BindingUnchangedRequest req. index is the lookup index of the binding,
+// taken from the last authentication path the client verified for it.
+// req.Epoch must be the epoch of the client's verified STR.
+//
+// If the directory asserts that the binding hasn't changed,
+// VerifyBindingUnchanged verifies the STRs linking the assertion to the
+// verified STR and the directory's signature of the assertion, and
+// returns a nil authentication path. Otherwise, it verifies the proof
+// for the first epoch in which the binding changed, and returns it.
+// In both cases, the client's verified STR is updated to the latest STR
+// in msg.
+func (cc *ConsistencyChecks) VerifyBindingUnchanged(req *directory.BindingUnchangedRequest,
+	index []byte, msg *directory.Response) (*merkletree.AuthenticationPath, error) {
+	ap, err := cc.verifyBindingUnchanged(req, index, msg)
+	return ap, cc.alert(err, req.Username)
+}
+
+func (cc *ConsistencyChecks) verifyBindingUnchanged(req *directory.BindingUnchangedRequest,
+	index []byte, msg *directory.Response) (*merkletree.AuthenticationPath, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	if req.Epoch != cc.VerifiedSTR().Epoch {
+		return nil, protocol.ErrMalformedMessage
+	}
+
+	switch r := msg.DirectoryResponse.(type) {
+	case *directory.BindingUnchanged:
+		if msg.Error != protocol.ReqSuccess {
+			return nil, protocol.ErrMalformedMessage
+		}
+		str := cc.VerifiedSTR()
+		if len(r.STR) > 0 {
+			if err := cc.auditFrom(req.Epoch, r.STR); err != nil {
+				return nil, err
+			}
+			str = r.STR[len(r.STR)-1]
+		}
+		if str.Epoch != r.Through {
+			return nil, protocol.ErrMalformedMessage
+		}
+		if !cc.Verify(r.Bytes(index, req.Commitment, req.Epoch, str.Signature), r.Signature[:]) {
+			return nil, protocol.CheckBadSignature
+		}
+		cc.Update(str)
+		return nil, nil
+
+	case *directory.DirectoryProof:
+		if len(r.AP) != 1 || len(r.STR) == 0 {
+			return nil, protocol.ErrMalformedMessage
+		}
+		if err := cc.auditFrom(req.Epoch, r.STR); err != nil {
+			return nil, err
+		}
+		str, ap := r.STR[len(r.STR)-1], r.AP[0]
+		if !bytes.Equal(ap.LookupIndex, index) {
+			return nil, protocol.CheckBadLookupIndex
+		}
+		if err := cc.verifyAuthPath(req.Username, nil, ap, str); err != nil {
+			return nil, err
+		}
+		var commitment []byte
+		switch {
+		case ap.ProofType() == merkletree.ProofOfInclusion && msg.Error == protocol.ReqSuccess:
+			commitment = ap.Leaf.Commitment.Hash
+		case ap.ProofType().IsAbsence() && msg.Error == protocol.ReqNameNotFound:
+		default:
+			return nil, protocol.ErrMalformedMessage
+		}
+		if bytes.Equal(commitment, req.Commitment) {
+			// the binding didn't change after all
+			return nil, protocol.ErrMalformedMessage
+		}
+		cc.Update(str)
+		return ap, nil
+
+	default:
+		if msg.Error != protocol.ReqSuccess {
+			return nil, msg.Error
+		}
+		return nil, protocol.ErrMalformedMessage
+	}
+}
+
+// auditFrom audits strs, which must start at the epoch after epoch.
+func (cc *ConsistencyChecks) auditFrom(epoch merkletree.Epoch, strs []*directory.SignedTreeRoot) error {
+	if strs[0].Epoch != epoch+1 {
+		return protocol.ErrMalformedMessage
+	}
+	return cc.AuditDirectory(strs)
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+func TestVerifyBindingUnchanged(t *testing.T) {
+	d, cc := monitored(t, 5)
+	index := monitor(d, 1).DirectoryResponse.(*directory.DirectoryProof).AP[0].LookupIndex
+
+	// alice was absent in epoch 1, so her registration is a change
+	req := &directory.BindingUnchangedRequest{Username: alice, Epoch: 1}
+	ap, err := cc.VerifyBindingUnchanged(req, index, d.BindingUnchanged(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap == nil || ap.ProofType() != merkletree.ProofOfInclusion || cc.VerifiedSTR().Epoch != 2 {
+		t.Fatal("Expect alice's inclusion in epoch 2, got", ap, cc.VerifiedSTR().Epoch)
+	}
+
+	req = &directory.BindingUnchangedRequest{Username: alice, Epoch: 2, Commitment: ap.Leaf.Commitment.Hash}
+	msg := d.BindingUnchanged(req)
+	if ap, err := cc.VerifyBindingUnchanged(req, index, msg); err != nil || ap != nil {
+		t.Fatal("Expect no change, got", ap, err)
+	}
+	if cc.VerifiedSTR().Epoch != 6 {
+		t.Error("Expect verified epoch 6, got", cc.VerifiedSTR().Epoch)
+	}
+
+	req.Epoch = 6
+	msg = d.BindingUnchanged(req)
+	if ap, err := cc.VerifyBindingUnchanged(req, index, msg); err != nil || ap != nil {
+		t.Fatal("Expect no change, got", ap, err)
+	}
+
+	// an assertion for another commitment
+	other := *req
+	other.Commitment = []byte("other")
+	if _, err := cc.VerifyBindingUnchanged(&other, index, msg); err != protocol.CheckBadSignature {
+		t.Error("Expect", protocol.CheckBadSignature, "got", err)
+	}
+
+	// the client must be up to date with the request
+	req.Epoch = 5
+	if _, err := cc.VerifyBindingUnchanged(req, index, d.BindingUnchanged(req)); err != protocol.ErrMalformedMessage {
+		t.Error("Expect", protocol.ErrMalformedMessage, "got", err)
+	}
+}
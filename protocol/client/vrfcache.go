@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+
+	"github.com/ORBAT/cloniks/conv"
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/directory"
+)
+
+// DefaultVRFCacheSize is the number of verified VRF proofs
+// a ConsistencyChecks remembers by default.
+const DefaultVRFCacheSize = 1024
+
+// A VRFCache is an LRU cache of the VRF proofs of lookup indices that
+// have been verified. A name's lookup index and its proof only change
+// when the directory's VRF key does, so a client monitoring a name
+// every epoch verifies its proof once per key rotation instead of once
+// per response. Entries are keyed by a digest of the length-prefixed
+// name, index, proof and VRF public key it was verified with, so that
+// any other proof is a cache miss, and the whole cache is purged when the
+// VrfPublicKey of the Config it verifies proofs for changes. Hash
+// indices are cheap to verify, so they're never cached. A VRFCache is
+// safe for concurrent use.
+type VRFCache struct {
+	size int
+
+	mu       sync.Mutex
+	lru      *list.List // of string digests, most recently used first
+	byDigest map[string]*list.Element
+	vrfKey   []byte // the VrfPublicKey the cached proofs were verified under
+	hits     uint64
+	misses   uint64
+}
+
+// NewVRFCache returns a VRFCache holding at most size proofs.
+func NewVRFCache(size int) *VRFCache {
+	return &VRFCache{
+		size:     size,
+		lru:      list.New(),
+		byDigest: make(map[string]*list.Element),
+	}
+}
+
+// VerifyIndex is directory.Config.VerifyIndex, except that a VRF proof
+// found in c isn't verified again, and one that verifies is added to c.
+// An index or a proof of the wrong length never verifies, so it isn't
+// looked up. A nil VRFCache verifies every proof.
+func (c *VRFCache) VerifyIndex(p *directory.Config, name, index, proof []byte) bool {
+	if c == nil || p.IndexHashKey != nil {
+		return p.VerifyIndex(name, index, proof)
+	}
+	if len(index) != int(p.IndexSize) || len(proof) != vrf.ProofSize {
+		return false
+	}
+	digest := string(hashed.Digest(lengthPrefixed(p.VRFKeyFor(name), name, index, proof)))
+	c.mu.Lock()
+	if !bytes.Equal(c.vrfKey, p.VrfPublicKey) {
+		c.purge()
+		c.vrfKey = append([]byte{}, p.VrfPublicKey...)
+	}
+	if e, ok := c.byDigest[digest]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		c.mu.Unlock()
+		return true
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	if !p.VerifyIndex(name, index, proof) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byDigest[digest]; !ok && bytes.Equal(c.vrfKey, p.VrfPublicKey) {
+		c.byDigest[digest] = c.lru.PushFront(digest)
+		for c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.byDigest, oldest.Value.(string))
+		}
+	}
+	return true
+}
+
+// lengthPrefixed concatenates the fields, each prefixed with its length,
+// so that no other fields concatenate to the same bytes.
+func lengthPrefixed(fields ...[]byte) []byte {
+	var bs []byte
+	for _, f := range fields {
+		bs = append(bs, conv.UInt32ToBytes(uint32(len(f)))...)
+		bs = append(bs, f...)
+	}
+	return bs
+}
+
+// Purge removes all proofs from c, e.g. after the application learned
+// that the directory's VRF key has been compromised.
+func (c *VRFCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge()
+}
+
+func (c *VRFCache) purge() {
+	c.lru.Init()
+	c.byDigest = make(map[string]*list.Element)
+}
+
+// Stats returns the number of cache hits and misses so far.
+func (c *VRFCache) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// proofOf returns the proof of the binding of name in d.
+func proofOf(d *directory.Tree, name string) *directory.DirectoryProof {
+	return d.KeyLookup(&directory.KeyLookupRequest{Username: name}).
+		DirectoryResponse.(*directory.DirectoryProof)
+}
+
+func TestVRFCacheMonitoring(t *testing.T) {
+	d := directory.NewTestTree(t)
+	if _, err := d.Register("alice", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	d.Update()
+	cc := New(d.LatestSTR(), true, staticSigningKey.Public())
+	for i := 0; i < 3; i++ {
+		df := proofOf(d, "alice")
+		if err := cc.verifyAuthPath("alice", []byte("key"), df.AP[0], df.STR[0]); err != nil {
+			t.Fatal(err)
+		}
+		d.Update()
+	}
+	if hits, misses := cc.VRFCache.Stats(); hits != 2 || misses != 1 {
+		t.Fatal("Expect 2 hits and 1 miss, got", hits, misses)
+	}
+
+	// a proof for another name, or a forged one, is never a hit
+	df := proofOf(d, "alice")
+	if err := cc.verifyAuthPath("bob", nil, df.AP[0], df.STR[0]); err != protocol.CheckBadVRFProof {
+		t.Error("Expect", protocol.CheckBadVRFProof, "got", err)
+	}
+	forged := *df.AP[0]
+	forged.VrfProof = append([]byte{}, forged.VrfProof...)
+	forged.VrfProof[0] ^= 1
+	for i := 0; i < 2; i++ {
+		if err := cc.verifyAuthPath("alice", []byte("key"), &forged, df.STR[0]); err != protocol.CheckBadVRFProof {
+			t.Error("Expect", protocol.CheckBadVRFProof, "got", err)
+		}
+	}
+	if hits, misses := cc.VRFCache.Stats(); hits != 2 || misses != 4 {
+		t.Error("Expect 2 hits and 4 misses, got", hits, misses)
+	}
+}
+
+func TestVRFCacheKeyRotation(t *testing.T) {
+	d := directory.NewTestTree(t)
+	vrfKey, err := vrf.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := directory.New(vrfKey, staticSigningKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewVRFCache(DefaultVRFCacheSize)
+	df := proofOf(d, "alice")
+	p := df.STR[0].Policies
+	if !c.VerifyIndex(p, []byte("alice"), df.AP[0].LookupIndex, df.AP[0].VrfProof) {
+		t.Fatal("Expect the proof to verify")
+	}
+
+	// the cached proof doesn't verify under the new key
+	rp := rotated.LatestSTR().Policies
+	if c.VerifyIndex(rp, []byte("alice"), df.AP[0].LookupIndex, df.AP[0].VrfProof) {
+		t.Error("Expect the proof not to verify under another VRF key")
+	}
+	df = proofOf(rotated, "alice")
+	if !c.VerifyIndex(rp, []byte("alice"), df.AP[0].LookupIndex, df.AP[0].VrfProof) {
+		t.Fatal("Expect the proof to verify")
+	}
+	if !c.VerifyIndex(rp, []byte("alice"), df.AP[0].LookupIndex, df.AP[0].VrfProof) {
+		t.Fatal("Expect the proof to verify")
+	}
+	if hits, misses := c.Stats(); hits != 1 || misses != 3 {
+		t.Error("Expect 1 hit and 3 misses, got", hits, misses)
+	}
+	if len(c.byDigest) != 1 {
+		t.Error("Expect the proofs of the old key to be purged, got", len(c.byDigest), "proofs")
+	}
+}
+
+func TestVRFCacheLRU(t *testing.T) {
+	d := directory.NewTestTree(t)
+	c := NewVRFCache(2)
+	verify := func(name string) {
+		df := proofOf(d, name)
+		if !c.VerifyIndex(df.STR[0].Policies, []byte(name), df.AP[0].LookupIndex, df.AP[0].VrfProof) {
+			t.Fatal("Expect the proof of", name, "to verify")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		verify("user" + strconv.Itoa(i))
+	}
+	verify("user2")
+	verify("user0") // evicted by user2
+	if hits, misses := c.Stats(); hits != 1 || misses != 4 {
+		t.Error("Expect 1 hit and 4 misses, got", hits, misses)
+	}
+
+	c.Purge()
+	verify("user2")
+	if hits, _ := c.Stats(); hits != 1 {
+		t.Error("Expect the purged proof to be a miss")
+	}
+}
+
+func TestVRFCacheShiftedFields(t *testing.T) {
+	d := directory.NewTestTree(t)
+	c := NewVRFCache(DefaultVRFCacheSize)
+	df := proofOf(d, "alice")
+	p, index, proof := df.STR[0].Policies, df.AP[0].LookupIndex, df.AP[0].VrfProof
+	if !c.VerifyIndex(p, []byte("alice"), index, proof) {
+		t.Fatal("Expect the proof to verify")
+	}
+
+	// the same bytes, split differently between the fields, aren't the
+	// cached proof
+	shifted := []struct {
+		name, index, proof []byte
+	}{
+		{[]byte("alic"), append([]byte("e"), index...), proof},
+		{[]byte("alice"), index[:len(index)-1], append(index[len(index)-1:len(index):len(index)], proof...)},
+		{[]byte("alice"), append(append([]byte{}, index...), proof[0]), proof[1:]},
+	}
+	for i, s := range shifted {
+		if c.VerifyIndex(p, s.name, s.index, s.proof) {
+			t.Errorf("Expect shifted fields %d not to verify", i)
+		}
+	}
+	if hits, misses := c.Stats(); hits != 0 || misses != 1 {
+		t.Error("Expect no hits and 1 miss, got", hits, misses)
+	}
+}
@@ -0,0 +1,193 @@
+// This module implements a conformance suite for CONIKS verifiers: test
+// vectors of STRs, authentication paths, temporary bindings and VRF
+// proofs produced by this directory, some of them valid and some
+// tampered with, along with the verdict a verifier must reach for each.
+// The suite is serialized as JSON in the same encoding the directory
+// uses on the wire (see testdata/suite.json), so that implementations of
+// the client in other languages can check that they accept exactly what
+// this module's client accepts. Run checks the suite against this
+// module's own client and auditor.
+
+package conformance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+	"github.com/ORBAT/cloniks/protocol/client"
+	"github.com/ORBAT/cloniks/protocol/registry"
+)
+
+// ErrMalformedSuite indicates that a suite couldn't be parsed, or is of
+// an unsupported version.
+var ErrMalformedSuite = errors.New("[conformance] Malformed suite")
+
+// SuiteVersion is the version of the suite format. Version 2 encodes
+// the STRs with their policies as typed associated data (see
+// directory.SignedTreeRoot.MarshalJSON).
+const SuiteVersion = 2
+
+// The kinds of vectors, i.e. of the checks they test.
+const (
+	// KindSTR vectors check STRs against a verified one, like
+	// a client or auditor does for every response: Verified is the STR
+	// the verifier trusts, and STRs are the consecutive STRs received,
+	// each of which must be signed with the suite's signing key and
+	// extend the hash chain. An STR of the same epoch as Verified must
+	// be the same STR.
+	KindSTR = "str"
+	// KindVRF vectors check that Index is a prefix of the VRF output
+	// for Username under the suite's VRF key, as proved by VRFProof.
+	KindVRF = "vrf"
+	// KindProof vectors check that AP proves the binding of Username to
+	// Key, or its absence, in the tree committed to by the only STR in
+	// STRs, and that the lookup index in AP is Username's, under the
+	// index function declared in the STR's policies. If Key is absent,
+	// any key is accepted.
+	KindProof = "proof"
+	// KindPromise vectors check that TB, returned along with the proof
+	// of absence AP and the only STR in STRs, is a promise signed with
+	// the suite's signing key to bind the lookup index of AP to Key. If
+	// Key is absent, any key is accepted.
+	KindPromise = "tb"
+)
+
+// VerdictValid is the verdict for the vectors a verifier must accept.
+const VerdictValid = "valid"
+
+// Verdict returns the verdict for the result err of a check: VerdictValid
+// if err is nil, and otherwise the name of the protocol.ErrorCode in the
+// registry, or the message of any other error.
+func Verdict(err error) string {
+	if err == nil {
+		return VerdictValid
+	}
+	if code, ok := err.(protocol.ErrorCode); ok {
+		return registry.ErrorCodeName(code)
+	}
+	return err.Error()
+}
+
+// A Suite is a set of test vectors for the directory with the public
+// signing key SignKey and VRF key VRFKey.
+type Suite struct {
+	Version int            `json:"version"`
+	SignKey sign.PublicKey `json:"signKey"`
+	VRFKey  vrf.PublicKey  `json:"vrfKey"`
+	Vectors []*Vector      `json:"vectors"`
+}
+
+// A Vector is the input of a single check, along with the verdict
+// a verifier must reach. Which of the inputs it has depends on its Kind.
+type Vector struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	Description string `json:"description"`
+
+	Username string                         `json:"username,omitempty"`
+	Key      []byte                         `json:"key,omitempty"`
+	Index    []byte                         `json:"index,omitempty"`
+	VRFProof []byte                         `json:"vrfProof,omitempty"`
+	Verified *directory.SignedTreeRoot      `json:"verified,omitempty"`
+	STRs     []*directory.SignedTreeRoot    `json:"strs,omitempty"`
+	AP       *merkletree.AuthenticationPath `json:"ap,omitempty"`
+	TB       *directory.TemporaryBinding    `json:"tb,omitempty"`
+
+	// Verdict is VerdictValid, or the name of the protocol.ErrorCode
+	// this module's verifier rejects the vector with. Other
+	// implementations need only reject the same vectors, not
+	// necessarily with the same error.
+	Verdict string `json:"verdict"`
+}
+
+// Load reads a suite from r. It returns ErrMalformedSuite if it can't be
+// parsed, is of another version, or has STRs without policies.
+func Load(r io.Reader) (*Suite, error) {
+	var s Suite
+	if err := json.NewDecoder(r).Decode(&s); err != nil || s.Version != SuiteVersion {
+		return nil, ErrMalformedSuite
+	}
+	for _, v := range s.Vectors {
+		if v == nil {
+			return nil, ErrMalformedSuite
+		}
+		for _, str := range append([]*directory.SignedTreeRoot{v.Verified}, v.STRs...) {
+			if str == nil {
+				continue
+			}
+			if str.SignedTreeRoot == nil || str.Policies == nil {
+				return nil, ErrMalformedSuite
+			}
+		}
+	}
+	return &s, nil
+}
+
+// Write writes s to w as indented JSON.
+func (s *Suite) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// Check runs the check of v with this module's client and auditor, and
+// returns its result: nil if v is valid, the protocol.ErrorCode it's
+// rejected with otherwise, and protocol.ErrMalformedMessage if it lacks
+// inputs its Kind needs. See Verdict.
+func (s *Suite) Check(v *Vector) error {
+	switch v.Kind {
+	case KindSTR:
+		if v.Verified == nil {
+			return protocol.ErrMalformedMessage
+		}
+		return auditor.New(s.SignKey, v.Verified).AuditDirectory(v.STRs)
+	case KindVRF:
+		if !s.VRFKey.VerifyTruncated([]byte(v.Username), v.Index, v.VRFProof) {
+			return protocol.CheckBadVRFProof
+		}
+		return nil
+	case KindProof:
+		if len(v.STRs) != 1 || v.AP == nil || v.AP.Leaf == nil {
+			return protocol.ErrMalformedMessage
+		}
+		return client.VerifyAuthPath(v.Username, v.Key, v.AP, v.STRs[0])
+	case KindPromise:
+		if len(v.STRs) != 1 || v.AP == nil || v.TB == nil {
+			return protocol.ErrMalformedMessage
+		}
+		return client.VerifyPromise(s.SignKey, v.Key, v.TB, v.AP, v.STRs[0])
+	default:
+		return fmt.Errorf("[conformance] Unknown kind of vector %q", v.Kind)
+	}
+}
+
+// A Mismatch is a vector for which a check reached another verdict than
+// expected.
+type Mismatch struct {
+	Vector *Vector
+	Got    string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s: expect %s, got %s", m.Vector.Name, m.Vector.Verdict, m.Got)
+}
+
+// Run checks each vector of s, and returns those for which this module's
+// verifier doesn't reach the expected verdict.
+func (s *Suite) Run() []Mismatch {
+	var mismatches []Mismatch
+	for _, v := range s.Vectors {
+		if got := Verdict(s.Check(v)); got != v.Verdict {
+			mismatches = append(mismatches, Mismatch{Vector: v, Got: got})
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,106 @@
+package conformance
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate testdata/suite.json")
+
+var suitePath = filepath.Join("testdata", "suite.json")
+
+// TestSuite checks the published suite, so that changes of the
+// verifier that would reject what other implementations accept, or vice
+// versa, don't go unnoticed. Run the test with -update to regenerate it
+// after deliberate changes.
+func TestSuite(t *testing.T) {
+	if *update {
+		s, err := Generate(DefaultSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(suitePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := s.Write(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(suitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range s.Run() {
+		t.Error(m)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	generate := func() []byte {
+		s, err := Generate(DefaultSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := s.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	suite := generate()
+	if !bytes.Equal(suite, generate()) {
+		t.Error("Expect the same seed to generate the same suite")
+	}
+	loaded, err := Load(bytes.NewReader(suite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]int)
+	verdicts := make(map[string]bool)
+	for _, v := range loaded.Vectors {
+		kinds[v.Kind]++
+		verdicts[v.Verdict] = true
+	}
+	for _, kind := range []string{KindSTR, KindVRF, KindProof, KindPromise} {
+		if kinds[kind] == 0 {
+			t.Errorf("Expect vectors of kind %s", kind)
+		}
+	}
+	if !verdicts[VerdictValid] || len(verdicts) < 8 {
+		t.Errorf("Expect valid vectors and many kinds of invalid ones, got %v", verdicts)
+	}
+	for _, m := range loaded.Run() {
+		t.Error(m)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, input := range []string{
+		`{"version": 1, "vectors": []}`,
+		`{"version": 2, "vectors": [null]}`,
+		`{"version": 2, "vectors": [{"kind": "str", "verified": {"STR": {"Epoch": 1}}}]}`,
+		`not json`,
+	} {
+		if _, err := Load(strings.NewReader(input)); err != ErrMalformedSuite {
+			t.Errorf("%s: expect ErrMalformedSuite, got %v", input, err)
+		}
+	}
+	s, err := Load(strings.NewReader(`{"version": 2, "vectors": [{"name": "x", "kind": "other", "verdict": "valid"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := s.Run(); len(m) != 1 || !strings.Contains(m[0].Got, "Unknown kind") {
+		t.Errorf("Expect an unknown kind to be reported, got %v", m)
+	}
+}
@@ -0,0 +1,260 @@
+package conformance
+
+import (
+	"math/rand"
+	"strconv"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/crypto/vrf"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// DefaultSeed is the seed of the published suite.
+const DefaultSeed = 1
+
+// Generate creates a directory and returns a suite of vectors built from
+// its output. Its keys, tree nonces and commitments come from a source
+// seeded with seed, and its signatures, VRF proofs and temporary bindings
+// are deterministic, so the same seed always generates the same suite,
+// and regenerating it after a change only changes the vectors it affects.
+func Generate(seed int64) (*Suite, error) {
+	rnd := rand.New(rand.NewSource(seed))
+	vrfKey, err := vrf.GenerateKey(rnd)
+	if err != nil {
+		return nil, err
+	}
+	signKey, err := sign.GenerateKey(rnd)
+	if err != nil {
+		return nil, err
+	}
+	d, err := directory.Open(
+		directory.WithVRFKey(vrfKey),
+		directory.WithSigningKey(signKey),
+		directory.WithSnapshots(10),
+		directory.WithRandomness(rnd),
+	)
+	if err != nil {
+		return nil, err
+	}
+	vrfPublic, _ := vrfKey.Public()
+	s := &Suite{Version: SuiteVersion, SignKey: d.PublicKey(), VRFKey: vrfPublic}
+	register := func(names ...string) error {
+		for _, name := range names {
+			if _, err := d.Register(name, []byte(name+"'s key")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	str0 := d.LatestSTR()
+	names := []string{"alice", "bob"}
+	for i := 0; i < 30; i++ {
+		names = append(names, "user"+strconv.Itoa(i))
+	}
+	if err := register(names...); err != nil {
+		return nil, err
+	}
+	if _, err := d.Update(); err != nil {
+		return nil, err
+	}
+	str1 := d.LatestSTR()
+	if _, err := d.Update(); err != nil {
+		return nil, err
+	}
+	str2 := d.LatestSTR()
+	// carol's binding is only promised
+	if err := register("carol"); err != nil {
+		return nil, err
+	}
+	s.addSTRs(signKey, str0, str1, str2)
+
+	lookup := func(name string) *directory.DirectoryProof {
+		return d.KeyLookup(&directory.KeyLookupRequest{Username: name}).
+			DirectoryResponse.(*directory.DirectoryProof)
+	}
+	alice, nobody, carol := lookup("alice"), lookup("nobody"), lookup("carol")
+	s.addVRFs(alice.AP[0])
+	s.addProofs(signKey, alice, lookup("bob"), nobody)
+	s.addPromises(carol, nobody, str1)
+	return s, nil
+}
+
+func (s *Suite) add(v *Vector) {
+	s.Vectors = append(s.Vectors, v)
+}
+
+// copySTR returns a copy of str that can be modified.
+func copySTR(str *directory.SignedTreeRoot) *directory.SignedTreeRoot {
+	inner := *str.SignedTreeRoot
+	return &directory.SignedTreeRoot{SignedTreeRoot: &inner, Policies: str.Policies}
+}
+
+// resign signs str again after it was modified, as a malicious
+// directory would.
+func resign(signKey sign.Signer, str *directory.SignedTreeRoot) *directory.SignedTreeRoot {
+	copy(str.Signature[:], signKey.Sign(str.Bytes()))
+	return str
+}
+
+// copyAP returns a copy of ap that can be modified.
+func copyAP(ap *merkletree.AuthenticationPath) *merkletree.AuthenticationPath {
+	c := *ap
+	c.PrunedTree = append(ap.PrunedTree[:0:0], ap.PrunedTree...)
+	leaf := *ap.Leaf
+	c.Leaf = &leaf
+	return &c
+}
+
+func (s *Suite) addSTRs(signKey sign.Signer, str0, str1, str2 *directory.SignedTreeRoot) {
+	badSignature := copySTR(str1)
+	badSignature.Signature[0] ^= 1
+	brokenChain := copySTR(str1)
+	brokenChain.PreviousSTRHash[0] ^= 1
+	forked := copySTR(str1)
+	forked.TreeHash[0] ^= 1
+	upgraded := copySTR(str1)
+	policies := *str1.Policies
+	policies.Version = []byte("0.2")
+	upgraded.Policies, upgraded.Ad = &policies, &policies
+	staleSchedule := copySTR(str1)
+	scheduled := *str1.Policies
+	scheduled.Schedule = []*directory.PolicyUpdate{{Epoch: str1.Epoch, MinKeyChangeInterval: 2}}
+	staleSchedule.Policies, staleSchedule.Ad = &scheduled, &scheduled
+	unapproved := copySTR(str1)
+	coManaged := *str1.Policies
+	// no approval can verify with the zero key
+	coManaged.Operators = &directory.Operators{Keys: []sign.PublicKey{make(sign.PublicKey, sign.PublicKeySize)},
+		Threshold: 1}
+	unapproved.Policies, unapproved.Ad = &coManaged, &coManaged
+	for _, v := range []*Vector{
+		{Name: "str/next", Description: "the STR of the next epoch",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{str1}, Verdict: VerdictValid},
+		{Name: "str/range", Description: "the STRs of the next two epochs",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{str1, str2}, Verdict: VerdictValid},
+		{Name: "str/same", Description: "the verified STR again",
+			Verified: str1, STRs: []*directory.SignedTreeRoot{str1}, Verdict: VerdictValid},
+		{Name: "str/bad-signature", Description: "an STR with a bad signature",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{badSignature}, Verdict: "CheckBadSignature"},
+		{Name: "str/broken-chain", Description: "a signed STR with the wrong hash of the previous STR",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{resign(signKey, brokenChain)}, Verdict: "CheckBadSTR"},
+		{Name: "str/skipped-epoch", Description: "an STR two epochs after the verified one",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{str2}, Verdict: "CheckBadSTR"},
+		{Name: "str/equivocation", Description: "a signed STR for the verified epoch with another tree",
+			Verified: str1, STRs: []*directory.SignedTreeRoot{resign(signKey, forked)}, Verdict: "CheckBadSTR"},
+		{Name: "str/unannounced-upgrade", Description: "a signed STR of another protocol version, which wasn't announced",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{resign(signKey, upgraded)}, Verdict: "CheckBadUpgrade"},
+		{Name: "str/stale-policy-schedule", Description: "a signed STR announcing a policy change for its own epoch",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{resign(signKey, staleSchedule)}, Verdict: "CheckBadPolicySchedule"},
+		{Name: "str/unapproved-operators", Description: "a signed STR introducing operators without their approval",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{resign(signKey, unapproved)}, Verdict: "CheckBadApproval"},
+		{Name: "str/range-bad-signature", Description: "a range of STRs the second of which has a bad signature",
+			Verified: str0, STRs: []*directory.SignedTreeRoot{str1, func() *directory.SignedTreeRoot {
+				str := copySTR(str2)
+				str.Signature[0] ^= 1
+				return str
+			}()}, Verdict: "CheckBadSignature"},
+	} {
+		v.Kind = KindSTR
+		s.add(v)
+	}
+}
+
+func (s *Suite) addVRFs(ap *merkletree.AuthenticationPath) {
+	badProof := append([]byte{}, ap.VrfProof...)
+	badProof[len(badProof)-1] ^= 1
+	badIndex := append([]byte{}, ap.LookupIndex...)
+	badIndex[0] ^= 1
+	for _, v := range []*Vector{
+		{Name: "vrf/valid", Description: "alice's lookup index",
+			Username: "alice", Index: ap.LookupIndex, VRFProof: ap.VrfProof, Verdict: VerdictValid},
+		{Name: "vrf/other-name", Description: "alice's lookup index for another name",
+			Username: "mallory", Index: ap.LookupIndex, VRFProof: ap.VrfProof, Verdict: "CheckBadVRFProof"},
+		{Name: "vrf/bad-proof", Description: "alice's lookup index with a tampered proof",
+			Username: "alice", Index: ap.LookupIndex, VRFProof: badProof, Verdict: "CheckBadVRFProof"},
+		{Name: "vrf/bad-index", Description: "a tampered lookup index with alice's proof",
+			Username: "alice", Index: badIndex, VRFProof: ap.VrfProof, Verdict: "CheckBadVRFProof"},
+	} {
+		v.Kind = KindVRF
+		s.add(v)
+	}
+}
+
+func (s *Suite) addProofs(signKey sign.Signer, alice, bob, nobody *directory.DirectoryProof) {
+	str := alice.STR[0]
+	strs := []*directory.SignedTreeRoot{str}
+	ap := alice.AP[0]
+	key := []byte("alice's key")
+
+	badSibling := copyAP(ap)
+	badSibling.PrunedTree[len(badSibling.PrunedTree)-1][0] ^= 1
+	forgedValue := copyAP(ap)
+	forgedValue.Leaf.Value = []byte("forged key")
+	shortIndex := copyAP(ap)
+	shortIndex.LookupIndex = shortIndex.LookupIndex[:len(shortIndex.LookupIndex)-1]
+	shallow := copySTR(str)
+	shallow.MaxDepth = ap.Leaf.Level - 1
+	absentWithValue := copyAP(nobody.AP[0])
+	absentWithValue.Leaf.Value = []byte("forged key")
+	futureEpoch := copyAP(ap)
+	futureEpoch.Leaf.ChangedEpoch = str.Epoch + 1
+	forgedEpoch := copyAP(ap)
+	forgedEpoch.Leaf.AddedEpoch, forgedEpoch.Leaf.ChangedEpoch = str.Epoch, str.Epoch
+	for _, v := range []*Vector{
+		{Name: "proof/inclusion", Description: "a proof of inclusion of alice's key",
+			Username: "alice", Key: key, AP: ap, STRs: strs, Verdict: VerdictValid},
+		{Name: "proof/inclusion-tofu", Description: "a proof of inclusion of alice's key, which isn't known yet",
+			Username: "alice", AP: ap, STRs: strs, Verdict: VerdictValid},
+		{Name: "proof/absence", Description: "a proof of absence of nobody",
+			Username: "nobody", AP: nobody.AP[0], STRs: strs, Verdict: VerdictValid},
+		{Name: "proof/other-key", Description: "a proof of inclusion of alice's key where another key is expected",
+			Username: "alice", Key: []byte("bob's key"), AP: ap, STRs: strs, Verdict: "CheckBindingsDiffer"},
+		{Name: "proof/bad-sibling", Description: "a proof of inclusion with a tampered sibling hash",
+			Username: "alice", Key: key, AP: badSibling, STRs: strs, Verdict: "CheckBadAuthPath"},
+		{Name: "proof/forged-value", Description: "a proof of inclusion of another key than alice's commitment",
+			Username: "alice", AP: forgedValue, STRs: strs, Verdict: "CheckBadCommitment"},
+		{Name: "proof/other-name", Description: "bob's proof of inclusion for alice",
+			Username: "alice", Key: []byte("bob's key"), AP: bob.AP[0], STRs: strs, Verdict: "CheckBadVRFProof"},
+		{Name: "proof/short-index", Description: "a proof of inclusion with a truncated lookup index",
+			Username: "alice", Key: key, AP: shortIndex, STRs: strs, Verdict: "CheckBadLookupIndex"},
+		{Name: "proof/too-deep", Description: "a proof of inclusion deeper than the STR allows",
+			Username: "alice", Key: key, AP: ap, STRs: []*directory.SignedTreeRoot{resign(signKey, shallow)},
+			Verdict: "CheckBadTreeDepth"},
+		{Name: "proof/absence-with-value", Description: "a proof of absence that claims a key",
+			Username: "nobody", AP: absentWithValue, STRs: strs, Verdict: "CheckBindingsDiffer"},
+		{Name: "proof/future-epoch", Description: "a proof of inclusion of a binding changed after the STR",
+			Username: "alice", Key: key, AP: futureEpoch, STRs: strs, Verdict: "CheckBadBindingEpochs"},
+		{Name: "proof/forged-epoch", Description: "a proof of inclusion with a tampered epoch of the binding",
+			Username: "alice", Key: key, AP: forgedEpoch, STRs: strs, Verdict: "CheckBadAuthPath"},
+	} {
+		v.Kind = KindProof
+		s.add(v)
+	}
+}
+
+func (s *Suite) addPromises(carol, nobody *directory.DirectoryProof, prev *directory.SignedTreeRoot) {
+	strs := []*directory.SignedTreeRoot{carol.STR[0]}
+	key := []byte("carol's key")
+	badSignature := *carol.TB
+	badSignature.Signature[0] ^= 1
+	for _, v := range []*Vector{
+		{Name: "tb/valid", Description: "a promise of carol's key",
+			Username: "carol", Key: key, TB: carol.TB, AP: carol.AP[0], STRs: strs, Verdict: VerdictValid},
+		{Name: "tb/valid-tofu", Description: "a promise of carol's key, which isn't known yet",
+			Username: "carol", TB: carol.TB, AP: carol.AP[0], STRs: strs, Verdict: VerdictValid},
+		{Name: "tb/bad-signature", Description: "a promise with a bad signature",
+			Username: "carol", Key: key, TB: &badSignature, AP: carol.AP[0], STRs: strs, Verdict: "CheckBadSignature"},
+		{Name: "tb/other-str", Description: "a promise signed for another STR",
+			Username: "carol", Key: key, TB: carol.TB, AP: carol.AP[0], STRs: []*directory.SignedTreeRoot{prev},
+			Verdict: "CheckBadSignature"},
+		{Name: "tb/other-index", Description: "carol's promise along with the proof of absence of nobody",
+			Username: "nobody", Key: key, TB: carol.TB, AP: nobody.AP[0], STRs: strs, Verdict: "CheckBadPromise"},
+		{Name: "tb/other-key", Description: "a promise of carol's key where another key is expected",
+			Username: "carol", Key: []byte("mallory's key"), TB: carol.TB, AP: carol.AP[0], STRs: strs,
+			Verdict: "CheckBindingsDiffer"},
+	} {
+		v.Kind = KindPromise
+		s.add(v)
+	}
+}
@@ -4,7 +4,9 @@
 // data structure that contains mappings from usernames to public keys.
 // It currently supports registration, latest-version key lookups, past key
 // lookups, and monitoring.
-// It does not yet support key changes.
+// Keys can only be changed with signed pre-announcements, i.e. key
+// transitions, compromised keys can be revoked, and bindings can be
+// deleted.
 
 package directory
 
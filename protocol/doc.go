@@ -8,6 +8,25 @@ an API for maintaining an auditable, privacy-preserving key directory on a
 server, as well as an API for checking the consistency of the directory
 at the client.
 
+Admin
+
+This module implements the admin socket of a directory server, an HTTP
+interface on a Unix socket for operational tasks such as integrity
+checks of the directory's storage, STR chain, promises and proofs.
+
+Alert
+
+This module implements the alerts that auditors and client monitors
+deliver to humans when they detect directory misbehavior, and sinks that
+deliver them to logs, webhooks or email.
+
+Archive
+
+This module implements a persistent archive of the proofs a CONIKS client
+verified, with the time each was verified, so that a user can later
+demonstrate what the directory served them. Archived proofs can be
+exported as bundles that anybody can check with the directory's public key.
+
 Auditlog
 
 This module implements a CONIKS audit log that a CONIKS auditor maintains.
@@ -18,6 +37,16 @@ Auditor
 
 This module implements a generic CONIKS auditor, that is all the functionality
 that clients and auditors need to verify a server's STR history.
+Its enumeration probe looks up random names and checks statistically that
+the directory's proofs of absence and response times don't reveal which
+names are registered.
+
+Gossip
+
+This module implements the peer management of a CONIKS auditor. It keeps
+a list of other auditors, health-checks and scores them by responsiveness
+and agreement rate, and cross-checks a directory's STRs with the
+best-scoring peers to detect forks.
 
 Client
 
@@ -25,6 +54,11 @@ This module implements all consistency checks performed by a CONIKS client
 on directory proofs received from a CONIKS server. These operations
 include the verification of username-to-key bindings (authentication paths),
 and non-equivocation checks (signed tree roots).
+Client-only builds, e.g. for mobile or WebAssembly apps, can leave out the
+server-side code with the coniks_client build tag: it excludes the
+directory's Tree with its storage, scheduling and request handling, and the
+merkletree's PAD and MerkleTree, but keeps the messages, STRs and proofs
+that clients verify.
 
 Directory
 
@@ -47,6 +81,13 @@ of errors that a CONIKS server may return to a client,
 and the results of a consistency check or a cryptographic verification
 that a CONIKS client performs.
 
+Evidence
+
+This module implements verification of evidence of directory misbehavior,
+such as two validly signed STRs for the same epoch with different
+contents, exchanged as serialized STRs so that independent observers
+can pool and check what they saw.
+
 Message
 
 This module defines the message format of the CONIKS client requests
@@ -54,12 +95,27 @@ and corresponding CONIKS server responses for each CONIKS protocol.
 It also provides constructors for the response messages for each
 protocol.
 
+Publish
+
+This module implements the publication of a directory's STRs to external
+mediums, such as storage buckets or git repositories, with at-least-once
+semantics, and a verifier that compares what the directory served with
+what it published, as additional resistance to equivocation.
+
 Policy
 
 This module defines the directory's current CONIKS security/privacy
 policies, which include the public part of the VRF key used to generate
-private indices, the cryptographic algorithms in use, as well as the
-protocol version number.
+private indices (or the key of the hash used instead, if the directory
+doesn't need lookup privacy), the cryptographic algorithms in use, as well
+as the protocol version number. The policies also advertise the optional
+features the directory supports, so that clients can detect them without
+trial and error; clients verify that no feature is withdrawn between two
+STRs unless the later one flags the policy change. A directory evolves its
+protocol version, and with it the encodings and algorithms of its STRs,
+by announcing the version and the epoch it takes effect in its policies
+ahead of time; clients and auditors verify that the version changes
+exactly at that epoch, and select the encoding of each STR by its version.
 
 Temporary Binding
 
@@ -72,5 +128,70 @@ binding for encryption/signing immediately without having to wait for the
 binding's inclusion in the next snapshot. However, clients must still check
 in the next epoch that the binding has been included in the snapshot to
 ensure that the server has not equivocated about it.
+
+Key Transition
+
+This module implements key transitions, a user's pre-announcement, signed
+with their current key, that their key will change to a new one in a future
+epoch. The directory stores the announcement next to the user's binding,
+so that the clients of the user's contacts can verify it, and treat the
+change as expected rather than as directory misbehavior. A directory may
+commit to a minimum number of epochs between key changes in its STRs; each
+transition records when the old key was bound, so clients can verify that
+the directory didn't let a hijacker replace a key early.
+
+Key Revocation
+
+This module implements key revocations, a statement, signed with the
+revoked key or with a recovery key it delegated to, that a user's key is
+compromised. The directory commits to the revocation next to the user's
+binding in the next snapshot, and attaches it to key lookups returning the
+revoked key right away, so that clients refuse to encrypt to the key even
+within the epoch in which it was revoked.
+
+Deletion
+
+This module implements soft deletions, a user's request, signed with their
+key, to delete their binding. The directory keeps the binding, commits to
+a tombstone with the epoch of the deletion next to it, and attaches the
+tombstone to key lookups. A directory may commit to a quarantine period in
+its STRs during which the name can't be bound to a different key, so that
+nobody can take over a name right after its owner deleted it; clients
+verify the quarantine against the tombstone.
+
+Re-attestation
+
+A directory may commit to a re-attestation interval in its STRs, after
+which bindings expire unless their owners re-sign them. The directory
+commits to the latest re-attestation of a binding next to it, attaches it
+to key lookups and monitoring responses, and flags expired bindings;
+clients verify the expiry against the re-attestation, and remind owners
+to re-attest their bindings in time.
+
+History Archive
+
+This module implements an archive format for a directory's complete
+history: a single file holding the fingerprints of the directory's keys,
+its chain of STRs, and the changes to its tree in each epoch. Auditors and
+replicas can verify an archive without talking to the directory, by
+checking the STR chain and rebuilding each snapshot's tree from the
+changes.
+
+Conformance
+
+This module includes a conformance suite for verifiers: STRs,
+authentication paths, temporary bindings and VRF proofs produced by the
+directory, valid and tampered with, along with the verdict a client must
+reach for each. Implementations of the client in other languages can
+check their verdicts against the suite's JSON file.
+
+Wire
+
+This module implements the compression of the protocols' HTTP framing.
+Servers compress lookup, monitoring and STR history responses, which are
+mostly lists of hashes, with zstd, gzip or deflate, negotiated with the
+Accept-Encoding header of the client; clients offer the codings they
+support and decompress the responses transparently, rejecting responses
+that decompress to more than a fixed limit.
 */
 package protocol
@@ -9,7 +9,8 @@ package protocol
 type ErrorCode int
 
 // These codes indicate the status of a client-server or client-auditor message
-// exchange.
+// exchange. Like the codes below, they're named in the protocol/registry
+// package.
 // Codes prefixed by "Req" indicate different client request results.
 // Codes prefixed by "Err" indicate an internal server/auditor error or a malformed
 // message.
@@ -23,6 +24,13 @@ const (
 	ErrDirectory
 	ErrAuditLog
 	ErrMalformedMessage
+
+	// directory->client: the directory no longer keeps the snapshot of
+	// the requested epoch, only its STR
+	ReqEpochPruned
+	// directory->client: the request or the binding to be registered
+	// isn't allowed by the directory's policy
+	ReqRejected
 )
 
 // These codes indicate the result
@@ -38,6 +46,16 @@ const (
 	CheckBadSTR
 	CheckBadPromise
 	CheckBrokenPromise
+	CheckBadTreeDepth
+	CheckSuspiciousTreeShape
+	CheckEarlyKeyChange
+	CheckCapabilityDowngrade
+	CheckEarlyReregistration
+	CheckBadUpgrade
+	CheckBadBindingEpochs
+	CheckBadPolicySchedule
+	CheckBadApproval
+	CheckBadKeyRotation
 )
 
 // errors contains codes indicating the client
@@ -56,6 +74,8 @@ var (
 		ReqSuccess:      "[coniks] Successful client request",
 		ReqNameExisted:  "[coniks] Registering identity is already registered",
 		ReqNameNotFound: "[coniks] Searched name not found in directory",
+		ReqEpochPruned:  "[coniks] The directory no longer serves proofs for the requested epoch",
+		ReqRejected:     "[coniks] The directory's policy doesn't allow the request",
 
 		ErrMalformedMessage: "[coniks] Malformed message",
 		ErrDirectory:        "[coniks] Directory error",
@@ -70,6 +90,17 @@ var (
 		CheckBadSTR:         "[coniks] The hash chain is inconsistent",
 		CheckBadPromise:     "[coniks] The directory returned an invalid registration promise",
 		CheckBrokenPromise:  "[coniks] The directory broke the registration promise",
+		CheckBadTreeDepth:   "[coniks] The authentication path is deeper than the STR allows",
+
+		CheckSuspiciousTreeShape: "[coniks] The tree shape in the STR suggests adversarial clustering",
+		CheckEarlyKeyChange:      "[coniks] The directory allowed a key change before the minimum interval",
+		CheckCapabilityDowngrade: "[coniks] The directory withdrew capabilities without flagging a policy change",
+		CheckEarlyReregistration: "[coniks] The directory rebound a deleted name before the end of its quarantine",
+		CheckBadUpgrade:          "[coniks] The directory changed its protocol version other than announced",
+		CheckBadBindingEpochs:    "[coniks] The epochs of the binding are inconsistent with the STR",
+		CheckBadPolicySchedule:   "[coniks] The directory changed its policies other than announced",
+		CheckBadApproval:         "[coniks] The STR lacks the approval of the directory's operators",
+		CheckBadKeyRotation:      "[coniks] The directory changed its signing key other than announced",
 	}
 )
 
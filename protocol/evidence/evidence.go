@@ -0,0 +1,211 @@
+// This module implements verification of evidence of directory
+// misbehavior that anybody can check with nothing but the directory's
+// public signing key. Evidence is exchanged as serialized STRs, so that
+// clients who observed the directory independently can pool what they
+// saw, and hand it to an auditor or a third party.
+
+package evidence
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+var (
+	// ErrMalformedSTR indicates that a serialized STR couldn't be decoded
+	// or isn't well-formed.
+	ErrMalformedSTR = errors.New("[evidence] Malformed STR")
+	// ErrBadSignature indicates that an STR isn't signed with the
+	// directory's signing key.
+	ErrBadSignature = errors.New("[evidence] Invalid STR signature")
+	// ErrBrokenChain indicates that a range of STRs isn't a valid hash chain.
+	ErrBrokenChain = errors.New("[evidence] The STRs don't form a hash chain")
+	// ErrEpochMismatch indicates that the STRs claimed to conflict
+	// are for different epochs.
+	ErrEpochMismatch = errors.New("[evidence] The STRs are for different epochs")
+	// ErrNoEquivocation indicates that the evidence is consistent, i.e.
+	// it doesn't prove that the directory equivocated.
+	ErrNoEquivocation = errors.New("[evidence] The STRs don't conflict")
+)
+
+// MarshalSTR serializes str for inclusion in evidence, with its policies
+// as its associated data (see directory.SignedTreeRoot.MarshalJSON).
+func MarshalSTR(str *directory.SignedTreeRoot) ([]byte, error) {
+	return json.Marshal(str)
+}
+
+// UnmarshalSTR decodes an STR serialized with MarshalSTR, reconstructing
+// its policies with the decoder registered for directory.ConfigType, and
+// checks that it is well-formed, i.e. that it carries the directory's
+// policies, a signature, and a previous epoch consistent with its epoch.
+// It returns ErrMalformedSTR otherwise.
+func UnmarshalSTR(bs []byte) (*directory.SignedTreeRoot, error) {
+	var str directory.SignedTreeRoot
+	if err := json.Unmarshal(bs, &str); err != nil ||
+		str.SignedTreeRoot == nil || str.Policies == nil ||
+		str.Signature.IsZero() {
+		return nil, ErrMalformedSTR
+	}
+	// the hashes and the signature can't have the wrong length, or they
+	// wouldn't have decoded
+	if str.Epoch == 0 && !str.IsGenesis() ||
+		str.Epoch > 0 && str.PreviousEpoch != str.Epoch-1 {
+		return nil, ErrMalformedSTR
+	}
+	return &str, nil
+}
+
+// An Equivocation is cryptographic proof that a directory equivocated:
+// two STRs for the same epoch, both signed by the directory, with
+// different contents.
+type Equivocation struct {
+	Epoch merkletree.Epoch
+	A, B  *directory.SignedTreeRoot
+	// SameParent is true if A and B extend the same previous STR, i.e.
+	// the directory's history forked at Epoch. Otherwise, it forked at
+	// an earlier epoch.
+	SameParent bool
+}
+
+// VerifyEquivocation determines whether the serialized STRs a and b,
+// claimed to be from the directory with the public signing key signKey,
+// prove that the directory equivocated. It returns the equivocation if
+// both STRs are well-formed, validly signed, for the same epoch, and
+// differ in content.
+//
+// Otherwise it returns ErrMalformedSTR, ErrBadSignature,
+// ErrEpochMismatch or ErrNoEquivocation.
+func VerifyEquivocation(signKey sign.PublicKey, a, b []byte) (*Equivocation, error) {
+	strA, err := decodeAndVerify(signKey, a)
+	if err != nil {
+		return nil, err
+	}
+	strB, err := decodeAndVerify(signKey, b)
+	if err != nil {
+		return nil, err
+	}
+	return compare(strA, strB)
+}
+
+func decodeAndVerify(signKey sign.PublicKey, bs []byte) (*directory.SignedTreeRoot, error) {
+	str, err := UnmarshalSTR(bs)
+	if err != nil {
+		return nil, err
+	}
+	if !signKey.Verify(str.Bytes(), str.Signature[:]) {
+		return nil, ErrBadSignature
+	}
+	return str, nil
+}
+
+// compare returns the equivocation of a and b, which must have valid
+// signatures.
+func compare(a, b *directory.SignedTreeRoot) (*Equivocation, error) {
+	if a.Epoch != b.Epoch {
+		return nil, ErrEpochMismatch
+	}
+	if bytes.Equal(a.Bytes(), b.Bytes()) {
+		return nil, ErrNoEquivocation
+	}
+	return &Equivocation{
+		Epoch:      a.Epoch,
+		A:          a,
+		B:          b,
+		SameParent: a.PreviousSTRHash == b.PreviousSTRHash,
+	}, nil
+}
+
+// A Bundle is evidence pooled by two parties who observed a directory
+// independently. Each of A and B is a range of consecutive serialized
+// STRs, oldest first, as seen by one party. The ranges may overlap
+// partially or not at all, but their last STRs must be for the same
+// epoch.
+type Bundle struct {
+	// SignKey is the public signing key the bundle claims the directory
+	// has. It only identifies the directory: anybody can create
+	// a bundle, so Verify checks the STRs against a key the verifier
+	// trusts instead.
+	SignKey sign.PublicKey
+	A, B    []json.RawMessage
+}
+
+// Verify checks the bundle against the directory's public signing key
+// signKey, which the verifier must obtain independently of the bundle,
+// and returns the earliest equivocation it proves. Each range in the
+// bundle must be signed with signKey, or Verify returns ErrBadSignature,
+// and be a valid hash chain, or it returns ErrBrokenChain.
+// Since each range is a hash chain, the earliest epoch for which the
+// ranges contain conflicting STRs is the best evidence of when the
+// directory's history forked.
+//
+// Verify returns ErrNoEquivocation if the ranges agree on every epoch
+// they have in common.
+func (b *Bundle) Verify(signKey sign.PublicKey) (*Equivocation, error) {
+	chainA, err := verifyChain(signKey, b.A)
+	if err != nil {
+		return nil, err
+	}
+	chainB, err := verifyChain(signKey, b.B)
+	if err != nil {
+		return nil, err
+	}
+	lastA, lastB := chainA[len(chainA)-1], chainB[len(chainB)-1]
+	if lastA.Epoch != lastB.Epoch {
+		return nil, ErrEpochMismatch
+	}
+
+	// the chains end in the same epoch, so align them at the end
+	offA, offB := 0, 0
+	if len(chainA) > len(chainB) {
+		offA = len(chainA) - len(chainB)
+	} else {
+		offB = len(chainB) - len(chainA)
+	}
+	for i := 0; offA+i < len(chainA); i++ {
+		if eq, err := compare(chainA[offA+i], chainB[offB+i]); err == nil {
+			return eq, nil
+		}
+	}
+	return nil, ErrNoEquivocation
+}
+
+func verifyChain(signKey sign.PublicKey, raw []json.RawMessage) ([]*directory.SignedTreeRoot, error) {
+	if len(raw) == 0 {
+		return nil, ErrMalformedSTR
+	}
+	chain := make([]*directory.SignedTreeRoot, len(raw))
+	for i, bs := range raw {
+		str, err := decodeAndVerify(signKey, bs)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && !str.VerifyHashChain(chain[i-1]) {
+			return nil, ErrBrokenChain
+		}
+		chain[i] = str
+	}
+	return chain, nil
+}
+
+// NewBundle creates a bundle from two ranges of STRs.
+func NewBundle(signKey sign.PublicKey, a, b []*directory.SignedTreeRoot) (*Bundle, error) {
+	bundle := &Bundle{SignKey: signKey}
+	for _, r := range []struct {
+		strs []*directory.SignedTreeRoot
+		dst  *[]json.RawMessage
+	}{{a, &bundle.A}, {b, &bundle.B}} {
+		for _, str := range r.strs {
+			bs, err := MarshalSTR(str)
+			if err != nil {
+				return nil, err
+			}
+			*r.dst = append(*r.dst, bs)
+		}
+	}
+	return bundle, nil
+}
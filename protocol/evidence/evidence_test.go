@@ -0,0 +1,167 @@
+package evidence
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+var staticSigningKey = crypto.NewStaticTestSigningKey()
+
+// forkedHistories returns the first numEpochs+1 STRs of two directories
+// with the same keys and genesis STR, whose histories differ from epoch
+// 1 on.
+func forkedHistories(t *testing.T, numEpochs int) (a, b []*directory.SignedTreeRoot) {
+	for _, hist := range []*[]*directory.SignedTreeRoot{&a, &b} {
+		d := directory.NewTestTree(t)
+		*hist = append(*hist, d.LatestSTR())
+		for i := 0; i < numEpochs; i++ {
+			d.Update()
+			*hist = append(*hist, d.LatestSTR())
+		}
+	}
+	return
+}
+
+func marshal(t *testing.T, str *directory.SignedTreeRoot) []byte {
+	bs, err := MarshalSTR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestVerifyEquivocation(t *testing.T) {
+	a, b := forkedHistories(t, 2)
+	pk := staticSigningKey.Public()
+
+	eq, err := VerifyEquivocation(pk, marshal(t, a[1]), marshal(t, b[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq.Epoch != 1 || !eq.SameParent {
+		t.Errorf("Unexpected equivocation %+v", eq)
+	}
+	eq, err = VerifyEquivocation(pk, marshal(t, a[2]), marshal(t, b[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq.Epoch != 2 || eq.SameParent {
+		t.Errorf("Unexpected equivocation %+v", eq)
+	}
+
+	forged := *a[1].SignedTreeRoot
+	forged.TreeHash = b[1].TreeHash
+	forgedSTR := &directory.SignedTreeRoot{SignedTreeRoot: &forged, Policies: a[1].Policies}
+
+	otherKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		pk   []byte
+		a, b []byte
+		want error
+	}{
+		{"same STR", pk, marshal(t, a[1]), marshal(t, a[1]), ErrNoEquivocation},
+		{"genesis", pk, marshal(t, a[0]), marshal(t, b[0]), ErrNoEquivocation},
+		{"different epochs", pk, marshal(t, a[1]), marshal(t, b[2]), ErrEpochMismatch},
+		{"forged", pk, marshal(t, a[1]), marshal(t, forgedSTR), ErrBadSignature},
+		{"wrong key", otherKey.Public(), marshal(t, a[1]), marshal(t, b[1]), ErrBadSignature},
+		{"garbage", pk, marshal(t, a[1]), []byte("{}"), ErrMalformedSTR},
+	} {
+		if _, err := VerifyEquivocation(tc.pk, tc.a, tc.b); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestUnmarshalSTRMalformed(t *testing.T) {
+	a, _ := forkedHistories(t, 1)
+	str := *a[1].SignedTreeRoot
+	str.PreviousEpoch = 5
+	bs := marshal(t, &directory.SignedTreeRoot{SignedTreeRoot: &str, Policies: a[1].Policies})
+	if _, err := UnmarshalSTR(bs); err != ErrMalformedSTR {
+		t.Error("Expect", ErrMalformedSTR, "got", err)
+	}
+	if _, err := UnmarshalSTR(marshal(t, a[1])); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	a, b := forkedHistories(t, 3)
+	pk := staticSigningKey.Public()
+
+	for _, tc := range []struct {
+		name      string
+		a, b      []*directory.SignedTreeRoot
+		wantEpoch merkletree.Epoch
+		wantErr   error
+	}{
+		{"full histories", a, b, 1, nil},
+		{"partial overlap", a[1:], b[2:], 2, nil},
+		{"single STRs", a[3:], b[3:], 3, nil},
+		{"no overlap in the fork", a[:1], b[:1], 0, ErrNoEquivocation},
+		{"same history", a, a[2:], 0, ErrNoEquivocation},
+		{"different last epochs", a, b[:3], 0, ErrEpochMismatch},
+		{"broken chain", []*directory.SignedTreeRoot{a[1], b[2]}, b[2:], 0, ErrBrokenChain},
+		{"gap", []*directory.SignedTreeRoot{a[1], a[3]}, b[3:], 0, ErrBrokenChain},
+		{"empty range", nil, b, 0, ErrMalformedSTR},
+	} {
+		bundle, err := NewBundle(pk, tc.a, tc.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// bundles are exchanged as JSON
+		bs, err := json.Marshal(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Bundle
+		if err := json.Unmarshal(bs, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		eq, err := decoded.Verify(pk)
+		if err != tc.wantErr {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.wantErr, err)
+			continue
+		}
+		if err == nil && eq.Epoch != tc.wantEpoch {
+			t.Errorf("%s: expect equivocation at epoch %d, got %d", tc.name, tc.wantEpoch, eq.Epoch)
+		}
+	}
+}
+
+func TestBundleSubstitutedKey(t *testing.T) {
+	// a forged fork, signed with a key of the forger's, which the
+	// bundle claims is the directory's
+	evilKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b []*directory.SignedTreeRoot
+	for _, hist := range []*[]*directory.SignedTreeRoot{&a, &b} {
+		d, err := directory.New(crypto.NewStaticTestVRFKey(), evilKey, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Update()
+		*hist = append(*hist, d.LatestSTR())
+	}
+	bundle, err := NewBundle(evilKey.Public(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bundle.Verify(evilKey.Public()); err != nil {
+		t.Fatal("Expect the bundle to prove an equivocation of the forger's directory, got", err)
+	}
+	if _, err := bundle.Verify(staticSigningKey.Public()); err != ErrBadSignature {
+		t.Error("Expect", ErrBadSignature, "got", err)
+	}
+}
@@ -0,0 +1,171 @@
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+// An IdentityPeer is a Peer that can also be asked for the identities of
+// the directories it audits.
+type IdentityPeer interface {
+	Peer
+	GetDirectories(ctx context.Context, req *directory.DirectoriesRequest) (*directory.Response, error)
+}
+
+// An IdentityObserver is an Observer that also answers
+// DirectoriesRequests locally, such as an auditlog.ConiksAuditLog.
+type IdentityObserver interface {
+	Observer
+	GetDirectories(req *directory.DirectoriesRequest) *directory.Response
+}
+
+type localIdentityPeer struct {
+	o IdentityObserver
+}
+
+func (p localIdentityPeer) GetObservedSTRs(_ context.Context, req *directory.AuditingRequest) (*directory.Response, error) {
+	return p.o.GetObservedSTRs(req), nil
+}
+
+func (p localIdentityPeer) GetDirectories(_ context.Context, req *directory.DirectoriesRequest) (*directory.Response, error) {
+	return p.o.GetDirectories(req), nil
+}
+
+// An IdentityReport is the result of gathering the identities of the
+// directories the peers audit.
+type IdentityReport struct {
+	// Directories has the valid identities the peers know, indexed by
+	// the directories' identifiers. A new auditor can start auditing
+	// them with auditlog.ConiksAuditLog.InitFromIdentity.
+	Directories map[[hashed.HashSizeByte]byte]*directory.DirectoryIdentity
+	// Sources maps the identifier of every directory in Directories to
+	// the peers that know it.
+	Sources map[[hashed.HashSizeByte]byte][]string
+	// Conflicting maps every address for which the peers know several
+	// directories, i.e. different initial STRs, to their identities.
+	Conflicting map[string][]*directory.DirectoryIdentity
+	// Unreachable lists the peers that failed to respond, or returned
+	// invalid identities.
+	Unreachable []string
+}
+
+// GatherIdentities asks every IdentityPeer of s for the identities of
+// the directories it audits, and merges them. Peers returning
+// identities whose initial STRs aren't signed by the directories' keys
+// lose agreement score, and their identities are ignored. Peers that
+// aren't IdentityPeers aren't asked.
+// GatherIdentities() sends an alert for each address with conflicting
+// identities, and returns ErrNoPeers if there is no peer to ask.
+func (s *PeerSet) GatherIdentities(ctx context.Context) (*IdentityReport, error) {
+	infos := s.Peers()
+	var addrs []string
+	s.mu.Lock()
+	for _, info := range infos {
+		if ps, ok := s.peers[info.Addr]; ok {
+			if _, ok := ps.peer.(IdentityPeer); ok {
+				addrs = append(addrs, info.Addr)
+			}
+		}
+	}
+	s.mu.Unlock()
+	if len(addrs) == 0 {
+		return nil, ErrNoPeers
+	}
+
+	known := make([][]*directory.DirectoryIdentity, len(addrs))
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i := range addrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			known[i], errs[i] = s.queryDirectories(ctx, addrs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := &IdentityReport{
+		Directories: make(map[[hashed.HashSizeByte]byte]*directory.DirectoryIdentity),
+		Sources:     make(map[[hashed.HashSizeByte]byte][]string),
+		Conflicting: make(map[string][]*directory.DirectoryIdentity),
+	}
+	byAddr := make(map[string][]*directory.DirectoryIdentity)
+	for i, addr := range addrs {
+		if errs[i] != nil {
+			report.Unreachable = append(report.Unreachable, addr)
+			continue
+		}
+		for _, id := range known[i] {
+			dirID := id.ID()
+			if _, ok := report.Directories[dirID]; !ok {
+				report.Directories[dirID] = id
+				byAddr[id.Addr] = append(byAddr[id.Addr], id)
+			}
+			report.Sources[dirID] = append(report.Sources[dirID], addr)
+		}
+	}
+	for addr, ids := range byAddr {
+		if len(ids) < 2 {
+			continue
+		}
+		report.Conflicting[addr] = ids
+		_ = alert.Send(s.Alerts, &alert.Alert{
+			Kind:      alert.ConflictingIdentity,
+			Severity:  alert.Critical,
+			Time:      s.now(),
+			Directory: addr,
+			Message:   fmt.Sprintf("peers know %d different initial STRs", len(ids)),
+			Err:       protocol.CheckBadSTR,
+		})
+	}
+	return report, nil
+}
+
+// queryDirectories asks the peer addr for the identities of the
+// directories it audits, and records the peer's responsiveness, and its
+// disagreement if any of the identities is invalid.
+func (s *PeerSet) queryDirectories(ctx context.Context, addr string) ([]*directory.DirectoryIdentity, error) {
+	s.mu.Lock()
+	ps, ok := s.peers[addr]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrNoPeers
+	}
+	peer := ps.peer.(IdentityPeer)
+
+	var ids *directory.DirectoryIdentities
+	err := s.call(ctx, ps, func(ctx context.Context) error {
+		resp, err := peer.GetDirectories(ctx, &directory.DirectoriesRequest{})
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return ErrUnexpectedResponse
+		}
+		if resp.Error != protocol.ReqSuccess {
+			return resp.Error
+		}
+		if ids, ok = resp.DirectoryResponse.(*directory.DirectoryIdentities); !ok {
+			return ErrUnexpectedResponse
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids.Directories {
+		if id == nil || id.Verify() != nil {
+			s.mu.Lock()
+			ps.Disagreements++
+			s.mu.Unlock()
+			return nil, protocol.CheckBadSignature
+		}
+	}
+	return ids.Directories, nil
+}
@@ -0,0 +1,106 @@
+package gossip
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+	"github.com/ORBAT/cloniks/protocol/auditlog"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+)
+
+type identityPeerFunc func() *directory.Response
+
+func (f identityPeerFunc) GetObservedSTRs(context.Context, *directory.AuditingRequest) (*directory.Response, error) {
+	return nil, errOffline
+}
+
+func (f identityPeerFunc) GetDirectories(context.Context, *directory.DirectoriesRequest) (*directory.Response, error) {
+	return f(), nil
+}
+
+func TestGatherIdentities(t *testing.T) {
+	_, honestLog, hist := auditlog.NewTestAuditLog(t, 2)
+	honestID, _ := auditor.ComputeDirectoryIdentity(hist[0])
+	// another directory claiming the same address
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), staticSigningKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostorLog := auditlog.New()
+	if err := impostorLog.InitHistory("test-server", staticSigningKey.Public(),
+		[]*directory.SignedTreeRoot{d.LatestSTR()}); err != nil {
+		t.Fatal(err)
+	}
+	// a peer claiming the honest directory has another signing key
+	otherKey, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liar := identityPeerFunc(func() *directory.Response {
+		return directory.NewDirectoryIdentitiesResponse([]*directory.DirectoryIdentity{{
+			Addr:    "test-server",
+			SignKey: otherKey.Public(),
+			InitSTR: hist[0],
+		}})
+	})
+
+	peers := NewPeerSet(map[string]Peer{
+		"honest":   LocalPeer(honestLog),
+		"impostor": LocalPeer(impostorLog),
+		"liar":     liar,
+		"offline":  offlinePeer(),
+	})
+	var alerts []*alert.Alert
+	peers.Alerts = alert.SinkFunc(func(a *alert.Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	})
+	report, err := peers.GatherIdentities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Directories) != 2 {
+		t.Fatal("Expect 2 directories, got", len(report.Directories))
+	}
+	if sources := report.Sources[honestID]; len(sources) != 1 || sources[0] != "honest" {
+		t.Error("Expect the honest directory from the honest peer, got", sources)
+	}
+	if len(report.Unreachable) != 1 || report.Unreachable[0] != "liar" {
+		t.Error("Expect the liar to be unreachable, got", report.Unreachable)
+	}
+	if len(report.Conflicting["test-server"]) != 2 {
+		t.Error("Expect conflicting identities for test-server, got", report.Conflicting)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != alert.ConflictingIdentity || alerts[0].Directory != "test-server" {
+		t.Error("Expect an alert for the conflicting identities, got", alerts)
+	}
+	for _, info := range peers.Peers() {
+		if info.Addr == "liar" && info.Disagreements != 1 {
+			t.Error("Expect the liar to lose agreement score")
+		}
+		if info.Addr == "offline" && info.Checks != 0 {
+			t.Error("Expect peers without identities not to be asked")
+		}
+	}
+
+	// a new auditor starts auditing the directories the peers know
+	newLog := auditlog.New()
+	if err := newLog.InitFromIdentity(report.Directories[honestID]); err != nil {
+		t.Fatal(err)
+	}
+	resp := newLog.GetObservedSTRs(&directory.AuditingRequest{DirInitSTRHash: honestID})
+	if resp.Error != protocol.ReqSuccess {
+		t.Error("Expect the new auditor to know the directory, got", resp.Error)
+	}
+
+	if _, err := NewPeerSet(map[string]Peer{"offline": offlinePeer()}).GatherIdentities(
+		context.Background()); err != ErrNoPeers {
+		t.Error("Expect", ErrNoPeers, "got", err)
+	}
+}
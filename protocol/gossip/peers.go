@@ -0,0 +1,409 @@
+// This module implements the peer management of a CONIKS auditor:
+// a list of other auditors built from static configuration and
+// optional discovery, health checks that score the peers'
+// responsiveness and agreement rate, and fork detection that
+// cross-checks a directory's STRs with the best-scoring peers.
+
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+	"github.com/ORBAT/cloniks/protocol/alert"
+)
+
+var (
+	// ErrNoPeers indicates that there are no peers to query.
+	ErrNoPeers = errors.New("[gossip] No peers")
+	// ErrUnexpectedResponse indicates that a peer returned a response
+	// that doesn't answer the request.
+	ErrUnexpectedResponse = errors.New("[gossip] Peer returned an unexpected response")
+)
+
+// A Peer is another CONIKS auditor that can be asked for the STRs it
+// has observed for a directory.
+type Peer interface {
+	GetObservedSTRs(ctx context.Context, req *directory.AuditingRequest) (*directory.Response, error)
+}
+
+// PeerFunc adapts an ordinary function to the Peer interface.
+type PeerFunc func(ctx context.Context, req *directory.AuditingRequest) (*directory.Response, error)
+
+// GetObservedSTRs calls f(ctx, req).
+func (f PeerFunc) GetObservedSTRs(ctx context.Context, req *directory.AuditingRequest) (*directory.Response, error) {
+	return f(ctx, req)
+}
+
+// An Observer is anything that answers AuditingRequests locally,
+// such as an auditlog.ConiksAuditLog.
+type Observer interface {
+	GetObservedSTRs(req *directory.AuditingRequest) *directory.Response
+}
+
+// LocalPeer returns a Peer that answers requests using o. If o is an
+// IdentityObserver, the Peer is an IdentityPeer.
+func LocalPeer(o Observer) Peer {
+	if io, ok := o.(IdentityObserver); ok {
+		return localIdentityPeer{io}
+	}
+	return PeerFunc(func(_ context.Context, req *directory.AuditingRequest) (*directory.Response, error) {
+		return o.GetObservedSTRs(req), nil
+	})
+}
+
+// A Discoverer finds peers in addition to the statically configured ones,
+// e.g. from a DNS record or another auditor's peer list.
+// Discover() returns the discovered peers indexed by their address.
+type Discoverer interface {
+	Discover(ctx context.Context) (map[string]Peer, error)
+}
+
+// PeerInfo is a snapshot of the state a PeerSet keeps about a peer.
+type PeerInfo struct {
+	Addr string
+	// Static is true if the peer was configured rather than discovered.
+	Static bool
+	// Checks and Failures count the health checks of the peer
+	// and how many of them failed.
+	Checks   uint64
+	Failures uint64
+	// Agreements and Disagreements count how often the STRs returned
+	// by the peer matched ours, and how often the peer returned STRs
+	// that didn't even carry a valid signature.
+	Agreements    uint64
+	Disagreements uint64
+	// Latency is a moving average of the peer's response time.
+	Latency  time.Duration
+	LastSeen time.Time
+}
+
+// Responsiveness returns the fraction of successful health checks
+// with a Laplace prior, i.e. a peer that hasn't been checked yet
+// has a responsiveness of 0.5.
+func (i PeerInfo) Responsiveness() float64 {
+	return float64(i.Checks-i.Failures+1) / float64(i.Checks+2)
+}
+
+// AgreementRate returns the fraction of STR comparisons in which the
+// peer agreed with us, with a Laplace prior.
+func (i PeerInfo) AgreementRate() float64 {
+	return float64(i.Agreements+1) / float64(i.Agreements+i.Disagreements+2)
+}
+
+// Score returns the weight of the peer's opinion, in [0, 1].
+func (i PeerInfo) Score() float64 {
+	return i.Responsiveness() * i.AgreementRate()
+}
+
+type peerState struct {
+	PeerInfo
+	peer Peer
+}
+
+// latencyWeight is the weight of a new latency measurement
+// in a peer's moving average.
+const latencyWeight = 0.2
+
+// A PeerSet maintains the list of peers of an auditor.
+// It is safe for concurrent use.
+type PeerSet struct {
+	// Timeout bounds the time a single request to a peer may take.
+	Timeout time.Duration
+	// Fanout is the maximum number of peers queried by DetectFork.
+	// If Fanout is 0, all peers are queried.
+	Fanout int
+	// Alerts receives an alert whenever DetectFork detects a fork.
+	// It may be nil.
+	Alerts alert.Sink
+
+	mu          sync.Mutex
+	peers       map[string]*peerState
+	discoverers []Discoverer
+	now         func() time.Time
+}
+
+// NewPeerSet creates a PeerSet containing the statically configured
+// peers static, indexed by their address. Additional peers are added
+// by Discover() using the given discoverers.
+func NewPeerSet(static map[string]Peer, discoverers ...Discoverer) *PeerSet {
+	s := &PeerSet{
+		Timeout:     10 * time.Second,
+		peers:       make(map[string]*peerState, len(static)),
+		discoverers: discoverers,
+		now:         time.Now,
+	}
+	for addr, p := range static {
+		s.peers[addr] = &peerState{
+			PeerInfo: PeerInfo{Addr: addr, Static: true},
+			peer:     p,
+		}
+	}
+	return s
+}
+
+// Discover runs all discoverers of s and adds the peers they found.
+// Already known peers are left unchanged. Discover() returns the first
+// error encountered, but still adds the peers found by the other
+// discoverers.
+func (s *PeerSet) Discover(ctx context.Context) error {
+	var firstErr error
+	for _, d := range s.discoverers {
+		found, err := d.Discover(ctx)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.mu.Lock()
+		for addr, p := range found {
+			if _, ok := s.peers[addr]; !ok {
+				s.peers[addr] = &peerState{
+					PeerInfo: PeerInfo{Addr: addr},
+					peer:     p,
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Remove removes the peer addr from s.
+func (s *PeerSet) Remove(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, addr)
+}
+
+// Peers returns the state of all peers, best score first.
+func (s *PeerSet) Peers() []PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := make([]PeerInfo, 0, len(s.peers))
+	for _, ps := range s.peers {
+		infos = append(infos, ps.PeerInfo)
+	}
+	sortByScore(infos)
+	return infos
+}
+
+func sortByScore(infos []PeerInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		if si, sj := infos[i].Score(), infos[j].Score(); si != sj {
+			return si > sj
+		}
+		return infos[i].Addr < infos[j].Addr
+	})
+}
+
+// query sends req to the peer addr and records the peer's
+// responsiveness. It returns the STRs in the peer's response.
+func (s *PeerSet) query(ctx context.Context, addr string, req *directory.AuditingRequest) ([]*directory.SignedTreeRoot, error) {
+	s.mu.Lock()
+	ps, ok := s.peers[addr]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrNoPeers
+	}
+
+	var resp *directory.Response
+	err := s.call(ctx, ps, func(ctx context.Context) (err error) {
+		resp, err = ps.peer.GetObservedSTRs(ctx, req)
+		if err == nil {
+			err = checkResponse(resp, req)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.DirectoryResponse.(*directory.STRHistoryRange).STR, nil
+}
+
+// call calls f with a context bounded by s.Timeout, and records the
+// responsiveness of the peer ps it queries. It returns the error of f.
+func (s *PeerSet) call(ctx context.Context, ps *peerState, f func(ctx context.Context) error) error {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	start := s.now()
+	err := f(ctx)
+	elapsed := s.now().Sub(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps.Checks++
+	if err != nil && err != protocol.ReqUnknownDirectory {
+		ps.Failures++
+		return err
+	}
+	ps.LastSeen = start.Add(elapsed)
+	if ps.Latency == 0 {
+		ps.Latency = elapsed
+	} else {
+		ps.Latency += time.Duration(latencyWeight * float64(elapsed-ps.Latency))
+	}
+	return err
+}
+
+// checkResponse returns the response's error code if it isn't a success,
+// and ErrUnexpectedResponse if the response doesn't contain the
+// requested range of STRs.
+func checkResponse(resp *directory.Response, req *directory.AuditingRequest) error {
+	if resp == nil {
+		return ErrUnexpectedResponse
+	}
+	if resp.Error != protocol.ReqSuccess {
+		return resp.Error
+	}
+	strs, ok := resp.DirectoryResponse.(*directory.STRHistoryRange)
+	if !ok || merkletree.Epoch(len(strs.STR)) != req.EndEpoch-req.StartEpoch+1 {
+		return ErrUnexpectedResponse
+	}
+	for i, str := range strs.STR {
+		if str == nil || str.Epoch != req.StartEpoch+merkletree.Epoch(i) {
+			return ErrUnexpectedResponse
+		}
+	}
+	return nil
+}
+
+// HealthCheck asks every peer for the initial STR of the directory
+// dirInitHash and updates the peers' responsiveness.
+// A peer that answers with protocol.ReqUnknownDirectory is healthy.
+func (s *PeerSet) HealthCheck(ctx context.Context, dirInitHash [hashed.HashSizeByte]byte) {
+	req := &directory.AuditingRequest{DirInitSTRHash: dirInitHash}
+	var wg sync.WaitGroup
+	for _, info := range s.Peers() {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			_, _ = s.query(ctx, addr, req)
+		}(info.Addr)
+	}
+	wg.Wait()
+}
+
+// A ForkReport is the result of cross-checking an STR with the
+// STRs observed by peers.
+type ForkReport struct {
+	// Agreeing lists the peers that observed the same STR.
+	Agreeing []string
+	// Conflicting maps peers that observed a different STR with a
+	// valid signature to that STR. A single entry is cryptographic
+	// proof that the directory equivocated.
+	Conflicting map[string]*directory.SignedTreeRoot
+	// Unreachable lists the peers that failed to respond, didn't know
+	// the directory or epoch, or returned STRs with invalid signatures.
+	Unreachable []string
+	// AgreementWeight and TotalWeight are the summed scores of the
+	// agreeing peers and of all queried peers.
+	AgreementWeight float64
+	TotalWeight     float64
+}
+
+// Forked returns true if any peer has observed a conflicting STR.
+func (r *ForkReport) Forked() bool {
+	return len(r.Conflicting) > 0
+}
+
+// Confidence returns the score-weighted fraction of queried peers that
+// agreed with the checked STR.
+func (r *ForkReport) Confidence() float64 {
+	if r.TotalWeight == 0 {
+		return 0
+	}
+	return r.AgreementWeight / r.TotalWeight
+}
+
+// DetectFork asks up to s.Fanout peers, best-scoring first, for the
+// STR they observed for the directory dirInitHash in str's epoch and
+// compares it with str. Peers' STRs are checked against the directory's
+// signing key signKey, so a peer cannot frame the directory; peers
+// returning STRs with invalid signatures lose agreement score, while
+// peers confirming str gain it.
+// DetectFork() returns ErrNoPeers if there is no peer to ask.
+func (s *PeerSet) DetectFork(ctx context.Context, dirInitHash [hashed.HashSizeByte]byte,
+	signKey sign.PublicKey, str *directory.SignedTreeRoot) (*ForkReport, error) {
+	infos := s.Peers()
+	if s.Fanout > 0 && len(infos) > s.Fanout {
+		infos = infos[:s.Fanout]
+	}
+	if len(infos) == 0 {
+		return nil, ErrNoPeers
+	}
+
+	req := &directory.AuditingRequest{
+		DirInitSTRHash: dirInitHash,
+		StartEpoch:     str.Epoch,
+		EndEpoch:       str.Epoch,
+	}
+	observed := make([]*directory.SignedTreeRoot, len(infos))
+	var wg sync.WaitGroup
+	for i := range infos {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if strs, err := s.query(ctx, infos[i].Addr, req); err == nil {
+				observed[i] = strs[0]
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	report := &ForkReport{Conflicting: make(map[string]*directory.SignedTreeRoot)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, info := range infos {
+		ps, ok := s.peers[info.Addr]
+		if !ok {
+			continue
+		}
+		peerSTR := observed[i]
+		switch {
+		case peerSTR == nil:
+			report.Unreachable = append(report.Unreachable, info.Addr)
+		case sameSTR(str, peerSTR):
+			ps.Agreements++
+			report.Agreeing = append(report.Agreeing, info.Addr)
+			report.AgreementWeight += ps.Score()
+		case signKey.Verify(peerSTR.Bytes(), peerSTR.Signature[:]):
+			report.Conflicting[info.Addr] = peerSTR
+		default:
+			ps.Disagreements++
+			report.Unreachable = append(report.Unreachable, info.Addr)
+		}
+		report.TotalWeight += ps.Score()
+	}
+	if report.Forked() {
+		_ = alert.Send(s.Alerts, &alert.Alert{
+			Kind:      alert.Equivocation,
+			Severity:  alert.Critical,
+			Time:      s.now(),
+			Directory: hex.EncodeToString(dirInitHash[:]),
+			Epoch:     str.Epoch,
+			Message:   fmt.Sprintf("%d peer(s) observed a conflicting STR", len(report.Conflicting)),
+			Err:       protocol.CheckBadSTR,
+		})
+	}
+	return report, nil
+}
+
+func sameSTR(a, b *directory.SignedTreeRoot) bool {
+	return a.Signature == b.Signature && bytes.Equal(a.Bytes(), b.Bytes())
+}
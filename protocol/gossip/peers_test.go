@@ -0,0 +1,160 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol/alert"
+	"github.com/ORBAT/cloniks/protocol/auditlog"
+	"github.com/ORBAT/cloniks/protocol/auditor"
+)
+
+var staticSigningKey = crypto.NewStaticTestSigningKey()
+
+var errOffline = errors.New("offline")
+
+func offlinePeer() Peer {
+	return PeerFunc(func(context.Context, *directory.AuditingRequest) (*directory.Response, error) {
+		return nil, errOffline
+	})
+}
+
+// lyingPeer returns STRs with a broken signature.
+func lyingPeer(strs []*directory.SignedTreeRoot) Peer {
+	return PeerFunc(func(_ context.Context, req *directory.AuditingRequest) (*directory.Response, error) {
+		str := *strs[req.StartEpoch].SignedTreeRoot
+		str.Signature[0]++
+		return directory.NewSTRHistoryRange([]*directory.SignedTreeRoot{directory.NewDirSTR(&str)}), nil
+	})
+}
+
+type staticDiscoverer map[string]Peer
+
+func (d staticDiscoverer) Discover(context.Context) (map[string]Peer, error) {
+	return d, nil
+}
+
+func TestDetectFork(t *testing.T) {
+	_, honestLog, hist := auditlog.NewTestAuditLog(t, 2)
+	// a second directory with the same keys and genesis STR but a
+	// different history from epoch 1 on
+	_, forkedLog, _ := auditlog.NewTestAuditLog(t, 2)
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
+	pk := staticSigningKey.Public()
+
+	peers := NewPeerSet(map[string]Peer{
+		"honest":  LocalPeer(honestLog),
+		"forked":  LocalPeer(forkedLog),
+		"offline": offlinePeer(),
+	}, staticDiscoverer{"liar": lyingPeer(hist)})
+	var alerts []*alert.Alert
+	peers.Alerts = alert.SinkFunc(func(a *alert.Alert) error {
+		alerts = append(alerts, a)
+		return nil
+	})
+	if err := peers.Discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers.Peers()) != 4 {
+		t.Fatal("Expect 4 peers, got", len(peers.Peers()))
+	}
+
+	report, err := peers.DetectFork(context.Background(), dirInitHash, pk, hist[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Forked() {
+		t.Fatal("Expect fork to be detected")
+	}
+	if _, ok := report.Conflicting["forked"]; !ok || len(report.Conflicting) != 1 {
+		t.Error("Expect only the forked peer to conflict, got", report.Conflicting)
+	}
+	if len(report.Agreeing) != 1 || report.Agreeing[0] != "honest" {
+		t.Error("Expect only the honest peer to agree, got", report.Agreeing)
+	}
+	if len(report.Unreachable) != 2 {
+		t.Error("Expect the offline peer and the liar to be unreachable, got", report.Unreachable)
+	}
+	if c := report.Confidence(); c <= 0 || c >= 1 {
+		t.Error("Expect confidence in (0, 1), got", c)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != alert.Equivocation || alerts[0].Epoch != 2 {
+		t.Error("Expect an equivocation alert for epoch 2, got", alerts)
+	}
+
+	// the genesis STR is the same for everybody
+	report, err = peers.DetectFork(context.Background(), dirInitHash, pk, hist[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Forked() {
+		t.Error("Expect no fork at epoch 0, got", report.Conflicting)
+	}
+
+	infos := peers.Peers()
+	if infos[0].Addr != "honest" {
+		t.Error("Expect the honest peer to have the best score, got", infos[0].Addr)
+	}
+	if last := infos[len(infos)-1]; last.Addr != "liar" && last.Addr != "offline" {
+		t.Error("Expect the liar or offline peer to have the worst score, got", last.Addr)
+	}
+	for _, info := range infos {
+		switch info.Addr {
+		case "liar":
+			if info.Disagreements != 2 {
+				t.Error("Expect 2 disagreements for the liar, got", info.Disagreements)
+			}
+		case "offline":
+			if info.Failures != info.Checks {
+				t.Error("Expect all checks of the offline peer to fail")
+			}
+		}
+	}
+}
+
+func TestHealthCheckAndFanout(t *testing.T) {
+	_, honestLog, hist := auditlog.NewTestAuditLog(t, 0)
+	dirInitHash, _ := auditor.ComputeDirectoryIdentity(hist[0])
+
+	peers := NewPeerSet(map[string]Peer{
+		"a":       LocalPeer(honestLog),
+		"b":       LocalPeer(auditlog.New()), // doesn't know the directory
+		"offline": offlinePeer(),
+	})
+	peers.HealthCheck(context.Background(), dirInitHash)
+	peers.HealthCheck(context.Background(), dirInitHash)
+
+	for _, info := range peers.Peers() {
+		if info.Checks != 2 {
+			t.Error("Expect 2 checks for", info.Addr, "got", info.Checks)
+		}
+		wantFailures := uint64(0)
+		if info.Addr == "offline" {
+			wantFailures = 2
+		}
+		if info.Failures != wantFailures {
+			t.Error("Expect", wantFailures, "failures for", info.Addr, "got", info.Failures)
+		}
+	}
+
+	peers.Fanout = 2
+	report, err := peers.DetectFork(context.Background(), dirInitHash, staticSigningKey.Public(), hist[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(report.Agreeing) + len(report.Unreachable); n != 2 {
+		t.Error("Expect 2 queried peers, got", n)
+	}
+	for _, addr := range report.Unreachable {
+		if addr == "offline" {
+			t.Error("Expect the offline peer not to be queried")
+		}
+	}
+
+	if _, err := NewPeerSet(nil).DetectFork(context.Background(), dirInitHash, nil, hist[0]); err != ErrNoPeers {
+		t.Error("Expect", ErrNoPeers, "got", err)
+	}
+}
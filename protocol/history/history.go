@@ -0,0 +1,373 @@
+// This module implements the archive format for a CONIKS directory's
+// complete history: a single file with a header identifying the
+// directory's keys, followed by the STR of every epoch in a range along
+// with the changes to the directory's tree in that epoch. Directories
+// export their history with Export, and auditors, replicas and
+// forensic tools read it back with a Reader and verify it with
+// a Replay, which rebuilds every snapshot's tree.
+//
+// All integers are big-endian. An archive starts with the magic
+// "coniks history", the version of the format, the fingerprints
+// (hashes) of the directory's signing and VRF public keys, and the
+// index size of its tree. Each snapshot follows as the byte 1, the
+// length-prefixed JSON encoding of its STR (see
+// directory.SignedTreeRoot.MarshalJSON), and its merkletree.Delta.
+// The first snapshot's Delta is full. The archive ends with the byte 0
+// and the number of snapshots in it, so that truncated archives are
+// detected.
+
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/ORBAT/cloniks/crypto/hashed"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+var (
+	// ErrMalformedArchive indicates that an archive couldn't be parsed,
+	// or doesn't start with a full snapshot.
+	ErrMalformedArchive = errors.New("[history] Malformed archive")
+	// ErrKeyMismatch indicates that the keys of a directory don't match
+	// the fingerprints in an archive's header.
+	ErrKeyMismatch = errors.New("[history] The keys don't match the archive")
+)
+
+var archiveMagic = []byte("coniks history")
+
+const (
+	// archiveVersion 2 encodes the policies of the STRs as their typed
+	// associated data
+	archiveVersion = 2
+	// maxSTRSize bounds the length of the STRs a Reader accepts, so that
+	// a malformed length can't exhaust memory.
+	maxSTRSize = 1 << 20
+)
+
+// Record kinds.
+const (
+	endRecord      = 0
+	snapshotRecord = 1
+)
+
+// A Header identifies the directory whose history an archive holds.
+type Header struct {
+	// SignKey and VRFKey are the fingerprints of the directory's public
+	// signing and VRF keys. See Fingerprint.
+	SignKey, VRFKey hashed.Hash
+	// IndexSize is the size of the lookup indices of the directory.
+	IndexSize uint32
+}
+
+// Fingerprint returns the fingerprint of a public key in a Header.
+func Fingerprint(key []byte) hashed.Hash {
+	return hashed.Sum(key)
+}
+
+// NewHeader returns the Header for the directory whose STRs are signed
+// with signKey and that has the policies p.
+func NewHeader(signKey sign.PublicKey, p *directory.Config) *Header {
+	return &Header{
+		SignKey:   Fingerprint(signKey),
+		VRFKey:    Fingerprint(p.VrfPublicKey),
+		IndexSize: p.IndexSize,
+	}
+}
+
+// A Snapshot is the STR of an epoch along with the Delta that turns the
+// tree of the epoch before into the tree of that epoch.
+type Snapshot struct {
+	STR   *directory.SignedTreeRoot
+	Delta *merkletree.Delta
+}
+
+// A Writer writes an archive.
+type Writer struct {
+	w         io.Writer
+	snapshots uint64
+}
+
+// NewWriter writes the header h of an archive to w, and returns
+// a Writer for its snapshots.
+func NewWriter(w io.Writer, h *Header) (*Writer, error) {
+	bs := append(append([]byte{}, archiveMagic...), archiveVersion)
+	bs = append(bs, h.SignKey[:]...)
+	bs = append(bs, h.VRFKey[:]...)
+	bs = appendUint32(bs, h.IndexSize)
+	if _, err := w.Write(bs); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteSnapshot appends s to the archive. The Delta of the first
+// snapshot must be full.
+func (w *Writer) WriteSnapshot(s *Snapshot) error {
+	str, err := json.Marshal(s.STR)
+	if err != nil {
+		return err
+	}
+	bs := appendUint32([]byte{snapshotRecord}, uint32(len(str)))
+	if _, err := w.w.Write(append(bs, str...)); err != nil {
+		return err
+	}
+	if _, err := s.Delta.WriteTo(w.w); err != nil {
+		return err
+	}
+	w.snapshots++
+	return nil
+}
+
+// Close ends the archive. It doesn't close the underlying io.Writer.
+func (w *Writer) Close() error {
+	var bs [9]byte
+	bs[0] = endRecord
+	binary.BigEndian.PutUint64(bs[1:], w.snapshots)
+	_, err := w.w.Write(bs[:])
+	return err
+}
+
+// Export writes the archive of the history of d from epoch from through
+// epoch to, or through the latest epoch if to is later, to w. It returns
+// the errors of directory.Tree.Snapshot if a snapshot in the range isn't
+// available in full, and any error of w.
+func Export(w io.Writer, d *directory.Tree, from, to merkletree.Epoch) error {
+	if latest := d.LatestSTR().Epoch; to > latest {
+		to = latest
+	}
+	str, delta, err := d.Snapshot(from, true)
+	if err != nil {
+		return err
+	}
+	aw, err := NewWriter(w, NewHeader(d.PublicKey(), str.Policies))
+	if err != nil {
+		return err
+	}
+	for epoch := from; ; epoch++ {
+		if err := aw.WriteSnapshot(&Snapshot{STR: str, Delta: delta}); err != nil {
+			return err
+		}
+		if epoch >= to {
+			return aw.Close()
+		}
+		if str, delta, err = d.Snapshot(epoch+1, false); err != nil {
+			return err
+		}
+	}
+}
+
+// A Reader reads an archive.
+type Reader struct {
+	r         io.Reader
+	header    Header
+	snapshots uint64
+	done      bool
+}
+
+// NewReader reads the header of the archive from r, and returns
+// a Reader for its snapshots. It returns ErrMalformedArchive if r doesn't
+// start with a header, and io.ErrUnexpectedEOF if r ends within it.
+func NewReader(r io.Reader) (*Reader, error) {
+	bs := make([]byte, len(archiveMagic)+1+2*hashed.HashSizeByte+4)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, unexpected(err)
+	}
+	if !bytes.Equal(bs[:len(archiveMagic)], archiveMagic) || bs[len(archiveMagic)] != archiveVersion {
+		return nil, ErrMalformedArchive
+	}
+	ar := &Reader{r: r}
+	bs = bs[len(archiveMagic)+1:]
+	copy(ar.header.SignKey[:], bs)
+	copy(ar.header.VRFKey[:], bs[hashed.HashSizeByte:])
+	ar.header.IndexSize = binary.BigEndian.Uint32(bs[2*hashed.HashSizeByte:])
+	return ar, nil
+}
+
+// Header returns the header of the archive.
+func (ar *Reader) Header() *Header {
+	h := ar.header
+	return &h
+}
+
+// Next returns the next snapshot in the archive, or io.EOF after the
+// last one. It returns ErrMalformedArchive if the snapshot can't be
+// parsed or the archive has fewer or more snapshots than its end says,
+// and io.ErrUnexpectedEOF if the archive ends before its end. The
+// snapshot isn't verified; see Replay.
+func (ar *Reader) Next() (*Snapshot, error) {
+	if ar.done {
+		return nil, io.EOF
+	}
+	var kind [1]byte
+	if _, err := io.ReadFull(ar.r, kind[:]); err != nil {
+		return nil, unexpected(err)
+	}
+	switch kind[0] {
+	case endRecord:
+		var count [8]byte
+		if _, err := io.ReadFull(ar.r, count[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		if binary.BigEndian.Uint64(count[:]) != ar.snapshots {
+			return nil, ErrMalformedArchive
+		}
+		ar.done = true
+		return nil, io.EOF
+	case snapshotRecord:
+	default:
+		return nil, ErrMalformedArchive
+	}
+
+	var l [4]byte
+	if _, err := io.ReadFull(ar.r, l[:]); err != nil {
+		return nil, unexpected(err)
+	}
+	if binary.BigEndian.Uint32(l[:]) > maxSTRSize {
+		return nil, ErrMalformedArchive
+	}
+	bs := make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err := io.ReadFull(ar.r, bs); err != nil {
+		return nil, unexpected(err)
+	}
+	s := &Snapshot{Delta: new(merkletree.Delta)}
+	if err := json.Unmarshal(bs, &s.STR); err != nil || s.STR == nil ||
+		s.STR.SignedTreeRoot == nil || s.STR.Policies == nil {
+		return nil, ErrMalformedArchive
+	}
+	switch _, err := s.Delta.ReadFrom(ar.r); err {
+	case nil:
+	case merkletree.ErrMalformedDelta:
+		return nil, ErrMalformedArchive
+	default:
+		return nil, err
+	}
+	ar.snapshots++
+	return s, nil
+}
+
+// A Replay verifies the snapshots of an archive in order, and rebuilds
+// their trees.
+type Replay struct {
+	header  Header
+	signKey sign.PublicKey
+	tree    *merkletree.MerkleTree
+	str     *directory.SignedTreeRoot
+}
+
+// NewReplay returns a Replay of the archive with the header h of the
+// directory with the public signing key signKey. It returns
+// ErrKeyMismatch if signKey doesn't match h.
+func NewReplay(h *Header, signKey sign.PublicKey) (*Replay, error) {
+	if Fingerprint(signKey) != h.SignKey {
+		return nil, ErrKeyMismatch
+	}
+	tree, err := merkletree.NewMerkleTreeWithIndexSize(int(h.IndexSize))
+	if err != nil {
+		return nil, ErrMalformedArchive
+	}
+	return &Replay{header: *h, signKey: signKey, tree: tree}, nil
+}
+
+// Apply verifies the next snapshot s and rebuilds its tree. s's STR must
+// be signed with the directory's key, and must follow the STR of the
+// previous snapshot in the hash chain, and applying s's Delta to the
+// tree of the previous snapshot must result in the tree s's STR commits
+// to. The first snapshot must have a full Delta, and its policies must
+// have the VRF key in the header.
+//
+// Apply returns protocol.CheckBadSignature for a bad signature,
+// protocol.CheckBadSTR if the STR doesn't follow the previous one or
+// doesn't commit to the rebuilt tree, ErrKeyMismatch if the VRF key
+// doesn't match, and ErrMalformedArchive if the Delta can't be applied.
+// r is only modified if Apply succeeds.
+func (r *Replay) Apply(s *Snapshot) error {
+	str := s.STR
+	if !r.signKey.Verify(str.Bytes(), str.Signature[:]) {
+		return protocol.CheckBadSignature
+	}
+	if r.str == nil {
+		if Fingerprint(str.Policies.VrfPublicKey) != r.header.VRFKey {
+			return ErrKeyMismatch
+		}
+		if !s.Delta.Full {
+			return ErrMalformedArchive
+		}
+	} else if str.Epoch != r.str.Epoch+1 || !str.VerifyHashChain(r.str) {
+		return protocol.CheckBadSTR
+	}
+	tree, err := r.tree.Apply(s.Delta)
+	if err != nil {
+		return ErrMalformedArchive
+	}
+	if !bytes.Equal(tree.Hash(), str.TreeHash[:]) {
+		return protocol.CheckBadSTR
+	}
+	r.tree, r.str = tree, str
+	return nil
+}
+
+// STR returns the STR of the last snapshot applied, or nil if there's
+// none.
+func (r *Replay) STR() *directory.SignedTreeRoot {
+	return r.str
+}
+
+// Tree returns the tree of the last snapshot applied. It must not be
+// modified.
+func (r *Replay) Tree() *merkletree.MerkleTree {
+	return r.tree
+}
+
+// Verify reads the archive from rd and verifies all of its snapshots
+// with a Replay for the directory with the public signing key signKey,
+// which it returns. It returns the errors of NewReader, Reader.Next,
+// NewReplay and Replay.Apply, and ErrMalformedArchive for an archive
+// without snapshots.
+func Verify(rd io.Reader, signKey sign.PublicKey) (*Replay, error) {
+	ar, err := NewReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReplay(ar.Header(), signKey)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		s, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Apply(s); err != nil {
+			return nil, err
+		}
+	}
+	if r.str == nil {
+		return nil, ErrMalformedArchive
+	}
+	return r, nil
+}
+
+func appendUint32(bs []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(bs, b[:]...)
+}
+
+// unexpected turns io.EOF into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// historyTree returns a directory with 6 epochs, in each of which a few
+// names were registered. Unlike directory.NewTestTree, its first
+// snapshot commits to its tree.
+func historyTree(t *testing.T) *directory.Tree {
+	d, err := directory.New(crypto.NewStaticTestVRFKey(), crypto.NewStaticTestSigningKey(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for epoch := 0; epoch < 6; epoch++ {
+		for i := 0; i < 3; i++ {
+			if _, err := d.Register(fmt.Sprintf("user%d-%d", epoch, i), []byte("key")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d.Update()
+	}
+	return d
+}
+
+func export(t *testing.T, d *directory.Tree, from, to merkletree.Epoch) []byte {
+	var buf bytes.Buffer
+	if err := Export(&buf, d, from, to); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportVerify(t *testing.T) {
+	d := historyTree(t)
+	for _, from := range []merkletree.Epoch{0, 3} {
+		r, err := Verify(bytes.NewReader(export(t, d, from, 100)), d.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest := d.LatestSTR()
+		if r.STR().Epoch != latest.Epoch || !bytes.Equal(r.Tree().Hash(), latest.TreeHash[:]) {
+			t.Errorf("Expect the replay of epochs %d- to end with the latest snapshot", from)
+		}
+	}
+
+	ar, err := NewReader(bytes.NewReader(export(t, d, 2, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ar.Header() != *NewHeader(d.PublicKey(), d.LatestSTR().Policies) {
+		t.Error("Unexpected header")
+	}
+	var epochs []merkletree.Epoch
+	for {
+		s, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		epochs = append(epochs, s.STR.Epoch)
+		if full := len(epochs) == 1; s.Delta.Full != full {
+			t.Errorf("Epoch %d: expect Full to be %v", s.STR.Epoch, full)
+		}
+	}
+	if fmt.Sprint(epochs) != "[2 3 4]" {
+		t.Errorf("Expect epochs 2 through 4, got %v", epochs)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	d := historyTree(t)
+	archive := export(t, d, 0, 100)
+	var snapshots []*Snapshot
+	ar, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		s, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	rewrite := func(snapshots ...*Snapshot) []byte {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, ar.Header())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range snapshots {
+			if err := w.WriteSnapshot(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	forged := *snapshots[1].STR.SignedTreeRoot
+	forged.Signature[0]++
+	badSignature := &Snapshot{STR: &directory.SignedTreeRoot{SignedTreeRoot: &forged,
+		Policies: snapshots[1].STR.Policies}, Delta: snapshots[1].Delta}
+	noChanges := &Snapshot{STR: snapshots[2].STR, Delta: &merkletree.Delta{Nonce: snapshots[2].Delta.Nonce}}
+	countless := append([]byte{}, archive...)
+	countless[len(countless)-1]++
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		want    error
+	}{
+		{"truncated", archive[:len(archive)-1], io.ErrUnexpectedEOF},
+		{"no end", archive[:len(archive)-9], io.ErrUnexpectedEOF},
+		{"bad count", countless, ErrMalformedArchive},
+		{"bad magic", append([]byte("x"), archive[1:]...), ErrMalformedArchive},
+		{"empty", rewrite(), ErrMalformedArchive},
+		{"not full", rewrite(snapshots[1:]...), ErrMalformedArchive},
+		{"gap", rewrite(snapshots[0], snapshots[2]), protocol.CheckBadSTR},
+		{"bad signature", rewrite(snapshots[0], badSignature), protocol.CheckBadSignature},
+		{"missing changes", rewrite(snapshots[0], snapshots[1], noChanges), protocol.CheckBadSTR},
+	} {
+		if _, err := Verify(bytes.NewReader(tc.archive), d.PublicKey()); err != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	other, err := sign.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(bytes.NewReader(archive), other.Public()); err != ErrKeyMismatch {
+		t.Errorf("Expect ErrKeyMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// A DirMedium publishes STRs as files in a local directory, one file per
+// epoch named after it, e.g. "42.json". The directory can be served
+// statically, synced to a storage bucket, or be the working tree of
+// a git repository whose changes are committed and pushed separately.
+type DirMedium string
+
+var _ Medium = DirMedium("")
+
+// Name returns "dir:" followed by the path of the directory.
+func (m DirMedium) Name() string {
+	return "dir:" + string(m)
+}
+
+func (m DirMedium) path(epoch merkletree.Epoch) string {
+	return filepath.Join(string(m), epoch.String()+".json")
+}
+
+// Put writes str to the file for epoch, replacing it atomically.
+func (m DirMedium) Put(_ context.Context, epoch merkletree.Epoch, str []byte) error {
+	if err := os.MkdirAll(string(m), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(string(m), epoch.String()+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(str); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path(epoch))
+}
+
+// Get reads the file for epoch.
+func (m DirMedium) Get(_ context.Context, epoch merkletree.Epoch) ([]byte, error) {
+	bs, err := ioutil.ReadFile(m.path(epoch))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return bs, err
+}
+
+// An HTTPMedium publishes STRs to an HTTP server, PUTting the STR of each
+// epoch to BaseURL followed by the epoch, e.g.
+// "https://example.com/strs/42", and GETting it back from there. It
+// works with WebDAV servers and storage buckets that accept PUT requests,
+// authenticated with Header.
+type HTTPMedium struct {
+	// BaseURL is prepended to the epochs; it usually ends with "/".
+	BaseURL string
+	// Header is added to every request, e.g. for an Authorization.
+	Header http.Header
+	// Client makes the requests. If it's nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+var _ Medium = (*HTTPMedium)(nil)
+
+// Name returns the base URL of m.
+func (m *HTTPMedium) Name() string {
+	return m.BaseURL
+}
+
+func (m *HTTPMedium) do(ctx context.Context, method string, epoch merkletree.Epoch, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, m.BaseURL+epoch.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range m.Header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// Put PUTs str to the URL for epoch. Any status other than 2xx is an
+// error.
+func (m *HTTPMedium) Put(ctx context.Context, epoch merkletree.Epoch, str []byte) error {
+	resp, err := m.do(ctx, http.MethodPut, epoch, str)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s%s: %s", m.BaseURL, epoch, resp.Status)
+	}
+	return nil
+}
+
+// Get GETs the STR from the URL for epoch. A 404 status means
+// ErrNotFound.
+func (m *HTTPMedium) Get(ctx context.Context, epoch merkletree.Epoch) ([]byte, error) {
+	resp, err := m.do(ctx, http.MethodGet, epoch, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("GET %s%s: %s", m.BaseURL, epoch, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
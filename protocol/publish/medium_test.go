@@ -0,0 +1,76 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testMedium(t *testing.T, m Medium) {
+	ctx := context.Background()
+	if _, err := m.Get(ctx, 1); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	for _, str := range []string{`{"a":1}`, `{"a":2}`} {
+		// putting again must succeed
+		if err := m.Put(ctx, 1, []byte(str)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := m.Get(ctx, 1)
+	if err != nil || string(got) != `{"a":2}` {
+		t.Fatalf("Expected the latest STR, got %q, %v", got, err)
+	}
+}
+
+func TestDirMedium(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testMedium(t, DirMedium(dir+"/strs"))
+}
+
+func TestHTTPMedium(t *testing.T) {
+	var mu sync.Mutex
+	strs := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			strs[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		case http.MethodGet:
+			str, ok := strs[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(str)
+		}
+	}))
+	defer srv.Close()
+
+	m := &HTTPMedium{BaseURL: srv.URL + "/strs/", Header: http.Header{"Authorization": {"secret"}}}
+	testMedium(t, m)
+	if !bytes.Equal(strs["/strs/1"], []byte(`{"a":2}`)) {
+		t.Errorf("Unexpected stored STRs %q", strs)
+	}
+
+	m.Header = nil
+	if err := m.Put(context.Background(), 2, []byte("{}")); err == nil ||
+		!strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected a 403 error, got %v", err)
+	}
+}
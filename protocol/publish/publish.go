@@ -0,0 +1,274 @@
+// This module implements the publication of a directory's STRs to
+// external mediums, such as storage buckets, git repositories or
+// broadcast networks. Anybody can read the STRs back from the mediums
+// and compare them with what the directory served them, so that to
+// equivocate undetected, the directory would also have to control every
+// medium. A Publisher pushes the STRs with at-least-once semantics,
+// and a Verifier consumes them. Webhooks push them to integrators as
+// they're signed.
+
+package publish
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+// ErrNotFound indicates that a medium has no STR for the requested
+// epoch.
+var ErrNotFound = errors.New("[publish] No STR published for the epoch")
+
+// A Medium is an external channel STRs are published to. STRs are
+// identified by their epoch, and serialized with evidence.MarshalSTR.
+//
+// Mediums that can only append, such as broadcast networks, can be used
+// with a Publisher only, and return ErrNotFound from Get.
+type Medium interface {
+	// Name identifies the medium in errors and logs.
+	Name() string
+	// Put publishes the serialized STR str for epoch. Since STRs are
+	// published at least once, putting the same STR again must succeed.
+	Put(ctx context.Context, epoch merkletree.Epoch, str []byte) error
+	// Get returns the serialized STR published for epoch, or
+	// ErrNotFound.
+	Get(ctx context.Context, epoch merkletree.Epoch) ([]byte, error)
+}
+
+// A ReportMedium is a Medium that publishes the directory's
+// EpochReports along with its STRs, e.g. a Webhook.
+type ReportMedium interface {
+	Medium
+	// PutReport is Put for the STR of report.Epoch, along with report.
+	PutReport(ctx context.Context, report *directory.EpochReport, str []byte) error
+}
+
+// A PublishError is a failure to publish an STR to a medium.
+type PublishError struct {
+	Medium string
+	Epoch  merkletree.Epoch
+	Err    error
+}
+
+func (e *PublishError) Error() string {
+	return "[publish] Publishing the STR for epoch " + e.Epoch.String() + " to " + e.Medium +
+		" failed: " + e.Err.Error()
+}
+
+func (e *PublishError) Unwrap() error { return e.Err }
+
+// Default values of Publisher's retry backoff.
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 5 * time.Minute
+)
+
+// A Publisher publishes STRs to mediums with at-least-once semantics:
+// every STR stays queued for a medium until the medium accepts it, and
+// each medium receives the STRs in the order of their epochs. Run
+// retries failed publications with exponential backoff.
+//
+// A Publisher is a directory.ReportPublisher, so a directory opened
+// WithPublisher queues its STRs as it signs them, and their EpochReports
+// for the ReportMediums. Since the queues are
+// kept in memory, STRs queued when the program exits are lost; after
+// a restart, use Backfill to publish the STRs the mediums missed.
+// A Publisher is safe for concurrent use.
+type Publisher struct {
+	// MinBackoff and MaxBackoff bound the time Run waits before retrying
+	// a failed publication. Zero values mean the defaults.
+	MinBackoff, MaxBackoff time.Duration
+	// OnError, if not nil, is called with every failed publication,
+	// including those of the STRs PublishSTR and PublishReport couldn't
+	// serialize, which are dropped.
+	OnError func(err *PublishError)
+
+	mediums []Medium
+	flushMu sync.Mutex // held by Flush, so that queued STRs are removed once
+	mu      sync.Mutex
+	queues  [][]queued
+	wake    chan struct{}
+}
+
+type queued struct {
+	epoch merkletree.Epoch
+	str   []byte
+	// report is the EpochReport of the STR, if the directory passed it
+	report *directory.EpochReport
+}
+
+var _ directory.ReportPublisher = (*Publisher)(nil)
+
+// NewPublisher returns a Publisher that publishes STRs to mediums.
+func NewPublisher(mediums ...Medium) *Publisher {
+	return &Publisher{
+		mediums: mediums,
+		queues:  make([][]queued, len(mediums)),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// PublishSTR queues str for publication to every medium. It implements
+// directory.Publisher, and doesn't block.
+func (p *Publisher) PublishSTR(str *directory.SignedTreeRoot) {
+	p.publish(str, nil)
+}
+
+// PublishReport queues report.STR for publication to every medium, along
+// with report for the ReportMediums. It implements
+// directory.ReportPublisher, and doesn't block.
+func (p *Publisher) PublishReport(report *directory.EpochReport) {
+	p.publish(report.STR, report)
+}
+
+func (p *Publisher) publish(str *directory.SignedTreeRoot, report *directory.EpochReport) {
+	bs, err := evidence.MarshalSTR(str)
+	if err != nil {
+		p.fail(str.Epoch, err)
+		return
+	}
+	p.mu.Lock()
+	for i := range p.queues {
+		p.queues[i] = append(p.queues[i], queued{str.Epoch, bs, report})
+	}
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fail reports to OnError that the STR for epoch can't be published to
+// any medium because of err.
+func (p *Publisher) fail(epoch merkletree.Epoch, err error) {
+	if p.OnError == nil {
+		return
+	}
+	for _, m := range p.mediums {
+		p.OnError(&PublishError{Medium: m.Name(), Epoch: epoch, Err: err})
+	}
+}
+
+// Backfill queues the STRs in strs that the mediums don't have yet for
+// publication, e.g. the directory's history after a restart. Mediums
+// whose Get fails get all of strs again. If an STR can't be serialized,
+// Backfill returns the error, and neither it nor the STRs after it are
+// queued, so that the mediums never have gaps.
+func (p *Publisher) Backfill(ctx context.Context, strs []*directory.SignedTreeRoot) error {
+	for _, str := range strs {
+		bs, err := evidence.MarshalSTR(str)
+		if err != nil {
+			return err
+		}
+		for i, m := range p.mediums {
+			if _, err := m.Get(ctx, str.Epoch); err == nil {
+				continue
+			}
+			p.mu.Lock()
+			p.queues[i] = append(p.queues[i], queued{str.Epoch, bs, nil})
+			p.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// Pending returns the number of STRs that are queued for publication,
+// counted once per medium.
+func (p *Publisher) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, q := range p.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// Flush tries to publish every queued STR once. A medium that fails
+// keeps its STRs queued from the one that failed on, so that it never
+// has gaps. Flush returns the first error, which is a *PublishError,
+// or ctx.Err() if ctx is done.
+func (p *Publisher) Flush(ctx context.Context) error {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+	var first error
+	for i, m := range p.mediums {
+		if err := p.flush(ctx, i, m); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (p *Publisher) flush(ctx context.Context, i int, m Medium) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		if len(p.queues[i]) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		q := p.queues[i][0]
+		p.mu.Unlock()
+
+		var err error
+		if rm, ok := m.(ReportMedium); ok && q.report != nil {
+			err = rm.PutReport(ctx, q.report, q.str)
+		} else {
+			err = m.Put(ctx, q.epoch, q.str)
+		}
+		if err != nil {
+			perr := &PublishError{Medium: m.Name(), Epoch: q.epoch, Err: err}
+			if p.OnError != nil {
+				p.OnError(perr)
+			}
+			return perr
+		}
+		p.mu.Lock()
+		p.queues[i] = p.queues[i][1:]
+		p.mu.Unlock()
+	}
+}
+
+// Run publishes the queued STRs as they're queued, until ctx is done,
+// and then returns ctx.Err(). Failed publications are retried after
+// a backoff that doubles with every consecutive failure.
+func (p *Publisher) Run(ctx context.Context) error {
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = DefaultMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	backoff := time.Duration(0)
+	for {
+		var retry *time.Timer
+		if err := p.Flush(ctx); err != nil && ctx.Err() == nil {
+			if backoff *= 2; backoff < min {
+				backoff = min
+			} else if backoff > max {
+				backoff = max
+			}
+			retry = time.NewTimer(backoff)
+		} else {
+			backoff = 0
+			retry = time.NewTimer(max)
+		}
+		select {
+		case <-ctx.Done():
+			retry.Stop()
+			return ctx.Err()
+		case <-p.wake:
+			retry.Stop()
+		case <-retry.C:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+var errUnavailable = errors.New("unavailable")
+
+// memMedium keeps published STRs in memory. Its next fail Puts fail.
+type memMedium struct {
+	mu   sync.Mutex
+	strs map[merkletree.Epoch][]byte
+	puts []merkletree.Epoch
+	fail int
+}
+
+func newMemMedium() *memMedium {
+	return &memMedium{strs: make(map[merkletree.Epoch][]byte)}
+}
+
+func (m *memMedium) Name() string { return "mem" }
+
+func (m *memMedium) Put(_ context.Context, epoch merkletree.Epoch, str []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail > 0 {
+		m.fail--
+		return errUnavailable
+	}
+	m.strs[epoch] = str
+	m.puts = append(m.puts, epoch)
+	return nil
+}
+
+func (m *memMedium) Get(_ context.Context, epoch merkletree.Epoch) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if str, ok := m.strs[epoch]; ok {
+		return str, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memMedium) published() []merkletree.Epoch {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]merkletree.Epoch(nil), m.puts...)
+}
+
+func openPublishing(t *testing.T, p *Publisher) *directory.Tree {
+	d, err := directory.Open(
+		directory.WithSigningKey(crypto.NewStaticTestSigningKey()),
+		directory.WithVRFKey(crypto.NewStaticTestVRFKey()),
+		directory.WithPublisher(p),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func equalEpochs(a, b []merkletree.Epoch) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPublisherFlush(t *testing.T) {
+	ok, flaky := newMemMedium(), newMemMedium()
+	flaky.fail = 1
+	p := NewPublisher(ok, flaky)
+	var errs []*PublishError
+	p.OnError = func(err *PublishError) { errs = append(errs, err) }
+	d := openPublishing(t, p)
+	d.Update()
+	d.Update()
+	if p.Pending() != 4 {
+		t.Fatalf("Expected 4 pending STRs, got %d", p.Pending())
+	}
+
+	err := p.Flush(context.Background())
+	var perr *PublishError
+	if !errors.As(err, &perr) || perr.Epoch != 1 || !errors.Is(err, errUnavailable) {
+		t.Fatalf("Expected a PublishError for epoch 1, got %v", err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("Expected OnError to be called once, got %d", len(errs))
+	}
+	// the flaky medium keeps both STRs, so that it gets them in order
+	if p.Pending() != 2 || !equalEpochs(ok.published(), []merkletree.Epoch{1, 2}) {
+		t.Fatalf("Unexpected state after a failure: %d pending, %v published", p.Pending(), ok.published())
+	}
+
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p.Pending() != 0 || !equalEpochs(flaky.published(), []merkletree.Epoch{1, 2}) {
+		t.Fatalf("Unexpected state after a retry: %d pending, %v published", p.Pending(), flaky.published())
+	}
+}
+
+func TestPublisherRun(t *testing.T) {
+	m := newMemMedium()
+	m.fail = 2
+	p := NewPublisher(m)
+	p.MinBackoff = time.Millisecond
+	d := openPublishing(t, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	d.Update()
+	d.Update()
+	deadline := time.Now().Add(time.Second)
+	for !equalEpochs(m.published(), []merkletree.Epoch{1, 2}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("STRs weren't published, got %v", m.published())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected Run to return context.Canceled, got %v", err)
+	}
+}
+
+func TestPublisherBackfill(t *testing.T) {
+	d := directory.NewTestTree(t)
+	var strs []*directory.SignedTreeRoot
+	for i := 0; i < 3; i++ {
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+	m := newMemMedium()
+	p := NewPublisher(m)
+	p.PublishSTR(strs[0])
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Backfill(context.Background(), strs); err != nil {
+		t.Fatal(err)
+	}
+	if p.Pending() != 2 {
+		t.Fatalf("Expected 2 STRs to be backfilled, got %d", p.Pending())
+	}
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !equalEpochs(m.published(), []merkletree.Epoch{1, 2, 3}) {
+		t.Errorf("Unexpected published epochs %v", m.published())
+	}
+}
+
+func TestPublisherUnserializableSTR(t *testing.T) {
+	d := directory.NewTestTree(t)
+	d.Update()
+	d.Update()
+	good := d.LatestSTR()
+	// policies that can't be encoded
+	policies := *good.Policies
+	policies.Stats = &directory.ActivityStats{Epsilon: math.NaN()}
+	bad := &directory.SignedTreeRoot{SignedTreeRoot: good.SignedTreeRoot, Policies: &policies}
+
+	m := newMemMedium()
+	p := NewPublisher(m)
+	var errs []*PublishError
+	p.OnError = func(err *PublishError) { errs = append(errs, err) }
+	p.PublishSTR(bad)
+	if p.Pending() != 0 || len(errs) != 1 || errs[0].Epoch != bad.Epoch {
+		t.Fatalf("Expected the STR to be dropped and reported, got %d pending, errors %v", p.Pending(), errs)
+	}
+
+	if err := p.Backfill(context.Background(), []*directory.SignedTreeRoot{bad, good}); err == nil {
+		t.Error("Expected Backfill to fail")
+	}
+	if p.Pending() != 0 {
+		t.Errorf("Expected no STR after the bad one to be backfilled, got %d", p.Pending())
+	}
+}
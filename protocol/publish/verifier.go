@@ -0,0 +1,111 @@
+package publish
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ORBAT/cloniks/crypto/sign"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+// ErrNotPublished indicates that no medium has published an STR.
+var ErrNotPublished = errors.New("[publish] The STR isn't published on any medium")
+
+// A MismatchError proves that a directory equivocated: a medium
+// published an STR signed by the directory that differs from the one it
+// was compared with.
+type MismatchError struct {
+	Medium string
+	*evidence.Equivocation
+}
+
+func (e *MismatchError) Error() string {
+	return "[publish] " + e.Medium + " published a different STR for epoch " + e.Epoch.String()
+}
+
+// A Verifier consumes the STRs published to mediums by the directory
+// with the public signing key SignKey.
+type Verifier struct {
+	SignKey sign.PublicKey
+	Mediums []Medium
+}
+
+// Fetch returns the STR published to m for epoch. It returns
+// ErrNotFound if m has none, evidence.ErrMalformedSTR or
+// evidence.ErrEpochMismatch if the published STR is malformed or for
+// another epoch, and evidence.ErrBadSignature if it isn't signed with
+// v.SignKey.
+func (v *Verifier) Fetch(ctx context.Context, m Medium, epoch merkletree.Epoch) (*directory.SignedTreeRoot, error) {
+	bs, err := m.Get(ctx, epoch)
+	if err != nil {
+		return nil, err
+	}
+	str, err := evidence.UnmarshalSTR(bs)
+	if err != nil {
+		return nil, err
+	}
+	if str.Epoch != epoch {
+		return nil, evidence.ErrEpochMismatch
+	}
+	if !v.SignKey.Verify(str.Bytes(), str.Signature[:]) {
+		return nil, evidence.ErrBadSignature
+	}
+	return str, nil
+}
+
+// Check compares str, e.g. an STR the directory served, with the STRs
+// the mediums published for its epoch, and returns the number of
+// mediums that published str.
+//
+// Check returns evidence.ErrBadSignature if str isn't signed with
+// v.SignKey, a *MismatchError if a medium published a different validly
+// signed STR for the epoch, and ErrNotPublished if no medium published
+// str. Mediums that fail, or publish STRs that aren't validly signed,
+// prove nothing about the directory, and are ignored.
+func (v *Verifier) Check(ctx context.Context, str *directory.SignedTreeRoot) (int, error) {
+	if !v.SignKey.Verify(str.Bytes(), str.Signature[:]) {
+		return 0, evidence.ErrBadSignature
+	}
+	mine, err := evidence.MarshalSTR(str)
+	if err != nil {
+		return 0, evidence.ErrMalformedSTR
+	}
+	n := 0
+	for _, m := range v.Mediums {
+		theirs, err := m.Get(ctx, str.Epoch)
+		if err != nil {
+			continue
+		}
+		eq, err := evidence.VerifyEquivocation(v.SignKey, mine, theirs)
+		switch err {
+		case nil:
+			return n, &MismatchError{Medium: m.Name(), Equivocation: eq}
+		case evidence.ErrNoEquivocation:
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, ErrNotPublished
+	}
+	return n, nil
+}
+
+// VerifyRange fetches the STRs for the epochs from start to end,
+// inclusive, from m, and checks that they form a hash chain. It returns
+// the STRs, the first error of Fetch, or evidence.ErrBrokenChain.
+func (v *Verifier) VerifyRange(ctx context.Context, m Medium, start, end merkletree.Epoch) ([]*directory.SignedTreeRoot, error) {
+	var strs []*directory.SignedTreeRoot
+	for epoch := start; epoch <= end; epoch++ {
+		str, err := v.Fetch(ctx, m, epoch)
+		if err != nil {
+			return nil, err
+		}
+		if len(strs) > 0 && !str.VerifyHashChain(strs[len(strs)-1]) {
+			return nil, evidence.ErrBrokenChain
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
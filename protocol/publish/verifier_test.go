@@ -0,0 +1,85 @@
+package publish
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+// published returns a directory's STRs up to epoch numEpochs, and
+// a medium they were published to.
+func published(t *testing.T, numEpochs int) ([]*directory.SignedTreeRoot, *memMedium) {
+	m := newMemMedium()
+	p := NewPublisher(m)
+	d := openPublishing(t, p)
+	strs := []*directory.SignedTreeRoot{d.LatestSTR()}
+	p.PublishSTR(d.LatestSTR())
+	for i := 0; i < numEpochs; i++ {
+		d.Update()
+		strs = append(strs, d.LatestSTR())
+	}
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return strs, m
+}
+
+func TestVerifierCheck(t *testing.T) {
+	strs, m := published(t, 2)
+	empty := newMemMedium()
+	v := &Verifier{SignKey: crypto.NewStaticTestSigningKey().Public(), Mediums: []Medium{m, empty}}
+	ctx := context.Background()
+
+	if n, err := v.Check(ctx, strs[2]); err != nil || n != 1 {
+		t.Fatalf("Expected the STR to be published once, got %d, %v", n, err)
+	}
+	v.Mediums = []Medium{empty}
+	if _, err := v.Check(ctx, strs[2]); err != ErrNotPublished {
+		t.Fatalf("Expected ErrNotPublished, got %v", err)
+	}
+
+	// a directory with the same keys but another history
+	forked, _ := published(t, 2)
+	v.Mediums = []Medium{m}
+	_, err := v.Check(ctx, forked[2])
+	var merr *MismatchError
+	if !errors.As(err, &merr) || merr.Epoch != 2 || merr.Medium != "mem" {
+		t.Fatalf("Expected a MismatchError, got %v", err)
+	}
+
+	forged := *strs[2].SignedTreeRoot
+	forged.TreeHash = forked[2].TreeHash
+	if _, err := v.Check(ctx, &directory.SignedTreeRoot{SignedTreeRoot: &forged,
+		Policies: strs[2].Policies}); err != evidence.ErrBadSignature {
+		t.Fatalf("Expected evidence.ErrBadSignature, got %v", err)
+	}
+}
+
+func TestVerifierVerifyRange(t *testing.T) {
+	strs, m := published(t, 3)
+	v := &Verifier{SignKey: crypto.NewStaticTestSigningKey().Public(), Mediums: []Medium{m}}
+	ctx := context.Background()
+
+	got, err := v.VerifyRange(ctx, m, 0, 3)
+	if err != nil || len(got) != 4 || got[3].Signature != strs[3].Signature {
+		t.Fatalf("Unexpected range %v, %v", got, err)
+	}
+	if _, err := v.VerifyRange(ctx, m, 2, 4); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	forked, _ := published(t, 3)
+	bs, _ := evidence.MarshalSTR(forked[2])
+	m.strs[2] = bs
+	if _, err := v.VerifyRange(ctx, m, 0, 3); err != evidence.ErrBrokenChain {
+		t.Errorf("Expected evidence.ErrBrokenChain, got %v", err)
+	}
+	m.strs[2] = m.strs[1]
+	if _, err := v.Fetch(ctx, m, 2); err != evidence.ErrEpochMismatch {
+		t.Errorf("Expected evidence.ErrEpochMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+)
+
+// The headers of the requests a Webhook sends.
+const (
+	// SignatureHeader has "sha256=" followed by the hex-encoded
+	// HMAC-SHA256 of the body, keyed with the Webhook's Secret.
+	SignatureHeader = "X-Coniks-Signature"
+	// EpochHeader has the epoch of the event.
+	EpochHeader = "X-Coniks-Epoch"
+)
+
+// ErrBadWebhookSignature indicates that the body of a webhook request
+// isn't signed with the expected secret.
+var ErrBadWebhookSignature = errors.New("[publish] Invalid webhook signature")
+
+// A WebhookEvent is the JSON body a Webhook POSTs for every STR.
+type WebhookEvent struct {
+	Epoch merkletree.Epoch
+	// STR is the STR of Epoch, serialized with evidence.MarshalSTR.
+	STR json.RawMessage
+	// Report describes the snapshot of Epoch, if the Webhook sends
+	// reports and the directory passed it.
+	Report *WebhookReport `json:",omitempty"`
+}
+
+// A WebhookReport is a directory.EpochReport without its epoch and STR,
+// which the WebhookEvent has.
+type WebhookReport struct {
+	FulfilledTBs   int
+	Insertions     uint64
+	Duration       time.Duration
+	Hash           merkletree.HashStats
+	PromiseLatency directory.PromiseLatency
+}
+
+// A Webhook is a ReportMedium that POSTs a WebhookEvent for every STR to
+// the URL of an integrator, e.g. a dashboard or an external log, so that
+// it can react to new epochs without polling the directory. Its
+// Publisher retries failed requests, and any status other than 2xx is
+// a failure. Since STRs are published at least once, the receiver may
+// get an epoch more than once, and should deduplicate the events by
+// epoch.
+//
+// A Webhook can only push, so Get returns ErrNotFound, and
+// Publisher.Backfill sends it every STR again.
+type Webhook struct {
+	URL string
+	// Secret is the key the bodies are signed with in SignatureHeader.
+	// If it's empty, the requests aren't signed.
+	Secret []byte
+	// Reports makes the events include the directory's EpochReports.
+	Reports bool
+	// Header is added to every request, e.g. for an Authorization.
+	Header http.Header
+	// Client makes the requests. If it's nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+var _ ReportMedium = (*Webhook)(nil)
+
+// Name returns "webhook:" followed by the URL of w.
+func (w *Webhook) Name() string {
+	return "webhook:" + w.URL
+}
+
+// Put POSTs the event for the STR str of epoch.
+func (w *Webhook) Put(ctx context.Context, epoch merkletree.Epoch, str []byte) error {
+	return w.post(ctx, &WebhookEvent{Epoch: epoch, STR: str})
+}
+
+// PutReport POSTs the event for the STR str of report.Epoch, including
+// report if w sends reports.
+func (w *Webhook) PutReport(ctx context.Context, report *directory.EpochReport, str []byte) error {
+	ev := &WebhookEvent{Epoch: report.Epoch, STR: str}
+	if w.Reports {
+		ev.Report = &WebhookReport{
+			FulfilledTBs:   report.FulfilledTBs,
+			Insertions:     report.Insertions,
+			Duration:       report.Duration,
+			Hash:           report.Hash,
+			PromiseLatency: report.PromiseLatency,
+		}
+	}
+	return w.post(ctx, ev)
+}
+
+// Get returns ErrNotFound, since webhooks can't be read back.
+func (w *Webhook) Get(context.Context, merkletree.Epoch) ([]byte, error) {
+	return nil, ErrNotFound
+}
+
+func (w *Webhook) post(ctx context.Context, ev *WebhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range w.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EpochHeader, ev.Epoch.String())
+	if len(w.Secret) > 0 {
+		req.Header.Set(SignatureHeader, webhookSignature(w.Secret, body))
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature returns the value of SignatureHeader for body.
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReadWebhook reads the WebhookEvent a Webhook with the secret secret
+// sent in r, for receivers of webhooks. It returns
+// ErrBadWebhookSignature if the body isn't signed with secret. The STR of
+// the event still has to be verified, e.g. with evidence.UnmarshalSTR
+// and the directory's public key.
+func ReadWebhook(r *http.Request, secret []byte) (*WebhookEvent, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(webhookSignature(secret, body))) {
+		return nil, ErrBadWebhookSignature
+	}
+	var ev WebhookEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
@@ -0,0 +1,98 @@
+package publish
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ORBAT/cloniks/crypto"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol/evidence"
+)
+
+var webhookSecret = []byte("webhook secret")
+
+// webhookReceiver records the events a Webhook sends to it. Its next
+// fail requests fail.
+type webhookReceiver struct {
+	mu     sync.Mutex
+	events []*WebhookEvent
+	fail   int
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.fail > 0 {
+		rcv.fail--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	ev, err := ReadWebhook(r, webhookSecret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get(EpochHeader) != ev.Epoch.String() {
+		http.Error(w, "wrong epoch header", http.StatusBadRequest)
+		return
+	}
+	rcv.events = append(rcv.events, ev)
+}
+
+func TestWebhook(t *testing.T) {
+	rcv := &webhookReceiver{fail: 1}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	withReports := &Webhook{URL: srv.URL, Secret: webhookSecret, Reports: true}
+	wrongSecret := &Webhook{URL: srv.URL, Secret: []byte("wrong")}
+	mem := newMemMedium()
+	p := NewPublisher(withReports, mem)
+	d := openPublishing(t, p)
+	d.Update()
+	d.Update()
+
+	ctx := context.Background()
+	if err := p.Flush(ctx); err == nil {
+		t.Fatal("Expect the failing webhook to fail")
+	}
+	if !equalEpochs(mem.published(), []merkletree.Epoch{1, 2}) {
+		t.Error("Expect the other medium to receive the STRs, got", mem.published())
+	}
+	if err := p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(rcv.events) != 2 {
+		t.Fatal("Expect an event for each epoch, got", len(rcv.events))
+	}
+	for i, ev := range rcv.events {
+		if ev.Epoch != merkletree.Epoch(i+1) || ev.Report == nil {
+			t.Fatal("Expect the report of epoch", i+1, "got", ev)
+		}
+		str, err := evidence.UnmarshalSTR(ev.STR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str.Epoch != ev.Epoch ||
+			!crypto.NewStaticTestSigningKey().Public().Verify(str.Bytes(), str.Signature[:]) {
+			t.Error("Expect the signed STR of epoch", ev.Epoch)
+		}
+	}
+
+	// backfilled STRs have no report
+	if err := withReports.Put(ctx, 3, rcv.events[0].STR); err != nil {
+		t.Fatal(err)
+	}
+	if ev := rcv.events[2]; ev.Report != nil {
+		t.Error("Expect no report, got", ev.Report)
+	}
+	if err := wrongSecret.Put(ctx, 1, rcv.events[0].STR); err == nil {
+		t.Error("Expect the receiver to reject a payload with the wrong signature")
+	}
+	if _, err := withReports.Get(ctx, 1); err != ErrNotFound {
+		t.Error("Expect", ErrNotFound, "got", err)
+	}
+}
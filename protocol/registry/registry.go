@@ -0,0 +1,193 @@
+// This module implements a registry of the constants of the CONIKS
+// protocols: the types of requests, the error codes, the results of
+// the consistency checks, and the types of proofs. Each constant has
+// a stable numeric ID, the value it's sent with on the wire, and a name,
+// e.g. "KeyLookup" for directory.KeyLookupType, so that logs, metrics
+// and serialized test vectors name the constants consistently.
+//
+// IDs are never reused or renumbered; a new constant is added to the
+// table of its kind with the next free ID.
+
+package registry
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// ErrUnknownName indicates that a name isn't registered for a kind of
+// constant.
+var ErrUnknownName = errors.New("[registry] Unknown name")
+
+// A Kind is a kind of protocol constant.
+type Kind int
+
+// The kinds of protocol constants.
+const (
+	// MessageType is the kind of the request types, e.g.
+	// directory.KeyLookupType.
+	MessageType Kind = iota
+	// ErrorCode is the kind of the protocol.ErrorCodes that report the
+	// result of a request, e.g. protocol.ReqSuccess.
+	ErrorCode
+	// CheckResult is the kind of the protocol.ErrorCodes that report
+	// a failed consistency check, e.g. protocol.CheckBadSTR.
+	CheckResult
+	// ProofType is the kind of the merkletree.ProofTypes.
+	ProofType
+)
+
+func (k Kind) String() string {
+	switch k {
+	case MessageType:
+		return "MessageType"
+	case ErrorCode:
+		return "ErrorCode"
+	case CheckResult:
+		return "CheckResult"
+	case ProofType:
+		return "ProofType"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// A Constant is a registered protocol constant.
+type Constant struct {
+	Kind Kind
+	ID   int
+	Name string
+}
+
+// constants holds the constants of every Kind, in the order of their
+// IDs.
+var constants = map[Kind][]Constant{
+	MessageType: {
+		{MessageType, directory.RegistrationType, "Registration"},
+		{MessageType, directory.KeyLookupType, "KeyLookup"},
+		{MessageType, directory.KeyLookupInEpochType, "KeyLookupInEpoch"},
+		{MessageType, directory.MonitoringType, "Monitoring"},
+		{MessageType, directory.AuditType, "Audit"},
+		{MessageType, directory.STRType, "STR"},
+		{MessageType, directory.BindingUnchangedType, "BindingUnchanged"},
+		{MessageType, directory.STRSkipType, "STRSkip"},
+		{MessageType, directory.RollupType, "Rollup"},
+		{MessageType, directory.TranscriptType, "Transcript"},
+		{MessageType, directory.TransitionType, "Transition"},
+		{MessageType, directory.RevocationType, "Revocation"},
+		{MessageType, directory.DeletionType, "Deletion"},
+		{MessageType, directory.ReattestationType, "Reattestation"},
+		{MessageType, directory.ProposalType, "Proposal"},
+		{MessageType, directory.ApprovalType, "Approval"},
+		{MessageType, directory.OpeningType, "Opening"},
+	},
+	ErrorCode: {
+		{ErrorCode, int(protocol.ReqSuccess), "ReqSuccess"},
+		{ErrorCode, int(protocol.ReqNameExisted), "ReqNameExisted"},
+		{ErrorCode, int(protocol.ReqNameNotFound), "ReqNameNotFound"},
+		{ErrorCode, int(protocol.ReqUnknownDirectory), "ReqUnknownDirectory"},
+		{ErrorCode, int(protocol.ErrDirectory), "ErrDirectory"},
+		{ErrorCode, int(protocol.ErrAuditLog), "ErrAuditLog"},
+		{ErrorCode, int(protocol.ErrMalformedMessage), "ErrMalformedMessage"},
+		{ErrorCode, int(protocol.ReqEpochPruned), "ReqEpochPruned"},
+		{ErrorCode, int(protocol.ReqRejected), "ReqRejected"},
+	},
+	CheckResult: {
+		{CheckResult, int(protocol.CheckBadSignature), "CheckBadSignature"},
+		{CheckResult, int(protocol.CheckBadVRFProof), "CheckBadVRFProof"},
+		{CheckResult, int(protocol.CheckBindingsDiffer), "CheckBindingsDiffer"},
+		{CheckResult, int(protocol.CheckBadCommitment), "CheckBadCommitment"},
+		{CheckResult, int(protocol.CheckBadLookupIndex), "CheckBadLookupIndex"},
+		{CheckResult, int(protocol.CheckBadAuthPath), "CheckBadAuthPath"},
+		{CheckResult, int(protocol.CheckBadSTR), "CheckBadSTR"},
+		{CheckResult, int(protocol.CheckBadPromise), "CheckBadPromise"},
+		{CheckResult, int(protocol.CheckBrokenPromise), "CheckBrokenPromise"},
+		{CheckResult, int(protocol.CheckBadTreeDepth), "CheckBadTreeDepth"},
+		{CheckResult, int(protocol.CheckSuspiciousTreeShape), "CheckSuspiciousTreeShape"},
+		{CheckResult, int(protocol.CheckEarlyKeyChange), "CheckEarlyKeyChange"},
+		{CheckResult, int(protocol.CheckCapabilityDowngrade), "CheckCapabilityDowngrade"},
+		{CheckResult, int(protocol.CheckEarlyReregistration), "CheckEarlyReregistration"},
+		{CheckResult, int(protocol.CheckBadUpgrade), "CheckBadUpgrade"},
+		{CheckResult, int(protocol.CheckBadBindingEpochs), "CheckBadBindingEpochs"},
+		{CheckResult, int(protocol.CheckBadPolicySchedule), "CheckBadPolicySchedule"},
+		{CheckResult, int(protocol.CheckBadApproval), "CheckBadApproval"},
+		{CheckResult, int(protocol.CheckBadKeyRotation), "CheckBadKeyRotation"},
+	},
+	ProofType: {
+		{ProofType, int(merkletree.ProofOfInclusion), merkletree.ProofOfInclusion.String()},
+		{ProofType, int(merkletree.ProofOfAbsenceEmpty), merkletree.ProofOfAbsenceEmpty.String()},
+		{ProofType, int(merkletree.ProofOfAbsenceConflict), merkletree.ProofOfAbsenceConflict.String()},
+	},
+}
+
+// Constants returns the registered constants of kind, in the order of
+// their IDs.
+func Constants(kind Kind) []Constant {
+	return append([]Constant(nil), constants[kind]...)
+}
+
+// Name returns the name of the constant of kind with the ID id, or
+// "Kind(id)", e.g. "MessageType(42)", if there is none.
+func Name(kind Kind, id int) string {
+	for _, c := range constants[kind] {
+		if c.ID == id {
+			return c.Name
+		}
+	}
+	return fmt.Sprintf("%s(%d)", kind, id)
+}
+
+// Parse returns the ID of the constant of kind named name. It returns
+// an ErrUnknownName if there is none.
+func Parse(kind Kind, name string) (int, error) {
+	for _, c := range constants[kind] {
+		if c.Name == name {
+			return c.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s %q", ErrUnknownName, kind, name)
+}
+
+// MessageTypeName returns the name of the request type t, e.g.
+// "KeyLookup" for directory.KeyLookupType.
+func MessageTypeName(t int) string {
+	return Name(MessageType, t)
+}
+
+// ParseMessageType returns the request type named name, or an
+// ErrUnknownName.
+func ParseMessageType(name string) (int, error) {
+	return Parse(MessageType, name)
+}
+
+// ErrorCodeName returns the name of the error code e, e.g. "ReqSuccess"
+// or "CheckBadSTR", whether it's an ErrorCode or a CheckResult.
+func ErrorCodeName(e protocol.ErrorCode) string {
+	if e >= protocol.CheckBadSignature {
+		return Name(CheckResult, int(e))
+	}
+	return Name(ErrorCode, int(e))
+}
+
+// ParseErrorCode returns the error code named name, whether it's an
+// ErrorCode or a CheckResult, or an ErrUnknownName.
+func ParseErrorCode(name string) (protocol.ErrorCode, error) {
+	if id, err := Parse(ErrorCode, name); err == nil {
+		return protocol.ErrorCode(id), nil
+	}
+	if id, err := Parse(CheckResult, name); err == nil {
+		return protocol.ErrorCode(id), nil
+	}
+	return 0, fmt.Errorf("%w: error code %q", ErrUnknownName, name)
+}
+
+// ParseProofType returns the proof type named name, as named by
+// merkletree.ProofType.String(), or an ErrUnknownName.
+func ParseProofType(name string) (merkletree.ProofType, error) {
+	id, err := Parse(ProofType, name)
+	return merkletree.ProofType(id), err
+}
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ORBAT/cloniks/directory"
+	"github.com/ORBAT/cloniks/merkletree"
+	"github.com/ORBAT/cloniks/protocol"
+)
+
+// TestStableIDs pins the IDs constants are sent with on the wire.
+func TestStableIDs(t *testing.T) {
+	for _, tc := range []struct {
+		kind Kind
+		name string
+		id   int
+	}{
+		{MessageType, "Registration", 0},
+		{MessageType, "KeyLookup", 1},
+		{MessageType, "STR", 5},
+		{MessageType, "Opening", 16},
+		{ErrorCode, "ReqSuccess", 100},
+		{ErrorCode, "ErrMalformedMessage", 106},
+		{ErrorCode, "ReqRejected", 108},
+		{CheckResult, "CheckBadSignature", 200},
+		{CheckResult, "CheckBadSTR", 206},
+		{CheckResult, "CheckBadApproval", 217},
+		{CheckResult, "CheckBadKeyRotation", 218},
+		{ProofType, "ProofOfInclusion", 1},
+		{ProofType, "ProofOfAbsenceConflict", 3},
+	} {
+		if id, err := Parse(tc.kind, tc.name); err != nil || id != tc.id {
+			t.Error("Expect", tc.name, "to be", tc.id, "got", id, err)
+		}
+	}
+}
+
+func TestConstants(t *testing.T) {
+	names := make(map[string]bool)
+	for _, kind := range []Kind{MessageType, ErrorCode, CheckResult, ProofType} {
+		cs := Constants(kind)
+		if len(cs) == 0 {
+			t.Fatal("Expect constants of kind", kind)
+		}
+		for i, c := range cs {
+			if c.Kind != kind {
+				t.Error("Expect", c.Name, "to be of kind", kind, "got", c.Kind)
+			}
+			if i > 0 && c.ID <= cs[i-1].ID {
+				t.Error("Expect the IDs of", kind, "to be ordered, got", c.ID, "after", cs[i-1].ID)
+			}
+			if Name(kind, c.ID) != c.Name {
+				t.Error("Expect", c.Name, "got", Name(kind, c.ID))
+			}
+			if kind != MessageType && names[c.Name] {
+				t.Error("Expect", c.Name, "to be registered once")
+			}
+			names[c.Name] = true
+		}
+	}
+}
+
+func TestCompleteness(t *testing.T) {
+	for typ := directory.RegistrationType; typ <= directory.OpeningType; typ++ {
+		name := MessageTypeName(typ)
+		if parsed, err := ParseMessageType(name); err != nil || parsed != typ {
+			t.Error("Expect request type", typ, "to be registered, got", name)
+		}
+	}
+	for e := protocol.ErrorCode(0); e < 300; e++ {
+		if e.Error() == "" {
+			continue
+		}
+		name := ErrorCodeName(e)
+		if parsed, err := ParseErrorCode(name); err != nil || parsed != e {
+			t.Error("Expect error code", int(e), "to be registered, got", name)
+		}
+	}
+	for _, pt := range []merkletree.ProofType{merkletree.ProofOfInclusion,
+		merkletree.ProofOfAbsenceEmpty, merkletree.ProofOfAbsenceConflict} {
+		if parsed, err := ParseProofType(pt.String()); err != nil || parsed != pt {
+			t.Error("Expect", pt, "to be registered, got", parsed, err)
+		}
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	if name := MessageTypeName(1000); name != "MessageType(1000)" {
+		t.Error("Expect MessageType(1000), got", name)
+	}
+	if _, err := ParseMessageType("Lookup"); !errors.Is(err, ErrUnknownName) {
+		t.Error("Expect", ErrUnknownName, "got", err)
+	}
+	if _, err := ParseErrorCode("ReqFailure"); !errors.Is(err, ErrUnknownName) {
+		t.Error("Expect", ErrUnknownName, "got", err)
+	}
+}
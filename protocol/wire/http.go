@@ -0,0 +1,115 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// A bufferedResponse keeps the status and body written by a handler so
+// that they can be compressed before they're sent.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// Handler wraps h so that its responses are compressed with the first of
+// codings the client accepts, unless they're smaller than
+// MinCompressedSize or don't shrink, and counts the compressed responses
+// in stats, if it isn't nil.
+func Handler(h http.Handler, codings []string, stats *Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		coding := Negotiate(r.Header.Get("Accept-Encoding"), codings)
+		if coding == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		b := &bufferedResponse{ResponseWriter: w}
+		h.ServeHTTP(b, r)
+		if b.status == 0 {
+			b.status = http.StatusOK
+		}
+		body := b.body.Bytes()
+		if len(body) >= MinCompressedSize {
+			if out, err := Compress(coding, body); err == nil && len(out) < len(body) {
+				stats.Add(len(body), len(out))
+				w.Header().Set("Content-Encoding", coding)
+				body = out
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(b.status)
+		_, _ = w.Write(body)
+	})
+}
+
+// A Transport is an http.RoundTripper for the clients of a CONIKS
+// server, which offers the server the content codings Codings, or
+// DefaultCodings if it's nil, unless the request sets Accept-Encoding
+// itself, and decompresses the responses, counting them in Stats if it
+// isn't nil. The responses of Base, or of http.DefaultTransport if it's
+// nil, carry the request.
+type Transport struct {
+	Base    http.RoundTripper
+	Codings []string
+	Stats   *Stats
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		codings := t.Codings
+		if codings == nil {
+			codings = DefaultCodings
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", AcceptEncoding(codings))
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	coding := resp.Header.Get("Content-Encoding")
+	if !known(coding) {
+		return resp, nil
+	}
+	compressed, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDecompressedSize+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body, err := Decompress(coding, compressed)
+	if err != nil {
+		return nil, err
+	}
+	t.Stats.Add(len(body), len(compressed))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Uncompressed = true
+	return resp, nil
+}
@@ -0,0 +1,228 @@
+// This module implements the compression of the HTTP framing of the
+// CONIKS protocols. Lookup, monitoring and STR history responses are
+// mostly lists of hashes, which compress well, so a server compresses
+// them with a content coding the client accepts: a Handler negotiates it
+// with the request's Accept-Encoding header, and a client's Transport
+// offers the codings it supports and decompresses the responses. zstd
+// is preferred, and gzip and deflate serve clients that lack it. Both
+// sides count the sizes of the compressed responses before and after
+// compression in Stats.
+
+package wire
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The content codings a response can be compressed with.
+const (
+	Zstd    = "zstd"
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// DefaultCodings are the content codings servers and clients use unless
+// they're configured otherwise, in order of preference.
+var DefaultCodings = []string{Zstd, Gzip, Deflate}
+
+// MinCompressedSize is the size in bytes below which responses aren't
+// compressed, since the content coding's overhead would outweigh the
+// savings.
+const MinCompressedSize = 512
+
+// MaxDecompressedSize is the size in bytes a compressed response may
+// decompress to, so that a malicious server can't exhaust the memory of
+// a client with a small response.
+const MaxDecompressedSize = 64 << 20
+
+var (
+	// ErrUnknownCoding is returned for content codings other than Zstd,
+	// Gzip and Deflate.
+	ErrUnknownCoding = errors.New("[wire] Unknown content coding")
+	// ErrTooLarge is returned by Decompress for bodies that decompress
+	// to more than MaxDecompressedSize bytes.
+	ErrTooLarge = errors.New("[wire] Decompressed body too large")
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCodec returns the zstd encoder and decoder, which are safe for
+// concurrent use with EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			panic(err)
+		}
+		zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+		if err != nil {
+			panic(err)
+		}
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+func known(coding string) bool {
+	return coding == Zstd || coding == Gzip || coding == Deflate
+}
+
+// ParseCodings parses a comma-separated list of content codings, in
+// order of preference. An empty list disables compression. It returns
+// an error wrapping ErrUnknownCoding for a coding it doesn't know.
+func ParseCodings(list string) ([]string, error) {
+	var codings []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known(name) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownCoding, name)
+		}
+		codings = append(codings, name)
+	}
+	return codings, nil
+}
+
+// AcceptEncoding returns the Accept-Encoding header of a client that
+// supports codings.
+func AcceptEncoding(codings []string) string {
+	return strings.Join(codings, ", ")
+}
+
+// Negotiate returns the first of the content codings offered that the
+// Accept-Encoding header accept allows, or "" if it allows none.
+func Negotiate(accept string, offered []string) string {
+	allowed := make(map[string]bool)
+	wildcard := false
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		if name == "*" {
+			wildcard = ok
+			continue
+		}
+		if _, seen := allowed[name]; !seen {
+			allowed[name] = ok
+		}
+	}
+	for _, name := range offered {
+		if ok, listed := allowed[name]; ok || !listed && wildcard {
+			return name
+		}
+	}
+	return ""
+}
+
+// Compress compresses body with the content coding coding.
+func Compress(coding string, body []byte) ([]byte, error) {
+	var w io.WriteCloser
+	var out bytes.Buffer
+	switch coding {
+	case Zstd:
+		enc, _ := zstdCodec()
+		return enc.EncodeAll(body, nil), nil
+	case Gzip:
+		w, _ = gzip.NewWriterLevel(&out, gzip.BestSpeed)
+	case Deflate:
+		w, _ = flate.NewWriter(&out, flate.BestSpeed)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCoding, coding)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Decompress decompresses body, which is compressed with the content
+// coding coding. It returns ErrTooLarge if body decompresses to more than
+// MaxDecompressedSize bytes.
+func Decompress(coding string, body []byte) ([]byte, error) {
+	var r io.Reader
+	switch coding {
+	case Zstd:
+		_, dec := zstdCodec()
+		out, err := dec.DecodeAll(body, nil)
+		if err == zstd.ErrDecoderSizeExceeded {
+			return nil, ErrTooLarge
+		}
+		return out, err
+	case Gzip:
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case Deflate:
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		r = fr
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCoding, coding)
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxDecompressedSize {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
+
+// Stats counts the compressed responses and their sizes in bytes before
+// and after compression. It's safe for concurrent use.
+type Stats struct {
+	Responses    uint64
+	Uncompressed uint64
+	Compressed   uint64
+}
+
+// Add counts a response of uncompressed bytes compressed to compressed.
+func (s *Stats) Add(uncompressed, compressed int) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.Responses, 1)
+	atomic.AddUint64(&s.Uncompressed, uint64(uncompressed))
+	atomic.AddUint64(&s.Compressed, uint64(compressed))
+}
+
+// Load returns a copy of s.
+func (s *Stats) Load() Stats {
+	return Stats{
+		Responses:    atomic.LoadUint64(&s.Responses),
+		Uncompressed: atomic.LoadUint64(&s.Uncompressed),
+		Compressed:   atomic.LoadUint64(&s.Compressed),
+	}
+}
@@ -0,0 +1,158 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	offered := []string{Zstd, Gzip, Deflate}
+	for _, tc := range []struct {
+		accept, want string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, zstd", "zstd"},
+		{"deflate, gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"zstd;q=0, gzip;q=0, deflate", "deflate"},
+		{"GZIP;q=0.5", "gzip"},
+		{"*", "zstd"},
+		{"*, zstd;q=0", "gzip"},
+		{"*;q=0", ""},
+		{"br", ""},
+	} {
+		if got := Negotiate(tc.accept, offered); got != tc.want {
+			t.Errorf("Negotiate(%q): expect %q, got %q", tc.accept, tc.want, got)
+		}
+	}
+	if got := Negotiate("gzip", nil); got != "" {
+		t.Errorf("Expect no coding without codings offered, got %q", got)
+	}
+}
+
+func TestParseCodings(t *testing.T) {
+	if codings, err := ParseCodings(" zstd,gzip "); err != nil || len(codings) != 2 || codings[0] != Zstd {
+		t.Errorf("Unexpected codings %v, error %v", codings, err)
+	}
+	if codings, err := ParseCodings(""); err != nil || len(codings) != 0 {
+		t.Errorf("Expect no codings, got %v, error %v", codings, err)
+	}
+	if _, err := ParseCodings("gzip,br"); !errors.Is(err, ErrUnknownCoding) {
+		t.Error("Expect", ErrUnknownCoding, "got", err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	for _, coding := range DefaultCodings {
+		out, err := Compress(coding, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) >= len(body) {
+			t.Errorf("%s: expect compression to shrink %d bytes, got %d", coding, len(body), len(out))
+		}
+		got, err := Decompress(coding, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%s: expect the decompressed body to equal the original", coding)
+		}
+	}
+	if _, err := Compress("br", body); !errors.Is(err, ErrUnknownCoding) {
+		t.Error("Expect", ErrUnknownCoding, "got", err)
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	bomb := make([]byte, MaxDecompressedSize+1)
+	for _, coding := range DefaultCodings {
+		out, err := Compress(coding, bomb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Decompress(coding, out); err != ErrTooLarge {
+			t.Error(coding, "Expect", ErrTooLarge, "got", err)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	var served Stats
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			_, _ = w.Write([]byte("small"))
+			return
+		}
+		_, _ = w.Write(large)
+	}), DefaultCodings, &served))
+	defer srv.Close()
+
+	for _, coding := range DefaultCodings {
+		var received Stats
+		client := &http.Client{Transport: &Transport{Codings: []string{coding}, Stats: &received}}
+		var encoding string
+		client.Transport.(*Transport).Base = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if accept := req.Header.Get("Accept-Encoding"); accept != coding {
+				t.Errorf("Expect Accept-Encoding %q, got %q", coding, accept)
+			}
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err == nil {
+				encoding = resp.Header.Get("Content-Encoding")
+			}
+			return resp, err
+		})
+		resp, err := client.Get(srv.URL + "/large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding != coding {
+			t.Errorf("Expect a %s-compressed response, got %q", coding, encoding)
+		}
+		if !bytes.Equal(body, large) {
+			t.Errorf("%s: expect the decompressed response to equal the original", coding)
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("Expect the Content-Encoding to be removed, got %q", enc)
+		}
+		if got := received.Load(); got.Responses != 1 || got.Uncompressed != uint64(len(large)) ||
+			got.Compressed == 0 || got.Compressed >= got.Uncompressed {
+			t.Errorf("%s: unexpected stats %+v", coding, got)
+		}
+	}
+	if got := served.Load(); got.Responses != uint64(len(DefaultCodings)) {
+		t.Error("Expect", len(DefaultCodings), "compressed responses, got", got.Responses)
+	}
+
+	resp, err := (&http.Client{Transport: &Transport{}}).Get(srv.URL + "/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "small" {
+		t.Errorf("Expect %q, got %q", "small", body)
+	}
+	if got := served.Load(); got.Responses != uint64(len(DefaultCodings)) {
+		t.Error("Expect small responses to be uncompressed")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}